@@ -0,0 +1,179 @@
+package irma
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// AttributeFormat specifies, in the description.xml of a credential type, the format that values
+// of an attribute type must have, e.g.:
+//
+//	<Attribute id="dateofbirth">
+//	  ...
+//	  <Format type="date" canonicalize="trim" />
+//	</Attribute>
+//
+// Values are first canonicalized (see Canonicalize()), after which they must satisfy the type and
+// the pattern of the format, if present. IRMA servers canonicalize and validate attribute values
+// before issuing them, and the irmaclient does not disclose values not satisfying the format.
+type AttributeFormat struct {
+	// One of the AttributeFormatType constants, or empty
+	Type AttributeFormatType `xml:"type,attr" json:",omitempty"`
+	// Comma-separated list of canonicalization rules (see AttributeCanonicalization constants),
+	// applied in the specified order
+	Canonicalization string `xml:"canonicalize,attr" json:",omitempty"`
+	// Regular expression that canonicalized values must match entirely
+	Pattern string `xml:"Pattern" json:",omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+// AttributeFormatType is a predefined format of attribute values.
+type AttributeFormatType string
+
+// AttributeCanonicalization is a rule that transforms attribute values into their canonical form.
+type AttributeCanonicalization string
+
+const (
+	// AttributeFormatDate: dates of the form YYYY-MM-DD
+	AttributeFormatDate = AttributeFormatType("date")
+	// AttributeFormatPhone: phone numbers in international format (E.164), e.g. +31612345678;
+	// spaces, dashes, dots and parentheses are removed when canonicalizing
+	AttributeFormatPhone = AttributeFormatType("phone")
+	// AttributeFormatEmail: email addresses, which are lowercased when canonicalizing
+	AttributeFormatEmail = AttributeFormatType("email")
+	// AttributeFormatInteger: integers without leading zeroes
+	AttributeFormatInteger = AttributeFormatType("integer")
+
+	// AttributeCanonicalizeTrim removes leading and trailing whitespace
+	AttributeCanonicalizeTrim = AttributeCanonicalization("trim")
+	// AttributeCanonicalizeLowercase converts values to lowercase
+	AttributeCanonicalizeLowercase = AttributeCanonicalization("lowercase")
+	// AttributeCanonicalizeUppercase converts values to uppercase
+	AttributeCanonicalizeUppercase = AttributeCanonicalization("uppercase")
+	// AttributeCanonicalizeCollapseSpaces replaces each sequence of whitespace by a single space
+	AttributeCanonicalizeCollapseSpaces = AttributeCanonicalization("collapsespaces")
+)
+
+var (
+	attributePhoneRegexp     = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	attributeEmailRegexp     = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	attributeIntegerRegexp   = regexp.MustCompile(`^(0|-?[1-9][0-9]*)$`)
+	attributePhoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+)
+
+// parse checks the format, and compiles its pattern.
+func (f *AttributeFormat) parse() error {
+	switch f.Type {
+	case "", AttributeFormatDate, AttributeFormatPhone, AttributeFormatEmail, AttributeFormatInteger:
+	default:
+		return errors.Errorf("unknown attribute format type %s", f.Type)
+	}
+	for _, rule := range f.rules() {
+		switch rule {
+		case AttributeCanonicalizeTrim, AttributeCanonicalizeLowercase,
+			AttributeCanonicalizeUppercase, AttributeCanonicalizeCollapseSpaces:
+		default:
+			return errors.Errorf("unknown attribute canonicalization %s", rule)
+		}
+	}
+	if f.Pattern != "" {
+		r, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+		if err != nil {
+			return errors.WrapPrefix(err, "invalid attribute format pattern", 0)
+		}
+		f.regexp = r
+	}
+	return nil
+}
+
+func (f *AttributeFormat) rules() []AttributeCanonicalization {
+	var rules []AttributeCanonicalization
+	for _, rule := range strings.Split(f.Canonicalization, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, AttributeCanonicalization(rule))
+		}
+	}
+	return rules
+}
+
+// Canonicalize returns the canonical form of the specified value: first the canonicalization
+// rules of the format are applied, and then the canonicalization implied by its type, if any.
+func (f *AttributeFormat) Canonicalize(value string) string {
+	for _, rule := range f.rules() {
+		switch rule {
+		case AttributeCanonicalizeTrim:
+			value = strings.TrimSpace(value)
+		case AttributeCanonicalizeLowercase:
+			value = strings.ToLower(value)
+		case AttributeCanonicalizeUppercase:
+			value = strings.ToUpper(value)
+		case AttributeCanonicalizeCollapseSpaces:
+			value = strings.Join(strings.Fields(value), " ")
+		}
+	}
+	switch f.Type {
+	case AttributeFormatPhone:
+		value = attributePhoneSeparators.Replace(value)
+		if strings.HasPrefix(value, "00") {
+			value = "+" + value[2:]
+		}
+	case AttributeFormatEmail:
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// Validate checks that the specified (canonical) value satisfies the format.
+func (f *AttributeFormat) Validate(value string) error {
+	var valid bool
+	switch f.Type {
+	case AttributeFormatDate:
+		_, err := time.Parse("2006-01-02", value)
+		valid = err == nil
+	case AttributeFormatPhone:
+		valid = attributePhoneRegexp.MatchString(value)
+	case AttributeFormatEmail:
+		valid = attributeEmailRegexp.MatchString(value)
+	case AttributeFormatInteger:
+		valid = attributeIntegerRegexp.MatchString(value)
+	default:
+		valid = true
+	}
+	if !valid {
+		return errors.Errorf("value is not a valid %s", f.Type)
+	}
+	if f.regexp != nil && !f.regexp.MatchString(value) {
+		return errors.Errorf("value does not match pattern %s", f.Pattern)
+	}
+	return nil
+}
+
+// AttributeFormat returns the format of the specified attribute type, or nil if the attribute
+// type is unknown or has no format.
+func (conf *Configuration) AttributeFormat(id AttributeTypeIdentifier) *AttributeFormat {
+	attr := conf.AttributeTypes[id]
+	if attr == nil {
+		return nil
+	}
+	return attr.Format
+}
+
+// CanonicalAttributeValue returns the canonical form of the specified value of the specified
+// attribute type, or an error if it does not satisfy the format of the attribute type.
+// Values of attribute types without a format are returned unmodified.
+func (conf *Configuration) CanonicalAttributeValue(id AttributeTypeIdentifier, value string) (string, error) {
+	format := conf.AttributeFormat(id)
+	if format == nil {
+		return value, nil
+	}
+	value = format.Canonicalize(value)
+	if err := format.Validate(value); err != nil {
+		return "", errors.WrapPrefix(err, fmt.Sprintf("invalid value of attribute %s:", id), 0)
+	}
+	return value, nil
+}
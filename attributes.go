@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -26,6 +27,22 @@ var (
 	credentialID     = metadataField{16, 8}
 )
 
+// bigIntPool contains scratch integers, to reduce allocations in code that is executed for each
+// verified attribute. Integers must be returned to it using putBigInt().
+var bigIntPool = sync.Pool{New: func() interface{} { return new(big.Int) }}
+
+// putBigInt returns the scratch integer to bigIntPool, after zeroing it (including its unused
+// capacity) so that the attribute values it contained do not linger in the pool.
+func putBigInt(bi *big.Int) {
+	words := bi.Bits()
+	words = words[:cap(words)]
+	for i := range words {
+		words[i] = 0
+	}
+	bi.SetInt64(0)
+	bigIntPool.Put(bi)
+}
+
 // metadataField contains the length and offset of a field within a metadata attribute.
 type metadataField struct {
 	length int
@@ -58,13 +75,48 @@ func NewAttributeListFromInts(ints []*big.Int, conf *Configuration) *AttributeLi
 	}
 }
 
+// Info returns information of the credential. For orphaned credentials (see Orphaned()), the
+// returned CredentialInfo contains only the raw attribute values.
 func (al *AttributeList) Info() *CredentialInfo {
-	if al.info == nil {
-		al.info = NewCredentialInfo(al.Ints, al.Conf)
+	// The credential may have become orphaned since we cached its info, due to a scheme update
+	if orphaned := al.Orphaned(); al.info == nil || al.info.Orphaned != orphaned {
+		if orphaned {
+			al.info = al.orphanedInfo()
+		} else {
+			al.info = NewCredentialInfo(al.Ints, al.Conf)
+		}
 	}
 	return al.info
 }
 
+// Orphaned returns whether the credential type of the credential was removed from its scheme, or
+// changed such that it has fewer attributes than the credential. (Credential types may gain new
+// attributes, which credentials issued before the change then simply lack.) The attributes of
+// orphaned credentials cannot be interpreted using their credential type, and they cannot be
+// disclosed.
+func (al *AttributeList) Orphaned() bool {
+	credtype := al.CredentialType()
+	return credtype == nil || len(credtype.AttributeTypes) < len(al.Ints)-1
+}
+
+func (al *AttributeList) orphanedInfo() *CredentialInfo {
+	info := &CredentialInfo{
+		SignedOn:      Timestamp(al.SigningDate()),
+		Expires:       Timestamp(al.Expiry()),
+		Hash:          al.Hash(),
+		Orphaned:      true,
+		RawAttributes: al.Strings(),
+	}
+	if credtype := al.CredentialType(); credtype != nil {
+		id := credtype.Identifier()
+		issid := id.IssuerIdentifier()
+		info.ID = id.Name()
+		info.IssuerID = issid.Name()
+		info.SchemeManagerID = issid.SchemeManagerIdentifier().Name()
+	}
+	return info
+}
+
 func (al *AttributeList) Hash() string {
 	if al.h == "" {
 		bytes := []byte{}
@@ -125,13 +177,16 @@ func (al *AttributeList) decode(i int) *string {
 
 // Decode attribute value into string according to metadataVersion
 func decodeAttribute(attr *big.Int, metadataVersion byte) *string {
-	bi := new(big.Int).Set(attr)
-	if metadataVersion >= 3 {
-		if bi.Bit(0) == 0 { // attribute does not exist
-			return nil
-		}
-		bi.Rsh(bi, 1)
+	if metadataVersion < 3 {
+		str := string(attr.Bytes())
+		return &str
 	}
+	if attr.Bit(0) == 0 { // attribute does not exist
+		return nil
+	}
+	bi := bigIntPool.Get().(*big.Int)
+	defer putBigInt(bi)
+	bi.Rsh(attr, 1)
 	str := string(bi.Bytes())
 	return &str
 }
@@ -187,7 +242,9 @@ func NewMetadataAttribute(version byte) *MetadataAttribute {
 func (attr *MetadataAttribute) Bytes() []byte {
 	bytes := attr.Int.Bytes()
 	if len(bytes) < metadataLength {
-		bytes = append(bytes, make([]byte, metadataLength-len(bytes))...)
+		padded := make([]byte, metadataLength)
+		copy(padded, bytes)
+		return padded
 	}
 	return bytes
 }
@@ -219,7 +276,7 @@ func (attr *MetadataAttribute) SigningDate() time.Time {
 }
 
 func (attr *MetadataAttribute) setSigningDate() {
-	attr.setField(signingDateField, shortToByte(int(time.Now().Unix()/ExpiryFactor)))
+	attr.setField(signingDateField, shortToByte(int(Now().Unix()/ExpiryFactor)))
 }
 
 // KeyCounter return the public key counter of the metadata attribute
@@ -247,7 +304,7 @@ func (attr *MetadataAttribute) setDefaultValidityDuration() {
 func (attr *MetadataAttribute) setExpiryDate(timestamp *Timestamp) error {
 	var expiry int64
 	if timestamp == nil {
-		expiry = time.Now().AddDate(0, 6, 0).Unix()
+		expiry = Now().AddDate(0, 6, 0).Unix()
 	} else {
 		expiry = time.Time(*timestamp).Unix()
 	}
@@ -284,7 +341,19 @@ func (attr *MetadataAttribute) IsValidOn(t time.Time) bool {
 
 // IsValid returns whether this instance is valid.
 func (attr *MetadataAttribute) IsValid() bool {
-	return attr.IsValidOn(time.Now())
+	return attr.IsValidOn(Now())
+}
+
+// ExpiredAt returns whether this instance had expired at the given time, allowing for the
+// specified grace period after the expiry date during which it is still accepted.
+func (attr *MetadataAttribute) ExpiredAt(t time.Time, grace time.Duration) bool {
+	return attr.Expiry().Add(grace).Before(t)
+}
+
+// ExpiresWithin returns whether this instance is valid now, but expires within the given duration.
+func (attr *MetadataAttribute) ExpiresWithin(d time.Duration) bool {
+	now := Now()
+	return attr.IsValidOn(now) && !attr.IsValidOn(now.Add(d))
 }
 
 // FloorToEpochBoundary returns the greatest time not greater than the argument
@@ -337,9 +406,13 @@ type DisclosureChoice struct {
 // An AttributeDisjunction encapsulates a list of possible attributes, one
 // of which should be disclosed.
 type AttributeDisjunction struct {
-	Label      string
+	// Label is shown to the user to describe the disjunction. Labels that were specified
+	// as a plain string in the request contain that string for each supported language.
+	Label      TranslatedString
 	Attributes []AttributeTypeIdentifier
 	Values     map[AttributeTypeIdentifier]*string
+	// Reason (optional) explains to the user for what purpose the requestor asks for this disjunction
+	Reason TranslatedString
 
 	selected *AttributeTypeIdentifier
 	value    *string
@@ -427,21 +500,25 @@ func (dl AttributeDisjunctionList) Find(ai AttributeTypeIdentifier) *AttributeDi
 func (disjunction *AttributeDisjunction) MarshalJSON() ([]byte, error) {
 	if !disjunction.HasValues() {
 		temp := struct {
-			Label      string                    `json:"label"`
+			Label      interface{}               `json:"label"`
 			Attributes []AttributeTypeIdentifier `json:"attributes"`
+			Reason     TranslatedString          `json:"reason,omitempty"`
 		}{
-			Label:      disjunction.Label,
+			Label:      marshalLabel(disjunction.Label),
 			Attributes: disjunction.Attributes,
+			Reason:     disjunction.Reason,
 		}
 		return json.Marshal(temp)
 	}
 
 	temp := struct {
-		Label      string                              `json:"label"`
+		Label      interface{}                         `json:"label"`
 		Attributes map[AttributeTypeIdentifier]*string `json:"attributes"`
+		Reason     TranslatedString                    `json:"reason,omitempty"`
 	}{
-		Label:      disjunction.Label,
+		Label:      marshalLabel(disjunction.Label),
 		Attributes: disjunction.Values,
+		Reason:     disjunction.Reason,
 	}
 	return json.Marshal(temp)
 }
@@ -459,18 +536,23 @@ func (disjunction *AttributeDisjunction) UnmarshalJSON(bytes []byte) error {
 	// So we unmarshal it into a temporary struct that has interface{} as the
 	// type of "attributes", so that we can check which of the two it is.
 	temp := struct {
-		Label      string      `json:"label"`
-		Attributes interface{} `json:"attributes"`
+		Label      json.RawMessage  `json:"label"`
+		Attributes interface{}      `json:"attributes"`
+		Reason     TranslatedString `json:"reason"`
 	}{}
 	if err := json.Unmarshal(bytes, &temp); err != nil {
 		return err
 	}
-	disjunction.Label = temp.Label
+	label, err := unmarshalLabel(temp.Label)
+	if err != nil {
+		return err
+	}
+	disjunction.Label = label
+	disjunction.Reason = temp.Reason
 
 	switch temp.Attributes.(type) {
 	case map[string]interface{}:
 		temp := struct {
-			Label      string             `json:"label"`
 			Attributes map[string]*string `json:"attributes"`
 		}{}
 		if err := json.Unmarshal(bytes, &temp); err != nil {
@@ -483,7 +565,6 @@ func (disjunction *AttributeDisjunction) UnmarshalJSON(bytes []byte) error {
 		}
 	case []interface{}:
 		temp := struct {
-			Label      string   `json:"label"`
 			Attributes []string `json:"attributes"`
 		}{}
 		if err := json.Unmarshal(bytes, &temp); err != nil {
@@ -498,3 +579,51 @@ func (disjunction *AttributeDisjunction) UnmarshalJSON(bytes []byte) error {
 
 	return nil
 }
+
+// NewLabel returns a disjunction label containing the specified untranslated text for each supported language.
+func NewLabel(text string) TranslatedString {
+	return NewTranslatedString(&text)
+}
+
+// untranslatedLabel returns whether the label was created from a plain string by NewLabel().
+func untranslatedLabel(label TranslatedString) bool {
+	raw, ok := label[""]
+	if !ok {
+		return false
+	}
+	for _, text := range label {
+		if text != raw {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalLabel returns the label as a plain string if it is untranslated,
+// so that requests with plain string labels remain unchanged when marshaled.
+func marshalLabel(label TranslatedString) interface{} {
+	if label == nil {
+		return ""
+	}
+	if untranslatedLabel(label) {
+		return label[""]
+	}
+	return label
+}
+
+// unmarshalLabel parses a disjunction label, which is either a TranslatedString
+// or (in older requests) a plain string.
+func unmarshalLabel(bts json.RawMessage) (TranslatedString, error) {
+	if len(bts) == 0 || string(bts) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(bts, &text); err == nil {
+		return NewLabel(text), nil
+	}
+	var label TranslatedString
+	if err := json.Unmarshal(bts, &label); err != nil {
+		return nil, errors.New("could not parse attribute disjunction: element 'label' was incorrect")
+	}
+	return label, nil
+}
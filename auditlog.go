@@ -0,0 +1,211 @@
+package irma
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+)
+
+// AuditLog records each use of an issuer private key and of a keyshare server public key as an
+// AuditEvent, so that key usage can be demonstrated afterwards, e.g. to compliance auditors. The
+// events are written to a pluggable AuditSink; each event contains the hash of its predecessor,
+// so that modification, insertion or removal of events can be detected (see VerifyAuditEvents()).
+//
+// The audit log of a Configuration is obtained with Configuration.AuditLog(). Until a sink is set
+// using SetSink(), nothing is recorded. An AuditLog is safe for concurrent use.
+type AuditLog struct {
+	mutex sync.Mutex
+	sink  AuditSink
+	last  *AuditEvent
+}
+
+// AuditSink stores audit events. Sinks should only ever append events, never modify or remove them.
+type AuditSink interface {
+	// Write appends the event to the sink.
+	Write(event *AuditEvent) error
+	// Last returns the event that was written last to the sink, or nil if the sink is empty,
+	// so that the AuditLog can continue the hash chain of earlier events.
+	Last() (*AuditEvent, error)
+}
+
+// AuditEventType is the type of an AuditEvent.
+type AuditEventType string
+
+const (
+	// AuditEventIssuance is recorded when an issuer private key is used to issue a credential,
+	// i.e., to compute its CL signature and the proof of correctness of the signature.
+	AuditEventIssuance = AuditEventType("ISSUANCE")
+	// AuditEventIssuanceCondition is recorded when the issuance condition of an IRMA server (see
+	// server.IssuanceCondition) approves, modifies or vetoes the issuance of a credential.
+	AuditEventIssuanceCondition = AuditEventType("ISSUANCE_CONDITION")
+	// AuditEventKeyshareVerification is recorded when a keyshare server public key is used to
+	// verify a JWT from the keyshare server.
+	AuditEventKeyshareVerification = AuditEventType("KEYSHARE_VERIFICATION")
+)
+
+// AuditEvent records a single use of a key.
+type AuditEvent struct {
+	Sequence uint64         `json:"sequence"` // Number of the event, starting at 1
+	Time     Timestamp      `json:"time"`
+	Type     AuditEventType `json:"type"`
+	Key      string         `json:"key"`                // Identifier of the key, e.g. irma-demo.MijnOverheid-2
+	Subject  string         `json:"subject,omitempty"`  // What the key was used for, e.g. the issued credential type
+	Previous []byte         `json:"previous,omitempty"` // Hash of the preceding event
+	Hash     []byte         `json:"hash"`               // Hash over this event, including Previous
+}
+
+// AuditFileSink is an AuditSink appending the events as lines of JSON to a file.
+type AuditFileSink struct {
+	path string
+}
+
+// NewAuditFileSink returns an AuditSink appending to the specified file, which is created
+// if it does not exist.
+func NewAuditFileSink(path string) *AuditFileSink {
+	return &AuditFileSink{path: path}
+}
+
+// AuditLog returns the audit log in which the uses of keys of this Configuration are recorded.
+func (conf *Configuration) AuditLog() *AuditLog {
+	return conf.auditLog
+}
+
+// SetSink sets the sink to which subsequent events are written, continuing the hash chain of the
+// events already present in the sink. If sink is nil, events are no longer recorded.
+func (log *AuditLog) SetSink(sink AuditSink) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	var last *AuditEvent
+	if sink != nil {
+		var err error
+		if last, err = sink.Last(); err != nil {
+			return errors.WrapPrefix(err, "failed to read last audit event", 0)
+		}
+	}
+	log.sink, log.last = sink, last
+	return nil
+}
+
+// Record writes a new event of the specified type to the sink, if any. Callers should abort
+// using the key if this returns an error, so that no key use goes unrecorded.
+func (log *AuditLog) Record(typ AuditEventType, key, subject string) error {
+	if log == nil {
+		return nil
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.sink == nil {
+		return nil
+	}
+
+	event := &AuditEvent{Sequence: 1, Time: Timestamp(Now()), Type: typ, Key: key, Subject: subject}
+	if log.last != nil {
+		event.Sequence = log.last.Sequence + 1
+		event.Previous = log.last.Hash
+	}
+	var err error
+	if event.Hash, err = event.computeHash(); err != nil {
+		return err
+	}
+	if err = log.sink.Write(event); err != nil {
+		return errors.WrapPrefix(err, "failed to write audit event", 0)
+	}
+	log.last = event
+	return nil
+}
+
+// computeHash computes the SHA256 hash over the JSON of the event excluding its Hash field.
+func (event *AuditEvent) computeHash() ([]byte, error) {
+	e := *event
+	e.Hash = nil
+	bts, err := json.Marshal(&e)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bts)
+	return hash[:], nil
+}
+
+// VerifyAuditEvents checks that the events, in the order in which they were recorded, are
+// numbered consecutively, that each event matches its hash and that each event contains the
+// hash of its predecessor. Note that removal of events at the end cannot be detected this way.
+func VerifyAuditEvents(events []*AuditEvent) error {
+	for i, event := range events {
+		hash, err := event.computeHash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, event.Hash) {
+			return errors.Errorf("audit event %d was modified", event.Sequence)
+		}
+		if i == 0 {
+			continue
+		}
+		if event.Sequence != events[i-1].Sequence+1 || !bytes.Equal(event.Previous, events[i-1].Hash) {
+			return errors.Errorf("audit events before event %d were removed, inserted or modified", event.Sequence)
+		}
+	}
+	return nil
+}
+
+// Events reads all events from the file.
+func (sink *AuditFileSink) Events() ([]*AuditEvent, error) {
+	file, err := os.Open(sink.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []*AuditEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		event := &AuditEvent{}
+		if err = json.Unmarshal(scanner.Bytes(), event); err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("%s:%d", sink.path, line), 0)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+func (sink *AuditFileSink) Last() (*AuditEvent, error) {
+	events, err := sink.Events()
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[len(events)-1], nil
+}
+
+func (sink *AuditFileSink) Write(event *AuditEvent) error {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(bts, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,127 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// SchemeList is a document, signed by its publisher, listing the schemes that a deployment should
+// install along with the fingerprints of their public keys. A fresh Configuration can be bootstrapped
+// from a scheme list using BootstrapSchemes(), so that apps and servers need to ship only the URL of
+// the list and the public key of its publisher instead of the schemes themselves.
+//
+// The list is served as JSON; the ASN.1-encoded ECDSA signature over it (see SignSchemeList()) is
+// served at the same URL suffixed with ".sig".
+type SchemeList struct {
+	Schemes []*SchemeListEntry `json:"schemes"`
+}
+
+// SchemeListEntry points to a scheme in a SchemeList.
+type SchemeListEntry struct {
+	ID  SchemeManagerIdentifier `json:"id"`
+	URL string                  `json:"url"`
+	// Fingerprint of the public key of the scheme (see SchemeKeyFingerprint()), against which
+	// the public key is verified after it has been downloaded
+	PublicKeyFingerprint string `json:"pk_fingerprint"`
+	// Whether or not this is a demo scheme; if true, private keys are also downloaded
+	Demo bool `json:"demo,omitempty"`
+}
+
+// SignSchemeList signs the JSON of a scheme list using the specified private key.
+func SignSchemeList(list []byte, sk *ecdsa.PrivateKey) ([]byte, error) {
+	return SignSchemeIndex(list, sk)
+}
+
+// DownloadSchemeList downloads the scheme list at the specified URL, and verifies its
+// signature against the public key of its publisher.
+func DownloadSchemeList(url string, pk *ecdsa.PublicKey) (*SchemeList, error) {
+	transport := NewHTTPTransport("")
+	bts, err := transport.GetBytes(url)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := transport.GetBytes(url + ".sig")
+	if err != nil {
+		return nil, configurationError(ErrMissingSignature, err, "failed to download scheme list signature")
+	}
+	if err = VerifySchemeIndexSignature(bts, sig, pk); err != nil {
+		return nil, errors.WrapPrefix(err, "scheme list signature invalid", 0)
+	}
+
+	list := &SchemeList{}
+	if err = json.Unmarshal(bts, list); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse scheme list", 0)
+	}
+	for _, entry := range list.Schemes {
+		if entry.ID.String() == "" || entry.URL == "" || entry.PublicKeyFingerprint == "" {
+			return nil, errors.New("scheme list contains incomplete entry")
+		}
+	}
+	return list, nil
+}
+
+// BootstrapSchemes downloads the scheme list at the specified URL, verifying it against the public
+// key of its publisher, and installs the listed schemes that are not already installed. The public
+// key of each scheme is verified against its fingerprint in the list before it is trusted.
+func (conf *Configuration) BootstrapSchemes(url string, pk *ecdsa.PublicKey) error {
+	if err := conf.writable("bootstrap schemes"); err != nil {
+		return err
+	}
+	Logger.Infof("Bootstrapping schemes from %s", url)
+	list, err := DownloadSchemeList(url, pk)
+	if err != nil {
+		return err
+	}
+	for _, entry := range list.Schemes {
+		if _, installed := conf.SchemeManagers[entry.ID]; installed {
+			Logger.Debugf("Scheme %s already installed, skipping", entry.ID)
+			continue
+		}
+		if err = conf.bootstrapScheme(entry); err != nil {
+			return err
+		}
+	}
+	Logger.Info("Finished bootstrapping schemes")
+	return nil
+}
+
+func (conf *Configuration) bootstrapScheme(entry *SchemeListEntry) error {
+	Logger.Debugf("Downloading scheme %s at %s", entry.ID, entry.URL)
+	scheme, err := DownloadSchemeManager(entry.URL)
+	if err != nil {
+		return err
+	}
+	if scheme.Identifier() != entry.ID {
+		return configurationError(ErrInvalidScheme, nil,
+			fmt.Sprintf("scheme at %s is %s instead of %s", entry.URL, scheme.ID, entry.ID))
+	}
+
+	pkbts, err := NewHTTPTransport(scheme.URL).GetBytes("pk.pem")
+	if err != nil {
+		return err
+	}
+	schemepk, err := ParsePemEcdsaPublicKey(pkbts)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := SchemeKeyFingerprint(schemepk)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(fingerprint, entry.PublicKeyFingerprint) {
+		return configurationError(ErrInvalidKey, nil,
+			fmt.Sprintf("public key of scheme %s does not match fingerprint %s", entry.ID, entry.PublicKeyFingerprint))
+	}
+
+	if err = conf.InstallSchemeManager(scheme, pkbts); err != nil {
+		return err
+	}
+	if entry.Demo {
+		return conf.downloadPrivateKeys(scheme)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package irma
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time. The logic in irmago concerning the expiry of credentials and
+// keys and the validity of timestamps obtains the current time from the Clock set using
+// SetClock(), by default the system clock, so that tests can simulate the passing of time.
+type Clock interface {
+	Now() time.Time
+}
+
+// OffsetClock is a Clock running the specified duration ahead of the system clock
+// (or behind it, if negative).
+type OffsetClock time.Duration
+
+// FixedClock is a Clock that is stopped at the specified time.
+type FixedClock time.Time
+
+type systemClock struct{}
+
+var (
+	clock      Clock = systemClock{}
+	clockMutex sync.RWMutex
+)
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c OffsetClock) Now() time.Time {
+	return time.Now().Add(time.Duration(c))
+}
+
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// SetClock sets the Clock used by irmago, returning the previous one. If c is nil the system
+// clock is used.
+func SetClock(c Clock) Clock {
+	if c == nil {
+		c = systemClock{}
+	}
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+	previous := clock
+	clock = c
+	return previous
+}
+
+// Now returns the current time according to the Clock set using SetClock().
+func Now() time.Time {
+	clockMutex.RLock()
+	defer clockMutex.RUnlock()
+	return clock.Now()
+}
@@ -0,0 +1,162 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-errors/errors"
+)
+
+// Parsing a scheme involves verifying the hash of each of its files against the scheme index,
+// and parsing the XML descriptions of all of its issuers and credential types. As this is slow
+// on mobile devices, the result is cached per scheme in a gob-encoded file in the scheme folder.
+// The cache is bound to the scheme index and its signature (which are still verified on each
+// parse), and to the size and modification time of each of the files in the index, so that
+// it is invalidated when the scheme is updated or any of its files is modified.
+
+const (
+	schemeCacheFilename = ".cache"
+	schemeCacheVersion  = 4
+)
+
+// schemeCache contains the parsed contents of a scheme.
+type schemeCache struct {
+	Version         int
+	Key             []byte
+	Issuers         []*Issuer
+	CredentialTypes []*CredentialType
+	Validation      []*ValidationEntry
+
+	// gob does not distinguish nil pointers from pointers to zero values,
+	// so AttributeType.DisplayIndex is stored separately
+	DisplayIndices map[string]int
+}
+
+// schemeCacheKey computes the key that a cache of the specified scheme must contain to be
+// applicable: a hash over the index, its signature, the scheme public key, and the size and
+// modification time of the files in the index.
+func (conf *Configuration) schemeCacheKey(manager *SchemeManager) ([]byte, error) {
+	h := sha256.New()
+	dir := filepath.Join(conf.Path, manager.ID)
+	for _, file := range []string{"index", "index.sig", "pk.pem"} {
+		bts, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(bts)
+		h.Write(sum[:])
+	}
+
+	files := make([]string, 0, len(manager.index))
+	for file := range manager.index {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		h.Write([]byte(file))
+		info, err := os.Stat(filepath.Join(conf.Path, file))
+		if os.IsNotExist(err) {
+			h.Write([]byte{0})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte{1})
+		_ = binary.Write(h, binary.BigEndian, info.Size())
+		_ = binary.Write(h, binary.BigEndian, info.ModTime().UnixNano())
+	}
+
+	return h.Sum(nil), nil
+}
+
+// readSchemeCache returns the cache of the specified scheme if it exists and matches the key,
+// and nil otherwise.
+func (conf *Configuration) readSchemeCache(manager *SchemeManager, key []byte) *schemeCache {
+	bts, err := ioutil.ReadFile(filepath.Join(conf.Path, manager.ID, schemeCacheFilename))
+	if err != nil {
+		return nil
+	}
+	cache := &schemeCache{}
+	if err = gob.NewDecoder(bytes.NewReader(bts)).Decode(cache); err != nil {
+		Logger.WithField("scheme", manager.ID).Warn("Ignoring invalid scheme cache: ", err.Error())
+		return nil
+	}
+	if cache.Version != schemeCacheVersion || !bytes.Equal(cache.Key, key) {
+		return nil
+	}
+	return cache
+}
+
+// writeSchemeCache caches the issuers, credential types and validation entries of the
+// specified (just parsed) scheme. Failing to save the cache (e.g. on a read-only file system) is
+// only logged, as the scheme is then just parsed again next time; failing to encode it is returned,
+// as it means that a type that gob cannot encode was added to the scheme contents.
+func (conf *Configuration) writeSchemeCache(manager *SchemeManager, key []byte, validation []*ValidationEntry) error {
+	if conf.writable("write scheme cache") != nil {
+		return nil
+	}
+	cache := &schemeCache{
+		Version:        schemeCacheVersion,
+		Key:            key,
+		Validation:     validation,
+		DisplayIndices: map[string]int{},
+	}
+	for _, issuer := range conf.Issuers {
+		if issuer.SchemeManagerID == manager.ID {
+			cache.Issuers = append(cache.Issuers, issuer)
+		}
+	}
+	for _, cred := range conf.CredentialTypes {
+		if cred.SchemeManagerID == manager.ID {
+			cache.CredentialTypes = append(cache.CredentialTypes, cred)
+			for _, attr := range cred.AttributeTypes {
+				if attr.DisplayIndex != nil {
+					cache.DisplayIndices[attr.GetAttributeTypeIdentifier().String()] = *attr.DisplayIndex
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cache); err != nil {
+		return errors.WrapPrefix(err, "Failed to encode scheme cache", 0)
+	}
+	if err := conf.saveFile(filepath.Join(conf.Path, manager.ID, schemeCacheFilename), buf.Bytes()); err != nil {
+		Logger.WithField("scheme", manager.ID).Warn("Failed to write scheme cache: ", err.Error())
+	}
+	return nil
+}
+
+// applySchemeCache adds the issuers and credential types from the specified cache to conf,
+// and reinstates the validation entries that were found when the scheme was originally parsed.
+func (conf *Configuration) applySchemeCache(cache *schemeCache) {
+	for _, issuer := range cache.Issuers {
+		conf.Issuers[issuer.Identifier()] = issuer
+	}
+	for _, cred := range cache.CredentialTypes {
+		credid := cred.Identifier()
+		conf.CredentialTypes[credid] = cred
+		conf.addReverseHash(credid)
+		for _, attr := range cred.AttributeTypes {
+			attrid := attr.GetAttributeTypeIdentifier()
+			attr.DisplayIndex = nil
+			if i, ok := cache.DisplayIndices[attrid.String()]; ok {
+				attr.DisplayIndex = &i
+			}
+			if attr.Format != nil {
+				_ = attr.Format.parse() // already checked when the scheme was originally parsed
+			}
+			conf.AttributeTypes[attrid] = attr
+		}
+	}
+	for _, entry := range cache.Validation {
+		conf.warn(entry.Severity, entry.Code, entry.Identifier, "%s", entry.Message)
+	}
+}
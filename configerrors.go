@@ -0,0 +1,82 @@
+package irma
+
+// Failures of Configuration methods are reported using a *ConfigurationError, whose kind
+// indicates the failure mode, so that applications can check for them using errors.Is(), e.g.
+//   if errors.Is(err, irma.ErrHashMismatch) { ... }
+// and using errors.As() to obtain the details of the failure. Failures of a scheme as a whole
+// are additionally wrapped in a *SchemeManagerError, and attempts to modify the storage of a
+// read-only Configuration fail with an *ErrReadOnly.
+
+// ConfigurationErrorKind is the kind of failure of a *ConfigurationError.
+type ConfigurationErrorKind string
+
+// ConfigurationError is returned when a Configuration method fails.
+type ConfigurationError struct {
+	Kind    ConfigurationErrorKind
+	Message string // Human-readable description of the failure, defaults to the kind
+	Err     error  // Underlying error, if any
+}
+
+const (
+	// ErrSchemeNotInstalled indicates that a scheme is not installed in the Configuration.
+	ErrSchemeNotInstalled = ConfigurationErrorKind("scheme not installed")
+	// ErrInvalidScheme indicates that the contents of a scheme are malformed, e.g. because a
+	// description or its timestamp cannot be read or parsed.
+	ErrInvalidScheme = ConfigurationErrorKind("invalid scheme")
+	// ErrMissingSignature indicates that the index of a scheme, its signature, or the public key
+	// of the scheme is missing.
+	ErrMissingSignature = ConfigurationErrorKind("missing scheme signature")
+	// ErrInvalidSignature indicates that the signature over the index of a scheme is invalid.
+	ErrInvalidSignature = ConfigurationErrorKind("invalid scheme signature")
+	// ErrHashMismatch indicates that the hash of a scheme file does not match the index of the scheme.
+	ErrHashMismatch = ConfigurationErrorKind("hash mismatch")
+	// ErrKeyNotFound indicates that a key is not present in the Configuration.
+	ErrKeyNotFound = ConfigurationErrorKind("key not found")
+	// ErrKeyExpired indicates that a key is used outside of its validity period.
+	ErrKeyExpired = ConfigurationErrorKind("key expired")
+	// ErrInvalidKey indicates that a key is malformed, or has the wrong counter.
+	ErrInvalidKey = ConfigurationErrorKind("invalid key")
+	// ErrPrivateKeysLocked indicates that an encrypted private key could not be decrypted, because
+	// the private keys have not been unlocked or the passphrase is wrong.
+	ErrPrivateKeysLocked = ConfigurationErrorKind("private keys locked")
+	// ErrEnvironmentNotAllowed indicates that the environment of a scheme is not allowed by the
+	// Environments of the Configuration.
+	ErrEnvironmentNotAllowed = ConfigurationErrorKind("scheme environment not allowed")
+	// ErrAssetsNotFound indicates that the assets folder of the Configuration does not exist.
+	ErrAssetsNotFound = ConfigurationErrorKind("assets folder not found")
+)
+
+func (k ConfigurationErrorKind) Error() string {
+	return string(k)
+}
+
+func (e *ConfigurationError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = string(e.Kind)
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is returns whether the target is the kind of this error, for use by errors.Is().
+func (e *ConfigurationError) Is(target error) bool {
+	kind, ok := target.(ConfigurationErrorKind)
+	return ok && kind == e.Kind
+}
+
+// Unwrap returns the underlying error, for use by errors.Is() and errors.As().
+func (e *ConfigurationError) Unwrap() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error, for use by errors.Is() and errors.As().
+func (sme SchemeManagerError) Unwrap() error {
+	return sme.Err
+}
+
+func configurationError(kind ConfigurationErrorKind, err error, message string) *ConfigurationError {
+	return &ConfigurationError{Kind: kind, Message: message, Err: err}
+}
@@ -3,7 +3,6 @@ package irma
 import (
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/privacybydesign/gabi/big"
 )
@@ -17,6 +16,8 @@ type CredentialInfo struct {
 	Expires         Timestamp                                    // Unix timestamp
 	Attributes      map[AttributeTypeIdentifier]TranslatedString // Human-readable rendered attributes
 	Hash            string                                       // SHA256 hash over the attributes
+	Orphaned        bool                                         // Whether the credential type was removed or changed (see AttributeList.Orphaned())
+	RawAttributes   []TranslatedString                           // Attribute values of orphaned credentials, in the order of issuance
 }
 
 // A CredentialInfoList is a list of credentials (implements sort.Interface).
@@ -30,6 +31,9 @@ func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
 	}
 
 	attrs := NewAttributeListFromInts(ints, conf)
+	if attrs.Orphaned() {
+		return attrs.orphanedInfo()
+	}
 	id := credtype.Identifier()
 	issid := id.IssuerIdentifier()
 	return &CredentialInfo{
@@ -49,7 +53,7 @@ func (ci CredentialInfo) GetCredentialType(conf *Configuration) *CredentialType
 
 // Returns true if credential is expired at moment of calling this function
 func (ci CredentialInfo) IsExpired() bool {
-	return ci.Expires.Before(Timestamp(time.Now()))
+	return ci.Expires.Before(Timestamp(Now()))
 }
 
 // Len implements sort.Interface.
@@ -0,0 +1,131 @@
+package irma
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Credential types may declare issuance dependencies in their description.xml: credential types
+// of which attributes must be disclosed before the credential type can be issued. These form a
+// directed graph over the credential types, which must not contain cycles. The functions below
+// allow clients and issuers to query this graph, e.g. to plan the order of a multi-step issuance flow.
+
+// Dependencies returns the credential types on which the specified credential type directly depends.
+func (conf *Configuration) Dependencies(id CredentialTypeIdentifier) ([]CredentialTypeIdentifier, error) {
+	credtype, ok := conf.CredentialTypes[id]
+	if !ok {
+		return nil, errors.Errorf("Unknown credential type %s", id)
+	}
+	return append([]CredentialTypeIdentifier{}, credtype.Dependencies...), nil
+}
+
+// IssuanceOrder returns the specified credential types along with all credential types on which they
+// (transitively) depend, sorted topologically: each credential type comes after its dependencies.
+// Returns an error if any of the credential types are unknown, or if the dependencies contain a cycle.
+func (conf *Configuration) IssuanceOrder(ids ...CredentialTypeIdentifier) ([]CredentialTypeIdentifier, error) {
+	sorter := &dependencySorter{
+		conf:  conf,
+		state: map[CredentialTypeIdentifier]int{},
+	}
+	for _, id := range sortCredentialTypes(ids) {
+		if err := sorter.visit(id); err != nil {
+			return nil, err
+		}
+	}
+	return sorter.order, nil
+}
+
+// DependencyCycle returns a cycle in the dependency graph of all credential types, if any,
+// as a list of credential types of which each depends on the next, and the last on the first.
+func (conf *Configuration) DependencyCycle() []CredentialTypeIdentifier {
+	ids := make([]CredentialTypeIdentifier, 0, len(conf.CredentialTypes))
+	for id := range conf.CredentialTypes {
+		ids = append(ids, id)
+	}
+	sorter := &dependencySorter{
+		conf:         conf,
+		state:        map[CredentialTypeIdentifier]int{},
+		allowMissing: true,
+	}
+	for _, id := range sortCredentialTypes(ids) {
+		if err := sorter.visit(id); err != nil {
+			return sorter.cycle
+		}
+	}
+	return nil
+}
+
+// dependencySorter performs a depth-first search of the dependency graph, appending each
+// credential type to order after all of its dependencies.
+type dependencySorter struct {
+	conf         *Configuration
+	state        map[CredentialTypeIdentifier]int
+	path         []CredentialTypeIdentifier
+	order        []CredentialTypeIdentifier
+	cycle        []CredentialTypeIdentifier
+	allowMissing bool
+}
+
+const (
+	dependencyVisiting = iota + 1
+	dependencyVisited
+)
+
+func (s *dependencySorter) visit(id CredentialTypeIdentifier) error {
+	switch s.state[id] {
+	case dependencyVisited:
+		return nil
+	case dependencyVisiting:
+		for i, cred := range s.path {
+			if cred == id {
+				s.cycle = append([]CredentialTypeIdentifier{}, s.path[i:]...)
+				break
+			}
+		}
+		return errors.Errorf("Dependency cycle in credential types: %s", cycleString(s.cycle))
+	}
+
+	credtype, ok := s.conf.CredentialTypes[id]
+	if !ok {
+		if s.allowMissing {
+			s.state[id] = dependencyVisited
+			return nil
+		}
+		return errors.Errorf("Unknown credential type %s", id)
+	}
+
+	s.state[id] = dependencyVisiting
+	s.path = append(s.path, id)
+	for _, dep := range sortCredentialTypes(credtype.Dependencies) {
+		if err := s.visit(dep); err != nil {
+			return err
+		}
+	}
+	s.path = s.path[:len(s.path)-1]
+	s.state[id] = dependencyVisited
+	s.order = append(s.order, id)
+	return nil
+}
+
+// sortCredentialTypes returns a sorted copy of the specified credential types,
+// so that the results of the dependency functions are deterministic.
+func sortCredentialTypes(ids []CredentialTypeIdentifier) []CredentialTypeIdentifier {
+	sorted := append([]CredentialTypeIdentifier{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+	return sorted
+}
+
+func cycleString(cycle []CredentialTypeIdentifier) string {
+	strs := make([]string, 0, len(cycle)+1)
+	for _, id := range cycle {
+		strs = append(strs, id.String())
+	}
+	if len(cycle) > 0 {
+		strs = append(strs, cycle[0].String())
+	}
+	return strings.Join(strs, " -> ")
+}
@@ -0,0 +1,87 @@
+package irma
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schemes can announce that a credential type or attribute type is deprecated, i.e. that it will
+// be removed from the scheme, using the <DeprecatedSince> and <ObsoletedBy> elements in their
+// description.xml. The functions below allow verifiers to notice this in advance.
+
+// IsDeprecated returns whether or not the credential type is deprecated at the specified time.
+func (ct *CredentialType) IsDeprecated(t time.Time) bool {
+	return ct.DeprecatedSince != nil && !time.Time(*ct.DeprecatedSince).After(t)
+}
+
+// IsDeprecated returns whether or not the attribute type is deprecated at the specified time.
+func (ad *AttributeType) IsDeprecated(t time.Time) bool {
+	return ad.DeprecatedSince != nil && !time.Time(*ad.DeprecatedSince).After(t)
+}
+
+// DeprecatedCredentialTypes returns the credential types that are or will be deprecated.
+func (conf *Configuration) DeprecatedCredentialTypes() []CredentialTypeIdentifier {
+	var ids []CredentialTypeIdentifier
+	for id, credtype := range conf.CredentialTypes {
+		if credtype.DeprecatedSince != nil {
+			ids = append(ids, id)
+		}
+	}
+	return sortCredentialTypes(ids)
+}
+
+// DeprecatedAttributeTypes returns the attribute types that are or will be deprecated.
+func (conf *Configuration) DeprecatedAttributeTypes() []AttributeTypeIdentifier {
+	var ids []AttributeTypeIdentifier
+	for id, attrtype := range conf.AttributeTypes {
+		if attrtype.DeprecatedSince != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Deprecations returns a warning for each credential type and attribute type in the specified
+// session request that is or will be deprecated.
+func (conf *Configuration) Deprecations(request SessionRequest) []string {
+	var warnings []string
+	seen := map[string]struct{}{}
+	add := func(kind, id string, since *Timestamp, obsoletedBy string) {
+		if since == nil {
+			return
+		}
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		verb := "is deprecated since"
+		if time.Time(*since).After(Now()) {
+			verb = "will be deprecated on"
+		}
+		warning := fmt.Sprintf("%s %s %s %s", kind, id, verb, time.Time(*since).UTC().Format("2006-01-02"))
+		if obsoletedBy != "" {
+			warning += fmt.Sprintf(", use %s instead", obsoletedBy)
+		}
+		warnings = append(warnings, warning)
+	}
+	addCredentialType := func(id CredentialTypeIdentifier) {
+		if credtype, ok := conf.CredentialTypes[id]; ok {
+			add("Credential type", id.String(), credtype.DeprecatedSince, credtype.ObsoletedBy.String())
+		}
+	}
+
+	if issuance, ok := request.(*IssuanceRequest); ok {
+		for _, cred := range issuance.Credentials {
+			addCredentialType(cred.CredentialTypeID)
+		}
+	}
+	for _, disjunction := range request.ToDisclose() {
+		for _, attr := range disjunction.Attributes {
+			addCredentialType(attr.CredentialTypeIdentifier())
+			if attrtype, ok := conf.AttributeTypes[attr]; ok && !attr.IsCredential() {
+				add("Attribute type", attr.String(), attrtype.DeprecatedSince, attrtype.ObsoletedBy.String())
+			}
+		}
+	}
+	return warnings
+}
@@ -16,26 +16,54 @@ type SchemeManager struct {
 	ID                string           `xml:"Id"`
 	Name              TranslatedString `xml:"Name"`
 	URL               string           `xml:"Url"`
+	Mirrors           []string         `xml:"Mirrors>Mirror"`
 	Contact           string           `xml:"contact"`
 	Description       TranslatedString
 	MinimumAppVersion SchemeAppVersion
 	KeyshareServer    string
 	KeyshareWebsite   string
 	KeyshareAttribute string
-	XMLVersion        int      `xml:"version,attr"`
-	XMLName           xml.Name `xml:"SchemeManager"`
+	KeyshareJWKS      string // URL of a JWKS with keyshare server keys, used besides those in the scheme (optional)
+	Environment       SchemeEnvironment
+	SubSchemes        []SubScheme `xml:"SubSchemes>SubScheme"`
+	Keys              []SchemeKey `xml:"Keys>Key"`
+	AssertsFreshness  bool        // Whether the scheme publishes freshness assertions (see freshness.go)
+	XMLVersion        int         `xml:"version,attr"`
+	XMLName           xml.Name    `xml:"SchemeManager"`
 
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
+	// Parent is the scheme of which this scheme is a sub-scheme, if any
+	Parent SchemeManagerIdentifier `xml:"-"`
+
 	Timestamp Timestamp
+	// Freshness is the time at which the scheme was last asserted to be current, if ever
+	Freshness *Timestamp `xml:"-"`
 
 	index SchemeManagerIndex
 }
 
+// SchemeEnvironment indicates whether a scheme is meant for demo purposes or for production use.
+type SchemeEnvironment string
+
+const (
+	SchemeEnvironmentDemo       = SchemeEnvironment("demo")
+	SchemeEnvironmentProduction = SchemeEnvironment("production")
+)
+
+// SubScheme refers to a scheme hosted at another URL, whose public key is vouched for
+// by the scheme whose description contains it.
+type SubScheme struct {
+	ID        string `xml:"Id"`
+	URL       string `xml:"Url"`
+	PublicKey string `xml:"PublicKey"` // PEM-encoded ECDSA public key
+}
+
 type SchemeAppVersion struct {
-	Android int `xml:"Android"`
-	IOS     int `xml:"iOS"`
+	Android int    `xml:"Android"`
+	IOS     int    `xml:"iOS"`
+	Irmago  string `xml:"Irmago"` // Minimum version of irmago, see RequiresUpdate()
 }
 
 // Issuer describes an issuer.
@@ -65,6 +93,18 @@ type CredentialType struct {
 	XMLName         xml.Name         `xml:"IssueSpecification"`
 	IssueURL        TranslatedString `xml:"IssueURL"`
 
+	// If present, the URL at which the issuer serves a session pointer (irma.Qr) to an issuance
+	// session that renews credentials of this type (see irmaclient.ReissueHandler)
+	ReissueURL string `xml:"ReissueURL" json:",omitempty"`
+
+	// Credential types of which attributes must be disclosed before this credential type can be issued
+	Dependencies []CredentialTypeIdentifier `xml:"Dependencies>CredentialType" json:",omitempty"`
+
+	// If present, the time since which (or from which on) this credential type is deprecated,
+	// and the credential type that replaces it, if any
+	DeprecatedSince *Timestamp               `xml:"DeprecatedSince" json:",omitempty"`
+	ObsoletedBy     CredentialTypeIdentifier `xml:"ObsoletedBy"`
+
 	Valid bool `xml:"-"`
 }
 
@@ -78,6 +118,14 @@ type AttributeType struct {
 	Index        int  `xml:"-"`
 	DisplayIndex *int `xml:"displayIndex,attr" json:",omitempty"`
 
+	// If present, the time since which (or from which on) this attribute type is deprecated,
+	// and the attribute type that replaces it, if any
+	DeprecatedSince *Timestamp              `xml:"DeprecatedSince" json:",omitempty"`
+	ObsoletedBy     AttributeTypeIdentifier `xml:"ObsoletedBy"`
+
+	// If present, the format that values of this attribute type must have
+	Format *AttributeFormat `xml:"Format" json:",omitempty"`
+
 	// Taken from containing CredentialType
 	CredentialTypeID string `xml:"-"`
 	IssuerID         string `xml:"-"`
@@ -0,0 +1,106 @@
+package irma
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The jwt library does not support Ed25519 signatures (the "EdDSA" JWT algorithm of RFC 8037), so
+// we implement and register it here. Ed25519 keys are stored in PEM files as usual, i.e. public keys
+// in a PKIX SubjectPublicKeyInfo and private keys in a PKCS #8 structure (RFC 8410).
+
+// SigningMethodEd25519 implements the EdDSA JWT signing method for Ed25519 keys. It expects
+// an ed25519.PrivateKey for signing and an ed25519.PublicKey for verification.
+type SigningMethodEd25519 struct{}
+
+// SigningMethodEdDSA is the EdDSA JWT signing method, registered with the jwt library.
+var SigningMethodEdDSA = &SigningMethodEd25519{}
+
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (*SigningMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (*SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok || len(pk) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pk, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (*SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	sk, ok := key.(ed25519.PrivateKey)
+	if !ok || len(sk) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(sk, []byte(signingString))), nil
+}
+
+// ParseEd25519PublicKeyFromPEM parses a PEM-encoded PKIX Ed25519 public key.
+func ParseEd25519PublicKeyFromPEM(bts []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded")
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(block.Bytes, &spki); err != nil || len(rest) != 0 {
+		return nil, errors.New("Failed to parse Ed25519 public key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidEd25519) {
+		return nil, errors.New("Key is not an Ed25519 public key")
+	}
+	if spki.PublicKey.BitLength != 8*ed25519.PublicKeySize {
+		return nil, errors.New("Ed25519 public key has invalid length")
+	}
+	return ed25519.PublicKey(spki.PublicKey.Bytes), nil
+}
+
+// ParseEd25519PrivateKeyFromPEM parses a PEM-encoded PKCS #8 Ed25519 private key.
+func ParseEd25519PrivateKeyFromPEM(bts []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded")
+	}
+	var pkcs8 struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &pkcs8); err != nil {
+		return nil, errors.New("Failed to parse Ed25519 private key")
+	}
+	if !pkcs8.Algorithm.Algorithm.Equal(oidEd25519) {
+		return nil, errors.New("Key is not an Ed25519 private key")
+	}
+	var seed []byte
+	if rest, err := asn1.Unmarshal(pkcs8.PrivateKey, &seed); err != nil || len(rest) != 0 {
+		return nil, errors.New("Failed to parse Ed25519 private key")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Ed25519 private key has invalid length")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
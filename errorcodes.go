@@ -0,0 +1,133 @@
+package irma
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Each error that IRMA clients and servers can emit is registered in the error registry with
+// a stable numeric code and name, so that apps and requestor frontends can map errors to
+// (localized) messages without inspecting error texts. Registered codes must never be changed
+// or reused. Client session errors (of type ErrorType) use codes 1000-1999, and server errors
+// (of type server.Error) use codes 2000-2999.
+
+// ErrorCode is the stable numeric code of a registered error.
+type ErrorCode int
+
+// ErrorOrigin indicates whether an error is emitted by IRMA clients or servers.
+type ErrorOrigin string
+
+// RegisteredError describes an error in the error registry.
+type RegisteredError struct {
+	Code        ErrorCode   `json:"code"`
+	Name        string      `json:"name"`
+	Origin      ErrorOrigin `json:"origin"`
+	Description string      `json:"description"`
+}
+
+const (
+	ErrorOriginClient = ErrorOrigin("client")
+	ErrorOriginServer = ErrorOrigin("server")
+)
+
+// ErrorCodeUnknown is the code of client errors whose type is not set or not registered.
+const ErrorCodeUnknown = ErrorCode(1000)
+
+var errorRegistry = struct {
+	sync.RWMutex
+	byCode map[ErrorCode]RegisteredError
+	byName map[ErrorOrigin]map[string]RegisteredError
+}{
+	byCode: map[ErrorCode]RegisteredError{},
+	byName: map[ErrorOrigin]map[string]RegisteredError{},
+}
+
+func init() {
+	for _, e := range []struct {
+		code        ErrorCode
+		typ         ErrorType
+		description string
+	}{
+		{ErrorCodeUnknown, "unknown", "Unknown error"},
+		{1001, ErrorProtocolVersionNotSupported, "Protocol version not supported"},
+		{1002, ErrorTransport, "Error in HTTP communication"},
+		{1003, ErrorInvalidJWT, "Invalid client JWT in first IRMA message"},
+		{1004, ErrorUnknownAction, "Unknown session type"},
+		{1005, ErrorCrypto, "Crypto error during calculation of our response"},
+		{1006, ErrorRejected, "Server rejected our response"},
+		{1007, ErrorSerialization, "(De)serializing of a message failed"},
+		{1008, ErrorKeyshare, "Error in keyshare protocol"},
+		{1009, ErrorApi, "API server error"},
+		{1010, ErrorServerResponse, "Server returned unexpected or malformed response"},
+		{1011, ErrorUnknownCredentialType, "Credential type not present in our Configuration"},
+		{1012, ErrorConfigurationDownload, "Error during downloading of credential type, issuer, or public keys"},
+		{1013, ErrorUnknownSchemeManager, "IRMA request refers to unknown scheme manager"},
+		{1014, ErrorInvalidSchemeManager, "A session is requested involving a scheme manager that has some problem"},
+		{1015, ErrorPanic, "Recovered panic"},
+	} {
+		RegisterError(RegisteredError{
+			Code:        e.code,
+			Name:        string(e.typ),
+			Origin:      ErrorOriginClient,
+			Description: e.description,
+		})
+	}
+}
+
+// RegisterError adds the specified error to the error registry. As codes and names must be
+// unique, it panics if either was registered before.
+func RegisterError(e RegisteredError) {
+	errorRegistry.Lock()
+	defer errorRegistry.Unlock()
+
+	if existing, ok := errorRegistry.byCode[e.Code]; ok {
+		panic(fmt.Sprintf("error code %d of %s already registered for %s", e.Code, e.Name, existing.Name))
+	}
+	if errorRegistry.byName[e.Origin] == nil {
+		errorRegistry.byName[e.Origin] = map[string]RegisteredError{}
+	}
+	if _, ok := errorRegistry.byName[e.Origin][e.Name]; ok {
+		panic(fmt.Sprintf("%s error %s already registered", e.Origin, e.Name))
+	}
+	errorRegistry.byCode[e.Code] = e
+	errorRegistry.byName[e.Origin][e.Name] = e
+}
+
+// LookupErrorCode returns the registered error having the specified code.
+func LookupErrorCode(code ErrorCode) (RegisteredError, bool) {
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	e, ok := errorRegistry.byCode[code]
+	return e, ok
+}
+
+// LookupError returns the registered error having the specified origin and name.
+func LookupError(origin ErrorOrigin, name string) (RegisteredError, bool) {
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	e, ok := errorRegistry.byName[origin][name]
+	return e, ok
+}
+
+// RegisteredErrors returns all registered errors, sorted by code.
+func RegisteredErrors() []RegisteredError {
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	errs := make([]RegisteredError, 0, len(errorRegistry.byCode))
+	for _, e := range errorRegistry.byCode {
+		errs = append(errs, e)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Code < errs[j].Code
+	})
+	return errs
+}
+
+// Code returns the registered code of the error type, or ErrorCodeUnknown if it is not registered.
+func (t ErrorType) Code() ErrorCode {
+	if e, ok := LookupError(ErrorOriginClient, string(t)); ok {
+		return e.Code
+	}
+	return ErrorCodeUnknown
+}
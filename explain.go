@@ -0,0 +1,220 @@
+package irma
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+)
+
+// ProofCheck identifies one of the checks performed when verifying a disclosure or
+// attribute-based signature.
+type ProofCheck string
+
+const (
+	ProofCheckCredentialType = ProofCheck("CREDENTIAL_TYPE") // Proof is of an unknown credential type
+	ProofCheckPublicKey      = ProofCheck("PUBLIC_KEY")      // Public key with which the credential was issued is missing
+	ProofCheckEnvironment    = ProofCheck("ENVIRONMENT")     // Scheme of the credential is not allowed in this environment
+	ProofCheckNonceContext   = ProofCheck("NONCE_CONTEXT")   // Proofs were computed over another nonce, context or message than those of the request
+	ProofCheckHash           = ProofCheck("HASH")            // Proofs do not verify against their challenge hash
+	ProofCheckTimestamp      = ProofCheck("TIMESTAMP")       // Timestamp of the attribute-based signature is invalid
+	ProofCheckExpiry         = ProofCheck("EXPIRY")          // Credential was expired at verification time
+	ProofCheckDisjunction    = ProofCheck("DISJUNCTION")     // Disjunction of the request is not satisfied
+)
+
+// ProofProblem describes why a disclosure or attribute-based signature failed to verify.
+// Fields that do not apply to the problem are zero, or -1 in case of indices.
+type ProofProblem struct {
+	Check       ProofCheck
+	Proof       int // Index of the proof concerned
+	Credential  CredentialTypeIdentifier
+	Issuer      IssuerIdentifier
+	KeyCounter  int
+	Disjunction int // Index of the disjunction of the request concerned
+	Message     string
+}
+
+func (p *ProofProblem) String() string {
+	s := string(p.Check)
+	if p.Proof >= 0 {
+		s += fmt.Sprintf(" (proof %d", p.Proof)
+		if p.Credential.String() != "" {
+			s += ", " + p.Credential.String()
+		}
+		if p.Issuer.String() != "" {
+			s += fmt.Sprintf(", key %s-%d", p.Issuer.String(), p.KeyCounter)
+		}
+		s += ")"
+	}
+	if p.Disjunction >= 0 {
+		s += fmt.Sprintf(" (disjunction %d)", p.Disjunction)
+	}
+	return s + ": " + p.Message
+}
+
+// Explain performs the same checks as Disclosure.Verify(), returning for each check
+// that fails a ProofProblem explaining the failure. It returns nil if the disclosure is valid.
+func (d *Disclosure) Explain(conf *Configuration, request *DisclosureRequest) []*ProofProblem {
+	problems, ok := explainProofs(conf, d.Proofs, Now())
+	if ok {
+		valid, err := ProofList(d.Proofs).VerifyProofs(conf, request.Context, request.Nonce, nil, false)
+		if err != nil || !valid {
+			problems = append(problems, newProofProblem(ProofCheckHash,
+				"proofs are invalid: they were computed over another nonce or context than those of the request, or were modified afterwards"))
+		}
+	}
+	return append(problems, explainDisjunctions(conf, d.Proofs, request.Content)...)
+}
+
+// Explain performs the same checks as SignedMessage.Verify(), returning for each check that
+// fails a ProofProblem explaining the failure. It returns nil if the signature is valid.
+// The request is optional.
+func (sm *SignedMessage) Explain(conf *Configuration, request *SignatureRequest) []*ProofProblem {
+	var problems []*ProofProblem
+	message := sm.Message
+	if request != nil {
+		message = request.Message
+		switch {
+		case sm.Nonce.Cmp(request.Nonce) != 0:
+			problems = append(problems, newProofProblem(ProofCheckNonceContext, "nonce does not match that of the request"))
+		case sm.Context.Cmp(request.Context) != 0:
+			problems = append(problems, newProofProblem(ProofCheckNonceContext, "context does not match that of the request"))
+		case sm.Message != request.Message:
+			problems = append(problems, newProofProblem(ProofCheckNonceContext, "signed message does not match that of the request"))
+		}
+	}
+
+	t := Now()
+	if sm.Timestamp != nil {
+		if err := sm.VerifyTimestamp(message, conf); err != nil {
+			problems = append(problems, newProofProblem(ProofCheckTimestamp, err.Error()))
+		} else {
+			t = time.Unix(sm.Timestamp.Time, 0)
+		}
+	}
+
+	proofProblems, ok := explainProofs(conf, sm.Signature, t)
+	problems = append(problems, proofProblems...)
+	if ok {
+		valid, err := ProofList(sm.Signature).VerifyProofs(conf, sm.Context, sm.GetNonce(), nil, true)
+		if err != nil || !valid {
+			problems = append(problems, newProofProblem(ProofCheckHash,
+				"proofs are invalid: they were not computed over the signed message, nonce and context, or were modified afterwards"))
+		}
+	}
+
+	if request != nil {
+		problems = append(problems, explainDisjunctions(conf, sm.Signature, request.Content)...)
+	}
+	return problems
+}
+
+func newProofProblem(check ProofCheck, message string) *ProofProblem {
+	return &ProofProblem{Check: check, Proof: -1, Disjunction: -1, Message: message}
+}
+
+// explainProofs checks the credential type, public key, environment and expiry of each of the
+// proofs. If any problem prevents the proofs from being cryptographically verified, it returns false.
+func explainProofs(conf *Configuration, proofs gabi.ProofList, t time.Time) ([]*ProofProblem, bool) {
+	var problems []*ProofProblem
+	verifiable := true
+	for i, proof := range proofs {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			problem := newProofProblem(ProofCheckHash, "not a disclosure proof")
+			problem.Proof = i
+			problems = append(problems, problem)
+			verifiable = false
+			continue
+		}
+
+		problem := newProofProblem("", "")
+		problem.Proof = i
+		if proofd.ADisclosed[1] == nil { // index 1 is metadata attribute
+			problem.Check = ProofCheckCredentialType
+			problem.Message = "proof does not disclose its metadata attribute"
+			problems = append(problems, problem)
+			verifiable = false
+			continue
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], conf)
+		credtype := metadata.CredentialType()
+		if credtype == nil {
+			problem.Check = ProofCheckCredentialType
+			problem.Message = "credential type not found in the configuration"
+			problems = append(problems, problem)
+			verifiable = false
+			continue
+		}
+		problem.Credential = credtype.Identifier()
+		problem.Issuer = credtype.IssuerIdentifier()
+		problem.KeyCounter = metadata.KeyCounter()
+
+		for index := range proofd.ADisclosed {
+			if index < 0 || index > len(credtype.AttributeTypes)+1 {
+				p := *problem
+				p.Check = ProofCheckCredentialType
+				p.Message = "proof discloses attributes that the credential type does not have; the configuration may be outdated"
+				problems = append(problems, &p)
+				verifiable = false
+				break
+			}
+		}
+
+		if !conf.EnvironmentAllowed(credtype.SchemeManagerIdentifier()) {
+			p := *problem
+			p.Check = ProofCheckEnvironment
+			p.Message = fmt.Sprintf("scheme %s is not allowed in this environment", credtype.SchemeManagerID)
+			problems = append(problems, &p)
+			verifiable = false
+		}
+		if pk, err := metadata.PublicKey(); err != nil || pk == nil {
+			p := *problem
+			p.Check = ProofCheckPublicKey
+			p.Message = "public key not found in the configuration"
+			if err != nil {
+				p.Message = "failed to read public key: " + err.Error()
+			}
+			problems = append(problems, &p)
+			verifiable = false
+		}
+		if metadata.ExpiredAt(t, conf.ExpiryGracePeriod) {
+			p := *problem
+			p.Check = ProofCheckExpiry
+			p.Message = fmt.Sprintf("credential expired at %s, before %s", metadata.Expiry().String(), t.String())
+			problems = append(problems, &p)
+		}
+	}
+	return problems, verifiable
+}
+
+// explainDisjunctions reports the disjunctions that are not satisfied by the proofs.
+func explainDisjunctions(conf *Configuration, proofs gabi.ProofList, disjunctions AttributeDisjunctionList) []*ProofProblem {
+	// Work on copies, so as not to modify the state of the disjunctions of the request
+	dl := make(AttributeDisjunctionList, len(disjunctions))
+	for i, disjunction := range disjunctions {
+		dl[i] = &AttributeDisjunction{Label: disjunction.Label, Attributes: disjunction.Attributes, Values: disjunction.Values}
+	}
+
+	_, attrs, err := ProofList(proofs).DisclosedAttributes(conf, dl)
+	if err != nil {
+		// Only happens for unknown credential types, which are reported by explainProofs
+		return nil
+	}
+
+	var problems []*ProofProblem
+	for i := range dl {
+		problem := newProofProblem(ProofCheckDisjunction, "")
+		problem.Disjunction = i
+		switch attrs[i].Status {
+		case AttributeProofStatusMissing:
+			problem.Message = fmt.Sprintf("none of the attributes %v was disclosed", dl[i].Attributes)
+		case AttributeProofStatusInvalidValue:
+			problem.Message = fmt.Sprintf("attribute %s was disclosed with a value other than requested", attrs[i].Identifier)
+		default:
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
@@ -0,0 +1,165 @@
+package irma
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// A scheme can delegate the management of some of its issuers to sub-schemes: schemes hosted at
+// other URLs, which are listed (with their public keys) in the description of the parent scheme.
+// As that description is signed, the parent scheme acts as the trust root of its sub-schemes:
+// a sub-scheme is installed using the public key listed by its parent instead of the one
+// served by the sub-scheme itself, and it is disabled if its public key does not match the
+// one listed by its parent. Apart from that, sub-schemes are stored and parsed as separate
+// schemes, and may themselves have sub-schemes. A scheme has at most one parent, so that
+// sub-schemes form a tree.
+
+// parseSubSchemes installs (if necessary) and parses the sub-schemes of the specified (just parsed)
+// scheme, after verifying their public keys. Problems with sub-schemes do not affect their parent:
+// the sub-scheme is then disabled and a warning is recorded.
+func (conf *Configuration) parseSubSchemes(manager *SchemeManager) {
+	for _, sub := range manager.SubSchemes {
+		id := NewSchemeManagerIdentifier(sub.ID)
+		if conf.isAncestor(id, manager) {
+			conf.warn(SeverityError, ValidationInvalidSubScheme, sub.ID,
+				"Ignoring sub-scheme %s of scheme %s: it is an ancestor of that scheme", sub.ID, manager.ID)
+			continue
+		}
+		if existing, ok := conf.SchemeManagers[id]; ok && !existing.Parent.Empty() && existing.Parent != manager.Identifier() {
+			conf.warn(SeverityError, ValidationInvalidSubScheme, sub.ID,
+				"Ignoring sub-scheme %s of scheme %s: it is already a sub-scheme of %s", sub.ID, manager.ID, existing.Parent)
+			continue
+		}
+
+		err := conf.parseSubScheme(manager, sub)
+		if err == nil {
+			continue
+		}
+		conf.warn(SeverityError, ValidationInvalidSubScheme, sub.ID,
+			"Sub-scheme %s of scheme %s is disabled: %s", sub.ID, manager.ID, err.Error())
+		if _, ok := conf.SchemeManagers[id]; !ok {
+			continue // not installed, so nothing to disable
+		}
+		mgrerr, ok := err.(*SchemeManagerError)
+		if !ok {
+			mgrerr = &SchemeManagerError{Manager: id, Err: err, Status: conf.SchemeManagers[id].Status}
+		}
+		conf.DisabledSchemeManagers[id] = mgrerr
+	}
+}
+
+// parseSubScheme installs the specified sub-scheme if it is not yet installed, or verifies
+// its public key and parses it otherwise.
+func (conf *Configuration) parseSubScheme(parent *SchemeManager, sub SubScheme) error {
+	id := NewSchemeManagerIdentifier(sub.ID)
+	pk := []byte(sub.PublicKey)
+	dir := filepath.Join(conf.Path, sub.ID)
+
+	exists, err := fs.PathExists(filepath.Join(dir, "description.xml"))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err = conf.writable("install sub-scheme " + sub.ID); err != nil {
+			return errors.Errorf("Sub-scheme %s is not installed", sub.ID)
+		}
+		manager, err := DownloadSchemeManager(sub.URL)
+		if err != nil {
+			return err
+		}
+		if manager.ID != sub.ID {
+			return errors.Errorf("Sub-scheme at %s has identifier %s instead of %s", sub.URL, manager.ID, sub.ID)
+		}
+		manager.Parent = parent.Identifier()
+		if err = conf.InstallSchemeManager(manager, pk); err != nil {
+			if _, installed := conf.SchemeManagers[id]; installed && conf.writable("remove scheme "+sub.ID) == nil {
+				_ = conf.RemoveSchemeManager(id, true)
+			}
+			return err
+		}
+		return nil
+	}
+
+	manager, parsed := conf.SchemeManagers[id]
+	if !parsed {
+		manager = NewSchemeManager(sub.ID)
+		manager.URL = sub.URL
+		conf.SchemeManagers[id] = manager
+	}
+	manager.Parent = parent.Identifier()
+	if err = verifySubSchemePublicKey(dir, pk); err != nil {
+		// If the sub-scheme was already parsed (because its directory came before the
+		// one of its parent), its contents must not be used.
+		conf.unloadSchemeManager(id)
+		manager.Status = SchemeManagerStatusInvalidSignature
+		manager.Valid = false
+		return &SchemeManagerError{Manager: id, Err: err, Status: manager.Status}
+	}
+	if parsed {
+		return nil
+	}
+	return conf.ParseSchemeManagerFolder(dir, manager)
+}
+
+// updateSubSchemes updates the (installed) sub-schemes of the specified scheme.
+func (conf *Configuration) updateSubSchemes(manager *SchemeManager, downloaded *IrmaIdentifierSet) error {
+	for _, sub := range manager.SubSchemes {
+		id := NewSchemeManagerIdentifier(sub.ID)
+		if s, ok := conf.SchemeManagers[id]; !ok || s.Parent != manager.Identifier() {
+			continue
+		}
+		if err := conf.UpdateSchemeManager(id, downloaded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subSchemePublicKey returns the public key of the specified scheme as listed by its parent,
+// or nil if it is not a sub-scheme.
+func (conf *Configuration) subSchemePublicKey(manager *SchemeManager) []byte {
+	parent, ok := conf.SchemeManagers[manager.Parent]
+	if !ok {
+		return nil
+	}
+	for _, sub := range parent.SubSchemes {
+		if sub.ID == manager.ID {
+			return []byte(sub.PublicKey)
+		}
+	}
+	return nil
+}
+
+// isAncestor returns whether the specified scheme identifier is the scheme itself,
+// or (recursively) its parent.
+func (conf *Configuration) isAncestor(id SchemeManagerIdentifier, manager *SchemeManager) bool {
+	for manager != nil {
+		if manager.Identifier() == id {
+			return true
+		}
+		manager = conf.SchemeManagers[manager.Parent]
+	}
+	return false
+}
+
+func verifySubSchemePublicKey(dir string, expected []byte) error {
+	expectedPk, err := ParsePemEcdsaPublicKey(expected)
+	if err != nil {
+		return err
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem"))
+	if err != nil {
+		return err
+	}
+	pk, err := ParsePemEcdsaPublicKey(bts)
+	if err != nil {
+		return err
+	}
+	if pk.Curve != expectedPk.Curve || pk.X.Cmp(expectedPk.X) != 0 || pk.Y.Cmp(expectedPk.Y) != 0 {
+		return errors.New("Public key of sub-scheme does not match the one listed by its parent")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package irma
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Verifying a scheme involves hashing each of its files and comparing the hash with the one in
+// the (signed) scheme index. VerifySchemeManager() does so in parallel, and remembers which files
+// it verified, along with their size and modification time, so that files that did not change
+// need not be hashed again when the scheme is verified again, e.g. after an update of the scheme
+// in which only some of its files changed.
+
+// fileHashes keeps track of the scheme files that have been verified against their scheme index.
+type fileHashes struct {
+	mutex   sync.Mutex
+	entries map[string]*fileHashEntry
+}
+
+type fileHashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    ConfigurationFileHash
+}
+
+func newFileHashes() *fileHashes {
+	return &fileHashes{entries: map[string]*fileHashEntry{}}
+}
+
+// verified returns whether the file at the specified path was verified to have the specified
+// hash, and has not changed since.
+func (h *fileHashes) verified(path string, info os.FileInfo, hash ConfigurationFileHash) bool {
+	if h == nil {
+		return false
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, ok := h.entries[path]
+	return ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) && bytes.Equal(entry.hash, hash)
+}
+
+func (h *fileHashes) put(path string, info os.FileInfo, hash ConfigurationFileHash) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries[path] = &fileHashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+}
+
+// verifyFiles verifies the specified files of the scheme against its index using a pool of
+// workers, returning the first error encountered, if any.
+func (conf *Configuration) verifyFiles(manager *SchemeManager, files []string) error {
+	workers := runtime.NumCPU()
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		queue    = make(chan string)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				if err := conf.verifyFile(manager, file); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, file := range files {
+		select {
+		case queue <- file:
+		case <-failed:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
+
+// verifyFile verifies the specified file of the scheme against its index, unless it was verified
+// before and has not changed since. Files that do not exist are skipped.
+func (conf *Configuration) verifyFile(manager *SchemeManager, file string) error {
+	path := filepath.Join(conf.Path, file)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hash := manager.index[file]
+	if conf.fileHashes.verified(path, info, hash) {
+		return nil
+	}
+
+	// Don't care about the actual bytes
+	if _, _, err = conf.ReadAuthenticatedFile(manager, file); err != nil {
+		return err
+	}
+	conf.fileHashes.put(path, info, hash)
+	return nil
+}
@@ -0,0 +1,242 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// A scheme that declares AssertsFreshness in its description periodically (e.g. daily) publishes
+// a freshness assertion: a statement signed by its timestamp key (see schemekeys.go) that at the
+// time of signing, the current version of the scheme is the one with the specified timestamp.
+// The assertion is kept in the freshness file of the scheme, as "<scheme timestamp> <time of
+// assertion>", and its signature in freshness.sig. As the timestamp key can be kept online, the
+// assertion can be renewed automatically without involving the scheme key.
+//
+// Scheme updates download and verify the freshness assertion, also when the scheme itself did not
+// change. Someone withholding updates (e.g. a stale or malicious mirror) can then only keep us on
+// an old version of the scheme until its freshness assertion expires: if the MaxSchemeAge of the
+// Configuration is set, schemes whose freshness was last asserted longer ago are stale (see
+// SchemeStale()). Schemes not asserting their freshness are stale when their timestamp is older
+// than MaxSchemeAge.
+
+// freshnessClockSkew is the maximum amount of time by which a freshness assertion may lie in the future.
+const freshnessClockSkew = 5 * time.Minute
+
+type schemeFreshness struct {
+	Timestamp Timestamp // Timestamp of the scheme version asserted to be current
+	Asserted  Timestamp // Time of the assertion
+}
+
+func (f schemeFreshness) String() string {
+	return fmt.Sprintf("%d %d\n", time.Time(f.Timestamp).Unix(), time.Time(f.Asserted).Unix())
+}
+
+func parseFreshness(bts []byte) (*schemeFreshness, error) {
+	parts := strings.Fields(string(bts))
+	if len(parts) != 2 {
+		return nil, errors.New("freshness assertion must consist of a timestamp and an assertion time")
+	}
+	var times [2]int64
+	for i, part := range parts {
+		var err error
+		if times[i], err = strconv.ParseInt(part, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return &schemeFreshness{
+		Timestamp: Timestamp(time.Unix(times[0], 0)),
+		Asserted:  Timestamp(time.Unix(times[1], 0)),
+	}, nil
+}
+
+// verifyFreshness checks the signature of the timestamp key of the scheme over the specified
+// freshness assertion, and parses it.
+func verifyFreshness(manager *SchemeManager, bts, sig []byte) (*schemeFreshness, error) {
+	key := manager.Key(SchemeKeyRoleTimestamp, 0)
+	if key == nil {
+		return nil, configurationError(ErrKeyNotFound, nil,
+			fmt.Sprintf("Scheme %s asserts its freshness but declares no timestamp key", manager.ID))
+	}
+	pk, err := ParsePemEcdsaPublicKey([]byte(key.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if err = VerifySchemeIndexSignature(bts, sig, pk); err != nil {
+		return nil, configurationError(ErrInvalidSignature, err, "Scheme freshness assertion failed to verify")
+	}
+	freshness, err := parseFreshness(bts)
+	if err != nil {
+		return nil, configurationError(ErrInvalidScheme, err, "Invalid scheme freshness assertion")
+	}
+	return freshness, nil
+}
+
+// parseFreshness reads and verifies the freshness assertion of the specified scheme, if present,
+// returning the time of the assertion. An assertion concerning another version of the scheme
+// than the installed one (e.g. after a rollback) is ignored.
+func (conf *Configuration) parseFreshness(manager *SchemeManager) (*Timestamp, error) {
+	if !manager.AssertsFreshness {
+		return nil, nil
+	}
+	dir := filepath.Join(conf.Path, manager.ID)
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "freshness"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ioutil.ReadFile(filepath.Join(dir, "freshness.sig"))
+	if err != nil {
+		return nil, configurationError(ErrMissingSignature, err, "Could not read scheme freshness assertion signature")
+	}
+	freshness, err := verifyFreshness(manager, bts, sig)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Time(freshness.Timestamp).Equal(time.Time(manager.Timestamp)) {
+		return nil, nil
+	}
+	return &freshness.Asserted, nil
+}
+
+// downloadFreshness downloads and verifies the freshness assertion of the specified scheme, which
+// must concern the specified (new) timestamp of the scheme and must not be older than the one we
+// have. It returns nil if the scheme does not assert its freshness.
+func (conf *Configuration) downloadFreshness(manager *SchemeManager, timestamp Timestamp) (bts, sig []byte, asserted *Timestamp, err error) {
+	if !manager.AssertsFreshness {
+		return nil, nil, nil, nil
+	}
+	err = conf.schemeRequest(manager, func(transport *HTTPTransport) (err error) {
+		if bts, err = transport.GetBytes("freshness"); err != nil {
+			return
+		}
+		sig, err = transport.GetBytes("freshness.sig")
+		return
+	})
+	if err != nil {
+		return nil, nil, nil, configurationError(ErrMissingSignature, err, "Could not download scheme freshness assertion")
+	}
+	freshness, err := verifyFreshness(manager, bts, sig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !time.Time(freshness.Timestamp).Equal(time.Time(timestamp)) {
+		return nil, nil, nil, configurationError(ErrInvalidScheme, nil,
+			fmt.Sprintf("Freshness assertion of scheme %s concerns another version of the scheme", manager.ID))
+	}
+	if manager.Freshness != nil && freshness.Asserted.Before(*manager.Freshness) {
+		return nil, nil, nil, configurationError(ErrInvalidScheme, nil,
+			fmt.Sprintf("Freshness assertion of scheme %s is older than the one we have", manager.ID))
+	}
+	if time.Time(freshness.Asserted).After(Now().Add(freshnessClockSkew)) {
+		return nil, nil, nil, configurationError(ErrInvalidScheme, nil,
+			fmt.Sprintf("Freshness assertion of scheme %s lies in the future", manager.ID))
+	}
+	return bts, sig, &freshness.Asserted, nil
+}
+
+func (conf *Configuration) saveFreshness(manager *SchemeManager, bts, sig []byte) error {
+	dir := filepath.Join(conf.Path, manager.ID)
+	if err := conf.saveFile(filepath.Join(dir, "freshness"), bts); err != nil {
+		return err
+	}
+	return conf.saveFile(filepath.Join(dir, "freshness.sig"), sig)
+}
+
+// updateFreshness downloads the freshness assertion of the specified scheme, whose version is
+// current, and stores it.
+func (conf *Configuration) updateFreshness(manager *SchemeManager) (*SchemeManager, error) {
+	bts, sig, asserted, err := conf.downloadFreshness(manager, manager.Timestamp)
+	if err != nil || asserted == nil {
+		return manager, err
+	}
+	if err = conf.saveFreshness(manager, bts, sig); err != nil {
+		return manager, err
+	}
+	updated := *manager
+	updated.Freshness = asserted
+	conf.mutex.Lock()
+	conf.SchemeManagers[manager.Identifier()] = &updated
+	conf.mutex.Unlock()
+	return &updated, nil
+}
+
+// SchemeStale returns whether the specified scheme is stale: whether its freshness was last
+// asserted (or if it has no freshness assertion, its timestamp lies) more than MaxSchemeAge ago.
+// If MaxSchemeAge is zero, schemes are never stale.
+func (conf *Configuration) SchemeStale(id SchemeManagerIdentifier) bool {
+	conf.mutex.RLock()
+	manager, ok := conf.SchemeManagers[id]
+	conf.mutex.RUnlock()
+	if conf.MaxSchemeAge == 0 || !ok {
+		return false
+	}
+	fresh := manager.Timestamp
+	if manager.Freshness != nil && manager.Freshness.After(fresh) {
+		fresh = *manager.Freshness
+	}
+	return Now().Sub(time.Time(fresh)) > conf.MaxSchemeAge
+}
+
+// StaleSchemes returns the schemes that are stale (see SchemeStale()).
+func (conf *Configuration) StaleSchemes() []SchemeManagerIdentifier {
+	conf.mutex.RLock()
+	ids := make([]SchemeManagerIdentifier, 0, len(conf.SchemeManagers))
+	for id := range conf.SchemeManagers {
+		ids = append(ids, id)
+	}
+	conf.mutex.RUnlock()
+
+	var stale []SchemeManagerIdentifier
+	for _, id := range ids {
+		if conf.SchemeStale(id) {
+			stale = append(stale, id)
+		}
+	}
+	return stale
+}
+
+// AssertSchemeFreshness writes a freshness assertion for the current version of the scheme in the
+// specified directory, signed using the specified timestamp key (see SchemeKeyRoleTimestamp).
+// As the index of the scheme is not modified, this does not require the scheme key.
+func AssertSchemeFreshness(dir string, sk *ecdsa.PrivateKey) error {
+	conf, id, err := schemeDirConfiguration(dir)
+	if err != nil {
+		return err
+	}
+	return conf.AssertSchemeFreshness(id, sk)
+}
+
+// AssertSchemeFreshness writes a freshness assertion for the specified scheme of the configuration,
+// as the package-level AssertSchemeFreshness() does.
+func (conf *Configuration) AssertSchemeFreshness(id SchemeManagerIdentifier, sk *ecdsa.PrivateKey) error {
+	dir := filepath.Join(conf.Path, id.String())
+	timestamp, exists, err := readTimestamp(filepath.Join(dir, "timestamp"))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("Scheme has no timestamp")
+	}
+	bts := []byte(schemeFreshness{Timestamp: *timestamp, Asserted: Timestamp(Now())}.String())
+	sig, err := SignSchemeIndex(bts, sk)
+	if err != nil {
+		return err
+	}
+	if err = conf.saveFile(filepath.Join(dir, "freshness"), bts); err != nil {
+		return errors.WrapPrefix(err, "Failed to write freshness", 0)
+	}
+	if err = conf.saveFile(filepath.Join(dir, "freshness.sig"), sig); err != nil {
+		return errors.WrapPrefix(err, "Failed to write freshness.sig", 0)
+	}
+	return nil
+}
@@ -172,6 +172,46 @@ func (id *AttributeTypeIdentifier) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// GobEncode implements gob.GobEncoder, as used by the scheme cache.
+func (id SchemeManagerIdentifier) GobEncode() ([]byte, error) {
+	return id.MarshalText()
+}
+
+// GobDecode implements gob.GobDecoder.
+func (id *SchemeManagerIdentifier) GobDecode(bts []byte) error {
+	return id.UnmarshalText(bts)
+}
+
+// GobEncode implements gob.GobEncoder, as used by the scheme cache.
+func (id IssuerIdentifier) GobEncode() ([]byte, error) {
+	return id.MarshalText()
+}
+
+// GobDecode implements gob.GobDecoder.
+func (id *IssuerIdentifier) GobDecode(bts []byte) error {
+	return id.UnmarshalText(bts)
+}
+
+// GobEncode implements gob.GobEncoder, as used by the scheme cache.
+func (id CredentialTypeIdentifier) GobEncode() ([]byte, error) {
+	return id.MarshalText()
+}
+
+// GobDecode implements gob.GobDecoder.
+func (id *CredentialTypeIdentifier) GobDecode(bts []byte) error {
+	return id.UnmarshalText(bts)
+}
+
+// GobEncode implements gob.GobEncoder, as used by the scheme cache.
+func (id AttributeTypeIdentifier) GobEncode() ([]byte, error) {
+	return id.MarshalText()
+}
+
+// GobDecode implements gob.GobDecoder.
+func (id *AttributeTypeIdentifier) GobDecode(bts []byte) error {
+	return id.UnmarshalText(bts)
+}
+
 func (set *IrmaIdentifierSet) Distributed(conf *Configuration) bool {
 	for id := range set.SchemeManagers {
 		if conf.SchemeManagers[id].Distributed() {
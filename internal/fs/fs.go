@@ -138,6 +138,21 @@ func CopyDirectory(src, dest string) error {
 	)
 }
 
+// DirectorySize returns the total size in bytes of all files in the specified directory and its subdirectories.
+func DirectorySize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 // ReadKey returns either the content of the file specified at path, if it exists,
 // or []byte(key) otherwise. It is an error to specify both or none arguments, or
 // specify an empty or unreadable file. If there is no error then the return []byte is non-empty.
@@ -0,0 +1,47 @@
+package servercore
+
+import (
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// This file contains the management of the server at runtime, for the admin API of the
+// requestor server: listing the unfinished sessions and updating the schemes. Sessions are
+// cancelled using CancelSession().
+
+// ActiveSessions returns the sessions that have not yet finished.
+func (s *Server) ActiveSessions() ([]*server.SessionInfo, error) {
+	sessions := []*server.SessionInfo{}
+	err := s.sessions.forEach(func(session *session) {
+		if session.status.Finished() {
+			return
+		}
+		sessions = append(sessions, &server.SessionInfo{
+			Token:      session.token,
+			Type:       session.action,
+			Status:     session.status,
+			Started:    irma.Timestamp(session.started),
+			LastActive: irma.Timestamp(session.lastActive),
+			Expiry:     irma.Timestamp(session.expiry()),
+		})
+	})
+	if err != nil {
+		return nil, server.LogError(err)
+	}
+	return sessions, nil
+}
+
+// UpdateSchemes updates all schemes immediately, instead of waiting for the next periodic update.
+func (s *Server) UpdateSchemes() error {
+	if err := s.conf.IrmaConfiguration.UpdateSchemes(); err != nil {
+		return server.LogError(err)
+	}
+	s.conf.Logger.Info("Schemes updated")
+	return nil
+}
+
+// DisabledSchemes returns the schemes that could not be parsed, and which are therefore not used
+// by the server, along with the reason why.
+func (s *Server) DisabledSchemes() map[irma.SchemeManagerIdentifier]*irma.SchemeManagerError {
+	return s.conf.IrmaConfiguration.Snapshot().DisabledSchemeManagers
+}
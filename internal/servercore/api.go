@@ -6,15 +6,12 @@ package servercore
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
-	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
@@ -25,32 +22,101 @@ import (
 
 type Server struct {
 	conf          *server.Configuration
-	sessions      sessionStore
-	scheduler     *gocron.Scheduler
-	stopScheduler chan bool
+	sessions      SessionStore
+	stopScheduler chan struct{}
+	sandbox       *sandboxClient
+	subscriptions *statusSubscriptions
+	callbackKey   []byte
+	drainer       *drainer
+
+	// The IRMA configuration and private key ring that we created ourselves (as opposed to having
+	// been passed them), whose private keys we wipe from memory in Stop()
+	ownConfiguration *irma.Configuration
+	ownKeyRing       *irma.PrivateKeyRingPath
 }
 
 func New(conf *server.Configuration) (*Server, error) {
 	s := &Server{
-		conf:      conf,
-		scheduler: gocron.NewScheduler(),
-		sessions: &memorySessionStore{
-			requestor: make(map[string]*session),
-			client:    make(map[string]*session),
-			conf:      conf,
-		},
-	}
-	s.scheduler.Every(10).Seconds().Do(func() {
-		s.sessions.deleteExpired()
-	})
-	s.stopScheduler = s.scheduler.Start()
-
-	return s, s.verifyConfiguration(s.conf)
+		conf:          conf,
+		stopScheduler: make(chan struct{}),
+		subscriptions: newStatusSubscriptions(),
+		drainer:       newDrainer(),
+	}
+	if err := s.verifyConfiguration(s.conf); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.sessions, err = s.newSessionStore(); err != nil {
+		return nil, server.LogError(err)
+	}
+	go s.deleteExpiredSessions()
+
+	return s, nil
+}
+
+func (s *Server) newSessionStore() (SessionStore, error) {
+	switch s.conf.StoreType {
+	case "", "memory":
+		return &memorySessionStore{
+			requestor:     make(map[string]*session),
+			client:        make(map[string]*session),
+			conf:          s.conf,
+			subscriptions: s.subscriptions,
+		}, nil
+	case "redis":
+		return newRedisSessionStore(s.conf, s.subscriptions)
+	case "postgres":
+		return newPostgresSessionStore(s.conf, s.subscriptions)
+	default:
+		return nil, errors.Errorf("Unknown session store type %s", s.conf.StoreType)
+	}
+}
+
+// deleteExpiredSessions periodically removes expired sessions from the session store,
+// until Stop() is called.
+func (s *Server) deleteExpiredSessions() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopScheduler:
+			return
+		case <-ticker.C:
+			s.sessions.deleteExpired()
+		}
+	}
+}
+
+// lockSession returns the session with the specified requestor or client token, locked (see
+// SessionStore.lock()), or nil if it does not exist. The caller must unlock the session afterwards.
+func (s *Server) lockSession(token string, requestor bool) (*session, error) {
+	var session *session
+	var err error
+	if requestor {
+		session, err = s.sessions.get(token)
+	} else {
+		session, err = s.sessions.clientGet(token)
+	}
+	if err != nil || session == nil {
+		return nil, err
+	}
+	return s.sessions.lock(session)
 }
 
 func (s *Server) Stop() {
-	s.stopScheduler <- true
+	close(s.stopScheduler)
 	s.sessions.stop()
+
+	// Only wipe the keys once the calls that may be using them, and the callbacks, have finished
+	s.drainer.keysUnused()
+	s.drainer.callbacks.Wait()
+	irma.SecureBytes(s.callbackKey).Wipe()
+	if s.ownKeyRing != nil {
+		s.ownKeyRing.Close()
+	}
+	if s.ownConfiguration != nil {
+		s.ownConfiguration.Close()
+	}
 }
 
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
@@ -86,6 +152,19 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		if err = s.conf.IrmaConfiguration.ParseFolder(); err != nil {
 			return server.LogError(err)
 		}
+		s.ownConfiguration = s.conf.IrmaConfiguration
+	}
+
+	if len(s.conf.SchemesEnvironments) == 0 && s.conf.Production {
+		s.conf.SchemesEnvironments = []string{string(irma.SchemeEnvironmentProduction)}
+	}
+	s.conf.IrmaConfiguration.Environments = nil
+	for _, env := range s.conf.SchemesEnvironments {
+		e := irma.SchemeEnvironment(env)
+		if e != irma.SchemeEnvironmentDemo && e != irma.SchemeEnvironmentProduction {
+			return server.LogError(errors.Errorf("Unknown scheme environment %s", env))
+		}
+		s.conf.IrmaConfiguration.Environments = append(s.conf.IrmaConfiguration.Environments, e)
 	}
 
 	if len(s.conf.IrmaConfiguration.SchemeManagers) == 0 {
@@ -101,29 +180,33 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		s.conf.IrmaConfiguration.AutoUpdateSchemes(uint(s.conf.SchemesUpdateInterval))
 	}
 
+	if s.conf.AuditLogPath != "" {
+		if err := s.conf.IrmaConfiguration.AuditLog().SetSink(irma.NewAuditFileSink(s.conf.AuditLogPath)); err != nil {
+			return server.LogError(err)
+		}
+	}
+
 	if s.conf.IssuerPrivateKeys == nil {
 		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
 	}
+	if s.conf.IssuerPrivateKeysPassphrase != "" {
+		if err := s.conf.IrmaConfiguration.UnlockPrivateKeys(s.conf.IssuerPrivateKeysPassphrase); err != nil {
+			return server.LogError(err)
+		}
+		if s.conf.IssuerPrivateKeyDecrypter == nil {
+			s.conf.IssuerPrivateKeyDecrypter = irma.PassphraseDecrypter(s.conf.IssuerPrivateKeysPassphrase)
+		}
+	}
 	if s.conf.IssuerPrivateKeysPath != "" {
-		files, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
+		ring, err := irma.NewPrivateKeyRingPath(s.conf.IssuerPrivateKeysPath, s.conf.IrmaConfiguration, s.conf.IssuerPrivateKeyDecrypter)
 		if err != nil {
 			return server.LogError(err)
 		}
-		for _, file := range files {
-			filename := file.Name()
-			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
-				s.conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
-				continue
-			}
-			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
-			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
-			if err != nil {
-				return server.LogError(err)
-			}
-			s.conf.IssuerPrivateKeys[issid] = sk
+		s.ownKeyRing = ring
+		if s.conf.IssuerPrivateKeyRing == nil {
+			s.conf.IssuerPrivateKeyRing = ring
+		} else {
+			s.conf.IssuerPrivateKeyRing = irma.PrivateKeyRingMerged{ring, s.conf.IssuerPrivateKeyRing}
 		}
 	}
 	for issid, sk := range s.conf.IssuerPrivateKeys {
@@ -139,6 +222,28 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		}
 	}
 
+	if s.conf.Sandbox {
+		if s.conf.Production {
+			return server.LogError(errors.New("Sandbox mode is not allowed in production mode"))
+		}
+		var err error
+		if s.sandbox, err = s.newSandboxClient(); err != nil {
+			return server.LogError(err)
+		}
+		s.conf.Logger.WithField("credentials", len(s.sandbox.credentials)).Warn("Sandbox mode enabled: sessions can be completed by a simulated IRMA app")
+	}
+
+	if s.conf.ClientTimeout < 0 || s.conf.SessionLifetime < 0 || s.conf.ResultRetention < 0 {
+		return server.LogError(errors.New("client_timeout, session_lifetime and result_retention must not be negative"))
+	}
+
+	if s.conf.CallbackHmacKey != "" {
+		var err error
+		if s.callbackKey, err = fs.Base64Decode([]byte(s.conf.CallbackHmacKey)); err != nil {
+			return server.LogError(errors.WrapPrefix(err, "Failed to base64 decode callback HMAC key", 0))
+		}
+	}
+
 	if s.conf.URL != "" {
 		if !strings.HasSuffix(s.conf.URL, "/") {
 			s.conf.URL = s.conf.URL + "/"
@@ -172,34 +277,120 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 }
 
 func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
+	defer s.drainer.useKeys()()
+
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
 		return nil, "", err
 	}
 
 	request := rrequest.SessionRequest()
+	if err := s.verifyRequestSignature(rrequest); err != nil {
+		return nil, "", err
+	}
 	action := request.Action()
+	conf := s.conf.IrmaConfiguration.Snapshot()
+	for id := range request.Identifiers().SchemeManagers {
+		if !conf.EnvironmentAllowed(id) {
+			return nil, "", server.LogWarning(errors.Errorf("Scheme %s is unknown or its environment is not allowed", id))
+		}
+	}
 	if action == irma.ActionIssuing {
-		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
+		if err := s.resolveAttributeValues(request.(*irma.IssuanceRequest), nil); err != nil {
+			return nil, "", err
+		}
+		if err := s.validateIssuanceRequest(conf, request.(*irma.IssuanceRequest)); err != nil {
+			return nil, "", err
+		}
+	}
+	callbackUrl := rrequest.Base().CallbackUrl
+	if callbackUrl != "" {
+		if err := s.validateCallbackUrl(callbackUrl); err != nil {
+			return nil, "", err
+		}
+	}
+	if base := rrequest.Base(); base.ClientTimeout < 0 || base.SessionLifetime < 0 || base.ResultRetention < 0 {
+		return nil, "", server.LogWarning(errors.New("Session request contains negative timeout, lifetime or retention"))
+	}
+	if nextSessionUrl := rrequest.Base().NextSessionUrl; nextSessionUrl != "" {
+		if action != irma.ActionDisclosing {
+			return nil, "", server.LogWarning(errors.New("Only disclosure sessions can have a next session"))
+		}
+		if err := s.validateCallbackUrl(nextSessionUrl); err != nil {
 			return nil, "", err
 		}
 	}
 
-	session := s.newSession(action, rrequest)
+	if !s.drainer.acquire() {
+		return nil, "", server.LogWarning(errors.New("Server is shutting down"))
+	}
+	session, err := s.newSession(action, rrequest, conf)
+	if err != nil {
+		s.drainer.started("")
+		return nil, "", server.LogError(err)
+	}
+	if callbackUrl != "" {
+		s.startCallback(session.token, callbackUrl)
+	}
+	s.drainer.started(session.token)
 	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
 	} else {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
 	}
+	for _, warning := range conf.Deprecations(request) {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Warn(warning)
+	}
+	expiry := irma.Timestamp(session.clientExpiry())
 	return &irma.Qr{
-		Type: action,
-		URL:  s.conf.URL + session.clientToken,
+		Type:   action,
+		URL:    s.conf.URL + session.clientToken,
+		Expiry: &expiry,
 	}, session.token, nil
 }
 
+func (s *Server) PreviewIssuance(req interface{}) ([]*irma.CredentialInfo, error) {
+	defer s.drainer.useKeys()()
+
+	rrequest, err := server.ParseSessionRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	request, ok := rrequest.SessionRequest().(*irma.IssuanceRequest)
+	if !ok {
+		return nil, server.LogWarning(errors.New("Not an issuance request"))
+	}
+	conf := s.conf.IrmaConfiguration.Snapshot()
+	for id := range request.Identifiers().SchemeManagers {
+		if !conf.EnvironmentAllowed(id) {
+			return nil, server.LogWarning(errors.Errorf("Scheme %s is unknown or its environment is not allowed", id))
+		}
+	}
+	if err = s.resolveAttributeValues(request, nil); err != nil {
+		return nil, err
+	}
+	if err = s.validateIssuanceRequest(conf, request); err != nil {
+		return nil, err
+	}
+
+	creds := make([]*irma.CredentialInfo, 0, len(request.Credentials))
+	for _, cred := range request.Credentials {
+		attrs, err := cred.AttributeList(conf, 0x03)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, attrs.Info())
+	}
+	return creds, nil
+}
+
 func (s *Server) GetSessionResult(token string) *server.SessionResult {
-	session := s.sessions.get(token)
+	session, err := s.sessions.get(token)
+	if err != nil {
+		_ = server.LogError(err)
+		return nil
+	}
 	if session == nil {
 		s.conf.Logger.Warn("Session result requested of unknown session ", token)
 		return nil
@@ -208,7 +399,11 @@ func (s *Server) GetSessionResult(token string) *server.SessionResult {
 }
 
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
-	session := s.sessions.get(token)
+	session, err := s.sessions.get(token)
+	if err != nil {
+		_ = server.LogError(err)
+		return nil
+	}
 	if session == nil {
 		s.conf.Logger.Warn("Session request requested of unknown session ", token)
 		return nil
@@ -217,10 +412,14 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 }
 
 func (s *Server) CancelSession(token string) error {
-	session := s.sessions.get(token)
+	session, err := s.lockSession(token, true)
+	if err != nil {
+		return server.LogError(err)
+	}
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
+	defer session.unlock()
 	session.handleDelete()
 	return nil
 }
@@ -239,22 +438,18 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 		return errors.New("Server sent events disabled")
 	}
 
-	var session *session
-	if requestor {
-		session = s.sessions.get(token)
-	} else {
-		session = s.sessions.clientGet(token)
+	session, err := s.lockSession(token, requestor)
+	if err != nil {
+		return server.LogError(err)
 	}
 	if session == nil {
 		return server.LogError(errors.Errorf("can't subscribe to server sent events of unknown session %s", token))
 	}
+	defer session.unlock()
 	if session.status.Finished() {
 		return server.LogError(errors.Errorf("can't subscribe to server sent events of finished session %s", token))
 	}
 
-	session.Lock()
-	defer session.Unlock()
-
 	// The EventSource.onopen Javascript callback is not consistently called across browsers (Chrome yes, Firefox+Safari no).
 	// However, when the SSE connection has been opened the webclient needs some signal so that it can early detect SSE failures.
 	// So we manually send an "open" event. Unfortunately:
@@ -270,12 +465,32 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
+// SubscribeStatus returns a channel on which the current status of the session with the specified
+// requestor token is sent, followed by each subsequent status update. The channel is closed after
+// the session has finished, when the session is deleted, or when the server stops. If the session
+// does not exist, a closed channel is returned.
+func (s *Server) SubscribeStatus(token string) <-chan server.Status {
+	session, err := s.lockSession(token, true)
+	if err != nil {
+		_ = server.LogError(err)
+	}
+	if session == nil {
+		c := make(chan server.Status)
+		close(c)
+		return c
+	}
+	defer session.unlock()
+	return s.subscriptions.add(session)
+}
+
 func (s *Server) HandleProtocolMessage(
 	path string,
 	method string,
 	headers map[string][]string,
 	message []byte,
 ) (status int, output []byte, result *server.SessionResult) {
+	defer s.drainer.useKeys()()
+
 	// Parse path into session and action
 	if len(path) > 0 { // Remove any starting and trailing slash
 		if path[0] == '/' {
@@ -298,14 +513,18 @@ func (s *Server) HandleProtocolMessage(
 	}
 
 	// Fetch the session
-	session := s.sessions.clientGet(token)
+	session, err := s.lockSession(token, false)
+	if err != nil {
+		_ = server.LogError(err)
+		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorUnknown, ""))
+		return
+	}
 	if session == nil {
 		s.conf.Logger.WithField("clientToken", token).Warn("Session not found")
 		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorSessionUnknown, ""))
 		return
 	}
-	session.Lock()
-	defer session.Unlock()
+	defer session.unlock()
 
 	// However we return, if the session status has been updated
 	// then we should inform the user by returning a SessionResult
@@ -316,6 +535,13 @@ func (s *Server) HandleProtocolMessage(
 		}
 	}()
 
+	// Don't leave the session dangling if handling the message panics
+	defer func() {
+		if e := recover(); e != nil {
+			status, output = server.JsonResponse(nil, session.failPanic(e))
+		}
+	}()
+
 	// Route to handler
 	switch len(noun) {
 	case 0:
@@ -365,7 +591,12 @@ func (s *Server) HandleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, ""))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostCommitments(commitments))
+			response, rerr := session.handlePostCommitments(commitments)
+			if rerr == nil && session.version.Below(2, 5) {
+				status, output = server.JsonResponse(response.Signatures, nil)
+				return
+			}
+			status, output = server.JsonResponse(response, rerr)
 			return
 		}
 		if noun == "proofs" && session.action == irma.ActionDisclosing {
@@ -374,7 +605,12 @@ func (s *Server) HandleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, ""))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostDisclosure(disclosure))
+			response, rerr := session.handlePostDisclosure(disclosure, s.startNextSession)
+			if rerr == nil && session.version.Below(2, 6) {
+				status, output = server.JsonResponse(response.ProofStatus, nil)
+				return
+			}
+			status, output = server.JsonResponse(response, rerr)
 			return
 		}
 		if noun == "proofs" && session.action == irma.ActionSigning {
@@ -0,0 +1,146 @@
+package servercore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains the delivery of session results to the callbackUrl of session requests
+// (see irma.RequestorBaseRequest), so that requestors need not poll for the result. Once the
+// session has finished (including by timing out), its result is POSTed to the callback URL, signed
+// either as a JWT (if server.Configuration.ResultJwtSigner is set) or using HMAC-SHA256 (using
+// server.Configuration.CallbackHmacKey). Failed deliveries are retried with exponential backoff,
+// until the server is stopped.
+
+const (
+	// CallbackSignatureHeader is the header containing the hex-encoded HMAC-SHA256 over the
+	// timestamp in the CallbackTimestampHeader, a dot, and the body of session results POSTed to
+	// callback URLs, if they are signed using the CallbackHmacKey.
+	CallbackSignatureHeader = "X-IRMA-Signature"
+	// CallbackTimestampHeader is the header containing the time (in Unix seconds) at which the
+	// session result was signed using the CallbackHmacKey. Receivers should reject old timestamps,
+	// so that captured results cannot be replayed.
+	CallbackTimestampHeader = "X-IRMA-Timestamp"
+)
+
+var (
+	// Number of attempts at POSTing a session result before giving up
+	callbackAttempts = 5
+	// Delay before the second attempt, which doubles after each subsequent failed attempt
+	callbackBackoff = time.Second
+
+	callbackClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func (s *Server) validateCallbackUrl(callbackUrl string) error {
+	if s.conf.ResultJwtSigner == nil && s.callbackKey == nil {
+		return server.LogWarning(errors.New("Session request contains callbackUrl but no JWT private key or callback HMAC key is configured"))
+	}
+	if u, err := url.ParseRequestURI(callbackUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return server.LogWarning(errors.Errorf("Invalid callbackUrl %s", callbackUrl))
+	}
+	return nil
+}
+
+// startCallback POSTs the result of the session to the callback URL once the session has finished.
+func (s *Server) startCallback(token, callbackUrl string) {
+	statuses := s.SubscribeStatus(token)
+	s.drainer.callbacks.Add(1)
+	go func() {
+		defer s.drainer.callbacks.Done()
+		for range statuses {
+		}
+		result := s.GetSessionResult(token)
+		if result == nil || !result.Status.Finished() {
+			return // the server was stopped
+		}
+		s.postCallback(callbackUrl, result)
+	}()
+}
+
+func (s *Server) postCallback(callbackUrl string, result *server.SessionResult) {
+	logger := s.conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		// Sign for each attempt, so that the timestamp of the signature is recent
+		body, header, err := s.signCallback(result)
+		if err != nil {
+			_ = server.LogError(errors.WrapPrefix(err, "Failed to sign session result for callback", 0))
+			return
+		}
+		logger.Debug("POSTing session result")
+		if err = doCallback(callbackUrl, body, header); err == nil {
+			return
+		}
+		if attempt == callbackAttempts {
+			logger.Warn("Failed to POST session result to callback URL, giving up: ", err.Error())
+			return
+		}
+		logger.Debugf("Failed to POST session result to callback URL, retrying in %s: %s", backoff, err.Error())
+		select {
+		case <-s.stopScheduler:
+			logger.Warn("Server stopped, giving up POSTing session result to callback URL")
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// signCallback returns the body to be POSTed to the callback URL, along with its headers: its
+// content type and, if the body is not a JWT, the current timestamp and the HMAC over both.
+func (s *Server) signCallback(result *server.SessionResult) ([]byte, http.Header, error) {
+	header := http.Header{}
+	if s.conf.ResultJwtSigner != nil {
+		j, err := s.conf.ResultJwtSigner(result)
+		header.Set("Content-Type", "text/plain; charset=UTF-8")
+		return []byte(j), header, err
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return nil, nil, err
+	}
+	timestamp := strconv.FormatInt(irma.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, s.callbackKey)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set(CallbackTimestampHeader, timestamp)
+	header.Set(CallbackSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return body, header, nil
+}
+
+func doCallback(callbackUrl string, body []byte, header http.Header) error {
+	res, err := postResult(callbackUrl, body, header)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("callback URL responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// postResult POSTs a session result signed by signCallback() to the specified URL.
+func postResult(url string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("User-Agent", "irmaserver")
+	return callbackClient.Do(req)
+}
@@ -0,0 +1,90 @@
+package servercore
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains chained sessions. If the request of a disclosure session specifies a
+// nextSessionUrl, then once the disclosed attributes have been verified, the session result is
+// POSTed to that URL, signed in the same way as results POSTed to callback URLs. The requestor
+// responds with the request of the next session (e.g. an issuance request containing attributes
+// based on the disclosed ones), or with 204 No Content if no next session is to be performed.
+// The server starts the next session immediately, and returns its session pointer to the IRMA app
+// along with the proof status, so that the app continues with it without the user having to scan
+// another QR. The requestor token of the next session is included in the result of the first
+// session, so that requestors can follow the entire chain starting from the first token.
+// If the next session cannot be started, the first session fails as well.
+
+// startNextSession starts the next session of the session, if its request specifies one.
+func (s *Server) startNextSession(session *session) (*irma.Qr, *irma.RemoteError) {
+	url := session.rrequest.Base().NextSessionUrl
+	if url == "" {
+		return nil, nil
+	}
+	logger := s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "nextSessionUrl": url})
+
+	result := *session.result
+	result.Status = server.StatusDone
+	request, err := s.fetchNextSession(url, &result)
+	if err != nil {
+		logger.Warn("Failed to obtain next session request: ", err.Error())
+		return nil, session.fail(server.ErrorNextSession, err.Error())
+	}
+	if request == nil {
+		logger.Info("Requestor did not provide a next session")
+		return nil, nil
+	}
+	if ir, ok := request.SessionRequest().(*irma.IssuanceRequest); ok {
+		// Attribute value providers may base the values of the next session on the disclosed attributes
+		if err = s.resolveAttributeValues(ir, session.result.Disclosed); err != nil {
+			logger.Warn("Failed to retrieve attribute values of next session: ", err.Error())
+			return nil, session.fail(server.ErrorNextSession, err.Error())
+		}
+	}
+
+	var qr *irma.Qr
+	var token string
+	if s.conf.NextSessionStarter != nil {
+		qr, token, err = s.conf.NextSessionStarter(session.token, request)
+	} else {
+		qr, token, err = s.StartSession(request)
+	}
+	if err != nil {
+		logger.Warn("Failed to start next session: ", err.Error())
+		return nil, session.fail(server.ErrorNextSession, err.Error())
+	}
+	logger.WithField("nextSession", token).Info("Next session started")
+	session.result.NextSession = token
+	return qr, nil
+}
+
+// fetchNextSession POSTs the session result to the URL, and returns the session request with
+// which the requestor responds, or nil if it responds with 204 No Content.
+func (s *Server) fetchNextSession(url string, result *server.SessionResult) (irma.RequestorRequest, error) {
+	body, header, err := s.signCallback(result)
+	if err != nil {
+		return nil, err
+	}
+	res, err := postResult(url, body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("next session URL responded with status %d", res.StatusCode)
+	}
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return server.ParseSessionRequest(bts)
+}
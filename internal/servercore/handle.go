@@ -1,6 +1,8 @@
 package servercore
 
 import (
+	"fmt"
+
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
@@ -33,6 +35,9 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 		return nil, session.fail(server.ErrorProtocolVersion, "")
 	}
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "version": session.version.String()}).Debugf("Protocol version negotiated")
+	if session.rrequest.Base().NextSessionUrl != "" && session.version.Below(2, 6) {
+		return nil, session.fail(server.ErrorProtocolVersion, "next sessions require protocol version 2.6")
+	}
 	session.request.SetVersion(session.version)
 
 	session.setStatus(server.StatusConnected)
@@ -53,12 +58,15 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	var rerr *irma.RemoteError
 	session.result.Signature = signature
 	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.SignatureRequest))
+		session.irmaConfiguration, session.request.(*irma.SignatureRequest))
 	if err == nil {
+		session.logDisclosure()
 		session.setStatus(server.StatusDone)
 	} else {
 		if err == irma.ErrorMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+		} else if _, ok := err.(*irma.CredentialTypeError); ok {
+			rerr = session.fail(server.ErrorUnknownCredentialType, err.Error())
 		} else {
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
@@ -66,7 +74,11 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostDisclosure(disclosure irma.Disclosure) (*irma.ProofStatus, *irma.RemoteError) {
+// handlePostDisclosure verifies the disclosure, after which startNext starts the next session of
+// the session, if any (see chain.go).
+func (session *session) handlePostDisclosure(
+	disclosure irma.Disclosure, startNext func(*session) (*irma.Qr, *irma.RemoteError),
+) (*irma.DisclosureResponse, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
@@ -74,21 +86,31 @@ func (session *session) handlePostDisclosure(disclosure irma.Disclosure) (*irma.
 
 	var err error
 	var rerr *irma.RemoteError
+	response := &irma.DisclosureResponse{}
 	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+		session.irmaConfiguration, session.request.(*irma.DisclosureRequest))
 	if err == nil {
+		session.logDisclosure()
+		if session.result.ProofStatus == irma.ProofStatusValid {
+			if response.NextSession, rerr = startNext(session); rerr != nil {
+				return nil, rerr
+			}
+		}
 		session.setStatus(server.StatusDone)
 	} else {
 		if err == irma.ErrorMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+		} else if _, ok := err.(*irma.CredentialTypeError); ok {
+			rerr = session.fail(server.ErrorUnknownCredentialType, err.Error())
 		} else {
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
 	}
-	return &session.result.ProofStatus, rerr
+	response.ProofStatus = session.result.ProofStatus
+	return response, rerr
 }
 
-func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
+func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) (*irma.IssuanceResponse, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
@@ -103,13 +125,13 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 
 	// Compute list of public keys against which to verify the received proofs
 	disclosureproofs := irma.ProofList(commitments.Proofs[:discloseCount])
-	pubkeys, err := disclosureproofs.ExtractPublicKeys(session.conf.IrmaConfiguration)
+	pubkeys, err := disclosureproofs.ExtractPublicKeys(session.irmaConfiguration)
 	if err != nil {
 		return nil, session.fail(server.ErrorInvalidProofs, err.Error())
 	}
 	for _, cred := range request.Credentials {
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		pubkey, _ := session.conf.IrmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
+		pubkey, _ := session.irmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
 		pubkeys = append(pubkeys, pubkey)
 	}
 
@@ -117,7 +139,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	for i, proof := range commitments.Proofs {
 		pubkey := pubkeys[i]
 		schemeid := irma.NewIssuerIdentifier(pubkey.Issuer).SchemeManagerIdentifier()
-		if session.conf.IrmaConfiguration.SchemeManagers[schemeid].Distributed() {
+		if session.irmaConfiguration.SchemeManagers[schemeid].Distributed() {
 			proofP, err := session.getProofP(commitments, schemeid)
 			if err != nil {
 				return nil, session.fail(server.ErrorKeyshareProofMissing, err.Error())
@@ -128,7 +150,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 
 	// Verify all proofs and check disclosed attributes, if any, against request
 	session.result.Disclosed, session.result.ProofStatus, err = commitments.Disclosure().VerifyAgainstDisjunctions(
-		session.conf.IrmaConfiguration, request.Disclose, request.Context, request.Nonce, pubkeys, false)
+		session.irmaConfiguration, request.Disclose, request.Context, request.Nonce, pubkeys, false)
 	if err != nil {
 		if err == irma.ErrorMissingPublicKey {
 			return nil, session.fail(server.ErrorUnknownPublicKey, "")
@@ -142,16 +164,27 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
+	session.logDisclosure()
+
+	modified, rerr := session.applyIssuanceCondition(request)
+	if rerr != nil {
+		return nil, rerr
+	}
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
 	for i, cred := range request.Credentials {
 		id := cred.CredentialTypeID.IssuerIdentifier()
-		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := session.conf.PrivateKey(id)
+		pk, _ := session.irmaConfiguration.PublicKey(id, cred.KeyCounter)
+		sk, _ := session.conf.PrivateKey(id, cred.KeyCounter)
 		issuer := gabi.NewIssuer(sk, pk, one)
 		proof := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
-		attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, 0x03)
+		attributes, err := cred.AttributeList(session.irmaConfiguration, 0x03)
+		if err != nil {
+			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+		}
+		err = session.irmaConfiguration.AuditLog().Record(irma.AuditEventIssuance,
+			fmt.Sprintf("%s-%d", id, cred.KeyCounter), cred.CredentialTypeID.String())
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 		}
@@ -163,5 +196,9 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	}
 
 	session.setStatus(server.StatusDone)
-	return sigs, nil
+	response := &irma.IssuanceResponse{Signatures: sigs}
+	if modified {
+		response.Credentials = request.Credentials
+	}
+	return response, nil
 }
@@ -28,7 +28,9 @@ func (session *session) setStatus(status server.Status) {
 		Info("Session status updated")
 	session.status = status
 	session.result.Status = status
-	session.sessions.update(session)
+	if err := session.sessions.update(session); err != nil {
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Error("Failed to update session: ", err.Error())
+	}
 }
 
 func (session *session) onUpdate() {
@@ -47,39 +49,74 @@ func (session *session) fail(err server.Error, message string) *irma.RemoteError
 	return rerr
 }
 
+// failPanic marks the session as failed after recovering from a panic while handling it.
+func (session *session) failPanic(e interface{}) *irma.RemoteError {
+	rerr := server.PanicError(e)
+	session.setStatus(server.StatusCancelled)
+	session.result = &server.SessionResult{
+		Err:     rerr,
+		ErrorID: rerr.ErrorID,
+		Token:   session.token,
+		Status:  server.StatusCancelled,
+		Type:    session.action,
+	}
+	return rerr
+}
+
+// logDisclosure logs the identifiers (but not the values) of the disclosed attributes, along with
+// the reason, if any, that the requestor gave for the disjunction that each attribute satisfies.
+func (session *session) logDisclosure() {
+	disjunctions := session.request.ToDisclose()
+	for i, attr := range session.result.Disclosed {
+		fields := logrus.Fields{"session": session.token, "attribute": attr.Identifier.String(), "status": attr.Status}
+		if i < len(disjunctions) && len(disjunctions[i].Reason) > 0 {
+			fields["reason"] = disjunctions[i].Reason
+		}
+		session.conf.Logger.WithFields(fields).Info("Attribute disclosed")
+	}
+}
+
+// verifyRequestSignature checks that the session request carries a valid signature of the party
+// approving session requests, if the server is configured with its key.
+func (s *Server) verifyRequestSignature(rrequest irma.RequestorRequest) error {
+	if s.conf.RequestApprovalKey == nil {
+		return nil
+	}
+	sig := rrequest.Base().RequestSignature
+	if sig == nil {
+		return server.LogWarning(errors.New("Session request is not signed by the approving party"))
+	}
+	if err := sig.Verify(rrequest.SessionRequest(), s.conf.RequestApprovalKey); err != nil {
+		return server.LogWarning(errors.WrapPrefix(err, "Invalid session request signature", 0))
+	}
+	return nil
+}
+
 // Issuance helpers
 
-func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+func (s *Server) validateIssuanceRequest(conf *irma.Configuration, request *irma.IssuanceRequest) error {
 	for _, cred := range request.Credentials {
 		// Check that we have the appropriate private key
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.PrivateKey(iss)
-		if err != nil {
-			return err
-		}
-		if privatekey == nil {
-			return errors.Errorf("missing private key of issuer %s", iss.String())
-		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, int(privatekey.Counter))
+		privatekey, err := s.issuerPrivateKey(conf, iss)
 		if err != nil {
 			return err
 		}
-		if pubkey == nil {
-			return errors.Errorf("missing public key of issuer %s", iss.String())
-		}
 		cred.KeyCounter = int(privatekey.Counter)
 
-		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		// Check that the credential is consistent with irma_configuration, after bringing its
+		// attribute values in the canonical form prescribed by the scheme
+		cred.Canonicalize(conf)
+		if err := cred.Validate(conf); err != nil {
 			return err
 		}
 
 		// Ensure the credential has an expiry date
-		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
+		defaultValidity := irma.Timestamp(irma.Now().AddDate(0, 6, 0))
 		if cred.Validity == nil {
 			cred.Validity = &defaultValidity
 		}
-		if cred.Validity.Before(irma.Timestamp(time.Now())) {
+		if cred.Validity.Before(irma.Timestamp(irma.Now())) {
 			return errors.New("cannot issue expired credentials")
 		}
 	}
@@ -87,6 +124,152 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 	return nil
 }
 
+// resolveAttributeValues retrieves the attribute values of the credentials in the request that
+// specify an attribute value provider, and removes the provider fields from them.
+func (s *Server) resolveAttributeValues(request *irma.IssuanceRequest, disclosed []*irma.DisclosedAttribute) error {
+	for _, cred := range request.Credentials {
+		if cred.Provider == "" {
+			continue
+		}
+		attrs, err := s.attributeValues(cred, disclosed)
+		if err != nil {
+			return err
+		}
+		cred.Attributes, cred.Provider, cred.ProviderKey = attrs, "", ""
+	}
+	return nil
+}
+
+// attributeValues returns the attribute values of the credential request, merged with those
+// retrieved from its attribute value provider, without modifying the credential request.
+func (s *Server) attributeValues(cred *irma.CredentialRequest, disclosed []*irma.DisclosedAttribute) (map[string]string, error) {
+	provider := s.conf.AttributeValueProviders[cred.Provider]
+	if provider == nil {
+		return nil, server.LogWarning(errors.Errorf("Unknown attribute value provider %s", cred.Provider))
+	}
+	values, err := provider.AttributeValues(&server.AttributeValueRequest{
+		CredentialType: cred.CredentialTypeID,
+		Key:            cred.ProviderKey,
+		Disclosed:      disclosed,
+	})
+	if err != nil {
+		return nil, server.LogWarning(errors.WrapPrefix(err,
+			fmt.Sprintf("Attribute value provider %s failed for %s", cred.Provider, cred.CredentialTypeID), 0))
+	}
+	attrs := make(map[string]string, len(values)+len(cred.Attributes))
+	for name, value := range values {
+		attrs[name] = value
+	}
+	for name, value := range cred.Attributes {
+		attrs[name] = value
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"provider": cred.Provider, "credential": cred.CredentialTypeID.String()}).
+		Debug("Attribute values retrieved from provider")
+	return attrs, nil
+}
+
+// applyIssuanceCondition passes the disclosed attributes and copies of the credentials to be issued
+// to the IssuanceCondition of the server, if any, and records its decision for each credential in
+// the audit log. If the condition modified attribute values, the credentials in the request are
+// replaced by the modified ones and true is returned.
+func (session *session) applyIssuanceCondition(request *irma.IssuanceRequest) (bool, *irma.RemoteError) {
+	if session.conf.IssuanceCondition == nil {
+		return false, nil
+	}
+
+	credentials := make([]*irma.CredentialRequest, len(request.Credentials))
+	for i, cred := range request.Credentials {
+		c := *cred
+		c.Attributes = make(map[string]string, len(cred.Attributes))
+		for name, value := range cred.Attributes {
+			c.Attributes[name] = value
+		}
+		credentials[i] = &c
+	}
+
+	decision, modified := "approved", false
+	err := session.conf.IssuanceCondition(session.result.Disclosed, credentials)
+	if err == nil {
+		for i, cred := range credentials {
+			// Only attribute values may be modified
+			orig := request.Credentials[i]
+			cred.CredentialTypeID, cred.KeyCounter, cred.Validity = orig.CredentialTypeID, orig.KeyCounter, orig.Validity
+			if !reflect.DeepEqual(cred.Attributes, orig.Attributes) {
+				modified = true
+			}
+		}
+	}
+	if err != nil {
+		decision = "vetoed"
+	} else if modified {
+		decision = "modified"
+	}
+
+	for _, cred := range request.Credentials {
+		if aerr := session.irmaConfiguration.AuditLog().Record(irma.AuditEventIssuanceCondition,
+			fmt.Sprintf("%s-%d", cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter),
+			fmt.Sprintf("%s %s", cred.CredentialTypeID, decision)); aerr != nil {
+			return false, session.fail(server.ErrorIssuanceFailed, aerr.Error())
+		}
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "decision": decision}).
+		Info("Issuance condition applied")
+
+	if err != nil {
+		return false, session.fail(server.ErrorIssuanceDenied, err.Error())
+	}
+	if !modified {
+		return false, nil
+	}
+	for _, cred := range credentials {
+		cred.Canonicalize(session.irmaConfiguration)
+		if err = cred.Validate(session.irmaConfiguration); err != nil {
+			return false, session.fail(server.ErrorIssuanceFailed, "issuance condition produced invalid credential: "+err.Error())
+		}
+	}
+	if session.version.Below(2, 5) {
+		return false, session.fail(server.ErrorProtocolVersion, "modified credentials require protocol version 2.5")
+	}
+	request.Credentials = credentials
+	request.CredentialInfoList = nil
+	return true, nil
+}
+
+// issuerPrivateKey returns the private key of the issuer belonging to its newest nonexpired
+// public key of which we have the private key.
+func (s *Server) issuerPrivateKey(conf *irma.Configuration, iss irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	indices, err := conf.PublicKeyIndices(iss)
+	if err != nil {
+		return nil, err
+	}
+	now := irma.Now().Unix()
+	var expired bool
+	for i := len(indices) - 1; i >= 0; i-- {
+		pubkey, err := conf.PublicKey(iss, indices[i])
+		if err != nil {
+			return nil, err
+		}
+		if pubkey == nil {
+			continue
+		}
+		if pubkey.ExpiryDate <= now {
+			expired = true
+			continue
+		}
+		privatekey, err := s.conf.PrivateKey(iss, indices[i])
+		if err != nil {
+			return nil, err
+		}
+		if privatekey != nil {
+			return privatekey, nil
+		}
+	}
+	if expired {
+		return nil, errors.Errorf("missing private key of nonexpired public key of issuer %s", iss.String())
+	}
+	return nil, errors.Errorf("missing private key of issuer %s", iss.String())
+}
+
 func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier) (*gabi.ProofP, error) {
 	if session.kssProofs == nil {
 		session.kssProofs = make(map[irma.SchemeManagerIdentifier]*gabi.ProofP)
@@ -102,7 +285,7 @@ func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, sche
 			jwt.StandardClaims
 			ProofP *gabi.ProofP
 		}{}
-		token, err := jwt.ParseWithClaims(str, claims, session.conf.IrmaConfiguration.KeyshareServerKeyFunc(scheme))
+		token, err := jwt.ParseWithClaims(str, claims, session.irmaConfiguration.KeyshareServerKeyFunc(scheme))
 		if err != nil {
 			return nil, err
 		}
@@ -115,7 +298,18 @@ func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, sche
 	return session.kssProofs[scheme], nil
 }
 
-var eventHeaders = [][]byte{[]byte("Access-Control-Allow-Origin: *")}
+// eventHeaders returns the CORS headers of server sent events, allowing the origin of the
+// request if permitted by the CorsOrigins of the configuration.
+func eventHeaders(conf *server.Configuration, r *http.Request) [][]byte {
+	if len(conf.CorsOrigins) == 0 {
+		return [][]byte{[]byte("Access-Control-Allow-Origin: *")}
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || !conf.CorsOriginAllowed(origin) {
+		return nil
+	}
+	return [][]byte{[]byte("Access-Control-Allow-Origin: " + origin), []byte("Vary: Origin")}
+}
 
 func (session *session) eventSource() eventsource.EventSource {
 	if session.evtSource != nil {
@@ -123,7 +317,8 @@ func (session *session) eventSource() eventsource.EventSource {
 	}
 
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debug("Making server sent event source")
-	session.evtSource = eventsource.New(nil, func(_ *http.Request) [][]byte { return eventHeaders })
+	session.evtSource = eventsource.New(nil, func(r *http.Request) [][]byte { return eventHeaders(session.conf, r) })
+	session.sessions.listen(session)
 	return session.evtSource
 }
 
@@ -0,0 +1,196 @@
+package servercore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/antage/eventsource.v1"
+)
+
+// This file contains what the persistent session stores (Redis and Postgres) have in common:
+// (un)marshaling of sessions, and forwarding of status updates published by other servers
+// to the local server sent event listeners.
+
+const (
+	// Maximum duration for which a session may be locked, after which the lock is released
+	// (in case the server holding the lock crashed)
+	sessionLockExpiry = 30 * time.Second
+	// Maximum duration to wait for acquiring the lock of a session
+	sessionLockTimeout = 10 * time.Second
+)
+
+// sessionData is the state of a session as saved in a persistent SessionStore.
+type sessionData struct {
+	Action      irma.Action                                   `json:"action"`
+	Token       string                                        `json:"token"`
+	ClientToken string                                        `json:"clientToken"`
+	Version     *irma.ProtocolVersion                         `json:"version,omitempty"`
+	Request     json.RawMessage                               `json:"request"`
+	Status      server.Status                                 `json:"status"`
+	PrevStatus  server.Status                                 `json:"prevStatus"`
+	Started     time.Time                                     `json:"started"`
+	LastActive  time.Time                                     `json:"lastActive"`
+	Result      *server.SessionResult                         `json:"result"`
+	KssProofs   map[irma.SchemeManagerIdentifier]*gabi.ProofP `json:"kssProofs,omitempty"`
+}
+
+// statusUpdate is published by a persistent SessionStore to all servers sharing it when the
+// status of a session changes.
+type statusUpdate struct {
+	Token  string        `json:"token"`
+	Status server.Status `json:"status"`
+}
+
+// eventSources contains the server sent event sources of the sessions in a persistent
+// SessionStore that have listeners at this server, by requestor token, and forwards status
+// updates also to the subscribers of the sessions (see Server.SubscribeStatus()).
+type eventSources struct {
+	sync.Mutex
+	conf          *server.Configuration
+	sources       map[string]eventsource.EventSource
+	subscriptions *statusSubscriptions
+}
+
+func (session *session) marshal() ([]byte, error) {
+	request, err := json.Marshal(session.rrequest)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&sessionData{
+		Action:      session.action,
+		Token:       session.token,
+		ClientToken: session.clientToken,
+		Version:     session.version,
+		Request:     request,
+		Status:      session.status,
+		PrevStatus:  session.prevStatus,
+		Started:     session.started,
+		LastActive:  session.lastActive,
+		Result:      session.result,
+		KssProofs:   session.kssProofs,
+	})
+}
+
+func unmarshalSession(bts []byte, conf *server.Configuration, store SessionStore, sources *eventSources) (*session, error) {
+	var data sessionData
+	if err := json.Unmarshal(bts, &data); err != nil {
+		return nil, err
+	}
+
+	var rrequest irma.RequestorRequest
+	switch data.Action {
+	case irma.ActionDisclosing:
+		rrequest = &irma.ServiceProviderRequest{}
+	case irma.ActionSigning:
+		rrequest = &irma.SignatureRequestorRequest{}
+	case irma.ActionIssuing:
+		rrequest = &irma.IdentityProviderRequest{}
+	default:
+		return nil, errors.Errorf("session %s has unknown action %s", data.Token, data.Action)
+	}
+	if err := json.Unmarshal(data.Request, rrequest); err != nil {
+		return nil, err
+	}
+
+	return &session{
+		action:      data.Action,
+		token:       data.Token,
+		clientToken: data.ClientToken,
+		version:     data.Version,
+		rrequest:    rrequest,
+		request:     rrequest.SessionRequest(),
+		status:      data.Status,
+		prevStatus:  data.PrevStatus,
+		evtSource:   sources.get(data.Token),
+		started:     data.Started,
+		lastActive:  data.LastActive,
+		result:      data.Result,
+		kssProofs:   data.KssProofs,
+		conf:        conf,
+		sessions:    store,
+
+		irmaConfiguration: conf.IrmaConfiguration,
+	}, nil
+}
+
+func newEventSources(conf *server.Configuration, subscriptions *statusSubscriptions) *eventSources {
+	return &eventSources{conf: conf, sources: map[string]eventsource.EventSource{}, subscriptions: subscriptions}
+}
+
+func (e *eventSources) get(token string) eventsource.EventSource {
+	e.Lock()
+	defer e.Unlock()
+	return e.sources[token]
+}
+
+func (e *eventSources) add(session *session) {
+	e.Lock()
+	defer e.Unlock()
+	e.sources[session.token] = session.evtSource
+}
+
+// tokens returns the requestor tokens of the sessions having listeners or subscribers.
+func (e *eventSources) tokens() []string {
+	e.Lock()
+	defer e.Unlock()
+	set := map[string]struct{}{}
+	for token := range e.sources {
+		set[token] = struct{}{}
+	}
+	for _, token := range e.subscriptions.tokens() {
+		set[token] = struct{}{}
+	}
+	tokens := make([]string, 0, len(set))
+	for token := range set {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// send forwards a published status update to the listeners of the session, if any.
+func (e *eventSources) send(payload string) {
+	var update statusUpdate
+	if err := json.Unmarshal([]byte(payload), &update); err != nil {
+		e.conf.Logger.Warn("Ignoring malformed session status update: ", err.Error())
+		return
+	}
+	e.subscriptions.send(update.Token, update.Status)
+	if src := e.get(update.Token); src != nil {
+		e.conf.Logger.WithFields(logrus.Fields{"session": update.Token, "status": update.Status}).
+			Debug("Sending status to SSE listeners")
+		// We send JSON like the other APIs, so quote
+		src.SendEventMessage(fmt.Sprintf(`"%s"`, update.Status), "", "")
+	}
+}
+
+func (e *eventSources) close(token string) {
+	e.Lock()
+	defer e.Unlock()
+	if src := e.sources[token]; src != nil {
+		src.Close()
+		delete(e.sources, token)
+	}
+	e.subscriptions.close(token)
+}
+
+func (e *eventSources) closeAll() {
+	e.Lock()
+	defer e.Unlock()
+	for token, src := range e.sources {
+		src.Close()
+		delete(e.sources, token)
+	}
+	e.subscriptions.closeAll()
+}
+
+func marshalStatusUpdate(session *session) (string, error) {
+	bts, err := json.Marshal(&statusUpdate{Token: session.token, Status: session.status})
+	return string(bts), err
+}
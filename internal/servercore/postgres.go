@@ -0,0 +1,250 @@
+package servercore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// postgresSessionStore is a SessionStore keeping the sessions in a Postgres table, which is
+// created if it does not exist. Sessions are locked using advisory locks, which Postgres releases
+// automatically if the connection of the server holding the lock is lost. Status updates are
+// published to the other servers using NOTIFY.
+type postgresSessionStore struct {
+	db       *sql.DB
+	listener *pq.Listener
+	conf     *server.Configuration
+	events   *eventSources
+}
+
+const postgresStatusChannel = "irma_session_status"
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS irma_sessions (
+		token TEXT PRIMARY KEY,
+		client_token TEXT NOT NULL UNIQUE,
+		expiry TIMESTAMP WITH TIME ZONE NOT NULL,
+		data BYTEA NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS irma_sessions_expiry ON irma_sessions (expiry)`,
+}
+
+func newPostgresSessionStore(conf *server.Configuration, subscriptions *statusSubscriptions) (*postgresSessionStore, error) {
+	if conf.PostgresURL == "" {
+		return nil, errors.New("Postgres session store requires a Postgres connection string")
+	}
+	db, err := sql.Open("postgres", conf.PostgresURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range postgresSchema {
+		if _, err = db.Exec(statement); err != nil {
+			_ = db.Close()
+			return nil, errors.WrapPrefix(err, "failed to create Postgres session table", 0)
+		}
+	}
+
+	s := &postgresSessionStore{db: db, conf: conf, events: newEventSources(conf, subscriptions)}
+	s.listener = pq.NewListener(conf.PostgresURL, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			conf.Logger.Warn("Postgres session status listener: ", err.Error())
+		}
+	})
+	if err = s.listener.Listen(postgresStatusChannel); err != nil {
+		_ = s.listener.Close()
+		_ = db.Close()
+		return nil, errors.WrapPrefix(err, "failed to listen to Postgres session status updates", 0)
+	}
+	go func() {
+		for notification := range s.listener.Notify {
+			if notification != nil { // nil after reconnecting
+				s.events.send(notification.Extra)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *postgresSessionStore) query(column, value string) (*session, error) {
+	var bts []byte
+	err := s.db.QueryRow("SELECT data FROM irma_sessions WHERE "+column+" = $1", value).Scan(&bts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSession(bts, s.conf, s, s.events)
+}
+
+func (s *postgresSessionStore) get(token string) (*session, error) {
+	return s.query("token", token)
+}
+
+func (s *postgresSessionStore) clientGet(clientToken string) (*session, error) {
+	return s.query("client_token", clientToken)
+}
+
+func (s *postgresSessionStore) add(session *session) error {
+	bts, err := session.marshal()
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO irma_sessions (token, client_token, expiry, data) VALUES ($1, $2, $3, $4)",
+		session.token, session.clientToken, session.expiry(), bts)
+	return err
+}
+
+func (s *postgresSessionStore) save(session *session) error {
+	bts, err := session.marshal()
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE irma_sessions SET expiry = $2, data = $3 WHERE token = $1",
+		session.token, session.expiry(), bts)
+	return err
+}
+
+func (s *postgresSessionStore) update(session *session) error {
+	if err := s.save(session); err != nil {
+		return err
+	}
+	update, err := marshalStatusUpdate(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("SELECT pg_notify($1, $2)", postgresStatusChannel, update)
+	return err
+}
+
+// acquire obtains the advisory lock of the session with the specified requestor token on a
+// connection of its own, and returns a function releasing the lock and the connection.
+func (s *postgresSessionStore) acquire(token string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionLockTimeout)
+	defer cancel()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", token); err != nil {
+		_ = conn.Close()
+		return nil, errors.WrapPrefix(err, "failed to lock session "+token, 0)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", token); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token}).Warn("Failed to unlock session: ", err.Error())
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+func (s *postgresSessionStore) lock(session *session) (*session, error) {
+	release, err := s.acquire(session.token)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.get(session.token)
+	if err != nil || current == nil {
+		release()
+		return nil, err
+	}
+	current.release = func() {
+		if err := s.save(current); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": current.token}).Error("Failed to save session: ", err.Error())
+		}
+		release()
+	}
+	return current, nil
+}
+
+func (s *postgresSessionStore) listen(session *session) {
+	s.events.add(session)
+}
+
+func (s *postgresSessionStore) forEach(f func(session *session)) error {
+	rows, err := s.db.Query("SELECT data FROM irma_sessions")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var bts []byte
+		if err = rows.Scan(&bts); err != nil {
+			return err
+		}
+		session, err := unmarshalSession(bts, s.conf, s, s.events)
+		if err != nil {
+			return err
+		}
+		f(session)
+	}
+	return rows.Err()
+}
+
+func (s *postgresSessionStore) deleteExpired() {
+	rows, err := s.db.Query("SELECT token FROM irma_sessions WHERE expiry < $1", time.Now())
+	if err != nil {
+		s.conf.Logger.Error("Failed to retrieve expired sessions from Postgres: ", err.Error())
+		return
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		s.conf.Logger.Error("Failed to retrieve expired sessions from Postgres: ", err.Error())
+		return
+	}
+
+	for _, token := range tokens {
+		if err = s.expire(token); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token}).Error("Failed to expire session: ", err.Error())
+		}
+	}
+
+	// Stop listening to sessions that have been deleted by another server
+	for _, token := range s.events.tokens() {
+		var exists bool
+		err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM irma_sessions WHERE token = $1)", token).Scan(&exists)
+		if err == nil && !exists {
+			s.events.close(token)
+		}
+	}
+}
+
+func (s *postgresSessionStore) expire(token string) error {
+	release, err := s.acquire(token)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := s.get(token)
+	if err != nil || session == nil {
+		return err
+	}
+	if session.checkExpiry() {
+		_, err = s.db.Exec("DELETE FROM irma_sessions WHERE token = $1", token)
+		s.events.close(token)
+	}
+	return err
+}
+
+func (s *postgresSessionStore) stop() {
+	s.events.closeAll()
+	_ = s.listener.Close()
+	_ = s.db.Close()
+}
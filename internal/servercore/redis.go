@@ -0,0 +1,249 @@
+package servercore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/go-redis/redis"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// redisSessionStore is a SessionStore keeping the sessions in Redis. Of each session, the following
+// keys are stored: the session itself (by requestor token), its requestor token by client token,
+// and its lock, if any. Additionally the sorted set redisExpiryKey contains the requestor tokens
+// of all sessions, scored by their expiry time, so that expired sessions are found efficiently.
+type redisSessionStore struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	conf   *server.Configuration
+	events *eventSources
+}
+
+const (
+	redisSessionPrefix = "irma-session:"
+	redisClientPrefix  = "irma-session-client:"
+	redisLockPrefix    = "irma-session-lock:"
+	redisExpiryKey     = "irma-session-expiry"
+	redisStatusChannel = "irma-session-status"
+)
+
+// redisUnlockScript deletes the lock only if we still hold it, i.e. if it has not expired
+// and been acquired by another server in the meantime.
+var redisUnlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`)
+
+func newRedisSessionStore(conf *server.Configuration, subscriptions *statusSubscriptions) (*redisSessionStore, error) {
+	if conf.RedisAddr == "" {
+		return nil, errors.New("Redis session store requires a Redis address")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     conf.RedisAddr,
+		Password: conf.RedisPassword,
+		DB:       conf.RedisDB,
+	})
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, errors.WrapPrefix(err, "failed to connect to Redis", 0)
+	}
+
+	s := &redisSessionStore{
+		client: client,
+		pubsub: client.Subscribe(redisStatusChannel),
+		conf:   conf,
+		events: newEventSources(conf, subscriptions),
+	}
+	go func() {
+		for msg := range s.pubsub.Channel() {
+			s.events.send(msg.Payload)
+		}
+	}()
+	return s, nil
+}
+
+func (s *redisSessionStore) get(token string) (*session, error) {
+	bts, err := s.client.Get(redisSessionPrefix + token).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSession(bts, s.conf, s, s.events)
+}
+
+func (s *redisSessionStore) clientGet(clientToken string) (*session, error) {
+	token, err := s.client.Get(redisClientPrefix + clientToken).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.get(token)
+}
+
+func (s *redisSessionStore) add(session *session) error {
+	return s.save(session)
+}
+
+func (s *redisSessionStore) update(session *session) error {
+	if err := s.save(session); err != nil {
+		return err
+	}
+	update, err := marshalStatusUpdate(session)
+	if err != nil {
+		return err
+	}
+	return s.client.Publish(redisStatusChannel, update).Err()
+}
+
+// save writes the session and its client token to Redis. The keys expire some time after the
+// session may be deleted, so that they are removed even if no server is running deleteExpired().
+func (s *redisSessionStore) save(session *session) error {
+	bts, err := session.marshal()
+	if err != nil {
+		return err
+	}
+	expiry := session.expiry()
+	ttl := time.Until(expiry) + maxSessionLifetime
+	if ttl < maxSessionLifetime {
+		ttl = maxSessionLifetime
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(redisSessionPrefix+session.token, bts, ttl)
+		pipe.Set(redisClientPrefix+session.clientToken, session.token, ttl)
+		pipe.ZAdd(redisExpiryKey, redis.Z{Score: float64(expiry.Unix()), Member: session.token})
+		return nil
+	})
+	return err
+}
+
+func (s *redisSessionStore) delete(session *session) error {
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(redisSessionPrefix+session.token, redisClientPrefix+session.clientToken)
+		pipe.ZRem(redisExpiryKey, session.token)
+		return nil
+	})
+	s.events.close(session.token)
+	return err
+}
+
+// acquire waits until it obtains the lock of the session with the specified requestor token,
+// and returns a function releasing the lock.
+func (s *redisSessionStore) acquire(token string) (func(), error) {
+	key, value := redisLockPrefix+token, newSessionToken()
+	deadline := time.Now().Add(sessionLockTimeout)
+	for {
+		ok, err := s.client.SetNX(key, value, sessionLockExpiry).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timeout while waiting for lock of session %s", token)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return func() {
+		if err := redisUnlockScript.Run(s.client, []string{key}, value).Err(); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token}).Warn("Failed to unlock session: ", err.Error())
+		}
+	}, nil
+}
+
+func (s *redisSessionStore) lock(session *session) (*session, error) {
+	release, err := s.acquire(session.token)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.get(session.token)
+	if err != nil || current == nil {
+		release()
+		return nil, err
+	}
+	current.release = func() {
+		if err := s.save(current); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": current.token}).Error("Failed to save session: ", err.Error())
+		}
+		release()
+	}
+	return current, nil
+}
+
+func (s *redisSessionStore) listen(session *session) {
+	s.events.add(session)
+}
+
+func (s *redisSessionStore) forEach(f func(session *session)) error {
+	tokens, err := s.client.ZRange(redisExpiryKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		session, err := s.get(token)
+		if err != nil {
+			return err
+		}
+		if session != nil { // the keys of the session may have expired
+			f(session)
+		}
+	}
+	return nil
+}
+
+func (s *redisSessionStore) deleteExpired() {
+	tokens, err := s.client.ZRangeByScore(redisExpiryKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		s.conf.Logger.Error("Failed to retrieve expired sessions from Redis: ", err.Error())
+		return
+	}
+	for _, token := range tokens {
+		if err = s.expire(token); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token}).Error("Failed to expire session: ", err.Error())
+		}
+	}
+
+	// Stop listening to sessions that have been deleted by another server
+	for _, token := range s.events.tokens() {
+		if n, err := s.client.Exists(redisSessionPrefix + token).Result(); err == nil && n == 0 {
+			s.events.close(token)
+		}
+	}
+}
+
+func (s *redisSessionStore) expire(token string) error {
+	release, err := s.acquire(token)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := s.get(token)
+	if err != nil {
+		return err
+	}
+	if session == nil { // the keys of the session expired
+		return s.client.ZRem(redisExpiryKey, token).Err()
+	}
+	if session.checkExpiry() {
+		return s.delete(session)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) stop() {
+	s.events.closeAll()
+	_ = s.pubsub.Close()
+	_ = s.client.Close()
+}
@@ -0,0 +1,261 @@
+package servercore
+
+import (
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// In sandbox mode, sessions can be completed by a simulated IRMA app that holds the credentials
+// from the SandboxCredentials server configuration option, instead of by an actual IRMA app.
+// This allows requestors to run end-to-end integration tests of their websites against the
+// real server API, with predictable results. The simulated client always consents to the session,
+// unless it does not have the requested attributes, in which case it cancels the session.
+// Credentials issued to the simulated client are not stored, so that each session starts
+// with the same credentials.
+
+type sandboxClient struct {
+	secretKey   *big.Int
+	credentials []*sandboxCredential
+}
+
+type sandboxCredential struct {
+	*gabi.Credential
+	attrs *irma.AttributeList
+}
+
+func (s *Server) newSandboxClient() (*sandboxClient, error) {
+	key, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[1024].Lm)
+	if err != nil {
+		return nil, err
+	}
+	client := &sandboxClient{secretKey: key}
+
+	conf := s.conf.IrmaConfiguration
+	request := &irma.IssuanceRequest{Credentials: s.conf.SandboxCredentials}
+	if err = s.validateIssuanceRequest(conf, request); err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid sandbox credentials", 0)
+	}
+	for _, cred := range request.Credentials {
+		if err = client.issue(s.conf, cred); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to issue sandbox credential "+cred.CredentialTypeID.String(), 0)
+		}
+	}
+	return client, nil
+}
+
+// issue creates the specified credential directly using the private key of its issuer.
+func (client *sandboxClient) issue(conf *server.Configuration, request *irma.CredentialRequest) error {
+	id := request.CredentialTypeID.IssuerIdentifier()
+	pk, err := conf.IrmaConfiguration.PublicKey(id, request.KeyCounter)
+	if err != nil {
+		return err
+	}
+	sk, err := conf.PrivateKey(id, request.KeyCounter)
+	if err != nil {
+		return err
+	}
+	attrs, err := request.AttributeList(conf.IrmaConfiguration, 0x03)
+	if err != nil {
+		return err
+	}
+
+	nonce2, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[4096].Lstatzk)
+	if err != nil {
+		return err
+	}
+	builder := gabi.NewCredentialBuilder(pk, one, client.secretKey, nonce2)
+	proofs := gabi.ProofBuilderList{builder}.BuildProofList(one, one, false)
+	err = conf.IrmaConfiguration.AuditLog().Record(irma.AuditEventIssuance,
+		fmt.Sprintf("%s-%d", id, request.KeyCounter), request.CredentialTypeID.String())
+	if err != nil {
+		return err
+	}
+	sig, err := gabi.NewIssuer(sk, pk, one).IssueSignature(proofs[0].(*gabi.ProofU).U, attrs.Ints, nonce2)
+	if err != nil {
+		return err
+	}
+	cred, err := builder.ConstructCredential(sig, attrs.Ints)
+	if err != nil {
+		return err
+	}
+
+	client.credentials = append(client.credentials, &sandboxCredential{Credential: cred, attrs: attrs})
+	return nil
+}
+
+// candidate returns the index of a credential of the client containing an attribute that
+// satisfies the specified disjunction, along with the index of that attribute within the credential.
+func (client *sandboxClient) candidate(conf *irma.Configuration, disjunction *irma.AttributeDisjunction) (int, int, bool) {
+	for _, attr := range disjunction.Attributes {
+		for i, cred := range client.credentials {
+			if cred.attrs.CredentialType().Identifier() != attr.CredentialTypeIdentifier() || !cred.attrs.IsValid() {
+				continue
+			}
+			if attr.IsCredential() {
+				return i, 1, true // Only the metadata attribute is disclosed
+			}
+			val := cred.attrs.UntranslatedAttribute(attr)
+			if val == nil {
+				continue
+			}
+			if required, present := disjunction.Values[attr]; present && required != nil && *val != *required {
+				continue
+			}
+			index, err := conf.CredentialTypes[attr.CredentialTypeIdentifier()].IndexOf(attr)
+			if err != nil {
+				continue
+			}
+			// Attribute indices within gabi credentials are offset by the secret key and metadata attribute
+			return i, index + 2, true
+		}
+	}
+	return 0, 0, false
+}
+
+// proofBuilders returns proof builders disclosing attributes that satisfy the disjunctions of the
+// specified request, or false if the client does not have the required attributes.
+func (client *sandboxClient) proofBuilders(conf *irma.Configuration, request irma.SessionRequest,
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, bool) {
+	var (
+		todisclose  []*sandboxCredential
+		disclosed   [][]int
+		credIndices = map[int]int{} // maps index in client.credentials to index in todisclose
+		indices     = irma.DisclosedAttributeIndices{}
+	)
+	for _, disjunction := range request.ToDisclose() {
+		i, attrIndex, ok := client.candidate(conf, disjunction)
+		if !ok {
+			return nil, nil, false
+		}
+		cred := client.credentials[i]
+		credIndex, present := credIndices[i]
+		if !present {
+			credIndex = len(todisclose)
+			credIndices[i] = credIndex
+			todisclose = append(todisclose, cred)
+			disclosed = append(disclosed, []int{1}) // Always disclose metadata
+		}
+		if attrIndex != 1 {
+			disclosed[credIndex] = append(disclosed[credIndex], attrIndex)
+		}
+		indices = append(indices, []*irma.DisclosedAttributeIndex{{
+			CredentialIndex: credIndex,
+			AttributeIndex:  attrIndex,
+			Identifier:      irma.CredentialIdentifier{Type: cred.attrs.CredentialType().Identifier(), Hash: cred.attrs.Hash()},
+		}})
+	}
+
+	builders := gabi.ProofBuilderList{}
+	for i, cred := range todisclose {
+		builders = append(builders, cred.CreateDisclosureProofBuilder(disclosed[i]))
+	}
+	return builders, indices, true
+}
+
+func (client *sandboxClient) disclosure(conf *irma.Configuration, request irma.SessionRequest, issig bool) (*irma.Disclosure, bool) {
+	builders, indices, ok := client.proofBuilders(conf, request)
+	if !ok {
+		return nil, false
+	}
+	return &irma.Disclosure{
+		Proofs:  builders.BuildProofList(request.GetContext(), request.GetNonce(), issig),
+		Indices: indices,
+	}, true
+}
+
+func (client *sandboxClient) commitments(conf *irma.Configuration, request *irma.IssuanceRequest) (*irma.IssueCommitmentMessage, bool, error) {
+	builders, indices, ok := client.proofBuilders(conf, request)
+	if !ok {
+		return nil, false, nil
+	}
+	nonce2, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[4096].Lstatzk)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, cred := range request.Credentials {
+		pk, err := conf.PublicKey(cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter)
+		if err != nil {
+			return nil, false, err
+		}
+		builders = append(builders, gabi.NewCredentialBuilder(pk, request.GetContext(), client.secretKey, nonce2))
+	}
+	return &irma.IssueCommitmentMessage{
+		IssueCommitmentMessage: &gabi.IssueCommitmentMessage{
+			Proofs: builders.BuildProofList(request.GetContext(), request.GetNonce(), false),
+			Nonce2: nonce2,
+		},
+		Indices: indices,
+	}, true, nil
+}
+
+// CompleteSandboxSession completes the specified session using the simulated IRMA app of the
+// sandbox mode, and returns the session result. If the session fails, the error is returned
+// along with the (cancelled) session result.
+func (s *Server) CompleteSandboxSession(token string) (result *server.SessionResult, rerr *irma.RemoteError) {
+	defer s.drainer.useKeys()()
+
+	if s.sandbox == nil {
+		return nil, server.RemoteError(server.ErrorUnsupported, "sandbox mode is not enabled")
+	}
+	session, err := s.lockSession(token, true)
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorUnknown, err.Error())
+	}
+	if session == nil {
+		return nil, server.RemoteError(server.ErrorSessionUnknown, "")
+	}
+	defer session.unlock()
+	defer func() {
+		if e := recover(); e != nil {
+			rerr = session.failPanic(e)
+			session.prevStatus = session.status
+			result = session.result
+		}
+	}()
+
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Completing session using sandbox client")
+	if _, rerr := session.handleGetRequest(minProtocolVersion, maxProtocolVersion); rerr != nil {
+		return nil, rerr
+	}
+
+	conf := session.irmaConfiguration
+	ok := true
+	switch session.action {
+	case irma.ActionDisclosing:
+		var disclosure *irma.Disclosure
+		if disclosure, ok = s.sandbox.disclosure(conf, session.request, false); ok {
+			_, rerr = session.handlePostDisclosure(*disclosure, s.startNextSession)
+		}
+	case irma.ActionSigning:
+		var disclosure *irma.Disclosure
+		if disclosure, ok = s.sandbox.disclosure(conf, session.request, true); ok {
+			signature, err := session.request.(*irma.SignatureRequest).SignatureFromMessage(disclosure)
+			if err != nil {
+				return nil, session.fail(server.ErrorUnknown, err.Error())
+			}
+			_, rerr = session.handlePostSignature(signature)
+		}
+	case irma.ActionIssuing:
+		commitments, satisfiable, err := s.sandbox.commitments(conf, session.request.(*irma.IssuanceRequest))
+		if err != nil {
+			return nil, session.fail(server.ErrorUnknown, err.Error())
+		}
+		if ok = satisfiable; ok {
+			_, rerr = session.handlePostCommitments(commitments)
+		}
+	}
+	if !ok {
+		// Like an IRMA app would, cancel the session if we do not have the requested attributes
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Sandbox client cannot satisfy session request")
+		session.handleDelete()
+	}
+
+	session.prevStatus = session.status
+	return session.result, rerr
+}
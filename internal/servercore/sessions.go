@@ -27,63 +27,113 @@ type session struct {
 	prevStatus server.Status
 	evtSource  eventsource.EventSource
 
+	started    time.Time
 	lastActive time.Time
 	result     *server.SessionResult
 
 	kssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP
 
 	conf     *server.Configuration
-	sessions sessionStore
+	sessions SessionStore
+	release  func() // unlocks the session, see SessionStore.lock()
+
+	// Snapshot of conf.IrmaConfiguration taken when the session was started,
+	// so that scheme updates during the session do not affect it
+	irmaConfiguration *irma.Configuration
 }
 
-type sessionStore interface {
-	get(token string) *session
-	clientGet(token string) *session
-	add(session *session)
-	update(session *session)
+// SessionStore stores the sessions of the server. By default sessions are kept in memory
+// (memorySessionStore), in which case they are lost when the server restarts. Sessions can also be
+// stored in Redis (redisSessionStore) or Postgres (postgresSessionStore), so that they survive
+// restarts and so that several servers sharing the store can each handle any session, allowing
+// horizontal scaling. Status updates of sessions are then published to all servers sharing the
+// store, which forward them to the server sent event listeners of the session that they have.
+//
+// Sessions loaded from a persistent store use the current IRMA configuration of the server
+// instead of a snapshot taken when the session started, as configurations cannot be stored.
+type SessionStore interface {
+	// get returns the session with the specified requestor token, or nil if it does not exist.
+	get(token string) (*session, error)
+	// clientGet returns the session with the specified client token, or nil if it does not exist.
+	clientGet(token string) (*session, error)
+	add(session *session) error
+	// update is called when the status of the session changes, and informs its listeners.
+	update(session *session) error
+	// lock locks the session against concurrent access (also by other servers sharing the store),
+	// and returns its current state. The caller must unlock the returned session afterwards,
+	// which saves any changes made to it.
+	lock(session *session) (*session, error)
+	// listen is called when a server sent event source is created for the session.
+	listen(session *session)
+	// forEach calls f for all sessions in the store, with the session locked if it is shared
+	// with other goroutines.
+	forEach(f func(session *session)) error
 	deleteExpired()
 	stop()
 }
 
 type memorySessionStore struct {
 	sync.RWMutex
-	conf *server.Configuration
+	conf          *server.Configuration
+	subscriptions *statusSubscriptions
 
 	requestor map[string]*session
 	client    map[string]*session
 }
 
 const (
-	maxSessionLifetime = 5 * time.Minute // After this a session is cancelled
+	maxSessionLifetime = 5 * time.Minute // After this much inactivity a session is cancelled
 	sessionChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 4)
+	maxProtocolVersion = irma.NewVersion(2, 6)
 )
 
-func (s *memorySessionStore) get(t string) *session {
+func (s *memorySessionStore) get(t string) (*session, error) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.requestor[t]
+	return s.requestor[t], nil
 }
 
-func (s *memorySessionStore) clientGet(t string) *session {
+func (s *memorySessionStore) clientGet(t string) (*session, error) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.client[t]
+	return s.client[t], nil
 }
 
-func (s *memorySessionStore) add(session *session) {
+func (s *memorySessionStore) add(session *session) error {
 	s.Lock()
 	defer s.Unlock()
 	s.requestor[session.token] = session
 	s.client[session.clientToken] = session
+	return nil
 }
 
-func (s *memorySessionStore) update(session *session) {
+func (s *memorySessionStore) update(session *session) error {
 	session.onUpdate()
+	s.subscriptions.send(session.token, session.status)
+	return nil
+}
+
+func (s *memorySessionStore) lock(session *session) (*session, error) {
+	session.Lock()
+	session.release = session.Unlock
+	return session, nil
+}
+
+func (s *memorySessionStore) listen(*session) {}
+
+func (s *memorySessionStore) forEach(f func(session *session)) error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, session := range s.requestor {
+		session.Lock()
+		f(session)
+		session.Unlock()
+	}
+	return nil
 }
 
 func (s *memorySessionStore) stop() {
@@ -94,6 +144,7 @@ func (s *memorySessionStore) stop() {
 			session.evtSource.Close()
 		}
 	}
+	s.subscriptions.closeAll()
 }
 
 func (s *memorySessionStore) deleteExpired() {
@@ -103,21 +154,8 @@ func (s *memorySessionStore) deleteExpired() {
 	expired := make([]string, 0, len(s.requestor))
 	for token, session := range s.requestor {
 		session.Lock()
-
-		timeout := maxSessionLifetime
-		if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.lastActive.Add(timeout).Before(time.Now()) {
-			if !session.status.Finished() {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
-				session.markAlive()
-				session.setStatus(server.StatusTimeout)
-			} else {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
-				expired = append(expired, token)
-			}
+		if session.checkExpiry() {
+			expired = append(expired, token)
 		}
 		session.Unlock()
 	}
@@ -130,15 +168,91 @@ func (s *memorySessionStore) deleteExpired() {
 		if session.evtSource != nil {
 			session.evtSource.Close()
 		}
+		s.subscriptions.close(token)
 		delete(s.client, session.clientToken)
 		delete(s.requestor, token)
 	}
 	s.Unlock()
 }
 
+// checkExpiry times out the session if it has been inactive for too long, and returns whether
+// the session finished long enough ago to be deleted.
+func (session *session) checkExpiry() bool {
+	if !session.expiry().Before(time.Now()) {
+		return false
+	}
+	if !session.status.Finished() {
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
+		session.markAlive()
+		session.setStatus(server.StatusTimeout)
+		return false
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
+	return true
+}
+
+// expiry returns the moment after which the session times out, or may be deleted if it has finished.
+func (session *session) expiry() time.Time {
+	if session.status.Finished() {
+		return session.lastActive.Add(session.resultRetention())
+	}
+	expiry := session.lastActive.Add(maxSessionLifetime)
+	if session.status == server.StatusInitialized {
+		expiry = session.lastActive.Add(session.clientTimeout())
+	}
+	if deadline, ok := session.deadline(); ok && deadline.Before(expiry) {
+		expiry = deadline
+	}
+	return expiry
+}
+
+// clientExpiry returns the moment at which the session times out if no IRMA app connects to it.
+func (session *session) clientExpiry() time.Time {
+	expiry := session.started.Add(session.clientTimeout())
+	if deadline, ok := session.deadline(); ok && deadline.Before(expiry) {
+		expiry = deadline
+	}
+	return expiry
+}
+
+// deadline returns the moment at which the session times out if it has not finished by then,
+// if its lifetime is limited.
+func (session *session) deadline() (time.Time, bool) {
+	lifetime := seconds(session.rrequest.Base().SessionLifetime, session.conf.SessionLifetime, 0)
+	if lifetime == 0 || session.started.IsZero() {
+		return time.Time{}, false
+	}
+	return session.started.Add(lifetime), true
+}
+
+func (session *session) clientTimeout() time.Duration {
+	return seconds(session.rrequest.Base().ClientTimeout, session.conf.ClientTimeout, maxSessionLifetime)
+}
+
+func (session *session) resultRetention() time.Duration {
+	return seconds(session.rrequest.Base().ResultRetention, session.conf.ResultRetention, maxSessionLifetime)
+}
+
+// seconds returns the duration specified in the session request if any, or else the one in
+// the server configuration if any, or else the default.
+func seconds(request, conf int, def time.Duration) time.Duration {
+	switch {
+	case request != 0:
+		return time.Duration(request) * time.Second
+	case conf != 0:
+		return time.Duration(conf) * time.Second
+	default:
+		return def
+	}
+}
+
+func (session *session) unlock() {
+	session.release()
+}
+
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
+func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, conf *irma.Configuration) (*session, error) {
 	token := newSessionToken()
 	clientToken := newSessionToken()
 
@@ -146,6 +260,7 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		action:      action,
 		rrequest:    request,
 		request:     request.SessionRequest(),
+		started:     time.Now(),
 		lastActive:  time.Now(),
 		token:       token,
 		clientToken: clientToken,
@@ -153,6 +268,8 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		prevStatus:  server.StatusInitialized,
 		conf:        s.conf,
 		sessions:    s.sessions,
+
+		irmaConfiguration: conf,
 		result: &server.SessionResult{
 			Token:  token,
 			Type:   action,
@@ -164,9 +281,11 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 	nonce, _ := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
 	ses.request.SetNonce(nonce)
 	ses.request.SetContext(one)
-	s.sessions.add(ses)
+	if err := s.sessions.add(ses); err != nil {
+		return nil, err
+	}
 
-	return ses
+	return ses, nil
 }
 
 func newSessionToken() string {
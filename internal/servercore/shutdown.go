@@ -0,0 +1,141 @@
+package servercore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// This file contains the graceful shutdown of the server. When shutting down, the server first
+// drains (see Drain()): it refuses new sessions, and waits for the sessions that it started to
+// finish and for their results to be delivered to their callback URLs. Only then is the server
+// stopped, so that session results are not lost by stopping the server in the middle of sessions.
+
+// Interval at which Drain() checks whether the sessions of the server have finished
+var drainPollInterval = 250 * time.Millisecond
+
+// drainer keeps track of the unfinished sessions started by the server, of the session
+// results that are being POSTed to callback URLs, and of the calls that may be using the
+// private keys of the server, which Stop() must not wipe before these calls have returned.
+type drainer struct {
+	mutex     sync.Mutex
+	draining  bool
+	sessions  map[string]struct{} // tokens of possibly unfinished sessions
+	pending   int                 // sessions that are being started
+	callbacks sync.WaitGroup
+	keyUsers  int // calls that may be using the private keys
+	keysIdle  *sync.Cond
+}
+
+func newDrainer() *drainer {
+	d := &drainer{sessions: map[string]struct{}{}}
+	d.keysIdle = sync.NewCond(&d.mutex)
+	return d
+}
+
+// acquire registers that a session is being started, and returns false if the server is
+// draining. If it succeeds, started() must be called afterwards.
+func (d *drainer) acquire() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.draining {
+		return false
+	}
+	d.pending++
+	return true
+}
+
+// started registers the session with the specified token, or only releases the session
+// registered by acquire() if the token is empty (i.e. starting the session failed).
+func (d *drainer) started(token string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending--
+	if token != "" {
+		d.sessions[token] = struct{}{}
+	}
+}
+
+// drained removes the finished sessions, and returns whether all sessions have finished.
+func (d *drainer) drained(finished func(token string) bool) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.draining = true
+	for token := range d.sessions {
+		if finished(token) {
+			delete(d.sessions, token)
+		}
+	}
+	return d.pending == 0 && len(d.sessions) == 0
+}
+
+func (d *drainer) isDraining() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.draining
+}
+
+// useKeys registers that the caller may use the private keys of the server until the returned
+// function is called.
+func (d *drainer) useKeys() func() {
+	d.mutex.Lock()
+	d.keyUsers++
+	d.mutex.Unlock()
+	return func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.keyUsers--; d.keyUsers == 0 {
+			d.keysIdle.Broadcast()
+		}
+	}
+}
+
+// keysUnused blocks until no calls registered by useKeys() are using the private keys.
+func (d *drainer) keysUnused() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for d.keyUsers > 0 {
+		d.keysIdle.Wait()
+	}
+}
+
+// Draining returns whether the server is draining, in which case it refuses new sessions.
+func (s *Server) Draining() bool {
+	return s.drainer.isDraining()
+}
+
+// Drain makes the server refuse new sessions, and waits until the sessions started by the server
+// have finished and their results have been POSTed to their callback URLs. If the context is done
+// before that, its error is returned. Afterwards, the server should be stopped using Stop().
+//
+// When sessions are stored in Redis or Postgres, sessions may be continued by other servers
+// sharing the store; Drain() waits only for the sessions that this server started.
+func (s *Server) Drain(ctx context.Context) error {
+	s.conf.Logger.Info("Draining: waiting for unfinished sessions")
+	for !s.drainer.drained(s.sessionFinished) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+
+	callbacks := make(chan struct{})
+	go func() {
+		s.drainer.callbacks.Wait()
+		close(callbacks)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-callbacks:
+		return nil
+	}
+}
+
+// sessionFinished returns whether the session with the specified token has finished or no
+// longer exists.
+func (s *Server) sessionFinished(token string) bool {
+	res := s.GetSessionResult(token)
+	return res == nil || res.Status.Finished()
+}
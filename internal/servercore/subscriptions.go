@@ -0,0 +1,85 @@
+package servercore
+
+import (
+	"sync"
+
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Capacity of the channels returned by Server.SubscribeStatus(), which exceeds the number of
+// status updates a session can have, so that sending never blocks on slow subscribers
+const statusSubscriptionCapacity = 8
+
+// statusSubscriptions contains the channels of the subscribers to status updates of sessions
+// (see Server.SubscribeStatus()), by requestor token.
+type statusSubscriptions struct {
+	sync.Mutex
+	channels map[string][]chan server.Status
+}
+
+func newStatusSubscriptions() *statusSubscriptions {
+	return &statusSubscriptions{channels: map[string][]chan server.Status{}}
+}
+
+// add returns a new channel subscribed to status updates of the session, on which its current
+// status is sent first. If the session has finished, the channel is closed right away.
+func (subs *statusSubscriptions) add(session *session) chan server.Status {
+	subs.Lock()
+	defer subs.Unlock()
+	c := make(chan server.Status, statusSubscriptionCapacity)
+	c <- session.status
+	if session.status.Finished() {
+		close(c)
+		return c
+	}
+	subs.channels[session.token] = append(subs.channels[session.token], c)
+	return c
+}
+
+// send sends the status to the subscribers of the session, closing their channels if the session
+// has finished.
+func (subs *statusSubscriptions) send(token string, status server.Status) {
+	subs.Lock()
+	defer subs.Unlock()
+	for _, c := range subs.channels[token] {
+		select {
+		case c <- status:
+		default: // the subscriber does not read its channel, so drop the update
+		}
+	}
+	if status.Finished() {
+		subs.closeLocked(token)
+	}
+}
+
+// tokens returns the requestor tokens of the sessions having subscribers.
+func (subs *statusSubscriptions) tokens() []string {
+	subs.Lock()
+	defer subs.Unlock()
+	tokens := make([]string, 0, len(subs.channels))
+	for token := range subs.channels {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func (subs *statusSubscriptions) close(token string) {
+	subs.Lock()
+	defer subs.Unlock()
+	subs.closeLocked(token)
+}
+
+func (subs *statusSubscriptions) closeLocked(token string) {
+	for _, c := range subs.channels[token] {
+		close(c)
+	}
+	delete(subs.channels, token)
+}
+
+func (subs *statusSubscriptions) closeAll() {
+	subs.Lock()
+	defer subs.Unlock()
+	for token := range subs.channels {
+		subs.closeLocked(token)
+	}
+}
@@ -0,0 +1,125 @@
+package servercore
+
+import (
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// ValidateIssuance checks the specified issuance request against the current configuration in the
+// same way as StartSession() would, without starting a session. Instead of stopping at the first
+// problem, it returns all problems that would prevent the credentials from being issued; if it
+// returns no problems, then the request can be issued. An error is returned only if the request
+// could not be parsed or is not an issuance request.
+func (s *Server) ValidateIssuance(req interface{}) ([]*server.IssuanceProblem, error) {
+	defer s.drainer.useKeys()()
+
+	rrequest, err := server.ParseSessionRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	request, ok := rrequest.SessionRequest().(*irma.IssuanceRequest)
+	if !ok {
+		return nil, server.LogWarning(errors.New("Not an issuance request"))
+	}
+
+	conf := s.conf.IrmaConfiguration.Snapshot()
+	problems := []*server.IssuanceProblem{}
+	for i, cred := range request.Credentials {
+		problems = append(problems, s.validateCredentialRequest(conf, i, cred)...)
+	}
+	return problems, nil
+}
+
+func (s *Server) validateCredentialRequest(conf *irma.Configuration, index int, cred *irma.CredentialRequest) []*server.IssuanceProblem {
+	var problems []*server.IssuanceProblem
+	problem := func(typ server.IssuanceProblemType, attr, format string, args ...interface{}) {
+		problems = append(problems, &server.IssuanceProblem{
+			Credential:     index,
+			CredentialType: cred.CredentialTypeID,
+			Attribute:      attr,
+			Type:           typ,
+			Message:        fmt.Sprintf(format, args...),
+		})
+	}
+
+	scheme := cred.CredentialTypeID.IssuerIdentifier().SchemeManagerIdentifier()
+	if !conf.EnvironmentAllowed(scheme) {
+		problem(server.IssuanceProblemSchemeNotAllowed, "", "scheme %s is unknown or its environment is not allowed", scheme)
+		return problems
+	}
+	credtype := conf.CredentialTypes[cred.CredentialTypeID]
+	if credtype == nil {
+		problem(server.IssuanceProblemUnknownCredentialType, "", "unknown credential type %s", cred.CredentialTypeID)
+		return problems
+	}
+	attributes := cred.Attributes
+	if cred.Provider != "" {
+		var err error
+		if attributes, err = s.attributeValues(cred, nil); err != nil {
+			problem(server.IssuanceProblemValueProvider, "", "%s", err.Error())
+			return problems
+		}
+	}
+
+	// Attributes
+	known := map[string]bool{}
+	for _, attrtype := range credtype.AttributeTypes {
+		known[attrtype.ID] = true
+		value, present := attributes[attrtype.ID]
+		if !present {
+			if attrtype.Optional != "true" {
+				problem(server.IssuanceProblemMissingAttribute, attrtype.ID, "required attribute %s not present", attrtype.ID)
+			}
+			continue
+		}
+		if attrtype.Format != nil {
+			if err := attrtype.Format.Validate(attrtype.Format.Canonicalize(value)); err != nil {
+				problem(server.IssuanceProblemInvalidAttribute, attrtype.ID, "invalid value of attribute %s: %s", attrtype.ID, err.Error())
+			}
+		}
+	}
+	for name := range attributes {
+		if !known[name] {
+			problem(server.IssuanceProblemUnknownAttribute, name, "attribute %s does not exist in credential type %s", name, cred.CredentialTypeID)
+		}
+	}
+
+	if cred.Validity != nil && cred.Validity.Before(irma.Timestamp(irma.Now())) {
+		problem(server.IssuanceProblemExpired, "", "requested validity %s lies in the past", cred.Validity.String())
+	}
+
+	// Keys: the same key is used as by validateIssuanceRequest()
+	iss := cred.CredentialTypeID.IssuerIdentifier()
+	indices, err := conf.PublicKeyIndices(iss)
+	if err != nil {
+		problem(server.IssuanceProblemPublicKey, "", "failed to read public keys of issuer %s: %s", iss, err.Error())
+		return problems
+	}
+	now := irma.Now().Unix()
+	var nonexpired bool
+	for i := len(indices) - 1; i >= 0; i-- {
+		pk, err := conf.PublicKey(iss, indices[i])
+		if err != nil || pk == nil || pk.ExpiryDate <= now {
+			continue
+		}
+		nonexpired = true
+		sk, err := s.conf.PrivateKey(iss, indices[i])
+		if err != nil || sk == nil {
+			continue
+		}
+		if len(credtype.AttributeTypes)+2 > len(pk.R) {
+			problem(server.IssuanceProblemKeySize, "", "public key %d of issuer %s supports %d attributes, required: %d",
+				indices[i], iss, len(pk.R), len(credtype.AttributeTypes)+2)
+		}
+		return problems
+	}
+	if nonexpired {
+		problem(server.IssuanceProblemPrivateKey, "", "missing private key of nonexpired public key of issuer %s", iss)
+	} else {
+		problem(server.IssuanceProblemPublicKey, "", "issuer %s has no nonexpired public key", iss)
+	}
+	return problems
+}
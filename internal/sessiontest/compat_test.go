@@ -0,0 +1,131 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file check that the current code remains wire compatible with previous
+// releases, using fixtures in testdata/compat containing protocol messages as they were sent or
+// expected by previous releases. When changing the protocol or the format of session requests,
+// add fixtures of the messages of the current release, so that compatibility with it is guarded.
+
+type compatFixture struct {
+	Description   string `json:"description"`
+	ClientVersion *struct {
+		Min *irma.ProtocolVersion `json:"min"`
+		Max *irma.ProtocolVersion `json:"max"`
+	} `json:"clientVersion"`
+	NegotiatedVersion *irma.ProtocolVersion `json:"negotiatedVersion"`
+	Request           json.RawMessage       `json:"request"`
+	Signature         json.RawMessage       `json:"signature"`
+	Status            irma.ProofStatus      `json:"status"`
+}
+
+func compatFixtures(t *testing.T) map[string]*compatFixture {
+	files, err := filepath.Glob(filepath.Join(testdata, "compat", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	fixtures := map[string]*compatFixture{}
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		fixture := &compatFixture{}
+		require.NoError(t, json.Unmarshal(bts, fixture), file)
+		fixtures[filepath.Base(file)] = fixture
+	}
+	return fixtures
+}
+
+// requireJsonSubset requires that actual contains everything that expected contains, i.e.,
+// that each (nested) field of expected is present in actual with the same value.
+func requireJsonSubset(t *testing.T, expected, actual interface{}, path string) {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		require.True(t, ok, "%s: expected object", path)
+		for key, val := range e {
+			require.Contains(t, a, key, "%s: missing field", path)
+			requireJsonSubset(t, val, a[key], path+"."+key)
+		}
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		require.True(t, ok, "%s: expected array", path)
+		require.Len(t, a, len(e), path)
+		for i := range e {
+			requireJsonSubset(t, e[i], a[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+	default:
+		require.Equal(t, expected, actual, path)
+	}
+}
+
+// TestCompatSessionRequests starts sessions using session requests from previous releases,
+// and retrieves the session request like IRMA apps of previous releases do, checking that
+// protocol version negotiation succeeds and that the request contains everything they expect.
+func TestCompatSessionRequests(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	for name, fixture := range compatFixtures(t) {
+		if fixture.ClientVersion == nil {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			qr, _, err := irmaServer.StartSession([]byte(fixture.Request), nil)
+			require.NoError(t, err, fixture.Description)
+
+			transport := irma.NewHTTPTransport(qr.URL)
+			transport.SetHeader(irma.MinVersionHeader, fixture.ClientVersion.Min.String())
+			transport.SetHeader(irma.MaxVersionHeader, fixture.ClientVersion.Max.String())
+			var received map[string]interface{}
+			require.NoError(t, transport.Get("", &received), fixture.Description)
+			defer transport.Delete()
+
+			require.Equal(t, fixture.NegotiatedVersion.String(), received["protocolVersion"])
+			require.Contains(t, received, "nonce")
+			require.Contains(t, received, "context")
+			var expected interface{}
+			require.NoError(t, json.Unmarshal(fixture.Request, &expected))
+			requireJsonSubset(t, expected, received, "request")
+		})
+	}
+}
+
+// TestCompatSignatures verifies attribute-based signatures created by previous releases,
+// and checks that they still contain everything previous releases expect after (un)marshaling.
+func TestCompatSignatures(t *testing.T) {
+	conf, err := irma.NewConfigurationReadOnly(filepath.Join(testdata, "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	for name, fixture := range compatFixtures(t) {
+		if fixture.Signature == nil {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			request := &irma.SignatureRequest{}
+			require.NoError(t, json.Unmarshal(fixture.Request, request))
+			signature := &irma.SignedMessage{}
+			require.NoError(t, json.Unmarshal(fixture.Signature, signature))
+
+			_, status, err := signature.Verify(conf, request)
+			require.NoError(t, err, fixture.Description)
+			require.Equal(t, fixture.Status, status)
+
+			bts, err := json.Marshal(signature)
+			require.NoError(t, err)
+			var expected, actual interface{}
+			require.NoError(t, json.Unmarshal(fixture.Signature, &expected))
+			require.NoError(t, json.Unmarshal(bts, &actual))
+			requireJsonSubset(t, expected, actual, "signature")
+		})
+	}
+}
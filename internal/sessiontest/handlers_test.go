@@ -2,6 +2,7 @@ package sessiontest
 
 import (
 	"encoding/json"
+	"sync"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -15,8 +16,9 @@ type TestClientHandler struct {
 	c chan error
 }
 
-func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
-func (i *TestClientHandler) UpdateAttributes()                               {}
+func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet)      {}
+func (i *TestClientHandler) UpdateAttributes()                                    {}
+func (i *TestClientHandler) OrphanedCredentials(orphaned irma.CredentialInfoList) {}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -79,6 +81,9 @@ func (th TestHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdenti
 func (th TestHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
 	th.Failure(&irma.SessionError{Err: errors.Errorf("Keyshare enrollment deleted for %s", manager.String())})
 }
+func (th TestHandler) UpdateRequired(manager irma.SchemeManagerIdentifier, minimumVersion string) {
+	th.Failure(&irma.SessionError{Err: errors.Errorf("Scheme %s requires irmago %s", manager.String(), minimumVersion)})
+}
 func (th TestHandler) StatusUpdate(action irma.Action, status irma.Status) {}
 func (th TestHandler) Success(result string) {
 	th.c <- nil
@@ -139,6 +144,48 @@ type SessionResult struct {
 	DisclosureResult *irma.Disclosure
 }
 
+// StateTestHandler embeds a TestHandler, and additionally sends the state transitions
+// of the session to its transitions channel.
+type StateTestHandler struct {
+	TestHandler
+	transitions chan irmaclient.SessionTransition
+}
+
+func (th StateTestHandler) StateChanged(transition irmaclient.SessionTransition) {
+	th.transitions <- transition
+}
+
+// ProgressTestHandler records the progress that is reported to it during a session.
+type ProgressTestHandler struct {
+	TestHandler
+	mutex    sync.Mutex
+	proofs   [][2]int
+	uploaded [2]int64
+}
+
+func (th *ProgressTestHandler) ProofProgress(done, total int) {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.proofs = append(th.proofs, [2]int{done, total})
+}
+func (th *ProgressTestHandler) UploadProgress(sent, total int64) {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.uploaded = [2]int64{sent, total}
+}
+func (th *ProgressTestHandler) Retrying(attempt int) {}
+
+// DismissTestHandler embeds a TestHandler, but instead of granting permission for disclosure it
+// sends the permission callback to its permission channel.
+type DismissTestHandler struct {
+	TestHandler
+	permission chan irmaclient.PermissionHandler
+}
+
+func (th DismissTestHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	th.permission <- callback
+}
+
 // ManualTestHandler embeds a TestHandler to inherit its methods.
 // Below we overwrite the methods that require behaviour specific to manual settings.
 type ManualTestHandler struct {
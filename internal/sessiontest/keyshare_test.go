@@ -66,7 +66,7 @@ func keyshareSessions(t *testing.T, client *irmaclient.Client) {
 	disclosureRequest := getDisclosureRequest(id)
 	disclosureRequest.Content = append(disclosureRequest.Content,
 		&irma.AttributeDisjunction{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")},
 		},
 	)
@@ -75,7 +75,7 @@ func keyshareSessions(t *testing.T, client *irmaclient.Client) {
 	sigRequest := getSigningRequest(id)
 	sigRequest.Content = append(sigRequest.Content,
 		&irma.AttributeDisjunction{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")},
 		},
 	)
@@ -1,10 +1,15 @@
 package sessiontest
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/stretchr/testify/require"
 )
 
@@ -70,3 +75,117 @@ func TestLogging(t *testing.T) {
 
 	test.ClearTestStorage(t)
 }
+
+func TestLogIntegrity(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getCombinedIssuanceRequest(attrid), "issue", client)
+	sessionHelper(t, getDisclosureRequest(attrid), "verification", client)
+	require.NoError(t, client.VerifyLogs())
+
+	logsfile := filepath.Join(test.FindTestdataFolder(t), "storage", "test", "logs")
+	original, err := ioutil.ReadFile(logsfile)
+	require.NoError(t, err)
+	var entries []map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(original, &entries))
+	require.True(t, len(entries) >= 2)
+	last := len(entries) - 1
+
+	requireProblem := func(logs []map[string]json.RawMessage, problem irmaclient.LogIntegrityProblem, entry int) {
+		bts, err := json.Marshal(logs)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(logsfile, bts, 0600))
+		err = client.VerifyLogs()
+		require.IsType(t, &irmaclient.LogIntegrityError{}, err)
+		require.Equal(t, problem, err.(*irmaclient.LogIntegrityError).Problem)
+		require.Equal(t, entry, err.(*irmaclient.LogIntegrityError).Entry)
+		require.NoError(t, ioutil.WriteFile(logsfile, original, 0600))
+		require.NoError(t, client.VerifyLogs())
+	}
+
+	// Remove the last log entry
+	requireProblem(entries[:last], irmaclient.LogTruncated, last)
+
+	// Remove the first log entry
+	requireProblem(entries[1:], irmaclient.LogChainBroken, 0)
+
+	// Modify a log entry
+	modified := append([]map[string]json.RawMessage{}, entries...)
+	modified[last] = map[string]json.RawMessage{}
+	for key, value := range entries[last] {
+		modified[last][key] = value
+	}
+	modified[last]["Time"] = json.RawMessage("0")
+	requireProblem(modified, irmaclient.LogEntryModified, last)
+}
+
+func TestLogHistory(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getCombinedIssuanceRequest(attrid), "issue", client)
+	sessionHelper(t, getDisclosureRequest(attrid), "verification", client)
+	sessionHelper(t, getSigningRequest(attrid), "signature", client)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+
+	// Pages contain the newest entries first
+	page, err := client.LogsPage(irmaclient.LogFilter{}, 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, []*irmaclient.LogEntry{logs[len(logs)-1], logs[len(logs)-2]}, page)
+	page, err = client.LogsPage(irmaclient.LogFilter{}, 2, 2)
+	require.NoError(t, err)
+	require.Equal(t, logs[len(logs)-3], page[0])
+	page, err = client.LogsPage(irmaclient.LogFilter{}, len(logs), 2)
+	require.NoError(t, err)
+	require.Empty(t, page)
+
+	// Filtering by session type and requestor
+	page, err = client.LogsPage(irmaclient.LogFilter{Types: []irma.Action{irma.ActionDisclosing}}, 0, 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, page)
+	for _, entry := range page {
+		require.Equal(t, irma.ActionDisclosing, entry.Type)
+	}
+	page, err = client.LogsPage(irmaclient.LogFilter{Verifier: "LOCALHOST"}, 0, 0)
+	require.NoError(t, err)
+	require.True(t, len(page) >= 2)
+	for _, entry := range page {
+		require.Equal(t, "localhost", entry.ServerName["en"])
+	}
+
+	// Structured entries
+	details, err := logs[len(logs)-1].Details(client.Configuration)
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionSigning, details.Type)
+	require.NotNil(t, details.SignedMessage)
+	require.NotEmpty(t, details.Disclosed)
+	require.Equal(t, attrid, details.Disclosed[0].Identifier)
+	details, err = logs[len(logs)-3].Details(client.Configuration)
+	require.NoError(t, err)
+	require.NotEmpty(t, details.Issued)
+
+	// Export
+	bts, err := client.ExportLogs(irmaclient.LogFilter{Types: []irma.Action{irma.ActionSigning}})
+	require.NoError(t, err)
+	var exported []*irmaclient.LogDetails
+	require.NoError(t, json.Unmarshal(bts, &exported))
+	require.NotEmpty(t, exported)
+	require.Equal(t, "s1234567", exported[0].Disclosed[0].Value["en"])
+
+	// Retention: older entries are removed, and the remaining log can still be verified
+	defer irma.SetClock(irma.SetClock(irma.FixedClock(time.Time(logs[len(logs)-1].Time).Add(time.Hour))))
+	require.NoError(t, client.SetLogRetention(2*time.Hour))
+	retained, err := client.Logs()
+	require.NoError(t, err)
+	require.True(t, len(retained) >= 3)
+	require.NoError(t, client.VerifyLogs())
+	require.NoError(t, client.SetLogRetention(time.Minute))
+	retained, err = client.Logs()
+	require.NoError(t, err)
+	require.Empty(t, retained)
+	require.NoError(t, client.VerifyLogs())
+}
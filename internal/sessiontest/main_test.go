@@ -49,11 +49,20 @@ func parseStorage(t *testing.T) (*irmaclient.Client, *TestClientHandler) {
 	return client, handler
 }
 
+// advanceClock lets the clock of irmago run the specified duration ahead of the system clock,
+// until the returned function is called.
+func advanceClock(d time.Duration) func() {
+	previous := irma.SetClock(irma.OffsetClock(d))
+	return func() {
+		irma.SetClock(previous)
+	}
+}
+
 func getDisclosureRequest(id irma.AttributeTypeIdentifier) *irma.DisclosureRequest {
 	return &irma.DisclosureRequest{
 		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
 		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{id},
 		}}),
 	}
@@ -65,7 +74,7 @@ func getSigningRequest(id irma.AttributeTypeIdentifier) *irma.SignatureRequest {
 		DisclosureRequest: irma.DisclosureRequest{
 			BaseRequest: irma.BaseRequest{Type: irma.ActionSigning},
 			Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-				Label:      "foo",
+				Label:      irma.NewLabel("foo"),
 				Attributes: []irma.AttributeTypeIdentifier{id},
 			}}),
 		},
@@ -127,7 +136,7 @@ func getSpecialIssuanceRequest(defaultValidity bool, attribute string) *irma.Iss
 func getCombinedIssuanceRequest(id irma.AttributeTypeIdentifier) *irma.IssuanceRequest {
 	request := getIssuanceRequest(false)
 	request.Disclose = irma.AttributeDisjunctionList{
-		&irma.AttributeDisjunction{Label: "foo", Attributes: []irma.AttributeTypeIdentifier{id}},
+		&irma.AttributeDisjunction{Label: irma.NewLabel("foo"), Attributes: []irma.AttributeTypeIdentifier{id}},
 	}
 	return request
 }
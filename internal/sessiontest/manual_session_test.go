@@ -165,3 +165,60 @@ func TestManualDisclosureSessionInvalidRequest(t *testing.T) {
 	// Second attribute result is EXTRA, since it is disclosed, but not matching the sigrequest
 	require.Equal(t, irma.AttributeProofStatusExtra, attrs[1].Status)
 }
+
+type OfflineTestHandler struct {
+	ManualTestHandler
+	proofs chan *irma.OfflineProof
+}
+
+func (th *OfflineTestHandler) OfflineProofReady(proof *irma.OfflineProof) {
+	th.proofs <- proof
+}
+
+func TestOfflineSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := "{\"nonce\": 42, \"context\": 1337, \"type\": \"disclosing\", \"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"
+	h := &OfflineTestHandler{
+		ManualTestHandler: *createManualSessionHandler(t, client),
+		proofs:            make(chan *irma.OfflineProof, 1),
+	}
+	client.NewOfflineSession(request, h)
+	result := <-h.c
+	require.NotNil(t, result)
+	require.NoError(t, result.Err)
+	proof := <-h.proofs
+	require.Equal(t, irma.ActionDisclosing, proof.Type)
+
+	// Transfer the proof as QR codes, scanned in reverse order
+	chunks, err := proof.QRChunks(500)
+	require.NoError(t, err)
+	require.True(t, len(chunks) > 1)
+	scanner := &irma.OfflineProofScanner{}
+	var done bool
+	for i := len(chunks) - 1; i >= 0; i-- {
+		done, err = scanner.Add(chunks[i])
+		require.NoError(t, err)
+	}
+	require.True(t, done)
+	scanned, err := scanner.Proof()
+	require.NoError(t, err)
+
+	verifyAs := &irma.DisclosureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(request), verifyAs))
+	attrs, status, err := scanned.Verify(client.Configuration, verifyAs)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, "456", attrs[0].Value["en"])
+
+	// A disclosure cannot be verified without its request
+	_, _, err = scanned.Verify(client.Configuration, nil)
+	require.Error(t, err)
+
+	// Other nonces do not verify
+	verifyAs.Nonce = big.NewInt(43)
+	_, status, err = scanned.Verify(client.Configuration, verifyAs)
+	require.NoError(t, err)
+	require.NotEqual(t, irma.ProofStatusValid, status)
+}
@@ -1,12 +1,42 @@
 package sessiontest
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/gorilla/websocket"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorclient"
+	"github.com/privacybydesign/irmago/server/requestorserver"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,6 +70,62 @@ func requestorSessionHelper(t *testing.T, request irma.SessionRequest) *server.S
 	return serverResult
 }
 
+func TestShutdown(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	results := make(chan *server.SessionResult, 1)
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, _, err := irmaServer.StartSession(request, func(result *server.SessionResult) {
+		results <- result
+	})
+	require.NoError(t, err)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- irmaServer.Shutdown(context.Background())
+	}()
+	for !irmaServer.Draining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New sessions are refused, while the unfinished session keeps the server from stopping
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("server stopped before the unfinished session finished")
+	default:
+	}
+
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, c, client, nil})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	require.NoError(t, <-stopped)
+	require.Equal(t, server.StatusDone, (<-results).Status)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, irmaServer.Shutdown(ctx))
+}
+
 func TestRequestorSignatureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	serverResult := requestorSessionHelper(t, &irma.SignatureRequest{
@@ -47,7 +133,7 @@ func TestRequestorSignatureSession(t *testing.T) {
 		DisclosureRequest: irma.DisclosureRequest{
 			BaseRequest: irma.BaseRequest{Type: irma.ActionSigning},
 			Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-				Label:      "foo",
+				Label:      irma.NewLabel("foo"),
 				Attributes: []irma.AttributeTypeIdentifier{id},
 			}}),
 		},
@@ -65,7 +151,7 @@ func TestRequestorDisclosureSession(t *testing.T) {
 	request := &irma.DisclosureRequest{
 		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
 		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{id},
 		}}),
 	}
@@ -79,10 +165,10 @@ func TestRequestorDisclosureMultipleAttrs(t *testing.T) {
 	request := &irma.DisclosureRequest{
 		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
 		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
 		}, {
-			Label:      "bar",
+			Label:      irma.NewLabel("bar"),
 			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
 		}}),
 	}
@@ -158,7 +244,7 @@ func testRequestorIssuance(t *testing.T, keyshare bool) {
 		})
 	}
 	request.Disclose = []*irma.AttributeDisjunction{{
-		Label:      "foo",
+		Label:      irma.NewLabel("foo"),
 		Attributes: []irma.AttributeTypeIdentifier{attrid},
 	}}
 
@@ -169,3 +255,1550 @@ func testRequestorIssuance(t *testing.T, keyshare bool) {
 	require.Equal(t, attrid, result.Disclosed[0].Identifier)
 	require.Equal(t, "456", result.Disclosed[0].Value["en"])
 }
+
+func TestIssuanceCondition(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Copy the disclosed student ID into the studentCardNumber of the new credential,
+	// and veto issuance if the student ID is not disclosed
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	StartIrmaServerWithCondition(t, func(disclosed []*irma.DisclosedAttribute, credentials []*irma.CredentialRequest) error {
+		if len(disclosed) == 0 || disclosed[0].Identifier != id {
+			return errors.New("student ID not disclosed")
+		}
+		credentials[0].Attributes["studentCardNumber"] = "verified-" + disclosed[0].Value["en"]
+		return nil
+	})
+	defer StopIrmaServer()
+
+	// issue performs the session, checking that the client fails only if denied is true
+	issue := func(request *irma.IssuanceRequest, denied bool) *server.SessionResult {
+		clientChan := make(chan *SessionResult)
+		serverChan := make(chan *server.SessionResult, 1)
+		qr, _, err := irmaServer.StartSession(request, func(result *server.SessionResult) {
+			serverChan <- result
+		})
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+
+		clientResult := <-clientChan
+		if denied {
+			require.NotNil(t, clientResult)
+			require.Error(t, clientResult.Err)
+		} else if clientResult != nil {
+			require.NoError(t, clientResult.Err)
+		}
+		select {
+		case serverResult := <-serverChan:
+			return serverResult
+		case <-time.After(10 * time.Second):
+			t.Fatal("server did not report the session result")
+			return nil
+		}
+	}
+
+	serverResult := issue(getCombinedIssuanceRequest(id), false)
+	require.Equal(t, server.StatusDone, serverResult.Status)
+	found := false
+	for _, cred := range client.CredentialInfoList() {
+		if cred.ID == "studentCard" && cred.Attributes[irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber")]["en"] == "verified-456" {
+			found = true
+		}
+	}
+	require.True(t, found, "credential with modified attribute not issued")
+
+	serverResult = issue(getIssuanceRequest(false), true)
+	require.Equal(t, server.StatusCancelled, serverResult.Status)
+	require.Equal(t, string(server.ErrorIssuanceDenied.Type), serverResult.Err.ErrorName)
+}
+
+func TestRequestorJwtAlgorithms(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor4-sk.pem"))
+	require.NoError(t, err)
+	ecdsask, err := jwt.ParseECPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	bts, err = ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor5-sk.pem"))
+	require.NoError(t, err)
+	ed25519sk, err := irma.ParseEd25519PrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	for _, c := range []struct {
+		requestor string
+		alg       jwt.SigningMethod
+		key       interface{}
+		ok        bool
+	}{
+		{"requestor4", jwt.SigningMethodES256, ecdsask, true},
+		{"requestor5", irma.SigningMethodEdDSA, ed25519sk, true},
+		// Requestors may only use the signature algorithm belonging to their key
+		{"requestor4", irma.SigningMethodEdDSA, ed25519sk, false},
+		{"requestor5", jwt.SigningMethodES256, ecdsask, false},
+	} {
+		j, err := irma.SignSessionRequest(request, c.alg, c.key, c.requestor)
+		require.NoError(t, err)
+		pkg := &server.SessionPackage{}
+		err = transport.Post("session", pkg, j)
+		if c.ok {
+			require.NoError(t, err, "%s using %s", c.requestor, c.alg.Alg())
+			require.NotEmpty(t, pkg.Token)
+		} else {
+			require.Error(t, err, "%s using %s", c.requestor, c.alg.Alg())
+		}
+	}
+}
+
+func TestRequestorJWKS(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor4-sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseECPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	sign := func(requestor, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, irma.NewServiceProviderJwt(requestor, request))
+		token.Header["kid"] = kid
+		j, err := token.SignedString(sk)
+		require.NoError(t, err)
+		return j
+	}
+
+	// The kid header specifies the key of the requestor (the jwt issuer) within its JWKS
+	pkg := &server.SessionPackage{}
+	require.NoError(t, transport.Post("session", pkg, sign("requestor6", "requestor6-key1")))
+	require.NotEmpty(t, pkg.Token)
+
+	// Unknown key ID
+	require.Error(t, transport.Post("session", &server.SessionPackage{}, sign("requestor6", "requestor6-key2")))
+	// The JWKS of a requestor cannot be used by other requestors
+	require.Error(t, transport.Post("session", &server.SessionPackage{}, sign("requestor4", "requestor6-key1")))
+}
+
+func TestRequestorExclusivePermissions(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "requestor7-token")
+	root := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: []*irma.CredentialRequest{{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+			Attributes:       map[string]string{"BSN": "299792458"},
+		}},
+	}
+	for _, c := range []struct {
+		request irma.SessionRequest
+		ok      bool
+	}{
+		{getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), true},
+		{getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")), false},
+		{root, true},
+		{getIssuanceRequest(true), false},
+		// The global permissions, allowing everything, do not apply to this requestor
+		{getSigningRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), false},
+	} {
+		var pkg server.SessionPackage
+		err := transport.Post("session", &pkg, c.request)
+		if c.ok {
+			require.NoError(t, err)
+			require.NotEmpty(t, pkg.Token)
+		} else {
+			require.Error(t, err)
+			require.Equal(t, string(server.ErrorUnauthorized.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           48682,
+		RateLimits:                     requestorserver.RateLimits{SessionRate: 0.1, RateBurst: 2},
+	})
+	defer StopRequestorServer()
+
+	status := func(token string) *http.Response {
+		res, err := http.Get("http://localhost:48682/session/" + token + "/status")
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+
+	// The burst of requests to a session is allowed, after which it is throttled
+	require.Equal(t, http.StatusBadRequest, status("abc").StatusCode)
+	require.Equal(t, http.StatusBadRequest, status("abc").StatusCode)
+	res := status("abc")
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	// Other sessions have their own limit
+	require.Equal(t, http.StatusBadRequest, status("def").StatusCode)
+}
+
+func TestResultClaims(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "requestor7-token")
+	var pkg server.SessionPackage
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, transport.Post("session", &pkg, request))
+
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, c, client, nil})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	res, err := http.Get("http://localhost:48682/session/" + pkg.Token + "/result-jwt")
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	skbts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(string(bts), claims, func(token *jwt.Token) (interface{}, error) {
+		return &sk.PublicKey, nil
+	})
+	require.NoError(t, err)
+
+	// Only the mapped attribute is present, in the configured claim
+	require.Equal(t, "disclosing_result", claims["sub"])
+	require.Equal(t, string(irma.ProofStatusValid), claims["proofStatus"])
+	require.Equal(t, map[string]interface{}{"id": "456"}, claims["student"])
+	require.NotContains(t, claims, "disclosed")
+}
+
+func TestSessionTemplate(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "xa6=*&9?8jeUu5>.f-%rVg`f63pHim")
+
+	// Variables must be present and match their pattern
+	var pkg server.SessionPackage
+	for _, variables := range []map[string]string{
+		{},
+		{"number": "123"},
+		{"number": "7654321", "university": "Utrecht"},
+	} {
+		err := transport.Post("session/template/studentcard", &pkg, variables)
+		require.Error(t, err)
+		require.Equal(t, string(server.ErrorInvalidRequest.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+	}
+
+	// Only the requestor of the template may use it
+	other := irma.NewHTTPTransport("http://localhost:48682")
+	other.SetHeader("Authorization", "requestor7-token")
+	err := other.Post("session/template/studentcard", &pkg, map[string]string{"number": "7654321"})
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorUnauthorized.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+
+	require.NoError(t, transport.Post("session/template/studentcard", &pkg, map[string]string{"number": "7654321"}))
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, c, client, nil})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// The variable was substituted into the issued credential
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	var found bool
+	for _, cred := range client.CredentialInfoList() {
+		if value, ok := cred.Attributes[studentID]; ok && value["en"] == "s7654321" {
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestChainedSessions(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	skbts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+
+	// The next session issues the disclosed student number as BSN
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		claims := &struct {
+			jwt.StandardClaims
+			server.SessionResult
+		}{}
+		_, err = jwt.ParseWithClaims(string(bts), claims, func(token *jwt.Token) (interface{}, error) {
+			return &sk.PublicKey, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, server.StatusDone, claims.Status)
+		require.Len(t, claims.Disclosed, 1)
+
+		request := &irma.IssuanceRequest{
+			BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+			Credentials: []*irma.CredentialRequest{{
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+				Attributes:       map[string]string{"BSN": *claims.Disclosed[0].RawValue},
+			}},
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(request))
+	}))
+	defer next.Close()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", "xa6=*&9?8jeUu5>.f-%rVg`f63pHim")
+	var pkg server.SessionPackage
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{NextSessionUrl: next.URL},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	require.NoError(t, transport.Post("session", &pkg, request))
+
+	// The client performs both sessions, without scanning another QR
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, c, client, nil})
+	for i := 0; i < 2; i++ {
+		if result := <-c; result != nil {
+			require.NoError(t, result.Err)
+		}
+	}
+
+	var result server.SessionResult
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result", &result))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.NotEmpty(t, result.NextSession)
+	var nextResult server.SessionResult
+	require.NoError(t, transport.Get("session/"+result.NextSession+"/result", &nextResult))
+	require.Equal(t, server.StatusDone, nextResult.Status)
+	require.Equal(t, irma.ActionIssuing, nextResult.Type)
+
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	var found bool
+	for _, cred := range client.CredentialInfoList() {
+		if value, ok := cred.Attributes[bsn]; ok && value["en"] == "456" {
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestRequestorClient(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	rclient := requestorclient.NewWithToken("http://localhost:48682", "xa6=*&9?8jeUu5>.f-%rVg`f63pHim")
+	rclient.PollInterval = 50 * time.Millisecond
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	pkg, err := rclient.StartSession(getDisclosureRequest(id))
+	require.NoError(t, err)
+	status, err := rclient.Status(pkg.Token)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusInitialized, status)
+
+	c := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, c, client, nil})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := rclient.Await(ctx, pkg.Token)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+
+	// The result JWT is verified against the public key retrieved from the server
+	claims, err := rclient.VerifiedResult(pkg.Token)
+	require.NoError(t, err)
+	require.Equal(t, "disclosing_result", claims.Subject)
+	require.Len(t, claims.Disclosed, 1)
+	require.Equal(t, "456", *claims.Disclosed[0].RawValue)
+
+	// JWTs signed by others are rejected
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims.Claims).SignedString(sk)
+	require.NoError(t, err)
+	_, err = rclient.ParseResultJwt(forged)
+	require.Error(t, err)
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	ca, cakey, capem, _ := createCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, servercert, serverkey := createCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, cakey)
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "requestor"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	pinned, _, pinnedcert, pinnedkey := createCertificate(t, clientTemplate, nil, nil)
+	_, _, issuedcert, issuedkey := createCertificate(t, clientTemplate, ca, cakey)
+	_, _, unknowncert, unknownkey := createCertificate(t, clientTemplate, nil, nil)
+
+	sum := sha256.Sum256(pinned.Raw)
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "https://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		},
+		Port:           48682,
+		TlsCertificate: servercert,
+		TlsPrivateKey:  serverkey,
+		Requestors: map[string]requestorserver.Requestor{
+			"pinned": {
+				AuthenticationMethod:    requestorserver.AuthenticationMethodCertificate,
+				CertificateFingerprints: []string{hex.EncodeToString(sum[:])},
+				Permissions:             requestorserver.Permissions{Disclosing: []string{"irma-demo.RU.*"}},
+			},
+			"issued": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodCertificate,
+				AuthenticationKey:    capem,
+				Permissions:          requestorserver.Permissions{Disclosing: []string{"irma-demo.MijnOverheid.*"}},
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	post := func(cert, key, attr string) int {
+		tlsConf := &tls.Config{RootCAs: roots}
+		if cert != "" {
+			keypair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+			require.NoError(t, err)
+			tlsConf.Certificates = []tls.Certificate{keypair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		request, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier(attr)))
+		require.NoError(t, err)
+		res, err := client.Post("https://localhost:48682/session", "application/json", bytes.NewReader(request))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	// The requestor is identified by its certificate, and so gets its own permissions
+	studentID, bsn := "irma-demo.RU.studentCard.studentID", "irma-demo.MijnOverheid.root.BSN"
+	require.Equal(t, http.StatusOK, post(pinnedcert, pinnedkey, studentID))
+	require.Equal(t, http.StatusForbidden, post(pinnedcert, pinnedkey, bsn))
+	require.Equal(t, http.StatusOK, post(issuedcert, issuedkey, bsn))
+	require.Equal(t, http.StatusForbidden, post(issuedcert, issuedkey, studentID))
+
+	require.Equal(t, http.StatusForbidden, post(unknowncert, unknownkey, studentID))
+	require.Equal(t, http.StatusBadRequest, post("", "", studentID))
+}
+
+// createCertificate creates a certificate from the template, signed by the parent (or self-signed
+// if parent is nil), returning it along with its private key, and both PEM-encoded.
+func createCertificate(
+	t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, sk
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &sk.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	skder, err := x509.MarshalECPrivateKey(sk)
+	require.NoError(t, err)
+	return cert, sk,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skder}))
+}
+
+func TestAdminAPI(t *testing.T) {
+	token := func(key string) requestorserver.Requestor {
+		return requestorserver.Requestor{AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: key}
+	}
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		Port:        48682,
+		Permissions: requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors:  map[string]requestorserver.Requestor{"first": token("first-token")},
+		RequestorsLoader: func() (map[string]requestorserver.Requestor, error) {
+			return map[string]requestorserver.Requestor{"second": token("second-token")}, nil
+		},
+		AdminToken: "admin-token",
+	})
+	defer StopRequestorServer()
+
+	admin := func(method, path, auth string, result interface{}) int {
+		req, err := http.NewRequest(method, "http://localhost:48682/admin/"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = res.Body.Close() }()
+		if result != nil && res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(result))
+		}
+		return res.StatusCode
+	}
+	start := func(key string) (string, error) {
+		transport := irma.NewHTTPTransport("http://localhost:48682")
+		transport.SetHeader("Authorization", key)
+		var pkg server.SessionPackage
+		err := transport.Post("session", &pkg, getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+		return pkg.Token, err
+	}
+
+	sessionToken, err := start("first-token")
+	require.NoError(t, err)
+
+	// The admin API requires the admin token
+	require.Equal(t, http.StatusForbidden, admin(http.MethodGet, "sessions", "", nil))
+	require.Equal(t, http.StatusForbidden, admin(http.MethodGet, "sessions", "first-token", nil))
+
+	var sessions []*server.SessionInfo
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "sessions", "admin-token", &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, sessionToken, sessions[0].Token)
+	require.Equal(t, "first", sessions[0].Requestor)
+	require.Equal(t, server.StatusInitialized, sessions[0].Status)
+
+	var disabled map[string]string
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "schemes/disabled", "admin-token", &disabled))
+	require.Empty(t, disabled)
+
+	// Cancelled sessions are no longer active
+	require.Equal(t, http.StatusNoContent, admin(http.MethodDelete, "session/"+sessionToken, "admin-token", nil))
+	require.Equal(t, http.StatusOK, admin(http.MethodGet, "sessions", "admin-token", &sessions))
+	require.Empty(t, sessions)
+
+	// After reloading, only the new requestors can start sessions
+	require.Equal(t, http.StatusNoContent, admin(http.MethodPost, "requestors/reload", "admin-token", nil))
+	_, err = start("first-token")
+	require.Error(t, err)
+	_, err = start("second-token")
+	require.NoError(t, err)
+
+	// Invalid requestors are refused, keeping the current ones
+	require.Error(t, requestorServer.ReloadRequestors(map[string]requestorserver.Requestor{
+		"third": {AuthenticationMethod: "nonexisting"},
+	}))
+	_, err = start("second-token")
+	require.NoError(t, err)
+}
+
+func TestRequestorsWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requestors")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	keyfile := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(keyfile, []byte("old-token"), 0600))
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		Port:        48682,
+		Permissions: requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor": {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKeyFile: keyfile},
+		},
+		RequestorsWatchInterval: 1,
+	})
+	defer StopRequestorServer()
+
+	start := func(key string) error {
+		transport := irma.NewHTTPTransport("http://localhost:48682")
+		transport.SetHeader("Authorization", key)
+		var pkg server.SessionPackage
+		return transport.Post("session", &pkg, getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	}
+	require.NoError(t, start("old-token"))
+
+	// Rotate the key of the requestor
+	require.NoError(t, ioutil.WriteFile(keyfile, []byte("new-token"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyfile, later, later))
+	time.Sleep(2500 * time.Millisecond)
+	require.Error(t, start("old-token"))
+	require.NoError(t, start("new-token"))
+}
+
+func TestTenants(t *testing.T) {
+	token := func(key string) map[string]requestorserver.Requestor {
+		return map[string]requestorserver.Requestor{
+			"requestor": {AuthenticationMethod: requestorserver.AuthenticationMethodToken, AuthenticationKey: key},
+		}
+	}
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		Port:              48682,
+		Permissions:       requestorserver.Permissions{Disclosing: []string{"*"}},
+		Requestors:        token("default-token"),
+		JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "sk.pem"),
+		Tenants: map[string]*requestorserver.Tenant{
+			"acme": {
+				PathPrefix:        "/acme",
+				Permissions:       requestorserver.Permissions{Disclosing: []string{"*"}},
+				Requestors:        token("acme-token"),
+				Issuers:           []string{"irma-demo.RU"},
+				JwtIssuer:         "acme",
+				JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "requestor1-sk.pem"),
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	start := func(prefix, key, attr string) (string, error) {
+		transport := irma.NewHTTPTransport("http://localhost:48682" + prefix)
+		transport.SetHeader("Authorization", key)
+		var pkg server.SessionPackage
+		err := transport.Post("session", &pkg, getDisclosureRequest(irma.NewAttributeTypeIdentifier(attr)))
+		return pkg.Token, err
+	}
+	studentID, bsn := "irma-demo.RU.studentCard.studentID", "irma-demo.MijnOverheid.root.BSN"
+
+	// Requestors only authenticate to the endpoints of their own tenant
+	_, err := start("", "default-token", bsn)
+	require.NoError(t, err)
+	_, err = start("", "acme-token", studentID)
+	require.Error(t, err)
+	_, err = start("/acme", "default-token", studentID)
+	require.Error(t, err)
+	sessionToken, err := start("/acme", "acme-token", studentID)
+	require.NoError(t, err)
+
+	// Requestors of the tenant can only use the issuers of the tenant
+	_, err = start("/acme", "acme-token", bsn)
+	require.Error(t, err)
+
+	// The results of the sessions of the tenant are signed with the key of the tenant
+	res, err := http.Get("http://localhost:48682/session/" + sessionToken + "/result-jwt")
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	skbts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor1-sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(string(bts), claims, func(token *jwt.Token) (interface{}, error) {
+		return &sk.PublicKey, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "acme", claims["iss"])
+
+	// Each tenant publishes its own public key
+	publickey := func(prefix string) []byte {
+		res, err := http.Get("http://localhost:48682" + prefix + "/publickey")
+		require.NoError(t, err)
+		bts, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return bts
+	}
+	require.NotEqual(t, publickey(""), publickey("/acme"))
+}
+
+func TestCorsAndSecurityHeaders(t *testing.T) {
+	frontend, backend, restricted := "https://frontend.example.com", "https://backend.example.com", "https://restricted.example.com"
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			CorsOrigins:           []string{frontend},
+		},
+		Port:                 48682,
+		Permissions:          requestorserver.Permissions{Disclosing: []string{"*"}},
+		RequestorCorsOrigins: []string{backend},
+		SecurityHeaders:      map[string]string{"X-Frame-Options": "SAMEORIGIN", "Referrer-Policy": ""},
+		Requestors: map[string]requestorserver.Requestor{
+			"restricted": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "restricted-token",
+				CorsOrigins:          []string{restricted},
+			},
+			"other": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "other-token",
+			},
+		},
+	})
+	defer StopRequestorServer()
+
+	do := func(method, path, origin, token string) *http.Response {
+		var body []byte
+		if method == http.MethodPost {
+			var err error
+			body, err = json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+			require.NoError(t, err)
+		}
+		req, err := http.NewRequest(method, "http://localhost:48682/"+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+
+	// The origins of the requestors may access the requestor endpoints
+	res := do(http.MethodOptions, "session", restricted, "")
+	require.Equal(t, restricted, res.Header.Get("Access-Control-Allow-Origin"))
+	res = do(http.MethodOptions, "session", "https://evil.example.com", "")
+	require.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+
+	// Requestors with origins may start sessions from browsers only from those origins
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, "session", backend, "restricted-token").StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "session", restricted, "restricted-token").StatusCode)
+	res = do(http.MethodPost, "session", backend, "other-token")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, backend, res.Header.Get("Access-Control-Allow-Origin"))
+
+	// The session status endpoints are accessible to the origins of the IRMA app endpoints
+	res = do(http.MethodGet, "session/unknown/status", frontend, "")
+	require.Equal(t, frontend, res.Header.Get("Access-Control-Allow-Origin"))
+	res = do(http.MethodGet, "session/unknown/status", backend, "")
+	require.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+
+	// Security headers, of which some are overridden
+	require.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	require.Equal(t, "SAMEORIGIN", res.Header.Get("X-Frame-Options"))
+	require.NotEmpty(t, res.Header.Get("Content-Security-Policy"))
+	require.NotContains(t, res.Header, "Referrer-Policy")
+}
+
+func TestSandboxSession(t *testing.T) {
+	sandbox, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		Sandbox:               true,
+		SandboxCredentials:    getIssuanceRequest(true).Credentials,
+	})
+	require.NoError(t, err)
+	defer sandbox.Stop()
+
+	// Disclosure of an attribute held by the sandbox client
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := sandbox.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	result, rerr := sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, "s1234567", result.Disclosed[0].Value["en"])
+
+	// Attribute-based signature
+	_, token, err = sandbox.StartSession(getSigningRequest(id), nil)
+	require.NoError(t, err)
+	result, rerr = sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.NotNil(t, result.Signature)
+
+	// Issuance
+	_, token, err = sandbox.StartSession(getNameIssuanceRequest(), nil)
+	require.NoError(t, err)
+	result, rerr = sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	// The sandbox client cancels sessions asking for attributes it does not have
+	_, token, err = sandbox.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")), nil)
+	require.NoError(t, err)
+	result, rerr = sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusCancelled, result.Status)
+
+	// Sessions can be completed only once
+	_, rerr = sandbox.CompleteSandboxSession(token)
+	require.NotNil(t, rerr)
+}
+
+func TestSubscribeStatus(t *testing.T) {
+	sandbox, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		Sandbox:               true,
+		SandboxCredentials:    getIssuanceRequest(true).Credentials,
+	})
+	require.NoError(t, err)
+	defer sandbox.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := sandbox.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	statuses := sandbox.SubscribeStatus(token)
+	_, rerr := sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+
+	var received []server.Status
+	for status := range statuses {
+		received = append(received, status)
+	}
+	require.Equal(t, []server.Status{server.StatusInitialized, server.StatusConnected, server.StatusDone}, received)
+
+	// Subscribing to a finished session yields its final status
+	received = nil
+	for status := range sandbox.SubscribeStatus(token) {
+		received = append(received, status)
+	}
+	require.Equal(t, []server.Status{server.StatusDone}, received)
+
+	// The channel of an unknown session is closed right away
+	_, ok := <-sandbox.SubscribeStatus("nonexisting")
+	require.False(t, ok)
+}
+
+func TestSessionLifetime(t *testing.T) {
+	irmaserv, err := irmaserver.New(&server.Configuration{
+		URL:           "http://localhost:48680",
+		Logger:        logger,
+		SchemesPath:   filepath.Join(testdata, "irma_configuration"),
+		ClientTimeout: 60,
+	})
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	start := func(timeout, lifetime int) (*irma.Qr, string, error) {
+		return irmaserv.StartSession(&irma.ServiceProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{ClientTimeout: timeout, SessionLifetime: lifetime},
+			Request:              getDisclosureRequest(id),
+		}, nil)
+	}
+	requireExpiry := func(qr *irma.Qr, seconds int) {
+		require.NotNil(t, qr.Expiry)
+		expected := time.Now().Add(time.Duration(seconds) * time.Second)
+		require.WithinDuration(t, expected, time.Time(*qr.Expiry), 2*time.Second)
+	}
+
+	// The client timeout of the server applies, unless the request specifies one,
+	// and the session lifetime caps it
+	qr, _, err := start(0, 0)
+	require.NoError(t, err)
+	requireExpiry(qr, 60)
+	qr, _, err = start(120, 0)
+	require.NoError(t, err)
+	requireExpiry(qr, 120)
+	qr, _, err = start(120, 30)
+	require.NoError(t, err)
+	requireExpiry(qr, 30)
+
+	_, _, err = start(-1, 0)
+	require.Error(t, err)
+
+	// Sessions to which no IRMA app connects time out
+	qr, token, err := start(1, 0)
+	require.NoError(t, err)
+	requireExpiry(qr, 1)
+	var status server.Status
+	for status = range irmaserv.SubscribeStatus(token) {
+	}
+	require.Equal(t, server.StatusTimeout, status)
+}
+
+func TestStatusWebSocket(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                "http://localhost:48682/irma",
+			Logger:             logger,
+			SchemesPath:        filepath.Join(testdata, "irma_configuration"),
+			Sandbox:            true,
+			SandboxCredentials: getIssuanceRequest(true).Credentials,
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           48682,
+	})
+	defer StopRequestorServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request, err := json.Marshal(getDisclosureRequest(id))
+	require.NoError(t, err)
+	res, err := http.Post("http://localhost:48682/session", "application/json", bytes.NewReader(request))
+	require.NoError(t, err)
+	pkg := &server.SessionPackage{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(pkg))
+	require.NoError(t, res.Body.Close())
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:48682/session/"+pkg.Token+"/statusws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	var status server.Status
+	require.NoError(t, conn.ReadJSON(&status))
+	require.Equal(t, server.StatusInitialized, status)
+
+	res, err = http.Post("http://localhost:48682/session/"+pkg.Token+"/sandbox", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.NoError(t, conn.ReadJSON(&status))
+	require.Equal(t, server.StatusConnected, status)
+	require.NoError(t, conn.ReadJSON(&status))
+	require.Equal(t, server.StatusDone, status)
+
+	// The server closes the connection once the session has finished
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestResultCallback(t *testing.T) {
+	key := []byte("callback secret")
+	sandbox, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		Sandbox:               true,
+		SandboxCredentials:    getIssuanceRequest(true).Credentials,
+		CallbackHmacKey:       base64.StdEncoding.EncodeToString(key),
+	})
+	require.NoError(t, err)
+	defer sandbox.Stop()
+
+	// The callback endpoint fails the first time, after which the result is POSTed again
+	results := make(chan *server.SessionResult, 1)
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		timestamp, err := strconv.ParseInt(r.Header.Get(irmaserver.CallbackTimestampHeader), 10, 64)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), time.Unix(timestamp, 0), time.Minute)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(r.Header.Get(irmaserver.CallbackTimestampHeader) + "."))
+		mac.Write(body)
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(irmaserver.CallbackSignatureHeader))
+		result := &server.SessionResult{}
+		require.NoError(t, json.Unmarshal(body, result))
+		results <- result
+	}))
+	defer callback.Close()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackUrl: callback.URL},
+		Request:              getDisclosureRequest(id),
+	}
+	_, token, err := sandbox.StartSession(request, nil)
+	require.NoError(t, err)
+	_, rerr := sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+
+	select {
+	case result := <-results:
+		require.Equal(t, token, result.Token)
+		require.Equal(t, server.StatusDone, result.Status)
+		require.Equal(t, "s1234567", result.Disclosed[0].Value["en"])
+	case <-time.After(10 * time.Second):
+		t.Fatal("no session result received")
+	}
+	require.Equal(t, 2, attempts)
+
+	// Without a signing key, session requests with a callbackUrl are refused
+	plain, err := irmaserver.New(&server.Configuration{
+		URL:         "http://localhost:48680",
+		Logger:      logger,
+		SchemesPath: filepath.Join(testdata, "irma_configuration"),
+	})
+	require.NoError(t, err)
+	defer plain.Stop()
+	_, _, err = plain.StartSession(request, nil)
+	require.Error(t, err)
+
+	// Stopping the server ends the retries of a failing callback
+	retrying, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		Sandbox:               true,
+		SandboxCredentials:    getIssuanceRequest(true).Credentials,
+		CallbackHmacKey:       base64.StdEncoding.EncodeToString(key),
+	})
+	require.NoError(t, err)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	request.CallbackUrl = failing.URL
+	_, token, err = retrying.StartSession(request, nil)
+	require.NoError(t, err)
+	_, rerr = retrying.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	time.Sleep(100 * time.Millisecond) // let the first attempt fail
+	start := time.Now()
+	retrying.Stop()
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestRequestSignature(t *testing.T) {
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor5-sk.pem"))
+	require.NoError(t, err)
+	sk, err := irma.ParseEd25519PrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	bts, err = ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor5.pem"))
+	require.NoError(t, err)
+	pk, err := irma.ParseEd25519PublicKeyFromPEM(bts)
+	require.NoError(t, err)
+
+	irmaServer, err := irmaserver.New(&server.Configuration{
+		URL:                "http://localhost:48680",
+		Logger:             logger,
+		SchemesPath:        filepath.Join(testdata, "irma_configuration"),
+		RequestApprovalKey: pk,
+	})
+	require.NoError(t, err)
+	defer irmaServer.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{Request: getDisclosureRequest(id)}
+	sig, err := irma.SignRequestHash(request.Request, irma.SigningMethodEdDSA, sk)
+	require.NoError(t, err)
+	request.RequestSignature = &irma.RequestSignature{Alg: irma.SigningMethodEdDSA.Alg(), Signature: sig}
+
+	// The signature survives the request being passed on as JSON by an intermediary
+	bts, err = json.Marshal(request)
+	require.NoError(t, err)
+	_, _, err = irmaServer.StartSession(bts, nil)
+	require.NoError(t, err)
+
+	// Tampered and unsigned requests are refused
+	request.Request.Content[0].Attributes[0] = irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	request.Request = getDisclosureRequest(id)
+	request.RequestSignature.Alg = "none"
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	request.RequestSignature = nil
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+}
+
+func TestStaticSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	results := make(chan *server.SessionResult, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := &server.SessionResult{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(result))
+		results <- result
+	}))
+	defer callback.Close()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request, err := json.Marshal(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackUrl: callback.URL},
+		Request:              getDisclosureRequest(id),
+	})
+	require.NoError(t, err)
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:             "http://localhost:48682/irma",
+			Logger:          logger,
+			SchemesPath:     filepath.Join(testdata, "irma_configuration"),
+			CallbackHmacKey: base64.StdEncoding.EncodeToString([]byte("callback secret")),
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           48682,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+		StaticSessions: map[string]requestorserver.StaticSession{
+			"studentcard": {Request: request},
+		},
+	})
+	defer StopRequestorServer()
+
+	// Each scan of the static QR starts a new session
+	qr := `{"irmaqr": "redirect", "u": "http://localhost:48682/irma/session/studentcard"}`
+	tokens := map[string]struct{}{}
+	for i := 0; i < 2; i++ {
+		c := make(chan *SessionResult)
+		client.NewSession(qr, TestHandler{t, c, client, nil})
+		if result := <-c; result != nil {
+			require.NoError(t, result.Err)
+		}
+
+		select {
+		case result := <-results:
+			require.Equal(t, server.StatusDone, result.Status)
+			require.Equal(t, id, result.Disclosed[0].Identifier)
+			tokens[result.Token] = struct{}{}
+		case <-time.After(10 * time.Second):
+			t.Fatal("no session result received")
+		}
+	}
+	require.Len(t, tokens, 2)
+
+	// Unknown static sessions cannot be started
+	res, err := http.Post("http://localhost:48682/irma/session/unknown", "application/json", nil)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, server.ErrorInvalidRequest.Status, res.StatusCode)
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	// Two servers sharing a Redis session store can each handle any session
+	var servers [2]*irmaserver.Server
+	defer func() {
+		for _, s := range servers {
+			if s != nil {
+				s.Stop()
+			}
+		}
+	}()
+	for i := range servers {
+		servers[i], err = irmaserver.New(&server.Configuration{
+			URL:                   "http://localhost:48680",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			Sandbox:               true,
+			SandboxCredentials:    getIssuanceRequest(true).Credentials,
+			StoreType:             "redis",
+			RedisAddr:             mr.Addr(),
+		})
+		require.NoError(t, err)
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := servers[0].StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusInitialized, servers[1].GetSessionResult(token).Status)
+	require.NotNil(t, servers[1].GetRequest(token))
+
+	result, rerr := servers[1].CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	result = servers[0].GetSessionResult(token)
+	require.NotNil(t, result)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "s1234567", result.Disclosed[0].Value["en"])
+
+	// Sessions survive restarts of the servers
+	servers[0].Stop()
+	servers[0], err = irmaserver.New(&server.Configuration{
+		URL:         "http://localhost:48680",
+		Logger:      logger,
+		SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		StoreType:   "redis",
+		RedisAddr:   mr.Addr(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, servers[0].GetSessionResult(token).Status)
+	require.NoError(t, servers[0].CancelSession(token))
+}
+
+func TestIssuancePreview(t *testing.T) {
+	irmaServer, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+	})
+	require.NoError(t, err)
+	defer irmaServer.Stop()
+
+	creds, err := irmaServer.PreviewIssuance(getNameIssuanceRequest())
+	require.NoError(t, err)
+	require.Len(t, creds, 1)
+	require.Equal(t, "fullName", creds[0].ID)
+	require.Equal(t, "Johan", creds[0].Attributes[irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")]["en"])
+	require.True(t, time.Time(creds[0].Expires).After(time.Now()))
+
+	// Invalid requests are rejected as when starting a session
+	request := getNameIssuanceRequest()
+	request.Credentials[0].Attributes["nonexisting"] = "foo"
+	_, err = irmaServer.PreviewIssuance(request)
+	require.Error(t, err)
+	_, err = irmaServer.PreviewIssuance(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.Error(t, err)
+}
+
+func TestIssuanceValidation(t *testing.T) {
+	irmaServer, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+	})
+	require.NoError(t, err)
+	defer irmaServer.Stop()
+
+	problems, err := irmaServer.ValidateIssuance(getNameIssuanceRequest())
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// All problems of all credentials are reported at once
+	request := getNameIssuanceRequest()
+	past := irma.Timestamp(time.Now().AddDate(0, 0, -1))
+	request.Credentials[0].Validity = &past
+	request.Credentials[0].Attributes["nonexisting"] = "foo"
+	delete(request.Credentials[0].Attributes, "familyname")
+	request.Credentials = append(request.Credentials, &irma.CredentialRequest{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.nonexisting"),
+	})
+	problems, err = irmaServer.ValidateIssuance(request)
+	require.NoError(t, err)
+	types := map[server.IssuanceProblemType]*server.IssuanceProblem{}
+	for _, problem := range problems {
+		types[problem.Type] = problem
+	}
+	require.Len(t, types, 4)
+	require.Equal(t, "nonexisting", types[server.IssuanceProblemUnknownAttribute].Attribute)
+	require.Equal(t, "familyname", types[server.IssuanceProblemMissingAttribute].Attribute)
+	require.Contains(t, types, server.IssuanceProblemExpired)
+	require.Equal(t, 1, types[server.IssuanceProblemUnknownCredentialType].Credential)
+
+	_, err = irmaServer.ValidateIssuance(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.Error(t, err)
+}
+
+func TestAttributeValueProvider(t *testing.T) {
+	// Provides the BSN from the requestor-provided key, or otherwise from the disclosed attribute
+	provider := server.AttributeValueProviderFunc(func(request *server.AttributeValueRequest) (map[string]string, error) {
+		if request.Key != "" {
+			return map[string]string{"BSN": request.Key}, nil
+		}
+		if len(request.Disclosed) == 0 {
+			return nil, errors.New("no key or disclosed attributes")
+		}
+		return map[string]string{"BSN": *request.Disclosed[0].RawValue}, nil
+	})
+	sandbox, err := irmaserver.New(&server.Configuration{
+		URL:                     "http://localhost:48680",
+		Logger:                  logger,
+		SchemesPath:             filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath:   filepath.Join(testdata, "privatekeys"),
+		Sandbox:                 true,
+		SandboxCredentials:      getIssuanceRequest(true).Credentials,
+		CallbackHmacKey:         base64.StdEncoding.EncodeToString([]byte("callback secret")),
+		AttributeValueProviders: map[string]server.AttributeValueProvider{"bsn": provider},
+	})
+	require.NoError(t, err)
+	defer sandbox.Stop()
+
+	request := func(key string) *irma.IssuanceRequest {
+		return &irma.IssuanceRequest{
+			BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+			Credentials: []*irma.CredentialRequest{{
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+				Provider:         "bsn",
+				ProviderKey:      key,
+			}},
+		}
+	}
+	bsn := func(token string) string {
+		cred := sandbox.GetRequest(token).SessionRequest().(*irma.IssuanceRequest).Credentials[0]
+		require.Empty(t, cred.Provider)
+		require.Empty(t, cred.ProviderKey)
+		return cred.Attributes["BSN"]
+	}
+
+	// Values from requestor-provided keys
+	_, token, err := sandbox.StartSession(request("12345"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "12345", bsn(token))
+	creds, err := sandbox.PreviewIssuance(request("12345"))
+	require.NoError(t, err)
+	require.Equal(t, "12345", creds[0].Attributes[irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")]["en"])
+
+	// Failing and unknown providers
+	_, _, err = sandbox.StartSession(request(""), nil)
+	require.Error(t, err)
+	unknown := request("12345")
+	unknown.Credentials[0].Provider = "nonexisting"
+	_, _, err = sandbox.StartSession(unknown, nil)
+	require.Error(t, err)
+	problems, err := sandbox.ValidateIssuance(unknown)
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	require.Equal(t, server.IssuanceProblemValueProvider, problems[0].Type)
+
+	// Values from the attributes disclosed in the previous session of a chained session
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewEncoder(w).Encode(request("")))
+	}))
+	defer next.Close()
+	_, token, err = sandbox.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{NextSessionUrl: next.URL},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}, nil)
+	require.NoError(t, err)
+	result, rerr := sandbox.CompleteSandboxSession(token)
+	require.Nil(t, rerr)
+	require.NotEmpty(t, result.NextSession)
+	require.Equal(t, "s1234567", bsn(result.NextSession))
+}
+
+func TestPulledSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Request source handing out a single disclosure request
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request, err := json.Marshal(getDisclosureRequest(id))
+	require.NoError(t, err)
+	pkgChan := make(chan *server.SessionPackage, 1)
+	resultChan := make(chan *server.SessionResult, 1)
+	pulled := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/next", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if pulled {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		pulled = true
+		server.WriteJson(w, requestorserver.PulledSessionRequest{ID: "foo", Request: request})
+	})
+	mux.HandleFunc("/foo/session", func(w http.ResponseWriter, r *http.Request) {
+		pkg := &server.SessionPackage{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(pkg))
+		pkgChan <- pkg
+		server.WriteString(w, "OK")
+	})
+	mux.HandleFunc("/foo/result", func(w http.ResponseWriter, r *http.Request) {
+		result := &server.SessionResult{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(result))
+		resultChan <- result
+		server.WriteString(w, "OK")
+	})
+	source := httptest.NewServer(mux)
+	defer source.Close()
+
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+		Port:                           48682,
+		RequestSources: []requestorserver.RequestSource{
+			{Requestor: "requestor", URL: source.URL, AuthenticationToken: "secret", PollTimeout: 1},
+		},
+	})
+	defer StopRequestorServer()
+
+	var pkg *server.SessionPackage
+	select {
+	case pkg = <-pkgChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session package received")
+	}
+
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	select {
+	case result := <-resultChan:
+		require.Equal(t, pkg.Token, result.Token)
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		require.Len(t, result.Disclosed, 1)
+		require.Equal(t, id, result.Disclosed[0].Identifier)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session result received")
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:         "http://localhost:48682/irma",
+			Logger:      logger,
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+		},
+		DisableRequestorAuthentication: true,
+		Permissions:                    requestorserver.Permissions{Disclosing: []string{"*"}},
+		SessionLimits:                  requestorserver.SessionLimits{MaxSessions: 1},
+		Port:                           48682,
+	})
+	defer StopRequestorServer()
+
+	request, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	post := func() *http.Response {
+		res, err := http.Post("http://localhost:48682/session", "application/json", bytes.NewReader(request))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := post()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	pkg := &server.SessionPackage{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(pkg))
+	res.Body.Close()
+
+	// The requestor already has an unfinished session
+	res = post()
+	res.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	// Once the session is finished, the requestor can start another one
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost:48682/session/"+pkg.Token, nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	res = post()
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := server.RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	rerr := &irma.RemoteError{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), rerr))
+	require.Equal(t, string(server.ErrorUnknown.Type), rerr.ErrorName)
+	require.NotEmpty(t, rerr.ErrorID)
+	require.Contains(t, rerr.Message, rerr.ErrorID)
+}
+
+func TestDiagnose(t *testing.T) {
+	newConf := func() *requestorserver.Configuration {
+		return &requestorserver.Configuration{
+			Configuration: &server.Configuration{
+				URL:         "http://localhost:48690/irma",
+				Logger:      logger,
+				SchemesPath: filepath.Join(testdata, "irma_configuration"),
+			},
+			DisableRequestorAuthentication: true,
+			Port:                           48690,
+		}
+	}
+
+	diagnostics := requestorserver.Diagnose(newConf())
+	checks := map[string]*requestorserver.Diagnostic{}
+	for _, d := range diagnostics {
+		checks[d.Check] = d
+	}
+	require.True(t, checks["configuration"].Passed)
+	require.True(t, checks["schemes"].Passed)
+	require.True(t, checks["JWT private key"].Passed)
+	require.True(t, checks["ports"].Passed)
+
+	// A port that is already in use fails the check
+	listener, err := net.Listen("tcp", ":48690")
+	require.NoError(t, err)
+	defer listener.Close()
+	diagnostics = requestorserver.Diagnose(newConf())
+	require.False(t, diagnostics.Passed())
+	for _, d := range diagnostics {
+		if d.Check == "ports" {
+			require.False(t, d.Passed)
+		}
+	}
+
+	// An invalid configuration fails immediately
+	conf := newConf()
+	conf.Port = 0
+	diagnostics = requestorserver.Diagnose(conf)
+	require.Len(t, diagnostics, 1)
+	require.False(t, diagnostics.Passed())
+}
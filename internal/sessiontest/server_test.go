@@ -1,6 +1,7 @@
 package sessiontest
 
 import (
+	"encoding/json"
 	"net/http"
 	"path/filepath"
 	"testing"
@@ -46,6 +47,10 @@ func StopRequestorServer() {
 }
 
 func StartIrmaServer(t *testing.T) {
+	StartIrmaServerWithCondition(t, nil)
+}
+
+func StartIrmaServerWithCondition(t *testing.T, condition server.IssuanceCondition) {
 	testdata := test.FindTestdataFolder(t)
 
 	logger := logrus.New()
@@ -58,6 +63,7 @@ func StartIrmaServer(t *testing.T) {
 		Logger:                logger,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		IssuanceCondition:     condition,
 	})
 
 	require.NoError(t, err)
@@ -95,6 +101,16 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 	Port: 48682,
 	DisableRequestorAuthentication: false,
 	MaxRequestAge:                  3,
+	Templates: map[string]requestorserver.SessionTemplate{
+		"studentcard": {
+			Requestor: "requestor2",
+			Request: json.RawMessage(`{"type": "issuing", "credentials": [{
+				"credential": "irma-demo.RU.studentCard",
+				"attributes": {"university": "Radboud", "studentCardNumber": "{{number}}", "studentID": "s{{number}}", "level": "42"}
+			}]}`),
+			Variables: map[string]string{"number": "[0-9]{7}"},
+		},
+	},
 	Permissions: requestorserver.Permissions{
 		Disclosing: []string{"*"},
 		Signing:    []string{"*"},
@@ -113,6 +129,32 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 			AuthenticationMethod: requestorserver.AuthenticationMethodHmac,
 			AuthenticationKey:    "eGE2PSomOT84amVVdTU+LmYtJXJWZ2BmNjNwSGltCg==",
 		},
+		"requestor4": {
+			AuthenticationMethod:  requestorserver.AuthenticationMethodPublicKey,
+			AuthenticationKeyFile: filepath.Join(testdata, "jwtkeys", "requestor4.pem"),
+			AuthenticationKeyType: requestorserver.KeyTypeECDSA,
+		},
+		"requestor5": {
+			AuthenticationMethod:  requestorserver.AuthenticationMethodPublicKey,
+			AuthenticationKeyFile: filepath.Join(testdata, "jwtkeys", "requestor5.pem"),
+			AuthenticationKeyType: requestorserver.KeyTypeEd25519,
+		},
+		"requestor6": {
+			AuthenticationMethod: requestorserver.AuthenticationMethodPublicKey,
+			AuthenticationJWKS:   "http://localhost:48681/jwtkeys/jwks.json",
+		},
+		"requestor7": {
+			AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+			AuthenticationKey:    "requestor7-token",
+			ExclusivePermissions: true,
+			Permissions: requestorserver.Permissions{
+				Disclosing: []string{"irma-demo.RU.*"},
+				Issuing:    []string{"irma-demo.MijnOverheid.root"},
+			},
+			ResultClaims: requestorserver.ResultClaims{
+				"irma-demo.RU.studentCard.studentID": "student.id",
+			},
+		},
 	},
 	JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "sk.pem"),
 }
@@ -1,12 +1,15 @@
 package sessiontest
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,6 +25,81 @@ func TestDisclosureSession(t *testing.T) {
 	sessionHelper(t, request, "verification", nil)
 }
 
+func TestSessionStateMachine(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	if TestType == "irmaserver" || TestType == "irmaserver-jwt" || TestType == "irmaserver-hmac-jwt" {
+		StartRequestorServer(JwtServerConfiguration)
+		defer StopRequestorServer()
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr := startSession(t, getDisclosureRequest(id), "verification")
+	c := make(chan *SessionResult)
+	h := StateTestHandler{TestHandler{t, c, client, nil}, make(chan irmaclient.SessionTransition, 16)}
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+	session := client.NewSession(string(qrjson), h).(irmaclient.SessionLifecycle)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// The handler is informed of each transition, in order
+	require.Equal(t, irmaclient.SessionStateSuccess, session.State())
+	var states []irmaclient.SessionState
+	for _, transition := range session.Transitions() {
+		require.Equal(t, transition, <-h.transitions)
+		states = append(states, transition.To)
+	}
+	require.Equal(t, []irmaclient.SessionState{
+		irmaclient.SessionStateConfiguring,
+		irmaclient.SessionStateAwaitingPermission,
+		irmaclient.SessionStateComputing,
+		irmaclient.SessionStateResponding,
+		irmaclient.SessionStateSuccess,
+	}, states)
+	require.Empty(t, irmaclient.AllowedTransitions(session.State()))
+
+	// A session asking for attributes we do not have (anymore) halts until it is dismissed
+	qrjson, err = json.Marshal(startSession(t, getDisclosureRequest(id), "verification"))
+	require.NoError(t, err)
+	defer advanceClock(10 * 365 * 24 * time.Hour)()
+	c = make(chan *SessionResult, 1)
+	h = StateTestHandler{TestHandler{t, c, client, nil}, make(chan irmaclient.SessionTransition, 16)}
+	session = client.NewSession(string(qrjson), h).(irmaclient.SessionLifecycle)
+	result := <-c
+	require.Equal(t, irma.ErrorType("UnsatisfiableRequest"), result.Err.(*irma.SessionError).ErrorType)
+	require.Equal(t, irmaclient.SessionStateHalted, session.State())
+	session.Dismiss()
+	require.Equal(t, irmaclient.SessionStateCancelled, session.State())
+	<-c
+}
+
+func TestExpiredCredentialDisclosure(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	if TestType == "irmaserver" || TestType == "irmaserver-jwt" || TestType == "irmaserver-hmac-jwt" {
+		StartRequestorServer(JwtServerConfiguration)
+		defer StopRequestorServer()
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	qr := startSession(t, request, "verification")
+
+	// Once the credentials of the client have expired, the request cannot be satisfied
+	defer advanceClock(10 * 365 * 24 * time.Hour)()
+	c := make(chan *SessionResult)
+	h := TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)}
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+
+	result := <-c
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorType("UnsatisfiableRequest"), result.Err.(*irma.SessionError).ErrorType)
+}
+
 func TestNoAttributeDisclosureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")
 	request := getDisclosureRequest(id)
@@ -135,7 +213,7 @@ func TestDisclosureNewAttributeUpdateSchemeManager(t *testing.T) {
 	disclosureRequest := irma.DisclosureRequest{
 		Content: irma.AttributeDisjunctionList{
 			&irma.AttributeDisjunction{
-				Label: "foo",
+				Label: irma.NewLabel("foo"),
 				Attributes: []irma.AttributeTypeIdentifier{
 					attrid,
 				},
@@ -208,7 +286,7 @@ func TestDisclosureNewCredTypeUpdateSchemeManager(t *testing.T) {
 	client.Configuration.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
 	request := &irma.DisclosureRequest{
 		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
-			Label:      "foo",
+			Label:      irma.NewLabel("foo"),
 			Attributes: []irma.AttributeTypeIdentifier{attrid},
 		}}),
 	}
@@ -264,3 +342,75 @@ func TestDownloadSchemeManager(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, exists)
 }
+
+func TestSessionProgress(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	if TestType == "irmaserver" || TestType == "irmaserver-jwt" || TestType == "irmaserver-hmac-jwt" {
+		StartRequestorServer(JwtServerConfiguration)
+		defer StopRequestorServer()
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getCombinedIssuanceRequest(id)
+	qr, err := json.Marshal(startSession(t, request, "issue"))
+	require.NoError(t, err)
+	c := make(chan *SessionResult)
+	h := &ProgressTestHandler{TestHandler: TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)}}
+	client.NewSession(string(qr), h)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// One step for the disclosed credential, one for each issued credential, and one completing the proofs
+	total := len(request.Credentials) + 2
+	require.Len(t, h.proofs, total)
+	for i, progress := range h.proofs {
+		require.Equal(t, [2]int{i + 1, total}, progress)
+	}
+	require.NotZero(t, h.uploaded[1])
+	require.Equal(t, h.uploaded[1], h.uploaded[0])
+}
+
+func TestDismissSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	if TestType == "irmaserver" || TestType == "irmaserver-jwt" || TestType == "irmaserver-hmac-jwt" {
+		StartRequestorServer(JwtServerConfiguration)
+		defer StopRequestorServer()
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, err := json.Marshal(startSession(t, getDisclosureRequest(id), "verification"))
+	require.NoError(t, err)
+	c := make(chan *SessionResult, 2)
+	h := DismissTestHandler{TestHandler{t, c, client, nil}, make(chan irmaclient.PermissionHandler, 1)}
+	session := client.NewSession(string(qr), h)
+	var callback irmaclient.PermissionHandler
+	select {
+	case callback = <-h.permission:
+	case result := <-c:
+		t.Fatalf("Session finished before asking permission: %+v", result)
+	}
+
+	// Dismissing the session while the user is asked for permission cancels it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, session.DismissContext(ctx))
+	result := <-c
+	require.EqualError(t, result.Err.(*irma.SessionError).Err, "Cancelled")
+	require.Equal(t, irmaclient.SessionStateCancelled, session.(irmaclient.SessionLifecycle).State())
+
+	// Granting permission or dismissing afterwards does not lead to another Handler callback
+	callback(true, &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}})
+	session.Dismiss()
+	select {
+	case result = <-c:
+		t.Fatalf("Unexpected session result after dismissal: %+v", result)
+	case <-time.After(500 * time.Millisecond):
+	}
+	require.Equal(t, irmaclient.SessionStateCancelled, session.(irmaclient.SessionLifecycle).State())
+}
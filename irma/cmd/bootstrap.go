@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap path url publickey",
+	Short: "Install the schemes in a signed scheme list",
+	Long: `The bootstrap command downloads the scheme list at the specified URL, verifies its signature (served at the URL suffixed with ".sig") against the specified PEM-encoded public key of its publisher, and installs the listed schemes into path (i.e., an irma_configuration folder) that are not yet installed there.
+
+The public key of each scheme is checked against its fingerprint in the list. Use "irma scheme signlist" to sign a scheme list.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := fs.EnsureDirectoryExists(args[0]); err != nil {
+			die("Failed to create irma_configuration directory", err)
+		}
+		pkbts, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			die("Failed to read public key", err)
+		}
+		pk, err := irma.ParsePemEcdsaPublicKey(pkbts)
+		if err != nil {
+			die("Failed to parse public key", err)
+		}
+
+		conf, err := irma.NewConfiguration(args[0])
+		if err != nil {
+			die("Failed to open irma_configuration", err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			die("Failed to parse irma_configuration", err)
+		}
+		if err = conf.BootstrapSchemes(args[1], pk); err != nil {
+			die("Bootstrapping schemes failed", err)
+		}
+	},
+}
+
+var signListCmd = &cobra.Command{
+	Use:   "signlist privatekey list",
+	Short: "Sign a scheme list",
+	Long: `The signlist command signs the scheme list (a JSON file containing the schemes to be installed by "irma scheme bootstrap") using the specified ECDSA private key, and writes the signature to the list filename suffixed with ".sig".
+
+The scheme list has the following form; the fingerprint is the hex-encoded SHA256 hash of the DER encoding of the public key of the scheme:
+
+{"schemes": [{"id": "irma-demo", "url": "https://example.com/irma-demo", "pk_fingerprint": "...", "demo": true}]}`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sk, err := readPrivateKey(args[0])
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read private key:", 0)
+		}
+		list, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(list, &irma.SchemeList{}); err != nil {
+			return errors.WrapPrefix(err, "Invalid scheme list:", 0)
+		}
+		sig, err := irma.SignSchemeList(list, sk)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(args[1]+".sig", sig, 0644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote signature to " + args[1] + ".sig")
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(bootstrapCmd)
+	schemeCmd.AddCommand(signListCmd)
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain request proof",
+	Short: "Explain why a disclosure or attribute-based signature fails to verify",
+	Long: `The explain command verifies the disclosure or attribute-based signature in the proof file against
+the disclosure or signature session request in the request file, including its nonce and context,
+and prints each of the checks that fails along with the credentials, public keys and disjunctions concerned.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		confpath, _ := cmd.Flags().GetString("irmaconf")
+		conf, err := irma.NewConfigurationReadOnly(confpath)
+		if err != nil {
+			die("Failed to read irma_configuration", err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			die("Failed to parse irma_configuration", err)
+		}
+
+		problems, err := explainProof(conf, args[0], args[1])
+		if err != nil {
+			die("", err)
+		}
+		if len(problems) == 0 {
+			fmt.Println("The proof is valid.")
+			return nil
+		}
+		for _, problem := range problems {
+			fmt.Println(problem.String())
+		}
+		return nil
+	},
+}
+
+func explainProof(conf *irma.Configuration, requestpath, proofpath string) ([]*irma.ProofProblem, error) {
+	bts, err := ioutil.ReadFile(requestpath)
+	if err != nil {
+		return nil, err
+	}
+	request, err := server.ParseSessionRequest(bts)
+	if err != nil {
+		return nil, err
+	}
+	if bts, err = ioutil.ReadFile(proofpath); err != nil {
+		return nil, err
+	}
+
+	switch r := request.SessionRequest().(type) {
+	case *irma.DisclosureRequest:
+		disclosure := &irma.Disclosure{}
+		if err = json.Unmarshal(bts, disclosure); err != nil {
+			return nil, err
+		}
+		return disclosure.Explain(conf, r), nil
+	case *irma.SignatureRequest:
+		sm := &irma.SignedMessage{}
+		if err = json.Unmarshal(bts, sm); err != nil {
+			return nil, err
+		}
+		return sm.Explain(conf, r), nil
+	default:
+		return nil, errors.New("Request must be a disclosure or signature request")
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(explainCmd)
+
+	explainCmd.Flags().StringP("irmaconf", "i", server.DefaultSchemesPath(), "path to irma_configuration")
+}
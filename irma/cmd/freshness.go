@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// freshnessCmd represents the freshness command
+var freshnessCmd = &cobra.Command{
+	Use:   "freshness [timestampkey] [path]",
+	Short: "Assert the freshness of a scheme",
+	Long: `Assert that the current version of the scheme in the specified directory is the newest one, by signing a freshness assertion using the timestamp key of the scheme. Both arguments are optional; "tsk.pem" and the working directory are the defaults. Outputs the freshness assertion and its signature in the specified directory.
+
+This is meant to be run periodically (e.g. daily) for schemes that declare AssertsFreshness in their description, after which the scheme must be published again. Clients consider the scheme stale if its freshness was not asserted recently enough.`,
+	Args: cobra.MaximumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		tsk, confpath := "tsk.pem", ""
+		if len(args) > 0 {
+			tsk = args[0]
+		}
+		if len(args) > 1 {
+			confpath, err = filepath.Abs(args[1])
+		} else {
+			confpath, err = os.Getwd()
+		}
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		if err = fs.AssertPathExists(confpath); err != nil {
+			return err
+		}
+
+		timestampkey, err := readPrivateKey(tsk)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read timestamp private key:", 0)
+		}
+		if err = irma.AssertSchemeFreshness(confpath, timestampkey); err != nil {
+			die("Failed to assert scheme freshness", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(freshnessCmd)
+}
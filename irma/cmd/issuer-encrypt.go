@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var issuerEncryptCmd = &cobra.Command{
+	Use:   "encrypt privatekey...",
+	Short: "Encrypt IRMA issuer private keys using a passphrase",
+	Long: `Encrypt IRMA issuer private keys in place using a passphrase, read from the IRMA_PRIVATEKEY_PASSPHRASE
+environment variable or else from the terminal.
+
+Encrypted private keys in a scheme can be used by the IRMA server after providing the passphrase
+(using the --privkeys-passphrase flag or the IRMASERVER_PRIVKEYS_PASSPHRASE environment variable).`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		decrypt, _ := cmd.Flags().GetBool("decrypt")
+		passphrase, err := readPassphrase(!decrypt)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range args {
+			bts, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if irma.PrivateKeyEncrypted(bts) != decrypt {
+				fmt.Printf("Skipping %s: already done\n", file)
+				continue
+			}
+			if decrypt {
+				bts, err = irma.DecryptPrivateKey(bts, passphrase)
+			} else {
+				bts, err = irma.EncryptPrivateKey(bts, passphrase)
+			}
+			if err != nil {
+				return errors.WrapPrefix(err, file, 0)
+			}
+			if err = ioutil.WriteFile(file, bts, 0600); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv("IRMA_PRIVATEKEY_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Print("Passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		fmt.Print("Repeat passphrase: ")
+		repeated, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		if string(repeated) != string(passphrase) {
+			return "", errors.New("Passphrases do not match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerEncryptCmd)
+
+	issuerEncryptCmd.Flags().BoolP("decrypt", "d", false, "Decrypt the private keys instead")
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 
 	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/spf13/cobra"
 )
@@ -32,6 +33,22 @@ var keygenCmd = &cobra.Command{
 			return err
 		}
 
+		count, err := cmd.Flags().GetInt("shares")
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			threshold, err := cmd.Flags().GetInt("threshold")
+			if err != nil {
+				return err
+			}
+			audit, err := cmd.Flags().GetString("audit")
+			if err != nil {
+				return err
+			}
+			return keygenShares(skfile, pkfile, threshold, count, audit)
+		}
+
 		// For safety we enforce that we never overwrite a file
 		if err := fs.AssertPathNotExists(skfile); err != nil {
 			return errors.Errorf("File %s already exists, not overwriting", skfile)
@@ -72,8 +89,62 @@ var keygenCmd = &cobra.Command{
 	},
 }
 
+// keygenShares generates a scheme key whose private key is split into shares among custodians,
+// writing the shares to files named after the private key file, i.e. sk.pem.1, sk.pem.2, etc.
+func keygenShares(skfile, pkfile string, threshold, count int, auditfile string) error {
+	if err := fs.AssertPathNotExists(pkfile); err != nil {
+		return errors.Errorf("File %s already exists, not overwriting", pkfile)
+	}
+	for i := 1; i <= count; i++ {
+		if err := fs.AssertPathNotExists(fmt.Sprintf("%s.%d", skfile, i)); err != nil {
+			return errors.Errorf("File %s.%d already exists, not overwriting", skfile, i)
+		}
+	}
+
+	audit, err := openAuditLog(auditfile)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	pk, shares, err := irma.GenerateSchemeKeyShares(threshold, count, audit)
+	if err != nil {
+		return err
+	}
+	for _, share := range shares {
+		file := fmt.Sprintf("%s.%d", skfile, share.Index)
+		if err = irma.WriteSchemeKeyShare(share, file); err != nil {
+			return err
+		}
+		share.Value.SetInt64(0)
+		fmt.Println("Private key share", share.Index, "written at", file)
+	}
+
+	bts, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(pkfile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts}), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Public key written at", pkfile)
+	return nil
+}
+
+// openAuditLog opens the specified file for appending key ceremony audit output,
+// or returns stdout if no file is specified.
+func openAuditLog(path string) (*os.File, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
 func init() {
 	schemeCmd.AddCommand(keygenCmd)
 	keygenCmd.Flags().StringP("privatekey", "s", "sk.pem", "filename for private key")
 	keygenCmd.Flags().StringP("publickey", "p", "pk.pem", "filename for public key")
+	keygenCmd.Flags().IntP("shares", "n", 0, "split the private key into this many shares instead of writing it to a single file")
+	keygenCmd.Flags().IntP("threshold", "t", 2, "amount of shares required to reconstruct the private key")
+	keygenCmd.Flags().String("audit", "", "append key ceremony audit log to this file (default stdout)")
 }
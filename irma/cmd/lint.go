@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/schemelint"
+	"github.com/spf13/cobra"
+)
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [path]",
+	Short: "Check a scheme for problems before signing it",
+	Long: `The lint command checks the scheme in the specified directory, or the current directory if not specified, using the same checks that are performed when the scheme is parsed. The scheme need not be signed.
+
+Available rules:
+` + lintRuleList(),
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		rules, _ := flags.GetStringSlice("rules")
+		confpath, _ := flags.GetString("irmaconf")
+		asJson, _ := flags.GetBool("json")
+
+		var err error
+		var path string
+		if len(args) > 0 {
+			path = args[0]
+		} else {
+			if path, err = os.Getwd(); err != nil {
+				return err
+			}
+		}
+
+		linter, err := schemelint.New(rules...)
+		if err != nil {
+			die("", err)
+		}
+		if confpath != "" {
+			if linter.Configuration, err = irma.NewConfigurationReadOnly(confpath); err != nil {
+				die("Failed to read irma_configuration", err)
+			}
+			if err = linter.Configuration.ParseFolder(); err != nil {
+				die("Failed to parse irma_configuration", err)
+			}
+		}
+
+		findings, err := linter.Lint(path)
+		if err != nil {
+			die("Linting failed", err)
+		}
+		if asJson {
+			if findings == nil {
+				findings = []*schemelint.Finding{}
+			}
+			fmt.Println(prettyprint(findings))
+		} else {
+			for _, finding := range findings {
+				fmt.Println(finding.String())
+			}
+			fmt.Println()
+			fmt.Printf("%d problem(s) found\n", len(findings))
+		}
+		if schemelint.HasErrors(findings) {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+func lintRuleList() string {
+	var lines []string
+	for _, rule := range schemelint.Rules {
+		lines = append(lines, fmt.Sprintf("  %-16s %s", rule.Name, rule.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func init() {
+	schemeCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().StringSlice("rules", nil, "Comma-separated list of rules to run (default all)")
+	lintCmd.Flags().StringP("irmaconf", "i", "", "irma_configuration containing other schemes to which the scheme refers")
+	lintCmd.Flags().Bool("json", false, "Output findings as JSON")
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"crypto/elliptic"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -68,6 +69,25 @@ func signRequest(request irma.RequestorRequest, name, authmethod, key string) (s
 		if sk, err = jwt.ParseRSAPrivateKeyFromPEM(bts); err != nil {
 			return "", err
 		}
+	case "ecdsa":
+		eck, err := jwt.ParseECPrivateKeyFromPEM(bts)
+		if err != nil {
+			return "", err
+		}
+		switch eck.Curve {
+		case elliptic.P256():
+			jwtalg = jwt.SigningMethodES256
+		case elliptic.P384():
+			jwtalg = jwt.SigningMethodES384
+		default:
+			return "", errors.New("Unsupported curve (supported curves: P-256, P-384)")
+		}
+		sk = eck
+	case "ed25519":
+		jwtalg = irma.SigningMethodEdDSA
+		if sk, err = irma.ParseEd25519PrivateKeyFromPEM(bts); err != nil {
+			return "", err
+		}
 	default:
 		return "", errors.Errorf("Unsupported signing algorithm: '%s'", authmethod)
 	}
@@ -254,7 +274,7 @@ func parseDisjunctions(disjunctionsStr []string, conf *irma.Configuration) (irma
 			}
 			disjunction.Attributes = append(disjunction.Attributes, attrid)
 		}
-		disjunction.Label = disjunction.Attributes[0].Name()
+		disjunction.Label = irma.NewLabel(disjunction.Attributes[0].Name())
 		list = append(list, disjunction)
 	}
 	return list, nil
@@ -306,7 +326,7 @@ func init() {
 
 func addRequestFlags(flags *pflag.FlagSet) {
 	flags.StringP("schemes-path", "s", server.DefaultSchemesPath(), "path to irma_configuration")
-	flags.StringP("authmethod", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
+	flags.StringP("authmethod", "a", "none", "Authentication method to server (none, token, rsa, ecdsa, ed25519, hmac)")
 	flags.String("key", "", "Key to sign request with")
 	flags.String("name", "", "Requestor name")
 	flags.StringArray("disclose", nil, "Add an attribute disjunction (comma-separated)")
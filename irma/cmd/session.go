@@ -168,7 +168,7 @@ func postRequest(serverurl string, request irma.RequestorRequest, name, authmeth
 	case "token":
 		transport.SetHeader("Authorization", key)
 		err = transport.Post("session", pkg, request)
-	case "hmac", "rsa":
+	case "hmac", "rsa", "ecdsa", "ed25519":
 		var jwtstr string
 		jwtstr, err = signRequest(request, name, authmethod, key)
 		if err != nil {
@@ -177,7 +177,7 @@ func postRequest(serverurl string, request irma.RequestorRequest, name, authmeth
 		logger.Debug("Session request JWT: ", jwtstr)
 		err = transport.Post("session", pkg, jwtstr)
 	default:
-		return nil, nil, errors.New("Invalid authentication method (must be none, token, hmac or rsa)")
+		return nil, nil, errors.New("Invalid authentication method (must be none, token, hmac, rsa, ecdsa or ed25519)")
 	}
 
 	token := pkg.Token
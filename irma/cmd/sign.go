@@ -2,18 +2,13 @@ package cmd
 
 import (
 	"crypto/ecdsa"
-	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"math/big"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -28,12 +23,27 @@ var signCmd = &cobra.Command{
 	Short: "Sign a scheme directory",
 	Long: `Sign a scheme manager directory, using the specified ECDSA key. Both arguments are optional; "sk.pem" and the working directory are the defaults. Outputs an index file, signature over the index file, and the public key in the specified directory.
 
+If the scheme declares a timestamp key in its description, specify its private key using --timestamp-key to also sign the timestamp of the scheme with it.
+
+If the private key was split into shares by "irma scheme keygen --shares", specify the share files using --shares instead of the privatekey argument; the private key is then reconstructed only in memory for the duration of the signing operation.
+
 Careful: this command could fail and invalidate or destroy your scheme manager directory! Use this only if you can restore it from git or backups.`,
 	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Validate arguments
 		var err error
 		var sk, confpath string
+		sharefiles, err := cmd.Flags().GetStringSlice("shares")
+		if err != nil {
+			return err
+		}
+		if len(sharefiles) > 0 && len(args) > 0 {
+			// The first argument is the path instead of the private key
+			args = append([]string{""}, args...)
+			if len(args) > 2 {
+				return errors.New("Too many arguments")
+			}
+		}
 		switch len(args) {
 		case 0:
 			sk = "sk.pem"
@@ -49,9 +59,29 @@ Careful: this command could fail and invalidate or destroy your scheme manager d
 			return errors.WrapPrefix(err, "Invalid path", 0)
 		}
 
-		privatekey, err := readPrivateKey(sk)
-		if err != nil {
-			return errors.WrapPrefix(err, "Failed to read private key:", 0)
+		var privatekey *ecdsa.PrivateKey
+		var audit io.Writer
+		if len(sharefiles) > 0 {
+			auditfile, err := cmd.Flags().GetString("audit")
+			if err != nil {
+				return err
+			}
+			auditlog, err := openAuditLog(auditfile)
+			if err != nil {
+				return err
+			}
+			defer auditlog.Close()
+			audit = auditlog
+			privatekey, err = readPrivateKeyShares(sharefiles, audit)
+			if err != nil {
+				return errors.WrapPrefix(err, "Failed to reconstruct private key:", 0)
+			}
+			defer privatekey.D.SetInt64(0)
+		} else {
+			privatekey, err = readPrivateKey(sk)
+			if err != nil {
+				return errors.WrapPrefix(err, "Failed to read private key:", 0)
+			}
 		}
 
 		if err = fs.AssertPathExists(confpath); err != nil {
@@ -62,9 +92,20 @@ Careful: this command could fail and invalidate or destroy your scheme manager d
 		if err != nil {
 			return err
 		}
-		if err := signManager(privatekey, confpath, skipverification); err != nil {
+		var timestampkey *ecdsa.PrivateKey
+		if tskfile, _ := cmd.Flags().GetString("timestamp-key"); tskfile != "" {
+			if timestampkey, err = readPrivateKey(tskfile); err != nil {
+				return errors.WrapPrefix(err, "Failed to read timestamp private key:", 0)
+			}
+		}
+		if err := signManager(privatekey, timestampkey, confpath, skipverification); err != nil {
 			die("Failed to sign scheme", err)
 		}
+		if audit != nil {
+			fingerprint, _ := irma.SchemeKeyFingerprint(&privatekey.PublicKey)
+			fmt.Fprintf(audit, "%s signed scheme %s using scheme key %s\n",
+				time.Now().Format(time.RFC3339), confpath, fingerprint)
+		}
 		return nil
 	},
 }
@@ -73,54 +114,44 @@ func init() {
 	schemeCmd.AddCommand(signCmd)
 
 	signCmd.Flags().BoolP("noverification", "n", false, "Skip verification of the scheme after signing it")
+	signCmd.Flags().StringSlice("shares", nil, "Comma-separated list of private key share files to sign with")
+	signCmd.Flags().String("audit", "", "Append key ceremony audit log to this file (default stdout)")
+	signCmd.Flags().String("timestamp-key", "", "Also sign the timestamp using this timestamp private key")
 }
 
-func signManager(privatekey *ecdsa.PrivateKey, confpath string, skipverification bool) error {
-	// Write timestamp
-	bts := []byte(strconv.FormatInt(time.Now().Unix(), 10) + "\n")
-	if err := ioutil.WriteFile(confpath+"/timestamp", bts, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write timestamp", 0)
-	}
-
-	// Traverse dir and add file hashes to index
-	var index irma.SchemeManagerIndex = make(map[string]irma.ConfigurationFileHash)
-	err := filepath.Walk(confpath, func(path string, info os.FileInfo, err error) error {
-		return calculateFileHash(path, info, err, confpath, index)
-	})
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to calculate file index:", 0)
-	}
-
-	// Write index
-	bts = []byte(index.String())
-	if err := ioutil.WriteFile(confpath+"/index", bts, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write index", 0)
-	}
-
-	// Create and write signature
-	indexHash := sha256.Sum256(bts)
-	r, s, err := ecdsa.Sign(rand.Reader, privatekey, indexHash[:])
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to sign index:", 0)
-	}
-	sigbytes, err := asn1.Marshal([]*big.Int{r, s})
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to serialize signature:", 0)
+func readPrivateKeyShares(paths []string, audit io.Writer) (*ecdsa.PrivateKey, error) {
+	shares := make([]*irma.SchemeKeyShare, 0, len(paths))
+	for _, path := range paths {
+		share, err := irma.ReadSchemeKeyShare(path)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
 	}
-	if err = ioutil.WriteFile(confpath+"/index.sig", sigbytes, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
+	key, err := irma.CombineSchemeKeyShares(shares, audit)
+	for _, share := range shares {
+		if share.Value != nil {
+			share.Value.SetInt64(0)
+		}
 	}
+	return key, err
+}
 
-	// Write public key
-	bts, err = x509.MarshalPKIXPublicKey(&privatekey.PublicKey)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to serialize public key", 0)
+func signManager(privatekey, timestampkey *ecdsa.PrivateKey, confpath string, skipverification bool) error {
+	if err := irma.SignScheme(confpath, privatekey); err != nil {
+		return err
 	}
-	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
-	if err := ioutil.WriteFile(confpath+"/pk.pem", pemEncodedPub, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write public key", 0)
+	if timestampkey != nil {
+		if err := irma.SignSchemeTimestamp(confpath, timestampkey); err != nil {
+			return err
+		}
+		// A freshness assertion concerns a specific timestamp, so renew it if the scheme has one
+		if exists, _ := fs.PathExists(filepath.Join(confpath, "freshness")); exists {
+			if err := irma.AssertSchemeFreshness(confpath, timestampkey); err != nil {
+				return err
+			}
+		}
 	}
-
 	if skipverification {
 		return nil
 	}
@@ -140,37 +171,3 @@ func readPrivateKey(path string) (*ecdsa.PrivateKey, error) {
 	block, _ := pem.Decode(bts)
 	return x509.ParseECPrivateKey(block.Bytes)
 }
-
-func calculateFileHash(path string, info os.FileInfo, err error, confpath string, index irma.SchemeManagerIndex) error {
-	if err != nil {
-		return err
-	}
-	// Skip stuff we don't want
-	if info.IsDir() || // Can only sign files
-		strings.HasSuffix(path, "index") || // Skip the index file itself
-		strings.Contains(path, "/.git/") || // No need to traverse .git dirs, can take quite long
-		strings.Contains(path, "/PrivateKeys/") { // Don't sign private keys
-		return nil
-	}
-	// Skip everything except the stuff we do want
-	if !strings.HasSuffix(path, ".xml") &&
-		!strings.HasSuffix(path, ".png") &&
-		!regexp.MustCompile("kss-\\d+\\.pem$").Match([]byte(filepath.Base(path))) &&
-		filepath.Base(path) != "timestamp" {
-		return nil
-	}
-
-	bts, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	relativePath, err := filepath.Rel(confpath, path)
-	if err != nil {
-		return err
-	}
-	relativePath = filepath.Join(filepath.Base(confpath), relativePath)
-
-	hash := sha256.Sum256(bts)
-	index[relativePath] = hash[:]
-	return nil
-}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+// transcriptCmd represents the transcript command
+var transcriptCmd = &cobra.Command{
+	Use:   "transcript",
+	Short: "Manage verification transcripts",
+}
+
+var transcriptVerifyCmd = &cobra.Command{
+	Use:   "verify archive",
+	Short: "Reverify a verification transcript archive",
+	Long: `The verify command reads a verification transcript archive, checks the authenticity of the scheme files it contains, and verifies the contained disclosure or attribute-based signature again against these scheme files at the time of the original verification.
+
+Unless --untrusted is specified, the schemes in the archive must be signed with the same keys as the schemes in the irma_configuration folder.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		confpath, _ := flags.GetString("irmaconf")
+		untrusted, _ := flags.GetBool("untrusted")
+
+		var trusted *irma.Configuration
+		if !untrusted {
+			var err error
+			if trusted, err = irma.NewConfigurationReadOnly(confpath); err != nil {
+				die("Failed to read irma_configuration", err)
+			}
+			if err = trusted.ParseFolder(); err != nil {
+				die("Failed to parse irma_configuration", err)
+			}
+		}
+
+		if err := verifyTranscript(args[0], trusted); err != nil {
+			die("Verification failed", err)
+		}
+		return nil
+	},
+}
+
+func verifyTranscript(path string, trusted *irma.Configuration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	transcript, attrs, status, err := irma.VerifyTranscriptArchive(f, info.Size(), trusted)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Type              :", transcript.Type)
+	fmt.Println("Verified at       :", time.Time(transcript.Verified).String())
+	fmt.Println("Scheme fingerprint:", transcript.SchemeFingerprint)
+	fmt.Println("Original status   :", transcript.Status)
+	fmt.Println("Status            :", status)
+	fmt.Println()
+	fmt.Println("Attributes:", prettyprint(attrs))
+
+	if status != transcript.Status {
+		return errors.Errorf("status %s does not match status %s of original verification", status, transcript.Status)
+	}
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(transcriptCmd)
+	transcriptCmd.AddCommand(transcriptVerifyCmd)
+
+	transcriptVerifyCmd.Flags().StringP("irmaconf", "i", server.DefaultSchemesPath(), "path to irma_configuration")
+	transcriptVerifyCmd.Flags().Bool("untrusted", false, "do not check the scheme keys in the archive against irma_configuration")
+}
@@ -0,0 +1,218 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the backup and restore of the contents of the client, with which users can
+// move their credentials to a new device. A backup (see Client.Export()) consists of
+// backupHeader, the Argon2 salt, the AES-GCM nonce, and the ciphertext of the JSON serialization
+// of the backup struct, encrypted using a key derived from a passphrase. The backup struct
+// contains its version, so that backups made by older versions of the client can be migrated
+// when they are imported (see backupMigrations).
+
+const backupHeader = "irma-backup\n"
+
+// backupVersion is the current version of the backup struct.
+const backupVersion = 1
+
+// backupMigrations convert backups made by older versions of the client: backupMigrations[i]
+// converts the JSON fields of a backup of version i+1 to version i+2.
+var backupMigrations = []func(backup map[string]json.RawMessage) error{}
+
+type backup struct {
+	Version   int
+	Created   irma.Timestamp
+	SecretKey *secretKey
+	// The attributes of the credentials, and their signatures by the hash of the attributes
+	Attributes      []*irma.AttributeList
+	Signatures      map[string]*gabi.CLSignature
+	KeyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer
+	Logs            []*LogEntry
+	Preferences     Preferences
+}
+
+// Export returns an encrypted backup of the contents of the client: the secret key, the
+// credentials, the keyshare server enrollments, the logs and the preferences. The backup is
+// encrypted using the passphrase, and can be restored using Import(), e.g. on another device.
+func (client *Client) Export(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase must not be empty")
+	}
+	logs, err := client.Logs()
+	if err != nil {
+		return nil, err
+	}
+	b := &backup{
+		Version:         backupVersion,
+		Created:         irma.Timestamp(time.Now()),
+		SecretKey:       client.secretkey,
+		Attributes:      []*irma.AttributeList{},
+		Signatures:      map[string]*gabi.CLSignature{},
+		KeyshareServers: client.keyshareServers,
+		Logs:            logs,
+		Preferences:     client.Preferences,
+	}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			sig, err := client.storage.LoadSignature(attrs)
+			if err != nil {
+				return nil, err
+			}
+			b.Attributes = append(b.Attributes, attrs)
+			b.Signatures[attrs.Hash()] = sig
+		}
+	}
+
+	plaintext, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	defer irma.SecureBytes(plaintext).Wipe()
+	salt := make([]byte, storageSaltLength)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := secretCipher([]byte(passphrase), salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(backupHeader), salt...), nonce...)
+	return aead.Seal(header, nonce, plaintext, []byte(backupHeader)), nil
+}
+
+// Import restores the contents of the client from a backup made using Export(), replacing its
+// secret key, keyshare server enrollments, logs and preferences. The client must not contain any
+// credentials or keyshare server enrollments.
+func (client *Client) Import(backup []byte, passphrase string) error {
+	if len(client.attributes) > 0 || len(client.keyshareServers) > 0 {
+		return errors.New("Client is not empty; remove all credentials and keyshare enrollments before importing a backup")
+	}
+	b, err := decryptBackup(backup, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// Check the backup before overwriting anything
+	if b.SecretKey == nil || b.SecretKey.Key == nil {
+		return errors.New("Backup contains no secret key")
+	}
+	for _, attrs := range b.Attributes {
+		if len(attrs.Ints) == 0 {
+			return errors.New("Backup contains credential without attributes")
+		}
+		if b.Signatures[attrs.Hash()] == nil {
+			return errors.Errorf("Backup contains no signature of credential %s", attrs.Hash())
+		}
+	}
+	if err = verifyLogs(b.Logs, newLogsHead(b.Logs)); err != nil {
+		return errors.WrapPrefix(err, "Backup contains invalid logs", 0)
+	}
+
+	// The signatures are stored first, so that the stored attributes always have signatures
+	for _, attrs := range b.Attributes {
+		if err = client.storage.store(b.Signatures[attrs.Hash()], client.storage.signatureFilename(attrs)); err != nil {
+			return err
+		}
+	}
+	if err = client.storage.StoreSecretKey(b.SecretKey); err != nil {
+		return err
+	}
+	if err = client.storage.store(b.Attributes, attributesFile); err != nil {
+		return err
+	}
+	if b.KeyshareServers == nil {
+		b.KeyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
+	}
+	if err = client.storage.StoreKeyshareServers(b.KeyshareServers); err != nil {
+		return err
+	}
+	if err = client.storage.StoreLogs(b.Logs); err != nil {
+		return err
+	}
+	if err = client.storage.StorePreferences(b.Preferences); err != nil {
+		return err
+	}
+
+	client.secretkey = b.SecretKey
+	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
+		return err
+	}
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+	client.keyshareServers = b.KeyshareServers
+	client.logs = b.Logs
+	client.Preferences = b.Preferences
+	client.applyPreferences()
+	client.orphaned = map[string]struct{}{}
+	for _, info := range client.OrphanedCredentials() {
+		client.orphaned[info.Hash] = struct{}{}
+	}
+	client.handler.UpdateAttributes()
+	return nil
+}
+
+// decryptBackup decrypts the backup using the passphrase, and parses it, migrating it to the
+// current version if necessary.
+func decryptBackup(ciphertext []byte, passphrase string) (*backup, error) {
+	if !bytes.HasPrefix(ciphertext, []byte(backupHeader)) {
+		return nil, errors.New("Not a backup")
+	}
+	ciphertext = ciphertext[len(backupHeader):]
+	if len(ciphertext) < storageSaltLength {
+		return nil, errors.New("Backup too short")
+	}
+	aead, err := secretCipher([]byte(passphrase), ciphertext[:storageSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[storageSaltLength:]
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("Backup too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(backupHeader))
+	if err != nil {
+		return nil, errors.New("Wrong passphrase or corrupted backup")
+	}
+	defer irma.SecureBytes(plaintext).Wipe()
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(plaintext, &fields); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse backup", 0)
+	}
+	var version int
+	if err = json.Unmarshal(fields["Version"], &version); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse backup version", 0)
+	}
+	if version < 1 || version > backupVersion {
+		return nil, errors.Errorf("Unsupported backup version %d (supported: up to %d)", version, backupVersion)
+	}
+	if version < backupVersion {
+		for ; version < backupVersion; version++ {
+			if err = backupMigrations[version-1](fields); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to migrate backup", 0)
+			}
+		}
+		if plaintext, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+		defer irma.SecureBytes(plaintext).Wipe()
+	}
+
+	b := &backup{}
+	if err = json.Unmarshal(plaintext, b); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse backup", 0)
+	}
+	b.Version = backupVersion
+	return b, nil
+}
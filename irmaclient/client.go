@@ -45,6 +45,9 @@ type Client struct {
 	logs             []*LogEntry
 	updates          []update
 
+	// Hashes of the credentials of which the handler knows that they are orphaned
+	orphaned map[string]struct{}
+
 	// Where we store/load it to/from
 	storage storage
 
@@ -54,6 +57,8 @@ type Client struct {
 	irmaConfigurationPath string
 	androidStoragePath    string
 	handler               ClientHandler
+	schemeUpdates         *schemeUpdateQueue
+	reissuance            *reissueScheduler
 }
 
 // SentryDSN should be set in the init() function
@@ -62,6 +67,11 @@ var SentryDSN = ""
 
 type Preferences struct {
 	EnableCrashReporting bool
+	// Maximum amount of bytes that the schemes may take on disk; 0 means no maximum.
+	// See Client.PruneSchemes().
+	SchemeSizeBudget int64
+	// Log entries older than this are removed; 0 means they are kept. See Client.PruneLogs().
+	LogRetention time.Duration
 }
 
 var defaultPreferences = Preferences{
@@ -90,6 +100,10 @@ type ClientHandler interface {
 
 	UpdateConfiguration(new *irma.IrmaIdentifierSet)
 	UpdateAttributes()
+	// OrphanedCredentials is called when credentials became orphaned because their credential
+	// type was removed from its scheme, or changed such that it no longer matches them.
+	// See Client.OrphanedCredentials().
+	OrphanedCredentials(orphaned irma.CredentialInfoList)
 }
 
 type secretKey struct {
@@ -149,43 +163,101 @@ func New(
 	if err = cm.storage.EnsureStorageExists(); err != nil {
 		return nil, err
 	}
+	if h, ok := handler.(StorageSecretHandler); ok {
+		secret, err := h.StorageSecret()
+		if err != nil {
+			return nil, err
+		}
+		if err = cm.storage.unlock(secret); err != nil {
+			return nil, err
+		}
+	}
 
 	if cm.Preferences, err = cm.storage.LoadPreferences(); err != nil {
 		return nil, err
 	}
 	cm.applyPreferences()
 
-	// Perform new update functions from clientUpdates, if any
-	if err = cm.update(); err != nil {
-		return nil, err
-	}
-
-	// Load our stuff
-	if cm.secretkey, err = cm.storage.LoadSecretKey(); err != nil {
+	// Load our stuff, from the profile that was last used
+	if err = cm.storage.loadProfileName(); err != nil {
 		return nil, err
 	}
-	if cm.attributes, err = cm.storage.LoadAttributes(); err != nil {
+	if err = cm.loadProfile(); err != nil {
 		return nil, err
 	}
-	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
-		return nil, err
+	cm.Configuration.RemovalHandler = cm.credentialTypesChanged
+	cm.Configuration.UpdateHandler = cm.credentialTypesChanged
+	cm.schemeUpdates = &schemeUpdateQueue{client: cm}
+	if h, ok := handler.(SchemeUpdateHandler); ok {
+		cm.Configuration.ProgressHandler = h.SchemeUpdateProgress
 	}
 
 	if len(cm.UnenrolledSchemeManagers()) > 1 {
 		return nil, errors.New("Too many keyshare servers")
 	}
 
+	if cm.Preferences.SchemeSizeBudget > 0 {
+		if _, err = cm.PruneSchemes(); err != nil {
+			irma.Logger.Warn("Failed to prune schemes: ", err.Error())
+		}
+	}
+	if cm.Preferences.LogRetention > 0 {
+		if err = cm.PruneLogs(); err != nil {
+			irma.Logger.Warn("Failed to prune logs: ", err.Error())
+		}
+	}
+
 	return cm, schemeMgrErr
 }
 
-// CredentialInfoList returns a list of information of all contained credentials.
+// CredentialInfoList returns a list of information of all contained credentials,
+// except orphaned ones (see OrphanedCredentials()).
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
 	for _, attrlistlist := range client.attributes {
 		for _, attrlist := range attrlistlist {
 			info := attrlist.Info()
-			if info == nil {
+			if info == nil || info.Orphaned {
+				continue
+			}
+			list = append(list, info)
+		}
+	}
+
+	return list
+}
+
+// OrphanedCredentials returns information of the contained credentials whose credential type was
+// removed from its scheme, or changed such that it no longer matches the credential. These
+// credentials cannot be disclosed, but their attribute values can still be shown to the user
+// using CredentialInfo.RawAttributes, and they can be removed like any other credential.
+func (client *Client) OrphanedCredentials() irma.CredentialInfoList {
+	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
+
+	for _, attrlistlist := range client.attributes {
+		for _, attrlist := range attrlistlist {
+			if attrlist.Orphaned() {
+				list = append(list, attrlist.Info())
+			}
+		}
+	}
+
+	return list
+}
+
+// ExpiringCredentials returns information of the contained credentials that are still valid but
+// expire within the specified duration, so that the user can be prompted to have them reissued.
+func (client *Client) ExpiringCredentials(within time.Duration) irma.CredentialInfoList {
+	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
+
+	for _, attrlistlist := range client.attributes {
+		for _, attrlist := range attrlistlist {
+			if !attrlist.ExpiresWithin(within) {
+				continue
+			}
+			info := attrlist.Info()
+			if info == nil || info.Orphaned {
 				continue
 			}
 			list = append(list, info)
@@ -293,13 +365,19 @@ func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index i
 	return client.remove(id, index, true)
 }
 
-// RemoveCredentialByHash removes the specified credential.
+// RemoveCredentialByHash removes the specified credential, which may be orphaned
+// (see OrphanedCredentials()).
 func (client *Client) RemoveCredentialByHash(hash string) error {
-	cred, index, err := client.credentialByHash(hash)
-	if err != nil {
-		return err
+	// Orphaned credentials may lack a credential type, so we look up the credential in
+	// client.attributes by hash instead of using client.credentialByHash()
+	for id, attrlistlist := range client.attributes {
+		for index, attrs := range attrlistlist {
+			if attrs.Hash() == hash {
+				return client.RemoveCredential(id, index)
+			}
+		}
 	}
-	return client.RemoveCredential(cred.CredentialType().Identifier(), index)
+	return errors.Errorf("Can't remove credential %s: no such credential", hash)
 }
 
 // RemoveAllCredentials removes all credentials.
@@ -323,10 +401,27 @@ func (client *Client) RemoveAllCredentials() error {
 		Time:    irma.Timestamp(time.Now()),
 		Removed: removed,
 	}
-	if err := client.addLogEntry(logentry); err != nil {
-		return err
+	return client.addLogEntry(logentry)
+}
+
+// credentialTypesChanged informs the handler of credentials that became orphaned because their
+// credential type was removed or changed by a scheme update.
+func (client *Client) credentialTypesChanged(*irma.IrmaIdentifierSet) {
+	var orphaned irma.CredentialInfoList
+	for _, info := range client.OrphanedCredentials() {
+		if _, known := client.orphaned[info.Hash]; known {
+			continue
+		}
+		client.orphaned[info.Hash] = struct{}{}
+		orphaned = append(orphaned, info)
 	}
-	return client.storage.StoreLogs(client.logs)
+	if len(orphaned) == 0 {
+		return
+	}
+
+	irma.Logger.Infof("%d credentials became orphaned by a scheme update", len(orphaned))
+	client.handler.OrphanedCredentials(orphaned)
+	client.handler.UpdateAttributes()
 }
 
 // Attribute and credential getter methods
@@ -428,11 +523,15 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 // Candidates returns a list of attributes present in this client
 // that satisfy the specified attribute disjunction.
 func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
+	return client.candidates(client.Configuration.Snapshot(), disjunction)
+}
+
+func (client *Client) candidates(conf *irma.Configuration, disjunction *irma.AttributeDisjunction) []*irma.AttributeIdentifier {
 	candidates := make([]*irma.AttributeIdentifier, 0, 10)
 
 	for _, attribute := range disjunction.Attributes {
 		credID := attribute.CredentialTypeIdentifier()
-		if !client.Configuration.Contains(credID) {
+		if !conf.Contains(credID) {
 			continue
 		}
 		creds := client.attributes[credID]
@@ -441,7 +540,7 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 			continue
 		}
 		for _, attrs := range creds {
-			if !attrs.IsValid() {
+			if !attrs.IsValid() || attrs.Orphaned() {
 				continue
 			}
 			id := &irma.AttributeIdentifier{Type: attribute, CredentialHash: attrs.Hash()}
@@ -452,11 +551,24 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 				if val == nil {
 					continue
 				}
+				// Don't offer values not satisfying the format prescribed by the scheme
+				format := conf.AttributeFormat(attribute)
+				if format != nil && format.Validate(*val) != nil {
+					continue
+				}
 				if !disjunction.HasValues() {
 					candidates = append(candidates, id)
 				} else {
 					requiredValue, present := disjunction.Values[attribute]
-					if !present || requiredValue == nil || *val == *requiredValue {
+					if !present || requiredValue == nil {
+						candidates = append(candidates, id)
+						continue
+					}
+					required := *requiredValue
+					if format != nil {
+						required = format.Canonicalize(required)
+					}
+					if *val == required {
 						candidates = append(candidates, id)
 					}
 				}
@@ -472,12 +584,17 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 // are returned.
 func (client *Client) CheckSatisfiability(
 	disjunctions irma.AttributeDisjunctionList,
+) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
+	return client.checkSatisfiability(client.Configuration.Snapshot(), disjunctions)
+}
+
+func (client *Client) checkSatisfiability(conf *irma.Configuration, disjunctions irma.AttributeDisjunctionList,
 ) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
 	candidates := [][]*irma.AttributeIdentifier{}
 	missing := irma.AttributeDisjunctionList{}
 	for i, disjunction := range disjunctions {
 		candidates = append(candidates, []*irma.AttributeIdentifier{})
-		candidates[i] = client.Candidates(disjunction)
+		candidates[i] = client.candidates(conf, disjunction)
 		if len(candidates[i]) == 0 {
 			missing = append(missing, disjunction)
 		}
@@ -493,7 +610,7 @@ type attributeGroup struct {
 
 // Given the user's choice of attributes to be disclosed, group them per credential out of which they
 // are to be disclosed
-func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
+func (client *Client) groupCredentials(conf *irma.Configuration, choice *irma.DisclosureChoice) (
 	[]attributeGroup, irma.DisclosedAttributeIndices, error,
 ) {
 	if choice == nil || choice.Attributes == nil {
@@ -525,7 +642,7 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 			continue // In this case we only disclose the metadata attribute, which is already handled above
 		}
 
-		attrIndex, err := client.Configuration.CredentialTypes[identifier.CredentialTypeIdentifier()].IndexOf(identifier)
+		attrIndex, err := conf.CredentialTypes[identifier.CredentialTypeIdentifier()].IndexOf(identifier)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -543,11 +660,18 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest, issig bool,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, error) {
-	todisclose, attributeIndices, err := client.groupCredentials(choice)
+	return client.proofBuilders(client.Configuration.Snapshot(), choice, request, issig, nil)
+}
+
+func (client *Client) proofBuilders(conf *irma.Configuration, choice *irma.DisclosureChoice, request irma.SessionRequest, issig bool,
+	progress *proofProgress,
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, error) {
+	todisclose, attributeIndices, err := client.groupCredentials(conf, choice)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	progress.add(len(todisclose))
 	builders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, grp := range todisclose {
 		cred, err := client.credentialByID(grp.cred)
@@ -555,6 +679,7 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 			return nil, nil, err
 		}
 		builders = append(builders, cred.Credential.CreateDisclosureProofBuilder(grp.attrs))
+		progress.step()
 	}
 
 	if issig {
@@ -579,15 +704,23 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 
 // Proofs computes disclosure proofs containing the attributes specified by choice.
 func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest, issig bool) (*irma.Disclosure, error) {
-	builders, choices, err := client.ProofBuilders(choice, request, issig)
+	return client.proofs(client.Configuration.Snapshot(), choice, request, issig, nil)
+}
+
+func (client *Client) proofs(conf *irma.Configuration, choice *irma.DisclosureChoice, request irma.SessionRequest, issig bool,
+	progress *proofProgress,
+) (*irma.Disclosure, error) {
+	builders, choices, err := client.proofBuilders(conf, choice, request, issig, progress)
 	if err != nil {
 		return nil, err
 	}
 
-	return &irma.Disclosure{
+	disclosure := &irma.Disclosure{
 		Proofs:  builders.BuildProofList(request.GetContext(), request.GetNonce(), issig),
 		Indices: choices,
-	}, nil
+	}
+	progress.step()
+	return disclosure, nil
 }
 
 // generateIssuerProofNonce generates a nonce which the issuer must use in its gabi.ProofS.
@@ -599,27 +732,37 @@ func generateIssuerProofNonce() (*big.Int, error) {
 // for the future credentials as well as possibly any disclosed attributes, and generates
 // a nonce against which the issuer's proof of knowledge must verify.
 func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest,
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *big.Int, error) {
+	return client.issuanceProofBuilders(client.Configuration.Snapshot(), request, nil)
+}
+
+func (client *Client) issuanceProofBuilders(conf *irma.Configuration, request *irma.IssuanceRequest, progress *proofProgress,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *big.Int, error) {
 	issuerProofNonce, err := generateIssuerProofNonce()
 	if err != nil {
 		return nil, nil, nil, err
 	}
+
+	// The disclosures are constructed first, so that all progress steps are known before they are performed
+	progress.add(len(request.Credentials))
+	disclosures, choices, err := client.proofBuilders(conf, request.Choice, request, false, progress)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	builders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, futurecred := range request.Credentials {
 		var pk *gabi.PublicKey
-		pk, err = client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
+		pk, err = conf.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
 		if err != nil {
 			return nil, nil, nil, err
 		}
 		credBuilder := gabi.NewCredentialBuilder(
 			pk, request.GetContext(), client.secretkey.Key, issuerProofNonce)
 		builders = append(builders, credBuilder)
+		progress.step()
 	}
 
-	disclosures, choices, err := client.ProofBuilders(request.Choice, request, false)
-	if err != nil {
-		return nil, nil, nil, err
-	}
 	builders = append(disclosures, builders...)
 	return builders, choices, issuerProofNonce, nil
 }
@@ -628,23 +771,36 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest,
 // and also returns the credential builders which will become the new credentials upon combination with the issuer's signature.
 func (client *Client) IssueCommitments(request *irma.IssuanceRequest,
 ) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
-	builders, choices, issuerProofNonce, err := client.IssuanceProofBuilders(request)
+	return client.issueCommitments(client.Configuration.Snapshot(), request, nil)
+}
+
+func (client *Client) issueCommitments(conf *irma.Configuration, request *irma.IssuanceRequest, progress *proofProgress,
+) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
+	builders, choices, issuerProofNonce, err := client.issuanceProofBuilders(conf, request, progress)
 	if err != nil {
 		return nil, nil, err
 	}
-	return &irma.IssueCommitmentMessage{
+	commitments := &irma.IssueCommitmentMessage{
 		IssueCommitmentMessage: &gabi.IssueCommitmentMessage{
 			Proofs: builders.BuildProofList(request.GetContext(), request.GetNonce(), false),
 			Nonce2: issuerProofNonce,
 		},
 		Indices: choices,
-	}, builders, nil
+	}
+	progress.step()
+	return commitments, builders, nil
 }
 
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
 // and credential builders.
 func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
-	if len(msg) > len(builders) {
+	return client.constructCredentials(client.Configuration.Snapshot(), msg, request, builders)
+}
+
+func (client *Client) constructCredentials(conf *irma.Configuration, msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest,
+	builders gabi.ProofBuilderList,
+) error {
+	if len(msg) != len(request.Credentials) || len(msg) > len(builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
 
@@ -659,7 +815,7 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 			continue
 		}
 		sig := msg[i-offset]
-		attrs, err := request.Credentials[i-offset].AttributeList(client.Configuration, irma.GetMetadataVersion(request.GetVersion()))
+		attrs, err := request.Credentials[i-offset].AttributeList(conf, irma.GetMetadataVersion(request.GetVersion()))
 		if err != nil {
 			return err
 		}
@@ -670,16 +826,64 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		gabicreds = append(gabicreds, cred)
 	}
 
-	for _, gabicred := range gabicreds {
+	// Check that the issuer gave us exactly the credentials that the user agreed to receive
+	newcreds := make([]*credential, 0, len(gabicreds))
+	for i, gabicred := range gabicreds {
+		// The credentials outlive the session, so they refer to the configuration of the client
+		// instead of to the snapshot used during the session
 		newcred, err := newCredential(gabicred, client.Configuration)
 		if err != nil {
 			return err
 		}
-		if err = client.addCredential(newcred, true); err != nil {
+		if err = verifyIssuedCredential(newcred, request.Credentials[i]); err != nil {
 			return err
 		}
+		newcreds = append(newcreds, newcred)
+	}
+
+	for _, newcred := range newcreds {
+		if err := client.addCredential(newcred, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyIssuedCredential checks that the specified newly issued credential contains exactly the
+// attribute values of the specified credential request, as approved by the user, and that its
+// metadata is within the bounds of the request.
+func verifyIssuedCredential(cred *credential, request *irma.CredentialRequest) error {
+	credtype := cred.CredentialType()
+	if credtype == nil || credtype.Identifier() != request.CredentialTypeID {
+		return errors.Errorf("Received credential is not of requested type %s", request.CredentialTypeID)
+	}
+	if cred.KeyCounter() != request.KeyCounter {
+		return errors.Errorf("Received %s credential has unexpected key counter %d", request.CredentialTypeID, cred.KeyCounter())
+	}
+
+	attrs := cred.AttributeList()
+	for _, attrtype := range credtype.AttributeTypes {
+		requested, present := request.Attributes[attrtype.ID]
+		value := attrs.UntranslatedAttribute(attrtype.GetAttributeTypeIdentifier())
+		if cred.MetadataAttribute.Version() < 0x03 {
+			// Before optional attributes, absent attributes are encoded as the empty string
+			present = value != nil
+		}
+		if present != (value != nil) || (present && *value != requested) {
+			return errors.Errorf("Attribute %s of received credential does not match issuance request", attrtype.GetAttributeTypeIdentifier())
+		}
 	}
 
+	// The signing date is set when constructing the credential, so it cannot lie in the future;
+	// absent a validity in the request, the default validity applies
+	maxExpiry := irma.Now().AddDate(0, 6, 0)
+	if request.Validity != nil {
+		maxExpiry = time.Time(*request.Validity)
+	}
+	if cred.Expiry().After(maxExpiry) {
+		return errors.Errorf("Received %s credential expires later than requested", request.CredentialTypeID)
+	}
 	return nil
 }
 
@@ -725,7 +929,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return errors.New("PIN too short, must be at least 5 characters")
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer)
+	transport := client.Configuration.NewSchemeTransport(managerID, manager.KeyshareServer)
 	kss, err := newKeyshareServer(managerID)
 	if err != nil {
 		return err
@@ -770,7 +974,7 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 		}
 	}
 	kss := client.keyshareServers[schemeid]
-	return verifyPinWorker(pin, kss, irma.NewHTTPTransport(scheme.KeyshareServer))
+	return verifyPinWorker(pin, kss, client.Configuration.NewSchemeTransport(schemeid, scheme.KeyshareServer))
 }
 
 func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, oldPin string, newPin string) {
@@ -788,7 +992,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer)
+	transport := client.Configuration.NewSchemeTransport(managerID, client.Configuration.SchemeManagers[managerID].KeyshareServer)
 	message := keyshareChangepin{
 		Username: kss.Username,
 		OldPin:   kss.HashedPin(oldPin),
@@ -825,15 +1029,20 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
-	if _, contains := client.keyshareServers[manager]; !contains {
+	ks, contains := client.keyshareServers[manager]
+	if !contains {
 		return errors.New("Can't uninstall unknown keyshare server")
 	}
+	ks.Nonce.Wipe()
 	delete(client.keyshareServers, manager)
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
 
 // KeyshareRemoveAll removes all keyshare server registrations.
 func (client *Client) KeyshareRemoveAll() error {
+	for _, ks := range client.keyshareServers {
+		ks.Nonce.Wipe()
+	}
 	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
@@ -841,7 +1050,19 @@ func (client *Client) KeyshareRemoveAll() error {
 // Add, load and store log entries
 
 func (client *Client) addLogEntry(entry *LogEntry) error {
-	client.logs = append(client.logs, entry)
+	// Ensure the existing log entries are loaded, so that we append to them instead of overwriting them
+	logs, err := client.Logs()
+	if err != nil {
+		return err
+	}
+	var previous []byte
+	if len(logs) > 0 {
+		previous = logs[len(logs)-1].Hash
+	}
+	if err = entry.chain(previous); err != nil {
+		return err
+	}
+	client.logs = client.retainLogs(append(logs, entry))
 	return client.storage.StoreLogs(client.logs)
 }
 
@@ -857,6 +1078,29 @@ func (client *Client) Logs() ([]*LogEntry, error) {
 	return client.logs, nil
 }
 
+// VerifyLogs checks the integrity of the stored log entries: each log entry contains the hash of
+// the preceding entry, so that modification, insertion or removal of log entries (e.g. by malware
+// or a faulty backup or sync) can be detected. If the log was tampered with or damaged, a
+// *LogIntegrityError is returned, indicating the first offending log entry.
+func (client *Client) VerifyLogs() error {
+	logs, err := client.storage.LoadLogs()
+	if err != nil {
+		return err
+	}
+	head, err := client.storage.LoadLogsHead()
+	if err != nil {
+		return err
+	}
+	return verifyLogs(logs, head)
+}
+
+// SetNetworkReachable informs the client whether or not the network is reachable, e.g. when the
+// operating system reports a change in connectivity. While the network is unreachable, automatic
+// scheme updates are postponed, and they are performed as soon as it is reachable again.
+func (client *Client) SetNetworkReachable(reachable bool) {
+	client.Configuration.SetNetworkReachable(reachable)
+}
+
 // SetCrashReportingPreference toggles whether or not crash reports should be sent to Sentry.
 // Has effect only after restarting.
 func (client *Client) SetCrashReportingPreference(enable bool) {
@@ -865,6 +1109,62 @@ func (client *Client) SetCrashReportingPreference(enable bool) {
 	client.applyPreferences()
 }
 
+// SetSchemeSizeBudget sets the maximum amount of bytes that the schemes may take on disk
+// (0 meaning no maximum), pruning the schemes if they exceed it.
+func (client *Client) SetSchemeSizeBudget(budget int64) error {
+	client.Preferences.SchemeSizeBudget = budget
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	if budget <= 0 {
+		return nil
+	}
+	_, err := client.PruneSchemes()
+	return err
+}
+
+// PruneSchemes removes issuers and credential types from disk for which we have no credentials,
+// and that have not been encountered in past sessions, until the schemes no longer exceed
+// Preferences.SchemeSizeBudget. The removed parts of the schemes are reinstalled when they are
+// needed in a session. Returns the amount of bytes that was removed.
+func (client *Client) PruneSchemes() (int64, error) {
+	if client.Preferences.SchemeSizeBudget <= 0 {
+		return 0, nil
+	}
+
+	keep := &irma.IrmaIdentifierSet{
+		SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{},
+		PublicKeys:      map[irma.IssuerIdentifier][]int{},
+	}
+	for credid := range client.attributes {
+		keep.CredentialTypes[credid] = struct{}{}
+	}
+	logs, err := client.Logs()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range logs {
+		request, err := entry.SessionRequest()
+		if err != nil {
+			return 0, err
+		}
+		if request == nil { // not a session, e.g. a credential removal
+			continue
+		}
+		ids := request.Identifiers()
+		for issid := range ids.Issuers {
+			keep.Issuers[issid] = struct{}{}
+		}
+		for credid := range ids.CredentialTypes {
+			keep.CredentialTypes[credid] = struct{}{}
+		}
+	}
+
+	return client.Configuration.PruneSchemes(keep, client.Preferences.SchemeSizeBudget)
+}
+
 func (client *Client) applyPreferences() {
 	if client.Preferences.EnableCrashReporting {
 		raven.SetDSN(SentryDSN)
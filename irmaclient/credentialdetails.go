@@ -0,0 +1,141 @@
+package irmaclient
+
+import (
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains methods for querying the credentials of the client, returning their
+// metadata and attribute values ready to be shown in (wallet) user interfaces. Orphaned
+// credentials (see Client.OrphanedCredentials()) are not included. Credentials that are about to
+// expire are returned by Client.ExpiringCredentials().
+
+// CredentialFilter selects the credentials returned by Client.Credentials(). Empty fields do not
+// filter.
+type CredentialFilter struct {
+	Scheme         irma.SchemeManagerIdentifier
+	Issuer         irma.IssuerIdentifier
+	CredentialType irma.CredentialTypeIdentifier
+
+	// Whether to include expired credentials
+	IncludeExpired bool
+}
+
+// CredentialDetails contains the metadata and attribute values of a credential.
+type CredentialDetails struct {
+	Hash           string
+	CredentialType irma.CredentialTypeIdentifier
+	// Name of the credential type, and of its issuer
+	Name       string
+	IssuerName string
+	SignedOn   irma.Timestamp
+	Expires    irma.Timestamp
+	Expired    bool
+	// The attributes in display order (see irma.CredentialType.AttributeTypesInDisplayOrder())
+	Attributes []*AttributeDetails
+}
+
+// AttributeDetails contains the name and value of an attribute of a credential.
+type AttributeDetails struct {
+	Type irma.AttributeTypeIdentifier
+	Name string
+	// Absent (optional) attributes have no value
+	Value *string
+}
+
+// Credentials returns the credentials matching the filter, sorted by credential type and
+// issuance time, with their names and attribute values in the specified language (falling back
+// to English if not available in that language).
+func (client *Client) Credentials(filter CredentialFilter, language string) []*CredentialDetails {
+	var result []*CredentialDetails
+	for id, attrlistlist := range client.attributes {
+		if !filter.Scheme.Empty() && id.IssuerIdentifier().SchemeManagerIdentifier() != filter.Scheme {
+			continue
+		}
+		if !filter.Issuer.Empty() && id.IssuerIdentifier() != filter.Issuer {
+			continue
+		}
+		if !filter.CredentialType.Empty() && id != filter.CredentialType {
+			continue
+		}
+		for _, attrs := range attrlistlist {
+			details := client.credentialDetails(attrs, language)
+			if details == nil || (details.Expired && !filter.IncludeExpired) {
+				continue
+			}
+			result = append(result, details)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CredentialType != result[j].CredentialType {
+			return result[i].CredentialType.String() < result[j].CredentialType.String()
+		}
+		return result[i].SignedOn.Before(result[j].SignedOn)
+	})
+	return result
+}
+
+// CredentialDetails returns the credential having the specified hash (see
+// irma.CredentialInfo.Hash), with its names and attribute values in the specified language.
+func (client *Client) CredentialDetails(hash string, language string) (*CredentialDetails, error) {
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			if attrs.Hash() != hash {
+				continue
+			}
+			if details := client.credentialDetails(attrs, language); details != nil {
+				return details, nil
+			}
+			return nil, errors.Errorf("Credential %s is orphaned", hash)
+		}
+	}
+	return nil, errors.Errorf("Credential %s not found", hash)
+}
+
+func (client *Client) credentialDetails(attrs *irma.AttributeList, language string) *CredentialDetails {
+	if attrs.Orphaned() {
+		return nil
+	}
+	credtype := attrs.CredentialType()
+	if credtype == nil {
+		return nil
+	}
+	details := &CredentialDetails{
+		Hash:           attrs.Hash(),
+		CredentialType: credtype.Identifier(),
+		Name:           translation(credtype.Name, language),
+		SignedOn:       irma.Timestamp(attrs.SigningDate()),
+		Expires:        irma.Timestamp(attrs.Expiry()),
+		Expired:        !attrs.IsValid(),
+	}
+	if issuer := client.Configuration.Issuers[credtype.IssuerIdentifier()]; issuer != nil {
+		details.IssuerName = translation(issuer.Name, language)
+	}
+	values := attrs.Strings()
+	for _, attrtype := range credtype.AttributeTypesInDisplayOrder() {
+		attr := &AttributeDetails{
+			Type: attrtype.GetAttributeTypeIdentifier(),
+			Name: translation(attrtype.Name, language),
+		}
+		if attrtype.Index < len(values) && values[attrtype.Index] != nil {
+			value := translation(values[attrtype.Index], language)
+			attr.Value = &value
+		}
+		details.Attributes = append(details.Attributes, attr)
+	}
+	return details
+}
+
+// translation returns the translation of the string in the specified language, or in English if
+// it is not available in that language.
+func translation(ts irma.TranslatedString, language string) string {
+	if t, ok := ts[language]; ok {
+		return t
+	}
+	if t, ok := ts["en"]; ok {
+		return t
+	}
+	return ts[""]
+}
@@ -80,6 +80,9 @@ func (h *keyshareEnrollmentHandler) KeyshareEnrollmentDeleted(manager irma.Schem
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: unenrolled"))
 }
+func (h *keyshareEnrollmentHandler) UpdateRequired(manager irma.SchemeManagerIdentifier, minimumVersion string) {
+	h.fail(errors.Errorf("Keyshare enrollment failed: scheme requires irmago version %s", minimumVersion))
+}
 func (h *keyshareEnrollmentHandler) UnsatisfiableRequest(ServerName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
 	h.fail(errors.New("Keyshare enrollment failed: unsatisfiable"))
 }
@@ -0,0 +1,163 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the API for showing the session history (i.e., the log entries) to the
+// user: retrieving it page by page, filtered by session type or requestor, as structured entries
+// containing the disclosed and issued attributes and signed messages, and exporting it. Log
+// entries can be removed after a configurable retention period (see Preferences.LogRetention);
+// as the first remaining entry still refers to the hash of the last removed one, the integrity of
+// the remaining entries can still be verified (see Client.VerifyLogs()).
+
+// LogFilter selects log entries in Client.LogsPage() and Client.ExportLogs(). Empty fields do not
+// filter.
+type LogFilter struct {
+	// Session types, e.g. irma.ActionDisclosing, or "removal" for the removal of credentials
+	Types []irma.Action
+	// Name of the requestor (in any language, case insensitive; see LogEntry.ServerName)
+	Verifier string
+}
+
+// LogDetails contains the contents of a log entry in structured form.
+type LogDetails struct {
+	Type       irma.Action
+	Time       irma.Timestamp
+	ServerName irma.TranslatedString `json:",omitempty"`
+
+	Disclosed     []*irma.DisclosedAttribute                                `json:",omitempty"`
+	Issued        irma.CredentialInfoList                                   `json:",omitempty"`
+	SignedMessage *irma.SignedMessage                                       `json:",omitempty"`
+	Removed       map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"`
+}
+
+func (filter LogFilter) matches(entry *LogEntry) bool {
+	if len(filter.Types) > 0 {
+		found := false
+		for _, t := range filter.Types {
+			if entry.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Verifier != "" {
+		for _, name := range entry.ServerName {
+			if strings.EqualFold(name, filter.Verifier) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Details returns the contents of the log entry in structured form.
+func (entry *LogEntry) Details(conf *irma.Configuration) (*LogDetails, error) {
+	details := &LogDetails{
+		Type:       entry.Type,
+		Time:       entry.Time,
+		ServerName: entry.ServerName,
+		Removed:    entry.Removed,
+	}
+	if entry.Type == actionRemoval {
+		return details, nil
+	}
+	var err error
+	if details.Disclosed, err = entry.GetDisclosedCredentials(conf); err != nil {
+		return nil, err
+	}
+	if details.Issued, err = entry.GetIssuedCredentials(conf); err != nil {
+		return nil, err
+	}
+	if details.SignedMessage, err = entry.GetSignedMessage(); err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+// LogsPage returns at most max log entries matching the filter, newest first, after skipping
+// the first offset matching entries; if max is 0, all of them are returned. Use
+// LogEntry.Details() to obtain their contents, e.g. LogEntry.GetSignedMessage() for the messages
+// signed in signature sessions.
+func (client *Client) LogsPage(filter LogFilter, offset, max int) ([]*LogEntry, error) {
+	logs, err := client.Logs()
+	if err != nil {
+		return nil, err
+	}
+	page := []*LogEntry{}
+	for i := len(logs) - 1; i >= 0 && (max <= 0 || len(page) < max); i-- {
+		if !filter.matches(logs[i]) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		page = append(page, logs[i])
+	}
+	return page, nil
+}
+
+// ExportLogs returns the JSON of the contents (see LogEntry.Details()) of the log entries
+// matching the filter, newest first.
+func (client *Client) ExportLogs(filter LogFilter) ([]byte, error) {
+	logs, err := client.LogsPage(filter, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*LogDetails, 0, len(logs))
+	for _, entry := range logs {
+		details, err := entry.Details(client.Configuration)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, details)
+	}
+	return json.Marshal(list)
+}
+
+// SetLogRetention sets the period after which log entries are removed (0 meaning they are kept),
+// removing the log entries older than that.
+func (client *Client) SetLogRetention(retention time.Duration) error {
+	client.Preferences.LogRetention = retention
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	return client.PruneLogs()
+}
+
+// PruneLogs removes the log entries that are older than Preferences.LogRetention. This happens
+// automatically when the client is created and when sessions are logged.
+func (client *Client) PruneLogs() error {
+	logs, err := client.Logs()
+	if err != nil {
+		return err
+	}
+	retained := client.retainLogs(logs)
+	if len(retained) == len(logs) {
+		return nil
+	}
+	client.logs = retained
+	return client.storage.StoreLogs(retained)
+}
+
+// retainLogs returns the log entries that are not older than Preferences.LogRetention.
+func (client *Client) retainLogs(logs []*LogEntry) []*LogEntry {
+	if client.Preferences.LogRetention <= 0 {
+		return logs
+	}
+	cutoff := irma.Timestamp(irma.Now().Add(-client.Preferences.LogRetention))
+	for len(logs) > 0 && logs[0].Time.Before(cutoff) {
+		logs = logs[1:]
+	}
+	return logs
+}
@@ -3,11 +3,14 @@ package irmaclient
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 
 	"os"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
@@ -96,6 +99,157 @@ func TestStorageDeserialization(t *testing.T) {
 	verifyKeyshareIsUnmarshaled(t, client)
 }
 
+type storageSecretHandler struct {
+	TestClientHandler
+	secret string
+}
+
+func (h *storageSecretHandler) StorageSecret() ([]byte, error) {
+	return []byte(h.secret), nil
+}
+
+func TestStorageEncryption(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	newClient := func(secret string) (*Client, error) {
+		return New(
+			"../testdata/storage/test",
+			"../testdata/irma_configuration",
+			"",
+			&storageSecretHandler{TestClientHandler{t: t}, secret},
+		)
+	}
+
+	// Existing unencrypted storage is encrypted when the client is created, including other profiles
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test/"+profilesDir+"/work"))
+	client, err := newClient("secret")
+	require.NoError(t, err)
+	require.True(t, client.StorageEncrypted())
+	verifyClientIsUnmarshaled(t, client)
+	for _, file := range []string{skFile, attributesFile, kssFile, profilesDir + "/work/" + skFile} {
+		bts, err := ioutil.ReadFile("../testdata/storage/test/" + file)
+		require.NoError(t, err)
+		require.True(t, storageEncrypted(bts), file)
+	}
+	require.NoError(t, client.SwitchProfile("work"))
+	verifyClientIsUnmarshaled(t, client)
+	require.NoError(t, client.SwitchProfile(DefaultProfile))
+
+	// Encrypted storage cannot be read without the secret
+	_, err = newClient("wrong")
+	require.Error(t, err)
+	_, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &TestClientHandler{t: t})
+	require.Error(t, err)
+
+	// After changing the secret, only the new secret can be used
+	require.NoError(t, client.ChangeStorageSecret([]byte("new secret")))
+	_, err = newClient("secret")
+	require.Error(t, err)
+	client, err = newClient("new secret")
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	// Unencrypted files are refused once the storage is encrypted
+	bts, err := ioutil.ReadFile("../testdata/teststorage/" + attributesFile)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile("../testdata/storage/test/"+attributesFile, bts))
+	_, err = newClient("new secret")
+	require.Error(t, err)
+
+	// Neither can they be accepted by resetting the flag that all files have been encrypted
+	bts, err = ioutil.ReadFile("../testdata/storage/test/" + storageKeyFile)
+	require.NoError(t, err)
+	var sk storageKey
+	require.NoError(t, json.Unmarshal(bts, &sk))
+	require.True(t, sk.Complete)
+	sk.Complete = false
+	bts, err = json.Marshal(sk)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile("../testdata/storage/test/"+storageKeyFile, bts))
+	_, err = newClient("new secret")
+	require.Error(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	backup, err := client.Export("passphrase")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "backup")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	restored, err := New(dir, "../testdata/irma_configuration", "", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Empty(t, restored.CredentialInfoList())
+
+	// The backup is encrypted and integrity protected
+	require.Error(t, restored.Import(backup, "wrong"))
+	corrupted := append([]byte{}, backup...)
+	corrupted[len(corrupted)-1] ^= 1
+	require.Error(t, restored.Import(corrupted, "passphrase"))
+	require.Empty(t, restored.CredentialInfoList())
+
+	require.NoError(t, restored.Import(backup, "passphrase"))
+	verifyClientIsUnmarshaled(t, restored)
+	verifyCredentials(t, restored)
+	verifyKeyshareIsUnmarshaled(t, restored)
+	require.Equal(t, client.secretkey.Key, restored.secretkey.Key)
+	restoredLogs, err := restored.Logs()
+	require.NoError(t, err)
+	require.Len(t, restoredLogs, len(logs))
+	require.NoError(t, restored.VerifyLogs())
+
+	// Backups are not imported into clients that already contain credentials
+	require.Error(t, restored.Import(backup, "passphrase"))
+}
+
+func TestProfiles(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.Equal(t, DefaultProfile, client.Profile())
+
+	require.NoError(t, client.CreateProfile("work"))
+	require.Error(t, client.CreateProfile("work"))
+	require.Error(t, client.CreateProfile("../work"))
+	require.Error(t, client.CreateProfile(DefaultProfile))
+	profiles, err := client.Profiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultProfile, "work"}, profiles)
+
+	// A new profile has its own secret key and no credentials
+	sk := client.secretkey.Key
+	require.NoError(t, client.SwitchProfile("work"))
+	require.Equal(t, "work", client.Profile())
+	require.Empty(t, client.CredentialInfoList())
+	require.Empty(t, client.keyshareServers)
+	require.NotEqual(t, sk, client.secretkey.Key)
+	require.Error(t, client.DeleteProfile("work"))
+
+	// The profile in use is remembered
+	client, err = New("../testdata/storage/test", "../testdata/irma_configuration", "", &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Equal(t, "work", client.Profile())
+	require.Empty(t, client.CredentialInfoList())
+
+	require.NoError(t, client.SwitchProfile(DefaultProfile))
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+
+	require.Error(t, client.DeleteProfile(DefaultProfile))
+	require.NoError(t, client.DeleteProfile("work"))
+	require.Error(t, client.SwitchProfile("work"))
+	profiles, err = client.Profiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultProfile}, profiles)
+}
+
 // TestCandidates tests the correctness of the function of the client that, given a disjunction of attributes
 // requested by the verifier, calculates a list of candidate attributes contained by the client that would
 // satisfy the attribute disjunction.
@@ -188,6 +342,82 @@ func TestCredentialRemoval(t *testing.T) {
 	require.Nil(t, cred)
 }
 
+func TestRemovedCredentialType(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	handler := client.handler.(*TestClientHandler)
+
+	// The credentials of a credential type that was removed from its scheme become orphaned
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	count := len(client.attributes[studentCard])
+	require.NotZero(t, count)
+	orphaned := len(client.OrphanedCredentials())
+	require.NoError(t, client.Configuration.RemoveCredentialType(studentCard, false))
+	removed := &irma.IrmaIdentifierSet{
+		SchemeManagers:  map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{studentCard: {}},
+		PublicKeys:      map[irma.IssuerIdentifier][]int{},
+	}
+	client.Configuration.RemovalHandler(removed)
+	require.Len(t, client.attributes[studentCard], count)
+	require.Len(t, handler.orphaned, count)
+	require.Len(t, client.OrphanedCredentials(), orphaned+count)
+	require.Subset(t, client.OrphanedCredentials(), handler.orphaned)
+	for _, info := range handler.orphaned {
+		require.True(t, info.Orphaned)
+		require.NotEmpty(t, info.RawAttributes)
+	}
+
+	// Orphaned credentials are not listed or disclosed
+	for _, info := range client.CredentialInfoList() {
+		require.NotEqual(t, "studentCard", info.ID)
+	}
+	require.Empty(t, client.Candidates(&irma.AttributeDisjunction{
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}))
+
+	// The handler is informed only once
+	client.Configuration.RemovalHandler(removed)
+	require.Len(t, handler.orphaned, count)
+
+	// Orphaned credentials can be removed
+	require.NoError(t, client.RemoveCredentialByHash(handler.orphaned[0].Hash))
+	require.Len(t, client.OrphanedCredentials(), orphaned+count-1)
+}
+
+func TestSchemeUpdateQueue(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	handler := client.handler.(*TestClientHandler)
+	handler.schemeUpdates = make(chan irma.SchemeManagerIdentifier, 4)
+
+	defer func(delay time.Duration) { schemeUpdateDelay = delay }(schemeUpdateDelay)
+	schemeUpdateDelay = 200 * time.Millisecond
+
+	// A scheme needed by a session is updated before the queued schemes
+	demo, testscheme := irma.NewSchemeManagerIdentifier("irma-demo"), irma.NewSchemeManagerIdentifier("test")
+	client.UpdateSchemes()
+	_, err := client.schemeUpdates.prioritize(func() (*irma.IrmaIdentifierSet, error) {
+		return &irma.IrmaIdentifierSet{
+			SchemeManagers: map[irma.SchemeManagerIdentifier]struct{}{testscheme: {}},
+		}, nil
+	})
+	require.NoError(t, err)
+
+	// The remaining schemes are updated in the background
+	var updated []irma.SchemeManagerIdentifier
+	for range client.Configuration.SchemeManagers {
+		select {
+		case id := <-handler.schemeUpdates:
+			updated = append(updated, id)
+		case <-time.After(10 * time.Second):
+			t.Fatal("scheme update did not finish")
+		}
+	}
+	require.Equal(t, []irma.SchemeManagerIdentifier{testscheme, demo}, updated)
+}
+
 func TestWrongSchemeManager(t *testing.T) {
 	client := parseStorage(t)
 	defer test.ClearTestStorage(t)
@@ -231,15 +461,188 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+func TestExpiringCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	var studentCard *irma.CredentialInfo
+	for _, credinfo := range client.CredentialInfoList() {
+		if credinfo.ID == "studentCard" {
+			studentCard = credinfo
+		}
+	}
+	require.NotNil(t, studentCard)
+
+	contains := func(list irma.CredentialInfoList) bool {
+		for _, credinfo := range list {
+			if credinfo.Hash == studentCard.Hash {
+				return true
+			}
+		}
+		return false
+	}
+
+	defer irma.SetClock(irma.SetClock(irma.FixedClock(time.Time(studentCard.Expires).Add(-24 * time.Hour))))
+	require.True(t, contains(client.ExpiringCredentials(48*time.Hour)))
+	require.False(t, contains(client.ExpiringCredentials(time.Hour)))
+}
+
+type reissueHandler struct {
+	TestClientHandler
+	offered chan *irma.CredentialInfo
+}
+
+func (h *reissueHandler) ReissueAvailable(credential *irma.CredentialInfo, reissue func(handler Handler)) {
+	h.offered <- credential
+}
+
+func TestReissuance(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.Error(t, client.StartReissuance(48*time.Hour)) // handler does not implement ReissueHandler
+
+	handler := &reissueHandler{TestClientHandler{t: t}, make(chan *irma.CredentialInfo, 10)}
+	client.handler = handler
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	var studentCard *irma.CredentialInfo
+	for _, credinfo := range client.CredentialInfoList() {
+		if credinfo.ID == "studentCard" {
+			studentCard = credinfo
+		}
+	}
+	require.NotNil(t, studentCard)
+	defer irma.SetClock(irma.SetClock(irma.FixedClock(time.Time(studentCard.Expires).Add(-24 * time.Hour))))
+	defer func(interval time.Duration) { reissueInterval = interval }(reissueInterval)
+	reissueInterval = 10 * time.Millisecond
+
+	// Without a ReissueURL, the credential is not offered
+	require.NoError(t, client.StartReissuance(48*time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	client.StopReissuance()
+	require.Len(t, handler.offered, 0)
+
+	// With a ReissueURL, it is offered once
+	client.Configuration.CredentialTypes[credid].ReissueURL = "http://localhost:48682/reissue"
+	require.NoError(t, client.StartReissuance(48*time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	client.StopReissuance()
+	require.Len(t, handler.offered, 1)
+	require.Equal(t, studentCard.Hash, (<-handler.offered).Hash)
+
+	// Credentials that do not expire within the period are not offered
+	require.NoError(t, client.StartReissuance(time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	client.StopReissuance()
+	require.Len(t, handler.offered, 0)
+}
+
+func TestCredentialDetails(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	all := client.Credentials(CredentialFilter{IncludeExpired: true}, "en")
+	require.Len(t, all, len(client.CredentialInfoList()))
+	require.Len(t, client.Credentials(CredentialFilter{Scheme: irma.NewSchemeManagerIdentifier("nonexistent")}, "en"), 0)
+
+	list := client.Credentials(CredentialFilter{CredentialType: credid, IncludeExpired: true}, "nl")
+	require.Len(t, list, 1)
+	details := list[0]
+	require.Equal(t, credid, details.CredentialType)
+	require.Equal(t, client.Configuration.CredentialTypes[credid].Name["nl"], details.Name)
+	require.Equal(t, client.Configuration.Issuers[credid.IssuerIdentifier()].Name["nl"], details.IssuerName)
+
+	// Attributes are returned in display order
+	ordered := client.Configuration.CredentialTypes[credid].AttributeTypesInDisplayOrder()
+	require.Len(t, details.Attributes, len(ordered))
+	for i, attrtype := range ordered {
+		require.Equal(t, attrtype.GetAttributeTypeIdentifier(), details.Attributes[i].Type)
+		require.Equal(t, attrtype.Name["nl"], details.Attributes[i].Name)
+	}
+	for _, attr := range details.Attributes {
+		if attr.Type.Name() == "studentID" {
+			require.NotNil(t, attr.Value)
+			require.Equal(t, "456", *attr.Value)
+		}
+	}
+
+	byHash, err := client.CredentialDetails(details.Hash, "nl")
+	require.NoError(t, err)
+	require.Equal(t, details, byHash)
+	_, err = client.CredentialDetails("nonexistent", "nl")
+	require.Error(t, err)
+
+	// Expired credentials are excluded unless requested
+	defer irma.SetClock(irma.SetClock(irma.FixedClock(time.Time(details.Expires).Add(time.Hour))))
+	require.Len(t, client.Credentials(CredentialFilter{CredentialType: credid}, "en"), 0)
+	list = client.Credentials(CredentialFilter{CredentialType: credid, IncludeExpired: true}, "en")
+	require.Len(t, list, 1)
+	require.True(t, list[0].Expired)
+}
+
+func TestVerifyIssuedCredential(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
+	request := &irma.CredentialRequest{
+		Validity:         &validity,
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		KeyCounter:       2,
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "42",
+		},
+	}
+	issue := func(req *irma.CredentialRequest) *credential {
+		attrs, err := req.AttributeList(client.Configuration, 0x03)
+		require.NoError(t, err)
+		gabicred := &gabi.Credential{Attributes: append([]*big.Int{big.NewInt(42)}, attrs.Ints...)}
+		cred, err := newCredential(gabicred, client.Configuration)
+		require.NoError(t, err)
+		return cred
+	}
+	require.NoError(t, verifyIssuedCredential(issue(request), request))
+
+	// Credentials with other attribute values, key counter or later expiry than requested are rejected
+	other := *request
+	other.Attributes = map[string]string{"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "43"}
+	require.Error(t, verifyIssuedCredential(issue(&other), request))
+	other = *request
+	other.KeyCounter = 1
+	require.Error(t, verifyIssuedCredential(issue(&other), request))
+	other = *request
+	later := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(2, 0, 0)))
+	other.Validity = &later
+	require.Error(t, verifyIssuedCredential(issue(&other), request))
+}
+
 // ------
 
 type TestClientHandler struct {
-	t *testing.T
-	c chan error
+	t             *testing.T
+	c             chan error
+	orphaned      irma.CredentialInfoList
+	schemeUpdates chan irma.SchemeManagerIdentifier
+}
+
+func (i *TestClientHandler) SchemeUpdateProgress(progress irma.SchemeProgress) {}
+func (i *TestClientHandler) SchemeUpdateFinished(scheme irma.SchemeManagerIdentifier, err error) {
+	if err != nil {
+		i.t.Error(err)
+	}
+	if i.schemeUpdates != nil {
+		i.schemeUpdates <- scheme
+	}
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
 func (i *TestClientHandler) UpdateAttributes()                               {}
+func (i *TestClientHandler) OrphanedCredentials(orphaned irma.CredentialInfoList) {
+	i.orphaned = append(i.orphaned, orphaned...)
+}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -36,6 +36,9 @@ type keyshareSessionHandler interface {
 	KeyshareError(manager *irma.SchemeManagerIdentifier, err error)
 	KeysharePin()
 	KeysharePinOK()
+	// KeyshareAborted returns whether the session was dismissed, in which case the keyshare
+	// protocol stops without contacting the keyshare servers or the user any further.
+	KeyshareAborted() bool
 }
 
 type keyshareSession struct {
@@ -52,8 +55,8 @@ type keyshareSession struct {
 }
 
 type keyshareServer struct {
-	Username                string `json:"username"`
-	Nonce                   []byte `json:"nonce"`
+	Username                string           `json:"username"`
+	Nonce                   irma.SecureBytes `json:"nonce"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
 	token                   string
 }
@@ -134,7 +137,10 @@ func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (ks
 }
 
 func (ks *keyshareServer) HashedPin(pin string) string {
-	hash := sha256.Sum256(append(ks.Nonce, []byte(pin)...))
+	salted := make(irma.SecureBytes, 0, len(ks.Nonce)+len(pin))
+	salted = append(append(salted, ks.Nonce...), pin...)
+	defer salted.Wipe()
+	hash := sha256.Sum256(salted)
 	// We must be compatible with the old Android app here,
 	// which uses Base64.encodeToString(hash, Base64.DEFAULT),
 	// which appends a newline.
@@ -191,7 +197,7 @@ func startKeyshareSession(
 		}
 
 		ks.keyshareServer = ks.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(scheme.KeyshareServer)
+		transport := ks.conf.NewSchemeTransport(managerID, scheme.KeyshareServer)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
 		transport.SetHeader(kssAuthHeader, "Bearer "+ks.keyshareServer.token)
 		transport.SetHeader(kssVersionHeader, "2")
@@ -252,11 +258,17 @@ func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error)
 // Ask for a pin, repeatedly if necessary, and either continue the keyshare protocol
 // with authorization, or stop the keyshare protocol and inform of failure.
 func (ks *keyshareSession) VerifyPin(attempts int) {
+	if ks.sessionHandler.KeyshareAborted() {
+		return
+	}
 	ks.pinRequestor.RequestPin(attempts, PinHandler(func(proceed bool, pin string) {
 		if !proceed {
 			ks.sessionHandler.KeyshareCancelled()
 			return
 		}
+		if ks.sessionHandler.KeyshareAborted() {
+			return
+		}
 		success, attemptsRemaining, blocked, manager, err := ks.verifyPinAttempt(pin)
 		if err != nil {
 			ks.sessionHandler.KeyshareError(&manager, err)
@@ -336,6 +348,9 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 // of all keyshare servers of their part of the private key, and merges these commitments
 // in our own proof builders.
 func (ks *keyshareSession) GetCommitments() {
+	if ks.sessionHandler.KeyshareAborted() {
+		return
+	}
 	pkids := map[irma.SchemeManagerIdentifier][]*publicKeyIdentifier{}
 	commitments := map[publicKeyIdentifier]*gabi.ProofPCommitment{}
 
@@ -399,6 +414,9 @@ func (ks *keyshareSession) GetCommitments() {
 // to calculate the challenge, which is sent to the keyshare servers in order to
 // receive their responses (2nd and 3rd message in Schnorr zero-knowledge protocol).
 func (ks *keyshareSession) GetProofPs() {
+	if ks.sessionHandler.KeyshareAborted() {
+		return
+	}
 	_, issig := ks.session.(*irma.SignatureRequest)
 	challenge := ks.builders.Challenge(ks.session.GetContext(), ks.session.GetNonce(), issig)
 
@@ -1,7 +1,10 @@
 package irmaclient
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -19,6 +22,8 @@ type LogEntry struct {
 	Request json.RawMessage     `json:",omitempty"` // Message that started the session
 	request irma.SessionRequest // cached parsed version of Request; get with LogEntry.SessionRequest()
 
+	ServerName irma.TranslatedString `json:",omitempty"` // Name of the requestor, as shown to the user during the session
+
 	// Session type-specific info
 	Removed       map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"` // In case of credential removal
 	SignedMessage []byte                                                    `json:",omitempty"` // In case of signature sessions
@@ -26,6 +31,128 @@ type LogEntry struct {
 
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
 	Disclosure      *irma.Disclosure             `json:",omitempty"`
+
+	// Hash chain, making modifications of the log detectable (see Client.VerifyLogs())
+	Previous []byte `json:",omitempty"` // Hash of the preceding log entry, if any
+	Hash     []byte `json:",omitempty"` // Hash over this log entry, including Previous
+
+	raw json.RawMessage // the entry as it was stored, if it was loaded from storage
+}
+
+// LogIntegrityProblem classifies a LogIntegrityError.
+type LogIntegrityProblem string
+
+const (
+	LogEntryModified = LogIntegrityProblem("MODIFIED")  // The log entry does not match its hash
+	LogChainBroken   = LogIntegrityProblem("BROKEN")    // The log entry does not refer to the hash of its predecessor, e.g. because entries were removed or inserted
+	LogTruncated     = LogIntegrityProblem("TRUNCATED") // Log entries are missing at the end of the log
+)
+
+// LogIntegrityError indicates that the log was tampered with, or damaged.
+type LogIntegrityError struct {
+	Problem LogIntegrityProblem
+	Entry   int // Index of the first offending log entry
+}
+
+func (e *LogIntegrityError) Error() string {
+	switch e.Problem {
+	case LogEntryModified:
+		return fmt.Sprintf("log entry %d was modified", e.Entry)
+	case LogChainBroken:
+		return fmt.Sprintf("log entries before log entry %d were removed, inserted or modified", e.Entry)
+	default:
+		return fmt.Sprintf("log entries after log entry %d were removed", e.Entry-1)
+	}
+}
+
+// logsHead records the amount of log entries and the hash of the last one, so that removal of
+// log entries at the end of the log can be detected.
+type logsHead struct {
+	Count int
+	Hash  []byte
+	// Hash to which the first log entry refers, if older log entries were pruned
+	// (see Preferences.LogRetention)
+	Start []byte `json:",omitempty"`
+}
+
+func newLogsHead(logs []*LogEntry) *logsHead {
+	head := &logsHead{Count: len(logs)}
+	if len(logs) > 0 {
+		head.Hash = logs[len(logs)-1].Hash
+		head.Start = logs[0].Previous
+	}
+	return head
+}
+
+// UnmarshalJSON unmarshals the log entry, keeping the JSON for verifying its hash.
+func (entry *LogEntry) UnmarshalJSON(bts []byte) error {
+	type plainEntry LogEntry // prevent infinite recursion
+	if err := json.Unmarshal(bts, (*plainEntry)(entry)); err != nil {
+		return err
+	}
+	entry.raw = append(json.RawMessage{}, bts...)
+	return nil
+}
+
+// chain sets the hashes of the log entry, to be appended to the log after the entry with the
+// specified hash (nil if the log is empty).
+func (entry *LogEntry) chain(previous []byte) error {
+	entry.Previous = previous
+	entry.Hash = nil
+	entry.raw = nil
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	return nil
+}
+
+// computeHash computes the SHA256 hash over the JSON of the log entry excluding its Hash field.
+// In order not to depend on the JSON encoding of its contents being reproducible, the stored JSON
+// is used for log entries loaded from storage; the fields are put in a canonical order.
+func (entry *LogEntry) computeHash() ([]byte, error) {
+	bts := []byte(entry.raw)
+	if bts == nil {
+		var err error
+		if bts, err = json.Marshal(entry); err != nil {
+			return nil, err
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "Hash")
+	bts, err := json.Marshal(fields) // marshals the fields sorted by name
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bts)
+	return hash[:], nil
+}
+
+// verifyLogs checks that each of the log entries matches its hash and refers to the hash of the
+// preceding entry, and that the last entry matches the specified head.
+func verifyLogs(logs []*LogEntry, head *logsHead) error {
+	previous := head.Start
+	for i, entry := range logs {
+		if !bytes.Equal(entry.Previous, previous) {
+			return &LogIntegrityError{Problem: LogChainBroken, Entry: i}
+		}
+		hash, err := entry.computeHash()
+		if err != nil || len(entry.Hash) == 0 || !bytes.Equal(hash, entry.Hash) {
+			return &LogIntegrityError{Problem: LogEntryModified, Entry: i}
+		}
+		previous = entry.Hash
+	}
+	if len(logs) < head.Count {
+		return &LogIntegrityError{Problem: LogTruncated, Entry: len(logs)}
+	}
+	if len(logs) > head.Count || !bytes.Equal(previous, head.Hash) {
+		return &LogIntegrityError{Problem: LogChainBroken, Entry: len(logs) - 1}
+	}
+	return nil
 }
 
 const actionRemoval = irma.Action("removal")
@@ -113,12 +240,25 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 	}, nil
 }
 
+// storeLogEntry adds a log entry of the session to the log. As the session has already succeeded
+// at this point, failure to do so is logged instead of failing the session.
+func (session *session) storeLogEntry(response interface{}) {
+	entry, err := session.createLogEntry(response)
+	if err == nil {
+		err = session.client.addLogEntry(entry)
+	}
+	if err != nil {
+		irma.Logger.Warn("Failed to store log entry: ", err.Error())
+	}
+}
+
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
 	entry := &LogEntry{
-		Type:    session.Action,
-		Time:    irma.Timestamp(time.Now()),
-		Version: session.Version,
-		request: session.request,
+		Type:       session.Action,
+		Time:       irma.Timestamp(time.Now()),
+		Version:    session.Version,
+		request:    session.request,
+		ServerName: session.ServerName,
 	}
 
 	if err := entry.setSessionRequest(); err != nil {
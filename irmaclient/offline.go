@@ -0,0 +1,63 @@
+package irmaclient
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// OfflineHandler is a Handler that also receives the proof computed in an offline session.
+type OfflineHandler interface {
+	Handler
+	// OfflineProofReady is called with the proof computed in the session, before Success(). The
+	// proof is to be transferred to the verifier out of band, e.g. as QR codes using
+	// irma.OfflineProof.QRChunks(), or as bytes using irma.OfflineProof.MarshalBinary().
+	OfflineProofReady(proof *irma.OfflineProof)
+}
+
+// NewOfflineSession computes a disclosure or attribute-based signature for the specified
+// disclosure or signature request (e.g. scanned from the screen of the verifier) without any
+// network connection, like manual sessions started by NewSession(). The resulting proof is
+// passed to the OfflineProofReady() method of the handler.
+func (client *Client) NewOfflineSession(sessionrequest string, handler OfflineHandler) SessionDismisser {
+	bts := []byte(sessionrequest)
+
+	sigRequest := &irma.SignatureRequest{}
+	if err := irma.UnmarshalValidate(bts, sigRequest); err == nil {
+		return client.newManualSession(sigRequest, &offlineSessionHandler{handler, irma.ActionSigning}, irma.ActionSigning)
+	}
+
+	disclosureRequest := &irma.DisclosureRequest{}
+	if err := irma.UnmarshalValidate(bts, disclosureRequest); err == nil {
+		return client.newManualSession(disclosureRequest, &offlineSessionHandler{handler, irma.ActionDisclosing}, irma.ActionDisclosing)
+	}
+
+	handler.Failure(&irma.SessionError{Err: errors.New("Offline session request could not be parsed"), Info: sessionrequest})
+	return finishedSession{}
+}
+
+// offlineSessionHandler passes the result of a manual session as an irma.OfflineProof to the
+// OfflineHandler.
+type offlineSessionHandler struct {
+	OfflineHandler
+	action irma.Action
+}
+
+func (h *offlineSessionHandler) Success(result string) {
+	proof := &irma.OfflineProof{Type: h.action}
+	var err error
+	if h.action == irma.ActionSigning {
+		proof.Signature = &irma.SignedMessage{}
+		err = json.Unmarshal([]byte(result), proof.Signature)
+	} else {
+		proof.Disclosure = &irma.Disclosure{}
+		err = json.Unmarshal([]byte(result), proof.Disclosure)
+	}
+	if err != nil {
+		h.OfflineHandler.Failure(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return
+	}
+	h.OfflineHandler.OfflineProofReady(proof)
+	h.OfflineHandler.Success(result)
+}
@@ -0,0 +1,198 @@
+package irmaclient
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the profiles of the client: isolated identities, each having its own secret
+// key, credentials, keyshare server enrollments and logs, for example for separating work and
+// personal credentials, or for devices shared by multiple users. The default profile is kept in
+// the root of the storage, and each other profile in its own directory in profilesDir. The
+// preferences, the storage key (see storageencryption.go) and the schemes are shared by all
+// profiles. The profile in use is kept in profileFile, so that the client continues using it
+// when it is created again.
+
+// DefaultProfile is the name of the profile that the client uses if no other profile is selected.
+const DefaultProfile = "default"
+
+const (
+	profilesDir = "profiles"
+	profileFile = "profile"
+)
+
+var profileName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Profile returns the name of the profile in use.
+func (client *Client) Profile() string {
+	if client.storage.profile == "" {
+		return DefaultProfile
+	}
+	return client.storage.profile
+}
+
+// Profiles returns the names of all profiles, starting with DefaultProfile.
+func (client *Client) Profiles() ([]string, error) {
+	profiles, err := client.storage.profiles()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{DefaultProfile}, profiles...), nil
+}
+
+// profiles returns the sorted names of the profiles in profilesDir, i.e., excluding the default profile.
+func (s *storage) profiles() ([]string, error) {
+	profiles := []string{}
+	exists, err := fs.PathExists(s.rootPath(profilesDir))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		files, err := ioutil.ReadDir(s.rootPath(profilesDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() && profileName.MatchString(file.Name()) {
+				profiles = append(profiles, file.Name())
+			}
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// CreateProfile creates a new, empty profile. Use SwitchProfile() to start using it.
+func (client *Client) CreateProfile(name string) error {
+	if err := checkProfileName(name); err != nil {
+		return err
+	}
+	dir := client.storage.rootPath(profilesDir + "/" + name)
+	exists, err := fs.PathExists(dir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.Errorf("Profile %s already exists", name)
+	}
+	return fs.EnsureDirectoryExists(dir + "/" + signaturesDir)
+}
+
+// SwitchProfile starts using the specified profile, loading its secret key, credentials,
+// keyshare server enrollments and logs. It must not be called during sessions.
+func (client *Client) SwitchProfile(name string) error {
+	if name == DefaultProfile {
+		name = ""
+	} else if err := client.assertProfileExists(name); err != nil {
+		return err
+	}
+
+	previous := client.storage.profile
+	client.storage.profile = name
+	if err := client.loadProfile(); err != nil {
+		client.storage.profile = previous
+		if loadErr := client.loadProfile(); loadErr != nil {
+			irma.Logger.Warn("Failed to reload previous profile: ", loadErr.Error())
+		}
+		return err
+	}
+	if err := fs.SaveFile(client.storage.rootPath(profileFile), []byte(name)); err != nil {
+		return err
+	}
+	client.handler.UpdateAttributes()
+	return nil
+}
+
+// DeleteProfile removes the specified profile along with all of its credentials. The default
+// profile and the profile in use cannot be deleted. Note that the keyshare server accounts of
+// the profile are not removed from the keyshare servers.
+func (client *Client) DeleteProfile(name string) error {
+	if name == DefaultProfile {
+		return errors.New("The default profile cannot be deleted")
+	}
+	if name == client.storage.profile {
+		return errors.New("The profile in use cannot be deleted")
+	}
+	if err := client.assertProfileExists(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(client.storage.rootPath(profilesDir + "/" + name))
+}
+
+// loadProfile loads the contents of the profile in use, updating it first if necessary.
+func (client *Client) loadProfile() (err error) {
+	if err = fs.EnsureDirectoryExists(client.storage.path(signaturesDir)); err != nil {
+		return err
+	}
+	// Perform new update functions from clientUpdates, if any
+	if err = client.update(); err != nil {
+		return err
+	}
+	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+		return err
+	}
+	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
+		return err
+	}
+	if client.keyshareServers, err = client.storage.LoadKeyshareServers(); err != nil {
+		return err
+	}
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+	client.logs = nil
+
+	client.orphaned = map[string]struct{}{}
+	for _, info := range client.OrphanedCredentials() {
+		client.orphaned[info.Hash] = struct{}{}
+	}
+	return nil
+}
+
+// loadProfileName reads the name of the profile in use from storage, falling back to the default
+// profile if it no longer exists.
+func (s *storage) loadProfileName() error {
+	bts, err := ioutil.ReadFile(s.rootPath(profileFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSpace(string(bts))
+	if name == "" || checkProfileName(name) != nil {
+		return nil
+	}
+	exists, err := fs.PathExists(s.rootPath(profilesDir + "/" + name))
+	if err != nil || !exists {
+		return err
+	}
+	s.profile = name
+	return nil
+}
+
+func (client *Client) assertProfileExists(name string) error {
+	if err := checkProfileName(name); err != nil {
+		return err
+	}
+	exists, err := fs.PathExists(client.storage.rootPath(profilesDir + "/" + name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("Profile %s does not exist", name)
+	}
+	return nil
+}
+
+func checkProfileName(name string) error {
+	if name == DefaultProfile || !profileName.MatchString(name) {
+		return errors.Errorf("Invalid profile name '%s'", name)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package irmaclient
+
+// ProgressHandler can be implemented by a Handler to be informed of the progress of a session,
+// e.g. to show a progress bar instead of a spinner when many credentials are involved or the
+// network is slow.
+type ProgressHandler interface {
+	// ProofProgress reports that done of the total steps of computing the proofs of the session
+	// have been performed: one for each credential involved, and a final one in which the proofs
+	// of all credentials are completed.
+	ProofProgress(done, total int)
+	// UploadProgress reports that sent of the total bytes of a message to the server have been
+	// sent.
+	UploadProgress(sent, total int64)
+	// Retrying is called when a request to the server failed due to a transient network failure
+	// and is retried; attempt is the number of the retry, starting at 1.
+	Retrying(attempt int)
+}
+
+// proofProgress reports the progress of computing the proofs of a session to a ProgressHandler.
+// All of its methods may be called on nil, in which case they do nothing.
+type proofProgress struct {
+	handler     ProgressHandler
+	done, total int
+}
+
+// newProofProgress returns a proofProgress for the handler, which includes the final step of
+// completing the proofs, or nil if the handler does not implement ProgressHandler.
+func newProofProgress(handler Handler) *proofProgress {
+	if h, ok := handler.(ProgressHandler); ok {
+		return &proofProgress{handler: h, total: 1}
+	}
+	return nil
+}
+
+// add adds steps to the total. All steps must be added before the first step is performed.
+func (p *proofProgress) add(steps int) {
+	if p != nil {
+		p.total += steps
+	}
+}
+
+// step reports that a step has been performed.
+func (p *proofProgress) step() {
+	if p == nil || p.done >= p.total {
+		return
+	}
+	p.done++
+	p.handler.ProofProgress(p.done, p.total)
+}
@@ -0,0 +1,135 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the scheduler that reissues credentials before they expire, so that users do
+// not discover expired credentials only when they need to disclose them. Credential types may
+// declare a ReissueURL, at which the issuer serves a session pointer to an issuance session that
+// renews credentials of that type (typically asking first for the expiring credential to be
+// disclosed). Once started using Client.StartReissuance(), the scheduler periodically looks for
+// credentials of such credential types that expire soon, and offers each of them once to the
+// ReissueHandler, which may start the reissuance session right away or after asking the user.
+
+// ReissueHandler must be implemented by the ClientHandler to use Client.StartReissuance().
+type ReissueHandler interface {
+	// ReissueAvailable is called when the credential expires soon and can be reissued. Calling
+	// reissue fetches the session pointer from the ReissueURL of its credential type and starts
+	// the reissuance session, passing feedback to the specified Handler. If reissue is not called
+	// (e.g. because the user declined), the credential is not offered again until the reissuance
+	// is started again.
+	ReissueAvailable(credential *irma.CredentialInfo, reissue func(handler Handler))
+}
+
+// Interval at which the reissuance scheduler checks for credentials that expire soon
+var reissueInterval = time.Hour
+
+type reissueScheduler struct {
+	client  *Client
+	handler ReissueHandler
+	within  time.Duration
+	offered map[string]struct{} // hashes of the credentials offered to the handler
+	stop    chan struct{}
+}
+
+// StartReissuance starts checking for credentials that expire within the specified duration and
+// whose credential type has a ReissueURL, offering them to the ClientHandler, which must implement
+// ReissueHandler. It checks immediately, and then every hour, until StopReissuance() is called.
+func (client *Client) StartReissuance(within time.Duration) error {
+	handler, ok := client.handler.(ReissueHandler)
+	if !ok {
+		return errors.New("ClientHandler does not implement ReissueHandler")
+	}
+	if within <= 0 {
+		return errors.New("Reissuance period must be positive")
+	}
+	client.StopReissuance()
+	client.reissuance = &reissueScheduler{
+		client:  client,
+		handler: handler,
+		within:  within,
+		offered: map[string]struct{}{},
+		stop:    make(chan struct{}),
+	}
+	go client.reissuance.run()
+	return nil
+}
+
+// StopReissuance stops the reissuance scheduler started by StartReissuance(), if any.
+func (client *Client) StopReissuance() {
+	if client.reissuance != nil {
+		close(client.reissuance.stop)
+		client.reissuance = nil
+	}
+}
+
+func (s *reissueScheduler) run() {
+	ticker := time.NewTicker(reissueInterval)
+	defer ticker.Stop()
+	for {
+		s.check()
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *reissueScheduler) check() {
+	for _, info := range s.client.ExpiringCredentials(s.within) {
+		if _, offered := s.offered[info.Hash]; offered {
+			continue
+		}
+		credtype := info.GetCredentialType(s.client.Configuration)
+		if credtype == nil || credtype.ReissueURL == "" {
+			continue
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.offered[info.Hash] = struct{}{}
+		url := credtype.ReissueURL
+		s.handler.ReissueAvailable(info, func(handler Handler) {
+			s.client.reissue(url, handler)
+		})
+	}
+}
+
+// reissue starts the issuance session to which the session pointer served at the specified URL
+// refers. Like static QRs, the URL may also serve a pointer from which the session pointer is
+// obtained by POSTing to it.
+func (client *Client) reissue(url string, handler Handler) {
+	qr := &irma.Qr{}
+	if err := irma.NewHTTPTransport("").Get(url, qr); err != nil {
+		serr, ok := err.(*irma.SessionError)
+		if !ok {
+			serr = &irma.SessionError{ErrorType: irma.ErrorTransport, Err: err}
+		}
+		handler.Failure(serr)
+		return
+	}
+	if err := qr.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err, Info: url})
+		return
+	}
+	if qr.Type == irma.ActionRedirect {
+		client.newRedirectSession(qr, handler)
+		return
+	}
+	if qr.Type != irma.ActionIssuing {
+		handler.Failure(&irma.SessionError{
+			ErrorType: irma.ErrorServerResponse,
+			Err:       errors.Errorf("Reissuance URL returned %s session instead of issuance session", qr.Type),
+			Info:      url,
+		})
+		return
+	}
+	client.newQrSession(qr, handler)
+}
@@ -0,0 +1,144 @@
+package irmaclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the queue in which the client updates its schemes. When many schemes need
+// updating (e.g. when the app starts after a long period of inactivity), updating them all before
+// a session can start would keep the user waiting. Instead, Client.UpdateSchemes() enqueues the
+// schemes to be updated one by one in the background, throttled, while sessions take precedence:
+// the schemes that a session needs are updated first (by irma.Configuration.Download()), after which
+// the remaining schemes are updated.
+
+// SchemeUpdateHandler can be implemented by a ClientHandler to be informed of the progress of
+// scheme updates.
+type SchemeUpdateHandler interface {
+	// SchemeUpdateProgress reports the progress of downloading the files of a scheme.
+	SchemeUpdateProgress(progress irma.SchemeProgress)
+	// SchemeUpdateFinished is called when a scheme has been updated, in the background or
+	// because a session needed it, or when updating it failed.
+	SchemeUpdateFinished(scheme irma.SchemeManagerIdentifier, err error)
+}
+
+// Delay before each scheme update in the background, so that the schemes needed by sessions that
+// are started in the meantime are updated first
+var schemeUpdateDelay = time.Second
+
+type schemeUpdateQueue struct {
+	client   *Client
+	mutex    sync.Mutex // protects queue and running
+	updating sync.Mutex // held during each update, so that updates do not run concurrently
+	queue    []irma.SchemeManagerIdentifier
+	running  bool
+}
+
+// UpdateSchemes updates all schemes in the background, one at a time. Sessions started in the
+// meantime first update the schemes they need. If the ClientHandler implements
+// SchemeUpdateHandler, it is informed of the progress.
+func (client *Client) UpdateSchemes() {
+	var ids []irma.SchemeManagerIdentifier
+	for id, scheme := range client.Configuration.SchemeManagers {
+		if scheme.Parent.Empty() { // otherwise updated along with its parent
+			ids = append(ids, id)
+		}
+	}
+	client.schemeUpdates.enqueue(ids...)
+}
+
+func (q *schemeUpdateQueue) enqueue(ids ...irma.SchemeManagerIdentifier) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, id := range ids {
+		if !q.contains(id) {
+			q.queue = append(q.queue, id)
+		}
+	}
+	if !q.running && len(q.queue) > 0 {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *schemeUpdateQueue) contains(id irma.SchemeManagerIdentifier) bool {
+	for _, queued := range q.queue {
+		if queued == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *schemeUpdateQueue) remove(id irma.SchemeManagerIdentifier) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, queued := range q.queue {
+		if queued == id {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns the next scheme to update, or false if the queue is empty.
+func (q *schemeUpdateQueue) next() (irma.SchemeManagerIdentifier, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.queue) == 0 {
+		q.running = false
+		return irma.SchemeManagerIdentifier{}, false
+	}
+	id := q.queue[0]
+	q.queue = q.queue[1:]
+	return id, true
+}
+
+func (q *schemeUpdateQueue) run() {
+	for {
+		time.Sleep(schemeUpdateDelay)
+		id, ok := q.next()
+		if !ok {
+			return
+		}
+
+		q.updating.Lock()
+		var err error
+		if _, installed := q.client.Configuration.SchemeManagers[id]; installed {
+			irma.Logger.WithField("scheme", id).Info("Updating scheme in the background")
+			err = q.client.Configuration.UpdateScheme(id)
+		}
+		q.updating.Unlock()
+
+		if err != nil {
+			irma.Logger.WithField("scheme", id).Warn("Updating scheme failed: ", err.Error())
+		}
+		q.finished(id, err)
+	}
+}
+
+// prioritize runs download, which updates the schemes needed by a session, before any further
+// background updates, and removes the schemes that it updated from the queue.
+func (q *schemeUpdateQueue) prioritize(
+	download func() (*irma.IrmaIdentifierSet, error),
+) (*irma.IrmaIdentifierSet, error) {
+	q.updating.Lock()
+	downloaded, err := download()
+	q.updating.Unlock()
+
+	if downloaded != nil {
+		for id := range downloaded.SchemeManagers {
+			q.remove(id)
+			q.finished(id, nil)
+		}
+	}
+	return downloaded, err
+}
+
+func (q *schemeUpdateQueue) finished(id irma.SchemeManagerIdentifier, err error) {
+	if handler, ok := q.client.handler.(SchemeUpdateHandler); ok {
+		handler.SchemeUpdateFinished(id, err)
+	}
+}
@@ -1,12 +1,14 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
@@ -38,6 +40,10 @@ type Handler interface {
 	KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)
 	KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)
 
+	// UpdateRequired is called when the session involves a scheme requiring a newer version
+	// of irmago (see irma.SchemeManager.RequiresUpdate()), after which the session is aborted.
+	UpdateRequired(manager irma.SchemeManagerIdentifier, minimumVersion string)
+
 	RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback PermissionHandler)
 	RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback PermissionHandler)
 	RequestSignaturePermission(request irma.SignatureRequest, ServerName irma.TranslatedString, callback PermissionHandler)
@@ -46,9 +52,16 @@ type Handler interface {
 	RequestPin(remainingAttempts int, callback PinHandler)
 }
 
-// SessionDismisser can dismiss the current IRMA session.
+// SessionDismisser can dismiss the current IRMA session, e.g. when the user navigates away from
+// it or the app is sent to the background. Once dismissed, the Handler is informed by Cancelled(),
+// unless the session had already finished; of the Success(), Cancelled() and Failure() methods of
+// the Handler, exactly one is called for each session.
 type SessionDismisser interface {
 	Dismiss()
+	// DismissContext dismisses the session like Dismiss(), deleting it at the server (if any)
+	// within the lifetime of the context, and stopping any keyshare protocol in progress. The
+	// returned error concerns only the deletion at the server: the session is dismissed regardless.
+	DismissContext(ctx context.Context) error
 }
 
 type session struct {
@@ -61,12 +74,28 @@ type session struct {
 	attrIndices irma.DisclosedAttributeIndices
 	client      *Client
 	request     irma.SessionRequest
-	done        bool
+	step        irma.ProtocolStep
+
+	// Snapshot of the configuration of the client against which the session is performed, taken
+	// once the schemes involved in the session are up to date (see checkAndUpateConfiguration()),
+	// so that scheme updates during the session do not affect it
+	conf *irma.Configuration
+
+	// Whether one of the terminal Handler methods has been called, see finish()
+	done      bool
+	doneMutex sync.Mutex
+
+	// State machine, see sessionstate.go
+	state       SessionState
+	transitions []SessionTransition
+	stateMutex  sync.Mutex
 
 	// State for issuance protocol
 	issuerProofNonce *big.Int
 	builders         gabi.ProofBuilderList
 
+	progress *proofProgress
+
 	// These are empty on manual sessions
 	Hostname  string
 	ServerURL string
@@ -78,7 +107,7 @@ var _ keyshareSessionHandler = (*session)(nil)
 
 // Supported protocol versions. Minor version numbers should be reverse sorted.
 var supportedVersions = map[int][]int{
-	2: {4},
+	2: {4, 5, 6},
 }
 var minVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]}
 var maxVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]}
@@ -92,6 +121,9 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 
 	qr := &irma.Qr{}
 	if err := irma.UnmarshalValidate(bts, qr); err == nil {
+		if qr.Type == irma.ActionRedirect {
+			return client.newRedirectSession(qr, handler)
+		}
 		return client.newQrSession(qr, handler)
 	}
 
@@ -111,6 +143,15 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 	}
 
 	handler.Failure(&irma.SessionError{Err: errors.New("Session request could not be parsed"), Info: sessionrequest})
+	return finishedSession{}
+}
+
+// finishedSession is returned for sessions that failed before they started; dismissing it does nothing.
+type finishedSession struct{}
+
+func (finishedSession) Dismiss() {}
+
+func (finishedSession) DismissContext(ctx context.Context) error {
 	return nil
 }
 
@@ -122,6 +163,7 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		client:  client,
 		Version: minVersion,
 		request: request,
+		state:   SessionStateStarted,
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusManualStarted)
 
@@ -136,6 +178,7 @@ func (client *Client) newSchemeSession(qr *irma.SchemeManagerRequest, handler Ha
 		Action:    irma.ActionSchemeManager,
 		Handler:   handler,
 		client:    client,
+		state:     SessionStateStarted,
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
@@ -153,6 +196,7 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 		Action:    irma.Action(qr.Type),
 		Handler:   handler,
 		client:    client,
+		state:     SessionStateStarted,
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
@@ -168,11 +212,14 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 		fallthrough
 	default:
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(session.Action)})
-		return nil
+		return session
 	}
 
 	session.transport.SetHeader(irma.MinVersionHeader, minVersion.String())
 	session.transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
+	if h, ok := handler.(ProgressHandler); ok {
+		session.transport.SetProgressHandlers(h.UploadProgress, h.Retrying)
+	}
 	if !strings.HasSuffix(session.ServerURL, "/") {
 		session.ServerURL += "/"
 	}
@@ -181,6 +228,56 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 	return session
 }
 
+// redirectSession obtains a session pointer from the URL of a QR of type irma.ActionRedirect
+// (e.g. a static QR printed on a poster), after which it performs the session that it points to.
+type redirectSession struct {
+	sync.Mutex
+	session   SessionDismisser
+	dismissed bool
+}
+
+func (client *Client) newRedirectSession(qr *irma.Qr, handler Handler) SessionDismisser {
+	redirect := &redirectSession{}
+	handler.StatusUpdate(irma.ActionUnknown, irma.StatusCommunicating)
+
+	go func() {
+		newqr := &irma.Qr{}
+		err := irma.NewHTTPTransport(qr.URL).Post("", newqr, struct{}{})
+
+		redirect.Lock()
+		defer redirect.Unlock()
+		if redirect.dismissed {
+			handler.Cancelled()
+			return
+		}
+		if err != nil {
+			handler.Failure(err.(*irma.SessionError))
+			return
+		}
+		if err := newqr.Validate(); err != nil || newqr.Type == irma.ActionRedirect {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(newqr.Type)})
+			return
+		}
+		redirect.session = client.newQrSession(newqr, handler)
+	}()
+
+	return redirect
+}
+
+func (redirect *redirectSession) Dismiss() {
+	_ = redirect.DismissContext(context.Background())
+}
+
+func (redirect *redirectSession) DismissContext(ctx context.Context) error {
+	redirect.Lock()
+	defer redirect.Unlock()
+	redirect.dismissed = true
+	if redirect.session != nil {
+		return redirect.session.DismissContext(ctx)
+	}
+	return nil
+}
+
 // Core session methods
 
 // getSessionInfo retrieves the first message in the IRMA protocol (only in interactive sessions)
@@ -188,6 +285,7 @@ func (session *session) getSessionInfo() {
 	defer session.recoverFromPanic()
 
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+	session.step = irma.StepRequest
 
 	// Get the first IRMA protocol message and parse it
 	err := session.transport.Get("", session.request)
@@ -239,11 +337,11 @@ func (session *session) processSessionInfo() {
 		session.request.SetVersion(session.Version)
 	}
 
-	session.ServerName = serverName(session.Hostname, session.request, session.client.Configuration)
+	session.ServerName = serverName(session.Hostname, session.request, session.conf)
 
 	if session.Action == irma.ActionIssuing {
 		ir := session.request.(*irma.IssuanceRequest)
-		_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version)
+		_, err := ir.GetCredentialInfoList(session.conf, session.Version)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownCredentialType, Err: err})
 			return
@@ -259,8 +357,9 @@ func (session *session) processSessionInfo() {
 		}
 	}
 
-	candidates, missing := session.client.CheckSatisfiability(session.request.ToDisclose())
+	candidates, missing := session.client.checkSatisfiability(session.conf, session.request.ToDisclose())
 	if len(missing) > 0 {
+		session.transition(SessionStateHalted)
 		session.Handler.UnsatisfiableRequest(session.ServerName, missing)
 		return
 	}
@@ -272,6 +371,7 @@ func (session *session) processSessionInfo() {
 		session.request.SetDisclosureChoice(choice)
 		go session.doSession(proceed)
 	})
+	session.transition(SessionStateAwaitingPermission)
 	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
 	switch session.Action {
 	case irma.ActionDisclosing:
@@ -298,7 +398,12 @@ func (session *session) doSession(proceed bool) {
 		session.cancel()
 		return
 	}
+	if session.finished() {
+		return // dismissed while asking for permission
+	}
+	session.transition(SessionStateComputing)
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+	session.step = irma.StepProofs
 
 	if !session.Distributed() {
 		message, err := session.getProof()
@@ -312,13 +417,16 @@ func (session *session) doSession(proceed bool) {
 		session.builders, session.attrIndices, session.issuerProofNonce, err = session.getBuilders()
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return
 		}
+		session.transition(SessionStateKeyshare)
+		session.step = irma.StepKeyshare
 		startKeyshareSession(
 			session,
 			session.Handler,
 			session.builders,
 			session.request,
-			session.client.Configuration,
+			session.conf,
 			session.client.keyshareServers,
 			session.issuerProofNonce,
 		)
@@ -330,9 +438,15 @@ type disclosureResponse string
 // sendResponse sends the proofs of knowledge of the hidden attributes and/or the secret key, or the constructed
 // attribute-based signature, to the API server.
 func (session *session) sendResponse(message interface{}) {
-	var log *LogEntry
 	var err error
 	var messageJson []byte
+	var next *irma.Qr
+	if session.finished() {
+		return // dismissed while computing the proofs
+	}
+	session.progress.step() // completes the proofs if computed by the keyshare protocol
+	session.transition(SessionStateResponding)
+	session.step = irma.StepResponse
 
 	switch session.Action {
 	case irma.ActionSigning:
@@ -359,7 +473,6 @@ func (session *session) sendResponse(message interface{}) {
 				return
 			}
 		}
-		log, _ = session.createLogEntry(message) // TODO err
 	case irma.ActionDisclosing:
 		messageJson, err = json.Marshal(message)
 		if err != nil {
@@ -367,36 +480,87 @@ func (session *session) sendResponse(message interface{}) {
 			return
 		}
 		if session.IsInteractive() {
-			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, message); err != nil {
+			response := &irma.DisclosureResponse{}
+			if session.Version.Below(2, 6) {
+				err = session.transport.Post("proofs", &response.ProofStatus, message)
+			} else {
+				err = session.transport.Post("proofs", response, message)
+			}
+			if err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
-			if response != "VALID" {
-				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response)})
+			if response.ProofStatus != irma.ProofStatusValid {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response.ProofStatus)})
+				return
+			}
+			if next = response.NextSession; next != nil && next.Validate() != nil {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorServerResponse, Info: "invalid next session"})
 				return
 			}
 		}
-		log, _ = session.createLogEntry(message) // TODO err
 	case irma.ActionIssuing:
-		response := []*gabi.IssueSignatureMessage{}
-		if err = session.transport.Post("commitments", &response, message); err != nil {
+		response := &irma.IssuanceResponse{}
+		if session.Version.Below(2, 5) {
+			err = session.transport.Post("commitments", &response.Signatures, message)
+		} else {
+			err = session.transport.Post("commitments", response, message)
+		}
+		if err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
-		if err = session.client.ConstructCredentials(response, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
+		if err = session.updateIssuedCredentials(response.Credentials); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err})
+			return
+		}
+		if session.finished() {
+			return // dismissed while awaiting the signatures; don't store credentials the user cancelled
+		}
+		if err = session.client.constructCredentials(session.conf, response.Signatures, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 			return
 		}
-		log, _ = session.createLogEntry(message) // TODO err
 	}
 
-	_ = session.client.addLogEntry(log) // TODO err
+	if !session.finish() {
+		return // dismissed while sending the response
+	}
+	session.storeLogEntry(message)
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
-	session.done = true
+	session.transition(SessionStateSuccess)
 	session.Handler.Success(string(messageJson))
+
+	// Continue with the next session that the server started for us, if any
+	if next != nil {
+		session.client.newQrSession(next, session.Handler)
+	}
+}
+
+// updateIssuedCredentials replaces the credentials in the issuance request by those that the server
+// reports to have issued, if any, which may differ from the request in their attribute values
+// (see server.IssuanceCondition). The number and types of the credentials must be unchanged.
+func (session *session) updateIssuedCredentials(credentials []*irma.CredentialRequest) error {
+	if len(credentials) == 0 {
+		return nil
+	}
+	request := session.request.(*irma.IssuanceRequest)
+	if len(credentials) != len(request.Credentials) {
+		return errors.New("Server issued unexpected amount of credentials")
+	}
+	for i, cred := range credentials {
+		if cred.CredentialTypeID != request.Credentials[i].CredentialTypeID {
+			return errors.Errorf("Server issued %s instead of %s", cred.CredentialTypeID, request.Credentials[i].CredentialTypeID)
+		}
+		if err := cred.Validate(session.conf); err != nil {
+			return err
+		}
+	}
+	request.Credentials = credentials
+	request.CredentialInfoList = nil
+	return nil
 }
 
 // managerSession performs a "session" in which a new scheme manager is added (asking for permission first).
@@ -408,17 +572,31 @@ func (session *session) managerSession() {
 	// when asking installation permission.
 	manager, err := irma.DownloadSchemeManager(session.ServerURL)
 	if err != nil {
-		session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+		if session.finish() {
+			session.transition(SessionStateFailed)
+			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err, Step: irma.StepConfiguration})
+		}
 		return
 	}
 
+	session.transition(SessionStateAwaitingPermission)
 	session.Handler.RequestSchemeManagerPermission(manager, func(proceed bool) {
 		if !proceed {
-			session.Handler.Cancelled() // No need to DELETE session here
+			if session.finish() {
+				session.transition(SessionStateCancelled)
+				session.Handler.Cancelled() // No need to DELETE session here
+			}
 			return
 		}
+		if session.finished() {
+			return // dismissed while asking for permission
+		}
+		session.transition(SessionStateConfiguring)
 		if err := session.client.Configuration.InstallSchemeManager(manager, nil); err != nil {
-			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+			if session.finish() {
+				session.transition(SessionStateFailed)
+				session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err, Step: irma.StepConfiguration})
+			}
 			return
 		}
 
@@ -430,7 +608,10 @@ func (session *session) managerSession() {
 				CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{},
 			},
 		)
-		session.Handler.Success("")
+		if session.finish() {
+			session.transition(SessionStateSuccess)
+			session.Handler.Success("")
+		}
 	})
 	return
 }
@@ -445,13 +626,14 @@ func (session *session) getBuilders() (gabi.ProofBuilderList, irma.DisclosedAttr
 	var issuerProofNonce *big.Int
 	var choices irma.DisclosedAttributeIndices
 
+	session.progress = newProofProgress(session.Handler)
 	switch session.Action {
 	case irma.ActionSigning:
-		builders, choices, err = session.client.ProofBuilders(session.choice, session.request, true)
+		builders, choices, err = session.client.proofBuilders(session.conf, session.choice, session.request, true, session.progress)
 	case irma.ActionDisclosing:
-		builders, choices, err = session.client.ProofBuilders(session.choice, session.request, false)
+		builders, choices, err = session.client.proofBuilders(session.conf, session.choice, session.request, false, session.progress)
 	case irma.ActionIssuing:
-		builders, choices, issuerProofNonce, err = session.client.IssuanceProofBuilders(session.request.(*irma.IssuanceRequest))
+		builders, choices, issuerProofNonce, err = session.client.issuanceProofBuilders(session.conf, session.request.(*irma.IssuanceRequest), session.progress)
 	}
 
 	return builders, choices, issuerProofNonce, err
@@ -463,13 +645,14 @@ func (session *session) getProof() (interface{}, error) {
 	var message interface{}
 	var err error
 
+	session.progress = newProofProgress(session.Handler)
 	switch session.Action {
 	case irma.ActionSigning:
-		message, err = session.client.Proofs(session.choice, session.request, true)
+		message, err = session.client.proofs(session.conf, session.choice, session.request, true, session.progress)
 	case irma.ActionDisclosing:
-		message, err = session.client.Proofs(session.choice, session.request, false)
+		message, err = session.client.proofs(session.conf, session.choice, session.request, false, session.progress)
 	case irma.ActionIssuing:
-		message, session.builders, err = session.client.IssueCommitments(session.request.(*irma.IssuanceRequest))
+		message, session.builders, err = session.client.issueCommitments(session.conf, session.request.(*irma.IssuanceRequest), session.progress)
 	}
 
 	return message, err
@@ -481,14 +664,15 @@ func (session *session) getProof() (interface{}, error) {
 // and aborts the session if not
 func (session *session) checkKeyshareEnrollment() bool {
 	for id := range session.request.Identifiers().SchemeManagers {
-		manager, ok := session.client.Configuration.SchemeManagers[id]
+		manager, ok := session.conf.SchemeManagers[id]
 		if !ok {
-			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
 			return false
 		}
 		distributed := manager.Distributed()
 		_, enrolled := session.client.keyshareServers[id]
 		if distributed && !enrolled {
+			session.transition(SessionStateHalted)
 			session.Handler.KeyshareEnrollmentMissing(id)
 			return false
 		}
@@ -497,8 +681,11 @@ func (session *session) checkKeyshareEnrollment() bool {
 }
 
 func (session *session) checkAndUpateConfiguration() bool {
+	session.transition(SessionStateConfiguring)
+	session.step = irma.StepConfiguration
+	session.conf = session.client.Configuration.Snapshot()
 	for id := range session.request.Identifiers().SchemeManagers {
-		manager, contains := session.client.Configuration.SchemeManagers[id]
+		manager, contains := session.conf.SchemeManagers[id]
 		if !contains {
 			session.fail(&irma.SessionError{
 				ErrorType: irma.ErrorUnknownSchemeManager,
@@ -513,6 +700,13 @@ func (session *session) checkAndUpateConfiguration() bool {
 			})
 			return false
 		}
+		if manager.RequiresUpdate() {
+			if session.delete() {
+				session.transition(SessionStateCancelled)
+				session.Handler.UpdateRequired(id, manager.MinimumAppVersion.Irmago)
+			}
+			return false
+		}
 	}
 
 	// Check if we are enrolled into all involved keyshare servers
@@ -520,8 +714,11 @@ func (session *session) checkAndUpateConfiguration() bool {
 		return false
 	}
 
-	// Download missing credential types/issuers/public keys from the scheme manager
-	downloaded, err := session.client.Configuration.Download(session.request)
+	// Download missing credential types/issuers/public keys from the scheme manager, before any
+	// pending background scheme updates
+	downloaded, err := session.client.schemeUpdates.prioritize(func() (*irma.IrmaIdentifierSet, error) {
+		return session.client.Configuration.Download(session.request)
+	})
 	if err != nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 		return false
@@ -529,6 +726,7 @@ func (session *session) checkAndUpateConfiguration() bool {
 	if downloaded != nil && !downloaded.Empty() {
 		session.client.handler.UpdateConfiguration(downloaded)
 	}
+	session.conf = session.client.Configuration.Snapshot()
 	return true
 }
 
@@ -543,7 +741,7 @@ func (session *session) Distributed() bool {
 	if session.Action == irma.ActionIssuing {
 		for _, credreq := range session.request.(*irma.IssuanceRequest).Credentials {
 			smi = credreq.CredentialTypeID.IssuerIdentifier().SchemeManagerIdentifier()
-			if session.client.Configuration.SchemeManagers[smi].Distributed() {
+			if session.conf.SchemeManagers[smi].Distributed() {
 				return true
 			}
 		}
@@ -555,7 +753,7 @@ func (session *session) Distributed() bool {
 
 	for _, ai := range session.choice.Attributes {
 		smi = ai.Type.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
-		if session.client.Configuration.SchemeManagers[smi].Distributed() {
+		if session.conf.SchemeManagers[smi].Distributed() {
 			return true
 		}
 	}
@@ -567,7 +765,8 @@ func (session *session) Distributed() bool {
 
 func (session *session) recoverFromPanic() {
 	if e := recover(); e != nil {
-		if session.Handler != nil {
+		if session.Handler != nil && session.finish() {
+			session.transition(SessionStateFailed)
 			session.Handler.Failure(panicToError(e))
 		}
 	}
@@ -588,35 +787,70 @@ func panicToError(e interface{}) *irma.SessionError {
 	return &irma.SessionError{ErrorType: irma.ErrorPanic, Info: info + "\n\n" + string(debug.Stack())}
 }
 
+// finish marks the session as finished, returning whether it was not finished already. Only the
+// caller for which it returns true may call the terminal Handler method (Success, Cancelled or
+// Failure), so that exactly one of them is called even if the session is dismissed concurrently.
+func (session *session) finish() bool {
+	session.doneMutex.Lock()
+	defer session.doneMutex.Unlock()
+	if session.done {
+		return false
+	}
+	session.done = true
+	return true
+}
+
+// finished returns whether the session has finished (or is finishing).
+func (session *session) finished() bool {
+	session.doneMutex.Lock()
+	defer session.doneMutex.Unlock()
+	return session.done
+}
+
 // Idempotently send DELETE to remote server, returning whether or not we did something
 func (session *session) delete() bool {
-	if !session.done {
-		if session.IsInteractive() {
-			session.transport.Delete()
-		}
-		session.done = true
-		return true
+	deleted, _ := session.deleteContext(context.Background())
+	return deleted
+}
+
+func (session *session) deleteContext(ctx context.Context) (bool, error) {
+	if !session.finish() {
+		return false, nil
 	}
-	return false
+	if session.IsInteractive() {
+		return true, session.transport.DeleteContext(ctx)
+	}
+	return true, nil
 }
 
 func (session *session) fail(err *irma.SessionError) {
 	if session.delete() {
 		err.Err = errors.Wrap(err.Err, 0)
+		if err.Step == "" {
+			err.Step = session.step
+		}
+		session.transition(SessionStateFailed)
 		session.Handler.Failure(err)
 	}
 }
 
 func (session *session) cancel() {
-	if session.delete() {
-		session.Handler.Cancelled()
-	}
+	_ = session.DismissContext(context.Background())
 }
 
 func (session *session) Dismiss() {
 	session.cancel()
 }
 
+func (session *session) DismissContext(ctx context.Context) error {
+	deleted, err := session.deleteContext(ctx)
+	if deleted {
+		session.transition(SessionStateCancelled)
+		session.Handler.Cancelled()
+	}
+	return err
+}
+
 // Keyshare session handler methods
 
 func (session *session) KeyshareDone(message interface{}) {
@@ -640,15 +874,22 @@ func (session *session) KeyshareCancelled() {
 	session.cancel()
 }
 
+func (session *session) KeyshareAborted() bool {
+	return session.finished()
+}
+
 func (session *session) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	session.transition(SessionStateHalted)
 	session.Handler.KeyshareEnrollmentIncomplete(manager)
 }
 
 func (session *session) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	session.transition(SessionStateHalted)
 	session.Handler.KeyshareEnrollmentDeleted(manager)
 }
 
 func (session *session) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	session.transition(SessionStateHalted)
 	session.Handler.KeyshareBlocked(manager, duration)
 }
 
@@ -664,9 +905,11 @@ func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err
 }
 
 func (session *session) KeysharePin() {
+	session.transition(SessionStateAwaitingPin)
 	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
 }
 
 func (session *session) KeysharePinOK() {
+	session.transition(SessionStateKeyshare)
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 }
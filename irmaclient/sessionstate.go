@@ -0,0 +1,162 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the state machine of IRMA sessions. Each session is at any time in one of the
+// SessionStates below, and moves between them only along the transitions listed in
+// sessionTransitions. Embedders can inspect the state of a session through the SessionLifecycle
+// interface, and can be informed of each transition by implementing SessionStateHandler in their
+// Handler, so that they need not rely on the order in which the other Handler methods are called.
+
+// SessionState is a state in the lifecycle of an IRMA session.
+type SessionState string
+
+const (
+	// SessionStateStarted: the session was created, and (for interactive sessions)
+	// the session request is being retrieved from the server.
+	SessionStateStarted = SessionState("STARTED")
+	// SessionStateConfiguring: the schemes involved in the session are being checked and updated,
+	// or (in scheme sessions) the scheme is being installed.
+	SessionStateConfiguring = SessionState("CONFIGURING")
+	// SessionStateAwaitingPermission: the Handler has been asked for permission to perform the session.
+	SessionStateAwaitingPermission = SessionState("AWAITING_PERMISSION")
+	// SessionStateComputing: the proofs or issuance commitments are being computed.
+	SessionStateComputing = SessionState("COMPUTING")
+	// SessionStateKeyshare: the keyshare protocol is being performed with the keyshare server(s).
+	SessionStateKeyshare = SessionState("KEYSHARE")
+	// SessionStateAwaitingPin: the Handler has been asked for the PIN of the keyshare server.
+	SessionStateAwaitingPin = SessionState("AWAITING_PIN")
+	// SessionStateResponding: the response is being sent to the server, or (in case of issuance)
+	// the received credentials are being constructed.
+	SessionStateResponding = SessionState("RESPONDING")
+	// SessionStateHalted: the session cannot continue, because the request is unsatisfiable, or the
+	// keyshare enrollment is missing, incomplete or blocked; the corresponding Handler method has
+	// been called. The session remains halted until it is dismissed.
+	SessionStateHalted = SessionState("HALTED")
+
+	// SessionStateSuccess: the session completed successfully (final).
+	SessionStateSuccess = SessionState("SUCCESS")
+	// SessionStateCancelled: the session was cancelled by the user or the keyshare server, or was
+	// aborted because an update of irmago is required (final).
+	SessionStateCancelled = SessionState("CANCELLED")
+	// SessionStateFailed: the session failed (final).
+	SessionStateFailed = SessionState("FAILED")
+)
+
+// sessionTransitions contains the states that can be reached from each nonfinal state.
+// Any state may move to SessionStateFailed, e.g. after a panic.
+var sessionTransitions = map[SessionState][]SessionState{
+	SessionStateStarted: {
+		SessionStateConfiguring, SessionStateAwaitingPermission, SessionStateCancelled,
+	},
+	SessionStateConfiguring: {
+		SessionStateAwaitingPermission, SessionStateHalted, SessionStateSuccess, SessionStateCancelled,
+	},
+	SessionStateAwaitingPermission: {
+		SessionStateComputing, SessionStateConfiguring, SessionStateCancelled,
+	},
+	SessionStateComputing: {
+		SessionStateKeyshare, SessionStateResponding, SessionStateCancelled,
+	},
+	SessionStateKeyshare: {
+		SessionStateAwaitingPin, SessionStateResponding, SessionStateHalted, SessionStateCancelled,
+	},
+	SessionStateAwaitingPin: {
+		SessionStateKeyshare, SessionStateHalted, SessionStateCancelled,
+	},
+	SessionStateResponding: {
+		SessionStateSuccess, SessionStateCancelled,
+	},
+	SessionStateHalted: {
+		SessionStateCancelled,
+	},
+}
+
+// SessionTransition records the move of a session from one state to another.
+type SessionTransition struct {
+	Action irma.Action
+	From   SessionState
+	To     SessionState
+	Time   time.Time
+}
+
+// SessionLifecycle allows inspecting the state of a session. The SessionDismisser returned when
+// starting a session implements it.
+type SessionLifecycle interface {
+	SessionDismisser
+	// State returns the current state of the session.
+	State() SessionState
+	// Transitions returns the transitions the session has made so far, in order.
+	Transitions() []SessionTransition
+}
+
+// SessionStateHandler can be implemented by a Handler to be informed of each state transition of
+// its session. StateChanged is called before the Handler method associated to the new state, if any.
+type SessionStateHandler interface {
+	StateChanged(transition SessionTransition)
+}
+
+// Final returns whether the session can no longer change state.
+func (state SessionState) Final() bool {
+	return state == SessionStateSuccess || state == SessionStateCancelled || state == SessionStateFailed
+}
+
+// AllowedTransitions returns the states that a session in the specified state can move to.
+func AllowedTransitions(state SessionState) []SessionState {
+	if state.Final() {
+		return nil
+	}
+	return append(append([]SessionState{}, sessionTransitions[state]...), SessionStateFailed)
+}
+
+func (state SessionState) allows(to SessionState) bool {
+	for _, s := range AllowedTransitions(state) {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+var _ SessionLifecycle = (*session)(nil)
+
+func (session *session) State() SessionState {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	return session.state
+}
+
+func (session *session) Transitions() []SessionTransition {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	return append([]SessionTransition{}, session.transitions...)
+}
+
+// transition moves the session to the specified state, informing the Handler if it implements
+// SessionStateHandler. Transitions not allowed by the state machine are ignored, and transitions
+// to the current state do nothing.
+func (session *session) transition(to SessionState) {
+	session.stateMutex.Lock()
+	from := session.state
+	if from == to {
+		session.stateMutex.Unlock()
+		return
+	}
+	if !from.allows(to) {
+		session.stateMutex.Unlock()
+		irma.Logger.Warnf("Ignoring invalid session state transition from %s to %s", from, to)
+		return
+	}
+	t := SessionTransition{Action: session.Action, From: from, To: to, Time: time.Now()}
+	session.state = to
+	session.transitions = append(session.transitions, t)
+	session.stateMutex.Unlock()
+
+	if handler, ok := session.Handler.(SessionStateHandler); ok {
+		handler.StateChanged(t)
+	}
+}
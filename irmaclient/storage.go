@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -17,6 +18,12 @@ import (
 type storage struct {
 	storagePath   string
 	Configuration *irma.Configuration
+
+	// If set, files are encrypted using this cipher and key (see storageencryption.go)
+	aead cipher.AEAD
+	key  []byte
+	// Profile in use, empty for the default profile (see profiles.go)
+	profile string
 }
 
 // Filenames in which we store stuff
@@ -26,11 +33,26 @@ const (
 	kssFile         = "kss"
 	updatesFile     = "updates"
 	logsFile        = "logs"
+	logsHeadFile    = "logshead"
 	preferencesFile = "preferences"
 	signaturesDir   = "sigs"
 )
 
+// path returns the path of the specified file of the profile in use. The preferences are shared
+// by all profiles.
 func (s *storage) path(p string) string {
+	return s.profilePath(s.profile, p)
+}
+
+// profilePath returns the path of the specified file of the specified profile.
+func (s *storage) profilePath(profile, p string) string {
+	if profile == "" || p == preferencesFile {
+		return s.rootPath(p)
+	}
+	return s.rootPath(profilesDir + "/" + profile + "/" + p)
+}
+
+func (s *storage) rootPath(p string) string {
 	return s.storagePath + "/" + p
 }
 
@@ -55,6 +77,9 @@ func (s *storage) load(dest interface{}, path string) (err error) {
 	if err != nil {
 		return
 	}
+	if bytes, err = s.decrypt(bytes, path); err != nil {
+		return
+	}
 	return json.Unmarshal(bytes, dest)
 }
 
@@ -63,6 +88,9 @@ func (s *storage) store(contents interface{}, file string) error {
 	if err != nil {
 		return err
 	}
+	if bts, err = s.encrypt(bts, file); err != nil {
+		return err
+	}
 	return fs.SaveFile(s.path(file), bts)
 }
 
@@ -102,8 +130,13 @@ func (s *storage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIde
 	return s.store(keyshareServers, kssFile)
 }
 
+// StoreLogs stores the log entries, which must be hash chained (see LogEntry.chain()),
+// along with the head of the hash chain.
 func (s *storage) StoreLogs(logs []*LogEntry) error {
-	return s.store(logs, logsFile)
+	if err := s.store(logs, logsFile); err != nil {
+		return err
+	}
+	return s.store(newLogsHead(logs), logsHeadFile)
 }
 
 func (s *storage) StorePreferences(prefs Preferences) error {
@@ -187,6 +220,14 @@ func (s *storage) LoadLogs() (logs []*LogEntry, err error) {
 	return logs, nil
 }
 
+func (s *storage) LoadLogsHead() (head *logsHead, err error) {
+	head = &logsHead{}
+	if err := s.load(head, logsHeadFile); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
 func (s *storage) LoadUpdates() (updates []update, err error) {
 	updates = []update{}
 	if err := s.load(&updates, updatesFile); err != nil {
@@ -0,0 +1,282 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"golang.org/x/crypto/argon2"
+)
+
+// This file contains the encryption of the storage of the client. If the ClientHandler implements
+// StorageSecretHandler, all files in storage are encrypted using AES-GCM with a random storage
+// key. The storage key is itself stored in storageKeyFile, encrypted using a key derived using
+// Argon2 from the secret provided by the handler: a key from the keystore of the platform, or the
+// PIN of the user. The storage secret can thus be changed (see Client.ChangeStorageSecret())
+// without encrypting all files again. Existing unencrypted storage is encrypted when the client
+// is created; once that has completed, unencrypted files are refused. An encrypted file consists
+// of storageEncryptionHeader, the AES-GCM nonce, and the ciphertext; its file name is authenticated
+// along with it, so that files cannot be swapped.
+
+// StorageSecretHandler can be implemented by a ClientHandler to have the storage of the client
+// encrypted.
+type StorageSecretHandler interface {
+	// StorageSecret returns the secret from which the key protecting the storage is derived,
+	// e.g. a key kept in the keystore of the platform, or the PIN of the user. It is called
+	// once, when the client is created.
+	StorageSecret() ([]byte, error)
+}
+
+const (
+	storageKeyFile          = "storagekey"
+	storageEncryptionHeader = "irma-encrypted-storage-v1\n"
+)
+
+const (
+	storageKeyLength     = 32
+	storageSaltLength    = 16
+	storageArgon2Time    = 1
+	storageArgon2Memory  = 64 * 1024
+	storageArgon2Threads = 4
+)
+
+// storageKey is the contents of storageKeyFile.
+type storageKey struct {
+	Salt []byte
+	// The storage key, encrypted using the key derived from the storage secret
+	Key []byte
+	// Whether all existing files have been encrypted using the storage key; authenticated along
+	// with the encrypted key (see storageKeyData())
+	Complete bool
+}
+
+// storageKeyData returns the additional data that is authenticated along with the encrypted
+// storage key, so that the Complete flag of storageKey cannot be reset to have unencrypted files
+// accepted.
+func storageKeyData(complete bool) []byte {
+	if complete {
+		return []byte(storageKeyFile + ":complete")
+	}
+	return []byte(storageKeyFile)
+}
+
+func newStorageCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretCipher returns the cipher with which the storage key is encrypted using the secret.
+func secretCipher(secret, salt []byte) (cipher.AEAD, error) {
+	return newStorageCipher(argon2.IDKey(secret, salt,
+		storageArgon2Time, storageArgon2Memory, storageArgon2Threads, storageKeyLength))
+}
+
+// storageEncrypted returns whether the specified file contents are encrypted.
+func storageEncrypted(bts []byte) bool {
+	return bytes.HasPrefix(bts, []byte(storageEncryptionHeader))
+}
+
+// unlock enables the encryption of the storage, reading the storage key using the secret or
+// generating it if the storage is not yet encrypted, and encrypts any unencrypted files.
+func (s *storage) unlock(secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("Storage secret must not be empty")
+	}
+	exists, err := fs.PathExists(s.rootPath(storageKeyFile))
+	if err != nil {
+		return err
+	}
+
+	var (
+		key      []byte
+		complete bool
+	)
+	if exists {
+		bts, err := ioutil.ReadFile(s.rootPath(storageKeyFile))
+		if err != nil {
+			return err
+		}
+		var sk storageKey
+		if err = json.Unmarshal(bts, &sk); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse storage key", 0)
+		}
+		aead, err := secretCipher(secret, sk.Salt)
+		if err != nil {
+			return err
+		}
+		if len(sk.Key) < aead.NonceSize() {
+			return errors.New("Storage key too short")
+		}
+		key, err = aead.Open(nil, sk.Key[:aead.NonceSize()], sk.Key[aead.NonceSize():], storageKeyData(sk.Complete))
+		if err != nil {
+			return errors.New("Wrong storage secret or corrupted storage key")
+		}
+		complete = sk.Complete
+	} else {
+		key = make([]byte, storageKeyLength)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+		if err = s.storeKey(key, secret, false); err != nil {
+			return err
+		}
+	}
+
+	if s.aead, err = newStorageCipher(key); err != nil {
+		return err
+	}
+	s.key = key
+	if complete {
+		return nil
+	}
+	// Encrypt the existing files, resuming if this was interrupted before
+	if err = s.encryptAll(); err != nil {
+		return err
+	}
+	return s.storeKey(key, secret, true)
+}
+
+// storeKey stores the storage key, encrypted using the secret, along with whether all existing
+// files have been encrypted.
+func (s *storage) storeKey(key, secret []byte, complete bool) error {
+	salt := make([]byte, storageSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := secretCipher(secret, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	bts, err := json.Marshal(storageKey{
+		Salt:     salt,
+		Key:      aead.Seal(nonce, nonce, key, storageKeyData(complete)),
+		Complete: complete,
+	})
+	if err != nil {
+		return err
+	}
+	return fs.SaveFile(s.rootPath(storageKeyFile), bts)
+}
+
+// encrypt encrypts the contents of the specified file, if encryption is enabled.
+func (s *storage) encrypt(bts []byte, file string) ([]byte, error) {
+	if s.aead == nil {
+		return bts, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append([]byte(storageEncryptionHeader), nonce...)
+	return s.aead.Seal(header, nonce, bts, []byte(file)), nil
+}
+
+// decrypt decrypts the contents of the specified file. Once the storage is encrypted, all files
+// are encrypted (see encryptAll()), so then unencrypted files are refused.
+func (s *storage) decrypt(bts []byte, file string) ([]byte, error) {
+	if !storageEncrypted(bts) {
+		if s.aead != nil {
+			return nil, errors.Errorf("File %s is not encrypted, but the storage is", file)
+		}
+		return bts, nil
+	}
+	if s.aead == nil {
+		return nil, errors.Errorf("File %s is encrypted, but no storage secret is available", file)
+	}
+	bts = bts[len(storageEncryptionHeader):]
+	if len(bts) < s.aead.NonceSize() {
+		return nil, errors.Errorf("Encrypted file %s too short", file)
+	}
+	plaintext, err := s.aead.Open(nil, bts[:s.aead.NonceSize()], bts[s.aead.NonceSize():], []byte(file))
+	if err != nil {
+		return nil, errors.Errorf("Failed to decrypt file %s", file)
+	}
+	return plaintext, nil
+}
+
+// encryptAll encrypts the files in storage of all profiles that are not yet encrypted.
+func (s *storage) encryptAll() error {
+	profiles, err := s.profiles()
+	if err != nil {
+		return err
+	}
+	for _, profile := range append([]string{""}, profiles...) {
+		if err = s.encryptProfile(profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptProfile encrypts the files of the specified profile that are not yet encrypted.
+func (s *storage) encryptProfile(profile string) error {
+	// The legacy config file is read by the client updates (see updates.go)
+	files := []string{skFile, attributesFile, kssFile, updatesFile, logsFile, logsHeadFile, preferencesFile, "config"}
+	exists, err := fs.PathExists(s.profilePath(profile, signaturesDir))
+	if err != nil {
+		return err
+	}
+	if exists {
+		sigs, err := ioutil.ReadDir(s.profilePath(profile, signaturesDir))
+		if err != nil {
+			return err
+		}
+		for _, sig := range sigs {
+			files = append(files, signaturesDir+"/"+sig.Name())
+		}
+	}
+
+	for _, file := range files {
+		path := s.profilePath(profile, file)
+		exists, err := fs.PathExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if storageEncrypted(bts) {
+			continue
+		}
+		if bts, err = s.encrypt(bts, file); err != nil {
+			return err
+		}
+		if err = fs.SaveFile(path, bts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangeStorageSecret replaces the secret from which the key protecting the storage is derived,
+// for example when the user changes the PIN. The storage must be encrypted.
+func (client *Client) ChangeStorageSecret(secret []byte) error {
+	if client.storage.aead == nil {
+		return errors.New("Storage is not encrypted")
+	}
+	if len(secret) == 0 {
+		return errors.New("Storage secret must not be empty")
+	}
+	return client.storage.storeKey(client.storage.key, secret, true)
+}
+
+// StorageEncrypted returns whether the storage of the client is encrypted.
+func (client *Client) StorageEncrypted() bool {
+	return client.storage.aead != nil
+}
@@ -68,6 +68,22 @@ var clientUpdates = []func(client *Client) error{
 	func(client *Client) (err error) {
 		return client.storage.StoreLogs([]*LogEntry{})
 	},
+
+	// 7: Hash chain the existing log entries
+	func(client *Client) (err error) {
+		logs, err := client.storage.LoadLogs()
+		if err != nil {
+			return
+		}
+		var previous []byte
+		for _, entry := range logs {
+			if err = entry.chain(previous); err != nil {
+				return
+			}
+			previous = entry.Hash
+		}
+		return client.storage.StoreLogs(logs)
+	},
 }
 
 // update performs any function from clientUpdates that has not
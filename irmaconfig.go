@@ -2,14 +2,13 @@ package irma
 
 import (
 	"crypto/rsa"
-	"encoding/base64"
 	"encoding/xml"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"crypto/sha256"
@@ -26,20 +25,21 @@ import (
 
 	"crypto/ecdsa"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
-	gobig "math/big"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
-	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
-	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
 // Configuration keeps track of scheme managers, issuers, credential types and public keys,
 // dezerializing them from an irma_configuration folder, and downloads and saves new ones on demand.
+//
+// The methods of Configuration that return public and private keys may be called concurrently
+// with ParseFolder() and scheme updates (e.g. by AutoUpdateSchemes()), which replace the maps
+// below by new ones instead of modifying them. The maps themselves however should not be read
+// directly while the Configuration may be reparsed or updated; use Snapshot() instead.
 type Configuration struct {
 	SchemeManagers  map[SchemeManagerIdentifier]*SchemeManager
 	Issuers         map[IssuerIdentifier]*Issuer
@@ -55,15 +55,69 @@ type Configuration struct {
 
 	Warnings []string
 
+	// Environments restricts the environments of the schemes that may be installed and used in
+	// sessions. If empty, schemes of all environments are allowed.
+	Environments []SchemeEnvironment
+
+	// MaxSchemeAge, if nonzero, is the age after which schemes are stale if their freshness is not
+	// asserted again (see SchemeStale()).
+	MaxSchemeAge time.Duration
+
+	// ProgressHandler, if set, receives the progress of downloading files during scheme
+	// installations and updates. It may be called from other goroutines, e.g. by the Updater.
+	ProgressHandler SchemeProgressHandler
+
+	// RemovalHandler, if set, receives the identifiers of the issuers and credential types that
+	// were removed from their scheme, after they have been removed from the Configuration during
+	// a scheme update. It may be called from other goroutines, e.g. by the Updater.
+	RemovalHandler func(removed *IrmaIdentifierSet)
+
+	// UpdateHandler, if set, receives the identifiers of the schemes, issuers and credential types
+	// that were updated by UpdateSchemes(), after the Configuration has been reparsed. It may be
+	// called from other goroutines, e.g. by the Updater.
+	UpdateHandler func(updated *IrmaIdentifierSet)
+
+	// KeyExpiryBoundary is the period before the expiry of the latest public key of an issuer
+	// during which CheckKeys() warns about the key, and a KeyExpiryWatcher reports it as expiring.
+	// If zero, DefaultKeyExpiryBoundary is used.
+	KeyExpiryBoundary time.Duration
+
+	// UpdateOnCredentialTypeError, if set and schemes are automatically updated (see
+	// AutoUpdateSchemes()), makes verification of a proof of an unknown credential type, or of a
+	// credential type not matching the proof (see CredentialTypeError), expedite the update of the
+	// scheme of the credential type, or of all schemes if the credential type is unknown.
+	UpdateOnCredentialTypeError bool
+
+	// ExpiryGracePeriod is the period after the expiry date of a credential during which its
+	// disclosure proofs are still accepted as unexpired, e.g. to allow for clock skew.
+	ExpiryGracePeriod time.Duration
+
+	validation    []*ValidationEntry
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
+	kssJWKS       map[SchemeManagerIdentifier]*JWKS
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
-	privateKeys   map[IssuerIdentifier]*gabi.PrivateKey
-	reverseHashes map[string]CredentialTypeIdentifier
+	privateKeys   map[IssuerIdentifier]map[int]*gabi.PrivateKey
+	reverseHashes map[string]CredentialTypeIdentifier // keyed by the raw credential type hash
 	initialized   bool
 	assets        string
 	readOnly      bool
-	cronchan      chan bool
-	scheduler     *gocron.Scheduler
+	dryRun        *dryRunLog
+	updater       *Updater
+	offline       bool
+	httpCache     *HTTPCache
+	mirrors       *mirrorHealth
+	transports    *schemeTransports
+	fileHashes    *fileHashes
+	trackedKeys   *privateKeyTracker
+	auditLog      *AuditLog
+
+	// Passphrase of encrypted private keys, see UnlockPrivateKeys()
+	privateKeyPassphrase string
+
+	// Protects against Snapshot() observing the maps above halfway being swapped by ParseFolder(),
+	// and protects the public and private keys, which are lazily parsed into the maps above.
+	// It is a pointer so that copies of the Configuration (see Snapshot()) get their own lock.
+	mutex *sync.RWMutex
 }
 
 // ConfigurationFileHash encodes the SHA256 hash of an authenticated
@@ -101,39 +155,44 @@ func (sme SchemeManagerError) Error() string {
 // NewConfiguration returns a new configuration. After this
 // ParseFolder() should be called to parse the specified path.
 func NewConfiguration(path string) (*Configuration, error) {
-	return newConfiguration(path, "")
+	return newConfiguration(path, "", false)
 }
 
 // NewConfigurationReadOnly returns a new configuration whose representation on disk
 // is never altered. ParseFolder() should be called to parse the specified path.
 func NewConfigurationReadOnly(path string) (*Configuration, error) {
-	conf, err := newConfiguration(path, "")
-	if err != nil {
-		return nil, err
-	}
-	conf.readOnly = true
-	return conf, nil
+	return newConfiguration(path, "", true)
 }
 
 // NewConfigurationFromAssets returns a new configuration, copying the schemes out of the assets folder to path.
 // ParseFolder() should be called to parse the specified path.
 func NewConfigurationFromAssets(path, assets string) (*Configuration, error) {
-	return newConfiguration(path, assets)
+	return newConfiguration(path, assets, false)
 }
 
-func newConfiguration(path string, assets string) (conf *Configuration, err error) {
+func newConfiguration(path string, assets string, readOnly bool) (conf *Configuration, err error) {
 	conf = &Configuration{
-		Path:   path,
-		assets: assets,
+		Path:        path,
+		mutex:       &sync.RWMutex{},
+		assets:      assets,
+		readOnly:    readOnly,
+		httpCache:   NewHTTPCache(),
+		mirrors:     newMirrorHealth(),
+		transports:  newSchemeTransports(),
+		fileHashes:  newFileHashes(),
+		trackedKeys: newPrivateKeyTracker(),
+		auditLog:    &AuditLog{},
 	}
 
 	if conf.assets != "" { // If an assets folder is specified, then it must exist
 		if err = fs.AssertPathExists(conf.assets); err != nil {
-			return nil, errors.WrapPrefix(err, "Nonexistent assets folder specified", 0)
+			return nil, configurationError(ErrAssetsNotFound, err, "Nonexistent assets folder specified")
 		}
 	}
-	if err = fs.EnsureDirectoryExists(conf.Path); err != nil {
-		return nil, err
+	if !conf.readOnly {
+		if err = fs.EnsureDirectoryExists(conf.Path); err != nil {
+			return nil, err
+		}
 	}
 
 	// Init all maps
@@ -149,17 +208,112 @@ func (conf *Configuration) clear() {
 	conf.AttributeTypes = make(map[AttributeTypeIdentifier]*AttributeType)
 	conf.DisabledSchemeManagers = make(map[SchemeManagerIdentifier]*SchemeManagerError)
 	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
+	conf.kssJWKS = make(map[SchemeManagerIdentifier]*JWKS)
 	conf.publicKeys = make(map[IssuerIdentifier]map[int]*gabi.PublicKey)
-	conf.privateKeys = make(map[IssuerIdentifier]*gabi.PrivateKey)
+	conf.privateKeys = make(map[IssuerIdentifier]map[int]*gabi.PrivateKey)
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
 }
 
 // ParseFolder populates the current Configuration by parsing the storage path,
 // listing the containing scheme managers, issuers and credential types.
+// The folder is parsed into a copy of conf having new maps, which is swapped into conf afterwards
+// if parsing completed (possibly with some schemes disabled, see SchemeManagerError),
+// so snapshots taken with Snapshot() are not affected.
 func (conf *Configuration) ParseFolder() (err error) {
-	// Init all maps
-	conf.clear()
+	conf.mutex.RLock()
+	parsed := *conf
+	conf.mutex.RUnlock()
+	parsed.mutex = &sync.RWMutex{}
+	parsed.initialized = false
+	parsed.validation = nil // each parse reports its own validation entries
+	parsed.clear()
+
+	err = parsed.parseFolder()
+	if parsed.initialized {
+		conf.swap(&parsed)
+	}
+	return err
+}
+
+// swap replaces the contents of conf with those of the specified (freshly parsed) Configuration.
+func (conf *Configuration) swap(parsed *Configuration) {
+	conf.mutex.Lock()
+	defer conf.mutex.Unlock()
+
+	conf.SchemeManagers = parsed.SchemeManagers
+	conf.Issuers = parsed.Issuers
+	conf.CredentialTypes = parsed.CredentialTypes
+	conf.AttributeTypes = parsed.AttributeTypes
+	conf.DisabledSchemeManagers = parsed.DisabledSchemeManagers
+	conf.Warnings = parsed.Warnings
+	conf.validation = parsed.validation
+	conf.kssPublicKeys = parsed.kssPublicKeys
+	conf.kssJWKS = parsed.kssJWKS
+	conf.publicKeys = parsed.publicKeys
+	conf.privateKeys = parsed.privateKeys
+	conf.reverseHashes = parsed.reverseHashes
+	conf.initialized = parsed.initialized
+}
 
+// Snapshot returns a read-only copy of the Configuration that is not affected when conf is
+// subsequently reparsed or updated (e.g. by the scheme Updater). Sessions should use a snapshot
+// taken at the start of the session, so that a scheme update during the session does not change
+// the configuration against which its messages are constructed or verified.
+func (conf *Configuration) Snapshot() *Configuration {
+	conf.mutex.RLock()
+	defer conf.mutex.RUnlock()
+
+	snapshot := *conf
+	snapshot.mutex = &sync.RWMutex{}
+	snapshot.readOnly = true
+	snapshot.Warnings = append([]string{}, conf.Warnings...)
+	snapshot.validation = append([]*ValidationEntry{}, conf.validation...)
+
+	// The maps are copied, as the snapshot lazily parses keys into its own maps
+	snapshot.clear()
+	for id, v := range conf.SchemeManagers {
+		snapshot.SchemeManagers[id] = v
+	}
+	for id, v := range conf.Issuers {
+		snapshot.Issuers[id] = v
+	}
+	for id, v := range conf.CredentialTypes {
+		snapshot.CredentialTypes[id] = v
+	}
+	for id, v := range conf.AttributeTypes {
+		snapshot.AttributeTypes[id] = v
+	}
+	for id, v := range conf.DisabledSchemeManagers {
+		snapshot.DisabledSchemeManagers[id] = v
+	}
+	for id, keys := range conf.kssPublicKeys {
+		snapshot.kssPublicKeys[id] = make(map[int]*rsa.PublicKey, len(keys))
+		for i, pk := range keys {
+			snapshot.kssPublicKeys[id][i] = pk
+		}
+	}
+	for id, jwks := range conf.kssJWKS {
+		snapshot.kssJWKS[id] = jwks
+	}
+	for id, keys := range conf.publicKeys {
+		snapshot.publicKeys[id] = make(map[int]*gabi.PublicKey, len(keys))
+		for i, pk := range keys {
+			snapshot.publicKeys[id][i] = pk
+		}
+	}
+	for id, keys := range conf.privateKeys {
+		snapshot.privateKeys[id] = make(map[int]*gabi.PrivateKey, len(keys))
+		for i, sk := range keys {
+			snapshot.privateKeys[id][i] = sk
+		}
+	}
+	for hash, v := range conf.reverseHashes {
+		snapshot.reverseHashes[hash] = v
+	}
+	return &snapshot
+}
+
+func (conf *Configuration) parseFolder() (err error) {
 	// Copy any new or updated scheme managers out of the assets into storage
 	if conf.assets != "" {
 		err = iterateSubfolders(conf.assets, func(dir string) error {
@@ -182,6 +336,9 @@ func (conf *Configuration) ParseFolder() (err error) {
 	var mgrerr *SchemeManagerError
 	err = iterateSubfolders(conf.Path, func(dir string) error {
 		manager := NewSchemeManager(filepath.Base(dir))
+		if _, parsed := conf.SchemeManagers[manager.Identifier()]; parsed {
+			return nil // Already parsed as sub-scheme of another scheme
+		}
 		err := conf.ParseSchemeManagerFolder(dir, manager)
 		if err == nil {
 			return nil // OK, do next scheme manager folder
@@ -202,6 +359,10 @@ func (conf *Configuration) ParseFolder() (err error) {
 	if mgrerr != nil {
 		return mgrerr
 	}
+	// Sub-schemes may have been disabled while parsing their parent
+	for _, mgrerr = range conf.DisabledSchemeManagers {
+		return mgrerr
+	}
 	return
 }
 
@@ -273,34 +434,70 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	}
 	if !exists {
 		manager.Status = SchemeManagerStatusParsingError
-		return errors.New("Scheme manager description not found")
+		return configurationError(ErrInvalidScheme, nil, "Scheme manager description not found")
 	}
 	if err = conf.checkScheme(manager, dir); err != nil {
 		return
 	}
 
-	// Verify that all other files are validly signed
-	err = conf.VerifySchemeManager(manager)
+	// If the scheme is unchanged since we last parsed it, use the cached result
+	cacheKey, err := conf.schemeCacheKey(manager)
 	if err != nil {
-		manager.Status = SchemeManagerStatusInvalidSignature
 		return
 	}
+	cache := conf.readSchemeCache(manager, cacheKey)
+	validationStart := len(conf.validation)
+
+	// Verify that all other files are validly signed
+	if cache == nil {
+		err = conf.VerifySchemeManager(manager)
+		if err != nil {
+			manager.Status = SchemeManagerStatusInvalidSignature
+			return
+		}
+	}
 
 	// Read timestamp indicating time of last modification
 	ts, exists, err := readTimestamp(dir + "/timestamp")
-	if err != nil || !exists {
-		return errors.WrapPrefix(err, "Could not read scheme manager timestamp", 0)
+	if err != nil {
+		return configurationError(ErrInvalidScheme, err, "Could not read scheme manager timestamp")
+	}
+	if !exists {
+		return configurationError(ErrInvalidScheme, nil, "Scheme manager timestamp not found")
+	}
+	if err = conf.verifySchemeTimestamp(manager); err != nil {
+		manager.Status = SchemeManagerStatusInvalidSignature
+		return
 	}
 	manager.Timestamp = *ts
+	if manager.Freshness, err = conf.parseFreshness(manager); err != nil {
+		manager.Status = SchemeManagerStatusInvalidSignature
+		return
+	}
 
 	// Parse contained issuers and credential types
-	err = conf.parseIssuerFolders(manager, dir)
-	if err != nil {
+	if cache != nil {
+		conf.applySchemeCache(cache)
+	} else {
+		err = conf.parseIssuerFolders(manager, dir)
+		if err != nil {
+			manager.Status = SchemeManagerStatusContentParsingError
+			return
+		}
+		if err = conf.writeSchemeCache(manager, cacheKey, conf.validation[validationStart:]); err != nil {
+			manager.Status = SchemeManagerStatusContentParsingError
+			return
+		}
+	}
+	// Load the public keys of all issuers up front, so that they can be selected by validity
+	if err = conf.parsePublicKeys(manager); err != nil {
 		manager.Status = SchemeManagerStatusContentParsingError
 		return
 	}
 	manager.Status = SchemeManagerStatusValid
 	manager.Valid = true
+
+	conf.parseSubSchemes(manager)
 	return
 }
 
@@ -326,113 +523,294 @@ func relativePath(outer string, inner string) (string, error) {
 }
 
 // PrivateKey returns the specified private key, or nil if not present in the Configuration.
-func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, error) {
-	if sk := conf.privateKeys[id]; sk != nil {
+func (conf *Configuration) PrivateKey(id IssuerIdentifier, counter int) (*gabi.PrivateKey, error) {
+	conf.mutex.RLock()
+	sk := conf.privateKeys[id][counter]
+	conf.mutex.RUnlock()
+	if sk != nil {
 		return sk, nil
 	}
 
 	path := fmt.Sprintf(privkeyPattern, conf.Path, id.SchemeManagerIdentifier().Name(), id.Name())
-	files, err := filepath.Glob(path)
+	file := strings.Replace(path, "*", strconv.Itoa(counter), 1)
+	if exists, err := fs.PathExists(file); err != nil || !exists {
+		return nil, err
+	}
+	sk, err := conf.readPrivateKey(file)
 	if err != nil {
 		return nil, err
 	}
-	if len(files) == 0 {
-		return nil, nil
+	if int(sk.Counter) != counter {
+		return nil, configurationError(ErrInvalidKey, nil,
+			fmt.Sprintf("Private key %s of issuer %s has wrong <Counter>", file, id.String()))
+	}
+	conf.trackedKeys.track(sk)
+	conf.mutex.Lock()
+	if conf.privateKeys[id] == nil {
+		conf.privateKeys[id] = make(map[int]*gabi.PrivateKey)
 	}
+	conf.privateKeys[id][counter] = sk
+	conf.mutex.Unlock()
 
-	// List private keys and get highest counter
-	counters := make([]int, 0, len(files))
-	for _, file := range files {
-		filename := filepath.Base(file)
-		count := filename[:len(filename)-4]
-		i, err := strconv.Atoi(count)
+	return sk, nil
+}
+
+// PrivateKeyLatest returns the private key of the specified issuer with the highest counter,
+// or nil if the Configuration contains no private keys of the issuer.
+func (conf *Configuration) PrivateKeyLatest(id IssuerIdentifier) (*gabi.PrivateKey, error) {
+	indices, err := conf.PrivateKeyIndices(id)
+	if err != nil || len(indices) == 0 {
+		return nil, err
+	}
+	return conf.PrivateKey(id, indices[len(indices)-1])
+}
+
+func (conf *Configuration) PrivateKeyIndices(issuerid IssuerIdentifier) (i []int, err error) {
+	return conf.matchKeyPattern(issuerid, privkeyPattern)
+}
+
+// RotateIssuerKey generates a new keypair for the specified issuer (see GenerateIssuerKeypair()),
+// with the same key length and amount of attributes as its current public key, valid for one year.
+func (conf *Configuration) RotateIssuerKey(id IssuerIdentifier) (*gabi.PrivateKey, error) {
+	indices, err := conf.PublicKeyIndices(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(indices) == 0 {
+		return nil, configurationError(ErrKeyNotFound, nil,
+			fmt.Sprintf("Issuer %s has no public keys", id.String()))
+	}
+	pk, err := conf.PublicKey(id, indices[len(indices)-1])
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, configurationError(ErrKeyNotFound, nil,
+			fmt.Sprintf("Current public key of issuer %s could not be read", id.String()))
+	}
+	return conf.GenerateIssuerKeypair(id, pk.N.BitLen(), len(pk.R), 365*24*time.Hour)
+}
+
+// generateKeyPair generates the issuer keypairs of GenerateIssuerKeypair(); replaced in tests, as
+// generating keys takes long.
+var generateKeyPair = gabi.GenerateKeyPair
+
+// GenerateIssuerKeypair generates a new keypair for the specified issuer having the specified key
+// length and amount of attributes (including the secret key), valid for the specified duration.
+// The keys get the counter following those of the existing keys of the issuer, and are written to
+// the PrivateKeys and PublicKeys folders of the issuer as <counter>.xml. As the new public key is
+// not yet included in the index of the scheme, the scheme must be re-signed (see SignScheme())
+// before the new key can be used. In dry-run mode the generated private key is returned without
+// being written.
+func (conf *Configuration) GenerateIssuerKeypair(id IssuerIdentifier, bits, numAttributes int, validity time.Duration) (*gabi.PrivateKey, error) {
+	if err := conf.writable("generate key of issuer " + id.String()); err != nil {
+		return nil, err
+	}
+	sysparams, ok := gabi.DefaultSystemParameters[bits]
+	if !ok {
+		return nil, errors.Errorf("Unsupported key length, should be one of %v", gabi.DefaultKeyLengths)
+	}
+	if numAttributes < 2 {
+		return nil, errors.New("Keys must support at least two attributes")
+	}
+	if validity <= 0 {
+		return nil, errors.New("Key validity must be positive")
+	}
+
+	// The counter must exceed those of all existing keys, public or private
+	counter := 0
+	for _, pattern := range []string{pubkeyPattern, privkeyPattern} {
+		indices, err := conf.matchKeyPattern(id, pattern)
 		if err != nil {
 			return nil, err
 		}
-		counters = append(counters, i)
+		if len(indices) > 0 && indices[len(indices)-1] >= counter {
+			counter = indices[len(indices)-1] + 1
+		}
 	}
-	sort.Ints(counters)
-	counter := counters[len(counters)-1]
 
-	// Read private key
-	file := strings.Replace(path, "*", strconv.Itoa(counter), 1)
-	sk, err := gabi.NewPrivateKeyFromFile(file)
+	scheme, issuer := id.SchemeManagerIdentifier().Name(), id.Name()
+	filename := strconv.Itoa(counter) + ".xml"
+	skfile := filepath.Join(conf.Path, scheme, issuer, "PrivateKeys", filename)
+	pkfile := filepath.Join(conf.Path, scheme, issuer, "PublicKeys", filename)
+	sk, pk, err := generateKeyPair(sysparams, numAttributes, uint(counter), Now().Add(validity))
 	if err != nil {
 		return nil, err
 	}
-	if int(sk.Counter) != counter {
-		return nil, errors.Errorf("Private key %s of issuer %s has wrong <Counter>", file, id.String())
+	conf.trackedKeys.track(sk)
+	if err = conf.writePrivateKey(sk, skfile); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to write private key", 0)
+	}
+	var pkxml bytes.Buffer
+	if _, err = pk.WriteTo(&pkxml); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to serialize public key", 0)
+	}
+	if err = conf.saveFile(pkfile, pkxml.Bytes()); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to write public key", 0)
+	}
+	if conf.dryRun != nil {
+		// In dry-run mode the keys were not written, so the private key is returned to the
+		// caller but not added to the configuration as if it were installed
+		return sk, nil
 	}
-	conf.privateKeys[id] = sk
 
+	conf.mutex.Lock()
+	if conf.privateKeys[id] == nil {
+		conf.privateKeys[id] = make(map[int]*gabi.PrivateKey)
+	}
+	conf.privateKeys[id][counter] = sk
+	conf.mutex.Unlock()
 	return sk, nil
 }
 
 // PublicKey returns the specified public key, or nil if not present in the Configuration.
 func (conf *Configuration) PublicKey(id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
-	var haveIssuer, haveKey bool
-	var err error
-	_, haveIssuer = conf.publicKeys[id]
-	if haveIssuer {
-		_, haveKey = conf.publicKeys[id][counter]
+	conf.mutex.RLock()
+	pk, haveKey := conf.publicKeys[id][counter]
+	conf.mutex.RUnlock()
+	if haveKey {
+		return pk, nil
 	}
 
 	// If we have not seen this issuer or key before in conf.publicKeys,
 	// try to parse the public key folder; new keys might have been put there since we last parsed it
-	if !haveIssuer || !haveKey {
-		if err = conf.parseKeysFolder(id); err != nil {
+	if err := conf.parseKeysFolder(id); err != nil {
+		return nil, err
+	}
+	conf.mutex.RLock()
+	defer conf.mutex.RUnlock()
+	return conf.publicKeys[id][counter], nil
+}
+
+// PublicKeyLatestValid returns the nonexpired public key of the specified issuer with the
+// highest counter, or nil if the issuer has no nonexpired public keys.
+func (conf *Configuration) PublicKeyLatestValid(id IssuerIdentifier) (*gabi.PublicKey, error) {
+	conf.mutex.RLock()
+	keys, parsed := conf.publicKeys[id]
+	conf.mutex.RUnlock()
+	if !parsed {
+		if err := conf.parseKeysFolder(id); err != nil {
 			return nil, err
 		}
+		conf.mutex.RLock()
+		keys = conf.publicKeys[id]
+		conf.mutex.RUnlock()
 	}
-	return conf.publicKeys[id][counter], nil
+
+	now := Now().Unix()
+	var latest *gabi.PublicKey
+	for _, pk := range keys {
+		if pk.ExpiryDate > now && (latest == nil || pk.Counter > latest.Counter) {
+			latest = pk
+		}
+	}
+	return latest, nil
+}
+
+// parsePublicKeys parses the public keys of all issuers of the specified scheme.
+func (conf *Configuration) parsePublicKeys(manager *SchemeManager) error {
+	for id := range conf.Issuers {
+		if id.SchemeManagerIdentifier() != manager.Identifier() {
+			continue
+		}
+		if err := conf.parseKeysFolder(id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // KeyshareServerKeyFunc returns a function that returns the public key with which to verify a keyshare server JWT,
-// suitable for passing to jwt.Parse() and jwt.ParseWithClaims().
+// suitable for passing to jwt.Parse() and jwt.ParseWithClaims(). If the scheme specifies a JWKS of the keyshare
+// server, the key is first looked up in the JWKS, and otherwise in the scheme.
 func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier) func(t *jwt.Token) (interface{}, error) {
 	return func(t *jwt.Token) (i interface{}, e error) {
 		var kid int
 		if kidstr, ok := t.Header["kid"].(string); ok {
+			if jwks := conf.keyshareServerJWKS(scheme); jwks != nil {
+				pk, err := jwks.Key(kidstr)
+				if err == nil {
+					if err = conf.auditLog.Record(AuditEventKeyshareVerification, scheme.String()+"-"+kidstr, ""); err != nil {
+						return nil, err
+					}
+					return pk, nil
+				}
+				Logger.Debugf("Keyshare server key %s not found in JWKS: %s", kidstr, err.Error())
+			}
 			var err error
 			if kid, err = strconv.Atoi(kidstr); err != nil {
 				return nil, err
 			}
 		}
-		return conf.KeyshareServerPublicKey(scheme, kid)
+		pk, err := conf.KeyshareServerPublicKey(scheme, kid)
+		if err != nil {
+			return nil, err
+		}
+		if err = conf.auditLog.Record(AuditEventKeyshareVerification, fmt.Sprintf("%s-%d", scheme, kid), ""); err != nil {
+			return nil, err
+		}
+		return pk, nil
 	}
 }
 
-// KeyshareServerPublicKey returns the i'th public key of the specified scheme.
+// keyshareServerJWKS returns the JWKS of the keyshare server of the specified scheme,
+// or nil if the scheme does not specify one.
+func (conf *Configuration) keyshareServerJWKS(scheme SchemeManagerIdentifier) *JWKS {
+	conf.mutex.Lock()
+	defer conf.mutex.Unlock()
+
+	manager, ok := conf.SchemeManagers[scheme]
+	if !ok || manager.KeyshareJWKS == "" {
+		return nil
+	}
+	jwks, ok := conf.kssJWKS[scheme]
+	if !ok || jwks.URL != manager.KeyshareJWKS {
+		jwks = NewJWKS(manager.KeyshareJWKS, conf.NewSchemeTransport(scheme, ""))
+		conf.kssJWKS[scheme] = jwks
+	}
+	return jwks
+}
+
+// KeyshareServerPublicKey returns the i'th public key of the specified scheme, or an error if
+// the scheme declares a validity period for the key that does not include the current time.
 func (conf *Configuration) KeyshareServerPublicKey(scheme SchemeManagerIdentifier, i int) (*rsa.PublicKey, error) {
+	if err := conf.checkKeyshareServerPublicKeyValidity(scheme, i); err != nil {
+		return nil, err
+	}
+
+	conf.mutex.RLock()
+	pk, contains := conf.kssPublicKeys[scheme][i]
+	conf.mutex.RUnlock()
+	if contains {
+		return pk, nil
+	}
+
+	pkbts, err := conf.keyshareServerPublicKeyBytes(scheme, i)
+	if err != nil {
+		return nil, err
+	}
+	pk, err = parsePemRsaPublicKey(pkbts)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.mutex.Lock()
+	defer conf.mutex.Unlock()
 	if _, contains := conf.kssPublicKeys[scheme]; !contains {
 		conf.kssPublicKeys[scheme] = make(map[int]*rsa.PublicKey)
 	}
-	if _, contains := conf.kssPublicKeys[scheme][i]; !contains {
-		pkbts, err := ioutil.ReadFile(filepath.Join(conf.Path, scheme.Name(), fmt.Sprintf("kss-%d.pem", i)))
-		if err != nil {
-			return nil, err
-		}
-		pkblk, _ := pem.Decode(pkbts)
-		genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
-		if err != nil {
-			return nil, err
-		}
-		pk, ok := genericPk.(*rsa.PublicKey)
-		if !ok {
-			return nil, errors.New("Invalid keyshare server public key")
-		}
-		conf.kssPublicKeys[scheme][i] = pk
-	}
-	return conf.kssPublicKeys[scheme][i], nil
+	conf.kssPublicKeys[scheme][i] = pk
+	return pk, nil
 }
 
 func (conf *Configuration) addReverseHash(credid CredentialTypeIdentifier) {
 	hash := sha256.Sum256([]byte(credid.String()))
-	conf.reverseHashes[base64.StdEncoding.EncodeToString(hash[:16])] = credid
+	conf.reverseHashes[string(hash[:16])] = credid
 }
 
 func (conf *Configuration) hashToCredentialType(hash []byte) *CredentialType {
-	if str, exists := conf.reverseHashes[base64.StdEncoding.EncodeToString(hash)]; exists {
+	// Indexing with string(hash) does not allocate, contrary to encoding the hash first
+	if str, exists := conf.reverseHashes[string(hash)]; exists {
 		return conf.CredentialTypes[str]
 	}
 	return nil
@@ -463,7 +841,7 @@ func (conf *Configuration) parseIssuerFolders(manager *SchemeManager, path strin
 			return nil
 		}
 		if issuer.XMLVersion < 4 {
-			return errors.New("Unsupported issuer description")
+			return configurationError(ErrInvalidScheme, nil, "Unsupported issuer description")
 		}
 
 		if err = conf.checkIssuer(manager, issuer, dir); err != nil {
@@ -477,6 +855,9 @@ func (conf *Configuration) parseIssuerFolders(manager *SchemeManager, path strin
 }
 
 func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error {
+	if err := conf.writable("delete scheme " + id.String()); err != nil {
+		return err
+	}
 	delete(conf.SchemeManagers, id)
 	delete(conf.DisabledSchemeManagers, id)
 	name := id.String()
@@ -495,16 +876,25 @@ func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error
 			delete(conf.CredentialTypes, cred)
 		}
 	}
-	if !conf.readOnly {
-		return os.RemoveAll(filepath.Join(conf.Path, id.Name()))
-	}
-	return nil
+	return conf.removeAll(filepath.Join(conf.Path, id.Name()))
 }
 
 // parse $schememanager/$issuer/PublicKeys/$i.xml for $i = 1, ...
+// parseKeysFolder (re)parses the public keys of the specified issuer into conf.publicKeys.
 func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
+	conf.mutex.RLock()
 	manager := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
-	conf.publicKeys[issuerid] = map[int]*gabi.PublicKey{}
+	conf.mutex.RUnlock()
+
+	// Replace the keys of the issuer with the ones parsed below at once, so that
+	// concurrent readers never observe the issuer having only some of its keys
+	keys := map[int]*gabi.PublicKey{}
+	defer func() {
+		conf.mutex.Lock()
+		conf.publicKeys[issuerid] = keys
+		conf.mutex.Unlock()
+	}()
+
 	path := fmt.Sprintf(pubkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
 	files, err := filepath.Glob(path)
 	if err != nil {
@@ -531,10 +921,11 @@ func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 			return err
 		}
 		if int(pk.Counter) != i {
-			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String())
+			return configurationError(ErrInvalidKey, nil,
+				fmt.Sprintf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String()))
 		}
 		pk.Issuer = issuerid.String()
-		conf.publicKeys[issuerid][i] = pk
+		keys[i] = pk
 	}
 
 	return nil
@@ -592,7 +983,8 @@ func (conf *Configuration) parseCredentialsFolder(manager *SchemeManager, issuer
 		return nil
 	})
 	if !foundcred {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no credential types", issuer.Identifier().String()))
+		conf.warn(SeverityWarning, ValidationNoCredentialTypes, issuer.Identifier().String(),
+			"Issuer %s has no credential types", issuer.Identifier().String())
 	}
 	return err
 }
@@ -614,8 +1006,8 @@ func iterateSubfolders(path string, handler func(string) error) error {
 		if !stat.IsDir() {
 			continue
 		}
-		if strings.HasSuffix(dir, "/.git") {
-			continue
+		if strings.HasPrefix(filepath.Base(dir), ".") {
+			continue // e.g. .git, or the scheme store
 		}
 		err = handler(dir)
 		if err != nil {
@@ -639,9 +1031,11 @@ func (conf *Configuration) pathToDescription(manager *SchemeManager, path string
 	if !found {
 		for p := range manager.index {
 			expectedName := p[0:strings.Index(p, "/")]
-			return false, errors.Errorf("Folder must be called %s, not %s", expectedName, manager.ID)
+			return false, configurationError(ErrInvalidScheme, nil,
+				fmt.Sprintf("Folder must be called %s, not %s", expectedName, manager.ID))
 		}
-		return false, errors.New("")
+		return false, configurationError(ErrInvalidScheme, nil,
+			fmt.Sprintf("File %s not found in scheme manager index", relativepath))
 	}
 	if err != nil {
 		return true, err
@@ -668,8 +1062,11 @@ func (conf *Configuration) isUpToDate(scheme SchemeManagerIdentifier) (bool, err
 	}
 	name := scheme.String()
 	newTime, exists, err := readTimestamp(filepath.Join(conf.assets, name, "timestamp"))
-	if err != nil || !exists {
-		return true, errors.WrapPrefix(err, "Could not read asset timestamp of scheme "+name, 0)
+	if err != nil {
+		return true, configurationError(ErrInvalidScheme, err, "Could not read asset timestamp of scheme "+name)
+	}
+	if !exists {
+		return true, configurationError(ErrInvalidScheme, nil, "Asset timestamp of scheme "+name+" not found")
 	}
 	// The storage version of the manager does not need to have a timestamp. If it does not, it is outdated.
 	oldTime, exists, err := readTimestamp(filepath.Join(conf.Path, name, "timestamp"))
@@ -686,10 +1083,10 @@ func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier)
 	// Remove old version; we want an exact copy of the assets version
 	// not a merge of the assets version and the storage version
 	name := scheme.String()
-	if err := os.RemoveAll(filepath.Join(conf.Path, name)); err != nil {
+	if err := conf.removeAll(filepath.Join(conf.Path, name)); err != nil {
 		return false, err
 	}
-	return true, fs.CopyDirectory(
+	return true, conf.copyDirectory(
 		filepath.Join(conf.assets, name),
 		filepath.Join(conf.Path, name),
 	)
@@ -723,7 +1120,24 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 // RemoveSchemeManager removes the specified scheme manager and all associated issuers,
 // public keys and credential types from this Configuration.
 func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromStorage bool) error {
-	// Remove everything falling under the manager's responsibility
+	if fromStorage {
+		if err := conf.writable("remove scheme " + id.String()); err != nil {
+			return err
+		}
+	}
+
+	conf.unloadSchemeManager(id)
+	delete(conf.SchemeManagers, id)
+
+	if fromStorage || !conf.readOnly {
+		return conf.removeAll(filepath.Join(conf.Path, id.String()))
+	}
+	return nil
+}
+
+// unloadSchemeManager removes all issuers, public keys and credential types
+// of the specified scheme manager from this Configuration.
+func (conf *Configuration) unloadSchemeManager(id SchemeManagerIdentifier) {
 	for credid := range conf.CredentialTypes {
 		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
 			delete(conf.CredentialTypes, credid)
@@ -739,21 +1153,83 @@ func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromS
 			delete(conf.publicKeys, issid)
 		}
 	}
-	delete(conf.SchemeManagers, id)
+}
+
+// RemoveIssuer removes the specified issuer, along with its credential types and keys, from
+// this Configuration. Unless the scheme of the issuer no longer contains the issuer, it is
+// reinstalled by the next update of the scheme.
+func (conf *Configuration) RemoveIssuer(id IssuerIdentifier, fromStorage bool) error {
+	if fromStorage {
+		if err := conf.writable("remove issuer " + id.String()); err != nil {
+			return err
+		}
+	}
+
+	conf.mutex.Lock()
+	for credid := range conf.CredentialTypes {
+		if credid.IssuerIdentifier() == id {
+			conf.unloadCredentialType(credid)
+		}
+	}
+	delete(conf.Issuers, id)
+	delete(conf.publicKeys, id)
+	delete(conf.privateKeys, id)
+	conf.mutex.Unlock()
+
+	if fromStorage || !conf.readOnly {
+		return conf.removeAll(filepath.Join(conf.Path, id.SchemeManagerIdentifier().String(), id.Name()))
+	}
+	return nil
+}
+
+// RemoveCredentialType removes the specified credential type from this Configuration. Unless the
+// scheme of the credential type no longer contains it, it is reinstalled by the next update of
+// the scheme.
+func (conf *Configuration) RemoveCredentialType(id CredentialTypeIdentifier, fromStorage bool) error {
+	if fromStorage {
+		if err := conf.writable("remove credential type " + id.String()); err != nil {
+			return err
+		}
+	}
+
+	conf.mutex.Lock()
+	conf.unloadCredentialType(id)
+	conf.mutex.Unlock()
 
 	if fromStorage || !conf.readOnly {
-		return os.RemoveAll(fmt.Sprintf("%s/%s", conf.Path, id.String()))
+		issid := id.IssuerIdentifier()
+		return conf.removeAll(filepath.Join(conf.Path, issid.SchemeManagerIdentifier().String(), issid.Name(), "Issues", id.Name()))
 	}
 	return nil
 }
 
+// unloadCredentialType removes the specified credential type and its attribute types
+// from this Configuration.
+func (conf *Configuration) unloadCredentialType(id CredentialTypeIdentifier) {
+	delete(conf.CredentialTypes, id)
+	for attrid := range conf.AttributeTypes {
+		if attrid.CredentialTypeIdentifier() == id {
+			delete(conf.AttributeTypes, attrid)
+		}
+	}
+	for hash, credid := range conf.reverseHashes {
+		if credid == id {
+			delete(conf.reverseHashes, hash)
+		}
+	}
+}
+
 func (conf *Configuration) ReinstallSchemeManager(manager *SchemeManager) (err error) {
-	if conf.readOnly {
-		return errors.New("cannot install scheme into a read-only configuration")
+	if err = conf.writable("reinstall scheme " + manager.ID); err != nil {
+		return
+	}
+	if conf.skipDryRun("reinstall scheme", filepath.Join(conf.Path, manager.ID)) {
+		return
 	}
 
 	// Check if downloading stuff from the remote works before we uninstall the specified manager:
 	// If we can't download anything we should keep the broken version
+	parent, publickey := manager.Parent, conf.subSchemePublicKey(manager)
 	manager, err = DownloadSchemeManager(manager.URL)
 	if err != nil {
 		return
@@ -761,15 +1237,23 @@ func (conf *Configuration) ReinstallSchemeManager(manager *SchemeManager) (err e
 	if err = conf.DeleteSchemeManager(manager.Identifier()); err != nil {
 		return
 	}
-	err = conf.InstallSchemeManager(manager, nil)
+	manager.Parent = parent
+	err = conf.InstallSchemeManager(manager, publickey)
 	return
 }
 
 // InstallSchemeManager downloads and adds the specified scheme manager to this Configuration,
 // provided its signature is valid.
 func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publickey []byte) error {
-	if conf.readOnly {
-		return errors.New("cannot install scheme into a read-only configuration")
+	if err := conf.writable("install scheme " + manager.ID); err != nil {
+		return err
+	}
+	if manager.Environment != "" && !conf.environmentAllowed(manager.Environment) {
+		return configurationError(ErrEnvironmentNotAllowed, nil,
+			fmt.Sprintf("cannot install scheme %s of disallowed environment %s", manager.ID, manager.Environment))
+	}
+	if conf.skipDryRun("install scheme", filepath.Join(conf.Path, manager.ID)) {
+		return nil
 	}
 
 	name := manager.ID
@@ -777,17 +1261,21 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 		return err
 	}
 
-	t := NewHTTPTransport(manager.URL)
 	path := fmt.Sprintf("%s/%s", conf.Path, name)
-	if err := t.GetFile("description.xml", path+"/description.xml"); err != nil {
+	err := conf.schemeRequest(manager, func(t *HTTPTransport) error {
+		if err := t.GetFile("description.xml", path+"/description.xml"); err != nil {
+			return err
+		}
+		if publickey == nil {
+			return t.GetFile("pk.pem", path+"/pk.pem")
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 	if publickey != nil {
-		if err := fs.SaveFile(path+"/pk.pem", publickey); err != nil {
-			return err
-		}
-	} else {
-		if err := t.GetFile("pk.pem", path+"/pk.pem"); err != nil {
+		if err := conf.saveFile(path+"/pk.pem", publickey); err != nil {
 			return err
 		}
 	}
@@ -799,37 +1287,72 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 		return err
 	}
 
-	return conf.ParseSchemeManagerFolder(filepath.Join(conf.Path, name), manager)
+	if err := conf.ParseSchemeManagerFolder(filepath.Join(conf.Path, name), manager); err != nil {
+		return err
+	}
+	// The environment of the scheme is now authenticated, so check it again
+	if !conf.environmentAllowed(manager.Environment) {
+		_ = conf.RemoveSchemeManager(manager.Identifier(), true)
+		return configurationError(ErrEnvironmentNotAllowed, nil,
+			fmt.Sprintf("cannot install scheme %s of disallowed environment %s", manager.ID, manager.Environment))
+	}
+	return nil
+}
+
+// EnvironmentAllowed returns whether or not the specified scheme may be used in sessions,
+// according to conf.Environments.
+func (conf *Configuration) EnvironmentAllowed(id SchemeManagerIdentifier) bool {
+	manager, ok := conf.SchemeManagers[id]
+	if !ok {
+		return false
+	}
+	return conf.environmentAllowed(manager.Environment)
+}
+
+func (conf *Configuration) environmentAllowed(env SchemeEnvironment) bool {
+	if len(conf.Environments) == 0 {
+		return true
+	}
+	for _, e := range conf.Environments {
+		if e == env {
+			return true
+		}
+	}
+	return false
 }
 
 // DownloadSchemeManagerSignature downloads, stores and verifies the latest version
 // of the index file and signature of the specified manager.
 func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager) (err error) {
-	if conf.readOnly {
-		return errors.New("cannot download into a read-only configuration")
+	if err = conf.writable("download index of scheme " + manager.ID); err != nil {
+		return
 	}
-
-	t := NewHTTPTransport(manager.URL)
 	path := fmt.Sprintf("%s/%s", conf.Path, manager.ID)
+	if conf.skipDryRun("download index", path) {
+		return
+	}
+
 	index := filepath.Join(path, "index")
 	sig := filepath.Join(path, "index.sig")
 
-	if err = t.GetFile("index", index); err != nil {
-		return
-	}
-	if err = t.GetFile("index.sig", sig); err != nil {
-		return
-	}
-	err = conf.VerifySignature(manager.Identifier())
-	return
+	// Download the index and signature from the same URL, so that they belong together
+	return conf.schemeRequest(manager, func(t *HTTPTransport) error {
+		if err := t.GetFile("index", index); err != nil {
+			return err
+		}
+		if err := t.GetFile("index.sig", sig); err != nil {
+			return err
+		}
+		return conf.VerifySignature(manager.Identifier())
+	})
 }
 
 // Download downloads the issuers, credential types and public keys specified in set
 // if the current Configuration does not already have them,  and checks their authenticity
 // using the scheme manager index.
 func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIdentifierSet, err error) {
-	if conf.readOnly {
-		return nil, errors.New("cannot download into a read-only configuration")
+	if err = conf.writable("download scheme contents"); err != nil {
+		return nil, err
 	}
 	managers := make(map[string]struct{}) // Managers that we must update
 	downloaded = &IrmaIdentifierSet{
@@ -846,6 +1369,19 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 		return
 	}
 
+	// Partially installed schemes only update what they already have,
+	// so install any missing credential types of such schemes explicitly
+	for id := range session.Identifiers().CredentialTypes {
+		schemeid := id.IssuerIdentifier().SchemeManagerIdentifier()
+		if _, contains := conf.CredentialTypes[id]; contains || !conf.IsPartial(schemeid) {
+			continue
+		}
+		if err = conf.InstallCredentialType(id); err != nil {
+			return
+		}
+		downloaded.CredentialTypes[id] = struct{}{}
+	}
+
 	// Update the scheme managers found above and parse them, if necessary
 	for id := range managers {
 		if err = conf.UpdateSchemeManager(NewSchemeManagerIdentifier(id), downloaded); err != nil {
@@ -961,11 +1497,12 @@ func (i SchemeManagerIndex) FromString(s string) error {
 		}
 		parts := strings.Split(line, " ")
 		if len(parts) != 2 {
-			return errors.Errorf("Scheme manager index line %d has incorrect amount of parts", j)
+			return configurationError(ErrInvalidScheme, nil,
+				fmt.Sprintf("Scheme manager index line %d has incorrect amount of parts", j))
 		}
 		hash, err := hex.DecodeString(parts[0])
 		if err != nil {
-			return err
+			return configurationError(ErrInvalidScheme, err, fmt.Sprintf("Scheme manager index line %d has invalid hash", j))
 		}
 		i[parts[1]] = hash
 	}
@@ -1005,11 +1542,11 @@ func (conf *Configuration) checkUnsignedFiles(name string, index SchemeManagerIn
 
 		if info.IsDir() {
 			if !dirInScheme(index, relpath) {
-				conf.Warnings = append(conf.Warnings, "Ignored dir: "+relpath)
+				conf.warn(SeverityInfo, ValidationIgnoredDir, relpath, "Ignored dir: %s", relpath)
 			}
 		} else {
 			if _, ok := index[relpath]; !ok {
-				conf.Warnings = append(conf.Warnings, "Ignored file: "+relpath)
+				conf.warn(SeverityInfo, ValidationIgnoredFile, relpath, "Ignored file: %s", relpath)
 			}
 		}
 
@@ -1033,12 +1570,16 @@ var sigExceptions = []*regexp.Regexp{
 	regexp.MustCompile(`^.*?/sk\.pem$`),
 	regexp.MustCompile(`^.*?/index`),
 	regexp.MustCompile(`^.*?/index\.sig`),
+	regexp.MustCompile(`^.*?/timestamp\.sig$`),
+	regexp.MustCompile(`^.*?/freshness(\.sig)?$`),
+	regexp.MustCompile(`^.*?/\.cache$`),
 	regexp.MustCompile(`^.*?/AUTHORS$`),
 	regexp.MustCompile(`^.*?/LICENSE$`),
 	regexp.MustCompile(`^.*?/README\.md$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys/\d+.xml$`),
 	regexp.MustCompile(`\.DS_Store$`),
+	regexp.MustCompile(`^.*?/\.partial$`),
 }
 
 func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
@@ -1047,41 +1588,55 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 		return err
 	}
 
-	var exists bool
+	// A timestamp signed by the timestamp key may be newer than the one in the index
+	timestampSigned, err := conf.timestampSigned(manager)
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(manager.index))
 	for file := range manager.index {
-		exists, err = fs.PathExists(filepath.Join(conf.Path, file))
-		if err != nil {
-			return err
-		}
-		if !exists {
+		if timestampSigned && file == manager.ID+"/timestamp" {
 			continue
 		}
-		// Don't care about the actual bytes
-		if _, _, err = conf.ReadAuthenticatedFile(manager, file); err != nil {
-			return err
-		}
+		files = append(files, file)
 	}
-
-	return nil
+	return conf.verifyFiles(manager, files)
 }
 
 // ReadAuthenticatedFile reads the file at the specified path
 // and verifies its authenticity by checking that the file hash
 // is present in the (signed) scheme manager index file.
+// If the file is present in the scheme store, it is read from there instead,
+// in which case its name suffices to verify it.
 func (conf *Configuration) ReadAuthenticatedFile(manager *SchemeManager, path string) ([]byte, bool, error) {
 	signedHash, ok := manager.index[filepath.ToSlash(path)]
 	if !ok {
 		return nil, false, nil
 	}
 
-	bts, err := ioutil.ReadFile(filepath.Join(conf.Path, path))
+	// Files that are not (or no longer) installed in the scheme directory are absent
+	// even if they are still in the store
+	if _, err := os.Stat(filepath.Join(conf.Path, path)); err != nil {
+		return nil, true, err
+	}
+	bts, stored, err := conf.readObject(signedHash)
+	if err != nil {
+		return nil, true, err
+	}
+	if stored {
+		return bts, true, nil
+	}
+
+	bts, err = ioutil.ReadFile(filepath.Join(conf.Path, path))
 	if err != nil {
 		return nil, true, err
 	}
 	computedHash := sha256.Sum256(bts)
 
 	if !bytes.Equal(computedHash[:], signedHash) {
-		return nil, true, errors.Errorf("Hash of %s does not match scheme manager index", path)
+		return nil, true, configurationError(ErrHashMismatch, nil,
+			fmt.Sprintf("Hash of %s does not match scheme manager index", path))
 	}
 	return bts, true, nil
 }
@@ -1093,24 +1648,23 @@ func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (err erro
 	defer func() {
 		if r := recover(); r != nil {
 			if e, ok := r.(error); ok {
-				err = errors.Errorf("Scheme manager index signature failed to verify: %s", e.Error())
+				err = configurationError(ErrInvalidSignature, e, "Scheme manager index signature failed to verify")
 			} else {
-				err = errors.New("Scheme manager index signature failed to verify")
+				err = configurationError(ErrInvalidSignature, nil, "Scheme manager index signature failed to verify")
 			}
 		}
 	}()
 
 	dir := filepath.Join(conf.Path, id.String())
 	if err := fs.AssertPathExists(dir+"/index", dir+"/index.sig", dir+"/pk.pem"); err != nil {
-		return errors.New("Missing scheme manager index file, signature, or public key")
+		return configurationError(ErrMissingSignature, err, "Missing scheme manager index file, signature, or public key")
 	}
 
-	// Read and hash index file
+	// Read index file
 	indexbts, err := ioutil.ReadFile(dir + "/index")
 	if err != nil {
 		return err
 	}
-	indexhash := sha256.Sum256(indexbts)
 
 	// Read and parse scheme manager public key
 	pkbts, err := ioutil.ReadFile(dir + "/pk.pem")
@@ -1122,30 +1676,26 @@ func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (err erro
 		return err
 	}
 
-	// Read and parse signature
+	// Read and verify signature
 	sig, err := ioutil.ReadFile(dir + "/index.sig")
 	if err != nil {
 		return err
 	}
-	ints := make([]*gobig.Int, 0, 2)
-	_, err = asn1.Unmarshal(sig, &ints)
-
-	// Verify signature
-	if !ecdsa.Verify(pk, indexhash[:], ints[0], ints[1]) {
-		return errors.New("Scheme manager signature was invalid")
-	}
-	return nil
+	return VerifySchemeIndexSignature(indexbts, sig, pk)
 }
 
 func ParsePemEcdsaPublicKey(pkbts []byte) (*ecdsa.PublicKey, error) {
 	pkblk, _ := pem.Decode(pkbts)
+	if pkblk == nil {
+		return nil, configurationError(ErrInvalidKey, nil, "Scheme manager public key is not PEM-encoded")
+	}
 	genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
 	if err != nil {
-		return nil, err
+		return nil, configurationError(ErrInvalidKey, err, "Invalid scheme manager public key")
 	}
 	pk, ok := genericPk.(*ecdsa.PublicKey)
 	if !ok {
-		return nil, errors.New("Invalid scheme manager public key")
+		return nil, configurationError(ErrInvalidKey, nil, "Invalid scheme manager public key")
 	}
 	return pk, nil
 }
@@ -1164,17 +1714,26 @@ func (hash ConfigurationFileHash) Equal(other ConfigurationFileHash) bool {
 // It stores the identifiers of new or updated credential types or issuers in the second parameter.
 // Note: any newly downloaded files are not yet parsed and inserted into conf.
 func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet) (err error) {
-	if conf.readOnly {
-		return errors.New("cannot update a read-only configuration")
+	if err = conf.writable("update scheme " + id.String()); err != nil {
+		return
 	}
+	conf.mutex.RLock()
 	manager, contains := conf.SchemeManagers[id]
+	conf.mutex.RUnlock()
 	if !contains {
-		return errors.Errorf("Cannot update unknown scheme manager %s", id)
+		return configurationError(ErrSchemeNotInstalled, nil, fmt.Sprintf("Cannot update unknown scheme manager %s", id))
+	}
+	if conf.skipDryRun("update scheme", filepath.Join(conf.Path, manager.ID)) {
+		return
 	}
 
-	// Check remote timestamp and see if we have to do anything
-	transport := NewHTTPTransport(manager.URL + "/")
-	timestampBts, err := transport.GetBytes("timestamp")
+	// Check remote timestamp and see if we have to do anything. The transport uses our HTTPCache
+	// so that we only download the timestamp (and other files) when it changed since we last saw it
+	var timestampBts []byte
+	err = conf.schemeRequest(manager, func(transport *HTTPTransport) (err error) {
+		timestampBts, err = transport.GetBytes("timestamp")
+		return
+	})
 	if err != nil {
 		return err
 	}
@@ -1183,7 +1742,18 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		return err
 	}
 	if !manager.Timestamp.Before(*timestamp) {
-		return nil
+		if manager, err = conf.updateFreshness(manager); err != nil {
+			return err
+		}
+		return conf.updateSubSchemes(manager, downloaded)
+	}
+	timestampSig, err := conf.downloadTimestampSignature(manager, timestampBts)
+	if err != nil {
+		return err
+	}
+	freshnessBts, freshnessSig, freshness, err := conf.downloadFreshness(manager, *timestamp)
+	if err != nil {
+		return err
 	}
 
 	// Download the new index and its signature, and check that the new index
@@ -1201,8 +1771,11 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 
 	issPattern := regexp.MustCompile("(.+)/(.+)/description\\.xml")
 	credPattern := regexp.MustCompile("(.+)/(.+)/Issues/(.+)/description\\.xml")
+	kssPattern := regexp.MustCompile("^[^/]+/kss-\\d+\\.pem$")
+	partial := conf.IsPartial(id)
 
-	// TODO: how to recover/fix local copy if err != nil below?
+	// Determine which files we need to fetch
+	var files []string
 	for filename, newHash := range newIndex {
 		path := filepath.Join(conf.Path, filename)
 		oldHash, known := manager.index[filename]
@@ -1214,19 +1787,49 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		if known && have && oldHash.Equal(newHash) {
 			continue // nothing to do, we already have this file
 		}
+		if partial && !have && !conf.partialSchemeHas(filename) {
+			continue // not installed in this partially installed scheme
+		}
+		if timestampSig != nil && filename == manager.ID+"/timestamp" {
+			continue // signed by the timestamp key, written below
+		}
+		files = append(files, filename)
+	}
+
+	// TODO: how to recover/fix local copy if err != nil below?
+	progress := conf.startProgress(id, len(files))
+	for _, filename := range files {
+		path := filepath.Join(conf.Path, filename)
+		newHash := newIndex[filename]
 		// Ensure that the folder in which to write the file exists
 		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 			return err
 		}
 		stripped := filename[len(manager.ID)+1:] // Scheme manager URL already ends with its name
-		// Download the new file, store it in our own irma_configuration folder
-		if err = transport.GetSignedFile(stripped, path, newHash); err != nil {
+		// Use the file from the scheme store if we have it (e.g. because an older version of the scheme
+		// contained it), otherwise download the new file, store it in our own irma_configuration folder
+		var stored bool
+		if stored, err = conf.checkoutObject(newHash, path); err != nil {
 			return
 		}
+		if !stored {
+			err = conf.schemeRequest(manager, func(transport *HTTPTransport) error {
+				return transport.GetSignedFile(stripped, path, newHash)
+			})
+			if err != nil {
+				return
+			}
+		}
+		progress.completed(path)
 		// See if the file is a credential type or issuer, and add it to the downloaded set if so
 		if downloaded == nil {
 			continue
 		}
+		// Changes to the scheme description or its keyshare server public keys require reparsing
+		// the scheme, so that new keyshare keys are used and the cached ones are dropped
+		if filename == manager.ID+"/description.xml" || kssPattern.MatchString(filename) {
+			downloaded.SchemeManagers[id] = struct{}{}
+		}
 		var matches []string
 		matches = issPattern.FindStringSubmatch(filename)
 		if len(matches) == 3 {
@@ -1240,8 +1843,102 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		}
 	}
 
-	manager.index = newIndex
-	return
+	// The timestamp signed by the timestamp key may be newer than the one in the index
+	if timestampSig != nil {
+		dir := filepath.Join(conf.Path, manager.ID)
+		if err = conf.saveFile(filepath.Join(dir, "timestamp"), timestampBts); err != nil {
+			return
+		}
+		if err = conf.saveFile(filepath.Join(dir, "timestamp.sig"), timestampSig); err != nil {
+			return
+		}
+	}
+	if freshness != nil {
+		if err = conf.saveFreshness(manager, freshnessBts, freshnessSig); err != nil {
+			return
+		}
+	}
+	if err = conf.storeSchemeVersion(manager, newIndex); err != nil {
+		return
+	}
+	removed, err := conf.removeDeleted(manager, newIndex)
+	if err != nil {
+		return
+	}
+	if !removed.Empty() {
+		if downloaded != nil {
+			downloaded.SchemeManagers[id] = struct{}{}
+		}
+		if conf.RemovalHandler != nil {
+			conf.RemovalHandler(removed)
+		}
+	}
+
+	// The manager may be in use by other goroutines (e.g. in snapshots of conf), so instead of
+	// modifying it we replace it with an updated copy
+	updated := *manager
+	updated.index = newIndex
+	if freshness != nil {
+		updated.Freshness = freshness
+	}
+	conf.mutex.Lock()
+	conf.SchemeManagers[id] = &updated
+	conf.mutex.Unlock()
+	return conf.updateSubSchemes(&updated, downloaded)
+}
+
+// removeDeleted removes the files in the current index of the scheme that the new index no longer
+// contains. Issuers and credential types of which the new index no longer contains the description
+// are removed entirely (see RemoveIssuer() and RemoveCredentialType()); their identifiers are
+// returned.
+func (conf *Configuration) removeDeleted(manager *SchemeManager, newIndex SchemeManagerIndex) (*IrmaIdentifierSet, error) {
+	removed := &IrmaIdentifierSet{
+		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[IssuerIdentifier]struct{}{},
+		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
+		PublicKeys:      map[IssuerIdentifier][]int{},
+	}
+	var files []string
+	for filename := range manager.index {
+		if _, ok := newIndex[filename]; ok {
+			continue
+		}
+		parts := strings.Split(filename, "/")
+		switch {
+		case len(parts) == 3 && parts[2] == "description.xml":
+			removed.Issuers[NewIssuerIdentifier(parts[0]+"."+parts[1])] = struct{}{}
+		case len(parts) == 5 && parts[2] == "Issues" && parts[4] == "description.xml":
+			removed.CredentialTypes[NewCredentialTypeIdentifier(parts[0]+"."+parts[1]+"."+parts[3])] = struct{}{}
+		default:
+			files = append(files, filename)
+		}
+	}
+
+	// The credential types of removed issuers are removed as well
+	for credid := range conf.CredentialTypes {
+		if _, ok := removed.Issuers[credid.IssuerIdentifier()]; ok {
+			removed.CredentialTypes[credid] = struct{}{}
+		}
+	}
+	for credid := range removed.CredentialTypes {
+		Logger.WithField("credentialtype", credid).Info("Removing credential type removed from its scheme")
+		if err := conf.RemoveCredentialType(credid, true); err != nil {
+			return nil, err
+		}
+	}
+	for issid := range removed.Issuers {
+		Logger.WithField("issuer", issid).Info("Removing issuer removed from its scheme")
+		if err := conf.RemoveIssuer(issid, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, filename := range files {
+		if err := conf.removeAll(filepath.Join(conf.Path, filepath.FromSlash(filename))); err != nil {
+			return nil, err
+		}
+	}
+
+	return removed, nil
 }
 
 func (conf *Configuration) UpdateSchemes() error {
@@ -1250,230 +1947,162 @@ func (conf *Configuration) UpdateSchemes() error {
 		Issuers:         map[IssuerIdentifier]struct{}{},
 		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
 	}
-	for id := range conf.SchemeManagers {
+	for id, manager := range conf.SchemeManagers {
+		if !manager.Parent.Empty() {
+			continue // updated along with its parent
+		}
 		Logger.WithField("scheme", id).Info("Auto-updating scheme")
 		if err := conf.UpdateSchemeManager(id, &updated); err != nil {
 			return err
 		}
 	}
-	if !updated.Empty() {
-		return conf.ParseFolder()
+	return conf.reparseUpdated(&updated)
+}
+
+// reparseUpdated reparses the configuration if anything was updated, and informs the UpdateHandler.
+func (conf *Configuration) reparseUpdated(updated *IrmaIdentifierSet) error {
+	if updated.Empty() {
+		return nil
+	}
+	if err := conf.ParseFolder(); err != nil {
+		return err
+	}
+	if conf.UpdateHandler != nil {
+		conf.UpdateHandler(updated)
 	}
 	return nil
 }
 
-func (conf *Configuration) AutoUpdateSchemes(interval uint) {
-	Logger.Infof("Updating schemes every %d minutes", interval)
+// UpdateScheme updates the specified scheme, reparsing the configuration if anything changed.
+func (conf *Configuration) UpdateScheme(id SchemeManagerIdentifier) error {
+	updated := IrmaIdentifierSet{
+		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
+		Issuers:         map[IssuerIdentifier]struct{}{},
+		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
+	}
+	if err := conf.UpdateSchemeManager(id, &updated); err != nil {
+		return err
+	}
+	return conf.reparseUpdated(&updated)
+}
 
-	conf.scheduler = gocron.NewScheduler()
-	conf.scheduler.Every(uint64(interval)).Minutes().Do(func() {
-		if err := conf.UpdateSchemes(); err != nil {
-			Logger.Error("Scheme autoupdater failed: ")
-			if e, ok := err.(*errors.Error); ok {
-				Logger.Error(e.ErrorStack())
-			} else {
-				Logger.Errorf("%s %s", reflect.TypeOf(err).String(), err.Error())
-			}
-		}
-	})
+// AutoUpdateSchemes starts an Updater that updates all schemes every interval minutes
+// (the first update happening shortly after calling this), and returns it.
+// As the Updater modifies conf from another goroutine, see the documentation of
+// Configuration on concurrent use.
+func (conf *Configuration) AutoUpdateSchemes(interval uint) *Updater {
+	if conf.updater != nil {
+		conf.updater.Stop()
+	}
+	conf.updater = NewUpdater(conf, time.Duration(interval)*time.Minute)
+	conf.updater.SetNetworkReachable(!conf.offline)
+	conf.updater.Start()
+	return conf.updater
+}
 
-	conf.cronchan = conf.scheduler.Start() // Schedule updates (first one in interval minutes from now)
-	go func() {                            // Run first update after a small delay
-		<-time.NewTimer(200 * time.Millisecond).C
-		conf.scheduler.RunAll()
-	}()
+// SetNetworkReachable informs the Configuration whether or not the network is reachable, so that
+// automatic scheme updates (see AutoUpdateSchemes()) are postponed while it is not.
+func (conf *Configuration) SetNetworkReachable(reachable bool) {
+	conf.offline = !reachable
+	if conf.updater != nil {
+		conf.updater.SetNetworkReachable(reachable)
+	}
+}
 
+// SchemeUpdater returns the Updater started by AutoUpdateSchemes, if any.
+func (conf *Configuration) SchemeUpdater() *Updater {
+	return conf.updater
 }
 
 func (conf *Configuration) StopAutoUpdateSchemes() {
-	if conf.cronchan != nil {
-		Logger.Info("Stopped scheme autoupdater")
-		conf.cronchan <- true
+	if conf.updater != nil {
+		conf.updater.Stop()
 	}
 }
 
+// Close stops automatic scheme updates, and wipes from memory all private keys that conf and its
+// snapshots have handed out (see WipePrivateKey()). Private keys requested afterwards are read
+// again from disk.
+func (conf *Configuration) Close() {
+	conf.StopAutoUpdateSchemes()
+	conf.mutex.Lock()
+	conf.privateKeys = make(map[IssuerIdentifier]map[int]*gabi.PrivateKey)
+	conf.mutex.Unlock()
+	conf.trackedKeys.wipe()
+}
+
 // Methods containing consistency checks on irma_configuration
 
 func (conf *Configuration) checkIssuer(manager *SchemeManager, issuer *Issuer, dir string) error {
+	report := &ValidationReport{}
+	defer conf.warnAll(report)
 	issuerid := issuer.Identifier()
-	conf.checkTranslations(fmt.Sprintf("Issuer %s", issuerid.String()), issuer)
-	// Check that the issuer has public keys
-	pkpath := fmt.Sprintf(pubkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-	files, err := filepath.Glob(pkpath)
-	if err != nil {
-		return err
-	}
-	if len(files) == 0 {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no public keys", issuerid.String()))
-	}
-
-	if filepath.Base(dir) != issuer.ID {
-		return errors.Errorf("Issuer %s has wrong directory name %s", issuerid.String(), filepath.Base(dir))
-	}
-	if manager.ID != issuer.SchemeManagerID {
-		return errors.Errorf("Issuer %s has wrong SchemeManager %s", issuerid.String(), issuer.SchemeManagerID)
-	}
-	if err = fs.AssertPathExists(dir + "/logo.png"); err != nil {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no logo.png", issuerid.String()))
-	}
-	return nil
+	LintTranslations(report, fmt.Sprintf("Issuer %s", issuerid.String()), issuerid.String(), issuer)
+	return LintIssuer(report, manager.ID, issuer, dir)
 }
 
 func (conf *Configuration) checkCredentialType(manager *SchemeManager, issuer *Issuer, cred *CredentialType, dir string) error {
+	report := &ValidationReport{}
+	defer conf.warnAll(report)
 	credid := cred.Identifier()
-	conf.checkTranslations(fmt.Sprintf("Credential type %s", credid.String()), cred)
-	if cred.XMLVersion < 4 {
-		return errors.New("Unsupported credential type description")
-	}
-	if cred.ID != filepath.Base(dir) {
-		return errors.Errorf("Credential type %s has wrong directory name %s", credid.String(), filepath.Base(dir))
-	}
-	if cred.IssuerID != issuer.ID {
-		return errors.Errorf("Credential type %s has wrong IssuerID %s", credid.String(), cred.IssuerID)
-	}
-	if cred.SchemeManagerID != manager.ID {
-		return errors.Errorf("Credential type %s has wrong SchemeManager %s", credid.String(), cred.SchemeManagerID)
-	}
-	if err := fs.AssertPathExists(dir + "/logo.png"); err != nil {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
-	}
-	return conf.checkAttributes(cred)
-}
-
-func (conf *Configuration) checkAttributes(cred *CredentialType) error {
-	name := cred.Identifier().String()
-	indices := make(map[int]struct{})
-	count := len(cred.AttributeTypes)
-	if count == 0 {
-		return errors.Errorf("Credenial type %s has no attributes", name)
-	}
-	for i, attr := range cred.AttributeTypes {
-		conf.checkTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr)
-		index := i
-		if attr.DisplayIndex != nil {
-			index = *attr.DisplayIndex
-		}
-		if index >= count {
-			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute displayIndex at attribute %d", name, i))
-		}
-		indices[index] = struct{}{}
+	LintTranslations(report, fmt.Sprintf("Credential type %s", credid.String()), credid.String(), cred)
+	if err := LintCredentialType(report, issuer, cred, dir); err != nil {
+		return err
 	}
-	if len(indices) != count {
-		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
+	for _, attr := range cred.AttributeTypes {
+		LintTranslations(report, fmt.Sprintf("Attribute %s of credential type %s", attr.ID, credid.String()), credid.String(), attr)
 	}
-	return nil
+	return LintAttributes(report, cred)
 }
 
 func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error {
-	if scheme.XMLVersion < 7 {
-		scheme.Status = SchemeManagerStatusParsingError
-		return errors.New("Unsupported scheme manager description")
-	}
-	if filepath.Base(dir) != scheme.ID {
+	report := &ValidationReport{}
+	defer conf.warnAll(report)
+	if err := LintScheme(report, scheme, dir); err != nil {
 		scheme.Status = SchemeManagerStatusParsingError
-		return errors.Errorf("Scheme %s has wrong directory name %s", scheme.ID, filepath.Base(dir))
-	}
-	if scheme.KeyshareServer != "" {
-		if err := fs.AssertPathExists(filepath.Join(dir, "kss-0.pem")); err != nil {
-			scheme.Status = SchemeManagerStatusParsingError
-			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID)
-		}
-	}
-	conf.checkTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme)
-	return nil
-}
-
-// checkTranslations checks for each member of the interface o that is of type TranslatedString
-// that it contains all necessary translations.
-func (conf *Configuration) checkTranslations(file string, o interface{}) {
-	langs := []string{"en", "nl"} // Hardcode these for now, TODO make configurable
-	v := reflect.ValueOf(o)
-
-	// Dereference in case of pointer or interface
-	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-		v = v.Elem()
+		return err
 	}
-
-	for i := 0; i < v.NumField(); i++ {
-		if v.Field(i).Type() == reflect.TypeOf(TranslatedString{}) {
-			val := v.Field(i).Interface().(TranslatedString)
-			for _, lang := range langs {
-				if _, exists := val[lang]; !exists {
-					conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s misses %s translation in <%s> tag", file, lang, v.Type().Field(i).Name))
-				}
+	if scheme.Environment == "" {
+		// Schemes not specifying their environment are production schemes, unless we know otherwise
+		scheme.Environment = SchemeEnvironmentProduction
+		for _, pointer := range DefaultSchemeManagers {
+			if pointer.Demo && filepath.Base(pointer.Url) == scheme.ID {
+				scheme.Environment = SchemeEnvironmentDemo
 			}
 		}
 	}
+	LintTranslations(report, fmt.Sprintf("Scheme %s", scheme.ID), scheme.ID, scheme)
+	return nil
 }
 
+// CheckKeys checks the public and private keys of all issuers, adding warnings about
+// expired or soon to expire public keys to conf.Warnings, and returning an error if a
+// private key does not match its public key.
 func (conf *Configuration) CheckKeys() error {
-	const expiryBoundary = int64(time.Hour/time.Second) * 24 * 31 // 1 month, TODO make configurable
+	report := &ValidationReport{}
+	err := conf.checkKeys(report)
+	conf.warnAll(report)
+	return err
+}
 
+func (conf *Configuration) checkKeys(report *ValidationReport) error {
 	for issuerid := range conf.Issuers {
 		if err := conf.parseKeysFolder(issuerid); err != nil {
 			return err
 		}
-		indices, err := conf.PublicKeyIndices(issuerid)
-		if err != nil {
-			return err
-		}
-		if len(indices) == 0 {
-			continue
-		}
-		latest, err := conf.PublicKey(issuerid, indices[len(indices)-1])
-		if err != nil {
-			return err
-		}
-		now := time.Now().Unix()
-		if latest == nil || latest.ExpiryDate < now {
-			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no nonexpired public keys", issuerid.String()))
-		}
-		if latest != nil && latest.ExpiryDate > now && latest.ExpiryDate < now+expiryBoundary {
-			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Latest public key of issuer %s expires soon (at %s)",
-				issuerid.String(), time.Unix(latest.ExpiryDate, 0).String()))
-		}
-
-		// Check private keys if any
-		privkeypath := fmt.Sprintf(privkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-		privkeys, err := filepath.Glob(privkeypath)
-		if err != nil {
-			return err
-		}
-		for _, privkey := range privkeys {
-			filename := filepath.Base(privkey)
-			count, err := strconv.Atoi(filename[:len(filename)-4])
-			if err != nil {
-				return err
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(privkey)
-			if err != nil {
-				return err
-			}
-			if int(sk.Counter) != count {
-				return errors.Errorf("Private key %s of issuer %s has wrong <Counter>", filename, issuerid.String())
-			}
-			pk, err := conf.PublicKey(issuerid, count)
-			if err != nil {
-				return err
-			}
-			if pk == nil {
-				return errors.Errorf("Private key %s of issuer %s has no corresponding public key", filename, issuerid.String())
-			}
-			if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
-				return errors.Errorf("Private key %s of issuer %s does not belong to public key %s", filename, issuerid.String(), filename)
-			}
-		}
-
-		// Check that the current public key supports enough attributes for all credential types
-		// issued by this issuer
+		var credtypes []*CredentialType
 		for id, typ := range conf.CredentialTypes {
-			if id.IssuerIdentifier() != issuerid {
-				continue
-			}
-			if len(typ.AttributeTypes)+2 > len(latest.R) {
-				return errors.Errorf("Latest public key of issuer %s does not support the amount of attributes that credential type %s requires (%d, required: %d)", issuerid.String(), id.String(), len(latest.R), len(typ.AttributeTypes)+2)
+			if id.IssuerIdentifier() == issuerid {
+				credtypes = append(credtypes, typ)
 			}
 		}
+		dir := filepath.Join(conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
+		conf.mutex.RLock()
+		pks := conf.publicKeys[issuerid]
+		conf.mutex.RUnlock()
+		if err := LintKeys(report, issuerid, dir, pks, credtypes, conf.KeyExpiryBoundary); err != nil {
+			return err
+		}
 	}
 
 	return nil
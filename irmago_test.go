@@ -1,19 +1,40 @@
 package irma
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 )
 
-func parseConfiguration(t *testing.T) *Configuration {
+func parseConfiguration(t testing.TB) *Configuration {
 	conf, err := NewConfiguration("testdata/irma_configuration")
 	require.NoError(t, err)
 	require.NoError(t, conf.ParseFolder())
@@ -190,6 +211,21 @@ func TestAttributeDisjunctionMarshaling(t *testing.T) {
 	disjunction.selected = &disjunction.Attributes[0]
 	disjunction.index = &index
 	require.True(t, disjunction.satisfied())
+
+	disjunction = AttributeDisjunction{}
+	attrsjson = `
+	{
+		"label": "Over 18",
+		"attributes": ["MijnOverheid.ageLower.over18"],
+		"reason": {"en": "To check your age", "nl": "Om je leeftijd te controleren"}
+	}`
+	require.NoError(t, json.Unmarshal([]byte(attrsjson), &disjunction))
+	require.Equal(t, "To check your age", disjunction.Reason["en"])
+	bts, err := json.Marshal(&disjunction)
+	require.NoError(t, err)
+	remarshaled := AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal(bts, &remarshaled))
+	require.Equal(t, disjunction.Reason, remarshaled.Reason)
 }
 
 func TestMetadataAttribute(t *testing.T) {
@@ -208,6 +244,21 @@ func TestMetadataAttribute(t *testing.T) {
 	}
 }
 
+func TestMetadataExpiry(t *testing.T) {
+	metadata := NewMetadataAttribute(0x02)
+	expiry := metadata.Expiry()
+
+	require.False(t, metadata.ExpiredAt(expiry.Add(-time.Minute), 0))
+	require.True(t, metadata.ExpiredAt(expiry.Add(time.Minute), 0))
+	require.False(t, metadata.ExpiredAt(expiry.Add(time.Minute), time.Hour))
+	require.True(t, metadata.ExpiredAt(expiry.Add(2*time.Hour), time.Hour))
+
+	require.False(t, metadata.ExpiresWithin(24*time.Hour))
+	require.True(t, metadata.ExpiresWithin(expiry.Sub(Now())+time.Hour))
+	defer SetClock(SetClock(FixedClock(expiry.Add(time.Hour))))
+	require.False(t, metadata.ExpiresWithin(24*time.Hour)) // already expired
+}
+
 func TestMetadataCompatibility(t *testing.T) {
 	conf, err := NewConfigurationReadOnly("testdata/irma_configuration")
 	require.NoError(t, err)
@@ -266,14 +317,20 @@ func TestServiceProvider(t *testing.T) {
 	require.NotNil(t, spjwt.Request.Request.Content.Find(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
 }
 
+// An attribute-based signature over irma-demo.RU.studentCard.studentID, and its request
+const (
+	testSignedMessageJson    = "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+	testSignatureRequestJson = "{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"
+)
+
 func TestVerifyValidSig(t *testing.T) {
 	conf := parseConfiguration(t)
 
-	irmaSignedMessageJson := "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+	irmaSignedMessageJson := testSignedMessageJson
 	irmaSignedMessage := &SignedMessage{}
 	json.Unmarshal([]byte(irmaSignedMessageJson), irmaSignedMessage)
 
-	request := "{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"
+	request := testSignatureRequestJson
 	sigRequestJSON := []byte(request)
 	sigRequest := &SignatureRequest{}
 	json.Unmarshal(sigRequestJSON, sigRequest)
@@ -307,6 +364,48 @@ func TestVerifyValidSig(t *testing.T) {
 	require.Equal(t, attrs[0].Value["en"], "456")
 }
 
+func TestVerifierConfiguration(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	listFiles := func() map[string]time.Time {
+		files := map[string]time.Time{}
+		require.NoError(t, filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err == nil {
+				files[file] = info.ModTime()
+			}
+			return err
+		}))
+		return files
+	}
+	before := listFiles()
+
+	vc, err := NewVerifierConfiguration(path)
+	require.NoError(t, err)
+	require.NotNil(t, vc.SchemeManager(NewSchemeManagerIdentifier("irma-demo")))
+	require.NotNil(t, vc.Issuer(NewIssuerIdentifier("irma-demo.RU")))
+	require.NotNil(t, vc.CredentialType(NewCredentialTypeIdentifier("irma-demo.RU.studentCard")))
+	require.NotNil(t, vc.AttributeType(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.Nil(t, vc.CredentialType(NewCredentialTypeIdentifier("irma-demo.RU.nonexisting")))
+	pk, err := vc.PublicKey(NewIssuerIdentifier("irma-demo.RU"), 2)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+
+	signature := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(testSignedMessageJson), signature))
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testSignatureRequestJson), request))
+	attrs, status, err := vc.VerifySignature(signature, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+	require.Len(t, attrs, 1)
+	require.Equal(t, "456", attrs[0].Value["en"])
+
+	// Nothing was written to the storage
+	require.Equal(t, before, listFiles())
+}
+
 func TestVerifyInValidSig(t *testing.T) {
 	conf := parseConfiguration(t)
 
@@ -360,6 +459,81 @@ func TestEmptySignature(t *testing.T) {
 	require.NotEqual(t, ProofStatusValid, status)
 }
 
+func TestExplainSignature(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(testSignedMessageJson), sm))
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testSignatureRequestJson), request))
+	require.Empty(t, sm.Explain(conf, request))
+	require.Empty(t, sm.Explain(conf, nil))
+
+	// Different message
+	request.Message = "I owe you nothing"
+	problems := sm.Explain(conf, request)
+	require.NotEmpty(t, problems)
+	require.Equal(t, ProofCheckNonceContext, problems[0].Check)
+
+	// Unsatisfied disjunction
+	require.NoError(t, json.Unmarshal([]byte(testSignatureRequestJson), request))
+	request.Content[0].Attributes = []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")}
+	problems = sm.Explain(conf, request)
+	require.Len(t, problems, 1)
+	require.Equal(t, ProofCheckDisjunction, problems[0].Check)
+	require.Equal(t, 0, problems[0].Disjunction)
+
+	// Modified challenge
+	sm = &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(strings.Replace(testSignedMessageJson, "pliyrSE7", "blablaE7", 1)), sm))
+	problems = sm.Explain(conf, nil)
+	require.Len(t, problems, 1)
+	require.Equal(t, ProofCheckHash, problems[0].Check)
+
+	// Credential expired at the time of the timestamp
+	sm.Timestamp = nil
+	defer SetClock(SetClock(FixedClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))))
+	problems = sm.Explain(conf, nil)
+	require.Len(t, problems, 2)
+	require.Equal(t, ProofCheckExpiry, problems[0].Check)
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), problems[0].Credential)
+	require.Equal(t, NewIssuerIdentifier("irma-demo.RU"), problems[0].Issuer)
+}
+
+func TestCredentialTypeErrors(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(testSignedMessageJson), sm))
+
+	// Credential type that lacks the disclosed attribute, as if the configuration were outdated
+	attrtypes := conf.CredentialTypes[credid].AttributeTypes
+	conf.CredentialTypes[credid].AttributeTypes = nil
+	_, _, err := sm.Verify(conf, nil)
+	require.IsType(t, &CredentialTypeError{}, err)
+	require.Equal(t, CredentialTypeMismatch, err.(*CredentialTypeError).Problem)
+	require.Equal(t, credid, err.(*CredentialTypeError).CredentialType)
+	problems := sm.Explain(conf, nil)
+	require.NotEmpty(t, problems)
+	require.Equal(t, ProofCheckCredentialType, problems[0].Check)
+	conf.CredentialTypes[credid].AttributeTypes = attrtypes
+
+	// Unknown credential type
+	reverseHashes := conf.reverseHashes
+	conf.reverseHashes = map[string]CredentialTypeIdentifier{}
+	_, _, err = sm.Verify(conf, nil)
+	require.IsType(t, &CredentialTypeError{}, err)
+	require.Equal(t, CredentialTypeUnknown, err.(*CredentialTypeError).Problem)
+	require.NotEmpty(t, err.(*CredentialTypeError).Hash)
+	conf.reverseHashes = reverseHashes
+
+	// Missing metadata attribute
+	delete(sm.Signature[0].(*gabi.ProofD).ADisclosed, 1)
+	_, _, err = sm.Verify(conf, nil)
+	require.IsType(t, &CredentialTypeError{}, err)
+	require.Equal(t, CredentialTypeNoMetadata, err.(*CredentialTypeError).Problem)
+}
+
 // Test attribute decoding with both old and new metadata versions
 func TestAttributeDecoding(t *testing.T) {
 	expected := "male"
@@ -371,4 +545,1985 @@ func TestAttributeDecoding(t *testing.T) {
 	oldAttribute, _ := new(big.Int).SetString("1835101285", 10)
 	oldString := decodeAttribute(oldAttribute, 2)
 	require.Equal(t, *oldString, expected)
+
+	// Scratch integers are zeroed when returned to the pool
+	bi := new(big.Int).SetBytes([]byte("a rather long attribute value"))
+	words := bi.Bits()
+	bi.Rsh(bi, 64)
+	putBigInt(bi)
+	require.Zero(t, bi.Sign())
+	for _, w := range words {
+		require.Zero(t, w)
+	}
+}
+
+func TestUpdaterBackoff(t *testing.T) {
+	u := NewUpdater(&Configuration{}, time.Hour)
+	u.Jitter = 0
+	u.MinBackoff = time.Minute
+	u.MaxBackoff = 10 * time.Minute
+
+	require.Equal(t, time.Minute, u.backoff(1))
+	require.Equal(t, 2*time.Minute, u.backoff(2))
+	require.Equal(t, 8*time.Minute, u.backoff(4))
+	require.Equal(t, 10*time.Minute, u.backoff(5))
+	require.Equal(t, 10*time.Minute, u.backoff(100))
+
+	u.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := u.jitter(time.Hour)
+		require.True(t, d >= 30*time.Minute && d <= 90*time.Minute)
+	}
+}
+
+func TestUpdaterNetworkReachability(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// While the network is unreachable, updates are postponed
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	conf.SetNetworkReachable(false)
+	updater := conf.AutoUpdateSchemes(60)
+	defer conf.StopAutoUpdateSchemes()
+	time.Sleep(3 * updaterInitialDelay)
+	require.True(t, updater.Status(schemeid).LastAttempt.IsZero())
+
+	// Once it is reachable again, the postponed updates are performed
+	conf.SetNetworkReachable(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for updater.Status(schemeid).LastAttempt.IsZero() {
+		require.True(t, time.Now().Before(deadline), "postponed update was not performed")
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestUpdaterConcurrentParse(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// Run with -race: the updater must not read the configuration while ParseFolder() swaps it
+	updater := NewUpdater(conf, time.Hour)
+	updater.Start()
+	defer updater.Stop()
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_ = updater.ForceUpdate(schemeid)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, conf.ParseFolder())
+	}
+	<-done
+}
+
+func TestRequestHash(t *testing.T) {
+	a := []byte(`{"type":"disclosing","content":[{"label":"Over 18","attributes":["irma-demo.MijnOverheid.ageLimits.over18"]}]}`)
+	b := []byte(`{
+		"content": [{"attributes": ["irma-demo.MijnOverheid.ageLimits.over18"], "label": "Over 18"}],
+		"type": "disclosing"
+	}`)
+
+	hashA, err := HashRequest(a)
+	require.NoError(t, err)
+	hashB, err := HashRequest(b)
+	require.NoError(t, err)
+	require.True(t, hashA.Equal(hashB))
+
+	request := &DisclosureRequest{}
+	require.NoError(t, json.Unmarshal(a, request))
+	hashC, err := HashRequest(request)
+	require.NoError(t, err)
+	require.True(t, hashA.Equal(hashC))
+
+	key := []byte("secret")
+	sig, err := SignRequestHash(b, jwt.SigningMethodHS256, key)
+	require.NoError(t, err)
+	require.NoError(t, VerifyRequestHash(request, sig, jwt.SigningMethodHS256, key))
+	request.Content[0].Label = NewLabel("Over 21")
+	require.Error(t, VerifyRequestHash(request, sig, jwt.SigningMethodHS256, key))
+}
+
+func TestEdDSAJwt(t *testing.T) {
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "requestor5-sk.pem"))
+	require.NoError(t, err)
+	sk, err := ParseEd25519PrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	bts, err = ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "requestor5.pem"))
+	require.NoError(t, err)
+	pk, err := ParseEd25519PublicKeyFromPEM(bts)
+	require.NoError(t, err)
+	bts, err = ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "requestor1.pem"))
+	require.NoError(t, err)
+	_, err = ParseEd25519PublicKeyFromPEM(bts)
+	require.Error(t, err)
+
+	j, err := jwt.NewWithClaims(SigningMethodEdDSA, &jwt.StandardClaims{Issuer: "requestor5"}).SignedString(sk)
+	require.NoError(t, err)
+	claims := &jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) { return pk, nil })
+	require.NoError(t, err)
+	require.Equal(t, "requestor5", claims.Issuer)
+
+	// Tampered JWTs, and keys of the wrong type, are rejected
+	other, err := jwt.NewWithClaims(SigningMethodEdDSA, &jwt.StandardClaims{Issuer: "other"}).SignedString(sk)
+	require.NoError(t, err)
+	tampered := other[:strings.LastIndex(other, ".")] + j[strings.LastIndex(j, "."):]
+	_, err = jwt.ParseWithClaims(tampered, claims, func(*jwt.Token) (interface{}, error) { return pk, nil })
+	require.Error(t, err)
+	_, err = jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) { return []byte("secret"), nil })
+	require.Error(t, err)
+}
+
+func TestJWKS(t *testing.T) {
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "requestor5-sk.pem"))
+	require.NoError(t, err)
+	edsk, err := ParseEd25519PrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	bts, err = ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "requestor4-sk.pem"))
+	require.NoError(t, err)
+	ecsk, err := jwt.ParseECPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	rsask, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []*JWK{
+		{KeyType: "OKP", KeyID: "ed", Curve: "Ed25519", X: b64(edsk.Public().(ed25519.PublicKey))},
+		{KeyType: "EC", KeyID: "ec", Curve: "P-256", X: b64(ecsk.X.Bytes()), Y: b64(ecsk.Y.Bytes())},
+		{KeyType: "EC", KeyID: "enc", Use: "enc", Curve: "P-256", X: b64(ecsk.X.Bytes()), Y: b64(ecsk.Y.Bytes())},
+	}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		bts, err := json.Marshal(map[string][]*JWK{"keys": keys})
+		require.NoError(t, err)
+		_, _ = w.Write(bts)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	defer SetClock(SetClock(FixedClock(now)))
+	jwks := NewJWKS(server.URL, nil)
+
+	pk, err := jwks.Key("ed")
+	require.NoError(t, err)
+	require.Equal(t, edsk.Public(), pk)
+	pk, err = jwks.Key("ec")
+	require.NoError(t, err)
+	require.Equal(t, &ecsk.PublicKey, pk)
+	_, err = jwks.Key("enc") // not a signature key
+	require.Error(t, err)
+	require.Equal(t, 1, fetches)
+
+	// Unknown keys cause the JWKS to be fetched again, but not too often
+	keys = append(keys, &JWK{KeyType: "RSA", KeyID: "rsa", N: b64(rsask.N.Bytes()), E: b64([]byte{1, 0, 1})})
+	_, err = jwks.Key("rsa")
+	require.Error(t, err)
+	require.Equal(t, 1, fetches)
+	SetClock(FixedClock(now.Add(2 * JWKSMinRefreshInterval)))
+	pk, err = jwks.Key("rsa")
+	require.NoError(t, err)
+	require.Equal(t, &rsask.PublicKey, pk)
+	require.Equal(t, 2, fetches)
+
+	// Cached keys expire after MaxAge
+	SetClock(FixedClock(now.Add(JWKSDefaultMaxAge + 3*JWKSMinRefreshInterval)))
+	_, err = jwks.Key("ed")
+	require.NoError(t, err)
+	require.Equal(t, 3, fetches)
+
+	// JWTs are verified using the key specified by their kid header
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &jwt.StandardClaims{Issuer: "test"})
+	token.Header["kid"] = "ec"
+	j, err := token.SignedString(ecsk)
+	require.NoError(t, err)
+	_, err = jwt.Parse(j, jwks.KeyFunc)
+	require.NoError(t, err)
+	token.Header["kid"] = "ed"
+	j, err = token.SignedString(ecsk)
+	require.NoError(t, err)
+	_, err = jwt.Parse(j, jwks.KeyFunc)
+	require.Error(t, err)
+
+	// Keyshare server keys are looked up in the JWKS of the scheme if present, and otherwise in the scheme
+	conf := parseConfiguration(t)
+	scheme := NewSchemeManagerIdentifier("test")
+	conf.SchemeManagers[scheme].KeyshareJWKS = server.URL
+	token.Header["kid"] = "ec"
+	pk, err = conf.KeyshareServerKeyFunc(scheme)(token)
+	require.NoError(t, err)
+	require.Equal(t, &ecsk.PublicKey, pk)
+	token.Header["kid"] = "0"
+	pk, err = conf.KeyshareServerKeyFunc(scheme)(token)
+	require.NoError(t, err)
+	require.IsType(t, &rsa.PublicKey{}, pk)
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sink := NewAuditFileSink(filepath.Join(dir, "audit.log"))
+
+	// Nothing is recorded without a sink
+	conf := parseConfiguration(t)
+	scheme := NewSchemeManagerIdentifier("test")
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = "0"
+	_, err = conf.KeyshareServerKeyFunc(scheme)(token)
+	require.NoError(t, err)
+	events, err := sink.Events()
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// Key uses are recorded in the sink
+	require.NoError(t, conf.AuditLog().SetSink(sink))
+	_, err = conf.KeyshareServerKeyFunc(scheme)(token)
+	require.NoError(t, err)
+	require.NoError(t, conf.AuditLog().Record(AuditEventIssuance, "irma-demo.RU-2", "irma-demo.RU.studentCard"))
+
+	// A new audit log continues the hash chain of the events in the sink
+	auditlog := &AuditLog{}
+	require.NoError(t, auditlog.SetSink(sink))
+	require.NoError(t, auditlog.Record(AuditEventIssuance, "irma-demo.RU-2", "irma-demo.RU.studentCard"))
+
+	events, err = sink.Events()
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.Equal(t, AuditEventKeyshareVerification, events[0].Type)
+	require.Equal(t, "test-0", events[0].Key)
+	require.Equal(t, AuditEventIssuance, events[1].Type)
+	require.Equal(t, "irma-demo.RU.studentCard", events[1].Subject)
+	require.Equal(t, uint64(3), events[2].Sequence)
+	require.NoError(t, VerifyAuditEvents(events))
+
+	// Modification and removal of events is detected
+	require.Error(t, VerifyAuditEvents([]*AuditEvent{events[0], events[2]}))
+	events[1].Subject = "irma-demo.MijnOverheid.root"
+	require.Error(t, VerifyAuditEvents(events))
+}
+
+func TestDisjunctionLabels(t *testing.T) {
+	// Plain string labels are accepted, and marshaled as plain strings again
+	plain := []byte(`{"label":"Over 18","attributes":["irma-demo.MijnOverheid.ageLimits.over18"]}`)
+	disjunction := &AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal(plain, disjunction))
+	require.Equal(t, "Over 18", disjunction.Label["en"])
+	require.Equal(t, "Over 18", disjunction.Label["nl"])
+	bts, err := json.Marshal(disjunction)
+	require.NoError(t, err)
+	require.JSONEq(t, string(plain), string(bts))
+
+	translated := []byte(`{"label":{"en":"Over 18","nl":"Ouder dan 18"},"attributes":["irma-demo.MijnOverheid.ageLimits.over18"]}`)
+	disjunction = &AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal(translated, disjunction))
+	require.Equal(t, TranslatedString{"en": "Over 18", "nl": "Ouder dan 18"}, disjunction.Label)
+	bts, err = json.Marshal(disjunction)
+	require.NoError(t, err)
+	require.JSONEq(t, string(translated), string(bts))
+
+	require.Error(t, json.Unmarshal([]byte(`{"label":1,"attributes":[]}`), disjunction))
+
+	// Labels end up in the disclosed attributes of the result
+	conf := parseConfiguration(t)
+	_, attrs, err := ProofList(nil).DisclosedAttributes(conf, AttributeDisjunctionList{disjunction})
+	require.NoError(t, err)
+	require.Len(t, attrs, 1)
+	require.Equal(t, AttributeProofStatusMissing, attrs[0].Status)
+	require.Equal(t, disjunction.Label, attrs[0].Label)
+}
+
+func TestQuery(t *testing.T) {
+	conf := parseConfiguration(t)
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	credtypes := conf.FindCredentialTypes(Query{Text: "studentenKAART"})
+	require.Len(t, credtypes, 1)
+	require.Equal(t, studentCard, credtypes[0].Identifier())
+	credtypes = conf.FindCredentialTypes(Query{Text: "studentenkaart", Language: "en"})
+	require.Empty(t, credtypes)
+	credtypes = conf.FindCredentialTypes(Query{Text: "student card", Issuer: NewIssuerIdentifier("irma-demo.RU")})
+	require.Len(t, credtypes, 1)
+	require.Equal(t, studentCard, credtypes[0].Identifier())
+
+	issuers := conf.FindIssuers(Query{Text: "radboud", Scheme: NewSchemeManagerIdentifier("irma-demo")})
+	require.Len(t, issuers, 1)
+	require.Equal(t, NewIssuerIdentifier("irma-demo.RU"), issuers[0].Identifier())
+
+	attrs := conf.FindAttributeTypes(Query{Text: "number", CredentialType: studentCard})
+	require.Len(t, attrs, 2)
+	require.Equal(t, "studentCardNumber", attrs[0].ID)
+	require.Equal(t, "studentID", attrs[1].ID)
+
+	// Display indices determine the order of the attributes
+	credtype := *conf.CredentialTypes[studentCard]
+	credtype.AttributeTypes = make([]*AttributeType, len(conf.CredentialTypes[studentCard].AttributeTypes))
+	for i, attr := range conf.CredentialTypes[studentCard].AttributeTypes {
+		copied := *attr
+		index := len(credtype.AttributeTypes) - 1 - i
+		copied.DisplayIndex = &index
+		credtype.AttributeTypes[i] = &copied
+	}
+	ordered := credtype.AttributeTypesInDisplayOrder()
+	require.Equal(t, "level", ordered[0].ID)
+	require.Equal(t, "university", ordered[len(ordered)-1].ID)
+}
+
+func TestVerifySchemeFileHashes(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.NoError(t, conf.VerifySchemeManager(scheme))
+	description := filepath.Join(path, "irma-demo", "RU", "description.xml")
+	info, err := os.Stat(description)
+	require.NoError(t, err)
+	require.True(t, conf.fileHashes.verified(description, info, scheme.index["irma-demo/RU/description.xml"]))
+
+	// A modified file is hashed again
+	bts, err := ioutil.ReadFile(description)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(description, append(bts, ' '), 0644))
+	require.Error(t, conf.VerifySchemeManager(scheme))
+
+	require.NoError(t, ioutil.WriteFile(description, bts, 0644))
+	require.NoError(t, conf.VerifySchemeManager(scheme))
+}
+
+func TestHTTPCache(t *testing.T) {
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("42"))
+	}))
+	defer server.Close()
+
+	transport := NewHTTPTransport(server.URL)
+	transport.SetCache(NewHTTPCache())
+	for i := 0; i < 3; i++ {
+		bts, err := transport.GetBytes("timestamp")
+		require.NoError(t, err)
+		require.Equal(t, "42", string(bts))
+	}
+	require.Equal(t, 3, requests)
+	require.Equal(t, 2, notModified)
+}
+
+func TestSchemeTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("42"))
+	}))
+	defer server.Close()
+
+	conf := parseConfiguration(t)
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+
+	// The certificate of the server is not trusted by default
+	_, err := conf.NewSchemeTransport(schemeid, server.URL).GetBytes("timestamp")
+	require.Error(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	conf.SetSchemeTransport(schemeid, &TransportSettings{TLSConfig: &tls.Config{RootCAs: pool}})
+	bts, err := conf.NewSchemeTransport(schemeid, server.URL).GetBytes("timestamp")
+	require.NoError(t, err)
+	require.Equal(t, "42", string(bts))
+
+	// The settings apply only to their own scheme, and to snapshots
+	_, err = conf.NewSchemeTransport(NewSchemeManagerIdentifier("test"), server.URL).GetBytes("timestamp")
+	require.Error(t, err)
+	_, err = conf.Snapshot().NewSchemeTransport(schemeid, server.URL).GetBytes("timestamp")
+	require.NoError(t, err)
+
+	conf.SetSchemeTransport(schemeid, nil)
+	_, err = conf.NewSchemeTransport(schemeid, server.URL).GetBytes("timestamp")
+	require.Error(t, err)
+}
+
+func TestSchemeKeyShares(t *testing.T) {
+	pk, shares, err := GenerateSchemeKeyShares(3, 5, nil)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	key, err := CombineSchemeKeyShares([]*SchemeKeyShare{shares[4], shares[0], shares[2]}, nil)
+	require.NoError(t, err)
+	require.Equal(t, pk.X, key.X)
+	require.Equal(t, pk.Y, key.Y)
+
+	_, err = CombineSchemeKeyShares(shares[:2], nil)
+	require.Error(t, err)
+
+	shares[1].Value.SetInt64(42)
+	_, err = CombineSchemeKeyShares(shares[:3], nil)
+	require.Error(t, err)
+}
+
+func TestConfigurationSnapshot(t *testing.T) {
+	conf := parseConfiguration(t)
+	snapshot := conf.Snapshot()
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	scheme := snapshot.SchemeManagers[schemeid]
+	credtype := snapshot.CredentialTypes[credid]
+	require.NotNil(t, scheme)
+	require.NotNil(t, credtype)
+
+	// Reparse the configuration repeatedly while a "session" uses the snapshot
+	done := make(chan struct{})
+	var parseErr error
+	go func() {
+		defer close(done)
+		for i := 0; i < 5 && parseErr == nil; i++ {
+			parseErr = conf.ParseFolder()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		require.True(t, scheme == snapshot.SchemeManagers[schemeid])
+		require.True(t, credtype == snapshot.CredentialTypes[credid])
+		_, err := snapshot.PublicKey(credid.IssuerIdentifier(), 2)
+		require.NoError(t, err)
+	}
+	<-done
+	require.NoError(t, parseErr)
+
+	// The configuration itself now contains freshly parsed instances, the snapshot does not
+	require.False(t, scheme == conf.SchemeManagers[schemeid])
+	require.True(t, scheme == snapshot.SchemeManagers[schemeid])
+	require.Error(t, snapshot.UpdateSchemeManager(schemeid, nil)) // snapshots are read-only
+
+	// Snapshots and reparsed configurations retain the settings of the configuration
+	conf.MaxSchemeAge = time.Hour
+	conf.Environments = []SchemeEnvironment{SchemeEnvironmentDemo}
+	require.Equal(t, time.Hour, conf.Snapshot().MaxSchemeAge)
+	require.NoError(t, conf.ParseFolder())
+	require.Equal(t, []SchemeEnvironment{SchemeEnvironmentDemo}, conf.Environments)
+
+	// If parsing fails, the configuration is left as it was
+	dir, err := ioutil.TempDir("", "irmaconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Symlink(filepath.Join(dir, "nonexisting"), filepath.Join(dir, "broken")))
+	scheme = conf.SchemeManagers[schemeid]
+	conf.Path = dir
+	require.Error(t, conf.ParseFolder())
+	require.True(t, scheme == conf.SchemeManagers[schemeid])
+}
+
+func TestPartialSchemeInstall(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Create a copy of the irma-demo scheme that contains only its root
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	require.NoError(t, os.RemoveAll(filepath.Join(path, "irma-demo", "RU")))
+	require.NoError(t, os.RemoveAll(filepath.Join(path, "irma-demo", "MijnOverheid")))
+	require.NoError(t, fs.SaveFile(filepath.Join(path, "irma-demo", partialSchemeMarker), nil))
+
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.True(t, conf.IsPartial(NewSchemeManagerIdentifier("irma-demo")))
+	require.Empty(t, conf.DisabledSchemeManagers)
+	var progress []SchemeProgress
+	conf.ProgressHandler = func(p SchemeProgress) {
+		progress = append(progress, p)
+	}
+
+	credid := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	require.NoError(t, conf.InstallCredentialType(credid))
+
+	// Progress is reported before and after each downloaded file
+	require.NotEmpty(t, progress)
+	last := progress[len(progress)-1]
+	require.Equal(t, NewSchemeManagerIdentifier("irma-demo"), last.Scheme)
+	require.Len(t, progress, last.FilesTotal+1)
+	require.Equal(t, last.FilesTotal, last.FilesCompleted)
+	require.NotZero(t, last.Bytes)
+	require.Contains(t, conf.CredentialTypes, credid)
+	require.Contains(t, conf.Issuers, credid.IssuerIdentifier())
+	pk, err := conf.PublicKey(credid.IssuerIdentifier(), 2)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+
+	// Other issuers and credential types of the scheme are not installed
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"))
+	require.NotContains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.RU"))
+
+	issid := NewIssuerIdentifier("irma-demo.RU")
+	require.NoError(t, conf.InstallIssuer(issid))
+	require.Contains(t, conf.Issuers, issid)
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+}
+
+func TestValidationReport(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	require.NoError(t, os.Remove(filepath.Join(path, "irma-demo", "RU", "logo.png")))
+
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	report := conf.Validate()
+	require.False(t, report.HasErrors())
+	found := false
+	for _, entry := range report.Entries {
+		if entry.Code == ValidationMissingLogo && entry.Identifier == "irma-demo.RU" {
+			require.Equal(t, SeverityWarning, entry.Severity)
+			found = true
+		}
+	}
+	require.True(t, found)
+	for _, entry := range report.Filter(SeverityWarning).Entries {
+		require.NotEqual(t, SeverityInfo, entry.Severity)
+	}
+
+	bts, err := json.Marshal(report.Entries[0])
+	require.NoError(t, err)
+	entry := &ValidationEntry{}
+	require.NoError(t, json.Unmarshal(bts, entry))
+	require.Equal(t, report.Entries[0], entry)
+
+	// Reparsing does not accumulate the entries of previous parses
+	require.NoError(t, conf.ParseFolder())
+	require.Len(t, conf.Validate().Entries, len(report.Entries))
+}
+
+func TestPruneSchemes(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	usage, err := conf.SchemeDiskUsage()
+	require.NoError(t, err)
+	freed, err := conf.PruneSchemes(nil, usage)
+	require.NoError(t, err)
+	require.Zero(t, freed)
+
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	keep := &IrmaIdentifierSet{
+		CredentialTypes: map[CredentialTypeIdentifier]struct{}{studentCard: {}},
+	}
+	freed, err = conf.PruneSchemes(keep, 0)
+	require.NoError(t, err)
+	require.NotZero(t, freed)
+	require.Empty(t, conf.DisabledSchemeManagers)
+
+	newUsage, err := conf.SchemeDiskUsage()
+	require.NoError(t, err)
+	require.Equal(t, usage-freed, newUsage)
+
+	require.True(t, conf.IsPartial(NewSchemeManagerIdentifier("irma-demo")))
+	require.Contains(t, conf.CredentialTypes, studentCard)
+	require.Contains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.RU"))
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"))
+	require.NotContains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.MijnOverheid"))
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	var readOnlyErr *ErrReadOnly
+	err = conf.DeleteSchemeManager(demo)
+	require.IsType(t, readOnlyErr, err)
+	err = conf.RemoveSchemeManager(demo, true)
+	require.IsType(t, readOnlyErr, err)
+	err = conf.UpdateSchemeManager(demo, nil)
+	require.IsType(t, readOnlyErr, err)
+	_, err = conf.PruneSchemes(nil, 0)
+	require.IsType(t, readOnlyErr, err)
+	require.Contains(t, conf.SchemeManagers, demo)
+	require.Contains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.RU"))
+
+	// In dry-run mode, writes are recorded but not performed
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	conf.SetDryRun(true)
+	require.NoError(t, conf.RemoveSchemeManager(demo, true))
+	require.NotContains(t, conf.SchemeManagers, demo)
+	require.Equal(t, []StorageWrite{{Operation: "remove", Path: filepath.Join(path, "irma-demo")}}, conf.DryRunWrites())
+	require.NoError(t, fs.AssertPathExists(filepath.Join(path, "irma-demo", "description.xml")))
+
+	conf.SetDryRun(false)
+	require.Empty(t, conf.DryRunWrites())
+}
+
+func TestSignScheme(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// The index computed from the scheme equals its signed index
+	index, err := SchemeIndex(filepath.Join("testdata", "irma_configuration", "irma-demo"))
+	require.NoError(t, err)
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "index"))
+	require.NoError(t, err)
+	expected := SchemeManagerIndex(make(map[string]ConfigurationFileHash))
+	require.NoError(t, expected.FromString(string(bts)))
+	require.Equal(t, expected, index)
+
+	// Sign a copy of the scheme with a new key
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(filepath.Join(path, "irma-demo"), sk))
+
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	require.NoError(t, conf.VerifySchemeManager(conf.SchemeManagers[demo]))
+
+	// Signatures over a modified index do not verify
+	bts, err = ioutil.ReadFile(filepath.Join(path, "irma-demo", "index"))
+	require.NoError(t, err)
+	sig, err := SignSchemeIndex(bts, sk)
+	require.NoError(t, err)
+	require.NoError(t, VerifySchemeIndexSignature(bts, sig, &sk.PublicKey))
+	require.Error(t, VerifySchemeIndexSignature(append(bts, '\n'), sig, &sk.PublicKey))
+	require.NoError(t, fs.SaveFile(filepath.Join(path, "irma-demo", "index"), append(bts, '\n')))
+	require.Error(t, conf.VerifySignature(demo))
+}
+
+func TestSchemeStore(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(filepath.Join(path, "irma-demo"), sk))
+
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	manager := conf.SchemeManagers[demo]
+	require.NoError(t, conf.storeSchemeVersion(manager, manager.index))
+	original := manager.Timestamp
+
+	// Files in the store are read from there, so only their name is checked
+	file := "irma-demo/RU/description.xml"
+	filename := filepath.Join(path, file)
+	bts, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filename, []byte("modified")))
+	read, found, err := conf.ReadAuthenticatedFile(manager, file)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, bts, read)
+
+	// Store a new version of the scheme in which the file is modified
+	time.Sleep(time.Second) // ensure the new version has a different timestamp
+	modified := append(append([]byte{}, bts...), []byte("<!-- modified -->\n")...)
+	require.NoError(t, fs.SaveFile(filename, modified))
+	require.NoError(t, SignScheme(filepath.Join(path, "irma-demo"), sk))
+	require.NoError(t, conf.ParseFolder())
+	manager = conf.SchemeManagers[demo]
+	require.NoError(t, conf.storeSchemeVersion(manager, manager.index))
+	versions, err := conf.SchemeVersions(demo)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+
+	// Roll back to the original version
+	require.NoError(t, conf.RollbackScheme(demo, original))
+	require.Equal(t, original.String(), conf.SchemeManagers[demo].Timestamp.String())
+	read, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, bts, read)
+	require.NoError(t, conf.VerifySchemeManager(conf.SchemeManagers[demo]))
+
+	// Pruning removes the newer version along with its modified file, but keeps the current one
+	require.NoError(t, conf.PruneSchemeVersions(0))
+	versions, err = conf.SchemeVersions(demo)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, original.String(), versions[0].String())
+	sum := sha256.Sum256(modified)
+	exists, err := fs.PathExists(conf.objectPath(sum[:]))
+	require.NoError(t, err)
+	require.False(t, exists)
+	sum = sha256.Sum256(bts)
+	exists, err = fs.PathExists(conf.objectPath(sum[:]))
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestConfigurationErrors(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	err = conf.UpdateSchemeManager(NewSchemeManagerIdentifier("foo"), nil)
+	require.True(t, errors.Is(err, ErrSchemeNotInstalled))
+
+	_, err = conf.KeyshareServerPublicKey(demo, 0)
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	require.False(t, errors.Is(err, ErrInvalidKey))
+
+	file := "irma-demo/RU/description.xml"
+	require.NoError(t, fs.SaveFile(filepath.Join(path, file), []byte("modified")))
+	_, _, err = conf.ReadAuthenticatedFile(conf.SchemeManagers[demo], file)
+	require.True(t, errors.Is(err, ErrHashMismatch))
+	var cerr *ConfigurationError
+	require.True(t, errors.As(err, &cerr))
+	require.Equal(t, ErrHashMismatch, cerr.Kind)
+
+	// Errors of schemes as a whole wrap the underlying typed error
+	bts, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "index"))
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(path, "irma-demo", "index"), append(bts, '\n')))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	err = conf.ParseFolder()
+	var mgrerr *SchemeManagerError
+	require.True(t, errors.As(err, &mgrerr))
+	require.True(t, errors.Is(err, ErrInvalidSignature))
+}
+
+func TestSchemeKeyRoles(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	dir := filepath.Join(path, "irma-demo")
+
+	// Declare a timestamp key in the scheme, and sign it
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tsk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bts, err := x509.MarshalPKIXPublicKey(&tsk.PublicKey)
+	require.NoError(t, err)
+	tpk := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
+	bts, err = ioutil.ReadFile(filepath.Join(dir, "description.xml"))
+	require.NoError(t, err)
+	bts = bytes.Replace(bts, []byte("</SchemeManager>"),
+		[]byte("<Keys><Key role=\"timestamp\">"+string(tpk)+"</Key></Keys></SchemeManager>"), 1)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "description.xml"), bts))
+	require.NoError(t, SignScheme(dir, sk))
+
+	// Without timestamp signature, the timestamp from the index is accepted
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NotNil(t, conf.SchemeManagers[demo].Key(SchemeKeyRoleTimestamp, 0))
+
+	// A timestamp signed by the timestamp key need not match the index
+	timestamp := []byte("2000000000\n")
+	sig, err := SignSchemeIndex(timestamp, tsk)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "timestamp"), timestamp))
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "timestamp.sig"), sig))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Equal(t, int64(2000000000), time.Time(conf.SchemeManagers[demo].Timestamp).Unix())
+
+	// but it must be signed by the timestamp key
+	sig, err = SignSchemeIndex(timestamp, sk)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "timestamp.sig"), sig))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.True(t, errors.Is(conf.ParseFolder(), ErrInvalidSignature))
+
+	// Keys may not be used for multiple roles
+	bts, err = x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	pk := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts}))
+	scheme := &SchemeManager{ID: "irma-demo", Keys: []SchemeKey{{Role: SchemeKeyRoleTimestamp, PublicKey: pk}}}
+	require.Error(t, lintSchemeKeys(scheme, dir))
+	scheme.Keys[0].PublicKey = string(tpk)
+	require.NoError(t, lintSchemeKeys(scheme, dir))
+
+	// Keyshare keys declared in the description take precedence over kss-*.pem files
+	testscheme := NewSchemeManagerIdentifier("test")
+	kss, err := ioutil.ReadFile(filepath.Join(path, "test", "kss-0.pem"))
+	require.NoError(t, err)
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	_ = conf.ParseFolder()
+	conf.SchemeManagers[testscheme].Keys = []SchemeKey{{Role: SchemeKeyRoleKeyshare, ID: 1, PublicKey: string(kss)}}
+	_, err = conf.KeyshareServerPublicKey(testscheme, 0)
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	_, err = conf.KeyshareServerPublicKey(testscheme, 1)
+	require.NoError(t, err)
+}
+
+func TestKeyshareKeyRollover(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewSchemeManagerIdentifier("test")
+	sk, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	bts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	kss := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
+
+	// Key 0 refers to kss-0.pem and is being phased out in favour of key 1
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(FixedClock(now)))
+	conf.SchemeManagers[id].Keys = []SchemeKey{
+		{Role: SchemeKeyRoleKeyshare, ID: 0, NotAfter: now.Add(time.Hour).Unix()},
+		{Role: SchemeKeyRoleKeyshare, ID: 1, NotBefore: now.Add(-time.Hour).Unix(), PublicKey: string(kss)},
+	}
+	require.NoError(t, lintSchemeKeys(conf.SchemeManagers[id], filepath.Join(conf.Path, "test")))
+
+	// During the overlap period both keys are accepted
+	_, err = conf.KeyshareServerPublicKey(id, 0)
+	require.NoError(t, err)
+	_, err = conf.KeyshareServerPublicKey(id, 1)
+	require.NoError(t, err)
+
+	// Afterwards the old key is rejected, even though it is cached
+	SetClock(FixedClock(now.Add(2 * time.Hour)))
+	_, err = conf.KeyshareServerPublicKey(id, 0)
+	require.True(t, errors.Is(err, ErrKeyExpired))
+	_, err = conf.KeyshareServerPublicKey(id, 1)
+	require.NoError(t, err)
+
+	// Keys not yet valid are rejected
+	SetClock(FixedClock(now.Add(-2 * time.Hour)))
+	_, err = conf.KeyshareServerPublicKey(id, 1)
+	require.True(t, errors.Is(err, ErrKeyExpired))
+
+	conf.SchemeManagers[id].Keys[0].NotBefore = conf.SchemeManagers[id].Keys[0].NotAfter
+	require.Error(t, lintSchemeKeys(conf.SchemeManagers[id], filepath.Join(conf.Path, "test")))
+}
+
+func TestSchemeFreshness(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	dir := filepath.Join(path, "irma-demo")
+
+	// Declare a timestamp key in the scheme and have it assert its freshness
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tsk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bts, err := x509.MarshalPKIXPublicKey(&tsk.PublicKey)
+	require.NoError(t, err)
+	tpk := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
+	bts, err = ioutil.ReadFile(filepath.Join(dir, "description.xml"))
+	require.NoError(t, err)
+	bts = bytes.Replace(bts, []byte("</SchemeManager>"), []byte("<AssertsFreshness>true</AssertsFreshness>"+
+		"<Keys><Key role=\"timestamp\">"+string(tpk)+"</Key></Keys></SchemeManager>"), 1)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "description.xml"), bts))
+	require.NoError(t, SignScheme(dir, sk))
+	require.NoError(t, AssertSchemeFreshness(dir, tsk))
+
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NotNil(t, conf.SchemeManagers[demo].Freshness)
+	require.Empty(t, conf.StaleSchemes())
+
+	// Schemes whose freshness was last asserted too long ago are stale
+	conf.MaxSchemeAge = time.Hour
+	require.False(t, conf.SchemeStale(demo))
+	old := Timestamp(time.Now().Add(-2 * time.Hour))
+	conf.SchemeManagers[demo].Freshness = &old
+	conf.SchemeManagers[demo].Timestamp = old
+	require.True(t, conf.SchemeStale(demo))
+	require.Contains(t, conf.StaleSchemes(), demo)
+
+	// A freshness assertion must be signed by the timestamp key
+	freshness, err := ioutil.ReadFile(filepath.Join(dir, "freshness"))
+	require.NoError(t, err)
+	sig, err := SignSchemeIndex(freshness, sk)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "freshness.sig"), sig))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.True(t, errors.Is(conf.ParseFolder(), ErrInvalidSignature))
+
+	// An assertion concerning another version of the scheme is ignored
+	f, err := parseFreshness(freshness)
+	require.NoError(t, err)
+	f.Timestamp = Timestamp(time.Unix(1000000000, 0))
+	freshness = []byte(f.String())
+	sig, err = SignSchemeIndex(freshness, tsk)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "freshness"), freshness))
+	require.NoError(t, fs.SaveFile(filepath.Join(dir, "freshness.sig"), sig))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Nil(t, conf.SchemeManagers[demo].Freshness)
+}
+
+func TestSubSchemes(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	testscheme := NewSchemeManagerIdentifier("test")
+
+	// Make irma-demo a sub-scheme of the test scheme, listing the specified public key
+	description, err := ioutil.ReadFile(filepath.Join(path, "test", "description.xml"))
+	require.NoError(t, err)
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	makeSubScheme := func(pk []byte) {
+		sub := "\t<SubSchemes><SubScheme><Id>irma-demo</Id><Url>http://localhost:48681/irma_configuration/irma-demo</Url>" +
+			"<PublicKey>" + string(pk) + "</PublicKey></SubScheme></SubSchemes>\n</SchemeManager>"
+		bts := bytes.Replace(description, []byte("</SchemeManager>"), []byte(sub), 1)
+		require.NoError(t, fs.SaveFile(filepath.Join(path, "test", "description.xml"), bts))
+		require.NoError(t, SignScheme(filepath.Join(path, "test"), sk))
+	}
+
+	pk, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "pk.pem"))
+	require.NoError(t, err)
+	makeSubScheme(pk)
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Empty(t, conf.DisabledSchemeManagers)
+	require.Equal(t, testscheme, conf.SchemeManagers[demo].Parent)
+	require.True(t, conf.SchemeManagers[demo].Valid)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+
+	// A sub-scheme whose public key is not the one listed by its parent is disabled
+	otherSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherPk, err := x509.MarshalPKIXPublicKey(&otherSk.PublicKey)
+	require.NoError(t, err)
+	makeSubScheme(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherPk}))
+	conf, err = NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.Error(t, conf.ParseFolder())
+	require.Contains(t, conf.DisabledSchemeManagers, demo)
+	require.False(t, conf.SchemeManagers[demo].Valid)
+	require.True(t, conf.SchemeManagers[testscheme].Valid)
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+}
+
+func TestConcurrentConfigurationAccess(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuer := NewIssuerIdentifier("irma-demo.RU")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, conf.ParseFolder())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		pk, err := conf.PublicKey(issuer, 2)
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		snapshot := conf.Snapshot()
+		require.Contains(t, snapshot.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+		_, err = snapshot.KeyshareServerPublicKey(NewSchemeManagerIdentifier("test"), 0)
+		require.NoError(t, err)
+	}
+}
+
+func TestSchemeCache(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NoError(t, fs.AssertPathExists(filepath.Join(path, "irma-demo", schemeCacheFilename)))
+
+	// Parsing again uses the cache, with the same result
+	cached, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, cached.ParseFolder())
+	require.Equal(t, len(conf.Issuers), len(cached.Issuers))
+	require.Equal(t, len(conf.CredentialTypes), len(cached.CredentialTypes))
+	require.Equal(t, len(conf.AttributeTypes), len(cached.AttributeTypes))
+	require.Equal(t, conf.reverseHashes, cached.reverseHashes)
+	for id, attr := range conf.AttributeTypes {
+		require.Contains(t, cached.AttributeTypes, id)
+		require.Equal(t, attr.Index, cached.AttributeTypes[id].Index)
+		require.Equal(t, attr.DisplayIndex, cached.AttributeTypes[id].DisplayIndex)
+		require.Equal(t, attr.Name["en"], cached.AttributeTypes[id].Name["en"])
+	}
+	require.Equal(t, conf.validation, cached.validation)
+
+	// Modifying a file invalidates the cache, so that the modification is detected
+	descpath := filepath.Join(path, "irma-demo", "RU", "Issues", "studentCard", "description.xml")
+	bts, err := ioutil.ReadFile(descpath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(descpath, append(bts, '\n'), 0600))
+	modified, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.Error(t, modified.ParseFolder())
+	require.Contains(t, modified.DisabledSchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+}
+
+func TestSchemeCacheEncoding(t *testing.T) {
+	deprecated := Timestamp(time.Unix(1500000000, 0))
+	cred := &CredentialType{
+		ID:              "studentCard",
+		IssuerID:        "RU",
+		SchemeManagerID: "irma-demo",
+		Dependencies:    []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")},
+		DeprecatedSince: &deprecated,
+		ObsoletedBy:     NewCredentialTypeIdentifier("irma-demo.RU.studentCardV2"),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(&schemeCache{CredentialTypes: []*CredentialType{cred}}))
+	decoded := &schemeCache{}
+	require.NoError(t, gob.NewDecoder(&buf).Decode(decoded))
+	require.Len(t, decoded.CredentialTypes, 1)
+	require.Equal(t, cred.Dependencies, decoded.CredentialTypes[0].Dependencies)
+	require.True(t, time.Time(deprecated).Equal(time.Time(*decoded.CredentialTypes[0].DeprecatedSince)))
+	require.Equal(t, cred.ObsoletedBy, decoded.CredentialTypes[0].ObsoletedBy)
+}
+
+func TestCredentialTypeDependencies(t *testing.T) {
+	cred := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4"><Dependencies>
+		<CredentialType>irma-demo.MijnOverheid.root</CredentialType>
+	</Dependencies></IssueSpecification>`), cred))
+	require.Equal(t, []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")}, cred.Dependencies)
+
+	conf := parseConfiguration(t)
+	root := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	fullName := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	conf.CredentialTypes[fullName].Dependencies = []CredentialTypeIdentifier{root}
+	conf.CredentialTypes[studentCard].Dependencies = []CredentialTypeIdentifier{fullName}
+
+	deps, err := conf.Dependencies(studentCard)
+	require.NoError(t, err)
+	require.Equal(t, []CredentialTypeIdentifier{fullName}, deps)
+	_, err = conf.Dependencies(NewCredentialTypeIdentifier("irma-demo.RU.nonexisting"))
+	require.Error(t, err)
+
+	order, err := conf.IssuanceOrder(studentCard)
+	require.NoError(t, err)
+	require.Equal(t, []CredentialTypeIdentifier{root, fullName, studentCard}, order)
+	require.Nil(t, conf.DependencyCycle())
+
+	conf.CredentialTypes[root].Dependencies = []CredentialTypeIdentifier{studentCard}
+	_, err = conf.IssuanceOrder(studentCard)
+	require.Error(t, err)
+	require.Len(t, conf.DependencyCycle(), 3)
+	var found bool
+	for _, entry := range conf.Validate().Entries {
+		if entry.Code == ValidationDependencyCycle {
+			found = true
+			require.Equal(t, SeverityError, entry.Severity)
+		}
+	}
+	require.True(t, found)
+}
+
+func TestAttributeFormats(t *testing.T) {
+	for _, c := range []struct {
+		format    AttributeFormat
+		value     string
+		canonical string
+		valid     bool
+	}{
+		{AttributeFormat{Type: AttributeFormatPhone, Canonicalization: "trim"}, " 0031 (6) 1234-5678", "+31612345678", true},
+		{AttributeFormat{Type: AttributeFormatPhone}, "06 12345678", "0612345678", false},
+		{AttributeFormat{Type: AttributeFormatDate}, "2000-01-31", "2000-01-31", true},
+		{AttributeFormat{Type: AttributeFormatDate}, "2000-02-30", "2000-02-30", false},
+		{AttributeFormat{Type: AttributeFormatEmail, Canonicalization: "trim"}, "Alice@Example.COM ", "alice@example.com", true},
+		{AttributeFormat{Type: AttributeFormatInteger}, "007", "007", false},
+		{AttributeFormat{Canonicalization: "collapsespaces,uppercase", Pattern: "[A-Z]{2} [0-9]+"}, " ab   12", "AB 12", true},
+		{AttributeFormat{Pattern: "[A-Z]{2}"}, "ABC", "ABC", false},
+	} {
+		require.NoError(t, c.format.parse())
+		canonical := c.format.Canonicalize(c.value)
+		require.Equal(t, c.canonical, canonical)
+		require.Equal(t, c.valid, c.format.Validate(canonical) == nil, "%s", c.value)
+	}
+
+	require.Error(t, (&AttributeFormat{Type: "unknown"}).parse())
+	require.Error(t, (&AttributeFormat{Canonicalization: "trim,unknown"}).parse())
+	require.Error(t, (&AttributeFormat{Pattern: "("}).parse())
+
+	// Formats are enforced on credential requests
+	conf := parseConfiguration(t)
+	id := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	conf.AttributeTypes[id].Format = &AttributeFormat{Canonicalization: "trim,lowercase", Pattern: "s[0-9]+"}
+	require.NoError(t, conf.AttributeTypes[id].Format.parse())
+	value, err := conf.CanonicalAttributeValue(id, " S1234567 ")
+	require.NoError(t, err)
+	require.Equal(t, "s1234567", value)
+	_, err = conf.CanonicalAttributeValue(id, "1234567")
+	require.Error(t, err)
+
+	request := &CredentialRequest{
+		CredentialTypeID: id.CredentialTypeIdentifier(),
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "S1234567",
+			"level":             "42",
+		},
+	}
+	require.Error(t, request.Validate(conf))
+	request.Canonicalize(conf)
+	require.Equal(t, "s1234567", request.Attributes["studentID"])
+	require.NoError(t, request.Validate(conf))
+}
+
+func TestDeprecation(t *testing.T) {
+	cred := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<DeprecatedSince>1546300800</DeprecatedSince>
+		<ObsoletedBy>irma-demo.MijnOverheid.fullName</ObsoletedBy>
+	</IssueSpecification>`), cred))
+	require.NotNil(t, cred.DeprecatedSince)
+	require.Equal(t, int64(1546300800), time.Time(*cred.DeprecatedSince).Unix())
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"), cred.ObsoletedBy)
+	require.True(t, cred.IsDeprecated(time.Now()))
+	require.False(t, cred.IsDeprecated(time.Unix(1546300799, 0)))
+
+	conf := parseConfiguration(t)
+	require.Empty(t, conf.DeprecatedCredentialTypes())
+	require.Empty(t, conf.DeprecatedAttributeTypes())
+
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	studentID := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	conf.CredentialTypes[studentCard].DeprecatedSince = cred.DeprecatedSince
+	conf.CredentialTypes[studentCard].ObsoletedBy = cred.ObsoletedBy
+	conf.AttributeTypes[studentID].DeprecatedSince = cred.DeprecatedSince
+	require.Equal(t, []CredentialTypeIdentifier{studentCard}, conf.DeprecatedCredentialTypes())
+	require.Equal(t, []AttributeTypeIdentifier{studentID}, conf.DeprecatedAttributeTypes())
+
+	request := &DisclosureRequest{Content: AttributeDisjunctionList{
+		{Attributes: []AttributeTypeIdentifier{studentID, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")}},
+		{Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")}},
+	}}
+	require.Equal(t, []string{
+		"Credential type irma-demo.RU.studentCard is deprecated since 2019-01-01, use irma-demo.MijnOverheid.fullName instead",
+		"Attribute type irma-demo.RU.studentCard.studentID is deprecated since 2019-01-01",
+	}, conf.Deprecations(request))
+}
+
+func TestSessionErrorClass(t *testing.T) {
+	require.Equal(t, ErrorClassRetryable, (&SessionError{ErrorType: ErrorTransport}).Class())
+	require.Equal(t, ErrorClassUserActionable, (&SessionError{ErrorType: ErrorRejected}).Class())
+	require.Equal(t, ErrorClassFatal, (&SessionError{ErrorType: ErrorCrypto}).Class())
+	require.Equal(t, ErrorClassFatal, (&SessionError{}).Class())
+
+	require.Equal(t, ErrorClassRetryable, (&SessionError{ErrorType: ErrorServerResponse, RemoteStatus: 503}).Class())
+	require.Equal(t, ErrorClassFatal, (&SessionError{ErrorType: ErrorServerResponse, RemoteStatus: 500}).Class())
+	require.Equal(t, ErrorClassUserActionable, (&SessionError{
+		ErrorType:    ErrorApi,
+		RemoteStatus: 400,
+		RemoteError:  &RemoteError{Status: 400, ErrorName: "SESSION_UNKNOWN"},
+	}).Class())
+	require.Equal(t, ErrorClassRetryable, (&SessionError{ErrorType: ErrorKeyshare}).Class())
+	require.Equal(t, ErrorClassUserActionable, (&SessionError{
+		ErrorType:   ErrorKeyshare,
+		RemoteError: &RemoteError{Status: 403, ErrorName: "USER_BLOCKED"},
+	}).Class())
+
+	err := &SessionError{ErrorType: ErrorTransport, Step: StepResponse}
+	require.Contains(t, err.Error(), "Protocol step: response")
+}
+
+func TestErrorRegistry(t *testing.T) {
+	require.Equal(t, ErrorCode(1002), ErrorTransport.Code())
+	require.Equal(t, ErrorCodeUnknown, ErrorType("").Code())
+	require.Equal(t, ErrorCodeUnknown, ErrorType("nonexisting").Code())
+	require.Equal(t, ErrorCode(1006), (&SessionError{ErrorType: ErrorRejected}).Code())
+
+	e, ok := LookupErrorCode(1013)
+	require.True(t, ok)
+	require.Equal(t, string(ErrorUnknownSchemeManager), e.Name)
+	require.Equal(t, ErrorOriginClient, e.Origin)
+	_, ok = LookupError(ErrorOriginServer, string(ErrorTransport))
+	require.False(t, ok)
+
+	errs := RegisteredErrors()
+	require.NotEmpty(t, errs)
+	for i := 1; i < len(errs); i++ {
+		require.True(t, errs[i-1].Code < errs[i].Code)
+	}
+	require.Panics(t, func() {
+		RegisterError(RegisteredError{Code: ErrorTransport.Code(), Name: "duplicate", Origin: ErrorOriginClient})
+	})
+}
+
+func TestVerificationTranscript(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(testSignedMessageJson), sm))
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testSignatureRequestJson), request))
+
+	transcript, err := NewSignatureTranscript(conf, request, sm)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, transcript.Status)
+	require.Contains(t, transcript.SchemeFiles, "irma-demo/RU/Issues/studentCard/description.xml")
+	require.NotContains(t, transcript.SchemeFiles, "irma-demo/MijnOverheid/description.xml")
+
+	var buf bytes.Buffer
+	require.NoError(t, transcript.WriteArchive(conf, &buf))
+	archive := bytes.NewReader(buf.Bytes())
+	reread, attrs, status, err := VerifyTranscriptArchive(archive, int64(buf.Len()), conf)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+	require.Equal(t, transcript.SchemeFingerprint, reread.SchemeFingerprint)
+	require.Len(t, attrs, 1)
+	require.Equal(t, "456", attrs[0].Value["en"])
+}
+
+func TestSchemeEnvironments(t *testing.T) {
+	conf := parseConfiguration(t)
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	require.Equal(t, SchemeEnvironmentDemo, conf.SchemeManagers[demo].Environment)
+	require.Equal(t, SchemeEnvironmentProduction, conf.SchemeManagers[NewSchemeManagerIdentifier("test")].Environment)
+	require.True(t, conf.EnvironmentAllowed(demo))
+
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(testSignedMessageJson), sm))
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(testSignatureRequestJson), request))
+
+	conf.Environments = []SchemeEnvironment{SchemeEnvironmentProduction}
+	require.False(t, conf.EnvironmentAllowed(demo))
+	_, status, err := sm.Verify(conf, request)
+	require.Error(t, err)
+	require.Equal(t, ProofStatusInvalid, status)
+
+	conf.Environments = []SchemeEnvironment{SchemeEnvironmentProduction, SchemeEnvironmentDemo}
+	_, status, err = sm.Verify(conf, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+}
+
+func TestUpdateRemovesDeletedParts(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Install a copy of irma-demo signed using a new key, served from the test storage
+	remote := filepath.Join("testdata", "storage", "test", "remote", "irma-demo")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), remote))
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clock := SetClock(FixedClock(time.Now().Add(-time.Hour)))
+	require.NoError(t, SignScheme(remote, sk))
+	SetClock(clock)
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(remote, filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Empty(t, conf.DisabledSchemeManagers)
+
+	// Remove a credential type and an issuer from the remote scheme
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	mijnOverheid := NewIssuerIdentifier("irma-demo.MijnOverheid")
+	require.Contains(t, conf.CredentialTypes, studentCard)
+	require.Contains(t, conf.Issuers, mijnOverheid)
+	require.NoError(t, os.RemoveAll(filepath.Join(remote, "RU", "Issues", "studentCard")))
+	require.NoError(t, os.RemoveAll(filepath.Join(remote, "MijnOverheid")))
+	require.NoError(t, SignScheme(remote, sk))
+
+	var removed *IrmaIdentifierSet
+	conf.RemovalHandler = func(ids *IrmaIdentifierSet) { removed = ids }
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	conf.SchemeManagers[schemeid].URL = "http://localhost:48681/storage/test/remote/irma-demo"
+	require.NoError(t, conf.UpdateScheme(schemeid))
+
+	// The removed parts are removed from the configuration and from disk
+	require.NotNil(t, removed)
+	require.Contains(t, removed.CredentialTypes, studentCard)
+	require.Contains(t, removed.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"))
+	require.Contains(t, removed.Issuers, mijnOverheid)
+	require.NotContains(t, conf.CredentialTypes, studentCard)
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NotContains(t, conf.Issuers, mijnOverheid)
+	require.Contains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.RU"))
+	require.Empty(t, conf.DisabledSchemeManagers)
+	require.NoError(t, fs.AssertPathNotExists(
+		filepath.Join(path, "irma-demo", "RU", "Issues", "studentCard"),
+		filepath.Join(path, "irma-demo", "MijnOverheid"),
+	))
+}
+
+func TestBootstrapSchemes(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	pkbts, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "pk.pem"))
+	require.NoError(t, err)
+	schemepk, err := ParsePemEcdsaPublicKey(pkbts)
+	require.NoError(t, err)
+	fingerprint, err := SchemeKeyFingerprint(schemepk)
+	require.NoError(t, err)
+
+	// Publish a signed scheme list in the test storage
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	listpath := filepath.Join("testdata", "storage", "test", "schemes.json")
+	publish := func(fingerprint string) {
+		list, err := json.Marshal(&SchemeList{Schemes: []*SchemeListEntry{{
+			ID:                   NewSchemeManagerIdentifier("irma-demo"),
+			URL:                  "http://localhost:48681/irma_configuration/irma-demo",
+			PublicKeyFingerprint: fingerprint,
+		}}})
+		require.NoError(t, err)
+		sig, err := SignSchemeList(list, sk)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(listpath, list, 0600))
+		require.NoError(t, ioutil.WriteFile(listpath+".sig", sig, 0600))
+	}
+	url := "http://localhost:48681/storage/test/schemes.json"
+
+	newConf := func(name string) *Configuration {
+		path := filepath.Join("testdata", "storage", "test", name)
+		require.NoError(t, fs.EnsureDirectoryExists(path))
+		conf, err := NewConfiguration(path)
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		return conf
+	}
+
+	// The list must be signed by the expected publisher
+	publish(fingerprint)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	conf := newConf("other")
+	require.Error(t, conf.BootstrapSchemes(url, &other.PublicKey))
+	require.Empty(t, conf.SchemeManagers)
+
+	// The scheme public key must match the pinned fingerprint
+	publish(strings.Repeat("00", sha256.Size))
+	conf = newConf("mismatch")
+	err = conf.BootstrapSchemes(url, &sk.PublicKey)
+	require.Error(t, err)
+	require.Empty(t, conf.SchemeManagers)
+
+	publish(fingerprint)
+	conf = newConf("bootstrapped")
+	require.NoError(t, conf.BootstrapSchemes(url, &sk.PublicKey))
+	require.Contains(t, conf.SchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Empty(t, conf.DisabledSchemeManagers)
+
+	// Bootstrapping again leaves installed schemes alone
+	require.NoError(t, conf.BootstrapSchemes(url, &sk.PublicKey))
+}
+
+func TestSchemeMirrors(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// The main URL of the scheme is down, but its mirror serves an updated version of the scheme
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	scheme := conf.SchemeManagers[schemeid]
+	unreachable := "http://localhost:48689/irma_configuration/irma-demo"
+	mirror := "http://localhost:48681/irma_configuration_updated/irma-demo"
+	scheme.URL = unreachable
+	scheme.Mirrors = []string{mirror}
+
+	require.NoError(t, conf.UpdateSchemeManager(schemeid, nil))
+	require.Equal(t, []string{mirror, unreachable}, conf.mirrors.order(scheme.URLs()))
+
+	// Once the main URL is healthy again it is preferred
+	conf.mirrors.succeeded(unreachable)
+	require.Equal(t, []string{unreachable, mirror}, conf.mirrors.order(scheme.URLs()))
+}
+
+// useFixtureKeyPairs makes GenerateIssuerKeypair() return the (1024-bit) fixture keypair of
+// irma-demo.MijnOverheid having the requested counter, expiry date and amount of attributes,
+// instead of generating a new keypair. The returned function restores the key generator.
+func useFixtureKeyPairs(t *testing.T) func() {
+	dir := filepath.Join("testdata", "irma_configuration", "irma-demo", "MijnOverheid")
+	generateKeyPair = func(params *gabi.SystemParameters, numAttributes int, counter uint, expiryDate time.Time) (*gabi.PrivateKey, *gabi.PublicKey, error) {
+		sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(dir, "PrivateKeys", "2.xml"))
+		require.NoError(t, err)
+		pk, err := gabi.NewPublicKeyFromFile(filepath.Join(dir, "PublicKeys", "2.xml"))
+		require.NoError(t, err)
+		require.Equal(t, int(params.Ln), pk.N.BitLen())
+		require.True(t, numAttributes <= len(pk.R))
+
+		pk.R = pk.R[:numAttributes]
+		sk.Counter, pk.Counter = counter, counter
+		sk.ExpiryDate, pk.ExpiryDate = expiryDate.Unix(), expiryDate.Unix()
+		return sk, pk, nil
+	}
+	return func() { generateKeyPair = gabi.GenerateKeyPair }
+}
+
+func TestRotateIssuerKey(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useFixtureKeyPairs(t)()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// All private keys of the issuer are available, not just the latest
+	id := NewIssuerIdentifier("irma-demo.RU")
+	sk, err := conf.PrivateKey(id, 1)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(1), sk.Counter)
+	sk, err = conf.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+	sk, err = conf.PrivateKey(id, 3)
+	require.NoError(t, err)
+	require.Nil(t, sk)
+
+	sk, err = conf.RotateIssuerKey(id)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), sk.Counter)
+	latest, err := conf.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.Equal(t, sk, latest)
+
+	// After re-signing the scheme, the new public key belongs to the new private key
+	schemesk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(filepath.Join(path, "irma-demo"), schemesk))
+	conf, err = NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	pk, err := conf.PublicKey(id, 3)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Equal(t, 0, new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N))
+	require.True(t, time.Unix(pk.ExpiryDate, 0).After(time.Now()))
+}
+
+func TestGenerateIssuerKeypair(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	defer useFixtureKeyPairs(t)()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	_, err = conf.GenerateIssuerKeypair(NewIssuerIdentifier("irma-demo.RU"), 1000, 6, time.Hour)
+	require.Error(t, err)
+
+	// The first key of an issuer gets counter 0
+	id := NewIssuerIdentifier("irma-demo.NewIssuer")
+	sk, err := conf.GenerateIssuerKeypair(id, 1024, 6, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), sk.Counter)
+	sk, err = conf.GenerateIssuerKeypair(id, 1024, 6, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), sk.Counter)
+
+	indices, err := conf.PublicKeyIndices(id)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, indices)
+	indices, err = conf.PrivateKeyIndices(id)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, indices)
+	bts, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "NewIssuer", "PublicKeys", "1.xml"))
+	require.NoError(t, err)
+	require.Contains(t, string(bts), "<Counter>1</Counter>")
+
+	// In dry-run mode the key is returned, but neither written nor installed
+	conf.SetDryRun(true)
+	sk, err = conf.GenerateIssuerKeypair(id, 1024, 6, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+	require.Equal(t, []StorageWrite{
+		{Operation: "write", Path: filepath.Join(path, "irma-demo", "NewIssuer", "PrivateKeys", "2.xml")},
+		{Operation: "write", Path: filepath.Join(path, "irma-demo", "NewIssuer", "PublicKeys", "2.xml")},
+	}, conf.DryRunWrites())
+	indices, err = conf.PrivateKeyIndices(id)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, indices)
+}
+
+type reversingDecrypter struct{}
+
+func (reversingDecrypter) DecryptPrivateKey(ciphertext []byte) ([]byte, error) {
+	plaintext := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		plaintext[len(ciphertext)-1-i] = b
+	}
+	return plaintext, nil
+}
+
+func TestPrivateKeyRing(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	conf := parseConfiguration(t)
+
+	id := NewIssuerIdentifier("irma-demo.RU")
+	ring, err := NewPrivateKeyRingPath(filepath.Join("testdata", "privatekeys"), conf, nil)
+	require.NoError(t, err)
+	sk, err := ring.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	sk, err = ring.PrivateKey(id, int(sk.Counter))
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+
+	// Encrypted private keys are decrypted when read
+	path := filepath.Join("testdata", "storage", "test", "privatekeys")
+	require.NoError(t, fs.EnsureDirectoryExists(path))
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "privatekeys", "irma-demo.RU.xml"))
+	require.NoError(t, err)
+	encrypted, err := reversingDecrypter{}.DecryptPrivateKey(bts)
+	require.NoError(t, err)
+	require.NoError(t, fs.SaveFile(filepath.Join(path, "irma-demo.RU.xml"), encrypted))
+	_, err = NewPrivateKeyRingPath(path, conf, nil)
+	require.Error(t, err)
+	encryptedRing, err := NewPrivateKeyRingPath(path, conf, reversingDecrypter{})
+	require.NoError(t, err)
+	decrypted, err := encryptedRing.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.Equal(t, sk, decrypted)
+
+	// Merged rings prefer the first ring, and the latest key of all rings
+	merged := PrivateKeyRingMerged{encryptedRing, conf}
+	sk, err = merged.PrivateKey(id, int(decrypted.Counter))
+	require.NoError(t, err)
+	require.True(t, sk == decrypted)
+	latest, err := conf.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	sk, err = merged.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.Equal(t, latest.Counter, sk.Counter)
+}
+
+func TestWipePrivateKeys(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewIssuerIdentifier("irma-demo.RU")
+
+	// Closing the configuration wipes the private keys that it and its snapshots handed out
+	sk, err := conf.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	snapshotsk, err := conf.Snapshot().PrivateKey(id, 1)
+	require.NoError(t, err)
+	conf.Close()
+	for _, key := range []*gabi.PrivateKey{sk, snapshotsk} {
+		require.Zero(t, key.P.Sign())
+		require.Zero(t, key.Q.Sign())
+		require.Zero(t, key.PPrime.Sign())
+		require.Zero(t, key.QPrime.Sign())
+	}
+
+	// Afterwards the private keys are read again from disk
+	fresh, err := conf.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.False(t, fresh == sk)
+	pk, err := conf.PublicKey(id, int(fresh.Counter))
+	require.NoError(t, err)
+	require.Equal(t, 0, new(big.Int).Mul(fresh.P, fresh.Q).Cmp(pk.N))
+
+	ring, err := NewPrivateKeyRingPath(filepath.Join("testdata", "privatekeys"), conf, nil)
+	require.NoError(t, err)
+	sk, err = ring.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	ring.Close()
+	require.Zero(t, sk.P.Sign())
+	sk, err = ring.PrivateKeyLatest(id)
+	require.NoError(t, err)
+	require.Nil(t, sk)
+
+	bts := SecureBytes("secret")
+	bts.Wipe()
+	require.Equal(t, SecureBytes{0, 0, 0, 0, 0, 0}, bts)
+}
+
+func TestSchemeRequiresUpdate(t *testing.T) {
+	for _, c := range []struct {
+		version, minimum string
+		ok               bool
+	}{
+		{"0.1.1", "0.1.1", true},
+		{"0.1.1", "0.1", true},
+		{"0.2", "0.1.5", true},
+		{"1.0.0", "0.10.0", true},
+		{"0.1.1", "0.1.2", false},
+		{"0.9.9", "1", false},
+	} {
+		ok, err := VersionAtLeast(c.version, c.minimum)
+		require.NoError(t, err)
+		require.Equal(t, c.ok, ok, "%s >= %s", c.version, c.minimum)
+	}
+	_, err := VersionAtLeast(Version, "1.x")
+	require.Error(t, err)
+
+	conf := parseConfiguration(t)
+	scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.False(t, scheme.RequiresUpdate())
+	scheme.MinimumAppVersion.Irmago = Version
+	require.False(t, scheme.RequiresUpdate())
+	scheme.MinimumAppVersion.Irmago = "1000.0.0"
+	require.True(t, scheme.RequiresUpdate())
+}
+
+func TestEncryptedPrivateKeys(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	file := filepath.Join(path, "irma-demo", "RU", "PrivateKeys", "2.xml")
+	bts, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	encrypted, err := EncryptPrivateKey(bts, "secret")
+	require.NoError(t, err)
+	require.True(t, PrivateKeyEncrypted(encrypted))
+	require.NoError(t, ioutil.WriteFile(file, encrypted, 0600))
+
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	id := NewIssuerIdentifier("irma-demo.RU")
+
+	// Encrypted private keys cannot be used until unlocked
+	_, err = conf.PrivateKey(id, 2)
+	require.True(t, errors.Is(err, ErrPrivateKeysLocked))
+	sk, err := conf.PrivateKey(id, 1)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+
+	require.True(t, errors.Is(conf.UnlockPrivateKeys("wrong"), ErrPrivateKeysLocked))
+	require.NoError(t, conf.UnlockPrivateKeys("secret"))
+	sk, err = conf.PrivateKey(id, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+
+	// PassphraseDecrypter handles both encrypted and unencrypted private keys
+	decrypted, err := PassphraseDecrypter("secret").DecryptPrivateKey(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, bts, decrypted)
+	decrypted, err = PassphraseDecrypter("secret").DecryptPrivateKey(bts)
+	require.NoError(t, err)
+	require.Equal(t, bts, decrypted)
+}
+
+func TestClock(t *testing.T) {
+	meta := NewMetadataAttribute(0x03)
+	require.NoError(t, meta.setExpiryDate(nil)) // default validity of six months
+	require.True(t, meta.IsValid())
+
+	previous := SetClock(OffsetClock(365 * 24 * time.Hour))
+	require.False(t, meta.IsValid())
+	SetClock(previous)
+	require.True(t, meta.IsValid())
+
+	fixed := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(FixedClock(fixed)))
+	require.Equal(t, fixed, Now())
+}
+
+func TestPublicKeyLatestValid(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	// Public keys are loaded when parsing
+	id := NewIssuerIdentifier("irma-demo.MijnOverheid")
+	require.Len(t, conf.publicKeys[id], 3)
+
+	// Of the keys of MijnOverheid, 2 expires before 1
+	defer SetClock(SetClock(FixedClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))))
+	pk, err := conf.PublicKeyLatestValid(id)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), pk.Counter)
+
+	SetClock(FixedClock(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)))
+	pk, err = conf.PublicKeyLatestValid(id)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), pk.Counter)
+
+	SetClock(FixedClock(time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)))
+	pk, err = conf.PublicKeyLatestValid(id)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+}
+
+func TestKeyExpiryWatcher(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewIssuerIdentifier("test.test")
+	pk, err := conf.PublicKey(id, 3)
+	require.NoError(t, err)
+	expiry := time.Unix(pk.ExpiryDate, 0)
+
+	events := func(w *KeyExpiryWatcher) []KeyExpiryEvent {
+		var result []KeyExpiryEvent
+		for _, event := range w.Check() {
+			if event.Issuer == id {
+				result = append(result, event)
+			}
+		}
+		return result
+	}
+
+	w := NewKeyExpiryWatcher(conf, nil)
+	defer SetClock(SetClock(FixedClock(expiry.Add(-2 * DefaultKeyExpiryBoundary))))
+	require.Empty(t, events(w))
+
+	// Entering the expiry window is reported once
+	SetClock(FixedClock(expiry.Add(-24 * time.Hour)))
+	require.Equal(t, []KeyExpiryEvent{{Issuer: id, Counter: 3, Expiry: expiry}}, events(w))
+	require.Empty(t, events(w))
+
+	// Expiry is reported once
+	SetClock(FixedClock(expiry.Add(time.Hour)))
+	require.Equal(t, []KeyExpiryEvent{{Issuer: id, Counter: 3, Expiry: expiry, Expired: true}}, events(w))
+	require.Empty(t, events(w))
+
+	// The expiry window is configurable
+	conf.KeyExpiryBoundary = 3 * DefaultKeyExpiryBoundary
+	SetClock(FixedClock(expiry.Add(-2 * DefaultKeyExpiryBoundary)))
+	require.Len(t, events(NewKeyExpiryWatcher(conf, nil)), 1)
+
+	// The running watcher sends the events to its channel
+	ch := make(chan KeyExpiryEvent, 10)
+	w = NewKeyExpiryWatcher(conf, nil)
+	w.Channel = ch
+	w.Start()
+	defer w.Stop()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no key expiry event received")
+	}
+}
+
+func TestOrphanedCredential(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	req := &CredentialRequest{
+		CredentialTypeID: credid,
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "42",
+		},
+	}
+	attrs, err := req.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	require.False(t, attrs.Orphaned())
+	require.False(t, attrs.Info().Orphaned)
+	require.Equal(t, "s1234567", attrs.Info().Attributes[NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")]["en"])
+
+	// A credential having more attributes than its credential type is orphaned
+	longer := NewAttributeListFromInts(append(attrs.Ints, big.NewInt(3)), conf)
+	require.True(t, longer.Orphaned())
+	require.Nil(t, NewCredentialInfo(longer.Ints, conf).Attributes)
+	info := longer.Info()
+	require.True(t, info.Orphaned)
+	require.Equal(t, "studentCard", info.ID)
+	require.Len(t, info.RawAttributes, 5)
+	require.Equal(t, "s1234567", info.RawAttributes[2]["en"])
+
+	// The cached info is updated when the credential type is removed
+	conf.unloadCredentialType(credid)
+	require.True(t, attrs.Orphaned())
+	info = attrs.Info()
+	require.True(t, info.Orphaned)
+	require.Empty(t, info.ID)
+	require.Len(t, info.RawAttributes, 4)
+	require.Equal(t, "Radboud", info.RawAttributes[0]["en"])
+}
+
+// The benchmarks below cover the parts of proof verification done by irmago itself, i.e. all but
+// the verification of the proofs in gabi: these are executed for each disclosed credential or attribute.
+
+func BenchmarkMetadataAttribute(b *testing.B) {
+	conf := parseConfiguration(b)
+	metadata := NewMetadataAttribute(0x03)
+	metadata.setCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	metadata = MetadataFromInt(metadata.Int, conf)
+	require.NotNil(b, metadata.CredentialType())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		metadata.CredentialType()
+		metadata.KeyCounter()
+		metadata.ExpiredAt(time.Time{}, 0)
+	}
+}
+
+func BenchmarkDecodeAttribute(b *testing.B) {
+	attr := new(big.Int).SetBytes([]byte("s1234567"))
+	attr.Lsh(attr, 1)
+	attr.Add(attr, big.NewInt(1))
+	require.Equal(b, "s1234567", *decodeAttribute(attr, 0x03))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeAttribute(attr, 0x03)
+	}
+}
+
+func TestOfflineProofChunks(t *testing.T) {
+	proof := &OfflineProof{
+		Type: ActionSigning,
+		Signature: &SignedMessage{
+			Nonce:   big.NewInt(42),
+			Context: big.NewInt(1337),
+			Message: strings.Repeat("I owe you everything. ", 200),
+		},
+	}
+	blob, err := proof.MarshalBinary()
+	require.NoError(t, err)
+	parsed := &OfflineProof{}
+	require.NoError(t, parsed.UnmarshalBinary(blob))
+	require.Equal(t, proof.Signature.Message, parsed.Signature.Message)
+	require.Error(t, parsed.UnmarshalBinary(blob[1:]))
+
+	chunks, err := proof.QRChunks(50)
+	require.NoError(t, err)
+	require.True(t, len(chunks) > 1)
+	for _, chunk := range chunks {
+		require.True(t, strings.HasPrefix(chunk, "irmaproof:"))
+	}
+
+	// Chunks may be scanned in any order and more than once
+	scanner := &OfflineProofScanner{}
+	require.Equal(t, -1, scanner.Missing())
+	for i := len(chunks) - 1; i > 0; i-- {
+		done, err := scanner.Add(chunks[i])
+		require.NoError(t, err)
+		require.False(t, done)
+		_, err = scanner.Add(chunks[i])
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, scanner.Missing())
+	_, err = scanner.Proof()
+	require.Error(t, err)
+	done, err := scanner.Add(chunks[0])
+	require.NoError(t, err)
+	require.True(t, done)
+	scanned, err := scanner.Proof()
+	require.NoError(t, err)
+	require.Equal(t, ActionSigning, scanned.Type)
+	require.Equal(t, proof.Signature.Message, scanned.Signature.Message)
+	require.Equal(t, 0, scanned.Signature.Nonce.Cmp(big.NewInt(42)))
+
+	// Chunks of other proofs and malformed chunks are rejected
+	proof.Signature.Message = "other message"
+	other, err := proof.QRChunks(50)
+	require.NoError(t, err)
+	_, err = scanner.Add(other[0])
+	require.Error(t, err)
+	_, err = (&OfflineProofScanner{}).Add("irmaproof:abcd:2/1:data")
+	require.Error(t, err)
+	_, err = (&OfflineProofScanner{}).Add("https://example.com")
+	require.Error(t, err)
+
+	// Tampered chunks do not match the identifier of the proof
+	scanner = &OfflineProofScanner{}
+	for i, chunk := range chunks {
+		if i == 0 {
+			chunk = chunk[:len(chunk)-1] + "A"
+			if chunk == chunks[0] {
+				chunk = chunk[:len(chunk)-1] + "B"
+			}
+		}
+		_, err = scanner.Add(chunk)
+		require.NoError(t, err)
+	}
+	_, err = scanner.Proof()
+	require.Error(t, err)
 }
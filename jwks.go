@@ -0,0 +1,212 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// JWKS is a JSON Web Key Set (RFC 7517) of public keys for verifying JWTs, published at a URL.
+// Organizations publishing their keys in a JWKS can rotate them without the need to distribute
+// them otherwise. The keys are fetched when first needed and cached for MaxAge. When a JWT refers
+// to a key ID that is not in the cache, the set is fetched again (at most once per
+// JWKSMinRefreshInterval), so that newly published keys are found.
+//
+// A JWKS is safe for concurrent use.
+type JWKS struct {
+	URL string
+	// MaxAge is the duration for which fetched keys are used before the set is fetched again
+	MaxAge time.Duration
+
+	mutex     sync.Mutex
+	transport *HTTPTransport
+	keys      map[string]interface{}
+	fetched   time.Time
+}
+
+// JWK is a single JSON Web Key (RFC 7517) of type RSA, EC (with curve P-256, P-384 or P-521)
+// or OKP (with curve Ed25519, RFC 8037).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+const (
+	// JWKSDefaultMaxAge is the default duration for which a JWKS caches its keys.
+	JWKSDefaultMaxAge = time.Hour
+	// JWKSMinRefreshInterval is the minimum duration between two fetches of a JWKS triggered
+	// by a JWT referring to an unknown key ID.
+	JWKSMinRefreshInterval = time.Minute
+)
+
+// NewJWKS returns a JWKS retrieving its keys from the specified URL. If transport is nil,
+// a new HTTPTransport with default settings is used.
+func NewJWKS(url string, transport *HTTPTransport) *JWKS {
+	if transport == nil {
+		transport = NewHTTPTransport("")
+	}
+	transport.SetCache(NewHTTPCache())
+	return &JWKS{
+		URL:       url,
+		MaxAge:    JWKSDefaultMaxAge,
+		transport: transport,
+	}
+}
+
+// Key returns the public key with the specified key ID, fetching the key set if necessary.
+func (jwks *JWKS) Key(kid string) (interface{}, error) {
+	jwks.mutex.Lock()
+	defer jwks.mutex.Unlock()
+
+	if jwks.keys == nil || Now().Sub(jwks.fetched) > jwks.MaxAge {
+		if err := jwks.fetch(); err != nil {
+			if jwks.keys == nil {
+				return nil, err
+			}
+			Logger.Warnf("Failed to refresh JWKS %s, using cached keys: %s", jwks.URL, err.Error())
+		}
+	}
+	if key, ok := jwks.keys[kid]; ok {
+		return key, nil
+	}
+
+	// The key may have been published after we last fetched the set
+	if Now().Sub(jwks.fetched) > JWKSMinRefreshInterval {
+		if err := jwks.fetch(); err != nil {
+			return nil, err
+		}
+		if key, ok := jwks.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, errors.Errorf("JWKS %s contains no key with key ID %s", jwks.URL, kid)
+}
+
+// KeyFunc returns the public key identified by the kid header of the specified token,
+// suitable for passing to jwt.Parse() and jwt.ParseWithClaims().
+func (jwks *JWKS) KeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("JWT has no kid header")
+	}
+	return jwks.Key(kid)
+}
+
+// fetch retrieves the key set, replacing the cached keys. Keys that cannot be used for verifying
+// signatures are skipped.
+func (jwks *JWKS) fetch() error {
+	bts, err := jwks.transport.GetBytes(jwks.URL)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to fetch JWKS "+jwks.URL, 0)
+	}
+	var set struct {
+		Keys []*JWK `json:"keys"`
+	}
+	if err = json.Unmarshal(bts, &set); err != nil {
+		return errors.WrapPrefix(err, "failed to parse JWKS "+jwks.URL, 0)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pk, err := jwk.PublicKey()
+		if err != nil {
+			Logger.Warnf("Skipping key %s of JWKS %s: %s", jwk.KeyID, jwks.URL, err.Error())
+			continue
+		}
+		keys[jwk.KeyID] = pk
+	}
+	jwks.keys = keys
+	jwks.fetched = Now()
+	return nil
+}
+
+// PublicKey returns the public key contained in the JWK: an *rsa.PublicKey, *ecdsa.PublicKey
+// or ed25519.PublicKey.
+func (jwk *JWK) PublicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := jwkInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA public exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := jwkInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC public key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Ed25519 public key has invalid length")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, errors.Errorf("unsupported key type %s", jwk.KeyType)
+	}
+}
+
+func jwkInt(s string) (*big.Int, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(bts) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(bts), nil
+}
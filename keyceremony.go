@@ -0,0 +1,239 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains support for scheme key ceremonies, in which the ECDSA private key
+// of a scheme is generated and immediately split into shares using Shamir secret sharing,
+// so that it never has to be stored as a whole. Signing the scheme then requires a threshold
+// amount of shares, which are combined into the private key only for the duration of the
+// signing operation. All steps can be recorded to an audit log.
+
+// SchemeKeyShare is a share of a scheme private key, to be handed out to a single custodian.
+type SchemeKeyShare struct {
+	Index     int      `json:"index"`
+	Threshold int      `json:"threshold"`
+	Count     int      `json:"count"`
+	Value     *big.Int `json:"value"`
+
+	// PEM-encoded public key of the scheme, used to check the reconstructed private key
+	PublicKey string `json:"publickey"`
+}
+
+// SchemeKeyFingerprint returns the hex-encoded SHA256 hash of the DER encoding of the public key.
+func SchemeKeyFingerprint(pk *ecdsa.PublicKey) (string, error) {
+	bts, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bts)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// GenerateSchemeKeyShares generates a new ECDSA scheme key and splits its private key into
+// count shares, any threshold of which suffice to reconstruct it. The private key itself
+// is not returned. If audit is not nil, the ceremony is logged to it.
+func GenerateSchemeKeyShares(threshold, count int, audit io.Writer) (*ecdsa.PublicKey, []*SchemeKeyShare, error) {
+	if threshold < 1 || count < threshold {
+		return nil, nil, errors.Errorf("Invalid share parameters: threshold %d, count %d", threshold, count)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroSchemeKey(key)
+
+	pkbts, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkpem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts}))
+	fingerprint, err := SchemeKeyFingerprint(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	auditSchemeKey(audit, "generated scheme key %s", fingerprint)
+
+	values, err := shamirSplit(key.D, key.Curve.Params().N, threshold, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	shares := make([]*SchemeKeyShare, count)
+	for i := range values {
+		shares[i] = &SchemeKeyShare{
+			Index:     i + 1,
+			Threshold: threshold,
+			Count:     count,
+			Value:     values[i],
+			PublicKey: pkpem,
+		}
+		auditSchemeKey(audit, "created share %d of %d (threshold %d) of scheme key %s", i+1, count, threshold, fingerprint)
+	}
+
+	return &key.PublicKey, shares, nil
+}
+
+// CombineSchemeKeyShares reconstructs the scheme private key out of the specified shares,
+// checking that it corresponds to the public key contained in the shares. The caller should
+// discard the private key as soon as it is no longer needed.
+func CombineSchemeKeyShares(shares []*SchemeKeyShare, audit io.Writer) (*ecdsa.PrivateKey, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("No shares specified")
+	}
+	pk, err := ParsePemEcdsaPublicKey([]byte(shares[0].PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := SchemeKeyFingerprint(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := shares[0].Threshold
+	seen := map[int]struct{}{}
+	var indices []string
+	for _, share := range shares {
+		if share.PublicKey != shares[0].PublicKey || share.Threshold != threshold {
+			return nil, errors.New("Shares belong to different scheme keys")
+		}
+		if share.Index < 1 || share.Value == nil {
+			return nil, errors.Errorf("Share %d is invalid", share.Index)
+		}
+		if _, ok := seen[share.Index]; ok {
+			return nil, errors.Errorf("Share %d specified more than once", share.Index)
+		}
+		seen[share.Index] = struct{}{}
+		indices = append(indices, fmt.Sprintf("%d", share.Index))
+	}
+	if len(shares) < threshold {
+		return nil, errors.Errorf("Need at least %d shares, got %d", threshold, len(shares))
+	}
+	sort.Strings(indices)
+
+	key := &ecdsa.PrivateKey{PublicKey: *pk}
+	key.D = shamirCombine(shares, pk.Curve.Params().N)
+	x, y := pk.Curve.ScalarBaseMult(key.D.Bytes())
+	if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+		zeroSchemeKey(key)
+		auditSchemeKey(audit, "failed to reconstruct scheme key %s from shares %s", fingerprint, strings.Join(indices, ","))
+		return nil, errors.New("Reconstructed private key does not match public key; one or more shares are invalid")
+	}
+
+	auditSchemeKey(audit, "reconstructed scheme key %s from shares %s", fingerprint, strings.Join(indices, ","))
+	return key, nil
+}
+
+// WriteSchemeKeyShare writes the share to the specified path, refusing to overwrite existing files.
+// As shares are kept outside of any Configuration, they are written directly using fs.SaveFile().
+func WriteSchemeKeyShare(share *SchemeKeyShare, path string) error {
+	if err := fs.AssertPathNotExists(path); err != nil {
+		return errors.Errorf("File %s already exists, not overwriting", path)
+	}
+	bts, err := json.MarshalIndent(share, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.SaveFile(path, bts)
+}
+
+// ReadSchemeKeyShare reads a share written by WriteSchemeKeyShare.
+func ReadSchemeKeyShare(path string) (*SchemeKeyShare, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	share := &SchemeKeyShare{}
+	if err = json.Unmarshal(bts, share); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse key share "+path, 0)
+	}
+	return share, nil
+}
+
+func auditSchemeKey(audit io.Writer, format string, args ...interface{}) {
+	if audit == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(audit, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+func zeroSchemeKey(key *ecdsa.PrivateKey) {
+	if key != nil && key.D != nil {
+		key.D.SetInt64(0)
+	}
+}
+
+// shamirSplit splits secret into count shares modulo the prime n, such that threshold of them
+// suffice to reconstruct the secret. Share i (starting at 0) is the evaluation at i+1 of a random
+// polynomial of degree threshold-1 whose constant term is the secret.
+func shamirSplit(secret, n *big.Int, threshold, count int) ([]*big.Int, error) {
+	coefficients := make([]*big.Int, threshold)
+	coefficients[0] = new(big.Int).Set(secret)
+	for i := 1; i < threshold; i++ {
+		c, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		coefficients[i] = c
+	}
+	defer func() {
+		for _, c := range coefficients {
+			c.SetInt64(0)
+		}
+	}()
+
+	shares := make([]*big.Int, count)
+	for i := 0; i < count; i++ {
+		x := big.NewInt(int64(i + 1))
+		y := new(big.Int)
+		for j := threshold - 1; j >= 0; j-- { // Horner's method
+			y.Mul(y, x)
+			y.Add(y, coefficients[j])
+			y.Mod(y, n)
+		}
+		shares[i] = y
+	}
+	return shares, nil
+}
+
+// shamirCombine computes the secret out of the shares modulo n using Lagrange interpolation at 0.
+func shamirCombine(shares []*SchemeKeyShare, n *big.Int) *big.Int {
+	secret := new(big.Int)
+	for j, sj := range shares {
+		num, den := big.NewInt(1), big.NewInt(1)
+		xj := big.NewInt(int64(sj.Index))
+		for m, sm := range shares {
+			if m == j {
+				continue
+			}
+			xm := big.NewInt(int64(sm.Index))
+			num.Mul(num, xm)
+			num.Mod(num, n)
+			den.Mul(den, new(big.Int).Sub(xm, xj))
+			den.Mod(den, n)
+		}
+		term := new(big.Int).Mul(sj.Value, num)
+		term.Mul(term, den.ModInverse(den, n))
+		secret.Add(secret, term)
+		secret.Mod(secret, n)
+	}
+	return secret
+}
@@ -0,0 +1,190 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The issuer private keys in the PrivateKeys folders of a scheme may be stored encrypted, using
+// AES-GCM with a key derived from a passphrase using scrypt (see EncryptPrivateKey()). Encrypted
+// private keys can only be used after the passphrase has been provided using UnlockPrivateKeys().
+// An encrypted private key file consists of encryptedKeyHeader, the scrypt salt, the AES-GCM
+// nonce, and the ciphertext.
+
+const encryptedKeyHeader = "irma-encrypted-privatekey-v1\n"
+
+const (
+	keyEncryptionSaltLength = 16
+	keyEncryptionScryptN    = 1 << 15
+	keyEncryptionScryptR    = 8
+	keyEncryptionScryptP    = 1
+)
+
+// PassphraseDecrypter is a PrivateKeyDecrypter decrypting private keys encrypted using
+// EncryptPrivateKey() with this passphrase. Unencrypted private keys are returned as is.
+type PassphraseDecrypter string
+
+func (p PassphraseDecrypter) DecryptPrivateKey(ciphertext []byte) ([]byte, error) {
+	if !PrivateKeyEncrypted(ciphertext) {
+		return ciphertext, nil
+	}
+	return DecryptPrivateKey(ciphertext, string(p))
+}
+
+// PrivateKeyEncrypted returns whether the specified private key file contents are encrypted.
+func PrivateKeyEncrypted(bts []byte) bool {
+	return bytes.HasPrefix(bts, []byte(encryptedKeyHeader))
+}
+
+func keyEncryptionCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt,
+		keyEncryptionScryptN, keyEncryptionScryptR, keyEncryptionScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptPrivateKey encrypts the specified private key file contents using the passphrase.
+func EncryptPrivateKey(plaintext []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase must not be empty")
+	}
+	salt := make([]byte, keyEncryptionSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyEncryptionCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptedKeyHeader), salt...)
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, plaintext, []byte(encryptedKeyHeader)), nil
+}
+
+// DecryptPrivateKey decrypts the specified private key file contents, encrypted using
+// EncryptPrivateKey(), using the passphrase.
+func DecryptPrivateKey(ciphertext []byte, passphrase string) ([]byte, error) {
+	if !PrivateKeyEncrypted(ciphertext) {
+		return nil, errors.New("Private key is not encrypted")
+	}
+	ciphertext = ciphertext[len(encryptedKeyHeader):]
+	if len(ciphertext) < keyEncryptionSaltLength {
+		return nil, errors.New("Encrypted private key too short")
+	}
+	aead, err := keyEncryptionCipher(passphrase, ciphertext[:keyEncryptionSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[keyEncryptionSaltLength:]
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("Encrypted private key too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(encryptedKeyHeader))
+	if err != nil {
+		return nil, errors.New("Wrong passphrase or corrupted private key")
+	}
+	return plaintext, nil
+}
+
+// UnlockPrivateKeys provides the passphrase with which the encrypted private keys in the
+// Configuration are decrypted when they are used. It returns an error if any of the encrypted
+// private keys cannot be decrypted using the passphrase.
+func (conf *Configuration) UnlockPrivateKeys(passphrase string) error {
+	files, err := filepath.Glob(fmt.Sprintf(privkeyPattern, conf.Path, "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !PrivateKeyEncrypted(bts) {
+			continue
+		}
+		if _, err = DecryptPrivateKey(bts, passphrase); err != nil {
+			return configurationError(ErrPrivateKeysLocked, err, fmt.Sprintf("Failed to unlock private key %s", file))
+		}
+	}
+
+	conf.mutex.Lock()
+	conf.privateKeyPassphrase = passphrase
+	conf.mutex.Unlock()
+	return nil
+}
+
+// readPrivateKey reads the private key in the specified file, decrypting it if necessary.
+// The file contents are wiped from memory afterwards.
+func (conf *Configuration) readPrivateKey(file string) (*gabi.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	bts := SecureBytes(contents)
+	defer bts.Wipe()
+	if PrivateKeyEncrypted(bts) {
+		conf.mutex.RLock()
+		passphrase := conf.privateKeyPassphrase
+		conf.mutex.RUnlock()
+		if passphrase == "" {
+			return nil, configurationError(ErrPrivateKeysLocked, nil,
+				fmt.Sprintf("Private key %s is encrypted, see UnlockPrivateKeys()", file))
+		}
+		plaintext, err := DecryptPrivateKey(bts, passphrase)
+		if err != nil {
+			return nil, configurationError(ErrPrivateKeysLocked, err, fmt.Sprintf("Failed to decrypt private key %s", file))
+		}
+		bts = SecureBytes(plaintext)
+		defer bts.Wipe()
+	}
+	return parsePrivateKey(bts)
+}
+
+// writePrivateKey writes the private key to the specified file, which must not yet exist. If the
+// private keys have been unlocked, the private key is encrypted using the same passphrase.
+func (conf *Configuration) writePrivateKey(sk *gabi.PrivateKey, file string) error {
+	exists, err := fs.PathExists(file)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.Errorf("Private key %s already exists", file)
+	}
+	bts, err := xml.MarshalIndent(sk, "", "   ")
+	if err != nil {
+		return err
+	}
+	bts = append([]byte(xml.Header), bts...)
+
+	conf.mutex.RLock()
+	passphrase := conf.privateKeyPassphrase
+	conf.mutex.RUnlock()
+	if passphrase != "" {
+		if bts, err = EncryptPrivateKey(bts, passphrase); err != nil {
+			return err
+		}
+	}
+	return conf.saveFile(file, bts)
+}
@@ -0,0 +1,170 @@
+package irma
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyExpiryWatcher periodically checks the latest public key of each issuer of a Configuration,
+// reporting a KeyExpiryEvent to its Handler and/or Channel when the key enters the expiry window
+// (the KeyExpiryBoundary of the Configuration) and when it expires. Each key is reported at most
+// once as expiring and once as expired. Publishing a new public key for the issuer ends the
+// reports about its previous key.
+type KeyExpiryWatcher struct {
+	// Interval between two checks
+	Interval time.Duration
+	// Handler, if set, is invoked for each event, from the goroutine of the watcher
+	Handler KeyExpiryHandler
+	// Channel, if set, receives each event; sending blocks until the event is received
+	Channel chan<- KeyExpiryEvent
+
+	conf     *Configuration
+	mutex    sync.Mutex // protects reported and stop
+	reported map[keyExpiryReport]struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// KeyExpiryEvent reports that a public key expires soon, or has expired.
+type KeyExpiryEvent struct {
+	Issuer  IssuerIdentifier
+	Counter int
+	Expiry  time.Time
+	Expired bool // false if the key has not yet expired but expires within the expiry window
+}
+
+// KeyExpiryHandler receives the events of a KeyExpiryWatcher.
+type KeyExpiryHandler func(event KeyExpiryEvent)
+
+type keyExpiryReport struct {
+	issuer  IssuerIdentifier
+	counter int
+	expired bool
+}
+
+const (
+	DefaultKeyExpiryBoundary      = 31 * 24 * time.Hour
+	DefaultKeyExpiryWatchInterval = time.Hour
+)
+
+// NewKeyExpiryWatcher returns a new (not yet started) KeyExpiryWatcher for the specified
+// configuration, invoking the handler (which may be nil) for each event.
+func NewKeyExpiryWatcher(conf *Configuration, handler KeyExpiryHandler) *KeyExpiryWatcher {
+	return &KeyExpiryWatcher{
+		Interval: DefaultKeyExpiryWatchInterval,
+		Handler:  handler,
+		conf:     conf,
+		reported: map[keyExpiryReport]struct{}{},
+	}
+}
+
+// Start starts checking the keys in the background, the first time immediately.
+// It has no effect if the watcher is already running.
+func (w *KeyExpiryWatcher) Start() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stop != nil {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run(w.stop, w.done)
+}
+
+// Stop stops the watcher, waiting for a running check (if any) to finish.
+func (w *KeyExpiryWatcher) Stop() {
+	w.mutex.Lock()
+	if w.stop == nil {
+		w.mutex.Unlock()
+		return
+	}
+	close(w.stop)
+	done := w.done
+	w.stop, w.done = nil, nil
+	w.mutex.Unlock()
+
+	<-done
+}
+
+func (w *KeyExpiryWatcher) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, event := range w.Check() {
+			w.report(event, stop)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *KeyExpiryWatcher) report(event KeyExpiryEvent, stop chan struct{}) {
+	if event.Expired {
+		Logger.Warnf("Latest public key %d of issuer %s has expired (at %s)", event.Counter, event.Issuer, event.Expiry)
+	} else {
+		Logger.Warnf("Latest public key %d of issuer %s expires soon (at %s)", event.Counter, event.Issuer, event.Expiry)
+	}
+	if w.Handler != nil {
+		w.Handler(event)
+	}
+	if w.Channel != nil {
+		select {
+		case w.Channel <- event:
+		case <-stop:
+		}
+	}
+}
+
+// Check checks the keys once, returning the events that have not been reported before.
+// The events are not passed to the Handler or Channel of the watcher.
+func (w *KeyExpiryWatcher) Check() []KeyExpiryEvent {
+	boundary := w.conf.KeyExpiryBoundary
+	if boundary == 0 {
+		boundary = DefaultKeyExpiryBoundary
+	}
+	now := Now()
+
+	var events []KeyExpiryEvent
+	for id := range w.conf.Issuers {
+		counters, err := w.conf.PublicKeyIndices(id)
+		if err != nil || len(counters) == 0 {
+			continue
+		}
+		latest := counters[0]
+		for _, counter := range counters {
+			if counter > latest {
+				latest = counter
+			}
+		}
+		pk, err := w.conf.PublicKey(id, latest)
+		if err != nil || pk == nil {
+			continue
+		}
+
+		expiry := time.Unix(pk.ExpiryDate, 0)
+		if expiry.After(now.Add(boundary)) {
+			continue
+		}
+		event := KeyExpiryEvent{Issuer: id, Counter: latest, Expiry: expiry, Expired: !expiry.After(now)}
+		if w.markReported(keyExpiryReport{issuer: id, counter: latest, expired: event.Expired}) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// markReported records the report, returning false if it had been made before.
+func (w *KeyExpiryWatcher) markReported(r keyExpiryReport) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.reported[r]; ok {
+		return false
+	}
+	w.reported[r] = struct{}{}
+	return true
+}
@@ -0,0 +1,272 @@
+package irma
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// The functions in this file contain the consistency checks that are performed on the contents of
+// a scheme when it is parsed. They report problems that do not prevent the scheme from being used
+// to the specified ValidationReport, and return an error for problems that do. They do not depend
+// on the scheme being signed, so that the schemelint package can run them on schemes under
+// development, before they are signed.
+
+// LintScheme checks the description of the scheme in the specified directory.
+func LintScheme(report *ValidationReport, scheme *SchemeManager, dir string) error {
+	if scheme.XMLVersion < 7 {
+		return errors.New("Unsupported scheme manager description")
+	}
+	switch scheme.Environment {
+	case SchemeEnvironmentDemo, SchemeEnvironmentProduction, "":
+	default:
+		return errors.Errorf("Scheme %s has unknown environment %s", scheme.ID, scheme.Environment)
+	}
+	if scheme.MinimumAppVersion.Irmago != "" {
+		if _, err := parseVersion(scheme.MinimumAppVersion.Irmago); err != nil {
+			return errors.Errorf("Scheme %s has invalid minimum irmago version: %s", scheme.ID, err.Error())
+		}
+	}
+	if filepath.Base(dir) != scheme.ID {
+		return errors.Errorf("Scheme %s has wrong directory name %s", scheme.ID, filepath.Base(dir))
+	}
+	if err := lintSchemeKeys(scheme, dir); err != nil {
+		return err
+	}
+	if scheme.KeyshareServer != "" && !scheme.HasKeys(SchemeKeyRoleKeyshare) {
+		if err := fs.AssertPathExists(filepath.Join(dir, "kss-0.pem")); err != nil {
+			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID)
+		}
+	}
+	for _, sub := range scheme.SubSchemes {
+		if sub.ID == "" || sub.URL == "" {
+			return errors.Errorf("Scheme %s has sub-scheme without identifier or URL", scheme.ID)
+		}
+		if sub.ID == scheme.ID {
+			return errors.Errorf("Scheme %s has itself as sub-scheme", scheme.ID)
+		}
+		if _, err := ParsePemEcdsaPublicKey([]byte(sub.PublicKey)); err != nil {
+			return errors.Errorf("Sub-scheme %s of scheme %s has invalid public key: %s", sub.ID, scheme.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// LintIssuer checks the description of the issuer in the specified directory,
+// which is contained in the specified scheme.
+func LintIssuer(report *ValidationReport, schemeID string, issuer *Issuer, dir string) error {
+	issuerid := issuer.Identifier()
+	// Check that the issuer has public keys
+	files, err := filepath.Glob(filepath.Join(dir, "PublicKeys", "*.xml"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		report.Add(SeverityWarning, ValidationNoPublicKeys, issuerid.String(),
+			fmt.Sprintf("Issuer %s has no public keys", issuerid.String()))
+	}
+
+	if filepath.Base(dir) != issuer.ID {
+		return errors.Errorf("Issuer %s has wrong directory name %s", issuerid.String(), filepath.Base(dir))
+	}
+	if schemeID != issuer.SchemeManagerID {
+		return errors.Errorf("Issuer %s has wrong SchemeManager %s", issuerid.String(), issuer.SchemeManagerID)
+	}
+	if err = fs.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
+		report.Add(SeverityWarning, ValidationMissingLogo, issuerid.String(),
+			fmt.Sprintf("Issuer %s has no logo.png", issuerid.String()))
+	}
+	return nil
+}
+
+// LintCredentialType checks the description of the credential type in the specified directory,
+// which is issued by the specified issuer. The attributes of the credential type are checked
+// separately by LintAttributes.
+func LintCredentialType(report *ValidationReport, issuer *Issuer, cred *CredentialType, dir string) error {
+	credid := cred.Identifier()
+	if cred.XMLVersion < 4 {
+		return errors.New("Unsupported credential type description")
+	}
+	if cred.ID != filepath.Base(dir) {
+		return errors.Errorf("Credential type %s has wrong directory name %s", credid.String(), filepath.Base(dir))
+	}
+	if cred.IssuerID != issuer.ID {
+		return errors.Errorf("Credential type %s has wrong IssuerID %s", credid.String(), cred.IssuerID)
+	}
+	if cred.SchemeManagerID != issuer.SchemeManagerID {
+		return errors.Errorf("Credential type %s has wrong SchemeManager %s", credid.String(), cred.SchemeManagerID)
+	}
+	if err := fs.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
+		report.Add(SeverityWarning, ValidationMissingLogo, credid.String(),
+			fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
+	}
+	return nil
+}
+
+// LintAttributes checks the attributes of the specified credential type, and their display order.
+func LintAttributes(report *ValidationReport, cred *CredentialType) error {
+	name := cred.Identifier().String()
+	indices := make(map[int]struct{})
+	count := len(cred.AttributeTypes)
+	if count == 0 {
+		return errors.Errorf("Credenial type %s has no attributes", name)
+	}
+	for i, attr := range cred.AttributeTypes {
+		index := i
+		if attr.DisplayIndex != nil {
+			index = *attr.DisplayIndex
+		}
+		if index >= count {
+			report.Add(SeverityWarning, ValidationInvalidDisplayIndex, name,
+				fmt.Sprintf("Credential type %s has invalid attribute displayIndex at attribute %d", name, i))
+		}
+		indices[index] = struct{}{}
+		if attr.Format != nil {
+			if err := attr.Format.parse(); err != nil {
+				return errors.Errorf("Attribute %s of credential type %s has invalid format: %s", attr.ID, name, err.Error())
+			}
+		}
+	}
+	if len(indices) != count {
+		report.Add(SeverityWarning, ValidationInvalidAttributeOrder, name,
+			fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
+	}
+	return nil
+}
+
+// LintTranslations checks for each member of the interface o that is of type TranslatedString
+// that it contains all necessary translations. The description (e.g. "Issuer irma-demo.RU")
+// is used in the messages of the validation entries.
+func LintTranslations(report *ValidationReport, description string, identifier string, o interface{}) {
+	langs := []string{"en", "nl"} // Hardcode these for now, TODO make configurable
+	v := reflect.ValueOf(o)
+
+	// Dereference in case of pointer or interface
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Type() == reflect.TypeOf(TranslatedString{}) {
+			val := v.Field(i).Interface().(TranslatedString)
+			for _, lang := range langs {
+				if _, exists := val[lang]; !exists {
+					report.Add(SeverityWarning, ValidationMissingTranslation, identifier,
+						fmt.Sprintf("%s misses %s translation in <%s> tag", description, lang, v.Type().Field(i).Name))
+				}
+			}
+		}
+	}
+}
+
+// LintKeys checks the public keys of the specified issuer, which must be indexed by their counter,
+// as well as the private keys in the PrivateKeys folder of the specified issuer directory, if any.
+// The credential types must be those issued by the issuer. A warning is added if the latest public
+// key expires within the specified boundary (DefaultKeyExpiryBoundary if zero).
+func LintKeys(report *ValidationReport, issuerid IssuerIdentifier, dir string,
+	pks map[int]*gabi.PublicKey, credtypes []*CredentialType, boundary time.Duration,
+) error {
+	if boundary == 0 {
+		boundary = DefaultKeyExpiryBoundary
+	}
+	expiryBoundary := int64(boundary / time.Second)
+
+	if len(pks) == 0 {
+		return nil
+	}
+	latestCounter := -1
+	for counter := range pks {
+		if counter > latestCounter {
+			latestCounter = counter
+		}
+	}
+	latest := pks[latestCounter]
+	now := Now().Unix()
+	if latest.ExpiryDate < now {
+		report.Add(SeverityWarning, ValidationNoValidPublicKeys, issuerid.String(),
+			fmt.Sprintf("Issuer %s has no nonexpired public keys", issuerid.String()))
+	}
+	if latest.ExpiryDate > now && latest.ExpiryDate < now+expiryBoundary {
+		report.Add(SeverityWarning, ValidationPublicKeyExpiresSoon, issuerid.String(), fmt.Sprintf("Latest public key of issuer %s expires soon (at %s)",
+			issuerid.String(), time.Unix(latest.ExpiryDate, 0).String()))
+	}
+
+	// Check private keys if any
+	privkeys, err := filepath.Glob(filepath.Join(dir, "PrivateKeys", "*.xml"))
+	if err != nil {
+		return err
+	}
+	for _, privkey := range privkeys {
+		filename := filepath.Base(privkey)
+		count, err := strconv.Atoi(filename[:len(filename)-4])
+		if err != nil {
+			return err
+		}
+		bts, err := ioutil.ReadFile(privkey)
+		if err != nil {
+			return err
+		}
+		if PrivateKeyEncrypted(bts) {
+			continue // cannot be checked without the passphrase
+		}
+		sk, err := gabi.NewPrivateKeyFromXML(string(bts))
+		if err != nil {
+			return err
+		}
+		if int(sk.Counter) != count {
+			return errors.Errorf("Private key %s of issuer %s has wrong <Counter>", filename, issuerid.String())
+		}
+		pk := pks[count]
+		if pk == nil {
+			return errors.Errorf("Private key %s of issuer %s has no corresponding public key", filename, issuerid.String())
+		}
+		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+			return errors.Errorf("Private key %s of issuer %s does not belong to public key %s", filename, issuerid.String(), filename)
+		}
+	}
+
+	// Check that the current public key supports enough attributes for all credential types
+	// issued by this issuer
+	for _, typ := range credtypes {
+		if len(typ.AttributeTypes)+2 > len(latest.R) {
+			return errors.Errorf("Latest public key of issuer %s does not support the amount of attributes that credential type %s requires (%d, required: %d)", issuerid.String(), typ.Identifier().String(), len(latest.R), len(typ.AttributeTypes)+2)
+		}
+	}
+
+	return nil
+}
+
+// LintDependencies checks that the dependencies of the specified credential types exist,
+// either among the specified credential types or in the optional Configuration, and that they
+// do not contain a cycle.
+func LintDependencies(report *ValidationReport, conf *Configuration, credtypes map[CredentialTypeIdentifier]*CredentialType) {
+	all := map[CredentialTypeIdentifier]*CredentialType{}
+	if conf != nil {
+		for id, credtype := range conf.CredentialTypes {
+			all[id] = credtype
+		}
+	}
+	for id, credtype := range credtypes {
+		all[id] = credtype
+	}
+	for id, credtype := range credtypes {
+		for _, dep := range credtype.Dependencies {
+			if _, ok := all[dep]; !ok {
+				report.Add(SeverityWarning, ValidationUnknownDependency, id.String(),
+					fmt.Sprintf("Credential type %s depends on unknown credential type %s", id, dep))
+			}
+		}
+	}
+	if cycle := (&Configuration{CredentialTypes: all}).DependencyCycle(); cycle != nil {
+		report.Add(SeverityError, ValidationDependencyCycle, cycle[0].String(),
+			"Dependency cycle in credential types: "+cycleString(cycle))
+	}
+}
@@ -98,6 +98,12 @@ type Action string
 // ErrorType are session errors.
 type ErrorType string
 
+// ErrorClass classifies session errors by how they should be handled.
+type ErrorClass string
+
+// ProtocolStep is a step of the IRMA protocol.
+type ProtocolStep string
+
 // SessionError is a protocol error.
 type SessionError struct {
 	Err error
@@ -105,6 +111,8 @@ type SessionError struct {
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
+	// Step is the step of the protocol during which the error occurred, if known
+	Step ProtocolStep
 }
 
 // RemoteError is an error message returned by the API server on errors.
@@ -114,6 +122,10 @@ type RemoteError struct {
 	Description string `json:"description,omitempty"`
 	Message     string `json:"message,omitempty"`
 	Stacktrace  string `json:"stacktrace,omitempty"`
+	// Code is the code of the error in the error registry
+	Code ErrorCode `json:"code,omitempty"`
+	// ErrorID identifies the error in the server logs (only set for unexpected errors)
+	ErrorID string `json:"errorId,omitempty"`
 }
 
 type Validator interface {
@@ -145,8 +157,12 @@ func (err *RemoteError) Error() string {
 type Qr struct {
 	// Server with which to perform the session
 	URL string `json:"u"`
-	// Session type (disclosing, signing, issuing)
+	// Session type (disclosing, signing, issuing), or redirect if a session pointer is to be
+	// obtained by POSTing to the URL (as done by static QRs)
 	Type Action `json:"irmaqr"`
+	// Moment at which the session times out if no IRMA app has connected to it by then, so that
+	// frontends can show that the QR has expired (set by IRMA servers when starting sessions)
+	Expiry *Timestamp `json:"expiry,omitempty"`
 }
 
 type SchemeManagerRequest Qr
@@ -164,6 +180,7 @@ const (
 	ActionDisclosing    = Action("disclosing")
 	ActionSigning       = Action("signing")
 	ActionIssuing       = Action("issuing")
+	ActionRedirect      = Action("redirect")
 	ActionUnknown       = Action("unknown")
 )
 
@@ -201,6 +218,69 @@ const (
 	ErrorPanic = ErrorType("panic")
 )
 
+// Error classes
+const (
+	// The error is likely temporary (e.g. network problems), so the session may succeed when retried
+	ErrorClassRetryable = ErrorClass("retryable")
+	// The session cannot succeed without action of the user or the requestor
+	// (e.g. the app needs to be updated, or the requestor rejected the response)
+	ErrorClassUserActionable = ErrorClass("userActionable")
+	// The error is caused by a bug or an incompatibility, and should be reported
+	ErrorClassFatal = ErrorClass("fatal")
+)
+
+// Protocol steps
+const (
+	// Retrieving the session request from the server
+	StepRequest = ProtocolStep("request")
+	// Checking and downloading the schemes involved in the session
+	StepConfiguration = ProtocolStep("configuration")
+	// Computing the proofs of knowledge
+	StepProofs = ProtocolStep("proofs")
+	// Performing the keyshare protocol with the keyshare server(s)
+	StepKeyshare = ProtocolStep("keyshare")
+	// Sending our response to the server and processing its reply
+	StepResponse = ProtocolStep("response")
+)
+
+// Class classifies the error as retryable, user-actionable or fatal,
+// based on its type and on the HTTP status returned by the server, if any.
+func (e *SessionError) Class() ErrorClass {
+	switch e.ErrorType {
+	case ErrorTransport, ErrorConfigurationDownload:
+		return ErrorClassRetryable
+	case ErrorProtocolVersionNotSupported, ErrorRejected, ErrorUnknownCredentialType,
+		ErrorUnknownSchemeManager, ErrorInvalidSchemeManager:
+		return ErrorClassUserActionable
+	case ErrorApi, ErrorServerResponse, ErrorKeyshare:
+		if e.RemoteStatus != 0 && e.RemoteStatus != 200 {
+			return statusClass(e.RemoteStatus)
+		}
+		if e.RemoteError != nil {
+			return statusClass(e.RemoteError.Status)
+		}
+		if e.ErrorType == ErrorKeyshare {
+			// Most likely the keyshare server could not be reached
+			return ErrorClassRetryable
+		}
+		return ErrorClassFatal
+	default:
+		return ErrorClassFatal
+	}
+}
+
+// statusClass classifies an HTTP error status returned by a server.
+func statusClass(status int) ErrorClass {
+	switch {
+	case status == 408, status == 429, status == 502, status == 503, status == 504:
+		return ErrorClassRetryable
+	case status >= 400 && status < 500:
+		return ErrorClassUserActionable
+	default:
+		return ErrorClassFatal
+	}
+}
+
 func (e *SessionError) Error() string {
 	var buffer bytes.Buffer
 	typ := e.ErrorType
@@ -210,6 +290,10 @@ func (e *SessionError) Error() string {
 
 	buffer.WriteString("Error type: ")
 	buffer.WriteString(string(typ))
+	if e.Step != "" {
+		buffer.WriteString("\nProtocol step: ")
+		buffer.WriteString(string(e.Step))
+	}
 	if e.Err != nil {
 		buffer.WriteString("\nDescription: ")
 		buffer.WriteString(e.Err.Error())
@@ -264,6 +348,22 @@ type IssueCommitmentMessage struct {
 	Indices DisclosedAttributeIndices `json:"indices"`
 }
 
+// IssuanceResponse is the response of the server to an IssueCommitmentMessage as of protocol
+// version 2.5. If the server modified the attribute values of the credentials (see
+// server.IssuanceCondition), Credentials contains the credentials that were actually issued.
+type IssuanceResponse struct {
+	Signatures  []*gabi.IssueSignatureMessage `json:"signatures"`
+	Credentials []*CredentialRequest          `json:"credentials,omitempty"`
+}
+
+// DisclosureResponse is the response of the server to the proofs of a disclosure session as of
+// protocol version 2.6. If the session is followed by a next session (see
+// RequestorBaseRequest.NextSessionUrl), NextSession points to that session.
+type DisclosureResponse struct {
+	ProofStatus ProofStatus `json:"proofStatus"`
+	NextSession *Qr         `json:"nextSession,omitempty"`
+}
+
 func (i *IssueCommitmentMessage) Disclosure() *Disclosure {
 	return &Disclosure{
 		Proofs:  i.Proofs,
@@ -307,6 +407,7 @@ func (qr *Qr) Validate() (err error) {
 	case ActionDisclosing: // nop
 	case ActionIssuing: // nop
 	case ActionSigning: // nop
+	case ActionRedirect: // nop
 	default:
 		return errors.New("Unsupported session type")
 	}
@@ -0,0 +1,100 @@
+package irma
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Schemes may list mirrors in their description.xml, from which the scheme can be downloaded
+// if its main URL is unreachable. The mirrors must serve exactly the same files as the main URL;
+// the authenticity of all files is checked against the (signed) scheme index as usual.
+// When downloading scheme files, the URLs of a scheme are tried in order of their health,
+// i.e., URLs that recently failed are tried last.
+
+// mirrorFailureExpiry is the duration after which a failure of a scheme URL is forgotten,
+// so that it is again preferred over its mirrors.
+const mirrorFailureExpiry = time.Hour
+
+// mirrorHealth keeps track of failed requests to scheme URLs.
+type mirrorHealth struct {
+	mutex    sync.Mutex
+	failures map[string]*mirrorFailures
+}
+
+type mirrorFailures struct {
+	count int
+	last  time.Time
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{failures: map[string]*mirrorFailures{}}
+}
+
+// order returns the specified URLs, sorted by the amount of recent consecutive failures.
+func (h *mirrorHealth) order(urls []string) []string {
+	sorted := append([]string{}, urls...)
+	if h == nil {
+		return sorted
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return h.recentFailures(sorted[i]) < h.recentFailures(sorted[j])
+	})
+	return sorted
+}
+
+func (h *mirrorHealth) recentFailures(url string) int {
+	f, ok := h.failures[url]
+	if !ok || time.Since(f.last) > mirrorFailureExpiry {
+		return 0
+	}
+	return f.count
+}
+
+func (h *mirrorHealth) failed(url string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	f, ok := h.failures[url]
+	if !ok {
+		f = &mirrorFailures{}
+		h.failures[url] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+func (h *mirrorHealth) succeeded(url string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.failures, url)
+}
+
+// URLs returns the URL of the scheme followed by its mirrors.
+func (sm *SchemeManager) URLs() []string {
+	return append([]string{sm.URL}, sm.Mirrors...)
+}
+
+// schemeRequest invokes f with a transport to the URL of the specified scheme, and if f fails,
+// to each of the mirrors of the scheme until f succeeds. Returns the error of the last attempt.
+func (conf *Configuration) schemeRequest(manager *SchemeManager, f func(transport *HTTPTransport) error) error {
+	var err error
+	for _, url := range conf.mirrors.order(manager.URLs()) {
+		transport := conf.NewSchemeTransport(manager.Identifier(), url)
+		transport.SetCache(conf.httpCache)
+		if err = f(transport); err == nil {
+			conf.mirrors.succeeded(url)
+			return nil
+		}
+		conf.mirrors.failed(url)
+		Logger.WithField("scheme", manager.ID).WithField("url", url).Warn("Scheme download failed: ", err.Error())
+	}
+	return err
+}
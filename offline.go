@@ -0,0 +1,229 @@
+package irma
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Offline disclosure: in manual sessions (see irmaclient.Client.NewOfflineSession()), the IRMA
+// app computes a disclosure or attribute-based signature without contacting a server. An
+// OfflineProof contains the result, to be transferred to the verifier out of band: as a byte blob
+// (see OfflineProof.MarshalBinary()), e.g. over NFC or Bluetooth, or as a sequence of QR codes
+// (see OfflineProof.QRChunks()), which the verifier scans in any order using an
+// OfflineProofScanner. The blob consists of offlineProofVersion followed by the DEFLATE-compressed
+// JSON of the OfflineProof. Each QR chunk has the form
+//
+//   irmaproof:<id>:<number>/<total>:<data>
+//
+// in which id identifies the proof (the hex-encoded first bytes of the SHA256 hash of the blob),
+// and data is a part of the base64url encoding of the blob.
+
+// OfflineProof is a disclosure or attribute-based signature computed without contacting a server.
+type OfflineProof struct {
+	Type       Action         `json:"type"`
+	Disclosure *Disclosure    `json:"disclosure,omitempty"`
+	Signature  *SignedMessage `json:"signature,omitempty"`
+}
+
+// DefaultOfflineChunkSize is the amount of data characters per QR chunk if none is specified;
+// larger QR codes take longer to scan, especially from screens.
+const DefaultOfflineChunkSize = 800
+
+const (
+	offlineProofVersion  = byte(1)
+	offlineChunkPrefix   = "irmaproof:"
+	offlineIDLength      = 4       // bytes of the hash of the blob
+	offlineProofMaxBytes = 1 << 20 // maximum size of the decompressed JSON
+	offlineMaxChunks     = 1000
+)
+
+// MarshalBinary returns the compressed binary encoding of the proof.
+func (p *OfflineProof) MarshalBinary() ([]byte, error) {
+	bts, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(offlineProofVersion)
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(bts); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary parses the binary encoding of a proof, as returned by MarshalBinary().
+func (p *OfflineProof) UnmarshalBinary(blob []byte) error {
+	if len(blob) == 0 || blob[0] != offlineProofVersion {
+		return errors.New("Unsupported offline proof version")
+	}
+	r := flate.NewReader(bytes.NewReader(blob[1:]))
+	defer r.Close()
+	bts, err := ioutil.ReadAll(&limitedReader{r: r, n: offlineProofMaxBytes})
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to decompress offline proof", 0)
+	}
+	if err = json.Unmarshal(bts, p); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse offline proof", 0)
+	}
+	switch {
+	case p.Type == ActionDisclosing && p.Disclosure != nil && p.Signature == nil:
+	case p.Type == ActionSigning && p.Signature != nil && p.Disclosure == nil:
+	default:
+		return errors.New("Offline proof must contain either a disclosure or a signature")
+	}
+	return nil
+}
+
+// QRChunks returns the proof as a sequence of strings to be shown as QR codes, each containing
+// at most chunkSize data characters (DefaultOfflineChunkSize if chunkSize is 0).
+func (p *OfflineProof) QRChunks(chunkSize int) ([]string, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultOfflineChunkSize
+	}
+	blob, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := base64.RawURLEncoding.EncodeToString(blob)
+	id := offlineProofID(blob)
+	total := (len(data) + chunkSize - 1) / chunkSize
+	chunks := make([]string, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, offlineChunkPrefix+id+":"+
+			strconv.Itoa(i+1)+"/"+strconv.Itoa(total)+":"+data[i*chunkSize:end])
+	}
+	return chunks, nil
+}
+
+// Verify verifies the proof. For disclosures, the request that was presented to the IRMA app is
+// required, as it contains the nonce and context that the proof must match; for signatures, the
+// request is optional (see SignedMessage.Verify()).
+func (p *OfflineProof) Verify(conf *Configuration, request SessionRequest) ([]*DisclosedAttribute, ProofStatus, error) {
+	switch p.Type {
+	case ActionDisclosing:
+		dr, ok := request.(*DisclosureRequest)
+		if !ok || dr == nil {
+			return nil, ProofStatusUnmatchedRequest, errors.New("Verifying offline disclosure requires its disclosure request")
+		}
+		return p.Disclosure.Verify(conf, dr)
+	case ActionSigning:
+		var sr *SignatureRequest
+		if request != nil {
+			var ok bool
+			if sr, ok = request.(*SignatureRequest); !ok {
+				return nil, ProofStatusUnmatchedRequest, errors.New("Offline signature must be verified against a signature request")
+			}
+		}
+		return p.Signature.Verify(conf, sr)
+	default:
+		return nil, ProofStatusInvalid, errors.Errorf("Unsupported offline proof type %s", p.Type)
+	}
+}
+
+// OfflineProofScanner reassembles an OfflineProof from its QR chunks (see OfflineProof.QRChunks()),
+// which may be scanned in any order and more than once.
+type OfflineProofScanner struct {
+	id      string
+	chunks  []string
+	missing int
+}
+
+// Add adds a scanned QR chunk, returning whether all chunks of the proof have now been scanned.
+func (s *OfflineProofScanner) Add(chunk string) (bool, error) {
+	if !strings.HasPrefix(chunk, offlineChunkPrefix) {
+		return false, errors.New("Not an offline proof")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(chunk, offlineChunkPrefix), ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return false, errors.New("Malformed offline proof chunk")
+	}
+	numbers := strings.SplitN(parts[1], "/", 2)
+	if len(numbers) != 2 {
+		return false, errors.New("Malformed offline proof chunk")
+	}
+	number, err1 := strconv.Atoi(numbers[0])
+	total, err2 := strconv.Atoi(numbers[1])
+	if err1 != nil || err2 != nil || total < 1 || total > offlineMaxChunks || number < 1 || number > total {
+		return false, errors.New("Malformed offline proof chunk number")
+	}
+
+	if s.chunks == nil {
+		s.id, s.chunks, s.missing = parts[0], make([]string, total), total
+	} else if parts[0] != s.id || total != len(s.chunks) {
+		return false, errors.New("Chunk belongs to a different offline proof")
+	}
+	if s.chunks[number-1] == "" {
+		s.chunks[number-1] = parts[2]
+		s.missing--
+	}
+	return s.missing == 0, nil
+}
+
+// Missing returns the amount of chunks that still have to be scanned, or -1 if no chunk has been
+// scanned yet.
+func (s *OfflineProofScanner) Missing() int {
+	if s.chunks == nil {
+		return -1
+	}
+	return s.missing
+}
+
+// Proof returns the proof, once all of its chunks have been scanned.
+func (s *OfflineProofScanner) Proof() (*OfflineProof, error) {
+	if s.chunks == nil || s.missing > 0 {
+		return nil, errors.New("Not all chunks of the offline proof have been scanned")
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(strings.Join(s.chunks, ""))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to decode offline proof", 0)
+	}
+	if offlineProofID(blob) != s.id {
+		return nil, errors.New("Offline proof does not match its identifier")
+	}
+	p := &OfflineProof{}
+	if err = p.UnmarshalBinary(blob); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func offlineProofID(blob []byte) string {
+	hash := sha256.Sum256(blob)
+	return hex.EncodeToString(hash[:offlineIDLength])
+}
+
+// limitedReader returns an error once more than n bytes are read, so that small blobs cannot
+// decompress into arbitrarily large amounts of data.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n -= n; l.n < 0 {
+		return n, errors.New("Offline proof too large")
+	}
+	return n, err
+}
@@ -0,0 +1,174 @@
+package irma
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// PrivateKeyRing provides the private keys of issuers. The Configuration is a PrivateKeyRing
+// containing the private keys in the PrivateKeys folders of its issuers; PrivateKeyRingPath
+// reads them from a directory, possibly decrypting them.
+//
+// Issuing a credential requires the private key itself, as the CL signature of the credential
+// cannot be computed by hardware security modules or key management services. These can
+// however protect the private keys at rest: a PrivateKeyDecrypter using e.g. a PKCS#11 token or
+// the decryption API of a cloud KMS unwraps the private keys only into memory when they are loaded.
+type PrivateKeyRing interface {
+	// PrivateKey returns the specified private key, or nil if not present in the ring.
+	PrivateKey(id IssuerIdentifier, counter int) (*gabi.PrivateKey, error)
+	// PrivateKeyLatest returns the private key of the issuer with the highest counter,
+	// or nil if the ring contains no private keys of the issuer.
+	PrivateKeyLatest(id IssuerIdentifier) (*gabi.PrivateKey, error)
+}
+
+// PrivateKeyDecrypter decrypts encrypted private key files, e.g. using a key in a PKCS#11 token
+// or a cloud KMS.
+type PrivateKeyDecrypter interface {
+	DecryptPrivateKey(ciphertext []byte) ([]byte, error)
+}
+
+// PrivateKeyRingPath is a PrivateKeyRing containing the private keys in a directory, named after
+// their issuer, either as scheme.issuer.xml or as scheme.issuer.counter.xml.
+type PrivateKeyRingPath struct {
+	path string
+	keys map[IssuerIdentifier]map[int]*gabi.PrivateKey
+}
+
+// PrivateKeyRingMerged is a PrivateKeyRing consisting of other rings. Of a key present in
+// several rings, the one in the first ring is used.
+type PrivateKeyRingMerged []PrivateKeyRing
+
+// NewPrivateKeyRingPath reads the private keys in the specified directory, decrypting them first
+// using the specified decrypter, if not nil. Each key must belong to a known issuer and to the
+// corresponding public key in the Configuration.
+func NewPrivateKeyRingPath(path string, conf *Configuration, decrypter PrivateKeyDecrypter) (*PrivateKeyRingPath, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &PrivateKeyRingPath{path: path, keys: map[IssuerIdentifier]map[int]*gabi.PrivateKey{}}
+	for _, file := range files {
+		filename := file.Name()
+		if file.IsDir() || filepath.Ext(filename) != ".xml" || filename[0] == '.' {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(filename, ".xml"), ".")
+		if len(parts) != 2 && len(parts) != 3 {
+			continue
+		}
+		id := NewIssuerIdentifier(parts[0] + "." + parts[1])
+		if _, ok := conf.Issuers[id]; !ok {
+			return nil, errors.Errorf("Private key %s belongs to an unknown issuer", filename)
+		}
+
+		sk, err := readPrivateKeyFile(filepath.Join(path, filename), decrypter)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 3 && parts[2] != strconv.Itoa(int(sk.Counter)) {
+			return nil, configurationError(ErrInvalidKey, nil,
+				fmt.Sprintf("Private key %s has wrong <Counter>", filename))
+		}
+		if err = checkPrivateKey(conf, id, sk); err != nil {
+			return nil, err
+		}
+
+		if ring.keys[id] == nil {
+			ring.keys[id] = map[int]*gabi.PrivateKey{}
+		}
+		ring.keys[id][int(sk.Counter)] = sk
+	}
+	return ring, nil
+}
+
+// readPrivateKeyFile reads the private key in the specified file, decrypting it first using the
+// specified decrypter, if not nil. The file contents are wiped from memory afterwards.
+func readPrivateKeyFile(file string, decrypter PrivateKeyDecrypter) (*gabi.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	bts := SecureBytes(contents)
+	defer bts.Wipe()
+	if decrypter != nil {
+		plaintext, err := decrypter.DecryptPrivateKey(bts)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to decrypt private key "+filepath.Base(file), 0)
+		}
+		bts = SecureBytes(plaintext)
+		defer bts.Wipe()
+	}
+	return parsePrivateKey(bts)
+}
+
+// checkPrivateKey checks that the specified private key belongs to the corresponding public key.
+func checkPrivateKey(conf *Configuration, id IssuerIdentifier, sk *gabi.PrivateKey) error {
+	pk, err := conf.PublicKey(id, int(sk.Counter))
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return errors.Errorf("Missing public key belonging to private key %s-%d", id.String(), sk.Counter)
+	}
+	if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+		return errors.Errorf("Private key %s-%d does not belong to corresponding public key", id.String(), sk.Counter)
+	}
+	return nil
+}
+
+func (ring *PrivateKeyRingPath) PrivateKey(id IssuerIdentifier, counter int) (*gabi.PrivateKey, error) {
+	return ring.keys[id][counter], nil
+}
+
+func (ring *PrivateKeyRingPath) PrivateKeyLatest(id IssuerIdentifier) (*gabi.PrivateKey, error) {
+	var latest *gabi.PrivateKey
+	for _, sk := range ring.keys[id] {
+		if latest == nil || sk.Counter > latest.Counter {
+			latest = sk
+		}
+	}
+	return latest, nil
+}
+
+// Close wipes the private keys of the ring from memory (see WipePrivateKey()), after which the
+// ring is empty.
+func (ring *PrivateKeyRingPath) Close() {
+	for _, keys := range ring.keys {
+		for _, sk := range keys {
+			WipePrivateKey(sk)
+		}
+	}
+	ring.keys = map[IssuerIdentifier]map[int]*gabi.PrivateKey{}
+}
+
+func (ring PrivateKeyRingMerged) PrivateKey(id IssuerIdentifier, counter int) (*gabi.PrivateKey, error) {
+	for _, r := range ring {
+		sk, err := r.PrivateKey(id, counter)
+		if err != nil || sk != nil {
+			return sk, err
+		}
+	}
+	return nil, nil
+}
+
+func (ring PrivateKeyRingMerged) PrivateKeyLatest(id IssuerIdentifier) (*gabi.PrivateKey, error) {
+	var latest *gabi.PrivateKey
+	for _, r := range ring {
+		sk, err := r.PrivateKeyLatest(id)
+		if err != nil {
+			return nil, err
+		}
+		if sk != nil && (latest == nil || sk.Counter > latest.Counter) {
+			latest = sk
+		}
+	}
+	return latest, nil
+}
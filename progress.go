@@ -0,0 +1,51 @@
+package irma
+
+import (
+	"os"
+)
+
+// SchemeProgress describes the progress of downloading the files of a scheme, during scheme
+// installation or updating.
+type SchemeProgress struct {
+	Scheme         SchemeManagerIdentifier
+	FilesTotal     int   // Amount of files that are to be downloaded
+	FilesCompleted int   // Amount of files downloaded so far
+	Bytes          int64 // Size of the files downloaded so far
+}
+
+// SchemeProgressHandler receives the progress of scheme installations and updates, see
+// Configuration.ProgressHandler.
+type SchemeProgressHandler func(progress SchemeProgress)
+
+// schemeProgress reports the progress of downloading the files of a scheme to the progress
+// handler of the Configuration, if any.
+type schemeProgress struct {
+	SchemeProgress
+	handler SchemeProgressHandler
+}
+
+// startProgress reports that the specified amount of files of the specified scheme are to be
+// downloaded, returning the schemeProgress to which to report completed files.
+func (conf *Configuration) startProgress(id SchemeManagerIdentifier, total int) *schemeProgress {
+	p := &schemeProgress{
+		SchemeProgress: SchemeProgress{Scheme: id, FilesTotal: total},
+		handler:        conf.ProgressHandler,
+	}
+	p.report()
+	return p
+}
+
+// completed reports that the file at the specified path has been downloaded.
+func (p *schemeProgress) completed(path string) {
+	p.FilesCompleted++
+	if info, err := os.Stat(path); err == nil {
+		p.Bytes += info.Size()
+	}
+	p.report()
+}
+
+func (p *schemeProgress) report() {
+	if p.handler != nil && p.FilesTotal > 0 {
+		p.handler(p.SchemeProgress)
+	}
+}
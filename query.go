@@ -0,0 +1,153 @@
+package irma
+
+import (
+	"sort"
+	"strings"
+)
+
+// This file contains functions for querying the issuers, credential types and attribute types
+// of a Configuration, e.g. for presenting them in (wallet) user interfaces.
+
+// Query specifies which issuers, credential types or attribute types are returned by
+// FindIssuers(), FindCredentialTypes() and FindAttributeTypes(). Empty fields do not filter.
+type Query struct {
+	// Text must occur in the name of the result (case-insensitively) in the language Language,
+	// or in any language if Language is empty
+	Text     string
+	Language string
+
+	Scheme         SchemeManagerIdentifier
+	Issuer         IssuerIdentifier
+	CredentialType CredentialTypeIdentifier
+
+	// Whether to include credential types and attribute types that are deprecated (at present)
+	IncludeDeprecated bool
+}
+
+// FindIssuers returns the issuers matching the query, sorted by identifier.
+// The CredentialType and IncludeDeprecated fields of the query are ignored.
+func (conf *Configuration) FindIssuers(query Query) []*Issuer {
+	conf.mutex.RLock()
+	defer conf.mutex.RUnlock()
+
+	var result []*Issuer
+	for id, issuer := range conf.Issuers {
+		if !query.Scheme.Empty() && id.SchemeManagerIdentifier() != query.Scheme {
+			continue
+		}
+		if !query.Issuer.Empty() && id != query.Issuer {
+			continue
+		}
+		if !query.matches(issuer.Name) && !query.matches(issuer.ShortName) {
+			continue
+		}
+		result = append(result, issuer)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Identifier().String() < result[j].Identifier().String()
+	})
+	return result
+}
+
+// FindCredentialTypes returns the credential types matching the query, sorted by identifier.
+func (conf *Configuration) FindCredentialTypes(query Query) []*CredentialType {
+	conf.mutex.RLock()
+	defer conf.mutex.RUnlock()
+
+	var result []*CredentialType
+	for id, credtype := range conf.CredentialTypes {
+		if !query.matchesCredentialType(id, credtype) {
+			continue
+		}
+		if !query.matches(credtype.Name) && !query.matches(credtype.ShortName) {
+			continue
+		}
+		result = append(result, credtype)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Identifier().String() < result[j].Identifier().String()
+	})
+	return result
+}
+
+// FindAttributeTypes returns the attribute types matching the query, sorted by credential type
+// identifier, and within each credential type in display order.
+func (conf *Configuration) FindAttributeTypes(query Query) []*AttributeType {
+	conf.mutex.RLock()
+	defer conf.mutex.RUnlock()
+
+	var credtypes []*CredentialType
+	for id, credtype := range conf.CredentialTypes {
+		if query.matchesCredentialType(id, credtype) {
+			credtypes = append(credtypes, credtype)
+		}
+	}
+	sort.Slice(credtypes, func(i, j int) bool {
+		return credtypes[i].Identifier().String() < credtypes[j].Identifier().String()
+	})
+
+	var result []*AttributeType
+	for _, credtype := range credtypes {
+		for _, attr := range credtype.AttributeTypesInDisplayOrder() {
+			if !query.IncludeDeprecated && attr.IsDeprecated(Now()) {
+				continue
+			}
+			if query.matches(attr.Name) {
+				result = append(result, attr)
+			}
+		}
+	}
+	return result
+}
+
+// AttributeTypesInDisplayOrder returns the attribute types of the credential type in the order in
+// which they should be shown to the user: ordered by their display index if specified, and
+// otherwise in the order in which they occur in the credential type.
+func (ct *CredentialType) AttributeTypesInDisplayOrder() []*AttributeType {
+	result := make([]*AttributeType, len(ct.AttributeTypes))
+	copy(result, ct.AttributeTypes)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].displayIndex() < result[j].displayIndex()
+	})
+	return result
+}
+
+func (ad AttributeType) displayIndex() int {
+	if ad.DisplayIndex != nil {
+		return *ad.DisplayIndex
+	}
+	return ad.Index
+}
+
+func (query Query) matchesCredentialType(id CredentialTypeIdentifier, credtype *CredentialType) bool {
+	if !query.Scheme.Empty() && id.IssuerIdentifier().SchemeManagerIdentifier() != query.Scheme {
+		return false
+	}
+	if !query.Issuer.Empty() && id.IssuerIdentifier() != query.Issuer {
+		return false
+	}
+	if !query.CredentialType.Empty() && id != query.CredentialType {
+		return false
+	}
+	if !query.IncludeDeprecated && credtype.IsDeprecated(Now()) {
+		return false
+	}
+	return true
+}
+
+// matches returns whether the text of the query occurs in the specified translated string.
+func (query Query) matches(ts TranslatedString) bool {
+	if query.Text == "" {
+		return true
+	}
+	text := strings.ToLower(query.Text)
+	for lang, translation := range ts {
+		if query.Language != "" && lang != query.Language {
+			continue
+		}
+		if strings.Contains(strings.ToLower(translation), text) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,10 @@
 package irma
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -84,6 +88,12 @@ type CredentialRequest struct {
 	KeyCounter       int                      `json:"keyCounter,omitempty"`
 	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
 	Attributes       map[string]string        `json:"attributes"`
+
+	// If set, the IRMA server retrieves the attribute values of the credential from its attribute
+	// value provider with this name (see server.AttributeValueProvider), passing it ProviderKey.
+	// The server removes these fields before sending the request to the IRMA app.
+	Provider    string `json:"provider,omitempty"`
+	ProviderKey string `json:"providerKey,omitempty"`
 }
 
 // ServerJwt contains standard JWT fields.
@@ -98,7 +108,15 @@ type ServerJwt struct {
 type RequestorBaseRequest struct {
 	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
 	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
+	SessionLifetime   int    `json:"lifetime,omitempty"`    // Time out the session if it has not finished this many seconds after it started
+	ResultRetention   int    `json:"retention,omitempty"`   // Keep the session result this many seconds after the session has finished
 	CallbackUrl       string `json:"callbackUrl,omitempty"` // URL to post session result to
+	// URL to post the session result to once the attributes have been disclosed, which responds
+	// with the request of the next session to be performed by the IRMA app (disclosure sessions only)
+	NextSessionUrl string `json:"nextSessionUrl,omitempty"`
+	// Signature over the session request by the party that approved it (see SignRequestHash()),
+	// e.g. when the request reaches the IRMA server through an intermediary
+	RequestSignature *RequestSignature `json:"requestSignature,omitempty"`
 }
 
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
@@ -243,14 +261,34 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	}
 
 	for _, attrtype := range credtype.AttributeTypes {
-		if _, present := cr.Attributes[attrtype.ID]; !present && attrtype.Optional != "true" {
+		value, present := cr.Attributes[attrtype.ID]
+		if !present && attrtype.Optional != "true" {
 			return errors.New("Required attribute not present in credential request")
 		}
+		if present && attrtype.Format != nil {
+			if err := attrtype.Format.Validate(value); err != nil {
+				return errors.WrapPrefix(err, "Invalid value of attribute "+attrtype.ID+":", 0)
+			}
+		}
 	}
 
 	return nil
 }
 
+// Canonicalize replaces the attribute values in this credential request by their canonical form,
+// as specified by the formats of their attribute types (see AttributeFormat), if any.
+func (cr *CredentialRequest) Canonicalize(conf *Configuration) {
+	credtype := conf.CredentialTypes[cr.CredentialTypeID]
+	if credtype == nil {
+		return
+	}
+	for _, attrtype := range credtype.AttributeTypes {
+		if value, present := cr.Attributes[attrtype.ID]; present && attrtype.Format != nil {
+			cr.Attributes[attrtype.ID] = attrtype.Format.Canonicalize(value)
+		}
+	}
+}
+
 // AttributeList returns the list of attributes from this credential request.
 func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion byte) (*AttributeList, error) {
 	if err := cr.Validate(conf); err != nil {
@@ -486,6 +524,26 @@ func (t *Timestamp) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalText implements encoding.TextMarshaler, encoding a timestamp as a Unix timestamp.
+func (t *Timestamp) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *Timestamp) UnmarshalText(text []byte) error {
+	return t.UnmarshalJSON(bytes.TrimSpace(text))
+}
+
+// GobEncode implements gob.GobEncoder, as used by the scheme cache.
+func (t *Timestamp) GobEncode() ([]byte, error) {
+	return time.Time(*t).MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder.
+func (t *Timestamp) GobDecode(bts []byte) error {
+	return (*time.Time)(t).UnmarshalBinary(bts)
+}
+
 // Timestamp implements Stringer.
 func (t *Timestamp) String() string {
 	return fmt.Sprint(time.Time(*t).Unix())
@@ -526,7 +584,7 @@ func NewServiceProviderJwt(servername string, dr *DisclosureRequest) *ServicePro
 	return &ServiceProviderJwt{
 		ServerJwt: ServerJwt{
 			ServerName: servername,
-			IssuedAt:   Timestamp(time.Now()),
+			IssuedAt:   Timestamp(Now()),
 			Type:       "verification_request",
 		},
 		Request: &ServiceProviderRequest{
@@ -541,7 +599,7 @@ func NewSignatureRequestorJwt(servername string, sr *SignatureRequest) *Signatur
 	return &SignatureRequestorJwt{
 		ServerJwt: ServerJwt{
 			ServerName: servername,
-			IssuedAt:   Timestamp(time.Now()),
+			IssuedAt:   Timestamp(Now()),
 			Type:       "signature_request",
 		},
 		Request: &SignatureRequestorRequest{
@@ -556,7 +614,7 @@ func NewIdentityProviderJwt(servername string, ir *IssuanceRequest) *IdentityPro
 	return &IdentityProviderJwt{
 		ServerJwt: ServerJwt{
 			ServerName: servername,
-			IssuedAt:   Timestamp(time.Now()),
+			IssuedAt:   Timestamp(Now()),
 			Type:       "issue_request",
 		},
 		Request: &IdentityProviderRequest{
@@ -610,7 +668,7 @@ func (claims *ServiceProviderJwt) Valid() error {
 
 		return errors.New("Verification jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(Now()) {
 		return errors.New("Verification jwt not yet valid")
 	}
 	return nil
@@ -620,7 +678,7 @@ func (claims *SignatureRequestorJwt) Valid() error {
 	if claims.Type != "signature_request" {
 		return errors.New("Signature jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(Now()) {
 		return errors.New("Signature jwt not yet valid")
 	}
 	return nil
@@ -630,7 +688,7 @@ func (claims *IdentityProviderJwt) Valid() error {
 	if claims.Type != "issue_request" {
 		return errors.New("Issuance jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(Now()) {
 		return errors.New("Issuance jwt not yet valid")
 	}
 	return nil
@@ -670,3 +728,98 @@ func SignRequestorRequest(request RequestorRequest, alg jwt.SigningMethod, key i
 	}
 	return jwtcontents.Sign(alg, key)
 }
+
+// RequestHash is the SHA256 hash of the canonical representation of a (session or requestor) request.
+type RequestHash []byte
+
+func (hash RequestHash) String() string {
+	return hex.EncodeToString(hash)
+}
+
+func (hash RequestHash) Equal(other RequestHash) bool {
+	return bytes.Equal(hash, other)
+}
+
+// CanonicalRequest returns a canonical byte representation of the specified request, which
+// may be a SessionRequest, a RequestorRequest, or their JSON serialization (as []byte or
+// json.RawMessage). The result is compact JSON whose object keys are sorted, so that two requests
+// that differ only in key order or whitespace have identical canonical representations.
+// Note that fields that the server fills in when starting the session (such as the nonce
+// and context) are included if present, so the canonical representation should be computed
+// before the request is handed to the server.
+func CanonicalRequest(request interface{}) ([]byte, error) {
+	var bts []byte
+	var err error
+	switch r := request.(type) {
+	case []byte:
+		bts = r
+	case json.RawMessage:
+		bts = r
+	default:
+		if bts, err = json.Marshal(request); err != nil {
+			return nil, err
+		}
+	}
+
+	// Unmarshaling into an interface{} and marshaling again sorts all object keys
+	// and removes all insignificant whitespace; UseNumber prevents numbers
+	// from being converted to (and possibly losing precision as) floats
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to canonicalize request", 0)
+	}
+	if decoder.More() {
+		return nil, errors.New("Failed to canonicalize request: trailing data")
+	}
+	return json.Marshal(generic)
+}
+
+// HashRequest returns the SHA256 hash of the canonical representation of the specified request
+// (see CanonicalRequest).
+func HashRequest(request interface{}) (RequestHash, error) {
+	bts, err := CanonicalRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bts)
+	return RequestHash(hash[:]), nil
+}
+
+// SignRequestHash computes a detached signature over the hash of the canonical
+// representation of the specified request, using the specified JWT signing method and key.
+// This allows requestors to approve a request independently of how it is transported
+// to the IRMA server.
+func SignRequestHash(request interface{}, alg jwt.SigningMethod, key interface{}) (string, error) {
+	hash, err := HashRequest(request)
+	if err != nil {
+		return "", err
+	}
+	return alg.Sign(hash.String(), key)
+}
+
+// RequestSignature is a detached signature over a session request created by SignRequestHash,
+// along with the JWT signing method with which it was created.
+type RequestSignature struct {
+	Alg       string `json:"alg"`
+	Signature string `json:"signature"`
+}
+
+// Verify verifies the signature over the specified request using the specified public key.
+func (sig *RequestSignature) Verify(request interface{}, key interface{}) error {
+	alg := jwt.GetSigningMethod(sig.Alg)
+	if alg == nil || alg == jwt.SigningMethodNone {
+		return errors.Errorf("Unsupported request signature algorithm %s", sig.Alg)
+	}
+	return VerifyRequestHash(request, sig.Signature, alg, key)
+}
+
+// VerifyRequestHash verifies a signature created by SignRequestHash over the specified request.
+func VerifyRequestHash(request interface{}, signature string, alg jwt.SigningMethod, key interface{}) error {
+	hash, err := HashRequest(request)
+	if err != nil {
+		return err
+	}
+	return alg.Verify(hash.String(), signature, key)
+}
@@ -0,0 +1,254 @@
+package irma
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// A scheme uses separate keys for separate purposes, so that the compromise of one of them does
+// not compromise the others. The index of the scheme is signed by the scheme key (pk.pem), which
+// is the trust root of the scheme. As the description is signed through the index, the scheme
+// key vouches for the other keys of the scheme, which are declared in its description:
+//  - a timestamp key, with which the timestamp of the scheme is signed (in timestamp.sig),
+//    so that the freshness of the scheme can be asserted using a key that can be kept online,
+//    without allowing its holder to modify the contents of the scheme;
+//  - keyshare keys, with which the keyshare server of the scheme signs its JWTs.
+// For compatibility, schemes that do not declare a timestamp key have their timestamp
+// signed through the index as before, and schemes that do not declare keyshare keys use the
+// kss-<counter>.pem files. A declared keyshare key without PEM contents refers to its
+// kss-<counter>.pem file, which is distributed to clients through scheme updates as any other
+// scheme file.
+//
+// Keyshare keys may declare a validity period, outside of which JWTs signed with the key are
+// rejected. A keyshare server rolls over to a new key by first publishing it in the scheme with
+// a validity period starting in the future, so that clients can install it in the meantime,
+// and then limiting the validity of the old key to shortly after the moment it switches keys. The timestamp of a scheme declaring a timestamp key but lacking
+// timestamp.sig is accepted if it matches the index, so that schemes can migrate by first
+// declaring the key and then signing their timestamp with it.
+
+// SchemeKeyRole is the purpose of a SchemeKey.
+type SchemeKeyRole string
+
+const (
+	SchemeKeyRoleTimestamp = SchemeKeyRole("timestamp") // ECDSA key signing the scheme timestamp
+	SchemeKeyRoleKeyshare  = SchemeKeyRole("keyshare")  // RSA key signing keyshare server JWTs
+)
+
+// SchemeKey is a public key of a scheme, declared in the description of the scheme.
+type SchemeKey struct {
+	Role      SchemeKeyRole `xml:"role,attr"`
+	ID        int           `xml:"id,attr"`                  // Counter of keyshare keys
+	NotBefore int64         `xml:"notbefore,attr,omitempty"` // Unix time from which the key is valid, if set
+	NotAfter  int64         `xml:"notafter,attr,omitempty"`  // Unix time until which the key is valid, if set
+	PublicKey string        `xml:",chardata"`                // PEM-encoded public key
+}
+
+// ValidAt returns whether the specified time lies within the validity period of the key.
+func (key *SchemeKey) ValidAt(t time.Time) bool {
+	return (key.NotBefore == 0 || !t.Before(time.Unix(key.NotBefore, 0))) &&
+		(key.NotAfter == 0 || t.Before(time.Unix(key.NotAfter, 0)))
+}
+
+// Key returns the key of the specified role and counter declared by the scheme, or nil if absent.
+func (scheme *SchemeManager) Key(role SchemeKeyRole, id int) *SchemeKey {
+	for i := range scheme.Keys {
+		if scheme.Keys[i].Role == role && scheme.Keys[i].ID == id {
+			return &scheme.Keys[i]
+		}
+	}
+	return nil
+}
+
+// HasKeys returns whether the scheme declares keys of the specified role.
+func (scheme *SchemeManager) HasKeys(role SchemeKeyRole) bool {
+	for _, key := range scheme.Keys {
+		if key.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// lintSchemeKeys checks that the keys declared by the scheme are valid for their roles, and that
+// no key is used for more than one role, including the scheme key in pk.pem.
+func lintSchemeKeys(scheme *SchemeManager, dir string) error {
+	seen := map[string]string{}
+	if bts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem")); err == nil {
+		if block, _ := pem.Decode(bts); block != nil {
+			seen[string(block.Bytes)] = "scheme key pk.pem"
+		}
+	}
+
+	declared := map[string]struct{}{}
+	for _, key := range scheme.Keys {
+		name := fmt.Sprintf("%s key %d", key.Role, key.ID)
+		if _, ok := declared[name]; ok {
+			return errors.Errorf("Scheme %s declares %s more than once", scheme.ID, name)
+		}
+		declared[name] = struct{}{}
+
+		if key.NotBefore != 0 && key.NotAfter != 0 && key.NotAfter <= key.NotBefore {
+			return errors.Errorf("Scheme %s has %s with empty validity period", scheme.ID, name)
+		}
+
+		var err error
+		bts := []byte(key.PublicKey)
+		switch key.Role {
+		case SchemeKeyRoleTimestamp:
+			if key.ID != 0 {
+				err = errors.New("timestamp key must have id 0")
+			} else {
+				_, err = ParsePemEcdsaPublicKey([]byte(key.PublicKey))
+			}
+		case SchemeKeyRoleKeyshare:
+			if strings.TrimSpace(key.PublicKey) == "" {
+				if bts, err = ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("kss-%d.pem", key.ID))); err != nil {
+					break
+				}
+			}
+			_, err = parsePemRsaPublicKey(bts)
+		default:
+			err = errors.New("unknown role")
+		}
+		if err != nil {
+			return errors.Errorf("Scheme %s has invalid %s: %s", scheme.ID, name, err.Error())
+		}
+		block, _ := pem.Decode(bts)
+		if other, ok := seen[string(block.Bytes)]; ok {
+			return errors.Errorf("Scheme %s uses the same key as %s and %s", scheme.ID, other, name)
+		}
+		seen[string(block.Bytes)] = name
+	}
+	if scheme.AssertsFreshness && !scheme.HasKeys(SchemeKeyRoleTimestamp) {
+		return errors.Errorf("Scheme %s asserts its freshness but declares no timestamp key", scheme.ID)
+	}
+	return nil
+}
+
+func parsePemRsaPublicKey(bts []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, configurationError(ErrInvalidKey, nil, "Keyshare server public key is not PEM-encoded")
+	}
+	genericPk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, configurationError(ErrInvalidKey, err, "Invalid keyshare server public key")
+	}
+	pk, ok := genericPk.(*rsa.PublicKey)
+	if !ok {
+		return nil, configurationError(ErrInvalidKey, nil, "Invalid keyshare server public key")
+	}
+	return pk, nil
+}
+
+// timestampSigned returns whether the timestamp of the specified scheme is signed by its
+// timestamp key instead of through its index.
+func (conf *Configuration) timestampSigned(manager *SchemeManager) (bool, error) {
+	if !manager.HasKeys(SchemeKeyRoleTimestamp) {
+		return false, nil
+	}
+	return fs.PathExists(filepath.Join(conf.Path, manager.ID, "timestamp.sig"))
+}
+
+// verifySchemeTimestamp verifies the signature of the timestamp key over the timestamp
+// of the specified scheme, if the scheme has a timestamp key and a timestamp signature.
+func (conf *Configuration) verifySchemeTimestamp(manager *SchemeManager) error {
+	signed, err := conf.timestampSigned(manager)
+	if err != nil || !signed {
+		return err
+	}
+	dir := filepath.Join(conf.Path, manager.ID)
+	timestamp, err := ioutil.ReadFile(filepath.Join(dir, "timestamp"))
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(filepath.Join(dir, "timestamp.sig"))
+	if err != nil {
+		return err
+	}
+	return verifyTimestampSignature(manager, timestamp, sig)
+}
+
+func verifyTimestampSignature(manager *SchemeManager, timestamp, sig []byte) error {
+	pk, err := ParsePemEcdsaPublicKey([]byte(manager.Key(SchemeKeyRoleTimestamp, 0).PublicKey))
+	if err != nil {
+		return err
+	}
+	if err = VerifySchemeIndexSignature(timestamp, sig, pk); err != nil {
+		return configurationError(ErrInvalidSignature, err, "Scheme timestamp signature failed to verify")
+	}
+	return nil
+}
+
+// keyshareServerPublicKeyBytes returns the PEM-encoded i'th keyshare server public key of the
+// specified scheme, from its description if it declares keyshare keys, or from kss-i.pem if it
+// does not or if the declared key has no PEM contents.
+func (conf *Configuration) keyshareServerPublicKeyBytes(scheme SchemeManagerIdentifier, i int) ([]byte, error) {
+	conf.mutex.RLock()
+	manager := conf.SchemeManagers[scheme]
+	conf.mutex.RUnlock()
+	if manager != nil && manager.HasKeys(SchemeKeyRoleKeyshare) {
+		key := manager.Key(SchemeKeyRoleKeyshare, i)
+		if key == nil {
+			return nil, configurationError(ErrKeyNotFound, nil,
+				fmt.Sprintf("Keyshare server public key %d of scheme %s not found", i, scheme))
+		}
+		if strings.TrimSpace(key.PublicKey) != "" {
+			return []byte(key.PublicKey), nil
+		}
+	}
+
+	bts, err := ioutil.ReadFile(filepath.Join(conf.Path, scheme.Name(), fmt.Sprintf("kss-%d.pem", i)))
+	if os.IsNotExist(err) {
+		return nil, configurationError(ErrKeyNotFound, err,
+			fmt.Sprintf("Keyshare server public key %d of scheme %s not found", i, scheme))
+	}
+	return bts, err
+}
+
+// checkKeyshareServerPublicKeyValidity checks that the i'th keyshare server public key of the
+// specified scheme is currently valid, if the scheme declares a validity period for it.
+func (conf *Configuration) checkKeyshareServerPublicKeyValidity(scheme SchemeManagerIdentifier, i int) error {
+	conf.mutex.RLock()
+	manager := conf.SchemeManagers[scheme]
+	conf.mutex.RUnlock()
+	if manager == nil {
+		return nil
+	}
+	if key := manager.Key(SchemeKeyRoleKeyshare, i); key != nil && !key.ValidAt(Now()) {
+		return configurationError(ErrKeyExpired, nil,
+			fmt.Sprintf("Keyshare server public key %d of scheme %s is not valid at this time", i, scheme))
+	}
+	return nil
+}
+
+// downloadTimestampSignature downloads and verifies the signature of the timestamp key of the
+// specified scheme over the specified (new) timestamp, or returns nil if the scheme does not
+// declare a timestamp key.
+func (conf *Configuration) downloadTimestampSignature(manager *SchemeManager, timestamp []byte) ([]byte, error) {
+	if !manager.HasKeys(SchemeKeyRoleTimestamp) {
+		return nil, nil
+	}
+	var sig []byte
+	err := conf.schemeRequest(manager, func(transport *HTTPTransport) (err error) {
+		sig, err = transport.GetBytes("timestamp.sig")
+		return
+	})
+	if err != nil {
+		return nil, configurationError(ErrMissingSignature, err, "Could not download scheme timestamp signature")
+	}
+	if err = verifyTimestampSignature(manager, timestamp, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
@@ -0,0 +1,135 @@
+package schemelint
+
+import (
+	"fmt"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// Rules contains all rules, in the order in which they are run by default.
+var Rules = []*Rule{
+	{
+		Name:        "scheme",
+		Description: "Scheme description version, environment, directory name and keyshare public key",
+		Check:       checkScheme,
+	},
+	{
+		Name:        "translations",
+		Description: "Presence of all translations in the scheme, issuer, credential type and attribute descriptions",
+		Check:       checkTranslations,
+	},
+	{
+		Name:        "issuers",
+		Description: "Issuer directory names, scheme identifiers, logos and public keys",
+		Check:       checkIssuers,
+	},
+	{
+		Name:        "credentialtypes",
+		Description: "Credential type description versions, directory names, issuer identifiers and logos",
+		Check:       checkCredentialTypes,
+	},
+	{
+		Name:        "attributes",
+		Description: "Presence and display order of the attributes of credential types",
+		Check:       checkAttributes,
+	},
+	{
+		Name:        "keys",
+		Description: "Expiry of public keys, correspondence of private keys to public keys, and amount of supported attributes",
+		Check:       checkKeys,
+	},
+	{
+		Name:        "dependencies",
+		Description: "Existence of credential type dependencies, and absence of dependency cycles",
+		Check:       checkDependencies,
+	},
+}
+
+func checkScheme(scheme *Scheme, report *irma.ValidationReport) error {
+	if err := irma.LintScheme(report, scheme.Description, scheme.Path); err != nil {
+		report.Add(irma.SeverityError, irma.ValidationInvalidContents, scheme.Description.ID, err.Error())
+	}
+	return nil
+}
+
+func checkTranslations(scheme *Scheme, report *irma.ValidationReport) error {
+	irma.LintTranslations(report, fmt.Sprintf("Scheme %s", scheme.Description.ID), scheme.Description.ID, scheme.Description)
+	for _, issuer := range scheme.Issuers {
+		issuerid := issuer.Description.Identifier().String()
+		irma.LintTranslations(report, fmt.Sprintf("Issuer %s", issuerid), issuerid, issuer.Description)
+		for _, cred := range issuer.CredentialTypes {
+			credid := cred.Description.Identifier().String()
+			irma.LintTranslations(report, fmt.Sprintf("Credential type %s", credid), credid, cred.Description)
+			for _, attr := range cred.Description.AttributeTypes {
+				irma.LintTranslations(report, fmt.Sprintf("Attribute %s of credential type %s", attr.ID, credid), credid, attr)
+			}
+		}
+	}
+	return nil
+}
+
+func checkIssuers(scheme *Scheme, report *irma.ValidationReport) error {
+	for _, issuer := range scheme.Issuers {
+		issuerid := issuer.Description.Identifier().String()
+		if issuer.Description.XMLVersion < 4 {
+			report.Add(irma.SeverityError, irma.ValidationInvalidContents, issuerid, "Unsupported issuer description")
+			continue
+		}
+		if err := irma.LintIssuer(report, scheme.Description.ID, issuer.Description, issuer.Path); err != nil {
+			report.Add(irma.SeverityError, irma.ValidationInvalidContents, issuerid, err.Error())
+		}
+	}
+	return nil
+}
+
+func checkCredentialTypes(scheme *Scheme, report *irma.ValidationReport) error {
+	for _, issuer := range scheme.Issuers {
+		if len(issuer.CredentialTypes) == 0 {
+			issuerid := issuer.Description.Identifier().String()
+			report.Add(irma.SeverityWarning, irma.ValidationNoCredentialTypes, issuerid,
+				fmt.Sprintf("Issuer %s has no credential types", issuerid))
+		}
+		for _, cred := range issuer.CredentialTypes {
+			if err := irma.LintCredentialType(report, issuer.Description, cred.Description, cred.Path); err != nil {
+				report.Add(irma.SeverityError, irma.ValidationInvalidContents, cred.Description.Identifier().String(), err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func checkAttributes(scheme *Scheme, report *irma.ValidationReport) error {
+	for _, issuer := range scheme.Issuers {
+		for _, cred := range issuer.CredentialTypes {
+			if err := irma.LintAttributes(report, cred.Description); err != nil {
+				report.Add(irma.SeverityError, irma.ValidationInvalidContents, cred.Description.Identifier().String(), err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func checkKeys(scheme *Scheme, report *irma.ValidationReport) error {
+	for _, issuer := range scheme.Issuers {
+		issuerid := issuer.Description.Identifier()
+		credtypes := make([]*irma.CredentialType, 0, len(issuer.CredentialTypes))
+		for _, cred := range issuer.CredentialTypes {
+			credtypes = append(credtypes, cred.Description)
+		}
+		if err := irma.LintKeys(report, issuerid, issuer.Path, issuer.PublicKeys, credtypes, 0); err != nil {
+			report.Add(irma.SeverityError, irma.ValidationInvalidKeys, issuerid.String(), err.Error())
+		}
+	}
+	return nil
+}
+
+func checkDependencies(scheme *Scheme, report *irma.ValidationReport) error {
+	credtypes := map[irma.CredentialTypeIdentifier]*irma.CredentialType{}
+	for _, issuer := range scheme.Issuers {
+		for _, cred := range issuer.CredentialTypes {
+			credtypes[cred.Description.Identifier()] = cred.Description
+		}
+	}
+	irma.LintDependencies(report, scheme.Others, credtypes)
+	return nil
+}
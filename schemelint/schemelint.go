@@ -0,0 +1,238 @@
+// Package schemelint checks the contents of a scheme folder, using the same consistency checks
+// that the irma package performs when it parses schemes. As it does not require the scheme to be
+// signed, scheme maintainers can use it to check their schemes before signing them.
+package schemelint
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// Scheme contains the (unverified) contents of a scheme folder.
+type Scheme struct {
+	Path        string
+	Description *irma.SchemeManager
+	Issuers     []*Issuer
+
+	// Others optionally contains other schemes, against which references
+	// of this scheme to other schemes are resolved
+	Others *irma.Configuration
+}
+
+// Issuer contains the contents of an issuer folder within a scheme.
+type Issuer struct {
+	Path            string
+	Description     *irma.Issuer
+	CredentialTypes []*CredentialType
+	PublicKeys      map[int]*gabi.PublicKey
+}
+
+// CredentialType contains the contents of a credential type folder within an issuer folder.
+type CredentialType struct {
+	Path        string
+	Description *irma.CredentialType
+}
+
+// Rule is a named check on a scheme. Problems that it finds are added to the report;
+// returned errors indicate that the rule could not be run.
+type Rule struct {
+	Name        string
+	Description string
+	Check       func(scheme *Scheme, report *irma.ValidationReport) error
+}
+
+// Finding is a problem found by a rule.
+type Finding struct {
+	Rule string `json:"rule"`
+	*irma.ValidationEntry
+}
+
+// Linter runs a set of rules on scheme folders.
+type Linter struct {
+	Rules []*Rule
+
+	// Configuration optionally contains other schemes, against which references
+	// of the linted schemes to other schemes are resolved
+	Configuration *irma.Configuration
+}
+
+// New returns a Linter running the rules with the specified names, or all rules if none are specified.
+func New(rules ...string) (*Linter, error) {
+	if len(rules) == 0 {
+		return &Linter{Rules: Rules}, nil
+	}
+	linter := &Linter{}
+	for _, name := range rules {
+		rule := RuleByName(name)
+		if rule == nil {
+			return nil, errors.Errorf("Unknown rule %s", name)
+		}
+		linter.Rules = append(linter.Rules, rule)
+	}
+	return linter, nil
+}
+
+// RuleByName returns the rule with the specified name from Rules, or nil if it does not exist.
+func RuleByName(name string) *Rule {
+	for _, rule := range Rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Lint runs the rules of the linter on the scheme in the specified folder,
+// and returns the problems found.
+func (l *Linter) Lint(dir string) ([]*Finding, error) {
+	scheme, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	scheme.Others = l.Configuration
+
+	var findings []*Finding
+	for _, rule := range l.Rules {
+		report := &irma.ValidationReport{}
+		if err = rule.Check(scheme, report); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to run rule "+rule.Name, 0)
+		}
+		for _, entry := range report.Entries {
+			findings = append(findings, &Finding{Rule: rule.Name, ValidationEntry: entry})
+		}
+	}
+	return findings, nil
+}
+
+// HasErrors returns whether any of the findings has severity irma.SeverityError.
+func HasErrors(findings []*Finding) bool {
+	for _, finding := range findings {
+		if finding.Severity >= irma.SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (finding *Finding) String() string {
+	return fmt.Sprintf("%s [%s]", finding.ValidationEntry.String(), finding.Rule)
+}
+
+// Load reads the descriptions and public keys of the scheme in the specified folder,
+// without verifying the scheme signature or index.
+func Load(dir string) (*Scheme, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	scheme := &Scheme{Path: dir, Description: irma.NewSchemeManager(filepath.Base(dir))}
+	if exists, err := readDescription(filepath.Join(dir, "description.xml"), scheme.Description); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, errors.Errorf("%s contains no scheme description.xml", dir)
+	}
+
+	issuerDirs, err := subfolders(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, issuerDir := range issuerDirs {
+		issuer := &Issuer{Path: issuerDir, Description: &irma.Issuer{}, PublicKeys: map[int]*gabi.PublicKey{}}
+		if exists, err := readDescription(filepath.Join(issuerDir, "description.xml"), issuer.Description); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+		if err = readPublicKeys(issuer); err != nil {
+			return nil, err
+		}
+
+		credDirs, err := subfolders(filepath.Join(issuerDir, "Issues"))
+		if err != nil {
+			return nil, err
+		}
+		for _, credDir := range credDirs {
+			cred := &CredentialType{Path: credDir, Description: &irma.CredentialType{}}
+			if exists, err := readDescription(filepath.Join(credDir, "description.xml"), cred.Description); err != nil {
+				return nil, err
+			} else if !exists {
+				continue
+			}
+			issuer.CredentialTypes = append(issuer.CredentialTypes, cred)
+		}
+		scheme.Issuers = append(scheme.Issuers, issuer)
+	}
+
+	return scheme, nil
+}
+
+// readDescription unmarshals the XML file at the specified path into description,
+// returning false if it does not exist.
+func readDescription(path string, description interface{}) (bool, error) {
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = xml.Unmarshal(bts, description); err != nil {
+		return true, errors.WrapPrefix(err, "Failed to parse "+path, 0)
+	}
+	return true, nil
+}
+
+func readPublicKeys(issuer *Issuer) error {
+	files, err := filepath.Glob(filepath.Join(issuer.Path, "PublicKeys", "*.xml"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filename := filepath.Base(file)
+		counter, err := strconv.Atoi(filename[:len(filename)-4])
+		if err != nil {
+			return errors.Errorf("Public key %s has invalid filename", file)
+		}
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		pk, err := gabi.NewPublicKeyFromBytes(bts)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to parse public key "+file, 0)
+		}
+		if int(pk.Counter) != counter {
+			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuer.Description.Identifier())
+		}
+		pk.Issuer = issuer.Description.Identifier().String()
+		issuer.PublicKeys[counter] = pk
+	}
+	return nil
+}
+
+// subfolders returns the subfolders of the specified folder, if it exists, skipping .git.
+func subfolders(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			dirs = append(dirs, filepath.Join(dir, info.Name()))
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,36 @@
+package schemelint
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	linter, err := New()
+	require.NoError(t, err)
+	findings, err := linter.Lint(filepath.Join("..", "testdata", "irma_configuration", "irma-demo"))
+	require.NoError(t, err)
+	require.False(t, HasErrors(findings))
+
+	// The findings must equal those of the irma package when it parses the scheme
+	conf, err := irma.NewConfigurationReadOnly(filepath.Join("..", "testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NoError(t, conf.CheckKeys())
+	for _, finding := range findings {
+		require.Contains(t, conf.Warnings, finding.Message)
+	}
+
+	_, err = New("nonexisting")
+	require.Error(t, err)
+	linter, err = New("attributes")
+	require.NoError(t, err)
+	findings, err = linter.Lint(filepath.Join("..", "testdata", "irma_configuration", "irma-demo"))
+	require.NoError(t, err)
+	for _, finding := range findings {
+		require.Equal(t, "attributes", finding.Rule)
+	}
+}
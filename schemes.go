@@ -2,7 +2,13 @@ package irma
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
 )
 
 // SchemeManagerPointer points to a remote IRMA scheme, containing information to download the scheme,
@@ -53,7 +59,13 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 }
 
 func (conf *Configuration) downloadPrivateKeys(scheme *SchemeManager) error {
-	transport := NewHTTPTransport(scheme.URL)
+	if err := conf.writable("download private keys of scheme " + scheme.ID); err != nil {
+		return err
+	}
+	if conf.skipDryRun("download private keys", filepath.Join(conf.Path, scheme.ID)) {
+		return nil
+	}
+	transport := conf.NewSchemeTransport(scheme.Identifier(), scheme.URL)
 
 	err := transport.GetFile("sk.pem", filepath.Join(conf.Path, scheme.ID, "sk.pem"))
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
@@ -77,3 +89,295 @@ func (conf *Configuration) downloadPrivateKeys(scheme *SchemeManager) error {
 
 	return nil
 }
+
+// Partial scheme installs
+//
+// Instead of installing an entire scheme, InstallIssuer() and InstallCredentialType() install only
+// the part of a scheme that is required for a single issuer or credential type: the files in the root
+// of the scheme (its description, timestamp and keyshare server public keys), the issuer's description,
+// logo and public keys, and (in case of InstallCredentialType()) the credential type's folder.
+// Such schemes are marked as partial using a file in the scheme folder, and when updated only the
+// files that were already installed are updated.
+
+// partialSchemeMarker is the name of the file in a scheme folder indicating that the scheme
+// is only partially installed.
+const partialSchemeMarker = ".partial"
+
+// InstallIssuer installs the specified issuer, along with its public keys but without any of its
+// credential types, installing (only the root of) its scheme if necessary.
+func (conf *Configuration) InstallIssuer(id IssuerIdentifier) error {
+	return conf.installPartial(id.SchemeManagerIdentifier(), issuerFilesWanted(id, nil))
+}
+
+// InstallCredentialType installs the specified credential type, along with its issuer and the
+// public keys of its issuer, installing (only the root of) its scheme if necessary.
+func (conf *Configuration) InstallCredentialType(id CredentialTypeIdentifier) error {
+	return conf.installPartial(id.IssuerIdentifier().SchemeManagerIdentifier(), issuerFilesWanted(id.IssuerIdentifier(), &id))
+}
+
+// issuerFilesWanted returns a predicate selecting the files of the specified issuer, excluding its
+// credential types except for credtype (if not nil), by their path relative to the scheme folder.
+func issuerFilesWanted(id IssuerIdentifier, credtype *CredentialTypeIdentifier) func(file string) bool {
+	issuerpath := id.Name() + "/"
+	credtypes := issuerpath + "Issues/"
+	return func(file string) bool {
+		if credtype != nil && strings.HasPrefix(file, credtypes+credtype.Name()+"/") {
+			return true
+		}
+		return strings.HasPrefix(file, issuerpath) && !strings.HasPrefix(file, credtypes)
+	}
+}
+
+// IsPartial returns whether or not the specified scheme is only partially installed.
+func (conf *Configuration) IsPartial(id SchemeManagerIdentifier) bool {
+	exists, _ := fs.PathExists(filepath.Join(conf.Path, id.String(), partialSchemeMarker))
+	return exists
+}
+
+// installPartial downloads all files from the index of the specified scheme that are wanted,
+// and which we don't already have, first installing the root of the scheme if we don't have the scheme.
+func (conf *Configuration) installPartial(id SchemeManagerIdentifier, wanted func(file string) bool) error {
+	if err := conf.writable("install into scheme " + id.String()); err != nil {
+		return err
+	}
+	if conf.skipDryRun("install into scheme", filepath.Join(conf.Path, id.String())) {
+		return nil
+	}
+
+	manager, ok := conf.SchemeManagers[id]
+	if !ok {
+		var err error
+		if manager, err = conf.installSchemeRoot(id); err != nil {
+			return err
+		}
+	}
+
+	var files []string
+	for file := range manager.index {
+		if !wanted(file[len(manager.ID)+1:]) {
+			continue
+		}
+		if _, _, err := conf.ReadAuthenticatedFile(manager, file); err == nil {
+			continue // nothing to do, we already have this file
+		}
+		files = append(files, file)
+	}
+
+	progress := conf.startProgress(id, len(files))
+	for _, file := range files {
+		relpath := file[len(manager.ID)+1:] // Scheme manager URL already ends with its name
+		path := filepath.Join(conf.Path, filepath.FromSlash(file))
+		err := conf.schemeRequest(manager, func(transport *HTTPTransport) error {
+			return transport.GetSignedFile(relpath, path, manager.index[file])
+		})
+		if err != nil {
+			return err
+		}
+		progress.completed(path)
+	}
+	if err := conf.storeSchemeVersion(manager, manager.index); err != nil {
+		return err
+	}
+
+	return conf.ParseFolder()
+}
+
+// SchemeDiskUsage returns the total size in bytes of all installed schemes,
+// not counting the scheme caches which are regenerated when parsing.
+func (conf *Configuration) SchemeDiskUsage() (int64, error) {
+	var total int64
+	for id := range conf.SchemeManagers {
+		dir := filepath.Join(conf.Path, id.String())
+		size, err := fs.DirectorySize(dir)
+		if err != nil {
+			return 0, err
+		}
+		if info, err := os.Stat(filepath.Join(dir, schemeCacheFilename)); err == nil {
+			size -= info.Size()
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// PruneSchemes removes the folders of credential types and issuers that are not contained in keep
+// from disk, largest first, until the total size of the installed schemes no longer exceeds budget.
+// Issuers of credential types in keep are kept, as are issuers that still have credential types
+// after pruning. The index and signature of the pruned schemes are kept, and the schemes are marked as
+// partially installed, so that the removed parts can be reinstalled on demand using InstallIssuer()
+// and InstallCredentialType(). Returns the amount of bytes that were removed.
+func (conf *Configuration) PruneSchemes(keep *IrmaIdentifierSet, budget int64) (int64, error) {
+	if err := conf.writable("prune schemes"); err != nil {
+		return 0, err
+	}
+	usage, err := conf.SchemeDiskUsage()
+	if err != nil || usage <= budget {
+		return 0, err
+	}
+
+	keptIssuers := map[IssuerIdentifier]struct{}{}
+	if keep != nil {
+		for id := range keep.Issuers {
+			keptIssuers[id] = struct{}{}
+		}
+		for id := range keep.CredentialTypes {
+			keptIssuers[id.IssuerIdentifier()] = struct{}{}
+		}
+	}
+
+	type candidate struct {
+		scheme SchemeManagerIdentifier
+		path   string
+		size   int64
+	}
+	var credtypes []candidate
+	for id := range conf.CredentialTypes {
+		if keep != nil {
+			if _, ok := keep.CredentialTypes[id]; ok {
+				continue
+			}
+		}
+		path := filepath.Join(conf.Path, id.IssuerIdentifier().SchemeManagerIdentifier().String(), id.IssuerIdentifier().Name(), "Issues", id.Name())
+		size, err := fs.DirectorySize(path)
+		if err != nil {
+			return 0, err
+		}
+		credtypes = append(credtypes, candidate{id.IssuerIdentifier().SchemeManagerIdentifier(), path, size})
+	}
+	sort.Slice(credtypes, func(i, j int) bool { return credtypes[i].size > credtypes[j].size })
+
+	var freed int64
+	pruned := map[SchemeManagerIdentifier]struct{}{}
+	remove := func(c candidate) error {
+		if err := conf.removeAll(c.path); err != nil {
+			return err
+		}
+		pruned[c.scheme] = struct{}{}
+		freed += c.size
+		return nil
+	}
+
+	for _, c := range credtypes {
+		if usage-freed <= budget {
+			break
+		}
+		if err = remove(c); err != nil {
+			return freed, err
+		}
+	}
+
+	// Issuers can only be removed if none of their credential types are left
+	var issuers []candidate
+	for id := range conf.Issuers {
+		if _, ok := keptIssuers[id]; ok {
+			continue
+		}
+		path := filepath.Join(conf.Path, id.SchemeManagerIdentifier().String(), id.Name())
+		if !fs.Empty(filepath.Join(path, "Issues")) {
+			continue
+		}
+		size, err := fs.DirectorySize(path)
+		if err != nil {
+			return freed, err
+		}
+		issuers = append(issuers, candidate{id.SchemeManagerIdentifier(), path, size})
+	}
+	sort.Slice(issuers, func(i, j int) bool { return issuers[i].size > issuers[j].size })
+	for _, c := range issuers {
+		if usage-freed <= budget {
+			break
+		}
+		if err = remove(c); err != nil {
+			return freed, err
+		}
+	}
+
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	for id := range pruned {
+		if err = conf.saveFile(filepath.Join(conf.Path, id.String(), partialSchemeMarker), nil); err != nil {
+			return freed, err
+		}
+	}
+	Logger.Infof("Pruned %d bytes from schemes", freed)
+	return freed, conf.ParseFolder()
+}
+
+// installSchemeRoot downloads the files in the root of a scheme that we do not have yet
+// (i.e., none of its issuers or credential types), and marks the scheme as partially installed.
+// Since we need the URL and public key of the scheme, only the default schemes can be installed this way.
+func (conf *Configuration) installSchemeRoot(id SchemeManagerIdentifier) (*SchemeManager, error) {
+	var pointer *SchemeManagerPointer
+	for i := range DefaultSchemeManagers {
+		if filepath.Base(DefaultSchemeManagers[i].Url) == id.String() {
+			pointer = &DefaultSchemeManagers[i]
+		}
+	}
+	if pointer == nil {
+		return nil, errors.Errorf("Cannot partially install unknown scheme %s", id)
+	}
+
+	manager, err := DownloadSchemeManager(pointer.Url)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(conf.Path, manager.ID)
+	if err = fs.EnsureDirectoryExists(path); err != nil {
+		return nil, err
+	}
+	if err = conf.saveFile(filepath.Join(path, "pk.pem"), pointer.Publickey); err != nil {
+		return nil, err
+	}
+	if err = conf.saveFile(filepath.Join(path, partialSchemeMarker), nil); err != nil {
+		return nil, err
+	}
+	if err = conf.DownloadSchemeManagerSignature(manager); err != nil {
+		_ = conf.removeAll(path)
+		return nil, err
+	}
+	if manager.index, err = conf.parseIndex(manager.ID, manager); err != nil {
+		_ = conf.removeAll(path)
+		return nil, err
+	}
+
+	var files []string
+	for file := range manager.index {
+		if !strings.Contains(file[len(manager.ID)+1:], "/") { // in the root of the scheme
+			files = append(files, file)
+		}
+	}
+	progress := conf.startProgress(id, len(files))
+	for _, file := range files {
+		relpath := file[len(manager.ID)+1:]
+		dest := filepath.Join(conf.Path, filepath.FromSlash(file))
+		err = conf.schemeRequest(manager, func(transport *HTTPTransport) error {
+			return transport.GetSignedFile(relpath, dest, manager.index[file])
+		})
+		if err != nil {
+			_ = conf.removeAll(path)
+			return nil, err
+		}
+		progress.completed(dest)
+	}
+
+	conf.SchemeManagers[id] = manager
+	return manager, nil
+}
+
+// partialSchemeHas returns whether the specified file from the index of a partially installed
+// scheme belongs to an issuer or credential type that is installed, i.e., if it should be updated.
+func (conf *Configuration) partialSchemeHas(file string) bool {
+	parts := strings.Split(file, "/")
+	var description string
+	switch {
+	case len(parts) <= 2: // in the root of the scheme
+		return true
+	case len(parts) >= 5 && parts[2] == "Issues": // in a credential type folder
+		description = filepath.Join(parts[0], parts[1], "Issues", parts[3], "description.xml")
+	default: // in an issuer folder
+		description = filepath.Join(parts[0], parts[1], "description.xml")
+	}
+	exists, _ := fs.PathExists(filepath.Join(conf.Path, description))
+	return exists
+}
@@ -0,0 +1,292 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// Besides in the scheme directories themselves, the files of the schemes are kept in a content
+// addressable store in the .store directory of the irma_configuration folder: each file is stored
+// once under its SHA256 hash (in objects/), regardless of how many scheme versions contain it.
+// Per scheme, the store keeps a manifest for each version of the scheme that was installed,
+// consisting of the index of that version (which maps the files of the scheme to their hashes),
+// its signature, and the public key of the scheme. As files are only added to the store after
+// their hash has been verified against a signed index, a file read from the store is authentic
+// if its name is the hash that the index expects. Rolling back to an older version of a scheme
+// amounts to checking out the files listed by its manifest from the store.
+//
+// Layout of the store:
+//   .store/objects/<first 2 hex chars of hash>/<hex hash>
+//   .store/manifests/<scheme>/<timestamp>/{index,index.sig,pk.pem}
+
+const schemeStoreDir = ".store"
+
+func (conf *Configuration) objectPath(hash ConfigurationFileHash) string {
+	h := hash.String()
+	return filepath.Join(conf.Path, schemeStoreDir, "objects", h[:2], h)
+}
+
+func (conf *Configuration) manifestPath(id SchemeManagerIdentifier, version Timestamp) string {
+	return filepath.Join(conf.Path, schemeStoreDir, "manifests", id.String(), version.String())
+}
+
+// storeSchemeVersion adds the files of the specified scheme index that are present in the scheme
+// directory and not yet in the store to the store, and records the index as a new manifest of the
+// scheme. Files whose hash does not match the index are not stored.
+func (conf *Configuration) storeSchemeVersion(manager *SchemeManager, index SchemeManagerIndex) error {
+	dir := filepath.Join(conf.Path, manager.ID)
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "timestamp"))
+	if err != nil {
+		return err
+	}
+	version, err := parseTimestamp(bts)
+	if err != nil {
+		return err
+	}
+
+	for file, hash := range index {
+		exists, err := fs.PathExists(conf.objectPath(hash))
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(conf.Path, filepath.FromSlash(file)))
+		if os.IsNotExist(err) {
+			continue // not installed in this partially installed scheme
+		}
+		if err != nil {
+			return err
+		}
+		if computed := sha256.Sum256(bts); !hash.Equal(computed[:]) {
+			continue
+		}
+		if err = conf.saveFile(conf.objectPath(hash), bts); err != nil {
+			return err
+		}
+	}
+
+	manifest := conf.manifestPath(manager.Identifier(), *version)
+	for _, name := range []string{"index", "index.sig", "pk.pem"} {
+		if bts, err = ioutil.ReadFile(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		if err = conf.saveFile(filepath.Join(manifest, name), bts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readObject returns the file with the specified hash from the store, if present.
+func (conf *Configuration) readObject(hash ConfigurationFileHash) ([]byte, bool, error) {
+	bts, err := ioutil.ReadFile(conf.objectPath(hash))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return bts, true, nil
+}
+
+// checkoutObject writes the file with the specified hash from the store to the specified path,
+// returning false if the store does not contain the file.
+func (conf *Configuration) checkoutObject(hash ConfigurationFileHash, path string) (bool, error) {
+	bts, found, err := conf.readObject(hash)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, conf.saveFile(path, bts)
+}
+
+// SchemeVersions returns the timestamps of the versions of the specified scheme to which it
+// can be rolled back using RollbackScheme(), sorted from old to new.
+func (conf *Configuration) SchemeVersions(id SchemeManagerIdentifier) ([]Timestamp, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(conf.Path, schemeStoreDir, "manifests", id.String()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []Timestamp
+	for _, dir := range dirs {
+		if _, err = strconv.Atoi(dir.Name()); err != nil {
+			continue
+		}
+		version, err := parseTimestamp([]byte(dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Before(versions[j])
+	})
+	return versions, nil
+}
+
+// RollbackScheme restores the specified version of the specified scheme from the store, and
+// parses the configuration again. The index of the version must be validly signed by the current
+// public key of the scheme. Note that the scheme is updated to its newest version again by
+// the next scheme update.
+func (conf *Configuration) RollbackScheme(id SchemeManagerIdentifier, version Timestamp) error {
+	if err := conf.writable("roll back scheme " + id.String()); err != nil {
+		return err
+	}
+	manager, ok := conf.SchemeManagers[id]
+	if !ok {
+		return configurationError(ErrSchemeNotInstalled, nil, fmt.Sprintf("Cannot roll back unknown scheme %s", id))
+	}
+	dir := filepath.Join(conf.Path, manager.ID)
+	if conf.skipDryRun("roll back scheme to "+version.String(), dir) {
+		return nil
+	}
+
+	// Read the manifest of the version and check that it is authentic
+	manifest := conf.manifestPath(id, version)
+	if err := fs.AssertPathExists(manifest+"/index", manifest+"/index.sig"); err != nil {
+		return errors.Errorf("Version %s of scheme %s is not in the scheme store", version.String(), id)
+	}
+	indexbts, err := ioutil.ReadFile(filepath.Join(manifest, "index"))
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(filepath.Join(manifest, "index.sig"))
+	if err != nil {
+		return err
+	}
+	pkbts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem"))
+	if err != nil {
+		return err
+	}
+	pk, err := ParsePemEcdsaPublicKey(pkbts)
+	if err != nil {
+		return err
+	}
+	if err = VerifySchemeIndexSignature(indexbts, sig, pk); err != nil {
+		return err
+	}
+	index := SchemeManagerIndex(make(map[string]ConfigurationFileHash))
+	if err = index.FromString(string(indexbts)); err != nil {
+		return err
+	}
+
+	// Check that we have all files that we need before modifying the scheme directory. Files
+	// that are not present in the store nor in the scheme directory belong to parts of a
+	// partially installed scheme that are not installed.
+	var files []string
+	for file, hash := range index {
+		exists, err := fs.PathExists(conf.objectPath(hash))
+		if err != nil {
+			return err
+		}
+		if exists {
+			files = append(files, file)
+			continue
+		}
+		installed, err := fs.PathExists(filepath.Join(conf.Path, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		if installed {
+			return errors.Errorf("Cannot roll back scheme %s: %s is not in the scheme store", id, file)
+		}
+	}
+
+	for _, file := range files {
+		if _, err = conf.checkoutObject(index[file], filepath.Join(conf.Path, filepath.FromSlash(file))); err != nil {
+			return err
+		}
+	}
+	for file := range manager.index {
+		if _, ok := index[file]; ok {
+			continue
+		}
+		if err = conf.removeAll(filepath.Join(conf.Path, filepath.FromSlash(file))); err != nil {
+			return err
+		}
+	}
+	if err = conf.saveFile(filepath.Join(dir, "index"), indexbts); err != nil {
+		return err
+	}
+	if err = conf.saveFile(filepath.Join(dir, "index.sig"), sig); err != nil {
+		return err
+	}
+
+	return conf.ParseFolder()
+}
+
+// PruneSchemeVersions removes all but the specified amount of newest versions of each scheme from
+// the store, always keeping the currently installed versions, along with the files in the store
+// that are no longer contained in any of the remaining versions.
+func (conf *Configuration) PruneSchemeVersions(keep int) error {
+	if err := conf.writable("prune scheme versions"); err != nil {
+		return err
+	}
+	manifests := filepath.Join(conf.Path, schemeStoreDir, "manifests")
+	if conf.skipDryRun("prune scheme versions", manifests) {
+		return nil
+	}
+
+	referenced := map[string]struct{}{}
+	err := iterateSubfolders(manifests, func(dir string) error {
+		id := NewSchemeManagerIdentifier(filepath.Base(dir))
+		versions, err := conf.SchemeVersions(id)
+		if err != nil {
+			return err
+		}
+		for i, version := range versions {
+			path := conf.manifestPath(id, version)
+			manager, installed := conf.SchemeManagers[id]
+			current := installed && !manager.Timestamp.Before(version) && !manager.Timestamp.After(version)
+			if !current && i < len(versions)-keep {
+				if err = conf.removeAll(path); err != nil {
+					return err
+				}
+				continue
+			}
+			bts, err := ioutil.ReadFile(filepath.Join(path, "index"))
+			if err != nil {
+				return err
+			}
+			index := SchemeManagerIndex(make(map[string]ConfigurationFileHash))
+			if err = index.FromString(string(bts)); err != nil {
+				return err
+			}
+			for _, hash := range index {
+				referenced[hash.String()] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return iterateSubfolders(filepath.Join(conf.Path, schemeStoreDir, "objects"), func(dir string) error {
+		objects, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if _, ok := referenced[object.Name()]; ok {
+				continue
+			}
+			if err = conf.removeAll(filepath.Join(dir, object.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,48 @@
+package irma
+
+import "sync"
+
+// Different schemes may require different network settings, e.g. a proxy, or a TLS configuration
+// trusting an internal CA of the organization operating the scheme. TransportSettings registered
+// for a scheme using SetSchemeTransport() apply to all traffic for that scheme: downloads of the
+// scheme (from its URL or its mirrors) and of its private keys, and the traffic of irmaclient with
+// the keyshare server of the scheme.
+
+// schemeTransports keeps track of the TransportSettings registered per scheme.
+type schemeTransports struct {
+	mutex    sync.RWMutex
+	settings map[SchemeManagerIdentifier]*TransportSettings
+}
+
+func newSchemeTransports() *schemeTransports {
+	return &schemeTransports{settings: map[SchemeManagerIdentifier]*TransportSettings{}}
+}
+
+func (st *schemeTransports) get(id SchemeManagerIdentifier) *TransportSettings {
+	if st == nil {
+		return nil
+	}
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.settings[id]
+}
+
+// SetSchemeTransport registers network settings to use for all traffic for the specified scheme,
+// replacing earlier registered settings. Passing nil restores the default settings.
+func (conf *Configuration) SetSchemeTransport(id SchemeManagerIdentifier, settings *TransportSettings) {
+	conf.transports.mutex.Lock()
+	defer conf.transports.mutex.Unlock()
+	if settings == nil {
+		delete(conf.transports.settings, id)
+	} else {
+		conf.transports.settings[id] = settings
+	}
+}
+
+// NewSchemeTransport returns a new HTTPTransport to the specified URL, using the network settings
+// registered for the specified scheme, if any.
+func (conf *Configuration) NewSchemeTransport(id SchemeManagerIdentifier, url string) *HTTPTransport {
+	transport := NewHTTPTransport(url)
+	transport.Configure(conf.transports.get(id))
+	return transport
+}
@@ -0,0 +1,86 @@
+package irma
+
+import (
+	"encoding/xml"
+	"sync"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// Secrets such as issuer private keys and keyshare PIN salts would otherwise remain in memory,
+// garbage collected or not, until the memory happens to be reused. Long-lived processes such as
+// the IRMA server therefore overwrite them once they are no longer needed: the serialized forms
+// of secrets are kept in SecureBytes, and the private keys handed out by a Configuration are
+// tracked so that they can be wiped by Configuration.Close().
+//
+// Note that this is best-effort: the Go runtime may have copied the memory elsewhere (e.g. when
+// growing slices or stacks), and the big integers of private keys may have left copies behind
+// during computations with them.
+
+// SecureBytes contains secret bytes that should be wiped using Wipe() when no longer needed.
+type SecureBytes []byte
+
+// Wipe overwrites the bytes with zeroes.
+func (b SecureBytes) Wipe() {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// parsePrivateKey parses the XML of a private key. Unlike gabi.NewPrivateKeyFromXML(), it does not
+// first copy the XML to a string, which could not be wiped. The buffers that the XML decoder uses
+// internally are not wiped either, so this too is best-effort.
+func parsePrivateKey(bts SecureBytes) (*gabi.PrivateKey, error) {
+	sk := &gabi.PrivateKey{}
+	if err := xml.Unmarshal(bts, sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// WipePrivateKey overwrites the secret numbers of the private key with zero. The private key is
+// unusable afterwards.
+func WipePrivateKey(sk *gabi.PrivateKey) {
+	if sk == nil {
+		return
+	}
+	for _, i := range []*big.Int{sk.P, sk.Q, sk.PPrime, sk.QPrime} {
+		if i != nil {
+			i.SetInt64(0)
+		}
+	}
+}
+
+// privateKeyTracker keeps track of the private keys handed out by a Configuration and its
+// snapshots, so that they can be wiped when the Configuration is closed.
+type privateKeyTracker struct {
+	mutex sync.Mutex
+	keys  map[*gabi.PrivateKey]struct{}
+}
+
+func newPrivateKeyTracker() *privateKeyTracker {
+	return &privateKeyTracker{keys: map[*gabi.PrivateKey]struct{}{}}
+}
+
+func (t *privateKeyTracker) track(sk *gabi.PrivateKey) {
+	if t == nil || sk == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.keys[sk] = struct{}{}
+}
+
+// wipe wipes and forgets all tracked private keys.
+func (t *privateKeyTracker) wipe() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for sk := range t.keys {
+		WipePrivateKey(sk)
+	}
+	t.keys = map[*gabi.PrivateKey]struct{}{}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,6 +25,42 @@ import (
 
 var Logger *logrus.Logger = logrus.StandardLogger()
 
+// IssuanceCondition inspects the attributes disclosed in an issuance session, i.e. those asked for
+// in the Disclose part of the IssuanceRequest, before the credentials are issued. It receives copies
+// of the credentials to be issued, whose attribute values it may modify (e.g. to copy a verified
+// email address into the new credential); other changes to the credentials are ignored. Returning
+// an error vetoes the issuance, failing the session. The decision is recorded in the audit log.
+//
+// Modified credentials can only be issued to IRMA apps supporting protocol version 2.5 or higher.
+type IssuanceCondition func(disclosed []*irma.DisclosedAttribute, credentials []*irma.CredentialRequest) error
+
+// AttributeValueProvider retrieves the attribute values of credentials to be issued from an
+// external source, such as a database, LDAP directory or API, so that requestors need not include
+// them in their issuance requests. It is used for the credentials whose Provider field contains the
+// name under which it is registered in Configuration.AttributeValueProviders, when their session is
+// started. Attribute values included in the request take precedence over the returned ones.
+type AttributeValueProvider interface {
+	AttributeValues(request *AttributeValueRequest) (map[string]string, error)
+}
+
+// AttributeValueProviderFunc is an AttributeValueProvider consisting of a function.
+type AttributeValueProviderFunc func(request *AttributeValueRequest) (map[string]string, error)
+
+func (f AttributeValueProviderFunc) AttributeValues(request *AttributeValueRequest) (map[string]string, error) {
+	return f(request)
+}
+
+// AttributeValueRequest specifies the credential whose attribute values an AttributeValueProvider
+// should retrieve.
+type AttributeValueRequest struct {
+	CredentialType irma.CredentialTypeIdentifier
+	// The ProviderKey of the credential request, e.g. identifying the user in the external source
+	Key string
+	// If the session is the next session of a chained session (see irma.RequestorBaseRequest),
+	// the attributes disclosed in the previous session
+	Disclosed []*irma.DisclosedAttribute
+}
+
 // Configuration contains configuration for the irmaserver library and irmad.
 type Configuration struct {
 	// irma_configuration. If not given, this will be popupated using SchemesPath.
@@ -37,10 +75,24 @@ type Configuration struct {
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Environments ("demo", "production") of the schemes that may be used in sessions. If not given,
+	// this defaults to "production" in production mode, and to all environments otherwise.
+	SchemesEnvironments []string `json:"schemes_environments" mapstructure:"schemes_environments"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// Issuer private keys
 	IssuerPrivateKeys map[irma.IssuerIdentifier]*gabi.PrivateKey `json:"-"`
+	// If specified, used to decrypt the private keys in IssuerPrivateKeysPath, e.g. using a PKCS#11 token or a KMS
+	IssuerPrivateKeyDecrypter irma.PrivateKeyDecrypter `json:"-"`
+	// Passphrase with which the encrypted private keys in IssuerPrivateKeysPath and in the schemes
+	// are decrypted (see irma.EncryptPrivateKey())
+	IssuerPrivateKeysPassphrase string `json:"privkeys_passphrase" mapstructure:"privkeys_passphrase"`
+	// Ring providing issuer private keys, in addition to IssuerPrivateKeys and the private keys in
+	// the schemes. The private keys in IssuerPrivateKeysPath are added to it.
+	IssuerPrivateKeyRing irma.PrivateKeyRing `json:"-"`
+	// Path to a file to which each use of an issuer private key or keyshare server public key
+	// is appended (see irma.AuditLog)
+	AuditLogPath string `json:"audit_log" mapstructure:"audit_log"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
@@ -53,6 +105,55 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool
+	// Default number of seconds that sessions wait for the IRMA app to connect before they time out
+	// (default 300), unless their requests specify otherwise (see irma.RequestorBaseRequest)
+	ClientTimeout int `json:"client_timeout" mapstructure:"client_timeout"`
+	// Default number of seconds after which sessions that have not finished time out, regardless
+	// of their activity (0 = only when inactive for 5 minutes)
+	SessionLifetime int `json:"session_lifetime" mapstructure:"session_lifetime"`
+	// Default number of seconds that the results of finished sessions are kept (default 300)
+	ResultRetention int `json:"result_retention" mapstructure:"result_retention"`
+	// Origins (e.g. https://example.com) of the web pages that may access the endpoints for the
+	// IRMA app and the session status from browsers (default: any origin)
+	CorsOrigins []string `json:"cors_origins" mapstructure:"cors_origins"`
+	// Enable sandbox mode, in which sessions can be completed by a simulated IRMA app holding
+	// SandboxCredentials, for integration testing of requestor websites. Not allowed in production mode.
+	Sandbox bool `json:"sandbox" mapstructure:"sandbox"`
+	// Credentials held by the simulated IRMA app in sandbox mode. The private keys of their issuers
+	// must be available.
+	SandboxCredentials []*irma.CredentialRequest `json:"sandbox_credentials" mapstructure:"-"`
+
+	// Base64-encoded key with which the session results POSTed to the callbackUrl of session
+	// requests are signed using HMAC-SHA256, if ResultJwtSigner is not set
+	CallbackHmacKey string `json:"callback_hmac_key" mapstructure:"callback_hmac_key"`
+	// If set, session results are POSTed to the callbackUrl of session requests as the JWT returned
+	// by this function instead (the requestor server sets this if it has a JWT private key)
+	ResultJwtSigner func(result *SessionResult) (string, error) `json:"-"`
+	// If set, called in issuance sessions after the attributes disclosed in the session have been
+	// verified and before the credentials are issued (see IssuanceCondition)
+	IssuanceCondition IssuanceCondition `json:"-"`
+	// Providers of attribute values of credentials to be issued, by name (see AttributeValueProvider)
+	AttributeValueProviders map[string]AttributeValueProvider `json:"-"`
+	// If set, starts the next sessions of chained sessions (see irma.RequestorBaseRequest.NextSessionUrl)
+	// instead of the server itself, given the requestor token of the previous session, e.g. to check
+	// that the requestor of the previous session may start the next one. It returns the session
+	// pointer and requestor token of the next session.
+	NextSessionStarter func(token string, request irma.RequestorRequest) (*irma.Qr, string, error) `json:"-"`
+	// If set, session requests are only started if they carry a signature over their session request
+	// (see irma.RequestorBaseRequest.RequestSignature) that verifies against this public key
+	// (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey), e.g. of a party approving the session
+	// requests that intermediaries start at this server
+	RequestApprovalKey interface{} `json:"-"`
+
+	// Where sessions are stored: "memory" (default), "redis" or "postgres". Sessions stored in Redis
+	// or Postgres survive restarts, and multiple servers sharing the store can each handle any session.
+	StoreType string `json:"store_type" mapstructure:"store_type"`
+	// Address (host:port), password and database number of the Redis server, if StoreType is "redis"
+	RedisAddr     string `json:"redis_addr" mapstructure:"redis_addr"`
+	RedisPassword string `json:"redis_pw" mapstructure:"redis_pw"`
+	RedisDB       int    `json:"redis_db" mapstructure:"redis_db"`
+	// Connection string of the Postgres database, if StoreType is "postgres"
+	PostgresURL string `json:"postgres_url" mapstructure:"postgres_url"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -82,8 +183,52 @@ type SessionResult struct {
 	Disclosed   []*irma.DisclosedAttribute `json:"disclosed,omitempty"`
 	Signature   *irma.SignedMessage        `json:"signature,omitempty"`
 	Err         *irma.RemoteError          `json:"error,omitempty"`
+	// ErrorID identifies the error in the server logs, if the session failed due to an unexpected error
+	ErrorID string `json:"errorId,omitempty"`
+	// Requestor token of the session that was started after this one (see
+	// irma.RequestorBaseRequest.NextSessionUrl), if any
+	NextSession string `json:"nextSession,omitempty"`
+}
+
+// SessionInfo describes an unfinished session, as listed by the admin API of the server.
+type SessionInfo struct {
+	Token      string         `json:"token"`
+	Type       irma.Action    `json:"type"`
+	Status     Status         `json:"status"`
+	Started    irma.Timestamp `json:"started"`
+	LastActive irma.Timestamp `json:"lastActive"`
+	// Time at which the session times out if it does not finish before
+	Expiry    irma.Timestamp `json:"expiry"`
+	Requestor string         `json:"requestor,omitempty"`
+}
+
+// IssuanceProblem is a reason why a credential of an issuance request cannot be issued, as found
+// by validating the issuance request without starting a session.
+type IssuanceProblem struct {
+	// Index of the credential within the issuance request
+	Credential     int                           `json:"credential"`
+	CredentialType irma.CredentialTypeIdentifier `json:"credentialType"`
+	Attribute      string                        `json:"attribute,omitempty"` // If the problem concerns a single attribute
+	Type           IssuanceProblemType           `json:"type"`
+	Message        string                        `json:"message"`
 }
 
+// IssuanceProblemType is the type of an IssuanceProblem.
+type IssuanceProblemType string
+
+const (
+	IssuanceProblemSchemeNotAllowed      IssuanceProblemType = "SCHEME_NOT_ALLOWED"      // Scheme unknown or its environment not allowed
+	IssuanceProblemValueProvider         IssuanceProblemType = "VALUE_PROVIDER"          // Attribute value provider unknown or failed
+	IssuanceProblemUnknownCredentialType IssuanceProblemType = "UNKNOWN_CREDENTIAL_TYPE" // Credential type does not exist
+	IssuanceProblemMissingAttribute      IssuanceProblemType = "MISSING_ATTRIBUTE"       // Required attribute absent
+	IssuanceProblemUnknownAttribute      IssuanceProblemType = "UNKNOWN_ATTRIBUTE"       // Attribute not in credential type
+	IssuanceProblemInvalidAttribute      IssuanceProblemType = "INVALID_ATTRIBUTE"       // Attribute value does not satisfy its format
+	IssuanceProblemExpired               IssuanceProblemType = "EXPIRED"                 // Requested validity lies in the past
+	IssuanceProblemPublicKey             IssuanceProblemType = "MISSING_PUBLIC_KEY"      // Issuer has no nonexpired public key
+	IssuanceProblemPrivateKey            IssuanceProblemType = "MISSING_PRIVATE_KEY"     // Private key of nonexpired public key absent
+	IssuanceProblemKeySize               IssuanceProblemType = "KEY_TOO_SMALL"           // Key does not support the amount of attributes
+)
+
 // Status is the status of an IRMA session.
 type Status string
 
@@ -95,21 +240,60 @@ const (
 	StatusTimeout     Status = "TIMEOUT"     // Session timed out
 )
 
-func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier) (sk *gabi.PrivateKey, err error) {
-	sk = conf.IssuerPrivateKeys[id]
-	if sk == nil {
-		if sk, err = conf.IrmaConfiguration.PrivateKey(id); err != nil {
-			return nil, err
-		}
+// PrivateKey returns the specified private key of the issuer, from IssuerPrivateKeys,
+// IssuerPrivateKeyRing or else from the IRMA configuration, or nil if we do not have it.
+func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier, counter int) (*gabi.PrivateKey, error) {
+	if sk := conf.IssuerPrivateKeys[id]; sk != nil && int(sk.Counter) == counter {
+		return sk, nil
+	}
+	return conf.privateKeyRing().PrivateKey(id, counter)
+}
+
+// PrivateKeyLatest returns the private key of the issuer with the highest counter that we have,
+// or nil if we have none.
+func (conf *Configuration) PrivateKeyLatest(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	sk, err := conf.privateKeyRing().PrivateKeyLatest(id)
+	if err != nil {
+		return nil, err
+	}
+	if configured := conf.IssuerPrivateKeys[id]; configured != nil && (sk == nil || configured.Counter >= sk.Counter) {
+		return configured, nil
 	}
 	return sk, nil
 }
 
+func (conf *Configuration) privateKeyRing() irma.PrivateKeyRing {
+	if conf.IssuerPrivateKeyRing == nil {
+		return conf.IrmaConfiguration
+	}
+	return irma.PrivateKeyRingMerged{conf.IssuerPrivateKeyRing, conf.IrmaConfiguration}
+}
+
+// CorsOriginAllowed returns whether web pages from the specified origin may access the endpoints
+// for the IRMA app and the session status (see CorsOrigins).
+func (conf *Configuration) CorsOriginAllowed(origin string) bool {
+	return OriginAllowed(conf.CorsOrigins, origin)
+}
+
+// OriginAllowed returns whether the origin is present in the list of origins, which allows any
+// origin if it is empty or contains "*".
+func OriginAllowed(origins []string, origin string) bool {
+	if len(origins) == 0 {
+		return true
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
 func (conf *Configuration) HavePrivateKeys() (bool, error) {
 	var err error
 	var sk *gabi.PrivateKey
 	for id := range conf.IrmaConfiguration.Issuers {
-		sk, err = conf.PrivateKey(id)
+		sk, err = conf.PrivateKeyLatest(id)
 		if err != nil {
 			return false, err
 		}
@@ -143,7 +327,43 @@ func RemoteError(err Error, message string) *irma.RemoteError {
 		ErrorName:   string(err.Type),
 		Message:     message,
 		Stacktrace:  stack,
+		Code:        err.Code,
+	}
+}
+
+// PanicError logs a value recovered from a panic along with a stack trace and a newly generated
+// error ID, and returns an error containing the ID that can be returned to the caller, so that
+// the log entry can be found when the caller reports the error.
+func PanicError(e interface{}) *irma.RemoteError {
+	id := newErrorID()
+	Logger.WithField("errorId", id).Errorf("Recovered from panic: %v\n%s", e, string(debug.Stack()))
+	rerr := RemoteError(ErrorUnknown, "internal server error with ID "+id)
+	rerr.ErrorID = id
+	return rerr
+}
+
+// RecoverMiddleware returns a http.Handler that recovers from panics in the specified handler,
+// returning the error from PanicError to the caller.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if e := recover(); e != nil {
+				if e == http.ErrAbortHandler {
+					panic(e)
+				}
+				WriteResponse(w, nil, PanicError(e))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newErrorID() string {
+	bts := make([]byte, 8)
+	if _, err := rand.Read(bts); err != nil {
+		return "unknown"
 	}
+	return hex.EncodeToString(bts)
 }
 
 // JsonResponse JSON-marshals the specified object or error
@@ -1,36 +1,56 @@
 package server
 
+import "github.com/privacybydesign/irmago"
+
 // Error represents an error that occured during an IRMA sessions.
 type Error struct {
-	Type        ErrorType `json:"error"`
-	Status      int       `json:"status"`
-	Description string    `json:"description"`
+	Type        ErrorType      `json:"error"`
+	Status      int            `json:"status"`
+	Description string         `json:"description"`
+	Code        irma.ErrorCode `json:"code"`
 }
 
 type ErrorType string
 
 var (
-	ErrorInvalidTimestamp          Error = Error{Type: "INVALID_TIMESTAMP", Status: 400, Description: "Timestamp was not an epoch boundary"}
-	ErrorIssuingDisabled           Error = Error{Type: "ISSUING_DISABLED", Status: 403, Description: "This server does not support issuing"}
-	ErrorMalformedVerifierRequest  Error = Error{Type: "MALFORMED_VERIFIER_REQUEST", Status: 400, Description: "Malformed verification request"}
-	ErrorMalformedSignatureRequest Error = Error{Type: "MALFORMED_SIGNATURE_REQUEST", Status: 400, Description: "Malformed signature request"}
-	ErrorMalformedIssuerRequest    Error = Error{Type: "MALFORMED_ISSUER_REQUEST", Status: 400, Description: "Malformed issuer request"}
-	ErrorUnauthorized              Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to issue or verify this attribute"}
-	ErrorAttributesWrong           Error = Error{Type: "ATTRIBUTES_WRONG", Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"}
-	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"}
+	ErrorInvalidTimestamp          Error = registerError(Error{Code: 2001, Type: "INVALID_TIMESTAMP", Status: 400, Description: "Timestamp was not an epoch boundary"})
+	ErrorIssuingDisabled           Error = registerError(Error{Code: 2002, Type: "ISSUING_DISABLED", Status: 403, Description: "This server does not support issuing"})
+	ErrorMalformedVerifierRequest  Error = registerError(Error{Code: 2003, Type: "MALFORMED_VERIFIER_REQUEST", Status: 400, Description: "Malformed verification request"})
+	ErrorMalformedSignatureRequest Error = registerError(Error{Code: 2004, Type: "MALFORMED_SIGNATURE_REQUEST", Status: 400, Description: "Malformed signature request"})
+	ErrorMalformedIssuerRequest    Error = registerError(Error{Code: 2005, Type: "MALFORMED_ISSUER_REQUEST", Status: 400, Description: "Malformed issuer request"})
+	ErrorUnauthorized              Error = registerError(Error{Code: 2006, Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to issue or verify this attribute"})
+	ErrorAttributesWrong           Error = registerError(Error{Code: 2007, Type: "ATTRIBUTES_WRONG", Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"})
+	ErrorCannotIssue               Error = registerError(Error{Code: 2008, Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"})
 
-	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"}
-	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
-	ErrorAttributesMissing    Error = Error{Type: "ATTRIBUTES_MISSING", Status: 400, Description: "Not all requested-for attributes were present"}
-	ErrorAttributesExpired    Error = Error{Type: "ATTRIBUTES_EXPIRED", Status: 400, Description: "Disclosed attributes were expired"}
-	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
-	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
-	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
-	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"}
-	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
-	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
+	ErrorIssuanceFailed       Error = registerError(Error{Code: 2009, Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"})
+	ErrorInvalidProofs        Error = registerError(Error{Code: 2010, Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"})
+	ErrorAttributesMissing    Error = registerError(Error{Code: 2011, Type: "ATTRIBUTES_MISSING", Status: 400, Description: "Not all requested-for attributes were present"})
+	ErrorAttributesExpired    Error = registerError(Error{Code: 2012, Type: "ATTRIBUTES_EXPIRED", Status: 400, Description: "Disclosed attributes were expired"})
+	ErrorUnexpectedRequest    Error = registerError(Error{Code: 2013, Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"})
+	ErrorUnknownPublicKey     Error = registerError(Error{Code: 2014, Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"})
+	ErrorKeyshareProofMissing Error = registerError(Error{Code: 2015, Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"})
+	ErrorSessionUnknown       Error = registerError(Error{Code: 2016, Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"})
+	ErrorMalformedInput       Error = registerError(Error{Code: 2017, Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"})
+	ErrorUnknown              Error = registerError(Error{Code: 2018, Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"})
 
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorUnsupported           Error = registerError(Error{Code: 2019, Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"})
+	ErrorInvalidRequest        Error = registerError(Error{Code: 2020, Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"})
+	ErrorProtocolVersion       Error = registerError(Error{Code: 2021, Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"})
+	ErrorUnknownCredentialType Error = registerError(Error{Code: 2022, Type: "UNKNOWN_CREDENTIAL_TYPE", Status: 400, Description: "Proof of a credential type that is unknown or does not match the proof"})
+	ErrorTooManySessions       Error = registerError(Error{Code: 2023, Type: "TOO_MANY_SESSIONS", Status: 429, Description: "Too many unfinished sessions"})
+	ErrorIssuanceDenied        Error = registerError(Error{Code: 2024, Type: "ISSUANCE_DENIED", Status: 403, Description: "Issuance denied by the issuer"})
+	ErrorTooManyRequests       Error = registerError(Error{Code: 2025, Type: "TOO_MANY_REQUESTS", Status: 429, Description: "Too many requests"})
+	ErrorShuttingDown          Error = registerError(Error{Code: 2026, Type: "SHUTTING_DOWN", Status: 503, Description: "Server is shutting down"})
+	ErrorNextSession           Error = registerError(Error{Code: 2027, Type: "NEXT_SESSION", Status: 502, Description: "Failed to start the next session"})
 )
+
+// registerError adds the specified error to the irma error registry.
+func registerError(err Error) Error {
+	irma.RegisterError(irma.RegisteredError{
+		Code:        err.Code,
+		Name:        string(err.Type),
+		Origin:      irma.ErrorOriginServer,
+		Description: err.Description,
+	})
+	return err
+}
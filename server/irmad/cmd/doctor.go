@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/spf13/cobra"
+)
+
+var DoctorCommand = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the server deployment is ready to go live",
+	Long: `doctor reads the server configuration like the main command does, from a
+configuration file, command line flags, or environmental variables, and checks the
+deployment end to end: whether the configuration is valid, the schemes are validly
+signed, the issuer public keys are not expired, the keyshare servers can be reached,
+the JWT private key can be read, the local clock is correct, and the ports to listen
+at are available. The server must not be running while performing these checks.
+
+Exits with status 1 if any check fails.`,
+	Run: func(command *cobra.Command, args []string) {
+		if err := configure(command); err != nil {
+			die(errors.WrapPrefix(err, "Failed to read configuration from file, args, or env vars", 0))
+		}
+
+		diagnostics := requestorserver.Diagnose(conf)
+		if asJson, _ := command.Flags().GetBool("json"); asJson {
+			bts, _ := json.MarshalIndent(diagnostics, "", "   ")
+			fmt.Println(string(bts))
+		} else {
+			fmt.Print(diagnostics.String())
+		}
+		if !diagnostics.Passed() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCommand.AddCommand(DoctorCommand)
+
+	if err := setFlags(DoctorCommand, productionMode()); err != nil {
+		die(errors.WrapPrefix(err, "Failed to attach flags to "+DoctorCommand.Name()+" command", 0))
+	}
+	DoctorCommand.Flags().Bool("json", false, "Output the report as JSON")
+}
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/mitchellh/mapstructure"
@@ -27,37 +30,73 @@ var RootCommand = &cobra.Command{
 		if err := configure(command); err != nil {
 			die(errors.WrapPrefix(err, "Failed to read configuration", 0))
 		}
-		serv, err := requestorserver.New(conf)
-		if err != nil {
-			die(errors.WrapPrefix(err, "Failed to configure server", 0))
+		if conf.Service == requestorserver.ServiceWindows {
+			runWindowsService()
+			return
 		}
 
-		stopped := make(chan struct{})
+		stop := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
-
 		go func() {
-			if err := serv.Start(conf); err != nil {
-				die(errors.WrapPrefix(err, "Failed to start server", 0))
-			}
-			conf.Logger.Debug("Server stopped")
-			stopped <- struct{}{}
+			<-interrupt
+			conf.Logger.Debug("Caught interrupt")
+			close(stop)
 		}()
 
-		for {
-			select {
-			case <-interrupt:
-				conf.Logger.Debug("Caught interrupt")
-				serv.Stop() // causes serv.Start() above to return
-				conf.Logger.Debug("Sent stop signal to server")
-			case <-stopped:
-				conf.Logger.Info("Exiting")
-				close(stopped)
-				close(interrupt)
-				return
+		runServer(stop)
+	},
+}
+
+// runServer runs the server until it fails, or until the stop channel is closed.
+func runServer(stop <-chan struct{}) {
+	serv, err := requestorserver.New(conf)
+	if err != nil {
+		die(errors.WrapPrefix(err, "Failed to configure server", 0))
+	}
+
+	// Reload the requestors from the configuration file on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for range hangup {
+			requestors, err := reloadRequestors()
+			if err == nil {
+				err = serv.ReloadRequestors(requestors)
+			}
+			if err != nil {
+				conf.Logger.Warn("Failed to reload requestors: ", err.Error())
 			}
 		}
-	},
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		if err := serv.Start(conf); err != nil {
+			die(errors.WrapPrefix(err, "Failed to start server", 0))
+		}
+		conf.Logger.Debug("Server stopped")
+		close(stopped)
+	}()
+
+	select {
+	case <-stop:
+		// Both Shutdown() and Stop() cause serv.Start() above to return
+		if conf.ShutdownTimeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout)*time.Second)
+			if err := serv.Shutdown(ctx); err != nil {
+				conf.Logger.Warn("Unfinished sessions aborted: ", err.Error())
+			}
+			cancel()
+		} else {
+			serv.Stop()
+		}
+		conf.Logger.Debug("Sent stop signal to server")
+		<-stopped
+	case <-stopped:
+	}
+	conf.Logger.Info("Exiting")
 }
 
 func init() {
@@ -103,11 +142,28 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration")
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
+	flags.StringSlice("schemes-environments", nil, "environments of schemes that may be used in sessions (demo, production) (default production in production mode, all otherwise)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.String("privkeys-passphrase", "", "passphrase of encrypted IRMA private keys (preferably set using IRMASERVER_PRIVKEYS_PASSPHRASE)")
+	flags.String("audit-log", "", "path to file to which each use of an IRMA private key or keyshare server key is appended")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Bool("sandbox", false, "Enable sandbox mode, in which sessions can be completed by a simulated IRMA app (not allowed in production mode)")
+	flags.String("sandbox-credentials", "", "credentials held by the simulated IRMA app in sandbox mode (in JSON)")
+	flags.Int("client-timeout", 300, "default seconds that sessions wait for the IRMA app to connect")
+	flags.Int("session-lifetime", 0, "default max seconds that sessions may take before they time out (0 = only when inactive for 5 minutes)")
+	flags.Int("result-retention", 300, "default seconds that results of finished sessions are kept")
+	flags.StringSlice("cors-origins", nil, "origins of web pages that may access the endpoints for the IRMA app and the session status (default any origin)")
+	flags.String("callback-hmac-key", "", "base64-encoded key with which session results POSTed to callback URLs are signed, if no JWT private key is configured (preferably set using IRMASERVER_CALLBACK_HMAC_KEY)")
+
+	flags.String("store-type", "memory", "where to store sessions: memory, redis or postgres")
+	flags.String("redis-addr", "", "address (host:port) of Redis server, if store-type is redis")
+	flags.String("redis-pw", "", "password of Redis server (preferably set using IRMASERVER_REDIS_PW)")
+	flags.Int("redis-db", 0, "Redis database number")
+	flags.String("postgres-url", "", "connection string of Postgres database, if store-type is postgres (preferably set using IRMASERVER_POSTGRES_URL)")
+	flags.Lookup("store-type").Header = `Session storage (Redis or Postgres keep sessions across restarts, and allow multiple servers to share them)`
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
@@ -117,6 +173,11 @@ func setFlags(cmd *cobra.Command, production bool) error {
 
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
 	flags.String("requestors", "", "requestor configuration (in JSON)")
+	flags.String("tenants", "", "tenants having their own requestors, permissions and JWT key, selected by hostname or path prefix (in JSON)")
+	flags.String("request-sources", "", "endpoints from which to pull session requests (in JSON)")
+	flags.String("templates", "", "session requests with variables from which requestors can start sessions (in JSON)")
+	flags.String("static-sessions", "", "session requests that IRMA apps can start by scanning static QRs (in JSON)")
+	flags.String("result-claims", "", "claims of disclosed attributes in session result JWTs of all requestors (in JSON)")
 	flags.StringSlice("disclose-perms", nil, "list of attributes that all requestors may verify (default *)")
 	flags.StringSlice("sign-perms", nil, "list of attributes that all requestors may request in signatures (default *)")
 	issHelp := "list of attributes that all requestors may issue"
@@ -124,6 +185,15 @@ func setFlags(cmd *cobra.Command, production bool) error {
 		issHelp += " (default *)"
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
+	flags.Int("max-sessions", 0, "max amount of unfinished sessions per requestor (0 = unlimited)")
+	flags.Int("queue-timeout", 0, "max seconds that session requests exceeding max-sessions wait for another session to finish")
+	flags.StringSlice("requestor-cors-origins", nil, "origins of web pages that may access the requestor endpoints (default any origin)")
+	flags.Float64("requestor-rate", 0, "max requests per second per requestor to authenticated endpoints (0 = unlimited)")
+	flags.Float64("ip-rate", 0, "max requests per second per IP address (0 = unlimited)")
+	flags.Float64("session-rate", 0, "max requests per second to the endpoints of each session (0 = unlimited)")
+	flags.Int("rate-burst", 0, "max requests at once allowed by the rate limits (default twice the rate)")
+	flags.String("admin-token", "", "token with which the admin API under /admin is accessed (leave empty to disable)")
+	flags.Int("requestors-watch-interval", 10, "seconds between checks for modifications of the configuration file and requestor key files, upon which the requestors are reloaded (0 = disabled)")
 	flags.Lookup("no-auth").Header = `Requestor authentication and default requestor permissions`
 
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
@@ -141,6 +211,10 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
 	flags.String("client-tls-privkey-file", "", "path to TLS private key for IRMA app server")
 	flags.Bool("no-tls", false, "Disable TLS")
+	flags.String("security-headers", "", "HTTP security headers overriding the default ones, empty values disabling them (in JSON)")
+	flags.StringSlice("acme-hosts", nil, "obtain TLS certificates for these hostnames automatically from Let's Encrypt, accepting its terms of service (requires being reachable at port 443)")
+	flags.String("acme-cache-dir", "", "directory in which to cache ACME account key and certificates (default next to --schemes-path)")
+	flags.String("acme-directory-url", "", "directory URL of ACME certificate authority (default Let's Encrypt)")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
@@ -150,12 +224,42 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.Int("shutdown-timeout", 30, "when stopping, max seconds to wait for unfinished sessions to finish (0 = stop immediately)")
+	flags.String("service", "", "integrate with service manager: systemd (socket activation, readiness notification, journal logging) or windows (Windows service, event log logging)")
 	flags.Bool("production", false, "Production mode")
 	flags.Lookup("verbose").Header = `Other options`
 
 	return nil
 }
 
+// readRequestors reads the requestors from the flags, environment variables or configuration file.
+func readRequestors() (map[string]requestorserver.Requestor, error) {
+	var err error
+	var requestors map[string]interface{}
+	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
+		if requestors, err = cast.ToStringMapE(viper.Get("requestors")); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
+		}
+	}
+	result := make(map[string]requestorserver.Requestor)
+	if len(requestors) > 0 {
+		if err := mapstructure.Decode(requestors, &result); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
+		}
+	}
+	return result, nil
+}
+
+// reloadRequestors reads the configuration file again, and returns the requestors configured in it.
+func reloadRequestors() (map[string]requestorserver.Requestor, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, notfound := err.(viper.ConfigFileNotFoundError); !notfound {
+			return nil, errors.WrapPrefix(err, "Failed to read configuration file", 0)
+		}
+	}
+	return readRequestors()
+}
+
 func configure(cmd *cobra.Command) error {
 	dashReplacer := strings.NewReplacer("-", "_")
 	viper.SetEnvKeyReplacer(dashReplacer)
@@ -182,6 +286,9 @@ func configure(cmd *cobra.Command) error {
 
 	// Create our logger instance
 	logger = server.NewLogger(viper.GetInt("verbose"), viper.GetBool("quiet"), viper.GetBool("log-json"))
+	if err := configureServiceLogger(viper.GetString("service"), viper.GetBool("quiet")); err != nil {
+		return err
+	}
 
 	// First log output: hello, development or production mode, log level
 	mode := "development"
@@ -204,38 +311,68 @@ func configure(cmd *cobra.Command) error {
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			URL:        viper.GetString("url"),
-			DisableTLS: viper.GetBool("no-tls"),
-			Email:      viper.GetString("email"),
-			EnableSSE:  viper.GetBool("sse"),
-			Verbose:    viper.GetInt("verbose"),
-			Quiet:      viper.GetBool("quiet"),
-			LogJSON:    viper.GetBool("log-json"),
-			Logger:     logger,
-			Production: viper.GetBool("production"),
+			SchemesPath:                 viper.GetString("schemes-path"),
+			SchemesAssetsPath:           viper.GetString("schemes-assets-path"),
+			SchemesUpdateInterval:       viper.GetInt("schemes-update"),
+			SchemesEnvironments:         viper.GetStringSlice("schemes-environments"),
+			DisableSchemesUpdate:        viper.GetInt("schemes-update") == 0,
+			IssuerPrivateKeysPath:       viper.GetString("privkeys"),
+			IssuerPrivateKeysPassphrase: viper.GetString("privkeys-passphrase"),
+			AuditLogPath:                viper.GetString("audit-log"),
+			CallbackHmacKey:             viper.GetString("callback-hmac-key"),
+			StoreType:                   viper.GetString("store-type"),
+			RedisAddr:                   viper.GetString("redis-addr"),
+			RedisPassword:               viper.GetString("redis-pw"),
+			RedisDB:                     viper.GetInt("redis-db"),
+			PostgresURL:                 viper.GetString("postgres-url"),
+			URL:                         viper.GetString("url"),
+			DisableTLS:                  viper.GetBool("no-tls"),
+			Email:                       viper.GetString("email"),
+			EnableSSE:                   viper.GetBool("sse"),
+			CorsOrigins:                 viper.GetStringSlice("cors-origins"),
+			ClientTimeout:               viper.GetInt("client-timeout"),
+			SessionLifetime:             viper.GetInt("session-lifetime"),
+			ResultRetention:             viper.GetInt("result-retention"),
+			Sandbox:                     viper.GetBool("sandbox"),
+			Verbose:                     viper.GetInt("verbose"),
+			Quiet:                       viper.GetBool("quiet"),
+			LogJSON:                     viper.GetBool("log-json"),
+			Logger:                      logger,
+			Production:                  viper.GetBool("production"),
 		},
 		Permissions: requestorserver.Permissions{
 			Disclosing: handlePermission("disclose-perms"),
 			Signing:    handlePermission("sign-perms"),
 			Issuing:    handlePermission("issue-perms"),
 		},
+		SessionLimits: requestorserver.SessionLimits{
+			MaxSessions:  viper.GetInt("max-sessions"),
+			QueueTimeout: viper.GetInt("queue-timeout"),
+		},
+		RateLimits: requestorserver.RateLimits{
+			RequestorRate: viper.GetFloat64("requestor-rate"),
+			IPRate:        viper.GetFloat64("ip-rate"),
+			SessionRate:   viper.GetFloat64("session-rate"),
+			RateBurst:     viper.GetInt("rate-burst"),
+		},
 		ListenAddress:                  viper.GetString("listen-addr"),
 		Port:                           viper.GetInt("port"),
 		ClientListenAddress:            viper.GetString("client-listen-addr"),
 		ClientPort:                     viper.GetInt("client-port"),
 		DisableRequestorAuthentication: viper.GetBool("no-auth"),
-		Requestors:                     make(map[string]requestorserver.Requestor),
 		JwtIssuer:                      viper.GetString("jwt-issuer"),
 		JwtPrivateKey:                  viper.GetString("jwt-privkey"),
 		JwtPrivateKeyFile:              viper.GetString("jwt-privkey-file"),
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
+		Service:                        viper.GetString("service"),
+		ShutdownTimeout:                viper.GetInt("shutdown-timeout"),
+		RequestorCorsOrigins:           viper.GetStringSlice("requestor-cors-origins"),
+		AdminToken:                     viper.GetString("admin-token"),
+		RequestorsLoader:               reloadRequestors,
+		RequestorsFile:                 viper.ConfigFileUsed(),
+		RequestorsWatchInterval:        viper.GetInt("requestors-watch-interval"),
 
 		TlsCertificate:           viper.GetString("tls-cert"),
 		TlsCertificateFile:       viper.GetString("tls-cert-file"),
@@ -245,6 +382,9 @@ func configure(cmd *cobra.Command) error {
 		ClientTlsCertificateFile: viper.GetString("client-tls-cert-file"),
 		ClientTlsPrivateKey:      viper.GetString("client-tls-privkey"),
 		ClientTlsPrivateKeyFile:  viper.GetString("client-tls-privkey-file"),
+		AcmeHosts:                viper.GetStringSlice("acme-hosts"),
+		AcmeCacheDir:             viper.GetString("acme-cache-dir"),
+		AcmeDirectoryURL:         viper.GetString("acme-directory-url"),
 	}
 
 	if conf.Production {
@@ -257,15 +397,96 @@ func configure(cmd *cobra.Command) error {
 	}
 
 	// Handle requestors
-	var requestors map[string]interface{}
-	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
-		if requestors, err = cast.ToStringMapE(viper.Get("requestors")); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
+	if conf.Requestors, err = readRequestors(); err != nil {
+		return err
+	}
+
+	// Handle sandbox credentials, specified either as JSON in a flag or env var, or in the config file
+	if creds := viper.Get("sandbox-credentials"); creds != nil && creds != "" {
+		var bts []byte
+		if str, ok := creds.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(creds); err != nil {
+			return errors.WrapPrefix(err, "Failed to read sandbox credentials from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.SandboxCredentials); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal sandbox credentials", 0)
 		}
 	}
-	if len(requestors) > 0 {
-		if err := mapstructure.Decode(requestors, &conf.Requestors); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
+
+	// Handle request sources, specified either as JSON in a flag or env var, or in the config file
+	if sources := viper.Get("request-sources"); sources != nil && sources != "" {
+		var bts []byte
+		if str, ok := sources.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(sources); err != nil {
+			return errors.WrapPrefix(err, "Failed to read request sources from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.RequestSources); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal request sources", 0)
+		}
+	}
+
+	// Handle session templates, specified either as JSON in a flag or env var, or in the config file
+	if templates := viper.Get("templates"); templates != nil && templates != "" {
+		var bts []byte
+		if str, ok := templates.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(templates); err != nil {
+			return errors.WrapPrefix(err, "Failed to read session templates from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.Templates); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal session templates", 0)
+		}
+	}
+
+	// Handle tenants, specified either as JSON in a flag or env var, or in the config file
+	if tenants := viper.Get("tenants"); tenants != nil && tenants != "" {
+		var bts []byte
+		if str, ok := tenants.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(tenants); err != nil {
+			return errors.WrapPrefix(err, "Failed to read tenants from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.Tenants); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal tenants", 0)
+		}
+	}
+
+	// Handle static sessions, specified either as JSON in a flag or env var, or in the config file
+	if static := viper.Get("static-sessions"); static != nil && static != "" {
+		var bts []byte
+		if str, ok := static.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(static); err != nil {
+			return errors.WrapPrefix(err, "Failed to read static sessions from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.StaticSessions); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal static sessions", 0)
+		}
+	}
+
+	if claims := viper.Get("result-claims"); claims != nil && claims != "" {
+		var bts []byte
+		if str, ok := claims.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(claims); err != nil {
+			return errors.WrapPrefix(err, "Failed to read result claims from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.ResultClaims); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal result claims", 0)
+		}
+	}
+
+	if headers := viper.Get("security-headers"); headers != nil && headers != "" {
+		var bts []byte
+		if str, ok := headers.(string); ok {
+			bts = []byte(str)
+		} else if bts, err = json.Marshal(headers); err != nil {
+			return errors.WrapPrefix(err, "Failed to read security headers from config file", 0)
+		}
+		if err = json.Unmarshal(bts, &conf.SecurityHeaders); err != nil {
+			return errors.WrapPrefix(err, "Failed to unmarshal security headers", 0)
 		}
 	}
 
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/sirupsen/logrus"
+)
+
+// configureServiceLogger adapts the logger to the specified service manager: when run by
+// systemd, log lines are formatted for the journal; when run as a Windows service, log entries
+// are written to the Windows event log.
+func configureServiceLogger(service string, quiet bool) error {
+	if quiet {
+		return nil
+	}
+	switch service {
+	case requestorserver.ServiceSystemd:
+		if _, isJson := logger.Formatter.(*logrus.JSONFormatter); !isJson {
+			logger.SetFormatter(server.NewJournaldFormatter())
+		}
+	case requestorserver.ServiceWindows:
+		return configureEventLog()
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"github.com/go-errors/errors"
+)
+
+func runWindowsService() {
+	die(errors.New("Running as Windows service is only supported on Windows"))
+}
+
+func configureEventLog() error {
+	return errors.New("Logging to the Windows event log is only supported on Windows")
+}
@@ -0,0 +1,100 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogSource is the event log source under which the server logs when run as a Windows
+// service. It must be registered before the service is started, e.g. using the PowerShell
+// command New-EventLog -LogName Application -Source irmad.
+const eventLogSource = "irmad"
+
+type windowsService struct{}
+
+// Execute runs the server as a Windows service, until the service control manager stops it.
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runServer(stop)
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				conf.Logger.Debug("Caught stop request from service control manager")
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 1
+		}
+	}
+}
+
+func runWindowsService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		die(errors.WrapPrefix(err, "Failed to determine if running as Windows service", 0))
+	}
+	if !isService {
+		die(errors.New("Running as Windows service requires being started by the Windows service control manager"))
+	}
+	if err = svc.Run(eventLogSource, windowsService{}); err != nil {
+		die(errors.WrapPrefix(err, "Failed to run Windows service", 0))
+	}
+}
+
+// eventLogHook is a logrus hook writing log entries to the Windows event log.
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+func (hook eventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook eventLogHook) Fire(entry *logrus.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return hook.log.Error(1, msg)
+	case logrus.WarnLevel:
+		return hook.log.Warning(1, msg)
+	default:
+		return hook.log.Info(1, msg)
+	}
+}
+
+func configureEventLog() error {
+	log, err := eventlog.Open(eventLogSource)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to open Windows event log", 0)
+	}
+	// Services have no console, so only log to the event log
+	logger.Out = ioutil.Discard
+	logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true})
+	logger.AddHook(eventLogHook{log: log})
+	return nil
+}
@@ -5,8 +5,10 @@
 package irmaserver
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -18,6 +20,7 @@ import (
 type Server struct {
 	*servercore.Server
 	handlers map[string]SessionHandler
+	running  sync.WaitGroup // session handlers that are running
 }
 
 // SessionHandler is a function that can handle a session result
@@ -53,7 +56,44 @@ func (s *Server) Stop() {
 	s.Server.Stop()
 }
 
+// Shutdown stops the server gracefully: it refuses new sessions, and waits until the unfinished
+// sessions have finished, their results have been POSTed to their callback URLs and their session
+// handlers have returned. If the context is done before that, the server is stopped anyway and the
+// error of the context is returned.
+func Shutdown(ctx context.Context) error {
+	return s.Shutdown(ctx)
+}
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Drain(ctx)
+	if err == nil {
+		handlers := make(chan struct{})
+		go func() {
+			s.running.Wait()
+			close(handlers)
+		}()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-handlers:
+		}
+	}
+	s.Stop()
+	return err
+}
+
+const (
+	// CallbackSignatureHeader is the header containing the hex-encoded HMAC-SHA256 over the timestamp in
+	// the CallbackTimestampHeader, a dot, and the session results POSTed to the callbackUrl of session
+	// requests, if server.Configuration.CallbackHmacKey is used.
+	CallbackSignatureHeader = servercore.CallbackSignatureHeader
+	// CallbackTimestampHeader is the header containing the time (in Unix seconds) at which the session
+	// result was signed using server.Configuration.CallbackHmacKey.
+	CallbackTimestampHeader = servercore.CallbackTimestampHeader
+)
+
 // StartSession starts an IRMA session, running the handler on completion, if specified.
+// If the request specifies a callbackUrl, the session result is also POSTed to it once the session
+// has finished, signed as a JWT or using HMAC (see server.Configuration.CallbackHmacKey).
 // The session token (the second return parameter) can be used in GetSessionResult()
 // and CancelSession().
 // The request parameter can be an irma.RequestorRequest, or an irma.SessionRequest, or a
@@ -96,6 +136,63 @@ func (s *Server) CancelSession(token string) error {
 	return s.Server.CancelSession(token)
 }
 
+// ActiveSessions returns the IRMA sessions that have not yet finished.
+func ActiveSessions() ([]*server.SessionInfo, error) {
+	return s.ActiveSessions()
+}
+func (s *Server) ActiveSessions() ([]*server.SessionInfo, error) {
+	return s.Server.ActiveSessions()
+}
+
+// UpdateSchemes updates all schemes immediately, instead of waiting for the next periodic update.
+func UpdateSchemes() error {
+	return s.UpdateSchemes()
+}
+func (s *Server) UpdateSchemes() error {
+	return s.Server.UpdateSchemes()
+}
+
+// DisabledSchemes returns the schemes that could not be parsed, along with the reason why.
+func DisabledSchemes() map[irma.SchemeManagerIdentifier]*irma.SchemeManagerError {
+	return s.DisabledSchemes()
+}
+func (s *Server) DisabledSchemes() map[irma.SchemeManagerIdentifier]*irma.SchemeManagerError {
+	return s.Server.DisabledSchemes()
+}
+
+// CompleteSandboxSession completes the specified IRMA session using the simulated IRMA app
+// of the sandbox mode (see server.Configuration.Sandbox), running the session handler if specified.
+func CompleteSandboxSession(token string) (*server.SessionResult, *irma.RemoteError) {
+	return s.CompleteSandboxSession(token)
+}
+func (s *Server) CompleteSandboxSession(token string) (*server.SessionResult, *irma.RemoteError) {
+	result, rerr := s.Server.CompleteSandboxSession(token)
+	if result != nil && result.Status.Finished() {
+		s.runHandler(result)
+	}
+	return result, rerr
+}
+
+// PreviewIssuance validates the specified issuance request as StartSession() would, and returns
+// the credentials that would be issued, including their computed expiry date and other metadata,
+// without starting a session.
+func PreviewIssuance(request interface{}) ([]*irma.CredentialInfo, error) {
+	return s.PreviewIssuance(request)
+}
+func (s *Server) PreviewIssuance(request interface{}) ([]*irma.CredentialInfo, error) {
+	return s.Server.PreviewIssuance(request)
+}
+
+// ValidateIssuance checks the specified issuance request against the current configuration
+// without starting a session, and returns all problems that would prevent its credentials from
+// being issued, or none if the request can be issued.
+func ValidateIssuance(request interface{}) ([]*server.IssuanceProblem, error) {
+	return s.ValidateIssuance(request)
+}
+func (s *Server) ValidateIssuance(request interface{}) ([]*server.IssuanceProblem, error) {
+	return s.Server.ValidateIssuance(request)
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
@@ -105,6 +202,17 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return s.Server.SubscribeServerSentEvents(w, r, token, requestor)
 }
 
+// SubscribeStatus returns a channel on which the current status of the specified IRMA session is
+// sent, followed by each of its status updates. The channel is closed once the session has finished
+// (i.e. after the DONE, CANCELLED or TIMEOUT status has been sent), or immediately if the session
+// is unknown.
+func SubscribeStatus(token string) <-chan server.Status {
+	return s.SubscribeStatus(token)
+}
+func (s *Server) SubscribeStatus(token string) <-chan server.Status {
+	return s.Server.SubscribeStatus(token)
+}
+
 // HandlerFunc returns a http.HandlerFunc that handles the IRMA protocol
 // with IRMA apps.
 //
@@ -116,7 +224,7 @@ func HandlerFunc() http.HandlerFunc {
 	return s.HandlerFunc()
 }
 func (s *Server) HandlerFunc() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return server.RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var message []byte
 		var err error
 		if r.Method == http.MethodPost {
@@ -145,9 +253,20 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			_ = server.LogError(errors.WrapPrefix(err, "http.ResponseWriter.Write() returned error", 0))
 		}
 		if result != nil && result.Status.Finished() {
-			if handler := s.handlers[result.Token]; handler != nil {
-				go handler(result)
-			}
+			s.runHandler(result)
 		}
+	})).ServeHTTP
+}
+
+// runHandler runs the handler of the finished session, if any, in the background.
+func (s *Server) runHandler(result *server.SessionResult) {
+	handler := s.handlers[result.Token]
+	if handler == nil {
+		return
 	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		handler(result)
+	}()
 }
@@ -0,0 +1,200 @@
+// Package requestorclient is a client of the RESTful requestor API of the IRMA server (see package
+// requestorserver), with which Go applications can start IRMA sessions at an IRMA server, follow
+// their status, and retrieve and verify their results.
+package requestorclient
+
+import (
+	"context"
+	"crypto/rsa"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Client starts and manages sessions at an IRMA server on behalf of a requestor.
+type Client struct {
+	// Interval at which SubscribeStatus() and Await() poll the session status
+	PollInterval time.Duration
+
+	url       string
+	token     string
+	authorize func(request irma.RequestorRequest) (interface{}, error)
+	transport *irma.HTTPTransport
+	keyMutex  sync.Mutex
+	publicKey *rsa.PublicKey
+}
+
+// Interval at which the status of sessions is polled by default
+const DefaultPollInterval = 500 * time.Millisecond
+
+// New returns a client of the IRMA server at the specified URL that sends session requests
+// unauthenticated, for servers whose requestors use the "none" authentication method.
+func New(url string) *Client {
+	return newClient(url, "", func(request irma.RequestorRequest) (interface{}, error) {
+		return request, nil
+	})
+}
+
+// NewWithToken returns a client that authenticates using the specified token, for requestors
+// using the "token" authentication method.
+func NewWithToken(url, token string) *Client {
+	return newClient(url, token, func(request irma.RequestorRequest) (interface{}, error) {
+		return request, nil
+	})
+}
+
+// NewWithKey returns a client that sends session requests as JWTs signed with the specified key,
+// for requestors using the "hmac" (jwt.SigningMethodHS256 and a []byte key) or "publickey"
+// authentication methods (jwt.SigningMethodRS256, ES256, ES384 or irma.SigningMethodEdDSA, and a
+// corresponding private key).
+func NewWithKey(url, requestor string, method jwt.SigningMethod, key interface{}) *Client {
+	return newClient(url, "", func(request irma.RequestorRequest) (interface{}, error) {
+		return irma.SignRequestorRequest(request, method, key, requestor)
+	})
+}
+
+func newClient(url, token string, authorize func(irma.RequestorRequest) (interface{}, error)) *Client {
+	client := &Client{
+		url:          url,
+		authorize:    authorize,
+		token:        token,
+		PollInterval: DefaultPollInterval,
+	}
+	client.transport = client.newTransport("")
+	return client
+}
+
+func (client *Client) newTransport(path string) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport(client.url)
+	transport.Server += path
+	if client.token != "" {
+		transport.SetHeader("Authorization", client.token)
+	}
+	return transport
+}
+
+func (client *Client) session(token string) *irma.HTTPTransport {
+	return client.newTransport("session/" + token + "/")
+}
+
+// SetPublicKey sets the public key with which the server signs session result JWTs. If it is not
+// set, it is retrieved from the server when a JWT is first verified.
+func (client *Client) SetPublicKey(pk *rsa.PublicKey) {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+	client.publicKey = pk
+}
+
+// StartSession starts a session at the server. The request may be an irma.RequestorRequest, an
+// irma.SessionRequest, or its JSON serialization as a string or []byte. The session pointer in
+// the returned session package is to be shown to the user as a QR.
+func (client *Client) StartSession(request interface{}) (*server.SessionPackage, error) {
+	rrequest, err := server.ParseSessionRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.authorize(rrequest)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to sign session request", 0)
+	}
+	pkg := &server.SessionPackage{}
+	if err = client.transport.Post("session", pkg, body); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// CancelSession cancels the specified session.
+func (client *Client) CancelSession(token string) {
+	client.session(token).Delete()
+}
+
+// Status returns the current status of the specified session.
+func (client *Client) Status(token string) (server.Status, error) {
+	var status server.Status
+	err := client.session(token).Get("status", &status)
+	return status, err
+}
+
+// SubscribeStatus polls the status of the specified session, sending the current status and each
+// subsequent status change to the returned channel, which is closed once the session has finished
+// or the context is done. If polling fails, the error is sent to the error channel, after which
+// both channels are closed.
+func (client *Client) SubscribeStatus(ctx context.Context, token string) (<-chan server.Status, <-chan error) {
+	statuses := make(chan server.Status, 4)
+	errs := make(chan error, 1)
+	transport := client.session(token)
+	go func() {
+		defer close(statuses)
+		defer close(errs)
+		var current server.Status
+		for {
+			var status server.Status
+			if err := transport.Get("status", &status); err != nil {
+				errs <- err
+				return
+			}
+			if status != current {
+				current = status
+				select {
+				case statuses <- status:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if status.Finished() {
+				return
+			}
+			select {
+			case <-time.After(client.PollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return statuses, errs
+}
+
+// Await waits until the specified session has finished, and returns its result.
+func (client *Client) Await(ctx context.Context, token string) (*server.SessionResult, error) {
+	statuses, errs := client.SubscribeStatus(ctx, token)
+	for range statuses {
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return client.Result(token)
+}
+
+// Result returns the result of the specified session.
+func (client *Client) Result(token string) (*server.SessionResult, error) {
+	result := &server.SessionResult{}
+	if err := client.session(token).Get("result", result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ResultJwt returns the result of the specified session as a JWT signed by the server.
+func (client *Client) ResultJwt(token string) (string, error) {
+	var j string
+	err := client.session(token).Get("result-jwt", &j)
+	return j, err
+}
+
+// VerifiedResult retrieves the result of the specified session as a JWT, and returns its contents
+// after verifying it (see ParseResultJwt()).
+func (client *Client) VerifiedResult(token string) (*ResultClaims, error) {
+	j, err := client.ResultJwt(token)
+	if err != nil {
+		return nil, err
+	}
+	return client.ParseResultJwt(j)
+}
@@ -0,0 +1,69 @@
+package requestorclient
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// ResultClaims are the contents of a session result JWT signed by the server.
+type ResultClaims struct {
+	jwt.StandardClaims
+	server.SessionResult
+
+	// All claims of the JWT. For requestors whose session results are mapped to custom claims
+	// (see requestorserver.ResultClaims), the disclosed attributes are present only here.
+	Claims jwt.MapClaims `json:"-"`
+}
+
+// PublicKey returns the public key with which the server signs session result JWTs, retrieving it
+// from the server if it has not been set using SetPublicKey().
+func (client *Client) PublicKey() (*rsa.PublicKey, error) {
+	client.keyMutex.Lock()
+	defer client.keyMutex.Unlock()
+	if client.publicKey != nil {
+		return client.publicKey, nil
+	}
+	var pem string
+	if err := client.transport.Get("publickey", &pem); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to retrieve public key of server", 0)
+	}
+	pk, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pem))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse public key of server", 0)
+	}
+	client.publicKey = pk
+	return pk, nil
+}
+
+// ParseResultJwt verifies the signature and expiry of a session result JWT, as returned by
+// ResultJwt() or POSTed by the server to the callbackUrl of a session, and returns its contents.
+func (client *Client) ParseResultJwt(j string) (*ResultClaims, error) {
+	pk, err := client.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(j, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, errors.Errorf("unexpected JWT signing method %s", token.Method.Alg())
+		}
+		return pk, nil
+	})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid session result JWT", 0)
+	}
+
+	bts, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	result := &ResultClaims{Claims: claims}
+	if err = json.Unmarshal(bts, result); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse session result JWT", 0)
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package requestorserver
+
+import (
+	"crypto/tls"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// If AcmeHosts is configured, the server obtains certificates for these hostnames from an ACME
+// certificate authority (by default Let's Encrypt) when they are first needed, and renews them
+// automatically before they expire, so that no reverse proxy is needed for TLS. The certificate
+// authority verifies control over the hostnames using the TLS-ALPN-01 challenge, for which the
+// server must be reachable from the internet at port 443 of these hostnames (possibly through port
+// forwarding). Unless they have their own TLS configuration, both the requestor server and the
+// client server (if enabled) use the ACME certificates. By enabling ACME, the terms of service of
+// the certificate authority are accepted.
+
+func (conf *Configuration) acmeEnabled() bool {
+	return len(conf.AcmeHosts) > 0
+}
+
+func (conf *Configuration) initializeAcme() error {
+	if !conf.acmeEnabled() {
+		return nil
+	}
+	if conf.TlsCertificate != "" || conf.TlsCertificateFile != "" || conf.TlsPrivateKey != "" || conf.TlsPrivateKeyFile != "" {
+		return errors.New("acme_hosts cannot be combined with tls_cert(_file) or tls_privkey(_file)")
+	}
+	if conf.AcmeCacheDir == "" {
+		// Without a cache, certificates would be requested again after each restart, quickly
+		// running into the rate limits of the certificate authority
+		conf.AcmeCacheDir = filepath.Join(filepath.Dir(conf.SchemesPath), "irmaserver_acme")
+		conf.Logger.Info("Using default ACME cache directory ", conf.AcmeCacheDir)
+	}
+
+	conf.acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.AcmeHosts...),
+		Cache:      autocert.DirCache(conf.AcmeCacheDir),
+		Email:      conf.Email,
+	}
+	if conf.AcmeDirectoryURL != "" {
+		conf.acmeManager.Client = &acme.Client{DirectoryURL: conf.AcmeDirectoryURL}
+	}
+	return nil
+}
+
+// acmeTlsConfig returns a TLS configuration using certificates obtained using ACME.
+func (conf *Configuration) acmeTlsConfig() *tls.Config {
+	tlsConf := secureTlsConfig(conf.acmeManager.GetCertificate)
+	// HTTP/2 is disabled (see startServer()), so we must not offer it during ALPN. The ACME
+	// protocol is used by the certificate authority for the TLS-ALPN-01 challenge.
+	tlsConf.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	return tlsConf
+}
@@ -0,0 +1,161 @@
+package requestorserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains the admin API, with which operators manage the server at runtime instead of
+// restarting it. It is available under /admin if an AdminToken is configured, which must be sent
+// in the Authorization header, and consists of the following endpoints:
+//  - GET /admin/sessions: the unfinished sessions (see server.SessionInfo)
+//  - DELETE /admin/session/{token}: cancel a session
+//  - POST /admin/schemes/update: update all schemes immediately
+//  - GET /admin/schemes/disabled: the schemes that could not be parsed, with the reason why
+//  - POST /admin/requestors/reload: reload the requestors (see reloadRequestors())
+// Each of these is also available as a method of the Server.
+
+// ActiveSessions returns the sessions that have not yet finished.
+func (s *Server) ActiveSessions() ([]*server.SessionInfo, error) {
+	sessions, err := s.irmaserv.ActiveSessions()
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Requestor, _ = s.sessionRequestors.get(session.Token)
+	}
+	return sessions, nil
+}
+
+// CancelSession cancels the specified session.
+func (s *Server) CancelSession(token string) error {
+	return s.irmaserv.CancelSession(token)
+}
+
+// UpdateSchemes updates all schemes immediately, instead of waiting for the next periodic update.
+func (s *Server) UpdateSchemes() error {
+	return s.irmaserv.UpdateSchemes()
+}
+
+// DisabledSchemes returns the schemes that could not be parsed, along with the reason why.
+func (s *Server) DisabledSchemes() map[irma.SchemeManagerIdentifier]*irma.SchemeManagerError {
+	return s.irmaserv.DisabledSchemes()
+}
+
+// ReloadRequestors replaces the requestors of the server, after validating them in the same way
+// as on startup. Sessions that have already been started are not affected. If the requestors are
+// invalid, the current requestors are kept and an error is returned. The requestors of the
+// tenants (see tenants.go) are not affected.
+func (s *Server) ReloadRequestors(requestors map[string]Requestor) error {
+	if s.conf.DisableRequestorAuthentication {
+		return errors.New("Requestors cannot be configured when requestor authentication is disabled")
+	}
+	if len(requestors) == 0 {
+		return errors.New("No requestors configured")
+	}
+
+	// Validate the requestors against a copy of the configuration containing them
+	candidate := *s.conf
+	candidate.Requestors = requestors
+	if candidate.certificateAuthentication() && !s.conf.certificateAuthentication() {
+		return errors.New("Certificate authentication can only be enabled by restarting the server")
+	}
+	auths, err := candidate.newAuthenticators(requestors)
+	if err != nil {
+		return err
+	}
+	for name, requestor := range requestors {
+		if err = candidate.validateResultClaims("Requestor "+name, requestor.ResultClaims, s.conf.jwtPrivateKey != nil); err != nil {
+			return err
+		}
+	}
+	if err = candidate.validatePermissions(); err != nil {
+		return err
+	}
+	if err = candidate.validateTemplates(); err != nil {
+		return err
+	}
+	if err = candidate.validateStaticSessions(); err != nil {
+		return err
+	}
+
+	requestorsMutex.Lock()
+	s.conf.Requestors, authenticators = requestors, auths
+	requestorsMutex.Unlock()
+	s.conf.Logger.WithField("requestors", len(requestors)).Info("Requestors reloaded")
+	return nil
+}
+
+func (s *Server) adminHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(s.adminAuthMiddleware)
+	router.Get("/sessions", s.handleAdminSessions)
+	router.Delete("/session/{token}", s.handleAdminCancel)
+	router.Post("/schemes/update", s.handleAdminUpdateSchemes)
+	router.Get("/schemes/disabled", s.handleAdminDisabledSchemes)
+	router.Post("/requestors/reload", s.handleAdminReloadRequestors)
+	return router
+}
+
+// adminAuthMiddleware refuses requests that do not contain the AdminToken.
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(s.conf.AdminToken)) != 1 {
+			s.conf.Logger.WithFields(logrus.Fields{"path": r.URL.Path, "remote": r.RemoteAddr}).
+				Warn("Unauthorized request to admin API")
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+		s.conf.Logger.WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path}).Info("Admin API request")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.ActiveSessions()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, sessions)
+}
+
+func (s *Server) handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	if err := s.CancelSession(chi.URLParam(r, "token")); err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminUpdateSchemes(w http.ResponseWriter, r *http.Request) {
+	if err := s.UpdateSchemes(); err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminDisabledSchemes(w http.ResponseWriter, r *http.Request) {
+	disabled := map[string]string{}
+	for id, err := range s.DisabledSchemes() {
+		disabled[id.String()] = err.Error()
+	}
+	server.WriteJson(w, disabled)
+}
+
+func (s *Server) handleAdminReloadRequestors(w http.ResponseWriter, r *http.Request) {
+	if err := s.reloadRequestors(); err != nil {
+		s.conf.Logger.Warn("Failed to reload requestors: ", err.Error())
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,8 +1,16 @@
 package requestorserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -10,6 +18,7 @@ import (
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Authenticator instances authenticate incoming session requests. Given details of the HTTP
@@ -30,16 +39,45 @@ type Authenticator interface {
 	) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError)
 }
 
+// ConnectionAuthenticator instances authenticate incoming session requests using the TLS
+// connection over which they are sent, in addition to its HTTP headers and POST body.
+type ConnectionAuthenticator interface {
+	Authenticator
+
+	// AuthenticateConnection is like Authenticate, but also receives the state of the TLS
+	// connection of the session request (nil if TLS is not used).
+	AuthenticateConnection(
+		state *tls.ConnectionState, headers http.Header, body []byte,
+	) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError)
+}
+
 type AuthenticationMethod string
 
 // Currently supported requestor authentication methods
 const (
-	AuthenticationMethodHmac      = "hmac"
-	AuthenticationMethodPublicKey = "publickey"
-	AuthenticationMethodToken     = "token"
-	AuthenticationMethodNone      = "none"
+	AuthenticationMethodHmac        = "hmac"
+	AuthenticationMethodPublicKey   = "publickey"
+	AuthenticationMethodToken       = "token"
+	AuthenticationMethodCertificate = "certificate"
+	AuthenticationMethodNone        = "none"
 )
 
+// Key types of requestors using the publickey authentication method, determining the JWT
+// signature algorithm that the requestor uses
+const (
+	KeyTypeRSA     = "rsa"     // RS256
+	KeyTypeECDSA   = "ecdsa"   // ES256 or ES384, depending on the curve of the key (P-256 or P-384)
+	KeyTypeEd25519 = "ed25519" // EdDSA
+)
+
+// publicKeyAlgs are the JWT signature algorithms accepted by the PublicKeyAuthenticator.
+var publicKeyAlgs = []string{
+	jwt.SigningMethodRS256.Name,
+	jwt.SigningMethodES256.Name,
+	jwt.SigningMethodES384.Name,
+	irma.SigningMethodEdDSA.Alg(),
+}
+
 type HmacAuthenticator struct {
 	hmackeys      map[string]interface{}
 	maxRequestAge int
@@ -51,9 +89,24 @@ type PublicKeyAuthenticator struct {
 type PresharedKeyAuthenticator struct {
 	presharedkeys map[string]string
 }
+type CertificateAuthenticator struct {
+	fingerprints map[string]string         // requestor per SHA-256 certificate fingerprint
+	roots        map[string]*x509.CertPool // CA certificates per requestor
+}
 type NilAuthenticator struct{}
 
-var authenticators map[AuthenticationMethod]Authenticator
+var (
+	authenticators map[AuthenticationMethod]Authenticator
+	// Guards authenticators and the Requestors of the configuration, which can be reloaded at runtime
+	requestorsMutex sync.RWMutex
+)
+
+// currentAuthenticators returns the authenticators of the current requestors.
+func currentAuthenticators() map[AuthenticationMethod]Authenticator {
+	requestorsMutex.RLock()
+	defer requestorsMutex.RUnlock()
+	return authenticators
+}
 
 func (NilAuthenticator) Authenticate(
 	headers http.Header, body []byte,
@@ -75,7 +128,7 @@ func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 func (hauth *HmacAuthenticator) Authenticate(
 	headers http.Header, body []byte,
 ) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, []string{jwt.SigningMethodHS256.Name}, hauth.hmackeys, hauth.maxRequestAge)
 }
 
 func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -98,18 +151,41 @@ func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) err
 func (pkauth *PublicKeyAuthenticator) Authenticate(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, publicKeyAlgs, pkauth.publickeys, pkauth.maxRequestAge)
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
+	if requestor.AuthenticationJWKS != "" {
+		if requestor.AuthenticationKey != "" || requestor.AuthenticationKeyFile != "" {
+			return errors.Errorf("Requestor %s cannot have both a key and a JWKS", name)
+		}
+		pkauth.publickeys[name] = irma.NewJWKS(requestor.AuthenticationJWKS, nil)
+		return nil
+	}
+
 	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
 	}
 
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
+	var pk interface{}
+	switch requestor.AuthenticationKeyType {
+	case "", KeyTypeRSA:
+		pk, err = jwt.ParseRSAPublicKeyFromPEM(bts)
+	case KeyTypeECDSA:
+		var ecpk *ecdsa.PublicKey
+		if ecpk, err = jwt.ParseECPublicKeyFromPEM(bts); err == nil && jwtKeyAlg(ecpk) == "" {
+			err = errors.New("unsupported curve (supported curves: P-256, P-384)")
+		}
+		pk = ecpk
+	case KeyTypeEd25519:
+		pk, err = irma.ParseEd25519PublicKeyFromPEM(bts)
+	default:
+		return errors.Errorf("Requestor %s has unsupported key type %s (supported key types: %s, %s, %s)",
+			name, requestor.AuthenticationKeyType, KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519)
+	}
 	if err != nil {
-		return err
+		return errors.WrapPrefix(err, "Failed to parse key of requestor "+name, 0)
 	}
 	pkauth.publickeys[name] = pk
 
@@ -143,31 +219,173 @@ func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requ
 	return nil
 }
 
+// Authenticate never applies, as requestors using certificate authentication are recognized
+// by their TLS client certificate (see AuthenticateConnection).
+func (cauth *CertificateAuthenticator) Authenticate(
+	headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	return false, nil, "", nil
+}
+
+func (cauth *CertificateAuthenticator) AuthenticateConnection(
+	state *tls.ConnectionState, headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	if state == nil || len(state.PeerCertificates) == 0 ||
+		headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return false, nil, "", nil
+	}
+	requestor, err := cauth.requestor(state.PeerCertificates)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, err.Error())
+	}
+	request, err := server.ParseSessionRequest(body)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, request, requestor, nil
+}
+
+// requestor returns the requestor to which the client certificate chain belongs: either the
+// requestor that configured the fingerprint of the certificate, or the single requestor whose
+// CA issued it.
+func (cauth *CertificateAuthenticator) requestor(chain []*x509.Certificate) (string, error) {
+	cert := chain[0]
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", errors.New("client certificate expired or not yet valid")
+	}
+	if requestor, ok := cauth.fingerprints[certificateFingerprint(cert)]; ok {
+		return requestor, nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	var requestors []string
+	for requestor, roots := range cauth.roots {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			requestors = append(requestors, requestor)
+		}
+	}
+	switch len(requestors) {
+	case 0:
+		return "", errors.New("unknown client certificate")
+	case 1:
+		return requestors[0], nil
+	default:
+		return "", errors.Errorf("client certificate belongs to multiple requestors: %s", strings.Join(requestors, ", "))
+	}
+}
+
+func (cauth *CertificateAuthenticator) Initialize(name string, requestor Requestor) error {
+	if len(requestor.CertificateFingerprints) == 0 &&
+		requestor.AuthenticationKey == "" && requestor.AuthenticationKeyFile == "" {
+		return errors.Errorf("Requestor %s must have certificate fingerprints or a CA certificate", name)
+	}
+
+	for _, fingerprint := range requestor.CertificateFingerprints {
+		fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+		if bts, err := hex.DecodeString(fingerprint); err != nil || len(bts) != sha256.Size {
+			return errors.Errorf("Requestor %s has invalid certificate fingerprint %s (must be a hex-encoded SHA-256 hash)", name, fingerprint)
+		}
+		if other, ok := cauth.fingerprints[fingerprint]; ok && other != name {
+			return errors.Errorf("Requestors %s and %s have the same certificate fingerprint", other, name)
+		}
+		cauth.fingerprints[fingerprint] = name
+	}
+
+	if requestor.AuthenticationKey == "" && requestor.AuthenticationKeyFile == "" {
+		return nil
+	}
+	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read CA certificate of requestor "+name, 0)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bts) {
+		return errors.Errorf("Failed to parse CA certificate of requestor %s", name)
+	}
+	cauth.roots[name] = roots
+	return nil
+}
+
 // Helper functions
 
-// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
+// certificateFingerprint returns the hex-encoded SHA-256 hash of the certificate.
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header.
+// The "kid" header names the requestor, unless it is not a known requestor and the issuer of the jwt is a
+// requestor whose keys are in a JWKS, in which case it names the key within the JWKS.
 func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
 	return func(token *jwt.Token) (interface{}, error) {
 		var ok bool
+		claims := token.Claims.(*jwt.StandardClaims)
 		kid, ok := token.Header["kid"]
 		if !ok {
-			kid = token.Claims.(*jwt.StandardClaims).Issuer
+			kid = claims.Issuer
 		}
-		requestor, ok := kid.(string)
+		keyid, ok := kid.(string)
 		if !ok {
 			return nil, errors.New("requestor name was not a string")
 		}
-		token.Claims.(*jwt.StandardClaims).Issuer = requestor
-		if pk, ok := publickeys[requestor]; ok {
-			return pk, nil
+		requestor := keyid
+		if _, known := publickeys[requestor]; !known {
+			if _, ok = publickeys[claims.Issuer].(*irma.JWKS); ok {
+				requestor = claims.Issuer
+			}
+		}
+		claims.Issuer = requestor
+		pk, ok := publickeys[requestor]
+		if !ok {
+			return nil, errors.Errorf("Unknown requestor: %s", requestor)
+		}
+		if jwks, ok := pk.(*irma.JWKS); ok {
+			var err error
+			if pk, err = jwks.Key(keyid); err != nil {
+				return nil, err
+			}
+		}
+		// Each requestor may only use the signature algorithm belonging to its key
+		if alg := token.Method.Alg(); alg != jwtKeyAlg(pk) {
+			return nil, errors.Errorf("Requestor %s may not use signature algorithm %s", requestor, alg)
+		}
+		return pk, nil
+	}
+}
+
+// jwtKeyAlg returns the JWT signature algorithm in which the specified key is used.
+func jwtKeyAlg(key interface{}) string {
+	switch k := key.(type) {
+	case []byte:
+		return jwt.SigningMethodHS256.Name
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Name
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256.Name
+		case elliptic.P384():
+			return jwt.SigningMethodES384.Name
 		}
-		return nil, errors.Errorf("Unknown requestor: %s", requestor)
+	case ed25519.PublicKey:
+		return irma.SigningMethodEdDSA.Alg()
 	}
+	return ""
 }
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlgs []string, keys map[string]interface{}, maxRequestAge int,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	// Read JWT and check its type
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "text/plain") {
@@ -179,10 +397,11 @@ func jwtAuthenticate(
 	// inspecting the JWT header here, before the signature is verified (which is done below). I suppose
 	// it would be more idiomatic to have the KeyFunc which is fed to jwt.ParseWithClaims() perform this
 	// task, but then the KeyFunc would need access to all public keys here instead of the ones belonging
-	// to the signature algorithm we are expecting (specified by signatureAlg). Security-wise it makes no
-	// difference: either way the alg header is examined before the signature is verified.
+	// to the signature algorithms we are expecting (specified by signatureAlgs). Security-wise it makes no
+	// difference: either way the alg header is examined before the signature is verified, and
+	// jwtKeyExtractor checks that it matches the key of the requestor.
 	alg, err := jwtSignatureAlg(requestorJwt)
-	if err != nil || alg != signatureAlg {
+	if err != nil || !contains(signatureAlgs, alg) {
 		// If err != nil, ie. we failed to determine the JWT signature algorithm, we assume that the
 		// request is not meant for this authenticator. So we don't return err
 		return false, nil, "", nil
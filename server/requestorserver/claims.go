@@ -0,0 +1,105 @@
+package requestorserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// ResultClaims maps attribute type identifiers to the names of the claims in which their disclosed
+// values are included in session result JWTs, so that relying parties can consume the session
+// results without parsing IRMA-specific structures. Dots in claim names denote nested claims;
+// e.g. the mapping
+//
+//	{"irma-demo.RU.studentCard.studentID": "student.id"}
+//
+// results in JWTs with claims like
+//
+//	{"sub": "disclosing_result", "status": "DONE", "proofStatus": "VALID", "student": {"id": "s1234567"}, ...}
+//
+// Disclosed attributes that are not mapped are left out. If a requestor has ResultClaims, its
+// session results are signed in this form (by /result-jwt, and when POSTed to the callbackUrl)
+// instead of containing the entire session result.
+type ResultClaims map[string]string
+
+// Interval at which the requestors of sessions that no longer exist are forgotten
+const sessionRequestorsPruneInterval = time.Minute
+
+// sessionRequestors keeps track of the requestor of each session.
+type sessionRequestors struct {
+	mutex      sync.Mutex
+	requestors map[string]string // requestor per session token
+	pruned     time.Time
+	exists     func(token string) bool
+}
+
+func newSessionRequestors(exists func(token string) bool) *sessionRequestors {
+	return &sessionRequestors{requestors: map[string]string{}, pruned: time.Now(), exists: exists}
+}
+
+func (r *sessionRequestors) set(token, requestor string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.pruned) > sessionRequestorsPruneInterval {
+		for t := range r.requestors {
+			if !r.exists(t) {
+				delete(r.requestors, t)
+			}
+		}
+		r.pruned = time.Now()
+	}
+	r.requestors[token] = requestor
+}
+
+func (r *sessionRequestors) get(token string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	requestor, ok := r.requestors[token]
+	return requestor, ok
+}
+
+// resultClaims returns the claims mapping applying to the specified session, if any.
+func (s *Server) resultClaims(token string) ResultClaims {
+	if requestor, ok := s.sessionRequestors.get(token); ok {
+		if r, ok := s.conf.requestor(requestor); ok && len(r.ResultClaims) > 0 {
+			return r.ResultClaims
+		}
+	}
+	return s.conf.ResultClaims
+}
+
+// mappedResultClaims returns the claims of the session result according to the mapping.
+func mappedResultClaims(result *server.SessionResult, mapping ResultClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"status":      result.Status,
+		"proofStatus": result.ProofStatus,
+	}
+	for _, attr := range result.Disclosed {
+		name, ok := mapping[attr.Identifier.String()]
+		if !ok {
+			continue
+		}
+		var value interface{}
+		if attr.RawValue != nil {
+			value = *attr.RawValue
+		}
+		setClaim(claims, strings.Split(name, "."), value)
+	}
+	return claims
+}
+
+// setClaim sets the (possibly nested) claim at the specified path.
+func setClaim(claims map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		nested, ok := claims[name].(map[string]interface{})
+		if !ok {
+			nested = map[string]interface{}{}
+			claims[name] = nested
+		}
+		claims = nested
+	}
+	claims[path[len(path)-1]] = value
+}
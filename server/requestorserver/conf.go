@@ -3,6 +3,7 @@ package requestorserver
 import (
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -13,6 +14,7 @@ import (
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Configuration struct {
@@ -21,6 +23,12 @@ type Configuration struct {
 	// Disclosing, signing or issuance permissions that apply to all requestors
 	Permissions `mapstructure:",squash"`
 
+	// Limits on the amount of unfinished sessions that apply to each requestor
+	SessionLimits `mapstructure:",squash"`
+
+	// Limits on the rate of HTTP requests per requestor, IP address and session
+	RateLimits `mapstructure:",squash"`
+
 	// Whether or not incoming session requests should be authenticated. If false, anyone
 	// can submit session requests. If true, the request is first authenticated against the
 	// server configuration before the server accepts it.
@@ -46,10 +54,45 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// If specified, TLS certificates for these hostnames are obtained and renewed automatically
+	// using ACME (e.g. from Let's Encrypt), instead of using the TLS configuration above
+	AcmeHosts []string `json:"acme_hosts" mapstructure:"acme_hosts"`
+	// Directory in which the ACME account key and certificates are cached
+	AcmeCacheDir string `json:"acme_cache_dir" mapstructure:"acme_cache_dir"`
+	// Directory URL of the ACME certificate authority (default Let's Encrypt)
+	AcmeDirectoryURL string `json:"acme_directory_url" mapstructure:"acme_directory_url"`
+
 	// Requestor-specific permission and authentication configuration
 	RequestorsString string               `json:"-" mapstructure:"requestors"`
 	Requestors       map[string]Requestor `json:"requestors"`
 
+	// If set, reads the current requestor configuration when the requestors are reloaded using
+	// the admin API (see admin.go) or after modifications (see watch.go)
+	RequestorsLoader func() (map[string]Requestor, error) `json:"-" mapstructure:"-"`
+	// File containing the requestor configuration, if any, which is watched for modifications
+	// along with the key files of the requestors (see watch.go)
+	RequestorsFile string `json:"requestors_file" mapstructure:"requestors_file"`
+	// Seconds between checks for modifications of the RequestorsFile and the key files of the
+	// requestors, upon which the requestors are reloaded (0 = disabled)
+	RequestorsWatchInterval int `json:"requestors_watch_interval" mapstructure:"requestors_watch_interval"`
+
+	// Tenants served by the server, each having its own requestors, permissions and result JWT
+	// key, selected by the hostname or path prefix of requests (see tenants.go)
+	Tenants map[string]*Tenant `json:"tenants" mapstructure:"-"`
+
+	// Token with which the admin API under /admin is accessed, in the Authorization header
+	// (leave empty to disable the admin API)
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	// Endpoints operated by requestors from which session requests are pulled (see pull.go)
+	RequestSources []RequestSource `json:"request_sources" mapstructure:"-"`
+
+	// Session requests from which IRMA apps can start sessions by scanning static QRs (see static.go)
+	StaticSessions map[string]StaticSession `json:"static_sessions" mapstructure:"-"`
+
+	// Session requests with variables from which requestors can start sessions (see templates.go)
+	Templates map[string]SessionTemplate `json:"templates" mapstructure:"-"`
+
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
 
@@ -57,6 +100,10 @@ type Configuration struct {
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
 
+	// Claims in which disclosed attributes are included in session result JWTs of requestors
+	// without their own ResultClaims (see ResultClaims)
+	ResultClaims ResultClaims `json:"result_claims" mapstructure:"result_claims"`
+
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
 
@@ -65,10 +112,27 @@ type Configuration struct {
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
 
+	// Origins (e.g. https://example.com) of the web pages that may access the requestor endpoints
+	// from browsers, in addition to the CorsOrigins of the requestors (default: any origin)
+	RequestorCorsOrigins []string `json:"requestor_cors_origins" mapstructure:"requestor_cors_origins"`
+	// Security headers included in all responses, overriding the default ones (see
+	// defaultSecurityHeaders); headers with an empty value are left out
+	SecurityHeaders map[string]string `json:"security_headers" mapstructure:"security_headers"`
+
+	// Service manager with which to integrate, ServiceSystemd or ServiceWindows (leave empty to disable)
+	Service string `json:"service" mapstructure:"service"`
+	// Max seconds that irmad waits for unfinished sessions to finish when it is stopped
+	// (0 = stop immediately, aborting them)
+	ShutdownTimeout int `json:"shutdown_timeout" mapstructure:"shutdown_timeout"`
+
 	jwtPrivateKey *rsa.PrivateKey
+	acmeManager   *autocert.Manager
 }
 
-// Permissions specify which attributes or credential a requestor may verify or issue.
+// Permissions specify which attributes or credential a requestor may verify or issue. Each
+// permission is an attribute type (or for issuing, a credential type) identifier, or a wildcard
+// such as "*", "irma-demo.*", "irma-demo.MijnOverheid.*" or (except for issuing)
+// "irma-demo.MijnOverheid.root.*".
 type Permissions struct {
 	Disclosing []string `json:"disclose_perms" mapstructure:"disclose_perms"`
 	Signing    []string `json:"sign_perms" mapstructure:"sign_perms"`
@@ -78,11 +142,30 @@ type Permissions struct {
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
 // for a requestor.
 type Requestor struct {
-	Permissions `mapstructure:",squash"`
-
-	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
-	AuthenticationKey     string               `json:"key" mapstructure:"key"`
-	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+	Permissions   `mapstructure:",squash"`
+	SessionLimits `mapstructure:",squash"`
+	// If true, only the permissions of this requestor apply to it; otherwise the global
+	// permissions also apply to it, in addition to its own
+	ExclusivePermissions bool `json:"exclusive_perms" mapstructure:"exclusive_perms"`
+	// Claims in which disclosed attributes are included in the session result JWTs of this requestor
+	ResultClaims ResultClaims `json:"result_claims" mapstructure:"result_claims"`
+
+	AuthenticationMethod AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
+	// Key of the requestor; for the certificate authentication method, the PEM-encoded CA
+	// certificate(s) issuing the TLS client certificates of the requestor
+	AuthenticationKey     string `json:"key" mapstructure:"key"`
+	AuthenticationKeyFile string `json:"key_file" mapstructure:"key_file"`
+	// Type of the key of the publickey authentication method: rsa (default), ecdsa or ed25519
+	AuthenticationKeyType string `json:"key_type" mapstructure:"key_type"`
+	// URL of a JWKS containing the keys of the publickey authentication method, instead of a
+	// static key; the kid header of the requestor's JWTs then specifies the key to use
+	AuthenticationJWKS string `json:"jwks_url" mapstructure:"jwks_url"`
+	// Hex-encoded SHA-256 fingerprints of the TLS client certificates of the requestor, for the
+	// certificate authentication method
+	CertificateFingerprints []string `json:"cert_fingerprints" mapstructure:"cert_fingerprints"`
+	// Origins of the web pages from which this requestor may start sessions in browsers
+	// (default: any origin allowed by RequestorCorsOrigins)
+	CorsOrigins []string `json:"cors_origins" mapstructure:"cors_origins"`
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -90,7 +173,7 @@ type Requestor struct {
 // the identity provider is allowed to verify the attributes being verified; use CanVerifyOrSign
 // for that).
 func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRequest) (bool, string) {
-	permissions := append(conf.Requestors[requestor].Issuing, conf.Issuing...)
+	permissions := conf.permissions(requestor, irma.ActionIssuing)
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
@@ -113,15 +196,10 @@ func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRe
 // CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
 // in any of the supported session types.
 func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeDisjunctionList) (bool, string) {
-	var permissions []string
-	switch action {
-	case irma.ActionDisclosing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
-	case irma.ActionIssuing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
-	case irma.ActionSigning:
-		permissions = append(conf.Requestors[requestor].Signing, conf.Signing...)
+	if action == irma.ActionIssuing {
+		action = irma.ActionDisclosing // attributes disclosed in issuance sessions are verified
 	}
+	permissions := conf.permissions(requestor, action)
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
@@ -143,13 +221,54 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 	return true, ""
 }
 
+// permissions returns the permissions of the specified requestor for the specified action,
+// including the global permissions unless the requestor has exclusive permissions.
+func (conf *Configuration) permissions(requestor string, action irma.Action) []string {
+	r, _ := conf.requestor(requestor)
+	globalperms := conf.Permissions
+	if tenant, _ := conf.tenantOf(requestor); tenant != nil {
+		globalperms = tenant.Permissions
+	}
+	own, global := permissionsFor(r.Permissions, action), permissionsFor(globalperms, action)
+	if r.ExclusivePermissions {
+		return own
+	}
+	return append(append([]string{}, own...), global...)
+}
+
+// requestor returns the configuration of the specified requestor.
+func (conf *Configuration) requestor(name string) (Requestor, bool) {
+	requestorsMutex.RLock()
+	defer requestorsMutex.RUnlock()
+	if tenant, n := conf.tenantOf(name); tenant != nil {
+		r, ok := tenant.Requestors[n]
+		return r, ok
+	}
+	r, ok := conf.Requestors[name]
+	return r, ok
+}
+
+func permissionsFor(permissions Permissions, action irma.Action) []string {
+	switch action {
+	case irma.ActionDisclosing:
+		return permissions.Disclosing
+	case irma.ActionSigning:
+		return permissions.Signing
+	case irma.ActionIssuing:
+		return permissions.Issuing
+	}
+	return nil
+}
+
 func (conf *Configuration) initialize() error {
 	if err := conf.readPrivateKey(); err != nil {
 		return err
 	}
 
 	if conf.DisableRequestorAuthentication {
+		requestorsMutex.Lock()
 		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+		requestorsMutex.Unlock()
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys, err := conf.HavePrivateKeys()
 		if err != nil {
@@ -166,25 +285,42 @@ func (conf *Configuration) initialize() error {
 		if len(conf.Requestors) == 0 {
 			return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
 		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+		auths, err := conf.newAuthenticators(conf.Requestors)
+		if err != nil {
+			return err
+		}
+		requestorsMutex.Lock()
+		authenticators = auths
+		requestorsMutex.Unlock()
+	}
+	if err := conf.initializeTenants(); err != nil {
+		return err
+	}
+
+	for _, source := range conf.RequestSources {
+		if source.Requestor == "" || source.URL == "" {
+			return errors.New("Request sources must specify a requestor and a URL")
 		}
+		if conf.Production && !strings.HasPrefix(source.URL, "https://") {
+			return errors.Errorf("Request source %s must use https in production mode", source.URL)
+		}
+	}
 
-		// Initialize authenticators
-		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
-			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
-			}
-			if err := authenticator.Initialize(name, requestor); err != nil {
-				return err
-			}
+	if err := conf.validateResultClaims("Global", conf.ResultClaims, conf.jwtPrivateKey != nil); err != nil {
+		return err
+	}
+	for name, requestor := range conf.Requestors {
+		if err := conf.validateResultClaims("Requestor "+name, requestor.ResultClaims, conf.jwtPrivateKey != nil); err != nil {
+			return err
 		}
 	}
 
+	switch conf.Service {
+	case "", ServiceSystemd, ServiceWindows:
+	default:
+		return errors.Errorf("Unsupported service %s (supported: %s, %s)", conf.Service, ServiceSystemd, ServiceWindows)
+	}
+
 	if conf.Port <= 0 || conf.Port > 65535 {
 		return errors.Errorf("Port must be between 1 and 65535 (was %d)", conf.Port)
 	}
@@ -199,10 +335,16 @@ func (conf *Configuration) initialize() error {
 		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
 
+	if err := conf.initializeAcme(); err != nil {
+		return err
+	}
 	tlsConf, err := conf.tlsConfig()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read TLS configuration", 0)
 	}
+	if conf.certificateAuthentication() && tlsConf == nil {
+		return errors.New("Requestors using certificate authentication require TLS to be enabled")
+	}
 	clientTlsConf, err := conf.clientTlsConfig()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
@@ -211,6 +353,9 @@ func (conf *Configuration) initialize() error {
 	if err := conf.validatePermissions(); err != nil {
 		return err
 	}
+	if err := conf.validateTemplates(); err != nil {
+		return err
+	}
 
 	if conf.StaticPath != "" {
 		if err := fs.AssertPathExists(conf.StaticPath); err != nil {
@@ -247,6 +392,47 @@ func (conf *Configuration) initialize() error {
 		}
 	}
 
+	return conf.validateStaticSessions()
+}
+
+// newAuthenticators returns the authenticators, initialized for each of the requestors.
+func (conf *Configuration) newAuthenticators(requestors map[string]Requestor) (map[AuthenticationMethod]Authenticator, error) {
+	auths := map[AuthenticationMethod]Authenticator{
+		AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
+		AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
+		AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+		AuthenticationMethodCertificate: &CertificateAuthenticator{
+			fingerprints: map[string]string{}, roots: map[string]*x509.CertPool{},
+		},
+	}
+	for name, requestor := range requestors {
+		authenticator, ok := auths[requestor.AuthenticationMethod]
+		if !ok {
+			return nil, errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s, %s)",
+				name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac,
+				AuthenticationMethodPublicKey, AuthenticationMethodCertificate)
+		}
+		if err := authenticator.Initialize(name, requestor); err != nil {
+			return nil, err
+		}
+	}
+	return auths, nil
+}
+
+func (conf *Configuration) validateResultClaims(requestor string, claims ResultClaims, havekey bool) error {
+	if len(claims) > 0 && !havekey {
+		return errors.Errorf("%s result_claims require a JWT private key", requestor)
+	}
+	for attr, claim := range claims {
+		if conf.IrmaConfiguration.AttributeTypes[irma.NewAttributeTypeIdentifier(attr)] == nil {
+			return errors.Errorf("%s result claim of unknown attribute type %s", requestor, attr)
+		}
+		for _, name := range strings.Split(claim, ".") {
+			if name == "" {
+				return errors.Errorf("%s result claim name '%s' of %s is invalid", requestor, claim, attr)
+			}
+		}
+	}
 	return nil
 }
 
@@ -320,11 +506,46 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 }
 
 func (conf *Configuration) clientTlsConfig() (*tls.Config, error) {
+	if conf.acmeEnabled() && conf.ClientTlsCertificate == "" && conf.ClientTlsCertificateFile == "" &&
+		conf.ClientTlsPrivateKey == "" && conf.ClientTlsPrivateKeyFile == "" {
+		return conf.acmeTlsConfig(), nil
+	}
 	return conf.readTlsConf(conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)
 }
 
 func (conf *Configuration) tlsConfig() (*tls.Config, error) {
-	return conf.readTlsConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	var tlsConf *tls.Config
+	var err error
+	if conf.acmeEnabled() {
+		tlsConf = conf.acmeTlsConfig()
+	} else {
+		tlsConf, err = conf.readTlsConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	}
+	if tlsConf != nil && conf.certificateAuthentication() {
+		// Client certificates are verified by the CertificateAuthenticator instead of by the TLS
+		// stack, so that certificates that are pinned by their fingerprint need not be CA-issued
+		tlsConf.ClientAuth = tls.RequestClientCert
+	}
+	return tlsConf, err
+}
+
+// certificateAuthentication returns whether any requestor, including those of the tenants, uses
+// the certificate authentication method.
+func (conf *Configuration) certificateAuthentication() bool {
+	requestorsMutex.RLock()
+	defer requestorsMutex.RUnlock()
+	requestors := []map[string]Requestor{conf.Requestors}
+	for _, tenant := range conf.Tenants {
+		requestors = append(requestors, tenant.Requestors)
+	}
+	for _, rs := range requestors {
+		for _, requestor := range rs {
+			if requestor.AuthenticationMethod == AuthenticationMethodCertificate {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tls.Config, error) {
@@ -332,21 +553,18 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 		return nil, nil
 	}
 
-	var certbts, keybts []byte
-	var err error
-	if certbts, err = fs.ReadKey(cert, certfile); err != nil {
-		return nil, err
-	}
-	if keybts, err = fs.ReadKey(key, keyfile); err != nil {
-		return nil, err
-	}
-
-	cer, err := tls.X509KeyPair(certbts, keybts)
+	cer, err := newTlsCertificate(cert, certfile, key, keyfile, conf.Logger)
 	if err != nil {
 		return nil, err
 	}
+	return secureTlsConfig(cer.GetCertificate), nil
+}
+
+// secureTlsConfig returns a TLS configuration using the specified certificate source, allowing
+// only secure TLS versions and cipher suites.
+func secureTlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
 	return &tls.Config{
-		Certificates:             []tls.Certificate{cer},
+		GetCertificate:           getCertificate,
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		PreferServerCipherSuites: true,
@@ -358,7 +576,7 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
-	}, nil
+	}
 }
 
 func (conf *Configuration) readPrivateKey() error {
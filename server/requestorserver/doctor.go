@@ -0,0 +1,187 @@
+package requestorserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// Diagnostic is the result of a single check performed by Diagnose().
+type Diagnostic struct {
+	Check   string   `json:"check"`
+	Passed  bool     `json:"passed"`
+	Details []string `json:"details,omitempty"`
+}
+
+// Diagnostics is the report produced by Diagnose().
+type Diagnostics []*Diagnostic
+
+// MaxClockSkew is the maximum allowed difference between the local clock and
+// the clocks of scheme servers before Diagnose() reports the local clock as wrong.
+var MaxClockSkew = time.Minute
+
+// diagnosticsTimeout is the timeout of the HTTP requests made by Diagnose().
+const diagnosticsTimeout = 5 * time.Second
+
+// Passed returns whether all checks passed.
+func (d Diagnostics) Passed() bool {
+	for _, diagnostic := range d {
+		if !diagnostic.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (d Diagnostics) String() string {
+	var b bytes.Buffer
+	for _, diagnostic := range d {
+		status := "PASS"
+		if !diagnostic.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "[%s] %s\n", status, diagnostic.Check)
+		for _, detail := range diagnostic.Details {
+			fmt.Fprintf(&b, "       %s\n", detail)
+		}
+	}
+	return b.String()
+}
+
+// Diagnose checks the deployment described by the specified configuration end to end, before
+// the server is started: whether the configuration is valid, the schemes are validly signed,
+// the public keys of the issuers are not expired, the keyshare servers of the schemes can be
+// reached, the JWT private key can be read, the local clock agrees with the scheme servers,
+// and the ports to listen at are available.
+// Schemes are not updated during the checks.
+func Diagnose(conf *Configuration) Diagnostics {
+	enabled := conf.DisableSchemesUpdate
+	conf.DisableSchemesUpdate = true
+	s, err := New(conf)
+	conf.DisableSchemesUpdate = enabled
+	if err != nil {
+		return Diagnostics{{Check: "configuration", Details: []string{err.Error()}}}
+	}
+	s.irmaserv.Stop()
+
+	client := &http.Client{Timeout: diagnosticsTimeout}
+	report := conf.IrmaConfiguration.Validate()
+	return Diagnostics{
+		{Check: "configuration", Passed: true},
+		conf.diagnoseSchemes(report),
+		conf.diagnoseKeys(report),
+		conf.diagnoseKeyshareServers(client),
+		conf.diagnoseJwtKey(),
+		conf.diagnoseClock(client),
+		conf.diagnosePorts(),
+	}
+}
+
+func (conf *Configuration) diagnoseSchemes(report *irma.ValidationReport) *Diagnostic {
+	d := &Diagnostic{Check: "schemes", Passed: true}
+	for _, entry := range report.Filter(irma.SeverityError).Entries {
+		if isKeyValidation(entry.Code) {
+			continue
+		}
+		d.Passed = false
+		d.Details = append(d.Details, entry.Message)
+	}
+	return d
+}
+
+func (conf *Configuration) diagnoseKeys(report *irma.ValidationReport) *Diagnostic {
+	d := &Diagnostic{Check: "public keys", Passed: true}
+	for _, entry := range report.Filter(irma.SeverityWarning).Entries {
+		if !isKeyValidation(entry.Code) {
+			continue
+		}
+		if entry.Severity == irma.SeverityError {
+			d.Passed = false
+		}
+		d.Details = append(d.Details, entry.Message)
+	}
+	return d
+}
+
+func isKeyValidation(code irma.ValidationCode) bool {
+	return code == irma.ValidationNoPublicKeys ||
+		code == irma.ValidationNoValidPublicKeys ||
+		code == irma.ValidationPublicKeyExpiresSoon ||
+		code == irma.ValidationInvalidKeys
+}
+
+func (conf *Configuration) diagnoseKeyshareServers(client *http.Client) *Diagnostic {
+	d := &Diagnostic{Check: "keyshare servers", Passed: true}
+	for id, scheme := range conf.IrmaConfiguration.SchemeManagers {
+		if scheme.KeyshareServer == "" {
+			continue
+		}
+		res, err := client.Get(scheme.KeyshareServer)
+		if err != nil {
+			d.Passed = false
+			d.Details = append(d.Details, fmt.Sprintf("keyshare server of scheme %s unreachable: %s", id, err.Error()))
+			continue
+		}
+		_ = res.Body.Close()
+		d.Details = append(d.Details, fmt.Sprintf("keyshare server of scheme %s reachable", id))
+	}
+	return d
+}
+
+func (conf *Configuration) diagnoseJwtKey() *Diagnostic {
+	d := &Diagnostic{Check: "JWT private key", Passed: true}
+	if conf.jwtPrivateKey == nil {
+		d.Details = []string{"no JWT private key configured; /result-jwt and /getproof are disabled"}
+	}
+	return d
+}
+
+// diagnoseClock compares the local clock with the Date header returned by the scheme servers.
+func (conf *Configuration) diagnoseClock(client *http.Client) *Diagnostic {
+	d := &Diagnostic{Check: "clock", Passed: true}
+	for id, scheme := range conf.IrmaConfiguration.SchemeManagers {
+		res, err := client.Head(scheme.URL + "/timestamp")
+		if err != nil {
+			d.Details = append(d.Details, fmt.Sprintf("could not compare clock with server of scheme %s: %s", id, err.Error()))
+			continue
+		}
+		_ = res.Body.Close()
+		remote, err := http.ParseTime(res.Header.Get("Date"))
+		if err != nil {
+			continue
+		}
+		skew := time.Since(remote)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > MaxClockSkew {
+			d.Passed = false
+			d.Details = append(d.Details, fmt.Sprintf("local clock differs %s from server of scheme %s", skew.Round(time.Second), id))
+		}
+	}
+	return d
+}
+
+// diagnosePorts checks that the server can listen at the configured addresses.
+func (conf *Configuration) diagnosePorts() *Diagnostic {
+	d := &Diagnostic{Check: "ports", Passed: true}
+	addrs := []string{net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.Port))}
+	if conf.separateClientServer() {
+		addrs = append(addrs, net.JoinHostPort(conf.ClientListenAddress, strconv.Itoa(conf.ClientPort)))
+	}
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			d.Passed = false
+			d.Details = append(d.Details, fmt.Sprintf("cannot listen at %s: %s", addr, err.Error()))
+			continue
+		}
+		_ = listener.Close()
+	}
+	return d
+}
@@ -0,0 +1,146 @@
+package requestorserver
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/cors"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// This file contains the CORS handling and the security headers of the server. Browsers may
+// access two groups of endpoints, each with its own allowed origins:
+//  - the endpoints for the IRMA app, the static files, and the (unauthenticated) session status
+//    endpoints of the requestor API, which web frontends use to follow sessions: the origins in
+//    server.Configuration.CorsOrigins;
+//  - the other endpoints of the requestor API: the origins in RequestorCorsOrigins, and the
+//    CorsOrigins of the requestors. Requestors having CorsOrigins can start sessions from
+//    browsers only from those origins.
+// Each of these defaults to any origin.
+
+// defaultSecurityHeaders are included in all responses, unless overridden by SecurityHeaders.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Referrer-Policy":         "no-referrer",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+}
+
+// Included in responses over TLS, unless overridden by SecurityHeaders
+const defaultHstsHeader = "max-age=31536000"
+
+var (
+	statusEndpoint = regexp.MustCompile(`^/session/[^/]+/(status|statusevents|statusws)$`)
+	// Path prefixes of the endpoints, which take precedence over the static files
+	endpointPrefixes = []string{"/irma/", "/session", "/issuance/", "/publickey", "/admin/"}
+)
+
+func corsOptions(origins []string) cors.Options {
+	options := cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Cache-Control"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+	}
+	if len(origins) > 0 {
+		options.AllowedOrigins = origins
+	}
+	return options
+}
+
+// requestorCorsOrigins returns the origins that may access the requestor endpoints.
+func (conf *Configuration) requestorCorsOrigins() []string {
+	if len(conf.RequestorCorsOrigins) == 0 {
+		return nil
+	}
+	requestorsMutex.RLock()
+	defer requestorsMutex.RUnlock()
+	origins := append([]string{}, conf.RequestorCorsOrigins...)
+	for _, requestor := range conf.Requestors {
+		origins = append(origins, requestor.CorsOrigins...)
+	}
+	for _, tenant := range conf.Tenants {
+		for _, requestor := range tenant.Requestors {
+			origins = append(origins, requestor.CorsOrigins...)
+		}
+	}
+	return origins
+}
+
+// staticFile returns whether the path is that of a static file hosted by the server.
+func (conf *Configuration) staticFile(path string) bool {
+	if conf.StaticPath == "" || !strings.HasPrefix(path, conf.StaticPrefix) {
+		return false
+	}
+	for _, prefix := range endpointPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsMiddleware handles CORS for the endpoints of both the requestor and the IRMA app.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	client := cors.New(corsOptions(s.conf.CorsOrigins)).Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/irma/") || statusEndpoint.MatchString(r.URL.Path) ||
+			s.conf.staticFile(r.URL.Path) {
+			client.ServeHTTP(w, r)
+		} else {
+			// The origins of the requestors may change when the requestors are reloaded
+			cors.New(corsOptions(s.conf.requestorCorsOrigins())).Handler(next).ServeHTTP(w, r)
+		}
+	})
+}
+
+// clientCorsMiddleware handles CORS for the endpoints of the IRMA app.
+func (s *Server) clientCorsMiddleware(next http.Handler) http.Handler {
+	return cors.New(corsOptions(s.conf.CorsOrigins)).Handler(next)
+}
+
+// requestorOriginAllowed checks that the requestor may start sessions from the origin of the
+// request, if it was sent by a browser. If not, it writes an error response and returns false.
+func (s *Server) requestorOriginAllowed(w http.ResponseWriter, r *http.Request, requestor string) bool {
+	origin := r.Header.Get("Origin")
+	rq, _ := s.conf.requestor(requestor)
+	if origin == "" || server.OriginAllowed(rq.CorsOrigins, origin) {
+		return true
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "origin": origin}).
+		Warn("Requestor not allowed to start sessions from origin")
+	server.WriteError(w, server.ErrorUnauthorized, "origin not allowed")
+	return false
+}
+
+// securityHeadersMiddleware includes the security headers in all responses.
+func (s *Server) securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		for name, value := range defaultSecurityHeaders {
+			// The static files may be web pages, which the default policy would break
+			if name == "Content-Security-Policy" && s.conf.staticFile(r.URL.Path) {
+				continue
+			}
+			header.Set(name, value)
+		}
+		if r.TLS != nil {
+			header.Set("Strict-Transport-Security", defaultHstsHeader)
+		}
+		for name, value := range s.conf.SecurityHeaders {
+			if value == "" {
+				header.Del(name)
+			} else {
+				header.Set(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// webSocketOriginAllowed checks the origin of WebSocket connections to the session status.
+func (s *Server) webSocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || s.conf.CorsOriginAllowed(origin)
+}
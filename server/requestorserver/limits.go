@@ -0,0 +1,128 @@
+package requestorserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// SessionLimits restrict the amount of unfinished sessions that a requestor may have at any
+// moment, so that a single (misbehaving) requestor cannot exhaust the session store of a
+// server shared with other requestors. The limits of a requestor override the global limits.
+type SessionLimits struct {
+	// Maximum amount of unfinished sessions of a requestor (0 = unlimited)
+	MaxSessions int `json:"max_sessions" mapstructure:"max_sessions"`
+	// If nonzero, a session request exceeding MaxSessions waits at most this many seconds for
+	// another session of the requestor to finish before being refused, instead of being refused
+	// immediately
+	QueueTimeout int `json:"queue_timeout" mapstructure:"queue_timeout"`
+}
+
+const (
+	// Interval at which queued session requests check if other sessions have finished
+	sessionQueuePollInterval = 250 * time.Millisecond
+	// Value of the Retry-After header of responses refusing a session request because of MaxSessions
+	sessionLimitRetryAfter = 10
+)
+
+// sessionLimits returns the limits applying to the specified requestor.
+func (conf *Configuration) sessionLimits(requestor string) SessionLimits {
+	limits := conf.SessionLimits
+	if r, ok := conf.requestor(requestor); ok {
+		if r.MaxSessions != 0 {
+			limits.MaxSessions = r.MaxSessions
+		}
+		if r.QueueTimeout != 0 {
+			limits.QueueTimeout = r.QueueTimeout
+		}
+	}
+	return limits
+}
+
+// sessionLimiter keeps track of the unfinished sessions of each requestor. As sessions may end
+// in several ways (including timeouts) without notifying the requestor server, the sessions of a
+// requestor are checked for being finished whenever the amount of sessions of the requestor
+// is needed.
+type sessionLimiter struct {
+	mutex    sync.Mutex
+	sessions map[string]map[string]struct{} // session tokens per requestor
+	pending  map[string]int                 // sessions per requestor that are being started
+	finished func(token string) bool
+}
+
+func newSessionLimiter(finished func(token string) bool) *sessionLimiter {
+	return &sessionLimiter{
+		sessions: map[string]map[string]struct{}{},
+		pending:  map[string]int{},
+		finished: finished,
+	}
+}
+
+// acquire reserves a session for the requestor if this does not exceed the limits, waiting at
+// most the queue timeout of the limits for a session of the requestor to finish. If it succeeds,
+// the returned function must be called with the token of the started session, or with an empty
+// token if starting the session failed.
+func (l *sessionLimiter) acquire(requestor string, limits SessionLimits) (func(token string), bool) {
+	if limits.MaxSessions <= 0 {
+		return func(string) {}, true
+	}
+	deadline := time.Now().Add(time.Duration(limits.QueueTimeout) * time.Second)
+	for !l.tryAcquire(requestor, limits.MaxSessions) {
+		if !time.Now().Before(deadline) {
+			return nil, false
+		}
+		time.Sleep(sessionQueuePollInterval)
+	}
+	return func(token string) { l.started(requestor, token) }, true
+}
+
+func (l *sessionLimiter) tryAcquire(requestor string, max int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for token := range l.sessions[requestor] {
+		if l.finished(token) {
+			delete(l.sessions[requestor], token)
+		}
+	}
+	if len(l.sessions[requestor])+l.pending[requestor] >= max {
+		return false
+	}
+	l.pending[requestor]++
+	return true
+}
+
+// started turns a session reserved by acquire() into the session with the specified token,
+// or releases it if the token is empty.
+func (l *sessionLimiter) started(requestor, token string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.pending[requestor]--; l.pending[requestor] <= 0 {
+		delete(l.pending, requestor)
+	}
+	if token == "" {
+		return
+	}
+	if l.sessions[requestor] == nil {
+		l.sessions[requestor] = map[string]struct{}{}
+	}
+	l.sessions[requestor][token] = struct{}{}
+}
+
+// sessionFinished returns whether the session with the specified token is finished or no
+// longer exists.
+func (s *Server) sessionFinished(token string) bool {
+	res := s.irmaserv.GetSessionResult(token)
+	return res == nil || res.Status.Finished()
+}
+
+// sessionExists returns whether the session with the specified token exists.
+func (s *Server) sessionExists(token string) bool {
+	return s.irmaserv.GetSessionResult(token) != nil
+}
+
+// sessionLimitError returns the error with which session requests exceeding the limits are refused.
+func sessionLimitError(requestor string) *irma.RemoteError {
+	return server.RemoteError(server.ErrorTooManySessions, "requestor "+requestor+" has too many unfinished sessions")
+}
@@ -0,0 +1,171 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Requestors whose backend cannot accept inbound connections cannot POST session requests to
+// this server, but they can have this server pull session requests from an endpoint that they
+// operate, a RequestSource. For each request source, the server repeatedly long-polls
+//   GET <url>/next?timeout=<seconds>
+// sending the token of the request source in the Authorization header. The endpoint responds
+// with 204 No Content if no session request became available within the timeout, and otherwise
+// with a PulledSessionRequest. The session request is checked against the permissions of the
+// requestor of the request source, after which the session is started and its session package
+// (or the error that prevented the session from starting) is POSTed to
+//   <url>/<id>/session
+// so that the requestor can show the QR to its user. When the session finishes, its result is
+// POSTed to
+//   <url>/<id>/result
+
+// RequestSource is an endpoint operated by a requestor from which session requests are pulled.
+type RequestSource struct {
+	// Requestor whose permissions apply to the session requests
+	Requestor string `json:"requestor" mapstructure:"requestor"`
+	// URL of the endpoint
+	URL string `json:"url" mapstructure:"url"`
+	// Token with which the server authenticates itself to the endpoint
+	AuthenticationToken string `json:"token" mapstructure:"token"`
+	// Maximum amount of seconds that the endpoint may hold a poll (default 60)
+	PollTimeout int `json:"poll_timeout" mapstructure:"poll_timeout"`
+}
+
+// PulledSessionRequest is a session request pulled from a RequestSource.
+type PulledSessionRequest struct {
+	// Identifies the session request at the request source
+	ID      string          `json:"id"`
+	Request json.RawMessage `json:"request"`
+}
+
+const (
+	defaultPollTimeout = 60 * time.Second
+	pullMinBackoff     = time.Second
+	pullMaxBackoff     = 5 * time.Minute
+)
+
+func (source RequestSource) pollTimeout() time.Duration {
+	if source.PollTimeout <= 0 {
+		return defaultPollTimeout
+	}
+	return time.Duration(source.PollTimeout) * time.Second
+}
+
+// startPulling starts pulling session requests from each request source, until stopPulling()
+// is called. Polls that are running at that moment finish in the background.
+func (s *Server) startPulling() {
+	s.pullStop = make(chan struct{})
+	for _, source := range s.conf.RequestSources {
+		go s.pull(source, s.pullStop)
+	}
+}
+
+func (s *Server) stopPulling() {
+	s.pullStopOnce.Do(func() {
+		if s.pullStop != nil {
+			close(s.pullStop)
+		}
+	})
+}
+
+func (s *Server) pull(source RequestSource, stop <-chan struct{}) {
+	logger := s.conf.Logger.WithFields(logrus.Fields{"requestor": source.Requestor, "source": source.URL})
+	logger.Info("Pulling session requests")
+
+	transport := irma.NewHTTPTransport(source.URL)
+	transport.SetHeader("Authorization", source.AuthenticationToken)
+	timeout := source.pollTimeout()
+	transport.SetTimeout(timeout + 10*time.Second)
+	backoff := pullMinBackoff
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		pulled := &PulledSessionRequest{}
+		err := transport.Get(fmt.Sprintf("next?timeout=%d", int(timeout/time.Second)), pulled)
+		if serr, ok := err.(*irma.SessionError); ok && serr.RemoteStatus == http.StatusNoContent {
+			backoff = pullMinBackoff
+			continue
+		}
+		if err != nil {
+			logger.Warnf("Failed to pull session request, retrying in %s: %s", backoff, err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > pullMaxBackoff {
+				backoff = pullMaxBackoff
+			}
+			continue
+		}
+
+		backoff = pullMinBackoff
+		s.startPulledSession(source, transport, pulled)
+	}
+}
+
+// startPulledSession starts a session for the pulled session request, and posts the session
+// package or error back to the request source.
+func (s *Server) startPulledSession(source RequestSource, transport *irma.HTTPTransport, pulled *PulledSessionRequest) {
+	logger := s.conf.Logger.WithFields(logrus.Fields{"requestor": source.Requestor, "id": pulled.ID})
+	path := url.PathEscape(pulled.ID)
+
+	var response interface{}
+	pkg, rerr := s.startPulledSessionRequest(source, transport, path, pulled)
+	if rerr != nil {
+		response = rerr
+	} else {
+		response = pkg
+		logger.WithField("session", pkg.Token).Info("Started session for pulled session request")
+	}
+
+	var x string // dummy for the request source's return value that we don't care about
+	if err := transport.Post(path+"/session", &x, response); err != nil {
+		logger.Warn("Failed to POST session package to request source: ", err.Error())
+	}
+}
+
+func (s *Server) startPulledSessionRequest(
+	source RequestSource, transport *irma.HTTPTransport, path string, pulled *PulledSessionRequest,
+) (*server.SessionPackage, *irma.RemoteError) {
+	rrequest, err := server.ParseSessionRequest([]byte(pulled.Request))
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	if rerr := s.authorize(source.Requestor, rrequest.SessionRequest()); rerr != nil {
+		return nil, rerr
+	}
+	if rrequest.Base().CallbackUrl != "" && !s.callbackSupported(source.Requestor) {
+		return nil, server.RemoteError(server.ErrorUnsupported, "")
+	}
+
+	started, ok := s.limiter.acquire(source.Requestor, s.conf.sessionLimits(source.Requestor))
+	if !ok {
+		return nil, sessionLimitError(source.Requestor)
+	}
+	qr, token, err := s.irmaserv.StartSession(rrequest, func(result *server.SessionResult) {
+		var x string
+		if err := transport.Post(path+"/result", &x, result); err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"requestor": source.Requestor, "id": pulled.ID}).
+				Warn("Failed to POST session result to request source: ", err.Error())
+		}
+	})
+	started(token)
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	s.sessionRequestors.set(token, source.Requestor)
+	return &server.SessionPackage{SessionPtr: qr, Token: token}, nil
+}
@@ -0,0 +1,146 @@
+package requestorserver
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimits restrict the rate at which HTTP requests are handled, so that a server exposed to the
+// internet cannot be flooded by a single party. Each limit is enforced using a token bucket per
+// key (requestor, IP address or session): the bucket holds at most RateBurst tokens, is refilled
+// at the rate of the limit, and each request takes one token. Requests for which no token is
+// available are refused with 429 Too Many Requests and a Retry-After header.
+type RateLimits struct {
+	// Requests per second that each requestor may make to endpoints that require requestor
+	// authentication (0 = unlimited)
+	RequestorRate float64 `json:"requestor_rate" mapstructure:"requestor_rate"`
+	// Requests per second that each IP address may make to any endpoint (0 = unlimited)
+	IPRate float64 `json:"ip_rate" mapstructure:"ip_rate"`
+	// Requests per second that may be made to the endpoints of each session, i.e. those under
+	// /session/{token} (0 = unlimited)
+	SessionRate float64 `json:"session_rate" mapstructure:"session_rate"`
+	// Amount of requests that may be made at once (default: twice the rate, at least 1)
+	RateBurst int `json:"rate_burst" mapstructure:"rate_burst"`
+
+	// If set, this decides whether requests may proceed instead of the builtin token buckets,
+	// e.g. so that the limits can be shared between the instances of a load balanced server
+	RateLimiter RateLimiter `json:"-" mapstructure:"-"`
+}
+
+// RateLimiter decides whether requests may proceed.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of the specified key (e.g. "ip:192.0.2.1"), refilled at
+	// the specified amount of tokens per second and holding at most burst tokens. If the bucket is
+	// empty, it returns false and the time after which the request may be retried.
+	Allow(key string, rate float64, burst int) (bool, time.Duration)
+}
+
+// Interval at which buckets that have been refilled completely are removed
+const rateLimitPruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// tokenBucketLimiter is the builtin RateLimiter, keeping its buckets in memory.
+type tokenBucketLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+func newTokenBucketLimiter() *tokenBucketLimiter {
+	return &tokenBucketLimiter{buckets: map[string]*tokenBucket{}, pruned: time.Now()}
+}
+
+func (l *tokenBucketLimiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) > rateLimitPruneInterval {
+		l.prune(now, rate, burst)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune removes the buckets that would have been refilled completely by now.
+func (l *tokenBucketLimiter) prune(now time.Time, rate float64, burst int) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+func (limits RateLimits) burst(rate float64) int {
+	if limits.RateBurst > 0 {
+		return limits.RateBurst
+	}
+	return int(math.Max(1, 2*rate))
+}
+
+// allow checks the limit of the specified rate for the specified key. If the request may not
+// proceed, it writes an error response and returns false.
+func (s *Server) allow(w http.ResponseWriter, key string, rate float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	ok, retry := s.rateLimiter.Allow(key, rate, s.conf.RateLimits.burst(rate))
+	if ok {
+		return true
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"key": key}).Warn("Rate limit exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	server.WriteError(w, server.ErrorTooManyRequests, "")
+	return false
+}
+
+// rateLimitMiddleware enforces the limits per IP address and per session.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if !s.allow(w, "ip:"+ip, s.conf.IPRate) {
+			return
+		}
+		if token := sessionToken(r.URL.Path); token != "" && !s.allow(w, "session:"+token, s.conf.SessionRate) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionToken returns the session token in paths of the form /session/{token}/...,
+// or "" if the path has no session token.
+func sessionToken(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "session" || parts[1] == "template" {
+		return ""
+	}
+	return parts[1]
+}
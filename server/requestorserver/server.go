@@ -6,21 +6,24 @@ package requestorserver
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
-	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/go-chi/cors"
 	"github.com/go-errors/errors"
+	"github.com/gorilla/websocket"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
@@ -33,6 +36,16 @@ type Server struct {
 	irmaserv *irmaserver.Server
 	stop     chan struct{}
 	stopped  chan struct{}
+
+	pullStop     chan struct{}
+	pullStopOnce sync.Once
+
+	watchStop     chan struct{}
+	watchStopOnce sync.Once
+
+	limiter           *sessionLimiter
+	rateLimiter       RateLimiter
+	sessionRequestors *sessionRequestors
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
@@ -52,25 +65,30 @@ func (s *Server) Start(config *Configuration) error {
 	// - any unexpected error is dealt with here instead of when stopping using Stop().
 	// Inspired by https://dave.cheney.net/practical-go/presentations/qcon-china.html#_never_start_a_goroutine_without_when_it_will_stop
 
-	count := 1
-	if s.conf.separateClientServer() {
-		count = 2
+	listeners, err := s.listeners()
+	if err != nil {
+		return err
 	}
+	count := len(listeners)
 	done := make(chan error, count)
 	s.stop = make(chan struct{})
 	s.stopped = make(chan struct{}, count)
 
 	if s.conf.separateClientServer() {
 		go func() {
-			done <- s.startClientServer()
+			done <- s.startClientServer(listeners[1])
 		}()
 	}
 	go func() {
-		done <- s.startRequestorServer()
+		done <- s.startRequestorServer(listeners[0])
 	}()
+	s.startPulling()
+	defer s.stopPulling()
+	s.startWatching()
+	defer s.stopWatching()
+	s.notify("READY=1")
 
 	var stopped bool
-	var err error
 	for i := 0; i < cap(done); i++ {
 		if err = <-done; err != nil {
 			_ = server.LogError(err)
@@ -84,22 +102,20 @@ func (s *Server) Start(config *Configuration) error {
 	return err
 }
 
-func (s *Server) startRequestorServer() error {
+func (s *Server) startRequestorServer(listener net.Listener) error {
 	tlsConf, _ := s.conf.tlsConfig()
-	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, tlsConf)
+	return s.startServer(s.Handler(), "Server", listener, tlsConf)
 }
 
-func (s *Server) startClientServer() error {
+func (s *Server) startClientServer(listener net.Listener) error {
 	tlsConf, _ := s.conf.clientTlsConfig()
-	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
+	return s.startServer(s.ClientHandler(), "Client server", listener, tlsConf)
 }
 
-func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
-	fulladdr := fmt.Sprintf("%s:%d", addr, port)
-	s.conf.Logger.Info(name, " listening at ", fulladdr)
+func (s *Server) startServer(handler http.Handler, name string, listener net.Listener, tlsConf *tls.Config) error {
+	s.conf.Logger.Info(name, " listening at ", listener.Addr().String())
 
 	serv := &http.Server{
-		Addr:      fulladdr,
 		Handler:   handler,
 		TLSConfig: tlsConf,
 	}
@@ -118,9 +134,9 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 		// Disable HTTP/2 (see package documentation of http): it breaks server side events :(
 		serv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 		s.conf.Logger.Info(name, " TLS enabled")
-		return filterStopError(serv.ListenAndServeTLS("", ""))
+		return filterStopError(serv.ServeTLS(listener, "", ""))
 	} else {
-		return filterStopError(serv.ListenAndServe())
+		return filterStopError(serv.Serve(listener))
 	}
 }
 
@@ -131,8 +147,29 @@ func filterStopError(err error) error {
 	return err
 }
 
+// Stop the server immediately, aborting unfinished sessions. See also Shutdown().
 func (s *Server) Stop() {
+	s.notify("STOPPING=1")
+	s.stopPulling()
 	s.irmaserv.Stop()
+	s.stopServers()
+}
+
+// Shutdown stops the server gracefully: it stops pulling session requests and refuses new
+// sessions, while it keeps serving unfinished sessions until they have finished and their results
+// have been POSTed to their callback URLs. Then the server is stopped. If the context is done
+// before all sessions have finished, the server is stopped anyway and the error of the context
+// is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.notify("STOPPING=1")
+	s.stopPulling()
+	err := s.irmaserv.Shutdown(ctx)
+	s.stopServers()
+	return err
+}
+
+// stopServers stops the HTTP servers started by Start().
+func (s *Server) stopServers() {
 	s.stop <- struct{}{}
 	<-s.stopped
 	if s.conf.separateClientServer() {
@@ -148,23 +185,33 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
+	s := &Server{
 		conf:     config,
 		irmaserv: irmaserv,
-	}, nil
-}
-
-var corsOptions = cors.Options{
-	AllowedOrigins: []string{"*"},
-	AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Cache-Control"},
-	AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+	}
+	if config.jwtEnabled() {
+		// Session results are POSTed to callback URLs as JWTs
+		config.ResultJwtSigner = s.resultJwt
+	}
+	// Next sessions of chained sessions are subject to the permissions of the requestor
+	config.NextSessionStarter = s.startNextSession
+	s.limiter = newSessionLimiter(s.sessionFinished)
+	s.sessionRequestors = newSessionRequestors(s.sessionExists)
+	if s.rateLimiter = config.RateLimiter; s.rateLimiter == nil {
+		s.rateLimiter = newTokenBucketLimiter()
+	}
+	return s, nil
 }
 
 func (s *Server) ClientHandler() http.Handler {
 	router := chi.NewRouter()
-	router.Use(cors.New(corsOptions).Handler)
+	router.Use(server.RecoverMiddleware)
+	router.Use(s.securityHeadersMiddleware)
+	router.Use(s.clientCorsMiddleware)
+	router.Use(s.rateLimitMiddleware)
 
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
+	router.Post("/irma/session/{name}", s.handleStaticSession)
 	if s.conf.StaticPath != "" {
 		router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
 	}
@@ -176,11 +223,18 @@ func (s *Server) ClientHandler() http.Handler {
 // and IRMA client messages.
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
-	router.Use(cors.New(corsOptions).Handler)
+	router.Use(server.RecoverMiddleware)
+	if len(s.conf.Tenants) > 0 {
+		router.Use(s.tenantMiddleware)
+	}
+	router.Use(s.securityHeadersMiddleware)
+	router.Use(s.corsMiddleware)
+	router.Use(s.rateLimitMiddleware)
 
 	if !s.conf.separateClientServer() {
 		// Mount server for irmaclient
 		router.Mount("/irma/", s.irmaserv.HandlerFunc())
+		router.Post("/irma/session/{name}", s.handleStaticSession)
 		if s.conf.StaticPath != "" {
 			router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
 		}
@@ -188,10 +242,15 @@ func (s *Server) Handler() http.Handler {
 
 	// Server routes
 	router.Post("/session", s.handleCreate)
+	router.Post("/session/template/{template}", s.handleTemplateSession)
+	router.Post("/issuance/preview", s.handleIssuancePreview)
+	router.Post("/issuance/validate", s.handleIssuanceValidation)
 	router.Delete("/session/{token}", s.handleDelete)
 	router.Get("/session/{token}/status", s.handleStatus)
 	router.Get("/session/{token}/statusevents", s.handleStatusEvents)
+	router.Get("/session/{token}/statusws", s.handleStatusWebSocket)
 	router.Get("/session/{token}/result", s.handleResult)
+	router.Post("/session/{token}/sandbox", s.handleSandbox)
 
 	// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 	router.Get("/session/{token}/result-jwt", s.handleJwtResult)
@@ -199,6 +258,10 @@ func (s *Server) Handler() http.Handler {
 
 	router.Get("/publickey", s.handlePublicKey)
 
+	if s.conf.AdminToken != "" {
+		router.Mount("/admin", s.adminHandler())
+	}
+
 	return router
 }
 
@@ -218,12 +281,109 @@ func (s *Server) StaticFilesHandler() http.Handler {
 }
 
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+	rrequest, requestor, ok := s.authorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	s.startSession(w, rrequest, requestor)
+}
+
+// startSession starts a session for the authenticated and authorized session request of the
+// requestor, and writes its session package.
+func (s *Server) startSession(w http.ResponseWriter, rrequest irma.RequestorRequest, requestor string) {
+	if rrequest.Base().CallbackUrl != "" && !s.callbackSupported(requestor) {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key or callback HMAC key is installed")
+		server.WriteError(w, server.ErrorUnsupported, "")
+		return
+	}
+
+	// Everything is authenticated and parsed; check that the requestor may start another session,
+	// possibly waiting for one of its other sessions to finish
+	started, ok := s.limiter.acquire(requestor, s.conf.sessionLimits(requestor))
+	if !ok {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor has too many unfinished sessions")
+		w.Header().Set("Retry-After", strconv.Itoa(sessionLimitRetryAfter))
+		server.WriteResponse(w, nil, sessionLimitError(requestor))
+		return
+	}
+
+	qr, token, err := s.irmaserv.StartSession(rrequest, nil)
+	started(token)
+	if err != nil && s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	s.sessionRequestors.set(token, requestor)
+
+	server.WriteJson(w, server.SessionPackage{
+		SessionPtr: qr,
+		Token:      token,
+	})
+}
+
+// startNextSession starts the next session of a chained session (see
+// irma.RequestorBaseRequest.NextSessionUrl) on behalf of the requestor of the previous session.
+func (s *Server) startNextSession(token string, rrequest irma.RequestorRequest) (*irma.Qr, string, error) {
+	requestor, _ := s.sessionRequestors.get(token)
+	if rerr := s.authorize(requestor, rrequest.SessionRequest()); rerr != nil {
+		return nil, "", rerr
+	}
+	qr, next, err := s.irmaserv.StartSession(rrequest, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	s.sessionRequestors.set(next, requestor)
+	return qr, next, nil
+}
+
+// handleIssuancePreview validates the posted issuance request in the same way as when starting
+// a session, and returns the credentials that would be issued, without starting a session.
+func (s *Server) handleIssuancePreview(w http.ResponseWriter, r *http.Request) {
+	rrequest, _, ok := s.authorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	creds, err := s.irmaserv.PreviewIssuance(rrequest)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	server.WriteJson(w, creds)
+}
+
+// handleIssuanceValidation checks the posted issuance request against the current configuration
+// without starting a session, and returns all problems found, or an empty list if it can be issued.
+func (s *Server) handleIssuanceValidation(w http.ResponseWriter, r *http.Request) {
+	rrequest, _, ok := s.authorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	problems, err := s.irmaserv.ValidateIssuance(rrequest)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	server.WriteJson(w, problems)
+}
+
+// authorizeRequest reads the session request from the HTTP POST body, and checks that its
+// requestor is authenticated and allowed to perform the request. If not, it writes an error
+// response and returns false.
+func (s *Server) authorizeRequest(w http.ResponseWriter, r *http.Request) (irma.RequestorRequest, string, bool) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		s.conf.Logger.Error("Could not read session request HTTP POST body")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
-		return
+		return nil, "", false
 	}
 
 	// Authenticate request: check if the requestor is known and allowed to submit requests.
@@ -231,13 +391,16 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	// one of them is applicable and able to authenticate the request.
 	var (
 		rrequest  irma.RequestorRequest
-		request   irma.SessionRequest
 		requestor string
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
-		applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
+	for _, authenticator := range s.conf.requestAuthenticators(r) { // rrequest abbreviates "requestor request"
+		if cauth, ok := authenticator.(ConnectionAuthenticator); ok {
+			applies, rrequest, requestor, rerr = cauth.AuthenticateConnection(r.TLS, r.Header, body)
+		} else {
+			applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
+		}
 		if applies || rerr != nil {
 			break
 		}
@@ -245,25 +408,45 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	if rerr != nil {
 		_ = server.LogError(rerr)
 		server.WriteResponse(w, nil, rerr)
-		return
+		return nil, "", false
 	}
 	if !applies {
 		s.conf.Logger.Warnf("Session request uses unknown authentication method, HTTP headers: %s, HTTP POST body: %s",
 			server.ToJson(r.Header), string(body))
 		server.WriteError(w, server.ErrorInvalidRequest, "Request could not be authorized")
-		return
+		return nil, "", false
 	}
+	requestor = tenantRequestor(requestTenant(r), requestor)
 
-	// Authorize request: check if the requestor is allowed to verify or issue
-	// the requested attributes or credentials
-	request = rrequest.SessionRequest()
+	if !s.allow(w, "requestor:"+requestor, s.conf.RequestorRate) {
+		return nil, "", false
+	}
+	if !s.requestorOriginAllowed(w, r, requestor) {
+		return nil, "", false
+	}
+	if rerr = s.authorize(requestor, rrequest.SessionRequest()); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return nil, "", false
+	}
+	return rrequest, requestor, true
+}
+
+// authorize checks if the requestor is allowed to verify or issue the requested attributes
+// or credentials.
+func (s *Server) authorize(requestor string, request irma.SessionRequest) *irma.RemoteError {
+	if tenant, _ := s.conf.tenantOf(requestor); tenant != nil {
+		if allowed, reason := tenant.schemesAllowed(request); !allowed {
+			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+				Warn("Issuer not available to the tenant of the requestor; full request: ", server.ToJson(request))
+			return server.RemoteError(server.ErrorUnauthorized, reason)
+		}
+	}
 	if request.Action() == irma.ActionIssuing {
 		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
 		if !allowed {
 			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
 				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
+			return server.RemoteError(server.ErrorUnauthorized, reason)
 		}
 	}
 	disjunctions := request.ToDisclose()
@@ -272,27 +455,10 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 		if !allowed {
 			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
 				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
+			return server.RemoteError(server.ErrorUnauthorized, reason)
 		}
 	}
-	if rrequest.Base().CallbackUrl != "" && s.conf.jwtPrivateKey == nil {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key is installed")
-		server.WriteError(w, server.ErrorUnsupported, "")
-		return
-	}
-
-	// Everything is authenticated and parsed, we're good to go!
-	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
-	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
-		return
-	}
-
-	server.WriteJson(w, server.SessionPackage{
-		SessionPtr: qr,
-		Token:      token,
-	})
+	return nil
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -316,6 +482,52 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleStatusWebSocket(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if s.irmaserv.GetSessionResult(token) == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	// The status endpoints are not authenticated (knowing the session token suffices), so we
+	// accept WebSocket connections from the same origins as the CORS middleware
+	upgrader := websocket.Upgrader{CheckOrigin: s.webSocketOriginAllowed}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade() already responded with an error
+	}
+	defer conn.Close()
+	s.conf.Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to status websocket")
+
+	// Read (and discard) incoming messages, so that we notice when the client closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	statuses := s.irmaserv.SubscribeStatus(token)
+	for {
+		select {
+		case status, ok := <-statuses:
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			// We send JSON like the other APIs
+			if err = conn.WriteJSON(status); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	err := s.irmaserv.CancelSession(chi.URLParam(r, "token"))
 	if err != nil {
@@ -332,14 +544,23 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, res)
 }
 
+func (s *Server) handleSandbox(w http.ResponseWriter, r *http.Request) {
+	res, rerr := s.irmaserv.CompleteSandboxSession(chi.URLParam(r, "token"))
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	server.WriteJson(w, res)
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	sessiontoken := chi.URLParam(r, "token")
+	if key, _ := s.sessionJwtKey(sessiontoken); key == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
-	sessiontoken := chi.URLParam(r, "token")
 	res := s.irmaserv.GetSessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
@@ -357,13 +578,14 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	sessiontoken := chi.URLParam(r, "token")
+	key, issuer := s.sessionJwtKey(sessiontoken)
+	if key == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
-	sessiontoken := chi.URLParam(r, "token")
 	res := s.irmaserv.GetSessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
@@ -385,8 +607,8 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	claims["iat"] = time.Now().Unix()
-	if s.conf.JwtIssuer != "" {
-		claims["iss"] = s.conf.JwtIssuer
+	if issuer != "" {
+		claims["iss"] = issuer
 	}
 	claims["status"] = res.ProofStatus
 	validity := s.irmaserv.GetRequest(sessiontoken).Base().ResultJwtValidity
@@ -406,7 +628,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 
 	// Sign the jwt and return it
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.jwtPrivateKey)
+	resultJwt, err := token.SignedString(key)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
@@ -417,12 +639,16 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	key := s.conf.jwtPrivateKey
+	if tenant := requestTenant(r); tenant != "" {
+		key = s.conf.Tenants[tenant].jwtPrivateKey
+	}
+	if key == nil {
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.jwtPrivateKey.PublicKey)
+	bts, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -435,12 +661,19 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error) {
+	key, issuer := s.sessionJwtKey(sessionresult.Token)
+	if key == nil {
+		return "", errors.New("no JWT private key configured for the requestor of the session")
+	}
+	if mapping := s.resultClaims(sessionresult.Token); len(mapping) > 0 {
+		return s.mappedResultJwt(sessionresult, mapping, key, issuer)
+	}
 	claims := struct {
 		jwt.StandardClaims
 		*server.SessionResult
 	}{
 		StandardClaims: jwt.StandardClaims{
-			Issuer:   s.conf.JwtIssuer,
+			Issuer:   issuer,
 			IssuedAt: time.Now().Unix(),
 			Subject:  string(sessionresult.Type) + "_result",
 		},
@@ -453,25 +686,39 @@ func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error)
 
 	// Sign the jwt and return it
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(s.conf.jwtPrivateKey)
+	return token.SignedString(key)
 }
 
-func (s *Server) doResultCallback(result *server.SessionResult) {
-	callbackUrl := s.irmaserv.GetRequest(result.Token).Base().CallbackUrl
-	if callbackUrl == "" || s.conf.jwtPrivateKey == nil {
-		return
+// mappedResultJwt returns a JWT containing the session result in the claims of the mapping.
+func (s *Server) mappedResultJwt(
+	sessionresult *server.SessionResult, mapping ResultClaims, key *rsa.PrivateKey, issuer string,
+) (string, error) {
+	claims := mappedResultClaims(sessionresult, mapping)
+	if issuer != "" {
+		claims["iss"] = issuer
 	}
-	s.conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl}).Debug("POSTing session result")
-
-	j, err := s.resultJwt(result)
-	if err != nil {
-		_ = server.LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
-		return
+	claims["iat"] = time.Now().Unix()
+	claims["sub"] = string(sessionresult.Type) + "_result"
+	validity := s.irmaserv.GetRequest(sessionresult.Token).Base().ResultJwtValidity
+	if validity != 0 {
+		claims["exp"] = time.Now().Unix() + int64(validity)
 	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+}
+
+// sessionJwtKey returns the private key with which the result JWTs of the session are signed,
+// and the issuer of these JWTs.
+func (s *Server) sessionJwtKey(token string) (*rsa.PrivateKey, string) {
+	requestor, _ := s.sessionRequestors.get(token)
+	return s.conf.jwtKey(requestor)
+}
 
-	var x string // dummy for the server's return value that we don't care about
-	if err := irma.NewHTTPTransport(callbackUrl).Post("", &x, j); err != nil {
-		// not our problem, log it and go on
-		s.conf.Logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+// callbackSupported returns whether the session results of the requestor can be POSTed to
+// callback URLs, either as a JWT or using HMAC.
+func (s *Server) callbackSupported(requestor string) bool {
+	if key, _ := s.conf.jwtKey(requestor); key != nil {
+		return true
 	}
+	// If result JWTs are enabled, callbacks are not signed using HMAC
+	return !s.conf.jwtEnabled() && s.conf.CallbackHmacKey != ""
 }
@@ -0,0 +1,71 @@
+package requestorserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Service managers with which the server can integrate (see Configuration.Service).
+const (
+	// ServiceSystemd: listen at the sockets passed by systemd socket activation if any (the
+	// first for the requestor server, the second for the client server if enabled), and notify
+	// systemd when the server is ready and when it is stopping.
+	ServiceSystemd = "systemd"
+	// ServiceWindows: run as a Windows service. The service control loop is implemented by
+	// the irma server command, as it manages the lifetime of the process.
+	ServiceWindows = "windows"
+)
+
+// listeners returns the sockets at which to listen: for the requestor server, and for the
+// client server if enabled.
+func (s *Server) listeners() ([]net.Listener, error) {
+	addrs := []string{fmt.Sprintf("%s:%d", s.conf.ListenAddress, s.conf.Port)}
+	if s.conf.separateClientServer() {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", s.conf.ClientListenAddress, s.conf.ClientPort))
+	}
+
+	if s.conf.Service == ServiceSystemd {
+		listeners, err := server.SystemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		if len(listeners) > 0 {
+			if len(listeners) != len(addrs) {
+				closeListeners(listeners)
+				return nil, errors.Errorf("Received %d sockets from systemd, expected %d", len(listeners), len(addrs))
+			}
+			s.conf.Logger.Info("Using sockets from systemd socket activation")
+			return listeners, nil
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
+
+// notify notifies the service manager of the specified state of the server, if enabled.
+func (s *Server) notify(state string) {
+	if s.conf.Service != ServiceSystemd {
+		return
+	}
+	if _, err := server.SystemdNotify(state); err != nil {
+		s.conf.Logger.Warn("Failed to notify systemd: ", err.Error())
+	}
+}
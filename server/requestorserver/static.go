@@ -0,0 +1,102 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// QRs that are printed, e.g. on posters or doors, cannot contain the session pointer of a session
+// started beforehand by a requestor. Instead, they can refer to a static session configured at
+// this server, by containing
+//   {"irmaqr": "redirect", "u": "<url>session/<name>"}
+// in which <url> is the URL of this server for IRMA apps. An IRMA app scanning this QR POSTs to
+// the URL, upon which the server starts a fresh session from the session request of the static
+// session, and returns the session pointer of the new session to the app. As no requestor waits
+// for the results of static sessions, the session request of a static session must specify a
+// callbackUrl to which its results are POSTed.
+
+// StaticSession is a disclosure request from which a new session is started each time an IRMA
+// app scans a QR referring to it.
+type StaticSession struct {
+	// Requestor whose permissions, limits and result claims apply to the sessions
+	// (may be omitted if requestor authentication is disabled)
+	Requestor string `json:"requestor" mapstructure:"requestor"`
+	// Disclosure request specifying a callbackUrl, in the same format as POSTed to /session
+	Request json.RawMessage `json:"request" mapstructure:"-"`
+}
+
+// validateStaticSessions checks that the static sessions can be started.
+func (conf *Configuration) validateStaticSessions() error {
+	for name, static := range conf.StaticSessions {
+		if name == "" || strings.ContainsAny(name, "/?#") {
+			return errors.Errorf("Invalid static session name '%s'", name)
+		}
+		if !conf.DisableRequestorAuthentication {
+			if _, ok := conf.requestor(static.Requestor); !ok {
+				return errors.Errorf("Static session %s has unknown requestor '%s'", name, static.Requestor)
+			}
+		}
+		rrequest, err := server.ParseSessionRequest([]byte(static.Request))
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to parse session request of static session "+name, 0)
+		}
+		request := rrequest.SessionRequest()
+		if request.Action() != irma.ActionDisclosing {
+			return errors.Errorf("Static session %s must be a disclosure session", name)
+		}
+		if rrequest.Base().CallbackUrl == "" {
+			return errors.Errorf("Static session %s must specify a callbackUrl", name)
+		}
+		if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" && conf.CallbackHmacKey == "" {
+			return errors.Errorf("Static session %s requires a JWT private key or callback HMAC key", name)
+		}
+		if allowed, reason := conf.CanVerifyOrSign(static.Requestor, request.Action(), request.ToDisclose()); !allowed {
+			return errors.Errorf("Requestor of static session %s may not verify %s", name, reason)
+		}
+		if conf.URL != "" {
+			conf.Logger.WithField("qr", server.ToJson(irma.Qr{Type: irma.ActionRedirect, URL: conf.URL + "session/" + name})).
+				Info("Static session ", name, " enabled")
+		}
+	}
+	return nil
+}
+
+// handleStaticSession starts a session from the static session in the URL, and returns its
+// session pointer to the IRMA app.
+func (s *Server) handleStaticSession(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	static, ok := s.conf.StaticSessions[name]
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown static session")
+		return
+	}
+	if s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+
+	started, ok := s.limiter.acquire(static.Requestor, s.conf.sessionLimits(static.Requestor))
+	if !ok {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": static.Requestor}).Warn("Requestor has too many unfinished sessions")
+		server.WriteResponse(w, nil, sessionLimitError(static.Requestor))
+		return
+	}
+	// Parse the request anew for each session, as sessions modify their request
+	qr, token, err := s.irmaserv.StartSession([]byte(static.Request), nil)
+	started(token)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	s.sessionRequestors.set(token, static.Requestor)
+
+	s.conf.Logger.WithFields(logrus.Fields{"static": name, "session": token}).Info("Started static session")
+	server.WriteJson(w, qr)
+}
@@ -0,0 +1,181 @@
+package requestorserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Instead of constructing entire session requests, which gives whoever constructs them (e.g. a
+// frontend) full control over the session, requestors can start sessions from session templates
+// configured at this server, by POSTing the values of the variables of the template to
+//   /session/template/<name>
+// e.g. {"studentid": "s1234567"}. The variables are checked against the patterns of the template
+// and substituted into its session request, after which the session is started as if the
+// session request had been POSTed to /session. As the body contains only the variables, the
+// requestor authenticates using its token in the Authorization header.
+
+// SessionTemplate is a session request containing variables.
+type SessionTemplate struct {
+	// Requestor that may start sessions from the template, and whose permissions apply to them
+	// (must use token authentication; omitted if requestor authentication is disabled)
+	Requestor string `json:"requestor" mapstructure:"requestor"`
+	// Session request, in the same format as POSTed to /session, in whose strings each occurrence
+	// of {{name}} is replaced by the value of the variable with that name
+	Request json.RawMessage `json:"request" mapstructure:"-"`
+	// Regular expression per variable that its values must match entirely
+	Variables map[string]string `json:"variables" mapstructure:"variables"`
+}
+
+var templateVariable = regexp.MustCompile(`\{\{([a-zA-Z0-9_]+)\}\}`)
+
+// validateTemplates checks that the session templates are well-formed.
+func (conf *Configuration) validateTemplates() error {
+	for name, template := range conf.Templates {
+		if !conf.DisableRequestorAuthentication {
+			requestor, ok := conf.requestor(template.Requestor)
+			if !ok {
+				return errors.Errorf("Session template %s has unknown requestor '%s'", name, template.Requestor)
+			}
+			if requestor.AuthenticationMethod != AuthenticationMethodToken {
+				return errors.Errorf("Requestor of session template %s must use token authentication", name)
+			}
+		}
+		for variable, pattern := range template.Variables {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return errors.WrapPrefix(err, "Invalid pattern of variable "+variable+" of session template "+name, 0)
+			}
+		}
+		var request interface{}
+		if err := json.Unmarshal(template.Request, &request); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse session request of session template "+name, 0)
+		}
+		for _, match := range templateVariable.FindAllStringSubmatch(string(template.Request), -1) {
+			if _, ok := template.Variables[match[1]]; !ok {
+				return errors.Errorf("Session template %s uses undeclared variable %s", name, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+// expand returns the session request of the template, after checking the variables and
+// substituting them into it.
+func (template SessionTemplate) expand(variables map[string]string) (irma.RequestorRequest, error) {
+	for variable, pattern := range template.Variables {
+		value, ok := variables[variable]
+		if !ok {
+			return nil, errors.Errorf("missing variable %s", variable)
+		}
+		if !regexp.MustCompile("^(?:" + pattern + ")$").MatchString(value) {
+			return nil, errors.Errorf("invalid value of variable %s", variable)
+		}
+	}
+	for variable := range variables {
+		if _, ok := template.Variables[variable]; !ok {
+			return nil, errors.Errorf("unknown variable %s", variable)
+		}
+	}
+
+	// Substitute into the decoded strings, so that values need not be escaped
+	decoder := json.NewDecoder(bytes.NewReader(template.Request))
+	decoder.UseNumber()
+	var request interface{}
+	if err := decoder.Decode(&request); err != nil {
+		return nil, err
+	}
+	bts, err := json.Marshal(substituteVariables(request, variables))
+	if err != nil {
+		return nil, err
+	}
+	return server.ParseSessionRequest(bts)
+}
+
+func substituteVariables(value interface{}, variables map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return templateVariable.ReplaceAllStringFunc(v, func(match string) string {
+			return variables[match[2:len(match)-2]]
+		})
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = substituteVariables(elem, variables)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = substituteVariables(elem, variables)
+		}
+	}
+	return value
+}
+
+// templateRequestor returns the requestor authenticated by the token in the Authorization header.
+func (s *Server) templateRequestor(r *http.Request) (string, *irma.RemoteError) {
+	auth := r.Header.Get("Authorization")
+	if s.conf.DisableRequestorAuthentication {
+		if auth != "" {
+			return "", server.RemoteError(server.ErrorUnauthorized, "requestor authentication is disabled")
+		}
+		return "", nil
+	}
+	if psk, ok := s.conf.requestAuthenticators(r)[AuthenticationMethodToken].(*PresharedKeyAuthenticator); ok && auth != "" {
+		if requestor, ok := psk.presharedkeys[auth]; ok {
+			return tenantRequestor(requestTenant(r), requestor), nil
+		}
+	}
+	return "", server.RemoteError(server.ErrorUnauthorized, "")
+}
+
+func (s *Server) handleTemplateSession(w http.ResponseWriter, r *http.Request) {
+	if s.irmaserv.Draining() {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
+	template, ok := s.conf.Templates[chi.URLParam(r, "template")]
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown session template")
+		return
+	}
+	requestor, rerr := s.templateRequestor(r)
+	if rerr == nil && requestor != template.Requestor {
+		rerr = server.RemoteError(server.ErrorUnauthorized, "session template belongs to another requestor")
+	}
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	if !s.allow(w, "requestor:"+requestor, s.conf.RequestorRate) {
+		return
+	}
+	if !s.requestorOriginAllowed(w, r, requestor) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	var variables map[string]string
+	if err = json.Unmarshal(body, &variables); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	rrequest, err := template.expand(variables)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if rerr = s.authorize(requestor, rrequest.SessionRequest()); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	s.startSession(w, rrequest, requestor)
+}
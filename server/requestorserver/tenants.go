@@ -0,0 +1,281 @@
+package requestorserver
+
+import (
+	"context"
+	"crypto/rsa"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains multi-tenancy: serving multiple tenants (e.g. the customers of a hosting
+// provider) from a single server, each having its own requestors, permissions and result JWT
+// key, and optionally being restricted to some of the schemes and issuers. A request to the
+// requestor endpoints is handled on behalf of the tenant whose Hosts contain the hostname of the
+// request, or otherwise the tenant whose PathPrefix the path of the request starts with (which
+// is then stripped from the path). Other requests are handled on behalf of the requestors of the
+// Configuration itself. The requestors of a tenant can only authenticate to the endpoints of
+// that tenant. Elsewhere, for example in RequestSources, StaticSessions and Templates, they are
+// referred to as "tenant/requestor".
+// The endpoints for the IRMA app, and the session endpoints, which are accessed using the
+// session token, are shared by all tenants. The requestors of tenants are not reloaded by
+// ReloadRequestors().
+
+// Tenant contains the configuration of a tenant of the server.
+type Tenant struct {
+	// Hostnames at which the requestor endpoints of the tenant are served
+	Hosts []string `json:"hosts" mapstructure:"hosts"`
+	// URL path prefix (e.g. /acme) under which the requestor endpoints of the tenant are served
+	PathPrefix string `json:"path_prefix" mapstructure:"path_prefix"`
+
+	// Disclosing, signing or issuance permissions that apply to all requestors of the tenant,
+	// instead of the global permissions
+	Permissions `mapstructure:",squash"`
+	// Requestors of the tenant
+	Requestors map[string]Requestor `json:"requestors" mapstructure:"requestors"`
+
+	// If specified, the requestors of the tenant may only use credentials of these schemes and
+	// issuers, regardless of their permissions
+	Schemes []string `json:"schemes" mapstructure:"schemes"`
+	Issuers []string `json:"issuers" mapstructure:"issuers"`
+
+	// Used in the "iss" field of the result JWTs of the requestors of the tenant
+	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
+	// Private key to sign the result JWTs of the requestors of the tenant with. If absent, the
+	// JWT endpoints are disabled for the tenant.
+	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
+	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+
+	jwtPrivateKey  *rsa.PrivateKey
+	authenticators map[AuthenticationMethod]Authenticator
+}
+
+type tenantContextKey struct{}
+
+func (conf *Configuration) initializeTenants() error {
+	if len(conf.Tenants) == 0 {
+		return nil
+	}
+	if conf.DisableRequestorAuthentication {
+		return errors.New("Tenants require requestor authentication to be enabled")
+	}
+	for name := range conf.Requestors {
+		if strings.Contains(name, "/") {
+			return errors.Errorf("Requestor name '%s' must not contain a slash if tenants are configured", name)
+		}
+	}
+
+	hosts, prefixes := map[string]string{}, map[string]string{}
+	for name, tenant := range conf.Tenants {
+		if name == "" || strings.Contains(name, "/") {
+			return errors.Errorf("Invalid tenant name '%s'", name)
+		}
+		if len(tenant.Hosts) == 0 && tenant.PathPrefix == "" {
+			return errors.Errorf("Tenant %s must specify hosts or a path prefix", name)
+		}
+		for i, host := range tenant.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return errors.Errorf("Host %s of tenant %s is also used by tenant %s", host, name, other)
+			}
+			hosts[host], tenant.Hosts[i] = name, host
+		}
+		if tenant.PathPrefix != "" {
+			if err := validatePathPrefix(name, tenant); err != nil {
+				return err
+			}
+			if other, ok := prefixes[tenant.PathPrefix]; ok {
+				return errors.Errorf("Path prefix %s of tenant %s is also used by tenant %s", tenant.PathPrefix, name, other)
+			}
+			prefixes[tenant.PathPrefix] = name
+		}
+
+		if len(tenant.Requestors) == 0 {
+			return errors.Errorf("Tenant %s has no requestors", name)
+		}
+		auths, err := conf.newAuthenticators(tenant.Requestors)
+		if err != nil {
+			return errors.WrapPrefix(err, "Tenant "+name, 0)
+		}
+		tenant.authenticators = auths
+
+		if err = conf.validateTenantSchemes(name, tenant); err != nil {
+			return err
+		}
+		errs := conf.validatePermissionSet("Tenant "+name, tenant.Permissions)
+		for rname, requestor := range tenant.Requestors {
+			errs = append(errs, conf.validatePermissionSet("Requestor "+name+"/"+rname, requestor.Permissions)...)
+		}
+		if len(errs) != 0 {
+			return errors.New("Errors encountered in permissions:\n" + strings.Join(errs, "\n"))
+		}
+
+		if tenant.JwtPrivateKey != "" || tenant.JwtPrivateKeyFile != "" {
+			keybytes, err := fs.ReadKey(tenant.JwtPrivateKey, tenant.JwtPrivateKeyFile)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to read private key of tenant "+name, 0)
+			}
+			if tenant.jwtPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes); err != nil {
+				return errors.WrapPrefix(err, "failed to parse private key of tenant "+name, 0)
+			}
+		}
+		for rname, requestor := range tenant.Requestors {
+			err = conf.validateResultClaims("Requestor "+name+"/"+rname, requestor.ResultClaims, tenant.jwtPrivateKey != nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validatePathPrefix(name string, tenant *Tenant) error {
+	tenant.PathPrefix = strings.TrimSuffix(tenant.PathPrefix, "/")
+	if !strings.HasPrefix(tenant.PathPrefix, "/") {
+		return errors.Errorf("Path prefix of tenant %s must start with a slash", name)
+	}
+	// The prefix must not hide any of the endpoints of the server
+	first := "/" + strings.SplitN(tenant.PathPrefix[1:], "/", 2)[0]
+	for _, prefix := range endpointPrefixes {
+		if strings.TrimSuffix(prefix, "/") == first {
+			return errors.Errorf("Path prefix %s of tenant %s conflicts with endpoint %s", tenant.PathPrefix, name, prefix)
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) validateTenantSchemes(name string, tenant *Tenant) error {
+	for _, scheme := range tenant.Schemes {
+		if conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier(scheme)] == nil {
+			return errors.Errorf("Tenant %s has unknown scheme %s", name, scheme)
+		}
+	}
+	for _, issuer := range tenant.Issuers {
+		if conf.IrmaConfiguration.Issuers[irma.NewIssuerIdentifier(issuer)] == nil {
+			return errors.Errorf("Tenant %s has unknown issuer %s", name, issuer)
+		}
+	}
+	return nil
+}
+
+// tenantOf returns the tenant of the specified requestor and its name within the tenant, or nil
+// if it is a requestor of the Configuration itself.
+func (conf *Configuration) tenantOf(requestor string) (*Tenant, string) {
+	i := strings.Index(requestor, "/")
+	if i < 0 || len(conf.Tenants) == 0 {
+		return nil, requestor
+	}
+	tenant := conf.Tenants[requestor[:i]]
+	if tenant == nil {
+		return nil, requestor
+	}
+	return tenant, requestor[i+1:]
+}
+
+// tenantRequestor returns the name by which the requestor of the tenant is referred to.
+func tenantRequestor(tenant, requestor string) string {
+	if tenant == "" {
+		return requestor
+	}
+	return tenant + "/" + requestor
+}
+
+// requestAuthenticators returns the authenticators of the requestors of the tenant of the request.
+func (conf *Configuration) requestAuthenticators(r *http.Request) map[AuthenticationMethod]Authenticator {
+	if tenant := requestTenant(r); tenant != "" {
+		return conf.Tenants[tenant].authenticators
+	}
+	return currentAuthenticators()
+}
+
+// requestTenant returns the name of the tenant on whose behalf the request is handled, if any.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// jwtKey returns the private key with which the session result JWTs of the requestor are signed,
+// and the issuer of these JWTs.
+func (conf *Configuration) jwtKey(requestor string) (*rsa.PrivateKey, string) {
+	if tenant, _ := conf.tenantOf(requestor); tenant != nil {
+		return tenant.jwtPrivateKey, tenant.JwtIssuer
+	}
+	return conf.jwtPrivateKey, conf.JwtIssuer
+}
+
+// jwtEnabled returns whether the server or any of its tenants has a JWT private key.
+func (conf *Configuration) jwtEnabled() bool {
+	if conf.jwtPrivateKey != nil {
+		return true
+	}
+	for _, tenant := range conf.Tenants {
+		if tenant.jwtPrivateKey != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// schemesAllowed checks that the request only involves schemes and issuers that the tenant may
+// use. If not, it returns the first issuer that is not allowed.
+func (tenant *Tenant) schemesAllowed(request irma.SessionRequest) (bool, string) {
+	if len(tenant.Schemes) == 0 && len(tenant.Issuers) == 0 {
+		return true, ""
+	}
+	for issuer := range request.Identifiers().Issuers {
+		if !contains(tenant.Schemes, issuer.SchemeManagerIdentifier().String()) &&
+			!contains(tenant.Issuers, issuer.String()) {
+			return false, issuer.String()
+		}
+	}
+	return true, ""
+}
+
+// selectTenant returns the tenant of the request, and the path prefix of the tenant if the tenant
+// was selected by it.
+func (conf *Configuration) selectTenant(r *http.Request) (string, string) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // no port
+	}
+	host = strings.ToLower(host)
+	for name, tenant := range conf.Tenants {
+		if contains(tenant.Hosts, host) {
+			return name, ""
+		}
+	}
+	for name, tenant := range conf.Tenants {
+		prefix := tenant.PathPrefix
+		if prefix != "" && (r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")) {
+			return name, prefix
+		}
+	}
+	return "", ""
+}
+
+// tenantMiddleware selects the tenant on whose behalf the request is handled, stripping its path
+// prefix from the request path.
+func (s *Server) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, prefix := s.conf.selectTenant(r)
+		if tenant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+		if prefix != "" {
+			u := *r.URL
+			if u.Path = strings.TrimPrefix(u.Path, prefix); u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
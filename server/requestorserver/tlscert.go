@@ -0,0 +1,108 @@
+package requestorserver
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/sirupsen/logrus"
+)
+
+// tlsReloadInterval is the minimum time between two checks for modifications of the TLS
+// certificate and private key files.
+const tlsReloadInterval = 10 * time.Second
+
+// tlsCertificate provides the TLS certificate of the server to the TLS stack. If the certificate
+// or private key is read from a file, then they are read again when the file is modified, so that
+// the certificate can be renewed (e.g. by Let's Encrypt, or by a secrets provider writing the files)
+// without restarting the server. Existing connections, and so the IRMA sessions running over them,
+// are not affected; the new certificate is used for new connections.
+type tlsCertificate struct {
+	sync.Mutex
+	cert, certfile, key, keyfile string
+	logger                       *logrus.Logger
+
+	certificate *tls.Certificate
+	modified    time.Time // modification time of the files when they were last read
+	checked     time.Time
+}
+
+func newTlsCertificate(cert, certfile, key, keyfile string, logger *logrus.Logger) (*tlsCertificate, error) {
+	t := &tlsCertificate{cert: cert, certfile: certfile, key: key, keyfile: keyfile, logger: logger}
+	modified, err := t.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = t.load(modified); err != nil {
+		return nil, err
+	}
+	t.checked = time.Now()
+	return t, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if its files have been
+// modified. It is meant to be used as the GetCertificate function of a tls.Config.
+func (t *tlsCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if (t.certfile == "" && t.keyfile == "") || time.Since(t.checked) < tlsReloadInterval {
+		return t.certificate, nil
+	}
+	t.checked = time.Now()
+
+	modified, err := t.modTime()
+	if err != nil {
+		t.logger.Warn("Failed to check TLS certificate files for modifications: ", err.Error())
+		return t.certificate, nil
+	}
+	if modified.Equal(t.modified) {
+		return t.certificate, nil
+	}
+	// If the files are being replaced one by one, the certificate and private key may not match
+	// yet; in that case we keep using the current certificate and try again later.
+	if err = t.load(modified); err != nil {
+		t.logger.Warn("Failed to reload TLS certificate, keeping current certificate: ", err.Error())
+		return t.certificate, nil
+	}
+	t.logger.Info("Reloaded TLS certificate from ", t.certfile)
+	return t.certificate, nil
+}
+
+func (t *tlsCertificate) load(modified time.Time) error {
+	var certbts, keybts []byte
+	var err error
+	if certbts, err = fs.ReadKey(t.cert, t.certfile); err != nil {
+		return err
+	}
+	if keybts, err = fs.ReadKey(t.key, t.keyfile); err != nil {
+		return err
+	}
+	cer, err := tls.X509KeyPair(certbts, keybts)
+	if err != nil {
+		return err
+	}
+	t.certificate = &cer
+	t.modified = modified
+	return nil
+}
+
+// modTime returns the latest modification time of the certificate and private key files.
+func (t *tlsCertificate) modTime() (time.Time, error) {
+	var modified time.Time
+	for _, path := range []string{t.certfile, t.keyfile} {
+		if path == "" {
+			continue
+		}
+		stat, err := os.Stat(path) // follows symlinks, as used by e.g. certbot
+		if err != nil {
+			return time.Time{}, err
+		}
+		if stat.ModTime().After(modified) {
+			modified = stat.ModTime()
+		}
+	}
+	return modified, nil
+}
@@ -0,0 +1,101 @@
+package requestorserver
+
+import (
+	"os"
+	"time"
+)
+
+// This file contains the hot reloading of the requestors. If RequestorsWatchInterval is set, the
+// server periodically checks the RequestorsFile and the key files of the requestors for
+// modifications. When any of them has been modified, the requestors are reloaded (see
+// reloadRequestors()), so that requestors can be added or removed, their keys rotated and their
+// permissions changed without restarting the server. Sessions that have already been started are
+// not affected. If the new configuration is invalid, the current requestors are kept.
+
+func (s *Server) startWatching() {
+	if s.conf.RequestorsWatchInterval <= 0 || s.conf.DisableRequestorAuthentication {
+		return
+	}
+	s.watchStop = make(chan struct{})
+	go s.watchRequestors(s.watchStop)
+}
+
+func (s *Server) stopWatching() {
+	s.watchStopOnce.Do(func() {
+		if s.watchStop != nil {
+			close(s.watchStop)
+		}
+	})
+}
+
+func (s *Server) watchRequestors(stop <-chan struct{}) {
+	interval := time.Duration(s.conf.RequestorsWatchInterval) * time.Second
+	modified, err := s.conf.requestorsModTime()
+	if err != nil {
+		s.conf.Logger.Warn("Failed to check requestor files for modifications: ", err.Error())
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		m, err := s.conf.requestorsModTime()
+		if err != nil {
+			// The files may be being replaced; try again later
+			s.conf.Logger.Warn("Failed to check requestor files for modifications: ", err.Error())
+			continue
+		}
+		if m.Equal(modified) {
+			continue
+		}
+		modified = m
+		if err = s.reloadRequestors(); err != nil {
+			s.conf.Logger.Warn("Failed to reload requestors, keeping current requestors: ", err.Error())
+		}
+	}
+}
+
+// reloadRequestors reloads the requestors returned by the RequestorsLoader, or if it is not set,
+// the current requestors, reading their key files again.
+func (s *Server) reloadRequestors() error {
+	var requestors map[string]Requestor
+	if s.conf.RequestorsLoader != nil {
+		var err error
+		if requestors, err = s.conf.RequestorsLoader(); err != nil {
+			return err
+		}
+	} else {
+		requestorsMutex.RLock()
+		requestors = s.conf.Requestors
+		requestorsMutex.RUnlock()
+	}
+	return s.ReloadRequestors(requestors)
+}
+
+// requestorsModTime returns the latest modification time of the RequestorsFile and the key files
+// of the requestors.
+func (conf *Configuration) requestorsModTime() (time.Time, error) {
+	requestorsMutex.RLock()
+	paths := []string{conf.RequestorsFile}
+	for _, requestor := range conf.Requestors {
+		paths = append(paths, requestor.AuthenticationKeyFile)
+	}
+	requestorsMutex.RUnlock()
+
+	var modified time.Time
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if stat.ModTime().After(modified) {
+			modified = stat.ModTime()
+		}
+	}
+	return modified, nil
+}
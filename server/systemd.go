@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+)
+
+// This file implements the parts of the systemd service protocol used by the IRMA server:
+// socket activation (see sd_listen_fds(3)), readiness notification (see sd_notify(3)),
+// and logging to the journal through stderr (see sd-daemon(3)).
+
+// systemdListenFdsStart is the first file descriptor passed by systemd socket activation.
+const systemdListenFdsStart = 3
+
+// SystemdListeners returns the listening sockets passed to this process by systemd socket
+// activation, in the order in which they are configured in the socket unit, or nil if the process
+// was not socket activated. The environment variables used by socket activation are unset, so
+// that they are not inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file) // duplicates the file descriptor
+		_ = file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("Socket %d passed by systemd is not a listening socket", fd), 0)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// SystemdNotify sends the specified state (e.g. "READY=1") to the service manager, if this
+// process is run by systemd as a service of type notify. It returns whether or not the
+// notification was sent.
+func SystemdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// JournaldFormatter formats log entries for the systemd journal: the journal adds its own
+// timestamps, and it reads the priority of each line from its "<priority>" prefix.
+type JournaldFormatter struct {
+	text prefixed.TextFormatter
+}
+
+// NewJournaldFormatter returns a formatter for logging to the systemd journal.
+func NewJournaldFormatter() *JournaldFormatter {
+	return &JournaldFormatter{text: prefixed.TextFormatter{
+		DisableTimestamp: true,
+		DisableColors:    true,
+	}}
+}
+
+func (f *JournaldFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	bts, err := f.text.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line of a multiline message is a separate journal entry, so prefix all of them
+	prefix := []byte(fmt.Sprintf("<%d>", journaldPriority(entry.Level)))
+	lines := bytes.SplitAfter(bytes.TrimSuffix(bts, []byte("\n")), []byte("\n"))
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(prefix)
+		buf.Write(line)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// journaldPriority maps logrus levels to syslog priorities.
+func journaldPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // LOG_CRIT
+	case logrus.ErrorLevel:
+		return 3 // LOG_ERR
+	case logrus.WarnLevel:
+		return 4 // LOG_WARNING
+	case logrus.InfoLevel:
+		return 6 // LOG_INFO
+	default:
+		return 7 // LOG_DEBUG
+	}
+}
@@ -0,0 +1,220 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	gobig "math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the functions that sign a scheme directory, i.e., compute the hashes of the
+// files in it and write them to the index file, along with a signature over the index file and
+// the public key with which it can be verified. The result is verified by VerifySignature() and
+// ReadAuthenticatedFile().
+
+// schemeFileInclusions are the files that are included in the index of a scheme
+// (unless excluded by schemeFileExclusions).
+var schemeFileInclusions = []*regexp.Regexp{
+	regexp.MustCompile(`\.xml$`),
+	regexp.MustCompile(`\.png$`),
+	regexp.MustCompile(`(^|/)kss-\d+\.pem$`),
+	regexp.MustCompile(`(^|/)timestamp$`),
+}
+
+// schemeFileExclusions are the files that are never included in the index of a scheme.
+var schemeFileExclusions = []*regexp.Regexp{
+	regexp.MustCompile(`(^|/)index$`),
+	regexp.MustCompile(`(^|/)\.git/`),
+	regexp.MustCompile(`(^|/)PrivateKeys/`),
+}
+
+// SignScheme signs the scheme in the specified directory using the specified private key:
+// it writes a new timestamp, computes the index of the scheme, and writes the index,
+// its signature and the public key to the scheme directory.
+func SignScheme(dir string, sk *ecdsa.PrivateKey) error {
+	conf, id, err := schemeDirConfiguration(dir)
+	if err != nil {
+		return err
+	}
+	return conf.SignScheme(id, sk)
+}
+
+// SignSchemeTimestamp writes a new timestamp to the scheme in the specified directory, and signs it
+// using the specified timestamp key (see SchemeKeyRoleTimestamp), writing the signature to timestamp.sig.
+// The index of the scheme is not modified, so this does not require the scheme key.
+func SignSchemeTimestamp(dir string, sk *ecdsa.PrivateKey) error {
+	conf, id, err := schemeDirConfiguration(dir)
+	if err != nil {
+		return err
+	}
+	return conf.SignSchemeTimestamp(id, sk)
+}
+
+// SignScheme signs the specified scheme of the configuration, as the package-level SignScheme() does.
+func (conf *Configuration) SignScheme(id SchemeManagerIdentifier, sk *ecdsa.PrivateKey) error {
+	dir := filepath.Join(conf.Path, id.String())
+
+	bts := []byte(strconv.FormatInt(Now().Unix(), 10) + "\n")
+	if err := conf.saveFile(filepath.Join(dir, "timestamp"), bts); err != nil {
+		return errors.WrapPrefix(err, "Failed to write timestamp", 0)
+	}
+
+	index, err := SchemeIndex(dir)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to calculate file index", 0)
+	}
+	bts = []byte(index.String())
+	if err = conf.saveFile(filepath.Join(dir, "index"), bts); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index", 0)
+	}
+
+	sig, err := SignSchemeIndex(bts, sk)
+	if err != nil {
+		return err
+	}
+	if err = conf.saveFile(filepath.Join(dir, "index.sig"), sig); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
+	}
+
+	bts, err = x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to serialize public key", 0)
+	}
+	pk := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
+	if err = conf.saveFile(filepath.Join(dir, "pk.pem"), pk); err != nil {
+		return errors.WrapPrefix(err, "Failed to write public key", 0)
+	}
+	return nil
+}
+
+// SignSchemeTimestamp signs the timestamp of the specified scheme of the configuration,
+// as the package-level SignSchemeTimestamp() does.
+func (conf *Configuration) SignSchemeTimestamp(id SchemeManagerIdentifier, sk *ecdsa.PrivateKey) error {
+	dir := filepath.Join(conf.Path, id.String())
+	bts := []byte(strconv.FormatInt(Now().Unix(), 10) + "\n")
+	if err := conf.saveFile(filepath.Join(dir, "timestamp"), bts); err != nil {
+		return errors.WrapPrefix(err, "Failed to write timestamp", 0)
+	}
+	sig, err := SignSchemeIndex(bts, sk)
+	if err != nil {
+		return err
+	}
+	if err = conf.saveFile(filepath.Join(dir, "timestamp.sig"), sig); err != nil {
+		return errors.WrapPrefix(err, "Failed to write timestamp.sig", 0)
+	}
+	return nil
+}
+
+// schemeDirConfiguration returns an (unparsed) configuration containing the scheme in the specified
+// directory, along with the identifier of that scheme, so that the package-level functions that
+// modify a scheme directory can write through the storage methods of Configuration.
+func schemeDirConfiguration(dir string) (*Configuration, SchemeManagerIdentifier, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, SchemeManagerIdentifier{}, err
+	}
+	conf, err := NewConfiguration(filepath.Dir(dir))
+	if err != nil {
+		return nil, SchemeManagerIdentifier{}, err
+	}
+	return conf, NewSchemeManagerIdentifier(filepath.Base(dir)), nil
+}
+
+// SchemeIndex computes the index of the scheme in the specified directory, containing the hashes
+// of all files in the scheme that must be signed. As in the index file, the paths in the index
+// start with the name of the scheme directory.
+func SchemeIndex(dir string) (SchemeManagerIndex, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	index := SchemeManagerIndex(make(map[string]ConfigurationFileHash))
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		relpath = filepath.ToSlash(filepath.Join(filepath.Base(dir), relpath))
+		if !schemeFileSigned(relpath) {
+			return nil
+		}
+		hash, err := SchemeFileHash(path)
+		if err != nil {
+			return err
+		}
+		index[relpath] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// SchemeFileHash computes the hash of the specified file, as it occurs in a scheme index.
+func SchemeFileHash(path string) (ConfigurationFileHash, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bts)
+	return hash[:], nil
+}
+
+// SignSchemeIndex computes the ASN.1-encoded ECDSA signature over the specified index file contents.
+func SignSchemeIndex(index []byte, sk *ecdsa.PrivateKey) ([]byte, error) {
+	hash := sha256.Sum256(index)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to sign index", 0)
+	}
+	sig, err := asn1.Marshal([]*gobig.Int{r, s})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to serialize signature", 0)
+	}
+	return sig, nil
+}
+
+// VerifySchemeIndexSignature verifies the ASN.1-encoded ECDSA signature over the specified
+// index file contents.
+func VerifySchemeIndexSignature(index, sig []byte, pk *ecdsa.PublicKey) error {
+	ints := make([]*gobig.Int, 0, 2)
+	if _, err := asn1.Unmarshal(sig, &ints); err != nil || len(ints) != 2 {
+		return configurationError(ErrInvalidSignature, nil, "Scheme manager signature could not be parsed")
+	}
+	hash := sha256.Sum256(index)
+	if !ecdsa.Verify(pk, hash[:], ints[0], ints[1]) {
+		return configurationError(ErrInvalidSignature, nil, "Scheme manager signature was invalid")
+	}
+	return nil
+}
+
+func schemeFileSigned(relpath string) bool {
+	for _, ex := range schemeFileExclusions {
+		if ex.MatchString(relpath) {
+			return false
+		}
+	}
+	for _, in := range schemeFileInclusions {
+		if in.MatchString(relpath) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package irma
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// Methods of Configuration that modify its storage first check that the configuration is not
+// read-only using writable(), returning an *ErrReadOnly if it is. Additionally, a Configuration
+// can be put in dry-run mode, in which modifications of its storage are recorded instead of
+// performed. Files written or removed directly are recorded individually by the helpers below,
+// while operations that download files from a scheme (such as installing or updating schemes)
+// are recorded as a whole, without contacting the scheme server, as their downloads depend on
+// each other.
+
+// ErrReadOnly is returned when attempting to modify the storage of a read-only Configuration.
+type ErrReadOnly struct {
+	Operation string
+}
+
+// StorageWrite is a modification of the storage of a Configuration in dry-run mode.
+type StorageWrite struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+}
+
+type dryRunLog struct {
+	sync.Mutex
+	writes []StorageWrite
+}
+
+func (e *ErrReadOnly) Error() string {
+	return fmt.Sprintf("cannot %s: configuration is read-only", e.Operation)
+}
+
+// SetDryRun enables or disables dry-run mode, in which modifications of the storage of the
+// Configuration are recorded (and returned by DryRunWrites()) instead of performed.
+func (conf *Configuration) SetDryRun(enabled bool) {
+	if enabled {
+		conf.dryRun = &dryRunLog{}
+	} else {
+		conf.dryRun = nil
+	}
+}
+
+// DryRunWrites returns the modifications of the storage that were recorded in dry-run mode.
+func (conf *Configuration) DryRunWrites() []StorageWrite {
+	if conf.dryRun == nil {
+		return nil
+	}
+	conf.dryRun.Lock()
+	defer conf.dryRun.Unlock()
+	return append([]StorageWrite{}, conf.dryRun.writes...)
+}
+
+// writable returns an *ErrReadOnly if the Configuration is read-only.
+func (conf *Configuration) writable(operation string) error {
+	if conf.readOnly {
+		return &ErrReadOnly{Operation: operation}
+	}
+	return nil
+}
+
+// skipDryRun records the specified operation and returns true if the Configuration
+// is in dry-run mode, in which case the caller must not perform the operation.
+func (conf *Configuration) skipDryRun(operation, path string) bool {
+	if conf.dryRun == nil {
+		return false
+	}
+	conf.dryRun.Lock()
+	defer conf.dryRun.Unlock()
+	conf.dryRun.writes = append(conf.dryRun.writes, StorageWrite{Operation: operation, Path: path})
+	Logger.WithField("path", path).Debugf("Dry run: skipping %s", operation)
+	return true
+}
+
+// saveFile writes the specified contents to the specified path, creating its directory if necessary.
+func (conf *Configuration) saveFile(path string, contents []byte) error {
+	if err := conf.writable("write " + path); err != nil {
+		return err
+	}
+	if conf.skipDryRun("write", path) {
+		return nil
+	}
+	if err := fs.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return fs.SaveFile(path, contents)
+}
+
+// removeAll removes the specified path and everything it contains.
+func (conf *Configuration) removeAll(path string) error {
+	if err := conf.writable("remove " + path); err != nil {
+		return err
+	}
+	if conf.skipDryRun("remove", path) {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// copyDirectory copies the directory src to dest.
+func (conf *Configuration) copyDirectory(src, dest string) error {
+	if err := conf.writable("copy to " + dest); err != nil {
+		return err
+	}
+	if conf.skipDryRun("copy from "+src, dest) {
+		return nil
+	}
+	return fs.CopyDirectory(src, dest)
+}
@@ -0,0 +1,377 @@
+package irma
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// VerificationTranscript contains everything that is needed to independently reverify a disclosure
+// or attribute-based signature at a later time, for example in case of a dispute about what was proven:
+// the request, the proofs, and the outcome and time of the original verification. Additionally it records
+// the hashes of the scheme files (scheme, issuer and credential type descriptions, and the public keys
+// used in the proofs) against which the proofs were verified, and a fingerprint over these hashes.
+//
+// Using WriteArchive() a transcript can be packaged together with these scheme files (and the index and
+// signature of their schemes, so that their authenticity can be checked) into a single zip archive, which
+// can be reverified with VerifyTranscriptArchive().
+type VerificationTranscript struct {
+	Type          Action          `json:"type"`
+	Request       json.RawMessage `json:"request"`
+	Disclosure    *Disclosure     `json:"disclosure,omitempty"` // In case of disclosure sessions
+	SignedMessage *SignedMessage  `json:"signature,omitempty"`  // In case of signature sessions
+	Nonce         *big.Int        `json:"nonce"`
+	Context       *big.Int        `json:"context"`
+
+	Verified   Timestamp             `json:"verified"` // Time of the original verification
+	Status     ProofStatus           `json:"status"`
+	Attributes []*DisclosedAttribute `json:"attributes"`
+
+	SchemeFiles       SchemeManagerIndex `json:"schemefiles"`
+	SchemeFingerprint string             `json:"schemefingerprint"`
+}
+
+const (
+	transcriptFile          = "transcript.json"
+	transcriptSchemesFolder = "irma_configuration"
+)
+
+// NewDisclosureTranscript verifies the disclosure against the request, and returns a transcript
+// of the verification.
+func NewDisclosureTranscript(conf *Configuration, request *DisclosureRequest, disclosure *Disclosure) (*VerificationTranscript, error) {
+	now := time.Now()
+	attrs, status, err := disclosure.verify(conf, request, now)
+	if err != nil {
+		return nil, err
+	}
+	t := &VerificationTranscript{
+		Type:       ActionDisclosing,
+		Disclosure: disclosure,
+		Nonce:      request.Nonce,
+		Context:    request.Context,
+		Verified:   Timestamp(now),
+		Status:     status,
+		Attributes: attrs,
+	}
+	return t, t.populate(conf, request, disclosure.Proofs)
+}
+
+// NewSignatureTranscript verifies the attribute-based signature against the request, and returns
+// a transcript of the verification.
+func NewSignatureTranscript(conf *Configuration, request *SignatureRequest, sm *SignedMessage) (*VerificationTranscript, error) {
+	now := time.Now()
+	attrs, status, err := sm.verify(conf, request, now)
+	if err != nil {
+		return nil, err
+	}
+	t := &VerificationTranscript{
+		Type:          ActionSigning,
+		SignedMessage: sm,
+		Nonce:         sm.GetNonce(),
+		Context:       sm.Context,
+		Verified:      Timestamp(now),
+		Status:        status,
+		Attributes:    attrs,
+	}
+	return t, t.populate(conf, request, sm.Signature)
+}
+
+// SessionRequest returns the request contained in the transcript.
+func (t *VerificationTranscript) SessionRequest() (SessionRequest, error) {
+	var request SessionRequest
+	switch t.Type {
+	case ActionDisclosing:
+		request = &DisclosureRequest{}
+	case ActionSigning:
+		request = &SignatureRequest{}
+	default:
+		return nil, errors.Errorf("Unsupported transcript type %s", t.Type)
+	}
+	if err := json.Unmarshal(t.Request, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Reverify verifies the proofs in the transcript again against the specified configuration,
+// at the time of the original verification.
+func (t *VerificationTranscript) Reverify(conf *Configuration) ([]*DisclosedAttribute, ProofStatus, error) {
+	request, err := t.SessionRequest()
+	if err != nil {
+		return nil, ProofStatusInvalid, err
+	}
+	verified := time.Time(t.Verified)
+	switch t.Type {
+	case ActionDisclosing:
+		if t.Disclosure == nil {
+			return nil, ProofStatusInvalid, errors.New("Transcript contains no disclosure")
+		}
+		return t.Disclosure.verify(conf, request.(*DisclosureRequest), verified)
+	default: // ActionSigning, as SessionRequest() checks the type
+		if t.SignedMessage == nil {
+			return nil, ProofStatusInvalid, errors.New("Transcript contains no signature")
+		}
+		return t.SignedMessage.verify(conf, request.(*SignatureRequest), verified)
+	}
+}
+
+// WriteArchive writes a zip archive to w containing the transcript and the scheme files
+// against which it was verified, taken from the specified configuration.
+func (t *VerificationTranscript) WriteArchive(conf *Configuration, w io.Writer) error {
+	files := map[string]struct{}{}
+	for file := range t.SchemeFiles {
+		files[file] = struct{}{}
+		scheme := strings.Split(file, "/")[0]
+		for _, f := range []string{"index", "index.sig", "pk.pem"} {
+			files[scheme+"/"+f] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(files))
+	for file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	archive := zip.NewWriter(w)
+	bts, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeArchiveFile(archive, transcriptFile, bts); err != nil {
+		return err
+	}
+	for _, file := range sorted {
+		bts, err = ioutil.ReadFile(filepath.Join(conf.Path, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		if err = writeArchiveFile(archive, transcriptSchemesFolder+"/"+file, bts); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// VerifyTranscriptArchive reads a transcript archive written by WriteArchive(), checks the authenticity
+// of the contained scheme files, and reverifies the transcript against these scheme files at the time of
+// the original verification. If trusted is not nil, then the public keys of the schemes in the archive must
+// equal those of the same schemes in trusted.
+func VerifyTranscriptArchive(r io.ReaderAt, size int64, trusted *Configuration) (*VerificationTranscript, []*DisclosedAttribute, ProofStatus, error) {
+	dir, err := ioutil.TempDir("", "irma-transcript")
+	if err != nil {
+		return nil, nil, ProofStatusInvalid, err
+	}
+	defer os.RemoveAll(dir)
+
+	t, err := extractTranscriptArchive(r, size, dir)
+	if err != nil {
+		return nil, nil, ProofStatusInvalid, err
+	}
+
+	conf, err := NewConfigurationReadOnly(filepath.Join(dir, transcriptSchemesFolder))
+	if err != nil {
+		return t, nil, ProofStatusInvalid, err
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return t, nil, ProofStatusInvalid, err
+	}
+	for id, manager := range conf.SchemeManagers {
+		if err = conf.VerifySchemeManager(manager); err != nil {
+			return t, nil, ProofStatusInvalid, err
+		}
+		if trusted == nil {
+			continue
+		}
+		if _, ok := trusted.SchemeManagers[id]; !ok {
+			return t, nil, ProofStatusInvalid, errors.Errorf("Scheme %s of transcript is not trusted", id)
+		}
+		pk, err := ioutil.ReadFile(filepath.Join(conf.Path, id.String(), "pk.pem"))
+		if err != nil {
+			return t, nil, ProofStatusInvalid, err
+		}
+		trustedPk, err := ioutil.ReadFile(filepath.Join(trusted.Path, id.String(), "pk.pem"))
+		if err != nil {
+			return t, nil, ProofStatusInvalid, err
+		}
+		if string(pk) != string(trustedPk) {
+			return t, nil, ProofStatusInvalid, errors.Errorf("Scheme %s of transcript has untrusted public key", id)
+		}
+	}
+
+	// Check that the scheme files in the archive are the ones against which the transcript was made
+	files := SchemeManagerIndex{}
+	for file, hash := range t.SchemeFiles {
+		manager, ok := conf.SchemeManagers[NewSchemeManagerIdentifier(strings.Split(file, "/")[0])]
+		if !ok || !manager.index[file].Equal(hash) {
+			return t, nil, ProofStatusInvalid, errors.Errorf("Transcript scheme file %s missing from archive", file)
+		}
+		files[file] = manager.index[file]
+	}
+	if files.fingerprint() != t.SchemeFingerprint {
+		return t, nil, ProofStatusInvalid, errors.New("Transcript scheme fingerprint mismatch")
+	}
+
+	attrs, status, err := t.Reverify(conf)
+	return t, attrs, status, err
+}
+
+// populate sets the request and scheme files of the transcript.
+func (t *VerificationTranscript) populate(conf *Configuration, request SessionRequest, proofs gabi.ProofList) error {
+	var err error
+	if t.Request, err = json.Marshal(request); err != nil {
+		return err
+	}
+	if t.SchemeFiles, err = transcriptSchemeFiles(conf, request.Identifiers(), proofs); err != nil {
+		return err
+	}
+	t.SchemeFingerprint = t.SchemeFiles.fingerprint()
+	return nil
+}
+
+// transcriptSchemeFiles returns the files (along with their hashes) of the schemes in conf against which
+// the proofs are verified: the root files of the schemes, the descriptions and logos of the issuers and
+// credential types occuring in the request or the proofs, and the public keys used in the proofs.
+func transcriptSchemeFiles(conf *Configuration, ids *IrmaIdentifierSet, proofs gabi.ProofList) (SchemeManagerIndex, error) {
+	schemes := map[SchemeManagerIdentifier]struct{}{}
+	issuers := map[IssuerIdentifier]struct{}{}
+	credtypes := map[CredentialTypeIdentifier]struct{}{}
+	keys := map[IssuerIdentifier]map[int]struct{}{}
+
+	for credid := range ids.CredentialTypes {
+		credtypes[credid] = struct{}{}
+	}
+	for _, proof := range proofs {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			return nil, errors.New("Cannot make transcript, not a disclosure proofD")
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], conf) // index 1 is metadata attribute
+		credtype := metadata.CredentialType()
+		if credtype == nil {
+			return nil, errors.New("Cannot make transcript, proof of unknown credential type")
+		}
+		credid := credtype.Identifier()
+		credtypes[credid] = struct{}{}
+		if keys[credid.IssuerIdentifier()] == nil {
+			keys[credid.IssuerIdentifier()] = map[int]struct{}{}
+		}
+		keys[credid.IssuerIdentifier()][metadata.KeyCounter()] = struct{}{}
+	}
+	for credid := range credtypes {
+		issuers[credid.IssuerIdentifier()] = struct{}{}
+	}
+	for issid := range issuers {
+		schemes[issid.SchemeManagerIdentifier()] = struct{}{}
+	}
+
+	files := SchemeManagerIndex{}
+	for id := range schemes {
+		manager, ok := conf.SchemeManagers[id]
+		if !ok {
+			return nil, errors.Errorf("Cannot make transcript, unknown scheme %s", id)
+		}
+		for file, hash := range manager.index {
+			parts := strings.Split(file, "/")
+			if len(parts) == 2 { // in the root of the scheme
+				files[file] = hash
+				continue
+			}
+			issid := NewIssuerIdentifier(parts[0] + "." + parts[1])
+			if _, ok := issuers[issid]; !ok {
+				continue
+			}
+			switch {
+			case len(parts) == 3: // issuer description and logo
+				files[file] = hash
+			case parts[2] == "PublicKeys" && len(parts) == 4:
+				counter, err := strconv.Atoi(strings.TrimSuffix(parts[3], ".xml"))
+				if err != nil {
+					continue
+				}
+				if _, ok := keys[issid][counter]; ok {
+					files[file] = hash
+				}
+			case parts[2] == "Issues" && len(parts) == 5:
+				if _, ok := credtypes[NewCredentialTypeIdentifier(issid.String()+"."+parts[3])]; ok {
+					files[file] = hash
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// fingerprint returns the hex-encoded SHA256 hash of the index, in the format of the index files of schemes.
+func (i SchemeManagerIndex) fingerprint() string {
+	hash := sha256.Sum256([]byte(i.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+func writeArchiveFile(archive *zip.Writer, name string, content []byte) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
+
+// extractTranscriptArchive extracts the scheme files of the archive into dir, and returns the transcript.
+func extractTranscriptArchive(r io.ReaderAt, size int64, dir string) (*VerificationTranscript, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var t *VerificationTranscript
+	for _, f := range archive.File {
+		name := filepath.Clean(filepath.FromSlash(f.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("Invalid file name %s in transcript archive", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		bts, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if f.Name == transcriptFile {
+			t = &VerificationTranscript{}
+			if err = json.Unmarshal(bts, t); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to parse transcript", 0)
+			}
+			continue
+		}
+		if !strings.HasPrefix(f.Name, transcriptSchemesFolder+"/") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err = fs.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		if err = fs.SaveFile(path, bts); err != nil {
+			return nil, err
+		}
+	}
+	if t == nil {
+		return nil, errors.New("Archive contains no transcript")
+	}
+	return t, nil
+}
@@ -2,15 +2,19 @@ package irma
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -26,6 +30,34 @@ type HTTPTransport struct {
 	Server  string
 	client  *retryablehttp.Client
 	headers map[string]string
+	cache   *HTTPCache
+	upload  func(sent, total int64)
+}
+
+// HTTPCache keeps track of the cache validators (the ETag and Last-Modified headers) that servers
+// sent along with earlier responses, so that HTTPTransports using it can make conditional requests
+// (using the If-None-Match and If-Modified-Since headers) and avoid downloading unchanged resources.
+type HTTPCache struct {
+	mutex   sync.Mutex
+	entries map[string]*httpCacheEntry
+}
+
+type httpCacheEntry struct {
+	etag         string
+	lastModified string
+	body         []byte // nil if the resource was stored to disk by GetSignedFile
+}
+
+// TransportSettings overrides network settings of HTTPTransports, e.g. for schemes that are
+// reachable only through a proxy or whose servers use certificates of an internal CA.
+// Fields that are not set keep their default.
+type TransportSettings struct {
+	// TLS configuration, e.g. with RootCAs containing an internal CA
+	TLSConfig *tls.Config
+	// Proxy returns the proxy to use for a request, see http.Transport.Proxy
+	Proxy func(*http.Request) (*url.URL, error)
+	// Timeout of requests
+	Timeout time.Duration
 }
 
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
@@ -83,19 +115,100 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 	}
 }
 
+// NewHTTPCache returns a new, empty HTTPCache.
+func NewHTTPCache() *HTTPCache {
+	return &HTTPCache{entries: map[string]*httpCacheEntry{}}
+}
+
+func (cache *HTTPCache) get(url string) *httpCacheEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.entries[url]
+}
+
+func (cache *HTTPCache) put(url string, res *http.Response, body []byte) {
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if etag == "" && lastModified == "" {
+		delete(cache.entries, url)
+		return
+	}
+	cache.entries[url] = &httpCacheEntry{etag: etag, lastModified: lastModified, body: body}
+}
+
+func (cache *HTTPCache) remove(url string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, url)
+}
+
 // SetHeader sets a header to be sent in requests.
 func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers[name] = val
 }
 
+// SetCache sets the HTTPCache to use in GetBytes, GetFile and GetSignedFile.
+func (transport *HTTPTransport) SetCache(cache *HTTPCache) {
+	transport.cache = cache
+}
+
+// SetProgressHandlers sets functions that are called while the bodies of requests are being sent,
+// with the amount of bytes sent so far and the total, and when a request is retried after a
+// transient network failure, with the number of the retry (starting at 1). Either may be nil.
+func (transport *HTTPTransport) SetProgressHandlers(upload func(sent, total int64), retry func(attempt int)) {
+	transport.upload = upload
+	transport.client.RequestLogHook = nil
+	if retry != nil {
+		transport.client.RequestLogHook = func(_ *log.Logger, _ *http.Request, attempt int) {
+			if attempt > 0 {
+				retry(attempt)
+			}
+		}
+	}
+}
+
+// Configure applies the specified settings to the transport.
+func (transport *HTTPTransport) Configure(settings *TransportSettings) {
+	if settings == nil {
+		return
+	}
+	if inner, ok := transport.client.HTTPClient.Transport.(*http.Transport); ok {
+		if settings.TLSConfig != nil {
+			inner.TLSClientConfig = settings.TLSConfig
+		}
+		if settings.Proxy != nil {
+			inner.Proxy = settings.Proxy
+		}
+	}
+	if settings.Timeout != 0 {
+		transport.SetTimeout(settings.Timeout)
+	}
+}
+
+// SetTimeout sets the timeout of requests (default 5 seconds), e.g. for long polling.
+func (transport *HTTPTransport) SetTimeout(timeout time.Duration) {
+	transport.client.HTTPClient.Timeout = timeout
+}
+
 func (transport *HTTPTransport) request(
-	url string, method string, reader io.Reader, isstr bool,
+	ctx context.Context, url string, method string, reader io.Reader, isstr bool,
+) (response *http.Response, err error) {
+	return transport.conditionalRequest(ctx, url, method, reader, isstr, nil)
+}
+
+// conditionalRequest performs the request, including the If-None-Match and If-Modified-Since
+// headers using the validators from the specified cache entry, if present. The request is
+// aborted when the context is done.
+func (transport *HTTPTransport) conditionalRequest(
+	ctx context.Context, url string, method string, reader io.Reader, isstr bool, cached *httpCacheEntry,
 ) (response *http.Response, err error) {
 	var req retryablehttp.Request
 	req.Request, err = http.NewRequest(method, transport.Server+url, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	req.Request = req.Request.WithContext(ctx)
 
 	req.Header.Set("User-Agent", "irmago")
 	if reader != nil {
@@ -108,6 +221,17 @@ func (transport *HTTPTransport) request(
 	for name, val := range transport.headers {
 		req.Header.Set(name, val)
 	}
+	if reader != nil && transport.upload != nil {
+		req.Body = &progressReader{ReadCloser: req.Body, total: req.ContentLength, report: transport.upload}
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
 
 	res, err := transport.client.Do(&req)
 	if err != nil {
@@ -116,7 +240,7 @@ func (transport *HTTPTransport) request(
 	return res, nil
 }
 
-func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
+func (transport *HTTPTransport) jsonRequest(ctx context.Context, url string, method string, result interface{}, object interface{}) error {
 	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
 	}
@@ -142,7 +266,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		Logger.Debugf("%s %s\n", method, url)
 	}
 
-	res, err := transport.request(url, method, reader, isstr)
+	res, err := transport.request(ctx, url, method, reader, isstr)
 	if err != nil {
 		return err
 	}
@@ -158,7 +282,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		apierr := &RemoteError{}
 		err = json.Unmarshal(body, apierr)
 		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
-			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode, Info: string(body)}
 		}
 		Logger.Debugf("ERROR: %+v\n", apierr)
 		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
@@ -177,12 +301,43 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 	return nil
 }
 
+// progressReader reports the amount of bytes read from the body of a request.
+type progressReader struct {
+	io.ReadCloser
+	sent, total int64
+	report      func(sent, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		r.report(r.sent, r.total)
+	}
+	return n, err
+}
+
+// GetBytes retrieves the specified resource. If the transport has an HTTPCache containing
+// validators for this resource, a conditional request is made, and the cached contents are
+// returned if the server reports that they have not been modified.
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
-	res, err := transport.request(url, http.MethodGet, nil, false)
+	var cached *httpCacheEntry
+	if transport.cache != nil {
+		if cached = transport.cache.get(transport.Server + url); cached != nil && cached.body == nil {
+			cached = nil
+		}
+	}
+
+	res, err := transport.conditionalRequest(context.Background(), url, http.MethodGet, nil, false, cached)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		Logger.Tracef("%s not modified, using cached version", transport.Server+url)
+		return cached.body, nil
+	}
 	if res.StatusCode != 200 {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
 	}
@@ -190,39 +345,101 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
+	if transport.cache != nil {
+		transport.cache.put(transport.Server+url, res, b)
+	}
 	return b, nil
 }
 
+// GetSignedFile downloads the specified resource to dest, checking that its SHA256 hash
+// equals the specified hash (if not nil). If the transport has an HTTPCache containing
+// validators for this resource and dest already exists, a conditional request is made,
+// leaving dest untouched if the server reports that the resource has not been modified.
 func (transport *HTTPTransport) GetSignedFile(url string, dest string, hash ConfigurationFileHash) error {
-	b, err := transport.GetBytes(url)
+	b, modified, err := transport.getFile(url, dest)
 	if err != nil {
 		return err
 	}
 	sha := sha256.Sum256(b)
 	if hash != nil && !bytes.Equal(hash, sha[:]) {
+		if !modified {
+			// Our local copy is outdated after all; try again without the cache
+			transport.cache.remove(transport.Server + url)
+			return transport.GetSignedFile(url, dest, hash)
+		}
 		return errors.Errorf("Signature over new file %s is not valid", dest)
 	}
+	if !modified {
+		return nil
+	}
 	if err = fs.EnsureDirectoryExists(filepath.Dir(dest)); err != nil {
 		return err
 	}
 	return fs.SaveFile(dest, b)
 }
 
+// getFile downloads the specified resource. If the server reports that the resource was not
+// modified since we last stored it at dest, the current contents of dest are returned instead,
+// along with false.
+func (transport *HTTPTransport) getFile(url string, dest string) ([]byte, bool, error) {
+	var cached *httpCacheEntry
+	if transport.cache != nil {
+		cached = transport.cache.get(transport.Server + url)
+		if cached != nil && cached.body != nil {
+			cached = nil
+		}
+		if exists, _ := fs.PathExists(dest); !exists {
+			cached = nil
+		}
+	}
+
+	res, err := transport.conditionalRequest(context.Background(), url, http.MethodGet, nil, false, cached)
+	if err != nil {
+		return nil, false, &SessionError{ErrorType: ErrorTransport, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		Logger.Tracef("%s not modified, keeping %s", transport.Server+url, dest)
+		local, err := ioutil.ReadFile(dest)
+		if err != nil {
+			return nil, false, err
+		}
+		return local, false, nil
+	}
+	if res.StatusCode != 200 {
+		return nil, false, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, false, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+	if transport.cache != nil {
+		transport.cache.put(transport.Server+url, res, nil)
+	}
+	return b, true, nil
+}
+
 func (transport *HTTPTransport) GetFile(url string, dest string) error {
 	return transport.GetSignedFile(url, dest, nil)
 }
 
 // Post sends the object to the server and parses its response into result.
 func (transport *HTTPTransport) Post(url string, result interface{}, object interface{}) error {
-	return transport.jsonRequest(url, http.MethodPost, result, object)
+	return transport.jsonRequest(context.Background(), url, http.MethodPost, result, object)
 }
 
 // Get performs a GET request and parses the server's response into result.
 func (transport *HTTPTransport) Get(url string, result interface{}) error {
-	return transport.jsonRequest(url, http.MethodGet, result, nil)
+	return transport.jsonRequest(context.Background(), url, http.MethodGet, result, nil)
 }
 
 // Delete performs a DELETE.
 func (transport *HTTPTransport) Delete() {
-	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
+	_ = transport.DeleteContext(context.Background())
+}
+
+// DeleteContext performs a DELETE, which is aborted when the context is done.
+func (transport *HTTPTransport) DeleteContext(ctx context.Context) error {
+	return transport.jsonRequest(ctx, "", http.MethodDelete, nil, nil)
 }
@@ -0,0 +1,369 @@
+package irma
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Updater periodically updates the schemes of a Configuration. Each scheme is updated
+// on its own schedule: after a succesful update the next update of that scheme happens
+// after Interval, and after a failed update it is retried with exponential backoff
+// (starting at MinBackoff, capped at MaxBackoff). All delays are randomized by Jitter
+// to avoid many servers contacting the scheme servers at the same moment.
+//
+// An Updater can be stopped and started again; the per-scheme state (including
+// the time of the last succesful update) is retained, so that a restarted Updater
+// resumes the schedule where it left off instead of updating all schemes at once.
+//
+// While the network is unreachable (see SetNetworkReachable()), updates that become due are
+// postponed without counting as failures, until the network is reachable again.
+type Updater struct {
+	// Interval between two succesful updates of a scheme
+	Interval time.Duration
+	// Jitter is the fraction (between 0 and 1) by which each delay is randomly lengthened or shortened
+	Jitter float64
+	// MinBackoff is the delay before the first retry after a failed update;
+	// it is doubled after each subsequent failure until it reaches MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	conf     *Configuration
+	mutex    sync.Mutex // protects schemes, offline and stop
+	updating sync.Mutex // ensures that only one update runs at a time
+	schemes  map[SchemeManagerIdentifier]*SchemeUpdateStatus
+	offline  bool
+	stop     chan struct{}
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// SchemeUpdateStatus contains the state of the Updater for a single scheme.
+type SchemeUpdateStatus struct {
+	LastAttempt time.Time
+	LastSuccess time.Time
+	NextAttempt time.Time
+	Failures    int
+	LastError   error
+}
+
+const (
+	// Delay before the first update of a scheme that has not been updated before
+	updaterInitialDelay = 200 * time.Millisecond
+
+	DefaultUpdaterJitter     = 0.1
+	DefaultUpdaterMinBackoff = time.Minute
+)
+
+// NewUpdater returns a new (not yet started) Updater for the specified configuration,
+// updating each scheme every interval.
+func NewUpdater(conf *Configuration, interval time.Duration) *Updater {
+	return &Updater{
+		Interval:   interval,
+		Jitter:     DefaultUpdaterJitter,
+		MinBackoff: DefaultUpdaterMinBackoff,
+		MaxBackoff: interval,
+		conf:       conf,
+		schemes:    map[SchemeManagerIdentifier]*SchemeUpdateStatus{},
+	}
+}
+
+// Start starts updating schemes in the background. It has no effect if the Updater
+// is already running.
+func (u *Updater) Start() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.stop != nil {
+		return
+	}
+	Logger.Infof("Updating schemes every %s", u.Interval)
+	u.stop = make(chan struct{})
+	u.wake = make(chan struct{}, 1)
+	u.done = make(chan struct{})
+	go u.run(u.stop, u.wake, u.done)
+}
+
+// Stop stops the Updater, waiting for a running update (if any) to finish.
+func (u *Updater) Stop() {
+	u.mutex.Lock()
+	if u.stop == nil {
+		u.mutex.Unlock()
+		return
+	}
+	close(u.stop)
+	done := u.done
+	u.stop, u.wake, u.done = nil, nil, nil
+	u.mutex.Unlock()
+
+	<-done
+	Logger.Info("Stopped scheme autoupdater")
+}
+
+// Running returns whether or not the Updater has been started.
+func (u *Updater) Running() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.stop != nil
+}
+
+// ForceUpdate immediately updates the specified scheme, regardless of its schedule.
+func (u *Updater) ForceUpdate(id SchemeManagerIdentifier) error {
+	if !u.installed(id) {
+		return configurationError(ErrSchemeNotInstalled, nil, fmt.Sprintf("Cannot update unknown scheme manager %s", id))
+	}
+	err := u.update(id)
+
+	// The schedule of the scheme has changed, let the background goroutine know
+	u.mutex.Lock()
+	if u.wake != nil {
+		select {
+		case u.wake <- struct{}{}:
+		default:
+		}
+	}
+	u.mutex.Unlock()
+
+	return err
+}
+
+// SetNetworkReachable informs the Updater whether or not the network is reachable. When it becomes
+// reachable again, the updates that were postponed while it was unreachable are performed.
+func (u *Updater) SetNetworkReachable(reachable bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.offline == !reachable {
+		return
+	}
+	u.offline = !reachable
+	if reachable && u.wake != nil {
+		select {
+		case u.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (u *Updater) reachable() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return !u.offline
+}
+
+// Expedite schedules an update of the specified scheme as soon as possible, unless an update of
+// the scheme was attempted less than MinBackoff ago. It has no effect if the Updater is not running.
+func (u *Updater) Expedite(id SchemeManagerIdentifier) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.stop == nil {
+		return
+	}
+	status, ok := u.schemes[id]
+	if !ok {
+		return // schemes are updated shortly after the Updater first sees them anyway
+	}
+	now := time.Now()
+	if now.Sub(status.LastAttempt) < u.MinBackoff || !status.NextAttempt.After(now) {
+		return
+	}
+	status.NextAttempt = now
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns (a copy of) the update state of the specified scheme,
+// or nil if the Updater has not yet seen the scheme.
+func (u *Updater) Status(id SchemeManagerIdentifier) *SchemeUpdateStatus {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	status, ok := u.schemes[id]
+	if !ok {
+		return nil
+	}
+	cpy := *status
+	return &cpy
+}
+
+// LastSuccess returns the time of the last succesful update of each scheme.
+func (u *Updater) LastSuccess() map[SchemeManagerIdentifier]time.Time {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	times := make(map[SchemeManagerIdentifier]time.Time, len(u.schemes))
+	for id, status := range u.schemes {
+		times[id] = status.LastSuccess
+	}
+	return times
+}
+
+func (u *Updater) run(stop, wake, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(u.schedule())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		case <-timer.C:
+			for _, id := range u.due() {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !u.reachable() {
+					break // postpone the remaining updates until the network is reachable
+				}
+				_ = u.update(id)
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if u.reachable() {
+			timer.Reset(u.schedule())
+		} // otherwise wait until SetNetworkReachable() wakes us
+	}
+}
+
+// schedule registers any schemes that the Updater has not yet seen,
+// and returns the time until the next scheme has to be updated.
+func (u *Updater) schedule() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+	var next time.Time
+	for _, id := range u.installedSchemes() {
+		status, ok := u.schemes[id]
+		if !ok {
+			status = &SchemeUpdateStatus{NextAttempt: now.Add(u.jitter(updaterInitialDelay))}
+			u.schemes[id] = status
+		}
+		if next.IsZero() || status.NextAttempt.Before(next) {
+			next = status.NextAttempt
+		}
+	}
+
+	if next.IsZero() {
+		return u.Interval // no schemes; check again later
+	}
+	if d := next.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// due returns the schemes whose next update is scheduled now or in the past.
+func (u *Updater) due() []SchemeManagerIdentifier {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+	var ids []SchemeManagerIdentifier
+	for id, status := range u.schemes {
+		if !u.installed(id) {
+			delete(u.schemes, id) // scheme has been removed in the meantime
+			continue
+		}
+		if !status.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// installedSchemes returns the schemes currently present in the configuration. As the
+// configuration may concurrently be reparsed, its maps are only read under its lock.
+func (u *Updater) installedSchemes() []SchemeManagerIdentifier {
+	u.conf.mutex.RLock()
+	defer u.conf.mutex.RUnlock()
+	ids := make([]SchemeManagerIdentifier, 0, len(u.conf.SchemeManagers))
+	for id := range u.conf.SchemeManagers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// installed returns whether the specified scheme is present in the configuration.
+func (u *Updater) installed(id SchemeManagerIdentifier) bool {
+	u.conf.mutex.RLock()
+	defer u.conf.mutex.RUnlock()
+	_, ok := u.conf.SchemeManagers[id]
+	return ok
+}
+
+func (u *Updater) update(id SchemeManagerIdentifier) error {
+	u.updating.Lock()
+	defer u.updating.Unlock()
+
+	Logger.WithField("scheme", id).Info("Auto-updating scheme")
+	started := time.Now()
+	err := u.conf.UpdateScheme(id)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	status, ok := u.schemes[id]
+	if !ok {
+		status = &SchemeUpdateStatus{}
+		u.schemes[id] = status
+	}
+	status.LastAttempt = started
+	status.LastError = err
+	if err == nil {
+		status.LastSuccess = started
+		status.Failures = 0
+		status.NextAttempt = time.Now().Add(u.jitter(u.Interval))
+		return nil
+	}
+
+	status.Failures++
+	status.NextAttempt = time.Now().Add(u.jitter(u.backoff(status.Failures)))
+	Logger.Errorf("Scheme autoupdater failed to update %s (attempt %d, retrying at %s): ",
+		id, status.Failures, status.NextAttempt.Format(time.RFC3339))
+	if e, ok := err.(*errors.Error); ok {
+		Logger.Error(e.ErrorStack())
+	} else {
+		Logger.Errorf("%s %s", reflect.TypeOf(err).String(), err.Error())
+	}
+	return err
+}
+
+// backoff returns the delay before the next attempt after the specified amount of
+// consecutive failures.
+func (u *Updater) backoff(failures int) time.Duration {
+	max := u.MaxBackoff
+	if max <= 0 || (u.Interval > 0 && max > u.Interval) {
+		max = u.Interval
+	}
+	d := u.MinBackoff
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// jitter randomly lengthens or shortens d by at most a fraction u.Jitter of d.
+func (u *Updater) jitter(d time.Duration) time.Duration {
+	if u.Jitter <= 0 {
+		return d
+	}
+	j := u.Jitter
+	if j > 1 {
+		j = 1
+	}
+	return d + time.Duration(float64(d)*j*(2*rand.Float64()-1))
+}
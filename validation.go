@@ -0,0 +1,148 @@
+package irma
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationSeverity indicates how serious a problem found in the Configuration is.
+type ValidationSeverity int
+
+// ValidationCode is a machine-readable code identifying a problem found in the Configuration.
+type ValidationCode string
+
+// ValidationEntry is a single problem found in the Configuration.
+type ValidationEntry struct {
+	Severity   ValidationSeverity `json:"severity"`
+	Code       ValidationCode     `json:"code"`
+	Identifier string             `json:"identifier,omitempty"` // scheme, issuer, credential type or file concerned
+	Message    string             `json:"message"`
+}
+
+// ValidationReport contains all problems found in the Configuration.
+type ValidationReport struct {
+	Entries []*ValidationEntry `json:"entries"`
+}
+
+const (
+	SeverityInfo ValidationSeverity = iota
+	SeverityWarning
+	SeverityError
+)
+
+const (
+	ValidationIgnoredFile           = ValidationCode("IGNORED_FILE")
+	ValidationIgnoredDir            = ValidationCode("IGNORED_DIR")
+	ValidationMissingTranslation    = ValidationCode("MISSING_TRANSLATION")
+	ValidationMissingLogo           = ValidationCode("MISSING_LOGO")
+	ValidationNoPublicKeys          = ValidationCode("NO_PUBLIC_KEYS")
+	ValidationNoCredentialTypes     = ValidationCode("NO_CREDENTIAL_TYPES")
+	ValidationInvalidDisplayIndex   = ValidationCode("INVALID_DISPLAY_INDEX")
+	ValidationInvalidAttributeOrder = ValidationCode("INVALID_ATTRIBUTE_ORDER")
+	ValidationNoValidPublicKeys     = ValidationCode("NO_VALID_PUBLIC_KEYS")
+	ValidationPublicKeyExpiresSoon  = ValidationCode("PUBLIC_KEY_EXPIRES_SOON")
+	ValidationInvalidKeys           = ValidationCode("INVALID_KEYS")
+	ValidationDisabledScheme        = ValidationCode("DISABLED_SCHEME")
+	ValidationUnknownDependency     = ValidationCode("UNKNOWN_DEPENDENCY")
+	ValidationDependencyCycle       = ValidationCode("DEPENDENCY_CYCLE")
+	ValidationInvalidContents       = ValidationCode("INVALID_CONTENTS")
+	ValidationInvalidSubScheme      = ValidationCode("INVALID_SUB_SCHEME")
+)
+
+func (s ValidationSeverity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+func (s ValidationSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ValidationSeverity) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "info":
+		*s = SeverityInfo
+	case "warning":
+		*s = SeverityWarning
+	case "error":
+		*s = SeverityError
+	default:
+		return fmt.Errorf("unknown severity %s", string(text))
+	}
+	return nil
+}
+
+func (entry *ValidationEntry) String() string {
+	return fmt.Sprintf("%s: %s (%s)", strings.Title(entry.Severity.String()), entry.Message, entry.Code)
+}
+
+// Add adds an entry to the report.
+func (report *ValidationReport) Add(severity ValidationSeverity, code ValidationCode, identifier, message string) {
+	report.Entries = append(report.Entries, &ValidationEntry{
+		Severity:   severity,
+		Code:       code,
+		Identifier: identifier,
+		Message:    message,
+	})
+}
+
+// Filter returns a report containing only the entries whose severity is at least the specified severity.
+func (report *ValidationReport) Filter(min ValidationSeverity) *ValidationReport {
+	filtered := &ValidationReport{Entries: []*ValidationEntry{}}
+	for _, entry := range report.Entries {
+		if entry.Severity >= min {
+			filtered.Entries = append(filtered.Entries, entry)
+		}
+	}
+	return filtered
+}
+
+// HasErrors returns whether the report contains any entry of severity SeverityError.
+func (report *ValidationReport) HasErrors() bool {
+	return len(report.Filter(SeverityError).Entries) > 0
+}
+
+// Validate returns a report of all problems encountered while parsing the Configuration,
+// of scheme managers that failed to parse, and of problems with the public and private keys.
+func (conf *Configuration) Validate() *ValidationReport {
+	conf.mutex.RLock()
+	report := &ValidationReport{Entries: append([]*ValidationEntry{}, conf.validation...)}
+	for id, err := range conf.DisabledSchemeManagers {
+		report.Add(SeverityError, ValidationDisabledScheme, id.String(), err.Error())
+	}
+	LintDependencies(report, nil, conf.CredentialTypes)
+	conf.mutex.RUnlock()
+
+	if err := conf.checkKeys(report); err != nil {
+		report.Add(SeverityError, ValidationInvalidKeys, "", err.Error())
+	}
+	return report
+}
+
+// warnAll records all entries of the specified report using warn().
+func (conf *Configuration) warnAll(report *ValidationReport) {
+	for _, entry := range report.Entries {
+		conf.warn(entry.Severity, entry.Code, entry.Identifier, "%s", entry.Message)
+	}
+}
+
+// warn records a problem found while parsing the Configuration, both as a ValidationEntry
+// (returned by Validate()) and as a string in conf.Warnings.
+func (conf *Configuration) warn(severity ValidationSeverity, code ValidationCode, identifier, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	conf.validation = append(conf.validation, &ValidationEntry{
+		Severity:   severity,
+		Code:       code,
+		Identifier: identifier,
+		Message:    message,
+	})
+	conf.Warnings = append(conf.Warnings, message)
+}
@@ -0,0 +1,79 @@
+package irma
+
+import (
+	"github.com/privacybydesign/gabi"
+)
+
+// VerifierConfiguration contains the part of a Configuration needed for verifying disclosures and
+// attribute-based signatures: the schemes, issuers, credential types and public keys. It is meant
+// for servers that only verify, which do not need private keys or writable storage.
+//
+// A VerifierConfiguration is parsed once by NewVerifierConfiguration(), and then only read. Contrary
+// to a Configuration, it has no methods that write to disk, download or update schemes, or read
+// private keys, so that its users are guaranteed at compile time not to do so.
+type VerifierConfiguration struct {
+	conf *Configuration
+}
+
+// NewVerifierConfiguration parses the schemes in the specified path, which is not written to,
+// into a new VerifierConfiguration.
+func NewVerifierConfiguration(path string) (*VerifierConfiguration, error) {
+	conf, err := NewConfigurationReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	// We never download anything or hand out private keys
+	conf.httpCache = nil
+	conf.trackedKeys = nil
+	if err = conf.ParseFolder(); err != nil {
+		return nil, err
+	}
+	// The validation entries are only of interest when linting schemes
+	conf.validation = nil
+	return &VerifierConfiguration{conf: conf}, nil
+}
+
+// SchemeManager returns the specified scheme, or nil if it is unknown.
+func (vc *VerifierConfiguration) SchemeManager(id SchemeManagerIdentifier) *SchemeManager {
+	return vc.conf.SchemeManagers[id]
+}
+
+// Issuer returns the specified issuer, or nil if it is unknown.
+func (vc *VerifierConfiguration) Issuer(id IssuerIdentifier) *Issuer {
+	return vc.conf.Issuers[id]
+}
+
+// CredentialType returns the specified credential type, or nil if it is unknown.
+func (vc *VerifierConfiguration) CredentialType(id CredentialTypeIdentifier) *CredentialType {
+	return vc.conf.CredentialTypes[id]
+}
+
+// AttributeType returns the specified attribute type, or nil if it is unknown.
+func (vc *VerifierConfiguration) AttributeType(id AttributeTypeIdentifier) *AttributeType {
+	return vc.conf.AttributeTypes[id]
+}
+
+// PublicKey returns the specified public key, or nil if not present.
+func (vc *VerifierConfiguration) PublicKey(id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	return vc.conf.PublicKey(id, counter)
+}
+
+// Warnings returns the warnings encountered while parsing the schemes.
+func (vc *VerifierConfiguration) Warnings() []string {
+	return append([]string{}, vc.conf.Warnings...)
+}
+
+// VerifyDisclosure verifies the disclosure against the request (see Disclosure.Verify()).
+func (vc *VerifierConfiguration) VerifyDisclosure(
+	disclosure *Disclosure, request *DisclosureRequest,
+) ([]*DisclosedAttribute, ProofStatus, error) {
+	return disclosure.Verify(vc.conf, request)
+}
+
+// VerifySignature verifies the attribute-based signature against the request, which may be nil
+// (see SignedMessage.Verify()).
+func (vc *VerifierConfiguration) VerifySignature(
+	signature *SignedMessage, request *SignatureRequest,
+) ([]*DisclosedAttribute, ProofStatus, error) {
+	return signature.Verify(vc.conf, request)
+}
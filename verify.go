@@ -2,6 +2,7 @@ package irma
 
 import (
 	"crypto/rsa"
+	"fmt"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -36,6 +37,8 @@ type DisclosedAttribute struct {
 	Value      TranslatedString        `json:"value"` // Value of the disclosed attribute
 	Identifier AttributeTypeIdentifier `json:"id"`
 	Status     AttributeProofStatus    `json:"status"`
+	// Label of the disjunction of the request that this attribute satisfies (or should have satisfied), if any
+	Label TranslatedString `json:"label,omitempty"`
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
@@ -43,6 +46,81 @@ type ProofList gabi.ProofList
 
 var ErrorMissingPublicKey = errors.New("Missing public key")
 
+// CredentialTypeProblem classifies a CredentialTypeError.
+type CredentialTypeProblem string
+
+const (
+	CredentialTypeUnknown    = CredentialTypeProblem("UNKNOWN")     // No credential type in the configuration has the hash in the metadata attribute of the proof
+	CredentialTypeMismatch   = CredentialTypeProblem("MISMATCH")    // Proof discloses attributes that the credential type does not have, e.g. because the configuration is outdated
+	CredentialTypeNoMetadata = CredentialTypeProblem("NO_METADATA") // Proof does not disclose its metadata attribute
+)
+
+// CredentialTypeError indicates that a disclosure proof cannot be verified because its credential
+// type is unknown, or does not match the proof.
+type CredentialTypeError struct {
+	Problem        CredentialTypeProblem
+	Proof          int                      // Index of the proof within its proof list
+	CredentialType CredentialTypeIdentifier // Empty if the credential type is unknown
+	Hash           []byte                   // Credential type hash in the metadata attribute, if present
+}
+
+func (e *CredentialTypeError) Error() string {
+	switch e.Problem {
+	case CredentialTypeUnknown:
+		return fmt.Sprintf("proof %d is of an unknown credential type (hash %x)", e.Proof, e.Hash)
+	case CredentialTypeMismatch:
+		return fmt.Sprintf("proof %d discloses attributes that credential type %s does not have", e.Proof, e.CredentialType)
+	default:
+		return fmt.Sprintf("proof %d does not disclose its metadata attribute", e.Proof)
+	}
+}
+
+// checkCredentialTypes checks that each of the disclosure proofs discloses its metadata attribute,
+// and that its credential type is known and has all of the disclosed attributes. Otherwise it
+// returns a *CredentialTypeError, expediting the update of the schemes concerned if configured.
+func (pl ProofList) checkCredentialTypes(configuration *Configuration) error {
+	for i, proof := range pl {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			continue
+		}
+		if proofd.ADisclosed[1] == nil { // index 1 is metadata attribute
+			return configuration.credentialTypeError(&CredentialTypeError{Problem: CredentialTypeNoMetadata, Proof: i})
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration)
+		credtype := metadata.CredentialType()
+		if credtype == nil {
+			return configuration.credentialTypeError(&CredentialTypeError{
+				Problem: CredentialTypeUnknown, Proof: i, Hash: metadata.CredentialTypeHash(),
+			})
+		}
+		for index := range proofd.ADisclosed {
+			if index < 0 || index > len(credtype.AttributeTypes)+1 {
+				return configuration.credentialTypeError(&CredentialTypeError{
+					Problem: CredentialTypeMismatch, Proof: i, CredentialType: credtype.Identifier(), Hash: metadata.CredentialTypeHash(),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// credentialTypeError returns err, after expediting the update of the scheme of its credential
+// type (or of all schemes if the credential type is unknown) if UpdateOnCredentialTypeError is set.
+func (conf *Configuration) credentialTypeError(err *CredentialTypeError) error {
+	if !conf.UpdateOnCredentialTypeError || conf.updater == nil || err.Problem == CredentialTypeNoMetadata {
+		return err
+	}
+	if err.Problem == CredentialTypeMismatch {
+		conf.updater.Expedite(err.CredentialType.IssuerIdentifier().SchemeManagerIdentifier())
+		return err
+	}
+	for id := range conf.SchemeManagers {
+		conf.updater.Expedite(id)
+	}
+	return err
+}
+
 // ExtractPublicKeys returns the public keys of each proof in the proofList, in the same order,
 // for later use in verification of the proofList. If one of the proofs is not a ProofD
 // an error is returned.
@@ -71,6 +149,9 @@ func (pl ProofList) ExtractPublicKeys(configuration *Configuration) ([]*gabi.Pub
 
 // VerifyProofs verifies the proofs cryptographically.
 func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int, nonce *big.Int, publickeys []*gabi.PublicKey, isSig bool) (bool, error) {
+	if err := pl.checkCredentialTypes(configuration); err != nil {
+		return false, err
+	}
 	if publickeys == nil {
 		var err error
 		publickeys, err = pl.ExtractPublicKeys(configuration)
@@ -87,6 +168,9 @@ func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int,
 	keyshareServers := make([]string, len(pl))
 	for i := range pl {
 		schemeID := NewIssuerIdentifier(publickeys[i].Issuer).SchemeManagerIdentifier()
+		if !configuration.EnvironmentAllowed(schemeID) {
+			return false, errors.Errorf("Proof of scheme %s, whose environment is not allowed", schemeID)
+		}
 		if !configuration.SchemeManagers[schemeID].Distributed() {
 			keyshareServers[i] = "." // dummy value: no IRMA scheme will ever have this name
 		} else {
@@ -97,11 +181,11 @@ func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int,
 	return gabi.ProofList(pl).Verify(publickeys, context, nonce, isSig, keyshareServers), nil
 }
 
-// Expired returns true if any of the contained disclosure proofs is specified at the specified time,
-// or now, when the specified time is nil.
+// Expired returns true if any of the contained disclosure proofs is expired at the specified time,
+// or now, when the specified time is nil, taking into account the ExpiryGracePeriod of the configuration.
 func (pl ProofList) Expired(configuration *Configuration, t *time.Time) bool {
 	if t == nil {
-		temp := time.Now()
+		temp := Now()
 		t = &temp
 	}
 	for _, proof := range pl {
@@ -110,7 +194,7 @@ func (pl ProofList) Expired(configuration *Configuration, t *time.Time) bool {
 			continue
 		}
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
-		if metadata.Expiry().Before(*t) {
+		if metadata.ExpiredAt(*t, configuration.ExpiryGracePeriod) {
 			return true
 		}
 	}
@@ -126,6 +210,9 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 	if d.Indices == nil || len(disjunctions) == 0 {
 		return ProofList(d.Proofs).DisclosedAttributes(configuration, disjunctions)
 	}
+	if err := ProofList(d.Proofs).checkCredentialTypes(configuration); err != nil {
+		return false, nil, err
+	}
 
 	list := make([]*DisclosedAttribute, len(disjunctions))
 	usedAttrs := map[int]map[int]struct{}{} // keep track of attributes that satisfy the disjunctions
@@ -133,7 +220,13 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 	// For each of the disjunctions, lookup the attribute that the user sent to satisfy this disjunction,
 	// using the indices specified by the user in d.Indices. Then see if the attribute satisfies the disjunction.
 	for i, disjunction := range disjunctions {
+		if i >= len(d.Indices) || len(d.Indices[i]) == 0 {
+			return false, nil, errors.New("Disclosure does not specify which attribute satisfies each disjunction")
+		}
 		index := d.Indices[i][0]
+		if index.CredentialIndex < 0 || index.CredentialIndex >= len(d.Proofs) {
+			return false, nil, errors.New("Disclosure index refers to nonexisting proof")
+		}
 		proofd, ok := d.Proofs[index.CredentialIndex].(*gabi.ProofD)
 		if !ok {
 			// If with the index the user told us to look for the required attribute at this specific location,
@@ -141,6 +234,9 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 			return false, nil, errors.New("ProofList contained proof of invalid type")
 		}
 
+		if index.AttributeIndex < 1 || proofd.ADisclosed[index.AttributeIndex] == nil {
+			return false, nil, errors.New("Disclosure index refers to undisclosed attribute")
+		}
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
 		attr, attrval, err := parseAttribute(index.AttributeIndex, metadata, proofd.ADisclosed[index.AttributeIndex])
 		if err != nil {
@@ -161,6 +257,7 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 		} else {
 			list[i] = &DisclosedAttribute{Status: AttributeProofStatusMissing}
 		}
+		list[i].Label = disjunction.Label
 	}
 
 	// Loop over any extra attributes in d.Proofs not requested in any of the disjunctions
@@ -213,6 +310,10 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 }
 
 func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctions AttributeDisjunctionList) (bool, []*DisclosedAttribute, error) {
+	if err := pl.checkCredentialTypes(configuration); err != nil {
+		return false, nil, err
+	}
+
 	var list []*DisclosedAttribute
 	list = make([]*DisclosedAttribute, len(disjunctions))
 	for i := range list {
@@ -220,6 +321,7 @@ func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctio
 		// is found below, the corresponding entry in the list is overwritten
 		list[i] = &DisclosedAttribute{
 			Status: AttributeProofStatusMissing,
+			Label:  disjunctions[i].Label,
 		}
 	}
 
@@ -260,6 +362,7 @@ func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctio
 					} else {
 						attr.Status = AttributeProofStatusInvalidValue
 					}
+					attr.Label = disjunction.Label
 					list[i] = attr
 					delete(extraAttrs, attr.Identifier)
 				}
@@ -304,12 +407,16 @@ func (d *Disclosure) VerifyAgainstDisjunctions(
 }
 
 func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
+	return d.verify(configuration, request, Now())
+}
+
+// verify verifies the disclosure as if the current time is now.
+func (d *Disclosure) verify(configuration *Configuration, request *DisclosureRequest, now time.Time) ([]*DisclosedAttribute, ProofStatus, error) {
 	list, status, err := d.VerifyAgainstDisjunctions(configuration, request.Content, request.Context, request.Nonce, nil, false)
 	if err != nil {
 		return list, status, err
 	}
 
-	now := time.Now()
 	if expired := ProofList(d.Proofs).Expired(configuration, &now); expired {
 		return list, ProofStatusExpired, nil
 	}
@@ -327,6 +434,12 @@ func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureReq
 // The signature request is optional; if it is nil then the attribute-based signature is still verified, and all
 // containing attributes returned in the result.
 func (sm *SignedMessage) Verify(configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
+	return sm.verify(configuration, request, Now())
+}
+
+// verify verifies the attribute-based signature as if the current time is now. If the signature
+// has a timestamp, then the time of the timestamp is used instead.
+func (sm *SignedMessage) verify(configuration *Configuration, request *SignatureRequest, now time.Time) ([]*DisclosedAttribute, ProofStatus, error) {
 	var message string
 
 	// First check if this signature matches the request
@@ -353,7 +466,7 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 	}
 
 	// Next, verify the timestamp
-	t := time.Now()
+	t := now
 	if sm.Timestamp != nil {
 		if err := sm.VerifyTimestamp(message, configuration); err != nil {
 			return nil, ProofStatusInvalidTimestamp, nil
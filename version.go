@@ -0,0 +1,57 @@
+package irma
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Version of irmago. Schemes can require a minimum version of irmago to be used (see
+// SchemeAppVersion), e.g. because they use cryptographic features that older versions lack.
+const Version = "0.1.1"
+
+// parseVersion parses a version of the form "major.minor.patch", in which the minor and patch
+// numbers may be omitted.
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.Split(version, ".")
+	if len(parts) > len(parsed) {
+		return parsed, errors.Errorf("Invalid version %s", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, errors.Errorf("Invalid version %s", version)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// VersionAtLeast returns whether the specified version is not older than the specified minimum.
+func VersionAtLeast(version, minimum string) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	m, err := parseVersion(minimum)
+	if err != nil {
+		return false, err
+	}
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] > m[i], nil
+		}
+	}
+	return true, nil
+}
+
+// RequiresUpdate returns whether the scheme requires a newer version of irmago than this one.
+func (sm *SchemeManager) RequiresUpdate() bool {
+	if sm.MinimumAppVersion.Irmago == "" {
+		return false
+	}
+	ok, err := VersionAtLeast(Version, sm.MinimumAppVersion.Irmago)
+	return err != nil || !ok
+}